@@ -0,0 +1,202 @@
+package blame
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/store"
+)
+
+// A Line is the authorship information for a single line of a file.
+type Line struct {
+	// Author is the email address of the line's author.
+	Author string
+
+	// CommitID is the ID of the commit that last modified the line.
+	CommitID string
+
+	// AuthorTime is the time (in seconds since the Unix epoch) that
+	// CommitID was authored.
+	AuthorTime int64
+}
+
+// File returns the authorship information for each line of file (a
+// path relative to dir, which must be in a git repository) as of
+// commitID. The i'th element of the returned slice describes the
+// (i+1)'th line of the file.
+func File(dir, commitID, file string) ([]Line, error) {
+	out, err := git(dir, "blame", "--porcelain", commitID, "--", file)
+	if err != nil {
+		return nil, err
+	}
+	return parsePorcelain(bytes.NewReader(out))
+}
+
+// Source returns the content of file (a path relative to dir, which
+// must be in a git repository) as of commitID. Use it (not the file in
+// the working tree, which may be modified or at another commit) as the
+// src of AnnotateDefs, so that defs' byte offsets refer to the same
+// lines that File blamed. If file doesn't exist at commitID, Source
+// returns an error for which os.IsNotExist is true.
+func Source(dir, commitID, file string) ([]byte, error) {
+	out, err := git(dir, "ls-tree", "--name-only", commitID, "--", file)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(out)) == 0 {
+		return nil, &os.PathError{Op: "git show " + commitID, Path: file, Err: os.ErrNotExist}
+	}
+	return git(dir, "show", commitID+":./"+file)
+}
+
+// git runs git with args in dir and returns its output.
+func git(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s failed: %s (stderr: %s)", strings.Join(args, " "), err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return out, nil
+}
+
+// parsePorcelain parses the output of `git blame --porcelain`.
+func parsePorcelain(r io.Reader) ([]Line, error) {
+	var (
+		lines   []Line
+		commits = map[string]*Line{}
+		cur     *Line
+		curLine int
+	)
+	br := bufio.NewReader(r)
+	for {
+		text, err := br.ReadString('\n')
+		if err == io.EOF && text == "" {
+			break
+		} else if err != nil && err != io.EOF {
+			return nil, err
+		}
+		text = strings.TrimSuffix(text, "\n")
+		if strings.HasPrefix(text, "\t") {
+			// The line's content ends each entry.
+			if cur == nil {
+				return nil, fmt.Errorf("git blame: line content without header")
+			}
+			for len(lines) < curLine {
+				lines = append(lines, Line{})
+			}
+			lines[curLine-1] = *cur
+			cur = nil
+			continue
+		}
+
+		if cur == nil {
+			// Header: "<commit> <orig line> <final line> [<num lines>]".
+			fields := strings.Fields(text)
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("git blame: bad header %q", text)
+			}
+			n, err := strconv.Atoi(fields[2])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("git blame: bad line number in header %q", text)
+			}
+			curLine = n
+			cur = commits[fields[0]]
+			if cur == nil {
+				cur = &Line{CommitID: fields[0]}
+				commits[fields[0]] = cur
+			}
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(text, "author-mail "):
+			cur.Author = strings.Trim(strings.TrimPrefix(text, "author-mail "), "<>")
+		case strings.HasPrefix(text, "author-time "):
+			t, err := strconv.ParseInt(strings.TrimPrefix(text, "author-time "), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("git blame: bad author-time %q", text)
+			}
+			cur.AuthorTime = t
+		}
+	}
+	return lines, nil
+}
+
+// AnnotateDefs sets the Author and AuthorCommitID fields of each def
+// in defs that is defined in a file whose contents are src and whose
+// per-line authorship information is lines. The Author is the person
+// who authored the most lines of the def (ties are broken by the most
+// recent authorship), and AuthorCommitID is the most recent commit in
+// which they modified the def.
+//
+// It returns the number of defs that were annotated. Defs with empty
+// spans or spans outside of lines are left unchanged.
+func AnnotateDefs(defs []*graph.Def, src []byte, lines []Line) int {
+	lt := store.NewLineTable(src)
+
+	var n int
+	for _, def := range defs {
+		if def.DefEnd <= def.DefStart {
+			continue
+		}
+		start, err := lt.Position(def.DefStart)
+		if err != nil {
+			continue
+		}
+		end, err := lt.Position(def.DefEnd - 1)
+		if err != nil {
+			continue
+		}
+		if end.Line > len(lines) {
+			continue
+		}
+
+		type authorStats struct {
+			lines  int
+			latest Line
+		}
+		byAuthor := map[string]*authorStats{}
+		for _, l := range lines[start.Line-1 : end.Line] {
+			if l.Author == "" {
+				continue
+			}
+			st := byAuthor[l.Author]
+			if st == nil {
+				st = &authorStats{}
+				byAuthor[l.Author] = st
+			}
+			st.lines++
+			if l.AuthorTime >= st.latest.AuthorTime {
+				st.latest = l
+			}
+		}
+		var (
+			best      string
+			bestStats *authorStats
+		)
+		for a, st := range byAuthor {
+			if bestStats == nil || st.lines > bestStats.lines ||
+				(st.lines == bestStats.lines && (st.latest.AuthorTime > bestStats.latest.AuthorTime ||
+					(st.latest.AuthorTime == bestStats.latest.AuthorTime && a < best))) {
+				best, bestStats = a, st
+			}
+		}
+		if bestStats == nil {
+			continue
+		}
+		def.Author = best
+		def.AuthorCommitID = bestStats.latest.CommitID
+		n++
+	}
+	return n
+}
@@ -0,0 +1,101 @@
+package blame
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/internal/gittest"
+)
+
+const c1, c2 = "1111111111111111111111111111111111111111", "2222222222222222222222222222222222222222"
+
+var porcelain = c1 + ` 1 1 2
+author Alice
+author-mail <alice@example.com>
+author-time 100
+author-tz +0000
+summary first
+filename f.go
+	package f
+` + c1 + ` 2 2
+	
+` + c2 + ` 3 3 1
+author Bob
+author-mail <bob@example.com>
+author-time 200
+author-tz +0000
+summary second
+previous ` + c1 + ` f.go
+filename f.go
+	func A() {}
+`
+
+func TestParsePorcelain(t *testing.T) {
+	lines, err := parsePorcelain(strings.NewReader(porcelain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Line{
+		{Author: "alice@example.com", CommitID: c1, AuthorTime: 100},
+		{Author: "alice@example.com", CommitID: c1, AuthorTime: 100},
+		{Author: "bob@example.com", CommitID: c2, AuthorTime: 200},
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("got %+v, want %+v", lines, want)
+	}
+}
+
+func TestAnnotateDefs(t *testing.T) {
+	src := []byte("a\nb\nc\nd\n")
+	lines := []Line{
+		{Author: "a@example.com", CommitID: "c1", AuthorTime: 1},
+		{Author: "b@example.com", CommitID: "c2", AuthorTime: 2},
+		{Author: "a@example.com", CommitID: "c3", AuthorTime: 3},
+		{Author: "b@example.com", CommitID: "c4", AuthorTime: 4},
+	}
+	defs := []*graph.Def{
+		{DefKey: graph.DefKey{Path: "lines1-3"}, DefStart: 0, DefEnd: 5},
+		{DefKey: graph.DefKey{Path: "line2"}, DefStart: 2, DefEnd: 3},
+		{DefKey: graph.DefKey{Path: "lines1-4 (tie)"}, DefStart: 0, DefEnd: 8},
+		{DefKey: graph.DefKey{Path: "empty"}, DefStart: 4, DefEnd: 4},
+	}
+	if n := AnnotateDefs(defs, src, lines); n != 3 {
+		t.Errorf("got %d defs annotated, want 3", n)
+	}
+
+	want := []struct{ author, commitID string }{
+		{"a@example.com", "c3"},
+		{"b@example.com", "c2"},
+		{"b@example.com", "c4"},
+		{"", ""},
+	}
+	for i, def := range defs {
+		if def.Author != want[i].author || def.AuthorCommitID != want[i].commitID {
+			t.Errorf("%s: got author %q commit %q, want %q %q", def.Path, def.Author, def.AuthorCommitID, want[i].author, want[i].commitID)
+		}
+	}
+}
+
+func TestSource(t *testing.T) {
+	repo := gittest.New(t)
+	defer repo.Remove()
+	repo.WriteFile("d/f.go", "package f\n")
+	commitID := repo.Commit("c")
+
+	// The working tree's changes are ignored.
+	repo.WriteFile("d/f.go", "// modified\npackage f\n")
+	src, err := Source(repo.Dir, commitID, "d/f.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "package f\n"; string(src) != want {
+		t.Errorf("got %q, want %q", src, want)
+	}
+
+	if _, err := Source(repo.Dir, commitID, "d/missing.go"); !os.IsNotExist(err) {
+		t.Errorf("missing file: got error %v, want a not-exist error", err)
+	}
+}
@@ -0,0 +1,8 @@
+// Package blame attributes defs to the people who wrote them, using
+// line-level authorship information from the VCS (git blame).
+//
+// Authorship is recorded on each def's Author and AuthorCommitID
+// fields at import time, so that stores can answer "who owns this
+// API?" queries (e.g., using the store.ByAuthor filter) without
+// consulting the VCS.
+package blame
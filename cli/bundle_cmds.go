@@ -0,0 +1,303 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"sourcegraph.com/sourcegraph/go-flags"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/store"
+	"sourcegraph.com/sourcegraph/srclib/store/graphql"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func init() {
+	cliInit = append(cliInit, func(cli *flags.Command) {
+		c, err := cli.AddCommand("bundle",
+			"offline store bundles",
+			"The bundle subcommands package graph data from a store into a single file and serve queries from it, for environments without access to the store.",
+			&bundleCmd,
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		_, err = c.AddCommand("create",
+			"create a bundle",
+			"The create subcommand writes the graph data of the selected versions in a MultiRepoStore (and metadata describing them) to a bundle file.",
+			&bundleCreateCmd,
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		_, err = c.AddCommand("serve",
+			"serve queries from a bundle",
+			"The serve subcommand loads a bundle file and serves queries on its data over HTTP. Each endpoint (/repos, /versions, /units, /defs, /refs) returns JSON and accepts the query parameters repo, commit, unit-type, unit, and file (and def-path for /defs and /refs). The bundle's manifest is served at /manifest. The /units, /defs, and /refs endpoints set ETag headers and honor If-None-Match. A GraphQL API over the bundle is served at /graphql.",
+			&bundleServeCmd,
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+	})
+}
+
+type BundleCmd struct{}
+
+var bundleCmd BundleCmd
+
+func (c *BundleCmd) Execute(args []string) error { return nil }
+
+type BundleCreateCmd struct {
+	StoreCmd
+
+	Output   string   `short:"o" long:"output" description:"bundle file to write" required:"yes" value-name:"FILE"`
+	Repos    []string `long:"repo" description:"only bundle this repo (may be specified multiple times)"`
+	Versions []string `long:"version" description:"only bundle this version, as REPO@COMMIT (may be specified multiple times)"`
+	Index    bool     `long:"index" description:"include indexes in the bundle (makes it larger, but queries on it faster)"`
+}
+
+var bundleCreateCmd BundleCreateCmd
+
+func (c *BundleCreateCmd) Execute(args []string) error {
+	s, err := c.StoreCmd.store()
+	if err != nil {
+		return err
+	}
+	src, ok := s.(store.MultiRepoStoreImporter)
+	if !ok {
+		return fmt.Errorf("store (type %T) is not a MultiRepoStore (use --type=MultiRepoStore)", s)
+	}
+
+	opt := &store.BundleOptions{Repos: c.Repos, Index: c.Index}
+	for _, rc := range c.Versions {
+		repo, commitID := parseRepoAndCommitID(rc)
+		if repo == "" || commitID == "" {
+			return fmt.Errorf("invalid --version %q (must be REPO@COMMIT)", rc)
+		}
+		opt.Versions = append(opt.Versions, store.Version{Repo: repo, CommitID: commitID})
+	}
+
+	f, err := os.Create(c.Output)
+	if err != nil {
+		return err
+	}
+	m, err := store.CreateBundle(f, src, opt)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(c.Output)
+		return err
+	}
+	log.Printf("# Wrote bundle with %d versions (%d source units) to %s.", len(m.Versions), m.Units, c.Output)
+	return nil
+}
+
+type BundleServeCmd struct {
+	HTTP string `long:"http" description:"HTTP listen address" default:":7070"`
+
+	Args struct {
+		File string `name:"FILE" description:"bundle file to serve"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+var bundleServeCmd BundleServeCmd
+
+func (c *BundleServeCmd) Execute(args []string) error {
+	f, err := os.Open(c.Args.File)
+	if err != nil {
+		return err
+	}
+	s, m, err := store.OpenBundle(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	log.Printf("# Serving bundle %s (%d versions, created %s) on %s", c.Args.File, len(m.Versions), m.Created, c.HTTP)
+	return http.ListenAndServe(c.HTTP, bundleHandler(s, m))
+}
+
+// bundleHandler returns an HTTP handler that serves queries on s (the
+// store of the bundle described by m).
+func bundleHandler(s store.MultiRepoStore, m *store.BundleManifest) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/manifest", func(w http.ResponseWriter, r *http.Request) {
+		writeBundleJSON(w, m, nil)
+	})
+	mux.HandleFunc("/repos", func(w http.ResponseWriter, r *http.Request) {
+		f, err := bundleQueryFilters(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var rf []store.RepoFilter
+		for _, f := range f {
+			if f, ok := f.(store.RepoFilter); ok {
+				rf = append(rf, f)
+			}
+		}
+		repos, err := s.Repos(rf...)
+		writeBundleJSON(w, repos, err)
+	})
+	mux.HandleFunc("/versions", func(w http.ResponseWriter, r *http.Request) {
+		f, err := bundleQueryFilters(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var vf []store.VersionFilter
+		for _, f := range f {
+			if f, ok := f.(store.VersionFilter); ok {
+				vf = append(vf, f)
+			}
+		}
+		versions, err := s.Versions(vf...)
+		writeBundleJSON(w, versions, err)
+	})
+	mux.HandleFunc("/units", func(w http.ResponseWriter, r *http.Request) {
+		f, err := bundleQueryFilters(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var uf []store.UnitFilter
+		for _, f := range f {
+			if f, ok := f.(store.UnitFilter); ok {
+				uf = append(uf, f)
+			}
+		}
+		cond := bundleConditionalQuery(r)
+		uf = append(uf, cond)
+		units, err := s.Units(uf...)
+		writeBundleConditionalJSON(w, cond, units, err)
+	})
+	mux.HandleFunc("/defs", func(w http.ResponseWriter, r *http.Request) {
+		f, err := bundleQueryFilters(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var df []store.DefFilter
+		for _, f := range f {
+			if f, ok := f.(store.DefFilter); ok {
+				df = append(df, f)
+			}
+		}
+		cond := bundleConditionalQuery(r)
+		df = append(df, cond)
+		if defPath := r.FormValue("def-path"); defPath != "" {
+			f, err := store.NewByDefPathFilter(defPath)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			df = append(df, f)
+		}
+		defs, err := s.Defs(df...)
+		writeBundleConditionalJSON(w, cond, defs, err)
+	})
+	mux.HandleFunc("/refs", func(w http.ResponseWriter, r *http.Request) {
+		f, err := bundleQueryFilters(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var rf []store.RefFilter
+		for _, f := range f {
+			if f, ok := f.(store.RefFilter); ok {
+				rf = append(rf, f)
+			}
+		}
+		cond := bundleConditionalQuery(r)
+		rf = append(rf, cond)
+		if defPath := r.FormValue("def-path"); defPath != "" {
+			f, err := store.NewByRefDefFilter(graph.RefDefKey{
+				DefRepo:     r.FormValue("def-repo"),
+				DefUnitType: r.FormValue("def-unit-type"),
+				DefUnit:     r.FormValue("def-unit"),
+				DefPath:     defPath,
+			})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			rf = append(rf, f)
+		}
+		refs, err := s.Refs(rf...)
+		writeBundleConditionalJSON(w, cond, refs, err)
+	})
+	mux.Handle("/graphql", graphql.Handler(s))
+	return mux
+}
+
+// bundleQueryFilters returns the filters specified by the common query
+// parameters (repo, commit, unit-type, unit, and file) of a bundle
+// query.
+func bundleQueryFilters(r *http.Request) ([]interface{}, error) {
+	var filters []interface{}
+	if repo := r.FormValue("repo"); repo != "" {
+		f, err := store.NewByReposFilter(repo)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	if commitID := r.FormValue("commit"); commitID != "" {
+		f, err := store.NewByCommitIDsFilter(commitID)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	if unitType, unitName := r.FormValue("unit-type"), r.FormValue("unit"); unitType != "" || unitName != "" {
+		f, err := store.NewByUnitsFilter(unit.ID2{Type: unitType, Name: unitName})
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	if file := r.FormValue("file"); file != "" {
+		f, err := store.NewByFilesFilter(true, file)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// bundleConditionalQuery returns a conditional query (see
+// store.ConditionalQuery) for the request's If-None-Match header.
+func bundleConditionalQuery(r *http.Request) *store.ConditionalQuery {
+	return &store.ConditionalQuery{IfNoneMatch: strings.Trim(r.Header.Get("If-None-Match"), `"`)}
+}
+
+// writeBundleConditionalJSON is like writeBundleJSON, but it sets the
+// response's ETag from cond and responds with 304 Not Modified if the
+// query was not modified.
+func writeBundleConditionalJSON(w http.ResponseWriter, cond *store.ConditionalQuery, v interface{}, err error) {
+	if cond.Token != "" {
+		w.Header().Set("ETag", `"`+cond.Token+`"`)
+	}
+	if err == store.ErrNotModified {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeBundleJSON(w, v, err)
+}
+
+func writeBundleJSON(w http.ResponseWriter, v interface{}, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing bundle query response: %s", err)
+	}
+}
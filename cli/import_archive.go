@@ -0,0 +1,104 @@
+package cli
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/tools/godoc/vfs"
+	"golang.org/x/tools/godoc/vfs/mapfs"
+)
+
+// maxBuildDataArchiveSize is the maximum total size of the
+// (uncompressed) files in a build data archive, which are read into
+// memory.
+const maxBuildDataArchiveSize = 2 << 30
+
+// ImportFromArchive imports build data from r, a gzipped tar archive
+// of a commit's build data directory (i.e., of the contents of
+// .srclib-cache/COMMIT, as created by `tar -czf - -C
+// .srclib-cache/COMMIT .`). It lets CI jobs run only the graphers and
+// upload their output to a server that performs the import.
+//
+// The archive's files are read into memory. Line tables, token
+// indexes, and CODEOWNERS-based owners can't be recorded (because the
+// archive does not contain source files), so opt.SourceFS,
+// opt.Tokens, and opt.CodeOwners are ignored.
+func ImportFromArchive(r io.Reader, stor interface{}, opt ImportOpt) error {
+	bdfs, err := readBuildDataArchive(r)
+	if err != nil {
+		return err
+	}
+	opt.SourceFS = nil
+	opt.CodeOwners = false
+	opt.Tokens = false
+	return Import(bdfs, stor, opt)
+}
+
+// readBuildDataArchive reads the files in a gzipped tar archive into
+// an in-memory FS.
+func readBuildDataArchive(r io.Reader) (vfs.FileSystem, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading build data archive: %s", err)
+	}
+	defer gr.Close()
+
+	files := map[string]string{}
+	var size int64
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading build data archive: %s", err)
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue // dirs are implied by the files' paths
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("build data archive entry %q is outside of the build data dir", hdr.Name)
+		}
+		if size += hdr.Size; size > maxBuildDataArchiveSize {
+			return nil, fmt.Errorf("build data archive is too large (its files exceed %d bytes)", maxBuildDataArchiveSize)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("reading build data archive entry %q: %s", hdr.Name, err)
+		}
+		files[name] = string(data)
+	}
+	return buildDataArchiveFS{mapfs.New(files)}, nil
+}
+
+// buildDataArchiveFS is an in-memory build data FS. Its paths are
+// relative to the build data dir (as they are for the OS FS returned
+// by GetBuildDataFS); mapfs requires rooted paths (so that, e.g.,
+// Lstat(".") finds the root dir).
+type buildDataArchiveFS struct{ fs vfs.FileSystem }
+
+func (fs buildDataArchiveFS) Open(p string) (vfs.ReadSeekCloser, error) {
+	return fs.fs.Open(path.Join("/", p))
+}
+
+func (fs buildDataArchiveFS) Lstat(p string) (os.FileInfo, error) {
+	return fs.fs.Lstat(path.Join("/", p))
+}
+
+func (fs buildDataArchiveFS) Stat(p string) (os.FileInfo, error) {
+	return fs.fs.Stat(path.Join("/", p))
+}
+
+func (fs buildDataArchiveFS) ReadDir(p string) ([]os.FileInfo, error) {
+	return fs.fs.ReadDir(path.Join("/", p))
+}
+
+func (fs buildDataArchiveFS) String() string { return "build data archive" }
@@ -0,0 +1,73 @@
+package cli
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"golang.org/x/tools/godoc/vfs"
+	"sourcegraph.com/sourcegraph/srclib/config"
+)
+
+func buildDataArchive(t *testing.T, files map[string]string) *bytes.Buffer {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestReadBuildDataArchive(t *testing.T) {
+	bdfs, err := readBuildDataArchive(buildDataArchive(t, map[string]string{
+		"./u/t.unit.json":  `{"Type": "t", "Name": "u"}`,
+		"./u/t.graph.json": `{"Defs": []}`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := vfs.ReadFile(bdfs, "u/t.graph.json"); err != nil {
+		t.Fatal(err)
+	} else if string(data) != `{"Defs": []}` {
+		t.Errorf("got graph data %q", data)
+	}
+
+	tree, err := config.ReadCached(bdfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.SourceUnits) != 1 || tree.SourceUnits[0].Name != "u" {
+		t.Errorf("got source units %+v, want [u]", tree.SourceUnits)
+	}
+}
+
+func TestReadBuildDataArchive_outsideDir(t *testing.T) {
+	for _, name := range []string{"../x.unit.json", "/x.unit.json", "a/../../x.unit.json"} {
+		if _, err := readBuildDataArchive(buildDataArchive(t, map[string]string{name: "{}"})); err == nil {
+			t.Errorf("%s: got nil error", name)
+		}
+	}
+}
+
+func TestReadBuildDataArchive_notGzip(t *testing.T) {
+	if _, err := readBuildDataArchive(bytes.NewReader([]byte("not gzip"))); err == nil {
+		t.Error("got nil error")
+	}
+}
@@ -0,0 +1,510 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sourcegraph.com/sourcegraph/srclib/store"
+)
+
+// Import uploads send a build data archive (see ImportFromArchive) to
+// an import server in chunks, so that an upload interrupted by a
+// network failure resumes where it left off instead of restarting.
+//
+// An upload's ID is the hex-encoded SHA-256 of its archive. Its chunks
+// are sent with:
+//
+//	PUT /uploads/ID
+//	Upload-Offset: (offset of the chunk in the archive)
+//	X-Srclib-Chunk-SHA256: (hex-encoded SHA-256 of the chunk)
+//
+// The server appends each chunk whose checksum matches and whose
+// offset is the number of bytes received so far. Otherwise it responds
+// with HTTP 400 (checksum mismatch) or 409 (offset mismatch). All
+// responses have an Upload-Offset header with the number of bytes
+// received so far, which is also returned by HEAD /uploads/ID. A chunk
+// that would make the upload larger than the server's per-upload limit
+// is rejected with HTTP 413, and one that would make the uploads
+// stored on the server larger than its total limit is rejected with
+// HTTP 507 (so the client retries it later).
+//
+// When all chunks have been sent, POST /uploads/ID/import?repo=REPO&commit=COMMIT
+// checks the archive's checksum and imports it. If the store's import
+// allow list doesn't allow imports into the repo at the commit, it
+// responds with HTTP 403 instead. While an upload is being imported,
+// other requests to import it or to append chunks to it are rejected
+// with HTTP 409.
+const (
+	uploadOffsetHeader      = "Upload-Offset"
+	uploadChunkSHA256Header = "X-Srclib-Chunk-SHA256"
+)
+
+// maxImportUploadChunkSize is the maximum size of a chunk accepted by
+// the import server (which reads each chunk into memory to check its
+// checksum before appending it).
+const maxImportUploadChunkSize = 64 << 20
+
+const (
+	// maxImportUploadSize is the maximum size of an upload accepted
+	// by the import server.
+	maxImportUploadSize = 4 << 30
+
+	// maxImportUploadsSize is the maximum total size of the uploads
+	// that the import server stores at once (which are removed when
+	// they are imported).
+	maxImportUploadsSize = 16 << 30
+)
+
+var importUploadIDPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ImportUploadHandler returns an HTTP handler that receives import
+// uploads (into dir) and imports them into stor with the given options
+// (whose Repo and CommitID are set from each import request).
+func ImportUploadHandler(stor interface{}, dir string, opt ImportOpt) http.Handler {
+	return &importUploadServer{
+		dir: dir,
+		checkAllowed: func(repo, commitID string) error {
+			if a, ok := stor.(store.MultiRepoImportAllower); ok {
+				return a.CheckImportAllowed(repo, commitID)
+			}
+			return nil
+		},
+		importArchive: func(r io.Reader, repo, commitID string) error {
+			opt := opt
+			opt.Repo = repo
+			opt.CommitID = commitID
+			return ImportFromArchive(r, stor, opt)
+		},
+	}
+}
+
+type importUploadServer struct {
+	dir           string
+	maxSize       int64 // maximum size of an upload (if 0, maxImportUploadSize)
+	maxTotalSize  int64 // maximum total size of the stored uploads (if 0, maxImportUploadsSize)
+	checkAllowed  func(repo, commitID string) error
+	importArchive func(r io.Reader, repo, commitID string) error
+
+	mu        sync.Mutex          // guards appends to upload files and importing
+	importing map[string]struct{} // IDs of the uploads being imported
+}
+
+func (s *importUploadServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/uploads/")
+	if rest == r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+	id, action := rest, ""
+	if i := strings.Index(rest, "/"); i != -1 {
+		id, action = rest[:i], rest[i+1:]
+	}
+	if !importUploadIDPattern.MatchString(id) {
+		http.Error(w, "invalid upload ID (must be the hex-encoded SHA-256 of the archive)", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case action == "" && (r.Method == "HEAD" || r.Method == "GET"):
+		size, err := s.size(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(uploadOffsetHeader, strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusNoContent)
+	case action == "" && r.Method == "PUT":
+		s.serveChunk(w, r, id)
+	case action == "import" && r.Method == "POST":
+		s.serveImport(w, r, id)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *importUploadServer) file(id string) string {
+	return filepath.Join(s.dir, id+".tar.gz")
+}
+
+// size returns the number of bytes of the upload that have been
+// received.
+func (s *importUploadServer) size(id string) (int64, error) {
+	fi, err := os.Stat(s.file(id))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (s *importUploadServer) maxUploadSize() int64 {
+	if s.maxSize == 0 {
+		return maxImportUploadSize
+	}
+	return s.maxSize
+}
+
+func (s *importUploadServer) maxUploadsSize() int64 {
+	if s.maxTotalSize == 0 {
+		return maxImportUploadsSize
+	}
+	return s.maxTotalSize
+}
+
+// totalSize returns the total size of the stored uploads.
+func (s *importUploadServer) totalSize() (int64, error) {
+	fis, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() {
+			total += fi.Size()
+		}
+	}
+	return total, nil
+}
+
+// startImport marks the upload as being imported. It returns false if
+// it is already being imported.
+func (s *importUploadServer) startImport(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, importing := s.importing[id]; importing {
+		return false
+	}
+	if s.importing == nil {
+		s.importing = map[string]struct{}{}
+	}
+	s.importing[id] = struct{}{}
+	return true
+}
+
+func (s *importUploadServer) endImport(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.importing, id)
+}
+
+func (s *importUploadServer) serveChunk(w http.ResponseWriter, r *http.Request, id string) {
+	offset, err := strconv.ParseInt(r.Header.Get(uploadOffsetHeader), 10, 64)
+	if err != nil {
+		http.Error(w, "missing or invalid "+uploadOffsetHeader+" header", http.StatusBadRequest)
+		return
+	}
+	chunk, err := ioutil.ReadAll(io.LimitReader(r.Body, maxImportUploadChunkSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(chunk) > maxImportUploadChunkSize {
+		http.Error(w, fmt.Sprintf("chunk exceeds %d bytes", maxImportUploadChunkSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	size, err := s.size(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(size, 10))
+	if sum := sha256.Sum256(chunk); hex.EncodeToString(sum[:]) != r.Header.Get(uploadChunkSHA256Header) {
+		http.Error(w, "chunk checksum mismatch", http.StatusBadRequest)
+		return
+	}
+	if offset != size {
+		http.Error(w, fmt.Sprintf("chunk offset is %d, but %d bytes have been received", offset, size), http.StatusConflict)
+		return
+	}
+	if _, importing := s.importing[id]; importing {
+		http.Error(w, "upload is being imported", http.StatusConflict)
+		return
+	}
+	if maxSize := s.maxUploadSize(); size+int64(len(chunk)) > maxSize {
+		http.Error(w, fmt.Sprintf("upload exceeds %d bytes", maxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	total, err := s.totalSize()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if total+int64(len(chunk)) > s.maxUploadsSize() {
+		http.Error(w, "not enough space for uploads (try again later)", http.StatusInsufficientStorage)
+		return
+	}
+
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f, err := os.OpenFile(s.file(id), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := f.Write(chunk); err != nil {
+		// Discard the partially written chunk so that it can be resent.
+		f.Truncate(size)
+		f.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := f.Close(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(size+int64(len(chunk)), 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *importUploadServer) serveImport(w http.ResponseWriter, r *http.Request, id string) {
+	repo, commitID := r.URL.Query().Get("repo"), r.URL.Query().Get("commit")
+	if repo == "" || commitID == "" {
+		http.Error(w, "repo and commit query parameters are required", http.StatusBadRequest)
+		return
+	}
+	if s.checkAllowed != nil {
+		if err := s.checkAllowed(repo, commitID); err != nil {
+			status := http.StatusInternalServerError
+			if store.IsImportNotAllowed(err) {
+				status = http.StatusForbidden
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+
+	if !s.startImport(id) {
+		http.Error(w, "upload is already being imported", http.StatusConflict)
+		return
+	}
+	defer s.endImport(id)
+
+	f, err := os.Open(s.file(id))
+	if os.IsNotExist(err) {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if hex.EncodeToString(h.Sum(nil)) != id {
+		http.Error(w, "archive checksum mismatch (is the upload incomplete?)", http.StatusBadRequest)
+		return
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.importArchive(f, repo, commitID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := os.Remove(s.file(id)); err != nil {
+		log.Printf("Warning: removing imported upload %s failed: %s", id, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ImportUploader uploads build data archives to an import server (see
+// ImportUploadHandler) in chunks, retrying failed requests and resuming
+// interrupted uploads.
+type ImportUploader struct {
+	// URL is the import server's base URL.
+	URL string
+
+	// ChunkSize is the size of each uploaded chunk. If 0, a default of
+	// 4 MB is used.
+	ChunkSize int
+
+	// MaxRetries is the number of times that each request is retried
+	// after a network error or server error. If 0, a default of 5 is
+	// used.
+	MaxRetries int
+
+	// RetryDelay is the delay before the first retry, which doubles
+	// after each retry. If 0, a default of 1 second is used.
+	RetryDelay time.Duration
+
+	// Client is the HTTP client to use. If nil, http.DefaultClient is
+	// used.
+	Client *http.Client
+
+	// Verbose, if set, logs upload progress.
+	Verbose bool
+}
+
+// Upload uploads the size-byte archive read from r and imports it as
+// repo's tree at commitID.
+func (u *ImportUploader) Upload(r io.ReaderAt, size int64, repo, commitID string) error {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, size)); err != nil {
+		return err
+	}
+	uploadURL := strings.TrimSuffix(u.URL, "/") + "/uploads/" + hex.EncodeToString(h.Sum(nil))
+
+	// Resume a previous upload of the same archive.
+	offset, err := u.offset(uploadURL)
+	if err != nil {
+		return err
+	}
+	if offset > size {
+		offset = 0 // shouldn't happen (uploads are keyed by checksum)
+	}
+
+	chunkSize := u.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = 4 << 20
+	}
+	buf := make([]byte, chunkSize)
+	for offset < size {
+		n, err := r.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if u.Verbose {
+			log.Printf("# Uploading %d bytes at offset %d of %d", n, offset, size)
+		}
+		if offset, err = u.putChunk(uploadURL, offset, buf[:n]); err != nil {
+			return err
+		}
+	}
+
+	importURL := uploadURL + "/import?" + url.Values{"repo": {repo}, "commit": {commitID}}.Encode()
+	resp, err := u.do(func() (*http.Request, error) { return http.NewRequest("POST", importURL, nil) })
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return importUploadError(resp)
+	}
+	return nil
+}
+
+// offset returns the number of bytes of the upload that the server
+// has received.
+func (u *ImportUploader) offset(uploadURL string) (int64, error) {
+	resp, err := u.do(func() (*http.Request, error) { return http.NewRequest("HEAD", uploadURL, nil) })
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return 0, importUploadError(resp)
+	}
+	return strconv.ParseInt(resp.Header.Get(uploadOffsetHeader), 10, 64)
+}
+
+// putChunk uploads the chunk at offset and returns the server's new
+// offset. If the server's offset differs from the chunk's (e.g.,
+// because a previous attempt to upload the chunk succeeded but its
+// response was lost), the server's offset is returned so the upload
+// continues from there.
+func (u *ImportUploader) putChunk(uploadURL string, offset int64, chunk []byte) (int64, error) {
+	sum := sha256.Sum256(chunk)
+	for i := 0; ; i++ {
+		resp, err := u.do(func() (*http.Request, error) {
+			req, err := http.NewRequest("PUT", uploadURL, bytes.NewReader(chunk))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set(uploadOffsetHeader, strconv.FormatInt(offset, 10))
+			req.Header.Set(uploadChunkSHA256Header, hex.EncodeToString(sum[:]))
+			return req, nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusNoContent, http.StatusConflict:
+			return strconv.ParseInt(resp.Header.Get(uploadOffsetHeader), 10, 64)
+		case http.StatusBadRequest:
+			// The chunk was corrupted in transit; resend it.
+			if i < u.maxRetries() {
+				continue
+			}
+		}
+		return 0, importUploadError(resp)
+	}
+}
+
+// do performs the request returned by newReq, retrying (with
+// exponential backoff) after network errors and server errors.
+func (u *ImportUploader) do(newReq func() (*http.Request, error)) (*http.Response, error) {
+	client := u.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	delay := u.RetryDelay
+	if delay == 0 {
+		delay = time.Second
+	}
+	for i := 0; ; i++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err == nil && resp.StatusCode < 500 {
+			return resp, nil
+		}
+		if i == u.maxRetries() {
+			if err == nil {
+				defer resp.Body.Close()
+				err = importUploadError(resp)
+			}
+			return nil, err
+		}
+		if err == nil {
+			err = importUploadError(resp)
+			resp.Body.Close()
+		}
+		if u.Verbose {
+			log.Printf("# %s %s failed (retrying in %s): %s", req.Method, req.URL, delay, err)
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (u *ImportUploader) maxRetries() int {
+	if u.MaxRetries == 0 {
+		return 5
+	}
+	return u.MaxRetries
+}
+
+func importUploadError(resp *http.Response) error {
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("%s %s: HTTP %s: %s", resp.Request.Method, resp.Request.URL, resp.Status, bytes.TrimSpace(msg))
+}
@@ -0,0 +1,206 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/store"
+)
+
+// flakyHandler fails every other request: alternately with HTTP 503
+// and (for chunk uploads) by corrupting the chunk in transit.
+type flakyHandler struct {
+	h  http.Handler
+	mu sync.Mutex
+	n  int
+}
+
+func (f *flakyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.n++
+	n := f.n
+	f.mu.Unlock()
+	switch {
+	case n%4 == 1:
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	case n%4 == 3 && r.Method == "PUT":
+		data, _ := ioutil.ReadAll(r.Body)
+		if len(data) > 0 {
+			data[0] ^= 0xFF
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	}
+	f.h.ServeHTTP(w, r)
+}
+
+func TestImportUpload(t *testing.T) {
+	archive := bytes.Repeat([]byte("0123456789"), 1000)
+
+	var imported []byte
+	var repo, commitID string
+	s := &importUploadServer{
+		dir: t.TempDir(),
+		importArchive: func(r io.Reader, repo_, commitID_ string) error {
+			var err error
+			imported, err = ioutil.ReadAll(r)
+			repo, commitID = repo_, commitID_
+			return err
+		},
+	}
+	ts := httptest.NewServer(&flakyHandler{h: s})
+	defer ts.Close()
+
+	u := &ImportUploader{URL: ts.URL, ChunkSize: 3000, RetryDelay: 1}
+	if err := u.Upload(bytes.NewReader(archive), int64(len(archive)), "r", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(imported, archive) {
+		t.Errorf("imported archive differs from uploaded archive (got %d bytes, want %d)", len(imported), len(archive))
+	}
+	if repo != "r" || commitID != "c" {
+		t.Errorf("got repo %q commit %q, want r c", repo, commitID)
+	}
+}
+
+func TestImportUpload_resume(t *testing.T) {
+	archive := bytes.Repeat([]byte("abcdefghij"), 1000)
+
+	var puts int
+	var imported []byte
+	s := &importUploadServer{
+		dir: t.TempDir(),
+		importArchive: func(r io.Reader, repo, commitID string) error {
+			var err error
+			imported, err = ioutil.ReadAll(r)
+			return err
+		},
+	}
+	failAfter := 2
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			if puts == failAfter {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			puts++
+		}
+		s.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	// The first upload fails after sending 2 chunks.
+	u := &ImportUploader{URL: ts.URL, ChunkSize: 1000, MaxRetries: 1, RetryDelay: 1}
+	if err := u.Upload(bytes.NewReader(archive), int64(len(archive)), "r", "c"); err == nil {
+		t.Fatal("got nil error")
+	}
+
+	// The second upload resumes with the 3rd chunk.
+	failAfter = -1
+	if err := u.Upload(bytes.NewReader(archive), int64(len(archive)), "r", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if want := 10; puts != want {
+		t.Errorf("got %d chunk uploads, want %d", puts, want)
+	}
+	if !bytes.Equal(imported, archive) {
+		t.Error("imported archive differs from uploaded archive")
+	}
+}
+
+func TestImportUpload_notAllowed(t *testing.T) {
+	var imported bool
+	s := &importUploadServer{
+		dir: t.TempDir(),
+		checkAllowed: func(repo, commitID string) error {
+			return store.ImportAllowList{{Repo: "other"}}.Check(repo, commitID)
+		},
+		importArchive: func(r io.Reader, repo, commitID string) error {
+			imported = true
+			return nil
+		},
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	u := &ImportUploader{URL: ts.URL, RetryDelay: 1}
+	if err := u.Upload(bytes.NewReader([]byte("x")), 1, "r", "c"); err == nil {
+		t.Fatal("got nil error, want error")
+	}
+	if imported {
+		t.Error("disallowed upload was imported")
+	}
+}
+
+func TestImportUpload_tooLarge(t *testing.T) {
+	archive := bytes.Repeat([]byte("x"), 100)
+	s := &importUploadServer{
+		dir:           t.TempDir(),
+		maxSize:       50,
+		importArchive: func(r io.Reader, repo, commitID string) error { return nil },
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	u := &ImportUploader{URL: ts.URL, ChunkSize: 40, MaxRetries: 1, RetryDelay: 1}
+	err := u.Upload(bytes.NewReader(archive), int64(len(archive)), "r", "c")
+	if err == nil || !strings.Contains(err.Error(), "413") {
+		t.Errorf("upload exceeding maxSize: got error %v, want HTTP 413", err)
+	}
+
+	// Other uploads count toward the total limit.
+	s.maxSize, s.maxTotalSize = 0, 60
+	err = u.Upload(bytes.NewReader(archive[:30]), 30, "r", "c")
+	if err == nil || !strings.Contains(err.Error(), "507") {
+		t.Errorf("upload exceeding maxTotalSize: got error %v, want HTTP 507", err)
+	}
+}
+
+func TestImportUpload_concurrentImports(t *testing.T) {
+	archive := []byte("x")
+	started, done := make(chan struct{}), make(chan struct{})
+	var imports int
+	s := &importUploadServer{
+		dir: t.TempDir(),
+		importArchive: func(r io.Reader, repo, commitID string) error {
+			imports++
+			close(started)
+			<-done
+			return nil
+		},
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	u := &ImportUploader{URL: ts.URL, MaxRetries: 1, RetryDelay: 1}
+	errc := make(chan error)
+	go func() { errc <- u.Upload(bytes.NewReader(archive), 1, "r", "c") }()
+	<-started
+
+	// While the upload is being imported, it can't be imported again.
+	sum := sha256.Sum256(archive)
+	resp, err := http.Post(ts.URL+"/uploads/"+hex.EncodeToString(sum[:])+"/import?repo=r&commit=c", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("concurrent import: got HTTP %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+
+	close(done)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if imports != 1 {
+		t.Errorf("got %d imports, want 1", imports)
+	}
+}
@@ -0,0 +1,92 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"golang.org/x/tools/godoc/vfs"
+
+	"sourcegraph.com/sourcegraph/srclib/blame"
+)
+
+// sourceFSAt returns a filesystem with the source files of the
+// repository as of commitID (for ImportOpt.SourceFS), so that the line
+// tables and token indexes built from it match the imported build
+// data. If the working tree is clean and at commitID, its files are
+// read directly. Otherwise, for git repositories, files are read from
+// commitID; for other VCSes, nil is returned (so no line tables or
+// tokens are built).
+func sourceFSAt(repo *Repo, commitID string) (vfs.FileSystem, error) {
+	if repo.CommitID == commitID {
+		dirty, err := workingTreeDirty(repo)
+		if err != nil {
+			return nil, err
+		}
+		if !dirty {
+			return vfs.OS(repo.RootDir), nil
+		}
+	}
+	if repo.VCSType != "git" {
+		return nil, nil
+	}
+	return &gitCommitFS{dir: repo.RootDir, commitID: commitID}, nil
+}
+
+// workingTreeDirty reports whether repo's working tree has changes
+// (including untracked files) relative to its current commit.
+func workingTreeDirty(repo *Repo) (bool, error) {
+	var cmd *exec.Cmd
+	switch repo.VCSType {
+	case "git":
+		cmd = exec.Command("git", "status", "--porcelain")
+	case "hg":
+		cmd = exec.Command("hg", "--config", "trusted.users=root", "status")
+	default:
+		return false, fmt.Errorf("unknown vcs type: %q", repo.VCSType)
+	}
+	cmd.Dir = repo.RootDir
+	out, err := cmd.Output()
+	if err != nil {
+		return false, fmt.Errorf("exec %v failed: %s", cmd.Args, err)
+	}
+	return len(bytes.TrimSpace(out)) > 0, nil
+}
+
+// gitCommitFS is a filesystem with the files of a git repository as of
+// a commit. Only Open is supported (which is all that Import needs).
+type gitCommitFS struct {
+	dir, commitID string
+}
+
+var errGitCommitFSUnsupported = errors.New("operation not supported on a git commit filesystem")
+
+func (fs *gitCommitFS) Open(name string) (vfs.ReadSeekCloser, error) {
+	src, err := blame.Source(fs.dir, fs.commitID, name)
+	if err != nil {
+		return nil, err
+	}
+	return nopCloser{bytes.NewReader(src)}, nil
+}
+
+func (fs *gitCommitFS) Lstat(name string) (os.FileInfo, error) {
+	return nil, &os.PathError{Op: "lstat", Path: name, Err: errGitCommitFSUnsupported}
+}
+
+func (fs *gitCommitFS) Stat(name string) (os.FileInfo, error) {
+	return nil, &os.PathError{Op: "stat", Path: name, Err: errGitCommitFSUnsupported}
+}
+
+func (fs *gitCommitFS) ReadDir(name string) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: name, Err: errGitCommitFSUnsupported}
+}
+
+func (fs *gitCommitFS) String() string { return "git(" + fs.dir + "@" + fs.commitID + ")" }
+
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,37 @@
+package cli
+
+import (
+	"testing"
+
+	"golang.org/x/tools/godoc/vfs"
+
+	"sourcegraph.com/sourcegraph/srclib/internal/gittest"
+)
+
+func TestSourceFSAt(t *testing.T) {
+	gitRepo := gittest.New(t)
+	defer gitRepo.Remove()
+	gitRepo.WriteFile("f.go", "package f\n")
+	commitID1 := gitRepo.Commit("c1")
+	gitRepo.WriteFile("f.go", "package f\n\nvar x int\n")
+	commitID2 := gitRepo.Commit("c2")
+	repo := &Repo{RootDir: gitRepo.Dir, VCSType: "git", CommitID: commitID2}
+
+	check := func(label, commitID, want string) {
+		fs, err := sourceFSAt(repo, commitID)
+		if err != nil {
+			t.Fatalf("%s: %s", label, err)
+		}
+		src, err := vfs.ReadFile(fs, "f.go")
+		if err != nil {
+			t.Fatalf("%s: %s", label, err)
+		}
+		if string(src) != want {
+			t.Errorf("%s: got %q, want %q", label, src, want)
+		}
+	}
+	check("clean, at commit", commitID2, "package f\n\nvar x int\n")
+	check("clean, other commit", commitID1, "package f\n")
+	gitRepo.WriteFile("f.go", "// modified\n")
+	check("dirty, at commit", commitID2, "package f\n\nvar x int\n")
+}
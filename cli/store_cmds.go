@@ -2,14 +2,21 @@ package cli
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
 	"sync"
@@ -18,17 +25,23 @@ import (
 	"github.com/alexsaveliev/go-colorable-wrapper"
 	"github.com/neelance/parallel"
 
+	"golang.org/x/net/context"
 	"golang.org/x/tools/godoc/vfs"
 
 	"sort"
 
 	"sourcegraph.com/sourcegraph/go-flags"
 	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/blame"
+	"sourcegraph.com/sourcegraph/srclib/codeowners"
 	"sourcegraph.com/sourcegraph/srclib/config"
+	"sourcegraph.com/sourcegraph/srclib/dep"
 	"sourcegraph.com/sourcegraph/srclib/graph"
 	"sourcegraph.com/sourcegraph/srclib/grapher"
 	"sourcegraph.com/sourcegraph/srclib/plan"
 	"sourcegraph.com/sourcegraph/srclib/store"
+	"sourcegraph.com/sourcegraph/srclib/store/export"
+	"sourcegraph.com/sourcegraph/srclib/store/graphql"
 	"sourcegraph.com/sourcegraph/srclib/unit"
 )
 
@@ -69,6 +82,33 @@ func InitStoreCmds(c *flags.Command) {
 	}
 	SetDefaultCommitIDOpt(importC)
 
+	_, err = c.AddCommand("verify",
+		"verify tree signatures",
+		"The verify command checks that a tree's data was signed (at import time, with --sign-key) by a trusted key and has not been modified since. The signature doesn't cover the tree's indexes, so after verifying the tree, it rebuilds them from the verified data (unless --no-rebuild-indexes is given), so that indexed queries only return signed data.",
+		&storeVerifyCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = c.AddCommand("manifest",
+		"show or verify a tree's manifest",
+		"The manifest command prints the manifest of a tree (written when the tree's version is created), which lists the tree's data and index files with their sizes and checksums. With --verify, it instead reports the differences between the manifest and the tree's files. With --write, it rewrites the manifest from the tree's current files.",
+		&storeManifestCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = c.AddCommand("sync",
+		"copy data to another store",
+		"The sync command copies all versions that are missing (or whose data differs) in the destination MultiRepoStore from this store (which must also be a MultiRepoStore). Versions with identical data (as determined by tree content digests) are skipped.",
+		&storeSyncCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	_, err = c.AddCommand("indexes",
 		"list indexes",
 		"The indexes command lists all of a store's indexes that match the specified criteria.",
@@ -132,6 +172,204 @@ func InitStoreCmds(c *flags.Command) {
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	_, err = c.AddCommand("usage",
+		"show storage usage",
+		"The usage command prints the number of bytes of data (including indexes) stored for each repo that matches a filter, as recorded in the repos' usage accounting files.",
+		&storeUsageCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = c.AddCommand("gc-shared-data",
+		"remove unreferenced shared unit data",
+		"The gc-shared-data command removes the shared copies of source unit data files (see --share-unit-data) that no tree of the repos that match a filter refers to anymore, and prints the number of files and bytes removed.",
+		&storeGCSharedDataCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = c.AddCommand("gc-content-store",
+		"remove unreferenced content-addressed unit data",
+		"The gc-content-store command removes the content-addressed objects (see --content-addressed) that no file in the store refers to anymore, and prints the number of objects and bytes removed. It must not run while other processes import into the store.",
+		&storeGCContentStoreCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = c.AddCommand("migrate-codec",
+		"rewrite data files in a different codec",
+		"The migrate-codec command rewrites the data files of each tree in a MultiRepoStore from one codec (--from) to another (--to), one tree at a time. Each tree's original files are kept until the rewritten tree's source units, defs, refs, and scan results are verified to equal the original ones; if verification fails, the tree is restored. Trees that were already migrated are skipped, so an interrupted migration can be resumed by running the command again. The store must not be used while it is being migrated. Afterwards, the new codec is recorded in the store's manifest, so programs that open the store use it (unless --repo was given, in which case the store can't be used until its other repos are migrated too). Signed trees must be re-signed after migration.",
+		&storeMigrateCodecCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = c.AddCommand("languages",
+		"show language stats",
+		"The languages command prints the number of source units, defs, refs, and files of each unit type (which usually corresponds to a language) in a tree.",
+		&storeLanguagesCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = c.AddCommand("external-refs",
+		"show usage of defs in other repos",
+		"The external-refs command prints the number of refs from each source unit in a tree to each def in another repo (e.g., a dependency), as summarized when the units were imported.",
+		&storeExternalRefsCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = c.AddCommand("dependents",
+		"list repos that depend on a repo",
+		"The dependents command lists the trees (in other repos) that have refs to defs in a repo, with the number of their source units and refs that refer to the repo.",
+		&storeDependentsCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = c.AddCommand("impact",
+		"show refs affected by changing defs",
+		"The impact command lists the trees, source units, and files (in the defs' repo and in the repos that depend on it) that contain refs to the given defs, with the number of refs in each.",
+		&storeImpactCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = c.AddCommand("ref-counts",
+		"show ref counts of a def over time",
+		"The ref-counts command prints the number of refs to a def in each version of the def's repo and the repos that depend on it (or of the given repos), for tracking the def's usage over time.",
+		&storeRefCountsCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = c.AddCommand("deprecations",
+		"list or set deprecated defs",
+		"The deprecations command lists the defs in a tree's deprecations overlay, or replaces the overlay with the defs in a JSON file (with --set). With --refs, it instead reports the remaining refs (in the tree and in the repos that depend on it) to each deprecated def in the tree, including defs that the toolchain marked deprecated.",
+		&storeDeprecationsCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = c.AddCommand("tokens",
+		"find occurrences of an identifier",
+		"The tokens command lists the locations in a tree's source files where the given identifier appears in a ref's span (using the token index built by 'srclib store import --tokens'). Unlike searching defs, it finds every literal occurrence of the identifier, including the qualifiers of qualified refs.",
+		&storeTokensCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = c.AddCommand("index-tree",
+		"build a tree's indexes resumably",
+		"The index-tree command rebuilds the indexes of a tree's source units (in parallel) and then builds the tree's indexes. Its progress is checkpointed in the store, so if it is interrupted, rerunning it only rebuilds the indexes of the remaining source units.",
+		&storeIndexTreeCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = c.AddCommand("hidden-repos",
+		"list, hide, or unhide repos",
+		"The hidden-repos command lists the repos that are hidden in a multi-repo store, or hides (with --hide) or unhides (with --unhide) a repo. Hidden repos' data is kept, but they are excluded from the repos list and from queries (e.g., while their data is known to be bad and pending reimport).",
+		&storeHiddenReposCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = c.AddCommand("repo-redirects",
+		"rename repos or list renamed repos",
+		"The repo-redirects command lists the redirects of renamed repos (from their old to their new URIs) in a MultiRepoStore. With --rename and --to, it moves a repo's data to a new repo URI and records a redirect, so that queries that name the old URI (e.g., when resolving refs imported before the rename) keep working.",
+		&storeRepoRedirectsCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = c.AddCommand("delete",
+		"delete a repo, tree, or source unit",
+		"The delete command removes imported data from the store: a source unit's data (with --unit and --unit-type), a tree's version and data (with --commit), or all of a repo's versions and data (with only --repo, for multi-repo stores). The affected indexes are rebuilt.",
+		&storeDeleteCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = c.AddCommand("graphql",
+		"serve or run GraphQL queries",
+		"The graphql command serves a GraphQL API over the store on an HTTP endpoint (at /graphql), so that clients can fetch repos, versions, units, files, defs, refs, and docs (with nested traversals) in a single request. If a query is given as an argument, it runs the query once and prints the result instead. Use --schema to print the schema.",
+		&storeGraphQLCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = c.AddCommand("export-sqlite",
+		"export data to a SQLite database",
+		"The export-sqlite command creates a SQLite database with units, defs, and refs tables (and indexes for common queries) holding the store's data, for ad-hoc analysis with SQL. It requires the sqlite3 command, unless --sql is given (in which case it writes the SQL script that creates the database to stdout instead). Use --schema to print the tables' schema.",
+		&storeExportSQLiteCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = c.AddCommand("export",
+		"export defs or refs as CSV or Parquet",
+		"The export command writes a table of the store's defs or refs (with repo, commit, and unit columns) in CSV or Parquet format, for loading into data warehouses. The data is queried and written one version at a time, so large stores can be exported with bounded memory.",
+		&storeExportCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = c.AddCommand("import-server",
+		"serve resumable imports of uploaded build data archives",
+		"The import-server command serves an HTTP API that receives build data archives uploaded by 'srclib store import --archive FILE --upload URL' and imports them into the store. Archives are uploaded in chunks (each with a checksum), so uploads interrupted by network failures resume where they left off.",
+		&storeImportServerCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = c.AddCommand("health",
+		"check the store's health",
+		"The health command performs a health check of the store: a read probe, an optional write probe (--write), and a check that a sampled tree's indexes are readable. It prints each probe's result and latency, and it fails if any probe failed. With --http, it serves the health check (as JSON, with HTTP status 503 if unhealthy) at /healthz instead.",
+		&storeHealthCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = c.AddCommand("dump-index",
+		"decode index files",
+		"The dump-index command decodes persisted index files (given as paths relative to the store's root, such as REPO/.srclib-store/COMMIT/UNIT/UNITTYPE/def_query.idx) and prints their contents as JSON, for debugging wrong query results. With --formats, it prints the names, locations, and encodings of all index formats instead.",
+		&storeDumpIndexCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = c.AddCommand("replay-queries",
+		"replay logged queries",
+		"The replay-queries command performs the queries in query logs (recorded with --query-log) on the store, one at a time, and prints how each query's duration, bytes read, and number of results compare with the logged ones. Use it to compare the performance of store builds (e.g., after changing the data format or indexes) on a real workload. If no query log files are given, all of the store's query logs are replayed.",
+		&storeReplayQueriesCmd,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
 // OpenStore is called by all of the store subcommands to open the
@@ -139,9 +377,52 @@ func InitStoreCmds(c *flags.Command) {
 var OpenStore func() (interface{}, error) = storeCmd.store
 
 type StoreCmd struct {
-	Type   string `short:"t" long:"type" description:"the (multi-)repo store type to use (RepoStore, MultiRepoStore, etc.)" default:"RepoStore"`
-	Root   string `short:"r" long:"root" description:"the root of the store (repo clone dir for RepoStore, global path for MultiRepoStore, etc.)" default:".srclib-store"`
-	Config string `long:"config" description:"(rarely used) JSON-encoded config for extra config, specific to each store type"`
+	Type   string `short:"t" long:"type" description:"the (multi-)repo store type to use (RepoStore, MultiRepoStore, or LegacyBuildStore to read-only query a legacy .srclib-cache dir given as --root)" default:"RepoStore"`
+	Root   string `short:"r" long:"root" description:"the root of the store (repo clone dir for RepoStore, global path for MultiRepoStore, .srclib-cache dir for LegacyBuildStore, etc.)" default:".srclib-store"`
+	Config string `long:"config" description:"(rarely used) JSON-encoded config for extra config, specific to each store type (e.g., store.FSStoreConf limits and write policy, per-repo import quotas in a Quotas field with the fields of store.RepoQuotas, the repos and commits that may be imported in an ImportAllowList field holding a list of store.ImportAllowRule, per-unit import size limits in an ImportLimits field with the fields of store.ImportLimits, or import notifiers in Webhooks and Kafka fields holding lists of store.WebhookNotifier and store.KafkaNotifier)"`
+
+	LazyIndex bool `long:"lazy-index" description:"build missing indexes on first use (and write them to the store) instead of falling back to scans (MultiRepoStore only)"`
+
+	StrictDefKeys bool `long:"strict-def-keys" description:"reject imports and filters with malformed def keys (e.g., a unit without a unit type, or an unclean def path)"`
+
+	IndexMemoryBudget int64 `long:"index-memory-budget" description:"approximate max bytes of index data kept loaded across queries (0 means limit the number of indexes instead)" value-name:"BYTES"`
+
+	MaxRecordSize int `long:"max-record-size" description:"maximum size of a single encoded def, ref, or source unit to decode; larger records are treated as corrupt and skipped (0 means the default of 16 MiB)" value-name:"BYTES"`
+
+	ScanWorkers int `long:"scan-workers" description:"decode and filter the records of each full scan of a source unit's defs or refs on this many goroutines (0 or 1 means scans are single-threaded)" value-name:"N"`
+
+	RefOrders string `long:"ref-orders" description:"comma-separated orders in which to store the refs of imported source units ('file' is always included; 'def' adds a copy of the refs in target-def order for fast def-scoped queries)" value-name:"ORDERS"`
+
+	EncryptionKeyEnv string `long:"encryption-key-env" description:"encrypt store data at rest using the base64-encoded AES key in this environment variable" value-name:"VAR"`
+
+	QueryLog bool `long:"query-log" description:"log queries (with their durations and bytes read) to the store's query-logs dir, for later use with 'srclib store replay-queries' (MultiRepoStore only; the store can only be queried, not imported into)"`
+
+	SlowQueryThreshold  time.Duration `long:"slow-query-threshold" description:"log queries that take at least this long (with their filters, the strategies chosen, and per-stage timings) as JSON lines to stderr (MultiRepoStore only; the store can only be queried, not imported into)"`
+	SlowQuerySampleRate float64       `long:"slow-query-sample-rate" description:"fraction (between 0 and 1) of slow queries to log (0 means all)"`
+
+	ShadowReadRate float64 `long:"shadow-read-rate" description:"verify this fraction (between 0 and 1) of defs and refs queries by repeating them with full scans in the background, and log the queries whose indexed and scanned results differ to stderr (MultiRepoStore only; the store can only be queried, not imported into)"`
+
+	DedupeQueries bool `long:"dedupe-queries" description:"make concurrent identical queries share a single execution (MultiRepoStore only; the store can only be queried, not imported into)"`
+
+	QueryCache int `long:"query-cache" description:"cache the results of up to this many queries until data is next imported (MultiRepoStore only; the store can only be queried, not imported into)" value-name:"N"`
+
+	ShareUnitData bool `long:"share-unit-data" description:"share identical source unit data files between a repo's trees by hard-linking them, so that unchanged units of successive commits are stored only once (MultiRepoStore on a local filesystem that supports hard links only; run 'srclib store gc-shared-data' to remove unreferenced data)"`
+
+	ContentAddressed bool `long:"content-addressed" description:"store source unit data files under the digests of their content, so that identical files in any trees of any repos are stored only once (MultiRepoStore only; a store imported with this option must always be opened with it; run 'srclib store gc-content-store' to remove unreferenced data)"`
+
+	Synonyms string `long:"synonyms" description:"expand def queries with the synonyms in this file, which contains one comma- or space-separated group of interchangeable terms (e.g., 'init, initialize') per line (MultiRepoStore only; the store can only be queried, not imported into)" value-name:"FILE"`
+
+	Codec string `long:"codec" description:"codec to encode a new store's data files in (json|protobuf); it is recorded in the store's manifest when data is first imported, and stores with a manifest always use the recorded codec (the codec of a store created before stores had manifests is detected from its data; MultiRepoStore only)"`
+
+	IndexProfile string   `long:"index-profile" description:"don't build the rarely-used indexes that this profile skips, trading query speed for import cost (full|archival; 'archival' skips the def query indexes; MultiRepoStore only)" value-name:"PROFILE"`
+	SkipIndexes  []string `long:"skip-index" description:"don't build this index (in addition to those skipped by --index-profile); queries that would use it fall back to other indexes or scans (may be specified multiple times; MultiRepoStore only)" value-name:"NAME"`
+
+	PinIndexes []string `long:"pin-indexes" description:"read all indexes of this repo's trees (or of a single tree, with REPO@COMMIT) into memory when the store is opened and keep them loaded, for low query latency (may be specified multiple times; MultiRepoStore only)" value-name:"REPO[@COMMIT]"`
+
+	// fs, bytesRead, and written are set by store.
+	fs        rwvfs.WalkableFileSystem
+	bytesRead func() int64
+	written   *store.WriteAmplification
 }
 
 var storeCmd StoreCmd
@@ -152,6 +433,9 @@ func (c *StoreCmd) Execute(args []string) error { return nil }
 // options.
 func (c *StoreCmd) store() (interface{}, error) {
 	fs := rwvfs.OS(c.Root)
+	if c.ShareUnitData {
+		fs = store.NewHardLinkOSFS(c.Root)
+	}
 
 	type createParents interface {
 		CreateParentDirs(bool)
@@ -160,13 +444,160 @@ func (c *StoreCmd) store() (interface{}, error) {
 		fs.CreateParentDirs(true)
 	}
 
+	if c.StrictDefKeys {
+		store.StrictDefKeys = true
+	}
+	if c.IndexMemoryBudget != 0 {
+		store.SetIndexMemoryBudget(c.IndexMemoryBudget)
+	}
+	if c.MaxRecordSize != 0 {
+		store.MaxRecordSize = c.MaxRecordSize
+	}
+	if c.ScanWorkers != 0 {
+		store.ScanWorkers = c.ScanWorkers
+	}
+
+	if c.RefOrders != "" {
+		orders, err := store.ParseRefSortOrders(c.RefOrders)
+		if err != nil {
+			return nil, fmt.Errorf("invalid store --ref-orders: %s", err)
+		}
+		store.RefOrders = orders
+	}
+
+	var conf struct {
+		store.FSStoreConf
+		Quotas store.RepoQuotas // MultiRepoStore only
+
+		ImportAllowList store.ImportAllowList // MultiRepoStore only
+
+		ImportLimits store.ImportLimits // MultiRepoStore only
+
+		// Import notifiers (MultiRepoStore only)
+		Webhooks []*store.WebhookNotifier
+		Kafka    []*store.KafkaNotifier
+	}
+	if c.Config != "" {
+		if err := json.Unmarshal([]byte(c.Config), &conf); err != nil {
+			return nil, fmt.Errorf("invalid store --config: %s", err)
+		}
+		if err := conf.ImportAllowList.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid store --config: %s", err)
+		}
+	}
+
+	wfs, err := store.NewWritePolicyFS(fs, conf.FSStoreConf)
+	if err != nil {
+		return nil, fmt.Errorf("invalid store --config: %s", err)
+	}
+	wfs = store.NewThrottledFS(wfs, conf.FSStoreConf)
+	if c.EncryptionKeyEnv != "" {
+		wfs = store.NewEncryptedFS(wfs, store.EnvKey(c.EncryptionKeyEnv))
+	}
+	c.fs = wfs
+	wfs, c.bytesRead = store.NewReadCountingFS(wfs)
+	wfs, c.written = store.NewWriteCountingFS(wfs)
+
 	switch c.Type {
 	case "RepoStore":
-		return store.NewFSRepoStore(rwvfs.Walkable(fs)), nil
+		if err := c.checkMultiRepoStoreFlags(); err != nil {
+			return nil, err
+		}
+		return store.NewFSRepoStore(wfs), nil
 	case "MultiRepoStore":
-		return store.NewFSMultiRepoStore(rwvfs.Walkable(fs), nil), nil
+		var notifiers []store.ImportNotifier
+		for _, n := range conf.Webhooks {
+			notifiers = append(notifiers, n)
+		}
+		for _, n := range conf.Kafka {
+			notifiers = append(notifiers, n)
+		}
+		pinIndexes, err := store.ParsePinnedVersions(c.PinIndexes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid store --pin-indexes: %s", err)
+		}
+		if c.Codec != "" {
+			if _, err := store.ParseCodec(c.Codec); err != nil {
+				return nil, fmt.Errorf("invalid store --codec: %s", err)
+			}
+		}
+		if c.IndexProfile != "" {
+			if _, ok := store.IndexProfiles[c.IndexProfile]; !ok {
+				return nil, fmt.Errorf("invalid store --index-profile: %q (valid values are %s)", c.IndexProfile, strings.Join(indexProfileNames(), ", "))
+			}
+		}
+		for _, name := range c.SkipIndexes {
+			if !isSkippableIndex(name) {
+				return nil, fmt.Errorf("invalid store --skip-index: %q (valid values are %s)", name, strings.Join(store.SkippableIndexes, ", "))
+			}
+		}
+		var s store.MultiRepoStore
+		s, err = store.OpenFSMultiRepoStore(wfs, &store.FSMultiRepoStoreConf{Quotas: conf.Quotas, Notifiers: notifiers, ShareUnitData: c.ShareUnitData, ContentAddressed: c.ContentAddressed, PinIndexes: pinIndexes, ImportAllowList: conf.ImportAllowList, ImportLimits: conf.ImportLimits, Codec: c.Codec, IndexProfile: c.IndexProfile, SkipIndexes: c.SkipIndexes, LazyIndexes: c.LazyIndex})
+		if err != nil {
+			return nil, err
+		}
+		if len(pinIndexes) > 0 {
+			stats, err := s.(store.MultiRepoPinnedIndexes).PinnedIndexes()
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("# Pinned %d indexes of %d trees (approx. %d bytes).", stats.Indexes, len(stats.Trees), stats.Bytes)
+		}
+		if c.Synonyms != "" {
+			f, err := os.Open(c.Synonyms)
+			if err != nil {
+				return nil, err
+			}
+			t, err := store.ReadSynonymTable(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("invalid store --synonyms file: %s", err)
+			}
+			s = store.NewSynonymStore(s, t)
+		}
+
+		// The middlewares are listed outermost first.
+		var mws []store.Middleware
+		if c.QueryLog {
+			// The log is never closed; each entry is written to it
+			// as soon as the query completes.
+			w, err := store.CreateQueryLog(c.fs)
+			if err != nil {
+				return nil, err
+			}
+			mws = append(mws, store.LoggingMiddleware(w, c.bytesRead))
+		}
+		if c.DedupeQueries {
+			// Slow-query logging (below) logs each shared execution
+			// once; query logging (above) logs every query.
+			mws = append(mws, store.SingleflightMiddleware())
+		}
+		if c.QueryCache != 0 {
+			mws = append(mws, store.CacheMiddleware(c.QueryCache))
+		}
+		if c.SlowQueryThreshold != 0 {
+			mws = append(mws, store.SlowQueryLoggingMiddleware(store.SlowQueryLogOptions{
+				Threshold:  c.SlowQueryThreshold,
+				SampleRate: c.SlowQuerySampleRate,
+				Sink:       store.NewQueryLogWriter(os.Stderr),
+			}))
+		}
+		if c.ShadowReadRate != 0 {
+			// Verifications run in the background; bound them so that
+			// they can't pile up full scans under load.
+			mws = append(mws, store.ShadowReadMiddleware(store.ShadowReadOptions{
+				SampleRate:    c.ShadowReadRate,
+				MaxConcurrent: 4,
+			}))
+		}
+		return store.Chain(s, mws...), nil
+	case "LegacyBuildStore":
+		if err := c.checkMultiRepoStoreFlags(); err != nil {
+			return nil, err
+		}
+		return store.NewLegacyBuildStore(wfs), nil
 	default:
-		return nil, fmt.Errorf("unrecognized store --type value: %q (valid values are RepoStore, MultiRepoStore)", c.Type)
+		return nil, fmt.Errorf("unrecognized store --type value: %q (valid values are RepoStore, MultiRepoStore, LegacyBuildStore)", c.Type)
 	}
 }
 
@@ -175,10 +606,15 @@ type StoreImportCmd struct {
 
 	Quiet bool `short:"q" long:"quiet" description:"silence all output"`
 
+	Archive string `long:"archive" description:"import the build data in this gzipped tar archive of a build data dir (e.g., uploaded by a CI job that ran the graphers), or '-' for stdin, instead of the local .srclib-cache" value-name:"FILE"`
+	Upload  string `long:"upload" description:"upload the --archive file (in resumable chunks) to the import server at this URL (see 'srclib store import-server'), which imports it" value-name:"URL"`
+
 	Sample           bool `long:"sample" description:"(sample data) import sample data, not .srclib-cache data"`
 	SampleDefs       int  `long:"sample-defs" description:"(sample data) number of sample defs to import" default:"100"`
 	SampleRefs       int  `long:"sample-refs" description:"(sample data) number of sample refs to import" default:"100"`
 	SampleImportOnly bool `long:"sample-import-only" description:"(sample data) only import, don't demonstrate listing data"`
+
+	WriteAmplification bool `long:"write-amplification" description:"after importing, print the bytes written to each index and to the source unit data (to see what each index costs, and which indexes to skip with --index-profile or --skip-index)"`
 }
 
 var storeImportCmd StoreImportCmd
@@ -186,6 +622,10 @@ var storeImportCmd StoreImportCmd
 func (c *StoreImportCmd) Execute(args []string) error {
 	start := time.Now()
 
+	if c.Upload != "" {
+		return c.upload(start)
+	}
+
 	s, err := OpenStore()
 	if err != nil {
 		return err
@@ -195,6 +635,26 @@ func (c *StoreImportCmd) Execute(args []string) error {
 		return c.sample(s)
 	}
 
+	if c.Archive != "" {
+		if GlobalOpt.Verbose {
+			log.Printf("# Importing build data archive %s for %s (commit %s)", c.Archive, c.Repo, c.CommitID)
+		}
+		r := io.Reader(os.Stdin)
+		if c.Archive != "-" {
+			f, err := os.Open(c.Archive)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		if err := ImportFromArchive(r, s, c.ImportOpt); err != nil {
+			return err
+		}
+		c.logCompleted(start)
+		return nil
+	}
+
 	bdfs, err := GetBuildDataFS(c.CommitID)
 	if err != nil {
 		return err
@@ -203,25 +663,153 @@ func (c *StoreImportCmd) Execute(args []string) error {
 		log.Printf("# Importing build data for %s (commit %s)", c.Repo, c.CommitID)
 	}
 
+	if lrepo, err := OpenLocalRepo(); err == nil && lrepo != nil && lrepo.RootDir != "" {
+		// Read source files as of the imported commit, not from the
+		// working tree (which may be modified or at another commit).
+		c.SourceFS, err = sourceFSAt(lrepo, c.CommitID)
+		if err != nil {
+			return err
+		}
+		if c.SourceFS == nil && GlobalOpt.Verbose {
+			log.Printf("# Working tree is not a clean checkout of commit %s; not building line tables.", c.CommitID)
+		}
+		c.RepoDir = lrepo.RootDir
+	}
+
 	if err := Import(bdfs, s, c.ImportOpt); err != nil {
 		return err
 	}
+	c.logCompleted(start)
+	return nil
+}
+
+// logCompleted logs that the import completed, and the bytes it wrote
+// (if --write-amplification is set).
+func (c *StoreImportCmd) logCompleted(start time.Time) {
 	if !c.Quiet {
 		log.Printf("# Import completed in %s.", time.Since(start))
 	}
+	if c.WriteAmplification && storeCmd.written != nil {
+		log.Printf("# Bytes written:\n%s", storeCmd.written)
+	}
+}
+
+// checkMultiRepoStoreFlags returns an error if any of the options that
+// only apply to a MultiRepoStore are set.
+func (c *StoreCmd) checkMultiRepoStoreFlags() error {
+	var set []string
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"--query-log", c.QueryLog},
+		{"--slow-query-threshold", c.SlowQueryThreshold != 0},
+		{"--shadow-read-rate", c.ShadowReadRate != 0},
+		{"--dedupe-queries", c.DedupeQueries},
+		{"--query-cache", c.QueryCache != 0},
+		{"--synonyms", c.Synonyms != ""},
+		{"--share-unit-data", c.ShareUnitData},
+		{"--content-addressed", c.ContentAddressed},
+		{"--pin-indexes", len(c.PinIndexes) > 0},
+		{"--codec", c.Codec != ""},
+		{"--index-profile", c.IndexProfile != ""},
+		{"--skip-index", len(c.SkipIndexes) > 0},
+		{"--lazy-index", c.LazyIndex},
+	} {
+		if f.set {
+			set = append(set, f.name)
+		}
+	}
+	if len(set) == 0 {
+		return nil
+	}
+	return fmt.Errorf("only --type=MultiRepoStore supports %s", strings.Join(set, ", "))
+}
+
+// indexProfileNames returns the sorted names of store.IndexProfiles.
+func indexProfileNames() []string {
+	names := make([]string, 0, len(store.IndexProfiles))
+	for name := range store.IndexProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isSkippableIndex reports whether name is one of
+// store.SkippableIndexes.
+func isSkippableIndex(name string) bool {
+	for _, n := range store.SkippableIndexes {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// upload uploads the --archive file to the --upload import server.
+func (c *StoreImportCmd) upload(start time.Time) error {
+	if c.Archive == "" || c.Archive == "-" {
+		return fmt.Errorf("--upload requires an --archive file")
+	}
+	if c.Repo == "" || c.CommitID == "" {
+		return fmt.Errorf("--upload requires --repo and --commit")
+	}
+	f, err := os.Open(c.Archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	u := &ImportUploader{URL: c.Upload, Verbose: GlobalOpt.Verbose}
+	if err := u.Upload(f, fi.Size(), c.Repo, c.CommitID); err != nil {
+		return err
+	}
+	if !c.Quiet {
+		log.Printf("# Upload and import completed in %s.", time.Since(start))
+	}
 	return nil
 }
 
 type ImportOpt struct {
-	DryRun  bool `short:"n" long:"dry-run" description:"print what would be done but don't do anything"`
+	DryRun  bool `short:"n" long:"dry-run" description:"print which source units would be written, updated, or skipped (because their data is unchanged) and which indexes would be rebuilt, but don't write anything"`
 	NoIndex bool `long:"no-index" description:"don't build indexes (indexes inside a single source unit are always built)"`
 
+	ResolveDefRepos bool `long:"resolve-def-repos" description:"rewrite refs' DefRepo clone URLs to repo URIs using the dependency resolution (depresolve) output"`
+	Blame           bool `long:"blame" description:"record the author of each def (using git blame)"`
+	CodeOwners      bool `long:"codeowners" description:"record the owners of each source unit and def (using the repository's CODEOWNERS file)"`
+	Tokens          bool `long:"tokens" description:"build a token index of the identifiers in refs' spans (queryable with 'srclib store tokens')"`
+
+	UnitMetadata []string `long:"unit-metadata" description:"set a metadata value on each imported source unit, as KEY=VALUE (queryable with 'srclib store units --metadata'); may be specified multiple times" value-name:"KEY=VALUE"`
+
+	MaxDefs  int   `long:"max-defs" description:"fail if any source unit has more than this many defs"`
+	MaxRefs  int   `long:"max-refs" description:"fail if any source unit has more than this many refs"`
+	MaxBytes int64 `long:"max-bytes" description:"fail if any source unit's estimated imported data size exceeds this many bytes"`
+
+	SignKey   string `long:"sign-key" description:"sign the imported tree data with the private key in this PEM file" value-name:"FILE"`
+	SignKeyID string `long:"sign-key-id" description:"key ID to record in the tree signature (default: the --sign-key file name)"`
+
 	Repo     string `long:"repo" description:"only import for this repo"`
 	Unit     string `long:"unit" description:"only import source units with this name"`
 	UnitType string `long:"unit-type" description:"only import source units with this type"`
 	CommitID string `long:"commit" description:"commit ID of commit whose data to import"`
 
-	Verbose bool
+	// SourceFS, if set, contains the source files of the tree being
+	// imported (as of CommitID, not a working tree that may differ
+	// from it). It is used to build the line tables (for translating
+	// between byte offsets and line/column positions) of each source
+	// unit's files. It is required by the CodeOwners and Tokens
+	// options.
+	SourceFS vfs.FileSystem
+
+	// RepoDir, if set, is the directory of the repository being
+	// imported. It is required by the Blame option.
+	RepoDir string
+
+	Verbose bool
 }
 
 // Import imports build data into a RepoStore or MultiRepoStore.
@@ -238,6 +826,44 @@ func Import(buildDataFS vfs.FileSystem, stor interface{}, opt ImportOpt) error {
 		return fmt.Errorf("error calling plan.Makefile: %s", err)
 	}
 
+	var signKey crypto.Signer
+	if opt.SignKey != "" {
+		signKey, err = readPrivateKeyFile(opt.SignKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	var metadata map[string]string
+	for _, spec := range opt.UnitMetadata {
+		i := strings.Index(spec, "=")
+		if i <= 0 {
+			return fmt.Errorf("invalid --unit-metadata %q (must be KEY=VALUE)", spec)
+		}
+		if metadata == nil {
+			metadata = map[string]string{}
+		}
+		metadata[spec[:i]] = spec[i+1:]
+	}
+
+	if opt.Tokens && opt.SourceFS == nil {
+		return errors.New("no source files (required for --tokens)")
+	}
+
+	var owners codeowners.Ruleset
+	if opt.CodeOwners {
+		if opt.SourceFS == nil {
+			return errors.New("no source files (required for --codeowners)")
+		}
+		owners, err = codeowners.Find(opt.SourceFS)
+		if err != nil {
+			return fmt.Errorf("error reading CODEOWNERS: %s", err)
+		}
+		if owners == nil {
+			log.Printf("Warning: no CODEOWNERS file found; not recording owners.")
+		}
+	}
+
 	// hasIndexableData is set if at least one source unit's graph data is
 	// successfully imported to the graph store.
 	//
@@ -251,11 +877,37 @@ func Import(buildDataFS vfs.FileSystem, stor interface{}, opt ImportOpt) error {
 	var (
 		mu               sync.Mutex
 		hasIndexableData bool
+		resolveStats     grapher.ResolveStats
+		lineTables       = map[string]store.LineTable{}
+		tokens           = store.TokenIndex{}
+		dryRun           store.ImportDryRun
 	)
 
+	// depFiles maps each source unit to the file containing its
+	// dependency resolution output (used when opt.ResolveDefRepos is
+	// set).
+	depFiles := map[unit.ID2]string{}
+	for _, rule := range mf.Rules {
+		if rule, ok := rule.(*dep.ResolveDepsRule); ok {
+			depFiles[rule.Unit.ID2()] = rule.Target()
+		}
+	}
+
 	importGraphData := func(graphFile string, sourceUnit *unit.SourceUnit) error {
+		// The limits are checked while the data is decoded, so that
+		// a unit that is too large isn't read into memory in full.
+		limits := store.ImportLimits{MaxDefs: opt.MaxDefs, MaxRefs: opt.MaxRefs, MaxBytes: opt.MaxBytes}
 		var data graph.Output
-		if err := readJSONFileFS(buildDataFS, graphFile, &data); err != nil {
+		if err := readFileFS(buildDataFS, graphFile, func(r io.Reader) error {
+			d, err := limits.DecodeOutput(r, sourceUnit.Type+" "+sourceUnit.Name)
+			if err == nil {
+				data = *d
+			}
+			return err
+		}); err != nil {
+			if store.IsImportTooLarge(err) {
+				return err
+			}
 			if err == errEmptyJSONFile {
 				log.Printf("Warning: the JSON file is empty for unit %s %s.", sourceUnit.Type, sourceUnit.Name)
 				return nil
@@ -266,11 +918,45 @@ func Import(buildDataFS vfs.FileSystem, stor interface{}, opt ImportOpt) error {
 			}
 			return fmt.Errorf("error reading JSON file %s for unit %s %s: %s", graphFile, sourceUnit.Type, sourceUnit.Name, err)
 		}
+		if opt.ResolveDefRepos {
+			if depFile, present := depFiles[sourceUnit.ID2()]; present {
+				var deps []*dep.Resolution
+				if err := readJSONFileFS(buildDataFS, depFile, &deps); err != nil && err != errEmptyJSONFile && !os.IsNotExist(err) {
+					return fmt.Errorf("error reading JSON file %s for unit %s %s: %s", depFile, sourceUnit.Type, sourceUnit.Name, err)
+				}
+				stats := grapher.ResolveRefDefRepos(data.Refs, deps)
+				mu.Lock()
+				resolveStats.Add(stats)
+				mu.Unlock()
+			}
+		}
+
+		if opt.Blame {
+			if err := blameDefs(opt.RepoDir, opt.CommitID, data.Defs); err != nil {
+				return fmt.Errorf("error getting authorship of defs in unit %s %s: %s", sourceUnit.Type, sourceUnit.Name, err)
+			}
+		}
+
+		if metadata != nil {
+			if sourceUnit.Metadata == nil {
+				sourceUnit.Metadata = make(map[string]string, len(metadata))
+			}
+			for k, v := range metadata {
+				sourceUnit.Metadata[k] = v
+			}
+		}
+
+		if owners != nil {
+			sourceUnit.Owners = owners.FilesOwners(sourceUnit.Files)
+			for _, def := range data.Defs {
+				if def.File != "" {
+					def.Owners = owners.Owners(def.File)
+				}
+			}
+		}
+
 		if opt.DryRun || GlobalOpt.Verbose {
 			log.Printf("# Importing graph data (%d defs, %d refs, %d docs, %d anns) for unit %s %s", len(data.Defs), len(data.Refs), len(data.Docs), len(data.Anns), sourceUnit.Type, sourceUnit.Name)
-			if opt.DryRun {
-				return nil
-			}
 		}
 
 		// HACK: Transfer docs to [def].Docs.
@@ -284,6 +970,24 @@ func Import(buildDataFS vfs.FileSystem, stor interface{}, opt ImportOpt) error {
 			}
 		}
 
+		if opt.DryRun {
+			var plan *store.UnitImportPlan
+			var err error
+			switch dr := stor.(type) {
+			case store.RepoImportDryRunner:
+				plan, err = dr.DryRunImport(opt.CommitID, sourceUnit, data)
+			case store.MultiRepoImportDryRunner:
+				plan, err = dr.DryRunImport(opt.Repo, opt.CommitID, sourceUnit, data)
+			default:
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("error computing dry-run import of unit %s %s: %s", sourceUnit.Type, sourceUnit.Name, err)
+			}
+			dryRun.Add(plan)
+			return nil
+		}
+
 		switch imp := stor.(type) {
 		case store.RepoImporter:
 			if err := imp.Import(opt.CommitID, sourceUnit, data); err != nil {
@@ -297,8 +1001,43 @@ func Import(buildDataFS vfs.FileSystem, stor interface{}, opt ImportOpt) error {
 			return fmt.Errorf("store (type %T) does not implement importing", stor)
 		}
 
+		var (
+			unitLineTables map[string]store.LineTable
+			unitTokens     store.TokenIndex
+		)
+		if opt.SourceFS != nil {
+			unitLineTables = make(map[string]store.LineTable, len(sourceUnit.Files))
+			var refsByFile map[string][]*graph.Ref
+			if opt.Tokens {
+				unitTokens = store.TokenIndex{}
+				refsByFile = map[string][]*graph.Ref{}
+				for _, ref := range data.Refs {
+					refsByFile[ref.File] = append(refsByFile[ref.File], ref)
+				}
+			}
+			for _, file := range sourceUnit.Files {
+				src, err := vfs.ReadFile(opt.SourceFS, file)
+				if err != nil {
+					if os.IsNotExist(err) {
+						continue
+					}
+					return fmt.Errorf("error reading source file %s for unit %s %s: %s", file, sourceUnit.Type, sourceUnit.Name, err)
+				}
+				unitLineTables[file] = store.NewLineTable(src)
+				if refs := refsByFile[file]; len(refs) > 0 {
+					unitTokens.AddRefs(file, src, refs)
+				}
+			}
+		}
+
 		mu.Lock()
 		hasIndexableData = true
+		for file, t := range unitLineTables {
+			lineTables[file] = t
+		}
+		for tok, spans := range unitTokens {
+			tokens[tok] = append(tokens[tok], spans...)
+		}
 		mu.Unlock()
 
 		return nil
@@ -339,6 +1078,65 @@ func Import(buildDataFS vfs.FileSystem, stor interface{}, opt ImportOpt) error {
 		return err
 	}
 
+	if opt.ResolveDefRepos && (opt.DryRun || GlobalOpt.Verbose) {
+		log.Printf("# Resolved ref DefRepos: %d of %d refs rewritten to repo URIs (%d clone URLs left unresolved)", resolveStats.Rewritten, resolveStats.Refs, resolveStats.Unresolved)
+	}
+
+	if opt.DryRun {
+		printImportDryRun(&dryRun)
+		return nil
+	}
+
+	if len(lineTables) > 0 {
+		if GlobalOpt.Verbose {
+			log.Printf("# Importing line tables for %d files", len(lineTables))
+		}
+		switch s := stor.(type) {
+		case store.RepoLineTables:
+			if err := s.ImportLineTables(opt.CommitID, lineTables); err != nil {
+				return fmt.Errorf("error importing line tables for commit %s: %s", opt.CommitID, err)
+			}
+		case store.MultiRepoLineTables:
+			if err := s.ImportLineTables(opt.Repo, opt.CommitID, lineTables); err != nil {
+				return fmt.Errorf("error importing line tables for %s@%s: %s", opt.Repo, opt.CommitID, err)
+			}
+		}
+	}
+
+	if len(tokens) > 0 {
+		if GlobalOpt.Verbose {
+			log.Printf("# Importing token index (%d distinct tokens)", len(tokens))
+		}
+		switch s := stor.(type) {
+		case store.RepoTokenIndex:
+			if err := s.ImportTokens(opt.CommitID, tokens); err != nil {
+				return fmt.Errorf("error importing token index for commit %s: %s", opt.CommitID, err)
+			}
+		case store.MultiRepoTokenIndex:
+			if err := s.ImportTokens(opt.Repo, opt.CommitID, tokens); err != nil {
+				return fmt.Errorf("error importing token index for %s@%s: %s", opt.Repo, opt.CommitID, err)
+			}
+		default:
+			log.Printf("Warning: store (type %T) does not implement token indexes; not importing token index.", stor)
+		}
+	}
+
+	if !opt.DryRun && len(treeConfig.SourceUnits) > 0 {
+		if GlobalOpt.Verbose {
+			log.Printf("# Importing scan results (%d source units)", len(treeConfig.SourceUnits))
+		}
+		switch s := stor.(type) {
+		case store.RepoScanResults:
+			if err := s.ImportScan(opt.CommitID, treeConfig.SourceUnits); err != nil {
+				return fmt.Errorf("error importing scan results for commit %s: %s", opt.CommitID, err)
+			}
+		case store.MultiRepoScanResults:
+			if err := s.ImportScan(opt.Repo, opt.CommitID, treeConfig.SourceUnits); err != nil {
+				return fmt.Errorf("error importing scan results for %s@%s: %s", opt.Repo, opt.CommitID, err)
+			}
+		}
+	}
+
 	if hasIndexableData && !opt.NoIndex {
 		if GlobalOpt.Verbose {
 			log.Printf("# Building indexes")
@@ -366,6 +1164,125 @@ func Import(buildDataFS vfs.FileSystem, stor interface{}, opt ImportOpt) error {
 		}
 	}
 
+	if signKey != nil && !opt.DryRun {
+		keyID := opt.SignKeyID
+		if keyID == "" {
+			keyID = filepath.Base(opt.SignKey)
+		}
+		if GlobalOpt.Verbose {
+			log.Printf("# Signing tree data with key %q", keyID)
+		}
+		switch s := stor.(type) {
+		case store.RepoTreeSigning:
+			if err := s.SignTree(opt.CommitID, keyID, signKey); err != nil {
+				return fmt.Errorf("error signing commit %s: %s", opt.CommitID, err)
+			}
+		case store.MultiRepoTreeSigning:
+			if err := s.SignTree(opt.Repo, opt.CommitID, keyID, signKey); err != nil {
+				return fmt.Errorf("error signing %s@%s: %s", opt.Repo, opt.CommitID, err)
+			}
+		default:
+			return fmt.Errorf("store (type %T) does not implement signing tree data", stor)
+		}
+	}
+
+	return nil
+}
+
+// printImportDryRun prints the report of a dry-run import.
+func printImportDryRun(r *store.ImportDryRun) {
+	for _, p := range r.Plans() {
+		log.Printf("# %-6s unit %s %s (%d defs, %d refs, %d bytes, digest %.12s)", p.Action, p.Unit.Type, p.Unit.Name, p.Defs, p.Refs, p.Bytes, p.Digest)
+		if len(p.UnitIndexes) > 0 && GlobalOpt.Verbose {
+			log.Printf("#        would rebuild unit indexes: %s", strings.Join(p.UnitIndexes, ", "))
+		}
+	}
+	log.Printf("# Dry run: %d units would be written, %d updated, and %d skipped (%d bytes would be written).", r.Count(store.ImportWrite), r.Count(store.ImportUpdate), r.Count(store.ImportSkip), r.Bytes())
+	if xs := r.TreeIndexes(); len(xs) > 0 {
+		log.Printf("# Dry run: tree indexes that would be rebuilt: %s", strings.Join(xs, ", "))
+	}
+}
+
+// readPrivateKeyFile reads a PEM-encoded RSA or ECDSA private key
+// (in PKCS #1, SEC 1, or PKCS #8 form).
+func readPrivateKeyFile(filename string) (crypto.Signer, error) {
+	block, err := readPEMFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if key, ok := key.(crypto.Signer); ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: unsupported private key type (PEM block type %q)", filename, block.Type)
+}
+
+// readPublicKeyFile reads a PEM-encoded (PKIX) public key.
+func readPublicKeyFile(filename string) (crypto.PublicKey, error) {
+	block, err := readPEMFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return key, nil
+}
+
+func readPEMFile(filename string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", filename)
+	}
+	return block, nil
+}
+
+// blameDefs records the author of each def in defs (see package
+// blame).
+func blameDefs(repoDir, commitID string, defs []*graph.Def) error {
+	if repoDir == "" {
+		return errors.New("no repository directory (required for --blame)")
+	}
+
+	defsByFile := map[string][]*graph.Def{}
+	for _, def := range defs {
+		if def.File != "" {
+			defsByFile[def.File] = append(defsByFile[def.File], def)
+		}
+	}
+	var n int
+	for file, fileDefs := range defsByFile {
+		// Read the file as of the blamed commit, not from the working
+		// tree (which may be modified or checked out at another
+		// commit), so that the defs' offsets refer to blamed lines.
+		src, err := blame.Source(repoDir, commitID, file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		lines, err := blame.File(repoDir, commitID, file)
+		if err != nil {
+			return err
+		}
+		n += blame.AnnotateDefs(fileDefs, src, lines)
+	}
+	if GlobalOpt.Verbose {
+		log.Printf("# Recorded authors of %d of %d defs", n, len(defs))
+	}
 	return nil
 }
 
@@ -738,94 +1655,1249 @@ func doStoreIndexesCmd(crit store.IndexCriteria, opt storeIndexOptions, f func(i
 				}
 				colorable.Println()
 
-				if err := printIndex(x); err != nil {
-					log.Fatal(err)
-				}
+				if err := printIndex(x); err != nil {
+					log.Fatal(err)
+				}
+
+				lastRepo = x.Repo
+				lastCommitID = x.CommitID
+				lastUnit = x.Unit
+			}
+			done <- struct{}{}
+		}()
+	default:
+		return fmt.Errorf("unexpected --output value: %q", opt.Output)
+	}
+
+	_, err = f(s, crit, indexChan)
+	defer func() {
+		close(indexChan)
+		<-done
+	}()
+	if err != nil {
+		return err
+	}
+	if hasError {
+		return errors.New("\nindex listing or index building errors occurred (see above)")
+	}
+	return nil
+}
+
+type storeIndexOptions struct {
+	Output   string `short:"o" long:"output" description:"output format (text|json)" default:"text"`
+	Parallel int    `short:"p" long:"parallel" description:"parallelism (may produce out-of-order output)" default:"1"`
+
+	Print bool `long:"print" description:"(debug) print representation of index"`
+}
+
+type StoreVerifyCmd struct {
+	Repo     string `long:"repo" description:"repo whose tree to verify (only for MultiRepoStore)"`
+	CommitID string `long:"commit" description:"commit ID of the tree to verify" required:"yes"`
+
+	TrustedKeys []string `long:"trusted-key" description:"a trusted public key, as ID=FILE (FILE is a PEM-encoded public key); may be specified multiple times" required:"yes"`
+
+	NoRebuildIndexes bool `long:"no-rebuild-indexes" description:"don't rebuild the tree's indexes (which the signature doesn't cover) after verifying it; indexed queries may then return unsigned data"`
+}
+
+var storeVerifyCmd StoreVerifyCmd
+
+func (c *StoreVerifyCmd) Execute(args []string) error {
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+
+	keys := make(store.TrustedKeys, len(c.TrustedKeys))
+	for _, spec := range c.TrustedKeys {
+		i := strings.Index(spec, "=")
+		if i == -1 {
+			return fmt.Errorf("invalid --trusted-key %q (must be ID=FILE)", spec)
+		}
+		key, err := readPublicKeyFile(spec[i+1:])
+		if err != nil {
+			return err
+		}
+		keys[spec[:i]] = key
+	}
+
+	switch s := s.(type) {
+	case store.RepoTreeSigning:
+		err = s.VerifyTree(c.CommitID, keys)
+	case store.MultiRepoTreeSigning:
+		err = s.VerifyTree(c.Repo, c.CommitID, keys)
+	default:
+		return fmt.Errorf("store (type %T) does not implement verifying tree signatures", s)
+	}
+	if err != nil {
+		return err
+	}
+	if GlobalOpt.Verbose {
+		log.Printf("# Tree signature is valid.")
+	}
+
+	if c.NoRebuildIndexes {
+		log.Printf("# Note: the signature doesn't cover the tree's indexes. Rebuild them before trusting indexed queries.")
+		return nil
+	}
+	built, err := store.BuildIndexes(s, store.IndexCriteria{Repo: c.Repo, CommitID: c.CommitID}, nil)
+	if err != nil {
+		return err
+	}
+	for _, x := range built {
+		if x.BuildError != "" {
+			return fmt.Errorf("rebuilding index %s: %s", x.Name, x.BuildError)
+		}
+	}
+	if GlobalOpt.Verbose {
+		log.Printf("# Rebuilt %d indexes.", len(built))
+	}
+	return nil
+}
+
+type StoreManifestCmd struct {
+	Repo     string `long:"repo" description:"repo of the tree (only for MultiRepoStore)"`
+	CommitID string `long:"commit" description:"commit ID of the tree" required:"yes"`
+	Verify   bool   `long:"verify" description:"report the differences between the manifest and the tree's files (and fail if there are any)"`
+	Write    bool   `long:"write" description:"rewrite the manifest from the tree's current files"`
+	Output   string `short:"o" long:"output" description:"output format (text|json)" default:"text"`
+}
+
+var storeManifestCmd StoreManifestCmd
+
+func (c *StoreManifestCmd) Execute(args []string) error {
+	if c.Verify && c.Write {
+		return errors.New("--verify and --write are mutually exclusive")
+	}
+
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+
+	var (
+		m          *store.TreeManifest
+		mismatches []store.TreeManifestMismatch
+	)
+	switch s := s.(type) {
+	case store.RepoTreeManifests:
+		switch {
+		case c.Verify:
+			mismatches, err = s.VerifyTreeManifest(c.CommitID)
+		case c.Write:
+			m, err = s.WriteTreeManifest(c.CommitID)
+		default:
+			m, err = s.TreeManifest(c.CommitID)
+		}
+	case store.MultiRepoTreeManifests:
+		switch {
+		case c.Verify:
+			mismatches, err = s.VerifyTreeManifest(c.Repo, c.CommitID)
+		case c.Write:
+			m, err = s.WriteTreeManifest(c.Repo, c.CommitID)
+		default:
+			m, err = s.TreeManifest(c.Repo, c.CommitID)
+		}
+	default:
+		return fmt.Errorf("store (type %T) does not implement tree manifests", s)
+	}
+	if err != nil {
+		return err
+	}
+
+	if c.Verify {
+		switch c.Output {
+		case "json":
+			PrintJSON(mismatches, "")
+		case "text":
+			for _, mm := range mismatches {
+				colorable.Println(mm)
+			}
+		default:
+			return fmt.Errorf("unexpected --output value: %q", c.Output)
+		}
+		if len(mismatches) > 0 {
+			return fmt.Errorf("tree does not match its manifest (%d differences)", len(mismatches))
+		}
+		if GlobalOpt.Verbose {
+			log.Printf("# Tree matches its manifest.")
+		}
+		return nil
+	}
+
+	switch c.Output {
+	case "json":
+		PrintJSON(m, "")
+	case "text":
+		for _, f := range m.Files {
+			kind := "data"
+			if f.Index {
+				kind = "index"
+			}
+			colorable.Printf("%s\t%s\t%d\t%s\n", f.Path, kind, f.Size, f.SHA256)
+		}
+	default:
+		return fmt.Errorf("unexpected --output value: %q", c.Output)
+	}
+	return nil
+}
+
+type StoreSyncCmd struct {
+	Dst    string   `long:"dst" description:"root dir of the destination MultiRepoStore" required:"yes" value-name:"DIR"`
+	Repos  []string `long:"repo" description:"only sync this repo (may be specified multiple times)"`
+	Index  bool     `long:"index" description:"build indexes in the destination store for each copied version"`
+	DryRun bool     `short:"n" long:"dry-run" description:"print the versions that would be copied but don't copy them"`
+}
+
+var storeSyncCmd StoreSyncCmd
+
+func (c *StoreSyncCmd) Execute(args []string) error {
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+	src, ok := s.(store.MultiRepoStoreImporter)
+	if !ok {
+		return fmt.Errorf("store (type %T) is not a MultiRepoStore (use --type=MultiRepoStore)", s)
+	}
+
+	dstFS := rwvfs.OS(c.Dst)
+	if err := rwvfs.MkdirAll(dstFS, "."); err != nil {
+		return err
+	}
+	dst := store.NewFSMultiRepoStore(rwvfs.Walkable(dstFS), nil)
+
+	opt := &store.SyncOptions{Repos: c.Repos, Index: c.Index, DryRun: c.DryRun}
+	if GlobalOpt.Verbose || c.DryRun {
+		opt.Log = log.New(os.Stderr, "# ", 0)
+	}
+	stats, err := store.Sync(src, dst, opt)
+	if err != nil {
+		return err
+	}
+	if c.DryRun {
+		log.Printf("# Sync would copy %d versions and skip %d identical versions.", len(stats.Copied), len(stats.Skipped))
+	} else {
+		log.Printf("# Sync copied %d versions (%d source units) and skipped %d identical versions.", len(stats.Copied), stats.Units, len(stats.Skipped))
+	}
+	return nil
+}
+
+type StoreIndexesCmd struct {
+	storeIndexCriteria
+	storeIndexOptions
+}
+
+var storeIndexesCmd StoreIndexesCmd
+
+func (c *StoreIndexesCmd) Execute(args []string) error {
+	return doStoreIndexesCmd(c.IndexCriteria(), c.storeIndexOptions, store.Indexes)
+}
+
+type StoreIndexCmd struct {
+	storeIndexCriteria
+	storeIndexOptions
+}
+
+var storeIndexCmd StoreIndexCmd
+
+func (c *StoreIndexCmd) Execute(args []string) error {
+	return doStoreIndexesCmd(c.IndexCriteria(), c.storeIndexOptions, store.BuildIndexes)
+}
+
+type StoreReposCmd struct {
+	IDContains string `short:"i" long:"id-contains" description:"filter to repos whose ID contains this substring"`
+}
+
+func (c *StoreReposCmd) filters() []store.RepoFilter {
+	var fs []store.RepoFilter
+	if c.IDContains != "" {
+		fs = append(fs, store.RepoFilterFunc(func(repo string) bool { return strings.Contains(repo, c.IDContains) }))
+	}
+	return fs
+}
+
+var storeReposCmd StoreReposCmd
+
+func (c *StoreReposCmd) Execute(args []string) error {
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+
+	mrs, ok := s.(store.MultiRepoStore)
+	if !ok {
+		return fmt.Errorf("store (type %T) does not implement listing repositories", s)
+	}
+
+	repos, err := mrs.Repos(c.filters()...)
+	if err != nil {
+		return err
+	}
+	for _, repo := range repos {
+		colorable.Println(repo)
+	}
+	return nil
+}
+
+type StoreUsageCmd struct {
+	StoreReposCmd
+
+	Update bool `long:"update" description:"recount the sizes of the repos' files before printing their usage (e.g., after data was written without being accounted for)"`
+	Trees  bool `long:"trees" description:"also print the usage of each of the repos' trees"`
+}
+
+var storeUsageCmd StoreUsageCmd
+
+func (c *StoreUsageCmd) Execute(args []string) error {
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+
+	var usages []*store.RepoUsage
+	switch s := s.(type) {
+	case store.MultiRepoStoreUsage:
+		if c.Update {
+			repos, err := s.(store.MultiRepoStore).Repos(c.filters()...)
+			if err != nil {
+				return err
+			}
+			for _, repo := range repos {
+				if err := s.UpdateUsage(repo); err != nil {
+					return err
+				}
+			}
+		}
+		usages, err = s.Usage(c.filters()...)
+		if err != nil {
+			return err
+		}
+	case store.RepoStoreUsage:
+		if c.Update {
+			if err := s.UpdateUsage(); err != nil {
+				return err
+			}
+		}
+		u, err := s.Usage()
+		if err != nil {
+			return err
+		}
+		usages = []*store.RepoUsage{u}
+	default:
+		return fmt.Errorf("store (type %T) does not implement usage accounting", s)
+	}
+
+	for _, u := range usages {
+		colorable.Printf("%d\t%s\n", u.Bytes, u.Repo)
+		if c.Trees {
+			commitIDs := make([]string, 0, len(u.Trees))
+			for commitID := range u.Trees {
+				commitIDs = append(commitIDs, commitID)
+			}
+			sort.Strings(commitIDs)
+			for _, commitID := range commitIDs {
+				colorable.Printf("%d\t  %s\n", u.Trees[commitID], commitID)
+			}
+		}
+	}
+	return nil
+}
+
+type StoreGCSharedDataCmd struct {
+	StoreReposCmd
+}
+
+var storeGCSharedDataCmd StoreGCSharedDataCmd
+
+func (c *StoreGCSharedDataCmd) Execute(args []string) error {
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+	gc, ok := s.(store.MultiRepoSharedDataGC)
+	if !ok {
+		return fmt.Errorf("store (type %T) does not support shared unit data", s)
+	}
+	stats, err := gc.GCSharedData(c.filters()...)
+	if err != nil {
+		return err
+	}
+	colorable.Printf("Removed %d unreferenced shared files (%d bytes); %d shared files remain.\n", stats.Removed, stats.Bytes, stats.Files)
+	return nil
+}
+
+type StoreGCContentStoreCmd struct{}
+
+var storeGCContentStoreCmd StoreGCContentStoreCmd
+
+func (c *StoreGCContentStoreCmd) Execute(args []string) error {
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+	gc, ok := s.(store.MultiRepoContentStoreGC)
+	if !ok {
+		return fmt.Errorf("store (type %T) does not support content-addressed unit data", s)
+	}
+	stats, err := gc.GCContentStore()
+	if err != nil {
+		return err
+	}
+	colorable.Printf("Removed %d unreferenced objects (%d bytes); %d objects remain.\n", stats.Removed, stats.Bytes, stats.Objects)
+	return nil
+}
+
+type StoreMigrateCodecCmd struct {
+	From    string   `long:"from" description:"codec that the store's data files are currently encoded in (json|protobuf)" required:"yes"`
+	To      string   `long:"to" description:"codec to rewrite the store's data files in (json|protobuf)" default:"protobuf"`
+	Repos   []string `long:"repo" description:"only migrate this repo (may be specified multiple times)"`
+	KeepOld bool     `long:"keep-old" description:"keep each tree's original files (in the repo's __codec_migration dir) after verification"`
+}
+
+var storeMigrateCodecCmd StoreMigrateCodecCmd
+
+func (c *StoreMigrateCodecCmd) Execute(args []string) error {
+	from, err := store.ParseCodec(c.From)
+	if err != nil {
+		return err
+	}
+	to, err := store.ParseCodec(c.To)
+	if err != nil {
+		return err
+	}
+
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+	mrs, ok := s.(store.MultiRepoStore)
+	if !ok {
+		return fmt.Errorf("store (type %T) is not a MultiRepoStore (use --type=MultiRepoStore)", s)
+	}
+
+	opt := &store.CodecMigrationOptions{Repos: c.Repos, KeepOld: c.KeepOld}
+	if GlobalOpt.Verbose {
+		opt.Log = log.New(os.Stderr, "# ", 0)
+	}
+	stats, err := store.MigrateCodec(mrs, from, to, opt)
+	if err != nil {
+		return err
+	}
+	colorable.Printf("Migrated %d trees (%d source units, %d defs, %d refs); skipped %d already-migrated trees.\n", len(stats.Migrated), stats.Units, stats.Defs, stats.Refs, len(stats.Skipped))
+	return nil
+}
+
+type StoreLanguagesCmd struct {
+	Repo     string `long:"repo" description:"repo whose tree to summarize (only for MultiRepoStore)"`
+	CommitID string `long:"commit" description:"commit ID of the tree to summarize" required:"yes"`
+	Output   string `short:"o" long:"output" description:"output format (text|json)" default:"text"`
+}
+
+var storeLanguagesCmd StoreLanguagesCmd
+
+func (c *StoreLanguagesCmd) Execute(args []string) error {
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+
+	var stats []*store.LanguageStats
+	switch s := s.(type) {
+	case store.RepoLanguageStats:
+		stats, err = s.LanguageStats(c.CommitID)
+	case store.MultiRepoLanguageStats:
+		stats, err = s.LanguageStats(c.Repo, c.CommitID)
+	default:
+		return fmt.Errorf("store (type %T) does not implement language stats", s)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch c.Output {
+	case "json":
+		PrintJSON(stats, "")
+	case "text":
+		for _, ls := range stats {
+			colorable.Printf("%s\t%d units\t%d defs\t%d refs\t%d files\n", ls.UnitType, ls.Units, ls.Defs, ls.Refs, ls.Files)
+		}
+	default:
+		return fmt.Errorf("unexpected --output value: %q", c.Output)
+	}
+	return nil
+}
+
+type StoreExternalRefsCmd struct {
+	Repo     string `long:"repo" description:"repo whose tree to summarize (only for MultiRepoStore)"`
+	CommitID string `long:"commit" description:"commit ID of the tree to summarize" required:"yes"`
+	DefRepo  string `long:"def-repo" description:"only count refs to defs in this repo"`
+	Output   string `short:"o" long:"output" description:"output format (text|json)" default:"text"`
+}
+
+var storeExternalRefsCmd StoreExternalRefsCmd
+
+func (c *StoreExternalRefsCmd) Execute(args []string) error {
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+
+	var counts []*store.ExternalRefCount
+	switch s := s.(type) {
+	case store.RepoExternalRefs:
+		counts, err = s.ExternalRefs(c.CommitID, c.DefRepo)
+	case store.MultiRepoExternalRefs:
+		counts, err = s.ExternalRefs(c.Repo, c.CommitID, c.DefRepo)
+	default:
+		return fmt.Errorf("store (type %T) does not implement external refs", s)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch c.Output {
+	case "json":
+		PrintJSON(counts, "")
+	case "text":
+		for _, ec := range counts {
+			colorable.Printf("%d\t%s %s\t%s %s %s %s\n", ec.Count, ec.UnitType, ec.Unit, ec.Def.DefRepo, ec.Def.DefUnitType, ec.Def.DefUnit, ec.Def.DefPath)
+		}
+	default:
+		return fmt.Errorf("unexpected --output value: %q", c.Output)
+	}
+	return nil
+}
+
+type StoreDependentsCmd struct {
+	Repo    string `long:"repo" description:"repo whose dependents to list" required:"yes"`
+	Rebuild bool   `long:"rebuild" description:"recompute all repos' dependents from the store's data before listing (e.g., after data was imported before dependents were recorded)"`
+	Output  string `short:"o" long:"output" description:"output format (text|json)" default:"text"`
+}
+
+var storeDependentsCmd StoreDependentsCmd
+
+func (c *StoreDependentsCmd) Execute(args []string) error {
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+
+	mrs, ok := s.(store.MultiRepoDependents)
+	if !ok {
+		return fmt.Errorf("store (type %T) does not implement listing dependents", s)
+	}
+	if c.Rebuild {
+		if err := mrs.RebuildDependents(); err != nil {
+			return err
+		}
+	}
+	deps, err := mrs.Dependents(c.Repo)
+	if err != nil {
+		return err
+	}
+
+	switch c.Output {
+	case "json":
+		PrintJSON(deps, "")
+	case "text":
+		for _, d := range deps {
+			colorable.Printf("%s\t%s\t%d units\t%d refs\n", d.Repo, d.CommitID, d.Units, d.Refs)
+		}
+	default:
+		return fmt.Errorf("unexpected --output value: %q", c.Output)
+	}
+	return nil
+}
+
+type StoreImpactCmd struct {
+	Repo     string   `long:"repo" description:"repo of the defs" required:"yes"`
+	CommitID string   `long:"commit" description:"commit ID of the defs' tree (if empty, all of the repo's trees are searched)"`
+	UnitType string   `long:"unit-type" description:"source unit type of the defs" required:"yes"`
+	Unit     string   `long:"unit" description:"source unit name of the defs" required:"yes"`
+	Paths    []string `long:"path" description:"def path; may be specified multiple times" required:"yes"`
+	Output   string   `short:"o" long:"output" description:"output format (text|json)" default:"text"`
+}
+
+var storeImpactCmd StoreImpactCmd
+
+func (c *StoreImpactCmd) Execute(args []string) error {
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+
+	mrs, ok := s.(store.MultiRepoImpact)
+	if !ok {
+		return fmt.Errorf("store (type %T) does not implement impact analysis", s)
+	}
+	defs := make([]graph.DefKey, len(c.Paths))
+	for i, path := range c.Paths {
+		defs[i] = graph.DefKey{Repo: c.Repo, CommitID: c.CommitID, UnitType: c.UnitType, Unit: c.Unit, Path: path}
+	}
+	report, err := mrs.Impact(defs)
+	if err != nil {
+		return err
+	}
+
+	switch c.Output {
+	case "json":
+		PrintJSON(report, "")
+	case "text":
+		colorable.Printf("%d refs\n", report.Refs)
+		for _, t := range report.Trees {
+			colorable.Printf("%d\t%s %s\n", t.Refs, t.Repo, t.CommitID)
+			for _, u := range t.Units {
+				colorable.Printf("%d\t  %s %s\n", u.Refs, u.UnitType, u.Unit)
+				files := make([]string, 0, len(u.Files))
+				for file := range u.Files {
+					files = append(files, file)
+				}
+				sort.Strings(files)
+				for _, file := range files {
+					colorable.Printf("%d\t    %s\n", u.Files[file], file)
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("unexpected --output value: %q", c.Output)
+	}
+	return nil
+}
+
+type StoreRefCountsCmd struct {
+	DefRepo     string   `long:"def-repo" description:"repo of the def (required for MultiRepoStore)"`
+	DefUnitType string   `long:"def-unit-type" description:"source unit type of the def" required:"yes"`
+	DefUnit     string   `long:"def-unit" description:"source unit name of the def" required:"yes"`
+	DefPath     string   `long:"def-path" description:"path of the def" required:"yes"`
+	Repos       []string `long:"in-repo" description:"only count refs in this repo's versions; may be specified multiple times (only for MultiRepoStore)"`
+	Output      string   `short:"o" long:"output" description:"output format (text|json)" default:"text"`
+}
+
+var storeRefCountsCmd StoreRefCountsCmd
+
+func (c *StoreRefCountsCmd) Execute(args []string) error {
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+
+	def := graph.RefDefKey{DefRepo: c.DefRepo, DefUnitType: c.DefUnitType, DefUnit: c.DefUnit, DefPath: c.DefPath}
+	var counts []*store.VersionRefCount
+	switch s := s.(type) {
+	case store.RepoDefRefCounts:
+		counts, err = s.DefRefCounts(def)
+	case store.MultiRepoDefRefCounts:
+		var fs []store.VersionFilter
+		if len(c.Repos) > 0 {
+			fs = append(fs, store.ByRepos(c.Repos...))
+		}
+		counts, err = s.DefRefCounts(def, fs...)
+	default:
+		return fmt.Errorf("store (type %T) does not implement def ref counts", s)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch c.Output {
+	case "json":
+		PrintJSON(counts, "")
+	case "text":
+		for _, vc := range counts {
+			if vc.Repo != "" {
+				colorable.Print(vc.Repo, "\t")
+			}
+			colorable.Printf("%s\t%d\n", vc.CommitID, vc.Refs)
+		}
+	default:
+		return fmt.Errorf("unexpected --output value: %q", c.Output)
+	}
+	return nil
+}
+
+type StoreTokensCmd struct {
+	Repo     string `long:"repo" description:"repo of the tree (required for MultiRepoStore)"`
+	CommitID string `long:"commit" description:"commit ID of the tree" required:"yes"`
+	Output   string `short:"o" long:"output" description:"output format (text|json)" default:"text"`
+
+	Args struct {
+		Token string `name:"TOKEN" description:"identifier to find (matched exactly)"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+var storeTokensCmd StoreTokensCmd
+
+func (c *StoreTokensCmd) Execute(args []string) error {
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+
+	var spans []store.TokenSpan
+	switch s := s.(type) {
+	case store.RepoTokenIndex:
+		spans, err = s.Tokens(c.CommitID, c.Args.Token)
+	case store.MultiRepoTokenIndex:
+		spans, err = s.Tokens(c.Repo, c.CommitID, c.Args.Token)
+	default:
+		return fmt.Errorf("store (type %T) does not implement token indexes", s)
+	}
+	if os.IsNotExist(err) {
+		return errors.New("tree has no token index (import it with --tokens)")
+	}
+	if err != nil {
+		return err
+	}
+
+	switch c.Output {
+	case "json":
+		PrintJSON(spans, "")
+	case "text":
+		for _, span := range spans {
+			colorable.Printf("%s:%d-%d\n", span.File, span.Start, span.End)
+		}
+	default:
+		return fmt.Errorf("unexpected --output value: %q", c.Output)
+	}
+	return nil
+}
+
+type StoreDeprecationsCmd struct {
+	Repo     string `long:"repo" description:"repo of the tree" required:"yes"`
+	CommitID string `long:"commit" description:"commit ID of the tree" required:"yes"`
+	Set      string `long:"set" description:"replace the tree's deprecations overlay with the defs in this JSON file (an array of {UnitType, Unit, Path, Message})" value-name:"FILE"`
+	Refs     bool   `long:"refs" description:"report the refs to each deprecated def in the tree"`
+	Output   string `short:"o" long:"output" description:"output format (text|json)" default:"text"`
+}
+
+var storeDeprecationsCmd StoreDeprecationsCmd
+
+func (c *StoreDeprecationsCmd) Execute(args []string) error {
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+
+	mrs, ok := s.(store.MultiRepoDeprecations)
+	if !ok {
+		return fmt.Errorf("store (type %T) does not implement deprecations", s)
+	}
+
+	if c.Set != "" {
+		var deps []*store.DefDeprecation
+		if err := readJSONFile(c.Set, &deps); err != nil {
+			return err
+		}
+		return mrs.SetDeprecations(c.Repo, c.CommitID, deps)
+	}
+
+	if c.Refs {
+		report, err := mrs.DeprecatedRefs(c.Repo, c.CommitID)
+		if err != nil {
+			return err
+		}
+		switch c.Output {
+		case "json":
+			PrintJSON(report, "")
+		case "text":
+			for _, d := range report {
+				colorable.Printf("%d\t%s %s %s", d.Refs, d.Def.UnitType, d.Def.Unit, d.Def.Path)
+				if d.Message != "" {
+					colorable.Printf("\t(%s)", d.Message)
+				}
+				colorable.Println()
+				for _, t := range d.Trees {
+					colorable.Printf("%d\t  %s %s\n", t.Refs, t.Repo, t.CommitID)
+				}
+			}
+		default:
+			return fmt.Errorf("unexpected --output value: %q", c.Output)
+		}
+		return nil
+	}
+
+	deps, err := mrs.Deprecations(c.Repo, c.CommitID)
+	if err != nil {
+		return err
+	}
+	switch c.Output {
+	case "json":
+		PrintJSON(deps, "")
+	case "text":
+		for _, d := range deps {
+			colorable.Printf("%s %s %s\t%s\n", d.UnitType, d.Unit, d.Path, d.Message)
+		}
+	default:
+		return fmt.Errorf("unexpected --output value: %q", c.Output)
+	}
+	return nil
+}
+
+type StoreIndexTreeCmd struct {
+	Repo            string `long:"repo" description:"repo of the tree (for multi-repo stores)"`
+	CommitID        string `long:"commit" description:"commit ID of the tree" required:"yes"`
+	Parallelism     int    `short:"p" long:"parallelism" description:"number of source units to index concurrently (default: GOMAXPROCS)"`
+	CheckpointEvery int    `long:"checkpoint-every" description:"number of source units to index between checkpoints" default:"1"`
+}
+
+var storeIndexTreeCmd StoreIndexTreeCmd
+
+func (c *StoreIndexTreeCmd) Execute(args []string) error {
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+
+	opt := &store.ResumableIndexOptions{
+		Parallelism:     c.Parallelism,
+		CheckpointEvery: c.CheckpointEvery,
+	}
+	if GlobalOpt.Verbose {
+		opt.Progress = func(done, total int) {
+			log.Printf("Indexed %d/%d source units", done, total)
+		}
+	}
+
+	var stats *store.ResumableIndexStats
+	switch s := s.(type) {
+	case store.MultiRepoResumableIndexer:
+		if c.Repo == "" {
+			return errors.New("--repo is required for multi-repo stores")
+		}
+		stats, err = s.IndexResumable(c.Repo, c.CommitID, opt)
+	case store.RepoResumableIndexer:
+		stats, err = s.IndexResumable(c.CommitID, opt)
+	default:
+		return fmt.Errorf("store (type %T) does not implement resumable index builds", s)
+	}
+	if err != nil {
+		return err
+	}
+	colorable.Printf("Indexed %d source units (%d built, %d done by earlier builds)\n", stats.Units, stats.Built, stats.Resumed)
+	return nil
+}
+
+type StoreHiddenReposCmd struct {
+	Hide   string `long:"hide" description:"hide this repo" value-name:"REPO"`
+	Reason string `long:"reason" description:"why the repo is hidden (with --hide)"`
+	Unhide string `long:"unhide" description:"unhide this repo" value-name:"REPO"`
+	Output string `short:"o" long:"output" description:"output format (text|json)" default:"text"`
+}
+
+var storeHiddenReposCmd StoreHiddenReposCmd
+
+func (c *StoreHiddenReposCmd) Execute(args []string) error {
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+
+	mrs, ok := s.(store.MultiRepoTombstones)
+	if !ok {
+		return fmt.Errorf("store (type %T) does not implement hiding repos", s)
+	}
+
+	if c.Hide != "" && c.Unhide != "" {
+		return errors.New("--hide and --unhide are mutually exclusive")
+	}
+	if c.Hide != "" {
+		return mrs.HideRepo(c.Hide, c.Reason)
+	}
+	if c.Unhide != "" {
+		return mrs.UnhideRepo(c.Unhide)
+	}
+
+	hidden, err := mrs.HiddenRepos()
+	if err != nil {
+		return err
+	}
+	switch c.Output {
+	case "json":
+		PrintJSON(hidden, "")
+	case "text":
+		for _, t := range hidden {
+			colorable.Printf("%s\t%s\t%s\n", t.Repo, t.Time.Format(time.RFC3339), t.Reason)
+		}
+	default:
+		return fmt.Errorf("unexpected --output value: %q", c.Output)
+	}
+	return nil
+}
+
+type StoreRepoRedirectsCmd struct {
+	Rename string `long:"rename" description:"rename this repo (requires --to)" value-name:"REPO"`
+	To     string `long:"to" description:"new URI of the repo renamed with --rename" value-name:"REPO"`
+	Output string `short:"o" long:"output" description:"output format (text|json)" default:"text"`
+}
+
+var storeRepoRedirectsCmd StoreRepoRedirectsCmd
+
+func (c *StoreRepoRedirectsCmd) Execute(args []string) error {
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+
+	mrs, ok := s.(store.MultiRepoRenamer)
+	if !ok {
+		return fmt.Errorf("store (type %T) does not implement renaming repos", s)
+	}
+
+	if (c.Rename == "") != (c.To == "") {
+		return errors.New("--rename and --to must be used together")
+	}
+	if c.Rename != "" {
+		return mrs.RenameRepo(c.Rename, c.To)
+	}
+
+	redirects, err := mrs.RepoRedirects()
+	if err != nil {
+		return err
+	}
+	switch c.Output {
+	case "json":
+		PrintJSON(redirects, "")
+	case "text":
+		repos := make([]string, 0, len(redirects))
+		for repo := range redirects {
+			repos = append(repos, repo)
+		}
+		sort.Strings(repos)
+		for _, repo := range repos {
+			colorable.Printf("%s\t%s\n", repo, redirects[repo])
+		}
+	default:
+		return fmt.Errorf("unexpected --output value: %q", c.Output)
+	}
+	return nil
+}
+
+type StoreDeleteCmd struct {
+	Repo     string `long:"repo" description:"repo to delete (or of the tree to delete from, for multi-repo stores)"`
+	CommitID string `long:"commit" description:"commit ID of the tree to delete (or to delete the source unit from)"`
+	UnitType string `long:"unit-type" description:"type of the source unit to delete (requires --unit)"`
+	Unit     string `long:"unit" description:"name of the source unit to delete (requires --commit and --unit-type)"`
+}
+
+var storeDeleteCmd StoreDeleteCmd
+
+func (c *StoreDeleteCmd) Execute(args []string) error {
+	if (c.Unit == "") != (c.UnitType == "") {
+		return errors.New("--unit and --unit-type must be used together")
+	}
+	if c.Unit != "" && c.CommitID == "" {
+		return errors.New("--commit is required to delete a source unit")
+	}
+	u := unit.ID2{Type: c.UnitType, Name: c.Unit}
+
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+
+	switch s := s.(type) {
+	case store.MultiRepoDeleter:
+		if c.Repo == "" {
+			return errors.New("--repo is required for multi-repo stores")
+		}
+		switch {
+		case c.Unit != "":
+			return s.DeleteUnit(c.Repo, c.CommitID, u)
+		case c.CommitID != "":
+			return s.Delete(c.Repo, c.CommitID)
+		default:
+			return s.DeleteRepo(c.Repo)
+		}
+	case store.RepoDeleter:
+		switch {
+		case c.Unit != "":
+			return s.DeleteUnit(c.CommitID, u)
+		case c.CommitID != "":
+			return s.Delete(c.CommitID)
+		default:
+			return errors.New("--commit is required for repo stores")
+		}
+	default:
+		return fmt.Errorf("store (type %T) does not implement deleting data", s)
+	}
+}
+
+type StoreGraphQLCmd struct {
+	HTTP      string `long:"http" description:"HTTP listen address" default:":7071"`
+	Schema    bool   `long:"schema" description:"print the GraphQL schema and exit"`
+	Variables string `long:"variables" description:"JSON object of query variables (with QUERY)"`
+
+	Args struct {
+		Query string `name:"QUERY" description:"GraphQL query to run (instead of serving)"`
+	} `positional-args:"yes"`
+}
+
+var storeGraphQLCmd StoreGraphQLCmd
+
+func (c *StoreGraphQLCmd) Execute(args []string) error {
+	if c.Schema {
+		colorable.Print(graphql.Schema)
+		return nil
+	}
+
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+	mrs, ok := s.(store.MultiRepoStore)
+	if !ok {
+		return fmt.Errorf("store (type %T) does not implement multi-repo queries", s)
+	}
+
+	if c.Args.Query != "" {
+		var vars map[string]interface{}
+		if c.Variables != "" {
+			if err := json.Unmarshal([]byte(c.Variables), &vars); err != nil {
+				return fmt.Errorf("invalid --variables: %s", err)
+			}
+		}
+		resp := graphql.Execute(mrs, c.Args.Query, vars)
+		PrintJSON(resp, "")
+		if len(resp.Errors) > 0 {
+			return fmt.Errorf("query failed with %d errors", len(resp.Errors))
+		}
+		return nil
+	}
+
+	log.Printf("# Serving GraphQL API on %s/graphql", c.HTTP)
+	mux := http.NewServeMux()
+	mux.Handle("/graphql", graphql.Handler(mrs))
+	return http.ListenAndServe(c.HTTP, mux)
+}
+
+type StoreExportSQLiteCmd struct {
+	Repos   []string `long:"repo" description:"only export these repos (can be specified multiple times)" value-name:"REPO"`
+	SQL     bool     `long:"sql" description:"write the SQL script to stdout instead of creating a database"`
+	Schema  bool     `long:"schema" description:"print the database schema and exit"`
+	SQLite3 string   `long:"sqlite3" description:"path to the sqlite3 command" default:"sqlite3"`
 
-				lastRepo = x.Repo
-				lastCommitID = x.CommitID
-				lastUnit = x.Unit
-			}
-			done <- struct{}{}
-		}()
-	default:
-		return fmt.Errorf("unexpected --output value: %q", opt.Output)
+	Args struct {
+		DB string `name:"DB" description:"SQLite database file to create"`
+	} `positional-args:"yes"`
+}
+
+var storeExportSQLiteCmd StoreExportSQLiteCmd
+
+func (c *StoreExportSQLiteCmd) Execute(args []string) error {
+	if c.Schema {
+		colorable.Print(export.SQLiteSchema)
+		return nil
+	}
+	if c.SQL == (c.Args.DB != "") {
+		return errors.New("exactly one of DB and --sql must be given")
 	}
 
-	_, err = f(s, crit, indexChan)
-	defer func() {
-		close(indexChan)
-		<-done
-	}()
+	s, err := OpenStore()
 	if err != nil {
 		return err
 	}
-	if hasError {
-		return errors.New("\nindex listing or index building errors occurred (see above)")
+	mrs, ok := s.(store.MultiRepoStore)
+	if !ok {
+		return fmt.Errorf("store (type %T) does not implement multi-repo queries", s)
+	}
+	var vf []store.VersionFilter
+	if len(c.Repos) > 0 {
+		f, err := store.NewByReposFilter(c.Repos...)
+		if err != nil {
+			return err
+		}
+		vf = append(vf, f)
+	}
+
+	if c.SQL {
+		return export.WriteSQLite(os.Stdout, mrs, vf...)
+	}
+
+	if _, err := os.Stat(c.Args.DB); err == nil {
+		return fmt.Errorf("database %s already exists", c.Args.DB)
+	}
+	cmd := exec.Command(c.SQLite3, "-bail", c.Args.DB)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if err := export.WriteSQLite(w, mrs, vf...); err != nil {
+		w.Close()
+		cmd.Wait()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: %s", c.SQLite3, err)
+	}
+	if GlobalOpt.Verbose {
+		log.Printf("# Created SQLite database %s", c.Args.DB)
 	}
 	return nil
 }
 
-type storeIndexOptions struct {
-	Output   string `short:"o" long:"output" description:"output format (text|json)" default:"text"`
-	Parallel int    `short:"p" long:"parallel" description:"parallelism (may produce out-of-order output)" default:"1"`
+type StoreExportCmd struct {
+	Repos  []string `long:"repo" description:"only export these repos (can be specified multiple times)" value-name:"REPO"`
+	Format string   `short:"f" long:"format" description:"export format (csv|parquet)" default:"csv"`
+	Output string   `short:"o" long:"output" description:"write to this file instead of stdout" value-name:"FILE"`
 
-	Print bool `long:"print" description:"(debug) print representation of index"`
+	Args struct {
+		Table string `name:"TABLE" description:"table to export (defs|refs)"`
+	} `positional-args:"yes" required:"yes"`
 }
 
-type StoreIndexesCmd struct {
-	storeIndexCriteria
-	storeIndexOptions
-}
+var storeExportCmd StoreExportCmd
 
-var storeIndexesCmd StoreIndexesCmd
+func (c *StoreExportCmd) Execute(args []string) error {
+	var write func(io.Writer, export.Format, store.MultiRepoStore, ...store.VersionFilter) error
+	switch c.Args.Table {
+	case "defs":
+		write = export.WriteDefs
+	case "refs":
+		write = export.WriteRefs
+	default:
+		return fmt.Errorf("unknown table %q (valid tables are defs and refs)", c.Args.Table)
+	}
 
-func (c *StoreIndexesCmd) Execute(args []string) error {
-	return doStoreIndexesCmd(c.IndexCriteria(), c.storeIndexOptions, store.Indexes)
-}
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+	mrs, ok := s.(store.MultiRepoStore)
+	if !ok {
+		return fmt.Errorf("store (type %T) does not implement multi-repo queries", s)
+	}
+	var vf []store.VersionFilter
+	if len(c.Repos) > 0 {
+		f, err := store.NewByReposFilter(c.Repos...)
+		if err != nil {
+			return err
+		}
+		vf = append(vf, f)
+	}
 
-type StoreIndexCmd struct {
-	storeIndexCriteria
-	storeIndexOptions
+	if c.Output == "" {
+		return write(os.Stdout, export.Format(c.Format), mrs, vf...)
+	}
+	f, err := os.Create(c.Output)
+	if err != nil {
+		return err
+	}
+	if err := write(f, export.Format(c.Format), mrs, vf...); err != nil {
+		f.Close()
+		os.Remove(c.Output)
+		return err
+	}
+	return f.Close()
 }
 
-var storeIndexCmd StoreIndexCmd
+type StoreImportServerCmd struct {
+	HTTP string `long:"http" description:"HTTP listen address" default:":7072"`
+	Dir  string `long:"dir" description:"directory to store uploads in until they are imported (default: a temp dir)"`
 
-func (c *StoreIndexCmd) Execute(args []string) error {
-	return doStoreIndexesCmd(c.IndexCriteria(), c.storeIndexOptions, store.BuildIndexes)
+	ImportOpt
 }
 
-type StoreReposCmd struct {
-	IDContains string `short:"i" long:"id-contains" description:"filter to repos whose ID contains this substring"`
-}
+var storeImportServerCmd StoreImportServerCmd
 
-func (c *StoreReposCmd) filters() []store.RepoFilter {
-	var fs []store.RepoFilter
-	if c.IDContains != "" {
-		fs = append(fs, store.RepoFilterFunc(func(repo string) bool { return strings.Contains(repo, c.IDContains) }))
+func (c *StoreImportServerCmd) Execute(args []string) error {
+	s, err := OpenStore()
+	if err != nil {
+		return err
 	}
-	return fs
+	if c.Dir == "" {
+		c.Dir = filepath.Join(os.TempDir(), "srclib-import-uploads")
+	}
+	c.Verbose = GlobalOpt.Verbose
+
+	log.Printf("# Serving imports on %s (uploads dir: %s)", c.HTTP, c.Dir)
+	return http.ListenAndServe(c.HTTP, ImportUploadHandler(s, c.Dir, c.ImportOpt))
 }
 
-var storeReposCmd StoreReposCmd
+type StoreHealthCmd struct {
+	Write      bool          `long:"write" description:"also check that the store is writable"`
+	Timeout    time.Duration `long:"timeout" description:"fail if the health check takes longer than this" default:"30s"`
+	MaxLatency time.Duration `long:"max-latency" description:"fail if any probe takes longer than this"`
+	HTTP       string        `long:"http" description:"serve the health check on this HTTP listen address"`
+}
 
-func (c *StoreReposCmd) Execute(args []string) error {
+var storeHealthCmd StoreHealthCmd
+
+func (c *StoreHealthCmd) Execute(args []string) error {
 	s, err := OpenStore()
 	if err != nil {
 		return err
 	}
-
 	mrs, ok := s.(store.MultiRepoStore)
 	if !ok {
-		return fmt.Errorf("store (type %T) does not implement listing repositories", s)
+		return fmt.Errorf("store (type %T) does not implement multi-repo queries", s)
 	}
+	opt := &store.HealthCheckOptions{WriteProbe: c.Write, MaxLatency: c.MaxLatency}
 
-	repos, err := mrs.Repos(c.filters()...)
-	if err != nil {
+	if c.HTTP != "" {
+		log.Printf("# Serving health check on %s/healthz", c.HTTP)
+		mux := http.NewServeMux()
+		mux.Handle("/healthz", store.HealthHandler(mrs, opt))
+		return http.ListenAndServe(c.HTTP, mux)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	rep := store.HealthCheck(ctx, mrs, opt)
+	for _, p := range rep.Probes {
+		status := "ok"
+		if p.Skipped {
+			status = "skipped"
+		}
+		if p.Error != "" {
+			status = "FAILED: " + p.Error
+		}
+		target := ""
+		if p.Target != "" {
+			target = " (" + p.Target + ")"
+		}
+		colorable.Printf("%-8s %-10s %s%s\n", p.Name, p.Latency, status, target)
+	}
+	if !rep.Healthy {
+		return fmt.Errorf("store is unhealthy")
+	}
+	return nil
+}
+
+type StoreDumpIndexCmd struct {
+	Formats bool `long:"formats" description:"print the formats of all index files"`
+
+	Args struct {
+		Files []string `name:"FILES" description:"index files to decode (relative to the store's root)"`
+	} `positional-args:"yes"`
+}
+
+var storeDumpIndexCmd StoreDumpIndexCmd
+
+func (c *StoreDumpIndexCmd) Execute(args []string) error {
+	if c.Formats {
+		PrintJSON(store.IndexFormats(), "")
+		return nil
+	}
+	if len(c.Args.Files) == 0 {
+		return errors.New("no index files given")
+	}
+
+	if _, err := OpenStore(); err != nil {
 		return err
 	}
-	for _, repo := range repos {
-		colorable.Println(repo)
+	for _, file := range c.Args.Files {
+		dump, err := store.DumpIndex(storeCmd.fs, file)
+		if err != nil {
+			return err
+		}
+		PrintJSON(dump, "")
 	}
 	return nil
 }
@@ -887,7 +2959,11 @@ type StoreUnitsCmd struct {
 
 	RepoCommitIDs string `long:"repo-commits" description:"comma-separated list of repo@commitID specifiers"`
 
-	File string `long:"file" description:"filter by units whose Files list contains this file"`
+	File     string   `long:"file" description:"filter by units whose Files list contains this file"`
+	Owner    string   `long:"owner" description:"filter by units owned by this owner (requires import with --codeowners)"`
+	Metadata []string `long:"metadata" description:"filter by units with this metadata value, as KEY=VALUE (requires import with --unit-metadata); may be specified multiple times" value-name:"KEY=VALUE"`
+
+	Scanned bool `long:"scanned" description:"list all units discovered by the scanners in the commit (even those with no imported graph data); requires --commit (and --repo for multi-repo stores)"`
 }
 
 func (c *StoreUnitsCmd) filters() []store.UnitFilter {
@@ -910,6 +2986,16 @@ func (c *StoreUnitsCmd) filters() []store.UnitFilter {
 	if c.File != "" {
 		fs = append(fs, store.ByFiles(false, path.Clean(c.File)))
 	}
+	if c.Owner != "" {
+		fs = append(fs, store.ByOwner(c.Owner))
+	}
+	for _, spec := range c.Metadata {
+		i := strings.Index(spec, "=")
+		if i <= 0 {
+			log.Fatalf("invalid --metadata %q (must be KEY=VALUE)", spec)
+		}
+		fs = append(fs, store.ByUnitMetadata(spec[:i], spec[i+1:]))
+	}
 	return fs
 }
 
@@ -921,6 +3007,10 @@ func (c *StoreUnitsCmd) Execute(args []string) error {
 		return err
 	}
 
+	if c.Scanned {
+		return c.executeScanned(s)
+	}
+
 	ts, ok := s.(store.TreeStore)
 	if !ok {
 		return fmt.Errorf("store (type %T) does not implement listing source units", s)
@@ -934,21 +3024,71 @@ func (c *StoreUnitsCmd) Execute(args []string) error {
 	return nil
 }
 
+// executeScanned lists the units in the scan results of a commit.
+func (c *StoreUnitsCmd) executeScanned(s interface{}) error {
+	if c.CommitID == "" {
+		return errors.New("--scanned requires --commit")
+	}
+	var fs []store.UnitFilter
+	if c.Type != "" && c.Name != "" {
+		fs = append(fs, store.ByUnits(unit.ID2{Type: c.Type, Name: c.Name}))
+	}
+	if c.File != "" {
+		fs = append(fs, store.ByFiles(false, path.Clean(c.File)))
+	}
+
+	var units []*unit.SourceUnit
+	var err error
+	switch s := s.(type) {
+	case store.RepoScanResults:
+		units, err = s.ScannedUnits(c.CommitID, fs...)
+	case store.MultiRepoScanResults:
+		if c.Repo == "" {
+			return errors.New("--scanned requires --repo for multi-repo stores")
+		}
+		units, err = s.ScannedUnits(c.Repo, c.CommitID, fs...)
+	default:
+		return fmt.Errorf("store (type %T) does not store scan results", s)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no scan results stored for commit %s", c.CommitID)
+		}
+		return err
+	}
+	PrintJSON(units, "  ")
+	return nil
+}
+
 type StoreDefsCmd struct {
 	Repo     string `long:"repo"`
 	Path     string `long:"path"`
 	UnitType string `long:"unit-type" `
 	Unit     string `long:"unit"`
 	File     string `long:"file"`
+	Dir      string `long:"dir" description:"only defs in files directly in this dir (not in its subdirs), e.g., to list a package's defs"`
 	CommitID string `long:"commit"`
 
 	RepoCommitIDs string `long:"repo-commits" description:"comma-separated list of repo@commitID specifiers"`
 
-	Query string `long:"query"`
+	Query      string `long:"query" description:"search query (def name prefix, with optional repo:, unit:, file:, kind:, and is:exported qualifiers)"`
+	Name       string `long:"name" description:"only defs with exactly this name"`
+	NameRegexp string `long:"name-regexp" description:"only defs whose names match this regexp (anchor it with ^ and a literal prefix to use indexes)" value-name:"REGEXP"`
+	Author     string `long:"author" description:"only defs authored by this person (email address; requires import with --blame)"`
+	Owner      string `long:"owner" description:"only defs owned by this owner (e.g., @org/team; requires import with --codeowners)"`
+
+	Signature string `long:"signature" description:"only defs whose typed signatures match this query (PARAMS -> RESULTS, e.g., 'context.Context -> error'; requires a toolchain that records signatures)"`
+
+	Deprecated bool `long:"deprecated" description:"only deprecated defs (marked by the toolchain or in the tree's deprecations overlay)"`
+
+	ForceScan    bool `long:"force-scan" description:"scan the data instead of using indexes (diff the results with and without it to debug index correctness)"`
+	RequireIndex bool `long:"require-index" description:"fail instead of scanning data if no index satisfies the query"`
 
 	Limit  int `short:"n" long:"limit" description:"max results to return (0 for all)"`
 	Offset int `long:"offset" description:"results offset (0 to start with first results)"`
 
+	Sample int `long:"sample" description:"return a random sample of up to this many of the matching defs (read at random offsets of the units' indexes instead of scanning them)" value-name:"N"`
+
 	// If Filter is non-nil, it is applied along with the above
 	// filters.
 	Filter store.DefFilter
@@ -977,14 +3117,56 @@ func (c *StoreDefsCmd) filters() []store.DefFilter {
 	if c.File != "" {
 		fs = append(fs, store.ByFiles(false, path.Clean(c.File)))
 	}
+	if c.Dir != "" {
+		fs = append(fs, store.ByDirs(c.Dir))
+	}
 	if c.Query != "" {
-		fs = append(fs, store.ByDefQuery(c.Query))
+		qfs, err := store.ParseDefSearchFilters(c.Query)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fs = append(fs, qfs...)
+	}
+	if c.Name != "" {
+		fs = append(fs, store.ByDefName(c.Name))
+	}
+	if c.NameRegexp != "" {
+		re, err := regexp.Compile(c.NameRegexp)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fs = append(fs, store.ByDefNameRegexp(re))
+	}
+	if c.Author != "" {
+		fs = append(fs, store.ByAuthor(c.Author))
+	}
+	if c.Owner != "" {
+		fs = append(fs, store.ByOwner(c.Owner))
+	}
+	if c.Signature != "" {
+		q, err := store.ParseSignatureQuery(c.Signature)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fs = append(fs, store.BySignatureQuery(*q))
+	}
+	if c.Deprecated {
+		fs = append(fs, store.ByDeprecated())
+	}
+	if c.ForceScan {
+		fs = append(fs, store.ForceScan())
+	}
+	if c.RequireIndex {
+		fs = append(fs, store.RequireIndex())
 	}
 	if c.Filter != nil {
 		fs = append(fs, c.Filter)
 	}
-	if c.Limit != 0 || c.Offset != 0 {
-		fs = append(fs, store.Limit(c.Limit, c.Offset))
+	if c.Limit != 0 {
+		fs = append(fs, store.First(c.Limit))
+	}
+	if c.Offset != 0 {
+		fs = append(fs, store.Offset(c.Offset))
 	}
 	return fs
 }
@@ -1006,6 +3188,14 @@ func (c *StoreDefsCmd) Get() ([]*graph.Def, error) {
 		return nil, err
 	}
 
+	if c.Sample != 0 {
+		ss, ok := s.(store.DefRefSampler)
+		if !ok {
+			return nil, fmt.Errorf("store (type %T) does not implement sampling defs", s)
+		}
+		return ss.SampleDefs(c.Sample, c.filters()...)
+	}
+
 	us, ok := s.(store.UnitStore)
 	if !ok {
 		return nil, fmt.Errorf("store (type %T) does not implement listing defs", s)
@@ -1029,6 +3219,7 @@ type StoreRefsCmd struct {
 
 	Start uint32 `long:"start"`
 	End   uint32 `long:"end"`
+	Line  int    `long:"line" description:"only refs on this line of --file (requires line tables, which are created at import)"`
 
 	DefRepo     string `long:"def-repo"`
 	DefUnitType string `long:"def-unit-type" `
@@ -1038,10 +3229,15 @@ type StoreRefsCmd struct {
 	Broken   bool `long:"broken" description:"only show refs that point to nonexistent defs"`
 	Coverage bool `long:"coverage" description:"print a coverage summary (resolved refs, broken refs, total refs)"`
 
+	ForceScan    bool `long:"force-scan" description:"scan the data instead of using indexes (diff the results with and without it to debug index correctness)"`
+	RequireIndex bool `long:"require-index" description:"fail instead of scanning data if no index satisfies the query"`
+
 	Format string `long:"format" description:"output format ('json' or 'none')" default:"json"`
 
 	Limit  int `short:"n" long:"limit" description:"max results to return (0 for all)"`
 	Offset int `long:"offset" description:"results offset (0 to start with first results)"`
+
+	Sample int `long:"sample" description:"return a random sample of up to this many of the matching refs (read at random offsets of the units' indexes instead of scanning them); with --coverage, summarize the sample" value-name:"N"`
 }
 
 func (c *StoreRefsCmd) filters() []store.RefFilter {
@@ -1075,12 +3271,16 @@ func (c *StoreRefsCmd) filters() []store.RefFilter {
 		}))
 	}
 	if c.DefPath != "" {
-		fs = append(fs, store.ByRefDef(graph.RefDefKey{
+		f, err := store.NewByRefDefFilter(graph.RefDefKey{
 			DefRepo:     c.DefRepo,
 			DefUnitType: c.DefUnitType,
 			DefUnit:     c.DefUnit,
 			DefPath:     c.DefPath,
-		}))
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		fs = append(fs, f)
 	} else {
 		// Slower filters since they don't use an index.
 		if c.DefRepo != "" {
@@ -1099,8 +3299,17 @@ func (c *StoreRefsCmd) filters() []store.RefFilter {
 			})))
 		}
 	}
-	if c.Limit != 0 || c.Offset != 0 {
-		fs = append(fs, store.Limit(c.Limit, c.Offset))
+	if c.ForceScan {
+		fs = append(fs, store.ForceScan())
+	}
+	if c.RequireIndex {
+		fs = append(fs, store.RequireIndex())
+	}
+	if c.Limit != 0 {
+		fs = append(fs, store.First(c.Limit))
+	}
+	if c.Offset != 0 {
+		fs = append(fs, store.Offset(c.Offset))
 	}
 	return fs
 }
@@ -1125,12 +3334,26 @@ func (c *StoreRefsCmd) Get() ([]*graph.Ref, error) {
 		return nil, err
 	}
 
-	us, ok := s.(store.UnitStore)
-	if !ok {
-		return nil, fmt.Errorf("store (type %T) does not implement listing refs", s)
+	if c.Line != 0 {
+		if err := c.setLineRange(s); err != nil {
+			return nil, err
+		}
 	}
 
-	refs, err := us.Refs(c.filters()...)
+	var refs []*graph.Ref
+	if c.Sample != 0 {
+		ss, ok := s.(store.DefRefSampler)
+		if !ok {
+			return nil, fmt.Errorf("store (type %T) does not implement sampling refs", s)
+		}
+		refs, err = ss.SampleRefs(c.Sample, c.filters()...)
+	} else {
+		us, ok := s.(store.UnitStore)
+		if !ok {
+			return nil, fmt.Errorf("store (type %T) does not implement listing refs", s)
+		}
+		refs, err = us.Refs(c.filters()...)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -1147,7 +3370,11 @@ func (c *StoreRefsCmd) Get() ([]*graph.Ref, error) {
 		}
 	}
 	if c.Coverage {
-		log.Printf("# Coverage summary:")
+		if c.Sample != 0 {
+			log.Printf("# Coverage summary (of a random sample of refs):")
+		} else {
+			log.Printf("# Coverage summary:")
+		}
 		log.Printf("#  - %d total refs", len(allRefs))
 		resolvedRefs := len(allRefs) - len(brokenRefs)
 		log.Printf("#  - %d resolved refs (%.1f)", resolvedRefs, percent(resolvedRefs, len(allRefs)))
@@ -1157,6 +3384,32 @@ func (c *StoreRefsCmd) Get() ([]*graph.Ref, error) {
 	return refs, nil
 }
 
+// setLineRange sets c.Start and c.End to the byte range of c.Line in
+// c.File.
+func (c *StoreRefsCmd) setLineRange(s interface{}) error {
+	if c.File == "" {
+		return errors.New("--line requires --file")
+	}
+	file := path.Clean(c.File)
+	var (
+		lt  store.LineTable
+		err error
+	)
+	switch s := s.(type) {
+	case store.RepoLineTables:
+		lt, err = s.LineTable(c.CommitID, file)
+	case store.MultiRepoLineTables:
+		lt, err = s.LineTable(c.Repo, c.CommitID, file)
+	default:
+		return fmt.Errorf("store (type %T) does not implement line tables", s)
+	}
+	if err != nil {
+		return fmt.Errorf("error getting line table for %s: %s", file, err)
+	}
+	c.Start, c.End, err = lt.LineRange(c.Line)
+	return err
+}
+
 func brokenRefsOnly(refs []*graph.Ref, s interface{}) ([]*graph.Ref, error) {
 	uniqRefDefs := map[graph.DefKey][]*graph.Ref{}
 	loggedDefRepos := map[string]struct{}{}
@@ -1225,3 +3478,100 @@ func makeRepoCommitIDsFilter(repoCommitIDs string) interface {
 	}
 	return store.ByRepoCommitIDs(vs...)
 }
+
+type StoreReplayQueriesCmd struct {
+	Args struct {
+		Files []string `name:"FILES" description:"query log files to replay (default: all of the store's query logs)"`
+	} `positional-args:"yes"`
+}
+
+var storeReplayQueriesCmd StoreReplayQueriesCmd
+
+func (c *StoreReplayQueriesCmd) Execute(args []string) error {
+	s, err := OpenStore()
+	if err != nil {
+		return err
+	}
+	mrs, ok := s.(store.MultiRepoStore)
+	if !ok {
+		return fmt.Errorf("store (type %T) is not a MultiRepoStore (use --type=MultiRepoStore)", s)
+	}
+
+	var entries []*store.QueryLogEntry
+	if len(c.Args.Files) == 0 {
+		if storeCmd.fs == nil {
+			return errors.New("no query log files given")
+		}
+		entries, err = store.ReadQueryLogs(storeCmd.fs)
+		if err != nil {
+			return err
+		}
+	}
+	for _, file := range c.Args.Files {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		es, err := store.ReadQueryLog(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		entries = append(entries, es...)
+	}
+	if len(entries) == 0 {
+		return errors.New("no queries to replay")
+	}
+
+	replays, err := store.ReplayQueryLog(mrs, entries, storeCmd.bytesRead)
+	if err != nil {
+		return err
+	}
+
+	var loggedTotal, replayedTotal time.Duration
+	for _, r := range replays {
+		loggedTotal += r.Logged.Duration
+		replayedTotal += r.Replayed.Duration
+
+		var notes []string
+		if r.Partial {
+			notes = append(notes, "partial")
+		}
+		if r.Replayed.Results != r.Logged.Results {
+			notes = append(notes, fmt.Sprintf("results %d -> %d", r.Logged.Results, r.Replayed.Results))
+		}
+		if r.Replayed.Error != "" {
+			notes = append(notes, "error: "+r.Replayed.Error)
+		}
+		fmt.Printf("%-8s %10s -> %-10s %7s  bytes %d -> %d  %s", r.Logged.Op, r.Logged.Duration, r.Replayed.Duration, durationChange(r.Logged.Duration, r.Replayed.Duration), r.Logged.BytesRead, r.Replayed.BytesRead, queryLogFiltersString(r.Logged.Filters))
+		if len(notes) > 0 {
+			fmt.Printf("  (%s)", strings.Join(notes, "; "))
+		}
+		fmt.Println()
+	}
+	fmt.Printf("# %d queries: %s -> %s (%s)\n", len(replays), loggedTotal, replayedTotal, durationChange(loggedTotal, replayedTotal))
+	return nil
+}
+
+// durationChange describes the relative change from a to b (e.g.,
+// "+25%").
+func durationChange(a, b time.Duration) string {
+	if a == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%+.0f%%", (float64(b)-float64(a))/float64(a)*100)
+}
+
+// queryLogFiltersString returns a short description of logged query
+// filters.
+func queryLogFiltersString(fs []store.QueryLogFilter) string {
+	strs := make([]string, len(fs))
+	for i, f := range fs {
+		if f.Name == "" {
+			strs[i] = f.String
+		} else {
+			strs[i] = f.Name
+		}
+	}
+	return strings.Join(strs, ",")
+}
@@ -0,0 +1,23 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStoreCmd_checkMultiRepoStoreFlags(t *testing.T) {
+	c := &StoreCmd{Type: "RepoStore"}
+	if err := c.checkMultiRepoStoreFlags(); err != nil {
+		t.Errorf("no MultiRepoStore options: got error %v", err)
+	}
+
+	c.Codec = "json"
+	c.SkipIndexes = []string{"def_query"}
+	err := c.checkMultiRepoStoreFlags()
+	if err == nil {
+		t.Fatal("got nil error")
+	}
+	if want := "--codec, --skip-index"; !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %q, want it to name only the options that are set (%s)", err, want)
+	}
+}
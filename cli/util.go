@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"os"
@@ -69,6 +70,14 @@ func readJSONFile(file string, v interface{}) error {
 }
 
 func readJSONFileFS(fs vfs.FileSystem, file string, v interface{}) (err error) {
+	return readFileFS(fs, file, func(r io.Reader) error {
+		return json.NewDecoder(r).Decode(v)
+	})
+}
+
+// readFileFS calls read with the contents of file. It returns
+// errEmptyJSONFile (without calling read) if the file is empty.
+func readFileFS(fs vfs.FileSystem, file string, read func(io.Reader) error) (err error) {
 	fi, err := fs.Stat(file)
 	if err != nil {
 		return err
@@ -86,7 +95,7 @@ func readJSONFileFS(fs vfs.FileSystem, file string, v interface{}) (err error) {
 			err = err2
 		}
 	}()
-	return json.NewDecoder(f).Decode(v)
+	return read(f)
 }
 
 func bytesString(s uint64) string {
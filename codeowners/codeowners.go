@@ -0,0 +1,172 @@
+package codeowners
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/godoc/vfs"
+)
+
+// Paths are the locations (relative to the repository root) where a
+// CODEOWNERS file is looked for, in order of precedence (the same
+// order that GitHub uses).
+var Paths = []string{".github/CODEOWNERS", "CODEOWNERS", "docs/CODEOWNERS"}
+
+// A Rule assigns owners to the files that match a pattern.
+type Rule struct {
+	// Pattern is the gitignore-style pattern that selects the files
+	// this rule applies to.
+	Pattern string
+
+	// Owners are the owners (e.g., "@org/team" or "user@example.com")
+	// of the files that match Pattern. If empty, the matching files
+	// have no owners.
+	Owners []string
+
+	re *regexp.Regexp
+}
+
+// Match reports whether the rule's pattern matches file, a
+// slash-separated path relative to the repository root.
+func (r *Rule) Match(file string) bool {
+	return r.re.MatchString(strings.TrimPrefix(file, "/"))
+}
+
+// A Ruleset is a parsed CODEOWNERS file.
+type Ruleset []*Rule
+
+// Owners returns the owners of file, a slash-separated path relative
+// to the repository root. As in CODEOWNERS files on code hosts, the
+// last matching rule takes precedence.
+func (rs Ruleset) Owners(file string) []string {
+	for i := len(rs) - 1; i >= 0; i-- {
+		if rs[i].Match(file) {
+			return rs[i].Owners
+		}
+	}
+	return nil
+}
+
+// FilesOwners returns the sorted, de-duplicated union of the owners
+// of files.
+func (rs Ruleset) FilesOwners(files []string) []string {
+	seen := map[string]struct{}{}
+	var owners []string
+	for _, file := range files {
+		for _, o := range rs.Owners(file) {
+			if _, present := seen[o]; !present {
+				seen[o] = struct{}{}
+				owners = append(owners, o)
+			}
+		}
+	}
+	sort.Strings(owners)
+	return owners
+}
+
+// Parse parses a CODEOWNERS file. Blank lines and lines starting with
+// "#" are ignored; every other line consists of a pattern followed by
+// zero or more whitespace-separated owners.
+func Parse(r io.Reader) (Ruleset, error) {
+	var rs Ruleset
+	s := bufio.NewScanner(r)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		line := s.Text()
+		if i := strings.Index(line, " #"); i != -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		re, err := compilePattern(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("CODEOWNERS line %d: invalid pattern %q: %s", lineNum, fields[0], err)
+		}
+		rule := &Rule{Pattern: fields[0], re: re}
+		if len(fields) > 1 {
+			rule.Owners = fields[1:]
+		}
+		rs = append(rs, rule)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// Find reads and parses the first CODEOWNERS file (in the locations
+// listed in Paths) that exists in fs. If there is none, it returns a
+// nil Ruleset and no error.
+func Find(fs vfs.FileSystem) (Ruleset, error) {
+	for _, path := range Paths {
+		f, err := fs.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		rs, err := Parse(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		return rs, nil
+	}
+	return nil, nil
+}
+
+// compilePattern converts a gitignore-style pattern to a regexp that
+// matches slash-separated paths relative to the repository root.
+//
+// A pattern containing a slash (other than a trailing one) is
+// anchored to the repository root; otherwise it matches at any
+// depth. A pattern matches both the file or directory it names and
+// everything beneath it.
+func compilePattern(pat string) (*regexp.Regexp, error) {
+	dirOnly := strings.HasSuffix(pat, "/")
+	pat = strings.TrimSuffix(pat, "/")
+	anchored := strings.Contains(pat, "/")
+	pat = strings.TrimPrefix(pat, "/")
+	if pat == "" {
+		return nil, fmt.Errorf("empty pattern")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("^")
+	if !anchored {
+		buf.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(pat); i++ {
+		switch c := pat[i]; {
+		case strings.HasPrefix(pat[i:], "**/"):
+			buf.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pat[i:], "/**") && i+3 == len(pat):
+			buf.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(pat[i:], "**"):
+			buf.WriteString(".*")
+			i++
+		case c == '*':
+			buf.WriteString("[^/]*")
+		case c == '?':
+			buf.WriteString("[^/]")
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if dirOnly {
+		buf.WriteString("/.*")
+	} else {
+		buf.WriteString("(?:/.*)?")
+	}
+	buf.WriteString("$")
+	return regexp.Compile(buf.String())
+}
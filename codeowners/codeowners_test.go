@@ -0,0 +1,121 @@
+package codeowners
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/godoc/vfs/mapfs"
+)
+
+func TestCompilePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		match   []string
+		noMatch []string
+	}{
+		{"*", []string{"a", "a/b", "a/b/c.go"}, nil},
+		{"*.go", []string{"a.go", "a/b.go", "a/b/c.go"}, []string{"a.goo", "a.js"}},
+		{"/a.go", []string{"a.go"}, []string{"b/a.go"}},
+		{"a", []string{"a", "a/b", "b/a", "b/a/c"}, []string{"ab", "b/ab"}},
+		{"a/", []string{"a/b", "b/a/c"}, []string{"a"}},
+		{"/a/", []string{"a/b", "a/b/c"}, []string{"a", "b/a/c"}},
+		{"a/b", []string{"a/b", "a/b/c"}, []string{"c/a/b"}},
+		{"a/*.go", []string{"a/b.go"}, []string{"a/b/c.go", "b.go"}},
+		{"**/a", []string{"a", "b/a", "b/c/a/d"}, []string{"ba"}},
+		{"a/**", []string{"a/b", "a/b/c"}, []string{"a", "b/a/c"}},
+		{"a/**/b", []string{"a/b", "a/x/b", "a/x/y/b"}, []string{"x/a/b"}},
+		{"a?c", []string{"abc", "x/abc"}, []string{"ac", "a/c"}},
+	}
+	for _, test := range tests {
+		re, err := compilePattern(test.pattern)
+		if err != nil {
+			t.Errorf("%q: %s", test.pattern, err)
+			continue
+		}
+		for _, file := range test.match {
+			if !re.MatchString(file) {
+				t.Errorf("%q: want match %q (regexp %s)", test.pattern, file, re)
+			}
+		}
+		for _, file := range test.noMatch {
+			if re.MatchString(file) {
+				t.Errorf("%q: want no match %q (regexp %s)", test.pattern, file, re)
+			}
+		}
+	}
+}
+
+func TestRuleset_Owners(t *testing.T) {
+	rs, err := Parse(strings.NewReader(`
+# Default owners.
+*       @org/core
+
+*.js    @org/frontend alice@example.com # Inline comment.
+/docs/  @org/docs
+/docs/generated/
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 4 {
+		t.Fatalf("got %d rules, want 4", len(rs))
+	}
+
+	tests := map[string][]string{
+		"main.go":                {"@org/core"},
+		"web/app.js":             {"@org/frontend", "alice@example.com"},
+		"docs/index.md":          {"@org/docs"},
+		"docs/app.js":            {"@org/docs"},
+		"docs/generated/api.md":  nil,
+		"/docs/generated/api.md": nil,
+	}
+	for file, want := range tests {
+		if got := rs.Owners(file); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got owners %v, want %v", file, got, want)
+		}
+	}
+
+	if got, want := rs.FilesOwners([]string{"web/app.js", "main.go", "x.go"}), []string{"@org/core", "@org/frontend", "alice@example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got files owners %v, want %v", got, want)
+	}
+}
+
+func TestParse_invalidPattern(t *testing.T) {
+	if _, err := Parse(strings.NewReader("/ @a\n")); err == nil {
+		t.Error("got err == nil, want error")
+	}
+}
+
+func TestFind(t *testing.T) {
+	rs, err := Find(mapfs.New(map[string]string{
+		".github/CODEOWNERS": "* @a\n",
+		"docs/CODEOWNERS":    "* @b\n",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rs.Owners("f"), []string{"@a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got owners %v, want %v", got, want)
+	}
+
+	// .github/CODEOWNERS takes precedence over the root CODEOWNERS.
+	rs, err = Find(mapfs.New(map[string]string{
+		"CODEOWNERS":         "* @c\n",
+		".github/CODEOWNERS": "* @a\n",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rs.Owners("f"), []string{"@a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got owners %v, want %v", got, want)
+	}
+
+	rs, err = Find(mapfs.New(map[string]string{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs != nil {
+		t.Errorf("got %v, want nil ruleset", rs)
+	}
+}
@@ -0,0 +1,9 @@
+// Package codeowners parses CODEOWNERS files, which assign owners
+// (teams or users) to files in a repository using gitignore-style
+// patterns.
+//
+// Ownership is recorded on each source unit's and def's Owners field
+// at import time, so that stores can answer "what does team X own?"
+// queries (e.g., using the store.ByOwner filter) without consulting
+// the repository.
+package codeowners
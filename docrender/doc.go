@@ -0,0 +1,11 @@
+// Package docrender renders the documentation stored on defs
+// (graph.DefDoc) as sanitized HTML.
+//
+// Docs are stored in whatever format the toolchain emitted (plain
+// text, markdown, HTML, etc.). A Pipeline picks a Renderer for each
+// doc based on its format and, optionally, the def's source unit type
+// (e.g., plain-text Go docs follow godoc conventions), and then
+// sanitizes the result, so that consumers can display docs from
+// untrusted toolchains without each implementing doc formatting and
+// HTML sanitization.
+package docrender
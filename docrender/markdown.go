@@ -0,0 +1,372 @@
+package docrender
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// Markdown renders markdown docs. It supports the commonly used
+// subset of CommonMark: ATX headings, paragraphs, fenced and indented
+// code blocks, block quotes, ordered and unordered lists, horizontal
+// rules, and inline code, emphasis, links, and autolinks. Raw HTML is
+// escaped (not passed through).
+var Markdown Renderer = RendererFunc(renderMarkdown)
+
+func renderMarkdown(data string) (string, error) {
+	var buf bytes.Buffer
+	renderMarkdownBlocks(&buf, strings.Split(strings.Replace(data, "\r\n", "\n", -1), "\n"))
+	return buf.String(), nil
+}
+
+var (
+	mdHeadingRE    = regexp.MustCompile(`^(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	mdHRRE         = regexp.MustCompile(`^ {0,3}(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	mdFenceRE      = regexp.MustCompile("^ {0,3}(```+|~~~+)[ \t]*([^ \t`]*)")
+	mdBulletRE     = regexp.MustCompile(`^ {0,3}([-*+])[ \t]+`)
+	mdOrderedRE    = regexp.MustCompile(`^ {0,3}([0-9]{1,9})[.)][ \t]+`)
+	mdQuoteRE      = regexp.MustCompile(`^ {0,3}> ?`)
+	mdIndentCodeRE = regexp.MustCompile(`^(?: {4}|\t)`)
+)
+
+func isBlank(line string) bool { return strings.TrimSpace(line) == "" }
+
+// startsBlock reports whether line starts a block that interrupts a
+// paragraph.
+func startsBlock(line string) bool {
+	return mdHeadingRE.MatchString(line) || mdHRRE.MatchString(line) || mdFenceRE.MatchString(line) ||
+		mdBulletRE.MatchString(line) || mdOrderedRE.MatchString(line) || mdQuoteRE.MatchString(line)
+}
+
+func renderMarkdownBlocks(buf *bytes.Buffer, lines []string) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case isBlank(line):
+			i++
+
+		case mdFenceRE.MatchString(line):
+			m := mdFenceRE.FindStringSubmatch(line)
+			fence, lang := m[1], m[2]
+			i++
+			var code []string
+			for ; i < len(lines); i++ {
+				if strings.HasPrefix(strings.TrimLeft(lines[i], " "), fence[:3]) && strings.Trim(strings.TrimSpace(lines[i]), fence[:1]) == "" {
+					i++
+					break
+				}
+				code = append(code, lines[i])
+			}
+			buf.WriteString("<pre><code")
+			if lang != "" {
+				buf.WriteString(` class="language-` + html.EscapeString(lang) + `"`)
+			}
+			buf.WriteString(">")
+			writeCodeLines(buf, code)
+			buf.WriteString("</code></pre>\n")
+
+		case mdHeadingRE.MatchString(line):
+			m := mdHeadingRE.FindStringSubmatch(line)
+			tag := "h" + string('0'+byte(len(m[1])))
+			buf.WriteString("<" + tag + ">" + renderInline(m[2]) + "</" + tag + ">\n")
+			i++
+
+		case mdHRRE.MatchString(line):
+			buf.WriteString("<hr>\n")
+			i++
+
+		case mdQuoteRE.MatchString(line):
+			var quoted []string
+			for ; i < len(lines) && mdQuoteRE.MatchString(lines[i]); i++ {
+				quoted = append(quoted, mdQuoteRE.ReplaceAllString(lines[i], ""))
+			}
+			buf.WriteString("<blockquote>\n")
+			renderMarkdownBlocks(buf, quoted)
+			buf.WriteString("</blockquote>\n")
+
+		case mdBulletRE.MatchString(line) || mdOrderedRE.MatchString(line):
+			i = renderMarkdownList(buf, lines, i)
+
+		case mdIndentCodeRE.MatchString(line):
+			var code []string
+			for ; i < len(lines) && (mdIndentCodeRE.MatchString(lines[i]) || isBlank(lines[i])); i++ {
+				code = append(code, mdIndentCodeRE.ReplaceAllString(lines[i], ""))
+			}
+			for len(code) > 0 && isBlank(code[len(code)-1]) {
+				code = code[:len(code)-1]
+			}
+			buf.WriteString("<pre><code>")
+			writeCodeLines(buf, code)
+			buf.WriteString("</code></pre>\n")
+
+		default:
+			var para []string
+			for ; i < len(lines) && !isBlank(lines[i]) && (len(para) == 0 || !startsBlock(lines[i])); i++ {
+				para = append(para, strings.TrimSpace(lines[i]))
+			}
+			buf.WriteString("<p>" + renderInline(strings.Join(para, "\n")) + "</p>\n")
+		}
+	}
+}
+
+func writeCodeLines(buf *bytes.Buffer, lines []string) {
+	for _, line := range lines {
+		buf.WriteString(html.EscapeString(line))
+		buf.WriteByte('\n')
+	}
+}
+
+// renderMarkdownList renders the list that starts at lines[start] and
+// returns the index of the first line after it.
+func renderMarkdownList(buf *bytes.Buffer, lines []string, start int) int {
+	ordered := mdOrderedRE.MatchString(lines[start])
+	itemRE := mdBulletRE
+	tag := "ul"
+	if ordered {
+		itemRE, tag = mdOrderedRE, "ol"
+	}
+	buf.WriteString("<" + tag)
+	if ordered {
+		if n := strings.TrimLeft(mdOrderedRE.FindStringSubmatch(lines[start])[1], "0"); n != "1" {
+			if n == "" {
+				n = "0"
+			}
+			buf.WriteString(` start="` + n + `"`)
+		}
+	}
+	buf.WriteString(">\n")
+
+	var items [][]string
+	tight := true
+	i := start
+	for i < len(lines) && itemRE.MatchString(lines[i]) {
+		indent := len(itemRE.FindString(lines[i]))
+		item := []string{lines[i][indent:]}
+		i++
+		// Continuation lines are indented (or are lazy paragraph
+		// continuations). A blank line ends the item unless the
+		// next line is indented.
+		for i < len(lines) {
+			if isBlank(lines[i]) {
+				if i+1 < len(lines) && leadingSpaces(lines[i+1]) >= 2 {
+					tight = false
+					item = append(item, "")
+					i++
+					continue
+				}
+				break
+			}
+			if leadingSpaces(lines[i]) >= 2 {
+				item = append(item, strings.TrimPrefix(lines[i], strings.Repeat(" ", minInt(indent, leadingSpaces(lines[i])))))
+			} else if !startsBlock(lines[i]) {
+				item = append(item, lines[i])
+			} else {
+				break
+			}
+			i++
+		}
+
+		items = append(items, item)
+
+		// Skip blank lines between items.
+		j := i
+		for j < len(lines) && isBlank(lines[j]) {
+			j++
+		}
+		if j < len(lines) && itemRE.MatchString(lines[j]) {
+			if j > i {
+				tight = false
+			}
+			i = j
+		}
+	}
+
+	for _, item := range items {
+		var itemBuf bytes.Buffer
+		renderMarkdownBlocks(&itemBuf, item)
+		content := strings.TrimSuffix(itemBuf.String(), "\n")
+		if tight && strings.HasPrefix(content, "<p>") {
+			// Items in tight lists (with no blank lines) have no
+			// paragraph wrapping their text.
+			end := strings.Index(content, "</p>")
+			content = content[len("<p>"):end] + content[end+len("</p>"):]
+		}
+		buf.WriteString("<li>" + content + "</li>\n")
+	}
+	buf.WriteString("</" + tag + ">\n")
+	return i
+}
+
+func leadingSpaces(s string) int {
+	return len(s) - len(strings.TrimLeft(s, " "))
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+var mdAutolinkRE = regexp.MustCompile(`^<((?:https?://|mailto:)[^<>\s]+)>`)
+
+// renderInline renders the inline markdown in s.
+func renderInline(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte("\\`*_{}[]()#+-.!<>|~", s[i+1]) != -1:
+			buf.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+			continue
+
+		case c == '`':
+			n := runLen(s[i:], '`')
+			fence := s[i : i+n]
+			if end := strings.Index(s[i+n:], fence); end != -1 {
+				code := strings.TrimSpace(strings.Replace(s[i+n:i+n+end], "\n", " ", -1))
+				buf.WriteString("<code>" + html.EscapeString(code) + "</code>")
+				i += n + end + n
+				continue
+			}
+			buf.WriteString(fence)
+			i += n
+			continue
+
+		case c == '*' || c == '_':
+			if out, n, ok := renderEmphasis(s, i); ok {
+				buf.WriteString(out)
+				i += n
+				continue
+			}
+
+		case c == '[':
+			if out, n, ok := renderLink(s[i:]); ok {
+				buf.WriteString(out)
+				i += n
+				continue
+			}
+
+		case c == '<':
+			if m := mdAutolinkRE.FindStringSubmatch(s[i:]); m != nil {
+				u := html.EscapeString(m[1])
+				buf.WriteString(`<a href="` + u + `">` + u + "</a>")
+				i += len(m[0])
+				continue
+			}
+		}
+		buf.WriteString(html.EscapeString(s[i : i+1]))
+		i++
+	}
+	return buf.String()
+}
+
+func runLen(s string, c byte) int {
+	n := 0
+	for n < len(s) && s[n] == c {
+		n++
+	}
+	return n
+}
+
+// renderEmphasis renders the emphasis (*em*, **strong**, _em_, or
+// __strong__) that starts at s[i], if any.
+func renderEmphasis(s string, i int) (string, int, bool) {
+	c := s[i]
+	n := runLen(s[i:], c)
+	if n > 2 {
+		n = 2
+	}
+	delim := s[i : i+n]
+	if c == '_' && i > 0 && isWordChar(s[i-1]) {
+		return "", 0, false // intraword underscore (e.g., snake_case)
+	}
+	start := i + n
+	if start >= len(s) || isSpaceOrNewline(s[start]) {
+		return "", 0, false
+	}
+	for j := start + 1; j+n <= len(s); j++ {
+		if s[j:j+n] != delim || isSpaceOrNewline(s[j-1]) {
+			continue
+		}
+		if j+n < len(s) && s[j+n] == c {
+			continue // part of a longer delimiter run
+		}
+		if c == '_' && j+n < len(s) && isWordChar(s[j+n]) {
+			continue
+		}
+		tag := "em"
+		if n == 2 {
+			tag = "strong"
+		}
+		return "<" + tag + ">" + renderInline(s[start:j]) + "</" + tag + ">", j + n - i, true
+	}
+	return "", 0, false
+}
+
+// renderLink renders the link ([text](url "title")) at the start of s,
+// if any. Links with unsafe URLs are rendered as their text.
+func renderLink(s string) (string, int, bool) {
+	depth := 0
+	closeText := -1
+	for j := 0; j < len(s); j++ {
+		if s[j] == '[' {
+			depth++
+		} else if s[j] == ']' {
+			depth--
+			if depth == 0 {
+				closeText = j
+				break
+			}
+		}
+	}
+	if closeText == -1 || closeText+1 >= len(s) || s[closeText+1] != '(' {
+		return "", 0, false
+	}
+	closeURL := -1
+	depth = 0
+	for j := closeText + 2; j < len(s) && closeURL == -1; j++ {
+		switch s[j] {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				closeURL = j - (closeText + 2)
+			}
+			depth--
+		}
+	}
+	if closeURL == -1 {
+		return "", 0, false
+	}
+	text := s[1:closeText]
+	dest := strings.TrimSpace(s[closeText+2 : closeText+2+closeURL])
+	n := closeText + 2 + closeURL + 1
+
+	var title string
+	if sp := strings.IndexAny(dest, " \t"); sp != -1 {
+		t := strings.TrimSpace(dest[sp:])
+		if len(t) >= 2 && (t[0] == '"' && t[len(t)-1] == '"' || t[0] == '\'' && t[len(t)-1] == '\'') {
+			title = t[1 : len(t)-1]
+			dest = dest[:sp]
+		}
+	}
+	dest = strings.TrimSuffix(strings.TrimPrefix(dest, "<"), ">")
+
+	if !safeURL(dest) {
+		return renderInline(text), n, true
+	}
+	out := `<a href="` + html.EscapeString(dest) + `"`
+	if title != "" {
+		out += ` title="` + html.EscapeString(title) + `"`
+	}
+	return out + ">" + renderInline(text) + "</a>", n, true
+}
+
+func isWordChar(c byte) bool {
+	return isLetter(c) || '0' <= c && c <= '9' || c >= 0x80
+}
+
+func isSpaceOrNewline(c byte) bool { return isSpace(c) }
@@ -0,0 +1,36 @@
+package docrender
+
+import "testing"
+
+func TestMarkdown(t *testing.T) {
+	tests := map[string]string{
+		"":                          "",
+		"a\nb\n\nc":                 "<p>a\nb</p>\n<p>c</p>\n",
+		"# H1\n## H2 ##":            "<h1>H1</h1>\n<h2>H2</h2>\n",
+		"x\n***\ny":                 "<p>x</p>\n<hr>\n<p>y</p>\n",
+		"```go\na < b\n```\nx":      "<pre><code class=\"language-go\">a &lt; b\n</code></pre>\n<p>x</p>\n",
+		"x\n\n    code\n\n    more": "<p>x</p>\n<pre><code>code\n\nmore\n</code></pre>\n",
+		"> q\n> r":                  "<blockquote>\n<p>q\nr</p>\n</blockquote>\n",
+		"- a\n- b\n  - c":           "<ul>\n<li>a</li>\n<li>b\n<ul>\n<li>c</li>\n</ul></li>\n</ul>\n",
+		"- a\n\n- b":                "<ul>\n<li><p>a</p></li>\n<li><p>b</p></li>\n</ul>\n",
+		"3. a\n4. b":                "<ol start=\"3\">\n<li>a</li>\n<li>b</li>\n</ol>\n",
+		"`a<b` **s** *e* _e_":       "<p><code>a&lt;b</code> <strong>s</strong> <em>e</em> <em>e</em></p>\n",
+		"snake_case_name":           "<p>snake_case_name</p>\n",
+		"2 * 3 * 4":                 "<p>2 * 3 * 4</p>\n",
+		`\*x\*`:                     "<p>*x*</p>\n",
+		"[a](http://x.com \"t\")":   "<p><a href=\"http://x.com\" title=\"t\">a</a></p>\n",
+		"[a](javascript:alert(1))":  "<p>a</p>\n",
+		"<http://x.com>":            "<p><a href=\"http://x.com\">http://x.com</a></p>\n",
+		"<b>raw</b>":                "<p>&lt;b&gt;raw&lt;/b&gt;</p>\n",
+	}
+	for in, want := range tests {
+		got, err := Markdown.RenderHTML(in)
+		if err != nil {
+			t.Errorf("%q: %s", in, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%q: got %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package docrender
+
+import (
+	"bytes"
+	"go/doc"
+	"html"
+	"html/template"
+	"strings"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+// Doc formats (the values of graph.DefDoc's Format field) that have
+// built-in renderers.
+const (
+	FormatPlain    = "text/plain"
+	FormatMarkdown = "text/x-markdown"
+	FormatHTML     = "text/html"
+)
+
+// A Renderer converts doc data in some format to HTML. The HTML need
+// not be sanitized; the Pipeline sanitizes it.
+type Renderer interface {
+	RenderHTML(data string) (string, error)
+}
+
+// RendererFunc is an adapter that allows an ordinary function to be
+// used as a Renderer.
+type RendererFunc func(data string) (string, error)
+
+// RenderHTML implements Renderer.
+func (f RendererFunc) RenderHTML(data string) (string, error) { return f(data) }
+
+var (
+	// Plain renders plain-text docs as HTML paragraphs (separated by
+	// blank lines in the text).
+	Plain Renderer = RendererFunc(renderPlain)
+
+	// HTML renders HTML docs as-is (the Pipeline sanitizes them).
+	HTML Renderer = RendererFunc(func(data string) (string, error) { return data, nil })
+
+	// Godoc renders plain-text docs that follow godoc conventions
+	// (headings, indented preformatted blocks, and URLs) as HTML.
+	Godoc Renderer = RendererFunc(renderGodoc)
+)
+
+func renderPlain(data string) (string, error) {
+	var buf bytes.Buffer
+	for _, para := range strings.Split(strings.Replace(data, "\r\n", "\n", -1), "\n\n") {
+		if para = strings.TrimSpace(para); para == "" {
+			continue
+		}
+		buf.WriteString("<p>" + html.EscapeString(para) + "</p>\n")
+	}
+	return buf.String(), nil
+}
+
+func renderGodoc(data string) (string, error) {
+	var buf bytes.Buffer
+	doc.ToHTML(&buf, data, nil)
+	return buf.String(), nil
+}
+
+// A Pipeline renders def docs as sanitized HTML.
+type Pipeline struct {
+	// Formats maps doc formats to their renderers. Docs in formats
+	// that are not in Formats are rendered with Plain.
+	Formats map[string]Renderer
+
+	// UnitTypes maps source unit types to renderers (keyed on doc
+	// format) that override Formats for defs in units of that type.
+	UnitTypes map[string]map[string]Renderer
+}
+
+// NewPipeline returns a Pipeline with the built-in renderers. Plain-text
+// docs on defs in GoPackage units are rendered with Godoc.
+func NewPipeline() *Pipeline {
+	return &Pipeline{
+		Formats: map[string]Renderer{
+			FormatPlain:    Plain,
+			FormatMarkdown: Markdown,
+			FormatHTML:     HTML,
+		},
+		UnitTypes: map[string]map[string]Renderer{
+			"GoPackage": {FormatPlain: Godoc},
+		},
+	}
+}
+
+// Renderer returns the renderer that p uses for docs in the given
+// format on defs in units of the given type.
+func (p *Pipeline) Renderer(unitType, format string) Renderer {
+	if r, present := p.UnitTypes[unitType][format]; present {
+		return r
+	}
+	if r, present := p.Formats[format]; present {
+		return r
+	}
+	return Plain
+}
+
+// Render renders doc (on a def in a unit of the given type) as
+// sanitized HTML.
+func (p *Pipeline) Render(unitType string, d *graph.DefDoc) (template.HTML, error) {
+	out, err := p.Renderer(unitType, d.Format).RenderHTML(d.Data)
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(Sanitize(out)), nil
+}
+
+// formatPreference lists doc formats from most to least preferred
+// when a def has docs in multiple formats.
+var formatPreference = []string{FormatHTML, FormatMarkdown, FormatPlain}
+
+// RenderDef renders def's doc as sanitized HTML. If def has docs in
+// multiple formats, the richest one (HTML, then markdown, then plain
+// text, then the first doc) is used. If def has no docs, it returns
+// "".
+func (p *Pipeline) RenderDef(def *graph.Def) (template.HTML, error) {
+	if len(def.Docs) == 0 {
+		return "", nil
+	}
+	d := def.Docs[0]
+outer:
+	for _, format := range formatPreference {
+		for _, dd := range def.Docs {
+			if dd.Format == format {
+				d = dd
+				break outer
+			}
+		}
+	}
+	return p.Render(def.UnitType, d)
+}
+
+// defaultPipeline is the pipeline used by Render and RenderDef.
+var defaultPipeline = NewPipeline()
+
+// Render renders doc (on a def in a unit of the given type) as
+// sanitized HTML using the built-in renderers.
+func Render(unitType string, d *graph.DefDoc) (template.HTML, error) {
+	return defaultPipeline.Render(unitType, d)
+}
+
+// RenderDef renders def's doc as sanitized HTML using the built-in
+// renderers. See (*Pipeline).RenderDef.
+func RenderDef(def *graph.Def) (template.HTML, error) {
+	return defaultPipeline.RenderDef(def)
+}
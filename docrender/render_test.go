@@ -0,0 +1,65 @@
+package docrender
+
+import (
+	"html/template"
+	"strings"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+func TestPipeline(t *testing.T) {
+	tests := []struct {
+		unitType string
+		doc      graph.DefDoc
+		want     template.HTML
+	}{
+		{"", graph.DefDoc{Format: FormatPlain, Data: "a <b>\n\nc"}, "<p>a &lt;b&gt;</p>\n<p>c</p>\n"},
+		{"", graph.DefDoc{Format: "text/x-rst", Data: "a*"}, "<p>a*</p>\n"},
+		{"", graph.DefDoc{Format: FormatMarkdown, Data: "*a*"}, "<p><em>a</em></p>\n"},
+		{"", graph.DefDoc{Format: FormatHTML, Data: "<p onclick=x>a<script>b</script>"}, "<p>a</p>"},
+		{"GoPackage", graph.DefDoc{Format: FormatPlain, Data: "a\n\n\tcode\n"}, "<p>a\n</p><pre>code\n</pre>\n"},
+	}
+	for _, test := range tests {
+		got, err := Render(test.unitType, &test.doc)
+		if err != nil {
+			t.Errorf("%s %+v: %s", test.unitType, test.doc, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s %+v: got %q, want %q", test.unitType, test.doc, got, test.want)
+		}
+	}
+}
+
+func TestPipeline_custom(t *testing.T) {
+	p := NewPipeline()
+	p.UnitTypes["X"] = map[string]Renderer{
+		FormatPlain: RendererFunc(func(data string) (string, error) {
+			return `<div class="x" onclick="y">` + strings.ToUpper(data) + "</div>", nil
+		}),
+	}
+	def := &graph.Def{
+		DefKey: graph.DefKey{UnitType: "X"},
+		Docs: []*graph.DefDoc{
+			{Format: "text/x-rst", Data: "rst"},
+			{Format: FormatPlain, Data: "plain"},
+		},
+	}
+	got, err := p.RenderDef(def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := template.HTML(`<div class="x">PLAIN</div>`); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	def.Docs = append(def.Docs, &graph.DefDoc{Format: FormatMarkdown, Data: "**md**"})
+	if got, _ := p.RenderDef(def); got != "<p><strong>md</strong></p>\n" {
+		t.Errorf("got %q, want markdown doc to be preferred", got)
+	}
+
+	if got, _ := p.RenderDef(&graph.Def{}); got != "" {
+		t.Errorf("got %q for def with no docs, want empty", got)
+	}
+}
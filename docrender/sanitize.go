@@ -0,0 +1,321 @@
+package docrender
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// allowedTags maps each HTML element that may appear in sanitized
+// HTML to its allowed attributes. All other elements are removed (but
+// their contents are kept, as text), except for those in
+// droppedTags.
+var allowedTags = map[string][]string{
+	"a":          {"href", "title"},
+	"abbr":       {"title"},
+	"b":          nil,
+	"blockquote": nil,
+	"br":         nil,
+	"code":       {"class"},
+	"dd":         nil,
+	"del":        nil,
+	"div":        {"class"},
+	"dl":         nil,
+	"dt":         nil,
+	"em":         nil,
+	"h1":         {"id"},
+	"h2":         {"id"},
+	"h3":         {"id"},
+	"h4":         {"id"},
+	"h5":         {"id"},
+	"h6":         {"id"},
+	"hr":         nil,
+	"i":          nil,
+	"ins":        nil,
+	"kbd":        nil,
+	"li":         nil,
+	"ol":         {"start"},
+	"p":          nil,
+	"pre":        {"class"},
+	"s":          nil,
+	"samp":       nil,
+	"span":       {"class"},
+	"strong":     nil,
+	"sub":        nil,
+	"sup":        nil,
+	"table":      nil,
+	"tbody":      nil,
+	"td":         nil,
+	"th":         nil,
+	"thead":      nil,
+	"tr":         nil,
+	"tt":         nil,
+	"u":          nil,
+	"ul":         nil,
+	"var":        nil,
+}
+
+// voidTags are the allowed elements that have no end tag.
+var voidTags = map[string]bool{"br": true, "hr": true}
+
+// closesP are the allowed elements whose start tag implicitly closes
+// an open <p> element (as in HTML parsing).
+var closesP = map[string]bool{
+	"blockquote": true, "div": true, "dl": true, "h1": true, "h2": true, "h3": true,
+	"h4": true, "h5": true, "h6": true, "hr": true, "ol": true, "p": true, "pre": true,
+	"table": true, "ul": true,
+}
+
+// droppedTags are the elements whose contents are removed along with
+// them.
+var droppedTags = map[string]bool{
+	"embed":    true,
+	"iframe":   true,
+	"noscript": true,
+	"object":   true,
+	"script":   true,
+	"style":    true,
+	"template": true,
+	"textarea": true,
+	"title":    true,
+}
+
+// urlAttrs are the attributes whose values are URLs (see safeURL).
+var urlAttrs = map[string]bool{"href": true}
+
+var entityRE = regexp.MustCompile(`^&(#[0-9]{1,7}|#[xX][0-9a-fA-F]{1,6}|[a-zA-Z][a-zA-Z0-9]{1,31});`)
+
+// Sanitize returns s (an HTML fragment) with all elements and
+// attributes that are not on an allowlist removed, unsafe URLs
+// removed, and all unclosed elements closed, so that it is safe to
+// include in a page. Text is preserved (and escaped where necessary),
+// except for the contents of elements such as <script> and <style>.
+func Sanitize(s string) string {
+	var buf bytes.Buffer
+	var open []string // stack of open elements
+	for i := 0; i < len(s); {
+		switch c := s[i]; c {
+		case '<':
+			n, ok := sanitizeTag(&buf, s[i:], &open)
+			if !ok {
+				buf.WriteString("&lt;")
+				n = 1
+			}
+			i += n
+		case '&':
+			if m := entityRE.FindString(s[i:]); m != "" {
+				buf.WriteString(m)
+				i += len(m)
+			} else {
+				buf.WriteString("&amp;")
+				i++
+			}
+		case '>':
+			buf.WriteString("&gt;")
+			i++
+		case '"':
+			buf.WriteString("&#34;")
+			i++
+		case 0:
+			i++
+		default:
+			buf.WriteByte(c)
+			i++
+		}
+	}
+	for j := len(open) - 1; j >= 0; j-- {
+		buf.WriteString("</" + open[j] + ">")
+	}
+	return buf.String()
+}
+
+// sanitizeTag parses the tag (or comment, etc.) at the start of s and
+// writes its sanitized form to buf. It returns the number of bytes
+// consumed, or false if s does not start with a well-formed tag.
+func sanitizeTag(buf *bytes.Buffer, s string, open *[]string) (int, bool) {
+	// Comments, doctypes, and processing instructions are removed.
+	if strings.HasPrefix(s, "<!--") {
+		if end := strings.Index(s[4:], "-->"); end != -1 {
+			return 4 + end + 3, true
+		}
+		return len(s), true
+	}
+	if strings.HasPrefix(s, "<!") || strings.HasPrefix(s, "<?") {
+		if end := strings.IndexByte(s, '>'); end != -1 {
+			return end + 1, true
+		}
+		return 0, false
+	}
+
+	i := 1
+	isEnd := i < len(s) && s[i] == '/'
+	if isEnd {
+		i++
+	}
+	nameStart := i
+	for i < len(s) && isTagNameChar(s[i]) {
+		i++
+	}
+	if i == nameStart || !isLetter(s[nameStart]) {
+		return 0, false
+	}
+	name := strings.ToLower(s[nameStart:i])
+
+	attrs, n, ok := parseAttrs(s[i:])
+	if !ok {
+		return 0, false
+	}
+	i += n
+
+	if isEnd {
+		// Close the element (and any elements opened inside it
+		// that were not closed), if it is open.
+		for j := len(*open) - 1; j >= 0; j-- {
+			if (*open)[j] == name {
+				for k := len(*open) - 1; k >= j; k-- {
+					buf.WriteString("</" + (*open)[k] + ">")
+				}
+				*open = (*open)[:j]
+				break
+			}
+		}
+		return i, true
+	}
+
+	if droppedTags[name] {
+		// Skip to the end of the element.
+		end := strings.Index(strings.ToLower(s[i:]), "</"+name)
+		if end == -1 {
+			return len(s), true
+		}
+		i += end
+		if gt := strings.IndexByte(s[i:], '>'); gt != -1 {
+			return i + gt + 1, true
+		}
+		return len(s), true
+	}
+
+	allowedAttrs, allowed := allowedTags[name]
+	if !allowed {
+		return i, true
+	}
+	if closesP[name] && len(*open) > 0 && (*open)[len(*open)-1] == "p" {
+		buf.WriteString("</p>")
+		*open = (*open)[:len(*open)-1]
+	}
+	buf.WriteString("<" + name)
+	for _, a := range attrs {
+		if !containsString(allowedAttrs, a.name) {
+			continue
+		}
+		if urlAttrs[a.name] && !safeURL(a.val) {
+			continue
+		}
+		buf.WriteString(" " + a.name + `="` + html.EscapeString(a.val) + `"`)
+	}
+	buf.WriteString(">")
+	if !voidTags[name] {
+		*open = append(*open, name)
+	}
+	return i, true
+}
+
+type attr struct{ name, val string }
+
+// parseAttrs parses the attributes of a tag and the tag's closing
+// '>' (or "/>"). It returns the attributes (with unescaped values)
+// and the number of bytes consumed.
+func parseAttrs(s string) (attrs []attr, n int, ok bool) {
+	i := 0
+	for {
+		for i < len(s) && isSpace(s[i]) {
+			i++
+		}
+		if i == len(s) {
+			return nil, 0, false
+		}
+		if s[i] == '>' {
+			return attrs, i + 1, true
+		}
+		if strings.HasPrefix(s[i:], "/>") {
+			return attrs, i + 2, true
+		}
+		if s[i] == '/' {
+			i++
+			continue
+		}
+
+		nameStart := i
+		for i < len(s) && !isSpace(s[i]) && s[i] != '=' && s[i] != '>' && s[i] != '/' && s[i] != '<' {
+			i++
+		}
+		if i == nameStart {
+			return nil, 0, false
+		}
+		a := attr{name: strings.ToLower(s[nameStart:i])}
+		for i < len(s) && isSpace(s[i]) {
+			i++
+		}
+		if i < len(s) && s[i] == '=' {
+			i++
+			for i < len(s) && isSpace(s[i]) {
+				i++
+			}
+			if i == len(s) {
+				return nil, 0, false
+			}
+			if q := s[i]; q == '"' || q == '\'' {
+				end := strings.IndexByte(s[i+1:], q)
+				if end == -1 {
+					return nil, 0, false
+				}
+				a.val = s[i+1 : i+1+end]
+				i += 1 + end + 1
+			} else {
+				valStart := i
+				for i < len(s) && !isSpace(s[i]) && s[i] != '>' {
+					i++
+				}
+				a.val = s[valStart:i]
+			}
+			a.val = html.UnescapeString(a.val)
+		}
+		attrs = append(attrs, a)
+	}
+}
+
+// safeURL reports whether u is a relative URL or an absolute URL with
+// a safe scheme (http, https, or mailto).
+func safeURL(u string) bool {
+	u = strings.TrimSpace(u)
+	for _, c := range u {
+		if c < 0x20 || c == 0x7F {
+			return false
+		}
+	}
+	colon := strings.IndexByte(u, ':')
+	if colon == -1 || strings.ContainsAny(u[:colon], "/?#") {
+		return true // relative URL
+	}
+	switch strings.ToLower(u[:colon]) {
+	case "http", "https", "mailto":
+		return true
+	}
+	return false
+}
+
+func isLetter(c byte) bool { return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' }
+
+func isTagNameChar(c byte) bool { return isLetter(c) || '0' <= c && c <= '9' || c == '-' }
+
+func isSpace(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' }
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package docrender
+
+import "testing"
+
+func TestSanitize(t *testing.T) {
+	tests := map[string]string{
+		"a < b & c":                        "a &lt; b &amp; c",
+		"&amp; &#39; &bogus":               "&amp; &#39; &amp;bogus",
+		"<p>x</p>":                         "<p>x</p>",
+		"<P CLASS=x>x":                     "<p>x</p>",
+		"<b>x<i>y</b>z":                    "<b>x<i>y</i></b>z",
+		"x</b>y":                           "xy",
+		"<br/><hr>":                        "<br><hr>",
+		"<script>alert(1)</script>x":       "x",
+		"<SCRIPT>alert(1)":                 "",
+		"<style>p{}</style><p>x</p>":       "<p>x</p>",
+		"<!-- c -->x<!DOCTYPE html>":       "x",
+		"<blink>x</blink>":                 "x",
+		`<p onclick="f()" style="x">x</p>`: "<p>x</p>",
+		`<a href="http://x.com/?a=1&amp;b=2">x</a>`: `<a href="http://x.com/?a=1&amp;b=2">x</a>`,
+		`<a href="/x" title='t"'>x</a>`:             `<a href="/x" title="t&#34;">x</a>`,
+		`<a href="javascript:alert(1)">x</a>`:       "<a>x</a>",
+		`<a href=" JavaScript:alert(1)">x</a>`:      "<a>x</a>",
+		`<a href="java&#x0A;script:alert(1)">x</a>`: "<a>x</a>",
+		`<a href="mailto:a@b.com">x</a>`:            `<a href="mailto:a@b.com">x</a>`,
+		`<img src=x onerror=alert(1)>`:              "",
+		"<p x=>":                                    "<p></p>",
+		"<p x=\"unterminated>":                      "&lt;p x=&#34;unterminated&gt;",
+		"<p>a<pre>b</pre>":                          "<p>a</p><pre>b</pre>",
+		"1 <2":                                      "1 &lt;2",
+	}
+	for in, want := range tests {
+		if got := Sanitize(in); got != want {
+			t.Errorf("%q: got %q, want %q", in, got, want)
+		}
+	}
+}
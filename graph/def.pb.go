@@ -129,6 +129,26 @@ type Def struct {
 	// tree-path for some def.
 	// The following regex captures the children of a tree-path X: X(/-[^/]*)*(/[^/-][^/]*)
 	TreePath string `protobuf:"bytes,17,opt,name=TreePath,proto3" json:"TreePath,omitempty"`
+	// Author is the email address of the person who authored the most lines
+	// of the def, according to the VCS (e.g., git blame). It is set at import
+	// time if authorship information is requested; graphers should not set it.
+	Author string `protobuf:"bytes,18,opt,name=Author,proto3" json:"Author,omitempty"`
+	// AuthorCommitID is the ID of the most recent commit in which Author
+	// modified the def.
+	AuthorCommitID string `protobuf:"bytes,19,opt,name=AuthorCommitID,proto3" json:"AuthorCommitID,omitempty"`
+	// Owners is the list of owners (e.g., teams or users from a CODEOWNERS
+	// file) of the file that the def is defined in. It is set at import
+	// time if ownership information is requested; graphers should not set it.
+	Owners []string `protobuf:"bytes,20,rep,name=Owners" json:"Owners,omitempty"`
+	// UnknownFields holds the fields of the JSON-encoded def that are
+	// not known to this version of the Def type (e.g., because it was
+	// emitted by a newer toolchain), as a JSON object. They are
+	// re-emitted when the def is JSON-encoded.
+	UnknownFields sourcegraph_com_sqs_pbtypes.RawMessage `protobuf:"bytes,21,opt,name=UnknownFields,proto3,casttype=sourcegraph.com/sqs/pbtypes.RawMessage" json:"-"`
+	// XXX_unrecognized holds the protobuf-encoded fields that are not
+	// known to this version of the Def type. They are re-emitted when
+	// the def is protobuf-encoded.
+	XXX_unrecognized []byte `json:"-"`
 }
 
 func (m *Def) Reset()         { *m = Def{} }
@@ -334,6 +354,52 @@ func (m *Def) MarshalTo(data []byte) (int, error) {
 		i = encodeVarintDef(data, i, uint64(len(m.TreePath)))
 		i += copy(data[i:], m.TreePath)
 	}
+	if len(m.Author) > 0 {
+		data[i] = 0x92
+		i++
+		data[i] = 0x1
+		i++
+		i = encodeVarintDef(data, i, uint64(len(m.Author)))
+		i += copy(data[i:], m.Author)
+	}
+	if len(m.AuthorCommitID) > 0 {
+		data[i] = 0x9a
+		i++
+		data[i] = 0x1
+		i++
+		i = encodeVarintDef(data, i, uint64(len(m.AuthorCommitID)))
+		i += copy(data[i:], m.AuthorCommitID)
+	}
+	if len(m.Owners) > 0 {
+		for _, s := range m.Owners {
+			data[i] = 0xa2
+			i++
+			data[i] = 0x1
+			i++
+			l = len(s)
+			for l >= 1<<7 {
+				data[i] = uint8(uint64(l)&0x7f | 0x80)
+				l >>= 7
+				i++
+			}
+			data[i] = uint8(l)
+			i++
+			i += copy(data[i:], s)
+		}
+	}
+	if m.UnknownFields != nil {
+		if len(m.UnknownFields) > 0 {
+			data[i] = 0xaa
+			i++
+			data[i] = 0x1
+			i++
+			i = encodeVarintDef(data, i, uint64(len(m.UnknownFields)))
+			i += copy(data[i:], m.UnknownFields)
+		}
+	}
+	if m.XXX_unrecognized != nil {
+		i += copy(data[i:], m.XXX_unrecognized)
+	}
 	return i, nil
 }
 
@@ -574,6 +640,29 @@ func (m *Def) Size() (n int) {
 	if l > 0 {
 		n += 2 + l + sovDef(uint64(l))
 	}
+	l = len(m.Author)
+	if l > 0 {
+		n += 2 + l + sovDef(uint64(l))
+	}
+	l = len(m.AuthorCommitID)
+	if l > 0 {
+		n += 2 + l + sovDef(uint64(l))
+	}
+	if len(m.Owners) > 0 {
+		for _, s := range m.Owners {
+			l = len(s)
+			n += 2 + l + sovDef(uint64(l))
+		}
+	}
+	if m.UnknownFields != nil {
+		l = len(m.UnknownFields)
+		if l > 0 {
+			n += 2 + l + sovDef(uint64(l))
+		}
+	}
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
 	return n
 }
 
@@ -1183,6 +1272,121 @@ func (m *Def) Unmarshal(data []byte) error {
 			}
 			m.TreePath = string(data[iNdEx:postIndex])
 			iNdEx = postIndex
+		case 18:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Author", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDef
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthDef
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Author = string(data[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 19:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field AuthorCommitID", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDef
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthDef
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.AuthorCommitID = string(data[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 20:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Owners", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDef
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthDef
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Owners = append(m.Owners, string(data[iNdEx:postIndex]))
+			iNdEx = postIndex
+		case 21:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field UnknownFields", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDef
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDef
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.UnknownFields = append([]byte{}, data[iNdEx:postIndex]...)
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipDef(data[iNdEx:])
@@ -1195,6 +1399,7 @@ func (m *Def) Unmarshal(data []byte) error {
 			if (iNdEx + skippy) > l {
 				return io.ErrUnexpectedEOF
 			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, data[iNdEx:iNdEx+skippy]...)
 			iNdEx += skippy
 		}
 	}
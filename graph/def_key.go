@@ -0,0 +1,89 @@
+package graph
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// An InvalidDefKeyError describes why a DefKey or RefDefKey is
+// malformed.
+type InvalidDefKeyError struct {
+	Field  string // the name of the offending field (e.g., "Path")
+	Value  string // the offending field's value
+	Reason string // why the value is invalid
+}
+
+func (e *InvalidDefKeyError) Error() string {
+	return fmt.Sprintf("invalid def key %s %q: %s", e.Field, e.Value, e.Reason)
+}
+
+// CleanDefPath returns the canonical form of a def path: it is
+// cleaned (as by path.Clean) and has no leading or trailing slashes.
+// An empty defPath is returned unchanged.
+//
+// Toolchains should emit def paths that are already canonical (see
+// ValidateDefPath); CleanDefPath is for normalizing user-supplied
+// paths (e.g., in queries).
+func CleanDefPath(defPath string) string {
+	if defPath == "" {
+		return ""
+	}
+	p := strings.Trim(path.Clean("/"+defPath), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+// ValidateDefPath returns an *InvalidDefKeyError (for the field
+// named by field) if defPath is empty or not in the canonical form
+// returned by CleanDefPath (e.g., if it has a leading or trailing
+// slash, an empty element, or a "." or ".." element).
+func ValidateDefPath(field, defPath string) error {
+	if defPath == "" {
+		return &InvalidDefKeyError{Field: field, Value: defPath, Reason: "empty def path"}
+	}
+	if clean := CleanDefPath(defPath); clean != defPath {
+		return &InvalidDefKeyError{Field: field, Value: defPath, Reason: fmt.Sprintf("def path is not clean (want %q)", clean)}
+	}
+	return nil
+}
+
+// ValidateDefKey returns an *InvalidDefKeyError if k is malformed:
+// if k.Unit is set but k.UnitType is empty, or if k.Path is empty or
+// not clean (see ValidateDefPath). Empty Repo, CommitID, UnitType,
+// and Unit fields are allowed, since def keys are often relative to
+// the repo, commit, or source unit they are stored in.
+func ValidateDefKey(k DefKey) error {
+	if k.Unit != "" && k.UnitType == "" {
+		return &InvalidDefKeyError{Field: "UnitType", Value: k.UnitType, Reason: fmt.Sprintf("empty unit type for unit %q", k.Unit)}
+	}
+	return ValidateDefPath("Path", k.Path)
+}
+
+// NormalizeDefKey returns k with its repo URI normalized (using
+// NormalizeRepoURI) and its path cleaned (using CleanDefPath). The
+// result is not necessarily valid; call ValidateDefKey to check it.
+func NormalizeDefKey(k DefKey) DefKey {
+	k.Repo = NormalizeRepoURI(k.Repo)
+	k.Path = CleanDefPath(k.Path)
+	return k
+}
+
+// ValidateRefDefKey is like ValidateDefKey, but for the target def of
+// a ref.
+func ValidateRefDefKey(k RefDefKey) error {
+	if k.DefUnit != "" && k.DefUnitType == "" {
+		return &InvalidDefKeyError{Field: "DefUnitType", Value: k.DefUnitType, Reason: fmt.Sprintf("empty unit type for unit %q", k.DefUnit)}
+	}
+	return ValidateDefPath("DefPath", k.DefPath)
+}
+
+// NormalizeRefDefKey is like NormalizeDefKey, but for the target def
+// of a ref.
+func NormalizeRefDefKey(k RefDefKey) RefDefKey {
+	k.DefRepo = NormalizeRepoURI(k.DefRepo)
+	k.DefPath = CleanDefPath(k.DefPath)
+	return k
+}
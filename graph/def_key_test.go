@@ -0,0 +1,73 @@
+package graph
+
+import "testing"
+
+func TestCleanDefPath(t *testing.T) {
+	tests := map[string]string{
+		"":           "",
+		".":          ".",
+		"/":          ".",
+		"a":          "a",
+		"a/b":        "a/b",
+		"/a/b/":      "a/b",
+		"a//b":       "a/b",
+		"./a/./b":    "a/b",
+		"a/../b":     "b",
+		"../a":       "a",
+		"a/-/b.c":    "a/-/b.c",
+		"a/-/<i>/@1": "a/-/<i>/@1",
+	}
+	for p, want := range tests {
+		if got := CleanDefPath(p); got != want {
+			t.Errorf("CleanDefPath(%q): got %q, want %q", p, got, want)
+		}
+	}
+}
+
+func TestValidateDefKey(t *testing.T) {
+	valid := []DefKey{
+		{Path: "."},
+		{Path: "a/b"},
+		{UnitType: "t", Path: "a"},
+		{Repo: "r", CommitID: "c", UnitType: "t", Unit: "u", Path: "a/-/b"},
+	}
+	for _, k := range valid {
+		if err := ValidateDefKey(k); err != nil {
+			t.Errorf("%+v: got error %v, want valid", k, err)
+		}
+		if err := ValidateRefDefKey(RefDefKey{DefRepo: k.Repo, DefUnitType: k.UnitType, DefUnit: k.Unit, DefPath: k.Path}); err != nil {
+			t.Errorf("%+v: got RefDefKey error %v, want valid", k, err)
+		}
+	}
+
+	invalid := map[DefKey]string{
+		{}:                          "Path",
+		{Unit: "u", Path: "a"}:      "UnitType",
+		{UnitType: "t", Path: "/a"}: "Path",
+		{Path: "a/"}:                "Path",
+		{Path: "a//b"}:              "Path",
+		{Path: "./a"}:               "Path",
+		{Path: "a/../b"}:            "Path",
+	}
+	for k, field := range invalid {
+		err := ValidateDefKey(k)
+		if e, ok := err.(*InvalidDefKeyError); !ok || e.Field != field {
+			t.Errorf("%+v: got error %v, want *InvalidDefKeyError for field %s", k, err, field)
+		}
+		err = ValidateRefDefKey(RefDefKey{DefUnitType: k.UnitType, DefUnit: k.Unit, DefPath: k.Path})
+		if e, ok := err.(*InvalidDefKeyError); !ok || e.Field != "Def"+field {
+			t.Errorf("%+v: got RefDefKey error %v, want *InvalidDefKeyError for field Def%s", k, err, field)
+		}
+	}
+}
+
+func TestNormalizeDefKey(t *testing.T) {
+	k := NormalizeDefKey(DefKey{Repo: "https://GitHub.com/a/b.git", UnitType: "t", Unit: "u", Path: "/x//y/"})
+	if want := (DefKey{Repo: "github.com/a/b", UnitType: "t", Unit: "u", Path: "x/y"}); k != want {
+		t.Errorf("got %+v, want %+v", k, want)
+	}
+	rk := NormalizeRefDefKey(RefDefKey{DefRepo: "https://GitHub.com/a/b.git", DefPath: "./x"})
+	if want := (RefDefKey{DefRepo: "github.com/a/b", DefPath: "x"}); rk != want {
+		t.Errorf("got %+v, want %+v", rk, want)
+	}
+}
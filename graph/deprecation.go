@@ -0,0 +1,26 @@
+package graph
+
+import "encoding/json"
+
+// Deprecation reports whether the def is marked deprecated in its
+// Data. Toolchains mark deprecated defs with a "Deprecated" field that
+// is either true or a (non-empty) message that describes what to use
+// instead, for example:
+//
+//	{"Deprecated": "Use NewClient instead."}
+func (d *Def) Deprecation() (deprecated bool, message string) {
+	if len(d.Data) == 0 {
+		return false, ""
+	}
+	var data struct{ Deprecated json.RawMessage }
+	if err := json.Unmarshal(d.Data, &data); err != nil || len(data.Deprecated) == 0 {
+		return false, ""
+	}
+	if err := json.Unmarshal(data.Deprecated, &deprecated); err == nil {
+		return deprecated, ""
+	}
+	if err := json.Unmarshal(data.Deprecated, &message); err == nil {
+		return message != "", message
+	}
+	return false, ""
+}
@@ -0,0 +1,27 @@
+package graph
+
+import "testing"
+
+func TestDef_Deprecation(t *testing.T) {
+	tests := []struct {
+		data        string
+		wantDep     bool
+		wantMessage string
+	}{
+		{"", false, ""},
+		{`{}`, false, ""},
+		{`{"Deprecated": false}`, false, ""},
+		{`{"Deprecated": true}`, true, ""},
+		{`{"Deprecated": "Use Q."}`, true, "Use Q."},
+		{`{"Deprecated": ""}`, false, ""},
+		{`{"Deprecated": 1}`, false, ""},
+		{`[]`, false, ""},
+	}
+	for _, test := range tests {
+		def := &Def{Data: []byte(test.data)}
+		dep, msg := def.Deprecation()
+		if dep != test.wantDep || msg != test.wantMessage {
+			t.Errorf("%q: got (%v, %q), want (%v, %q)", test.data, dep, msg, test.wantDep, test.wantMessage)
+		}
+	}
+}
@@ -1,3 +1,4 @@
 package graph
 
 //go:generate gopathexec protoc -I$GOPATH/src -I$GOPATH/src/github.com/gogo/protobuf/protobuf -I. --gogo_out=. def.proto doc.proto output.proto ref.proto
+//go:generate go run gen_json_decoders.go
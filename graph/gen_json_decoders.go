@@ -0,0 +1,171 @@
+// +build ignore
+
+// This program generates json_decoders.go, which holds the generated
+// JSON decoders of the graph types that the store decodes most often.
+// Run it with go generate.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"strings"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+// types are the types to generate JSON decoders for. The decoders of
+// the struct types of their fields are also generated.
+var types = []reflect.Type{
+	reflect.TypeOf(graph.Def{}),
+	reflect.TypeOf(graph.Ref{}),
+}
+
+const output = "json_decoders.go"
+
+// A field is a JSON object field of a struct.
+type field struct {
+	name   string // JSON name
+	goExpr string // Go selector (relative to the struct), e.g. "DefKey.Path"
+	typ    reflect.Type
+}
+
+func main() {
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "// Code generated by gen_json_decoders.go.")
+	fmt.Fprintln(&buf, "// DO NOT EDIT!")
+	fmt.Fprintln(&buf)
+	fmt.Fprintln(&buf, "package graph")
+
+	done := map[reflect.Type]bool{}
+	queue := append([]reflect.Type(nil), types...)
+	for len(queue) > 0 {
+		t := queue[0]
+		queue = queue[1:]
+		if done[t] {
+			continue
+		}
+		done[t] = true
+		queue = append(queue, genDecoder(&buf, t)...)
+	}
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatalf("formatting generated code: %s\n%s", err, buf.Bytes())
+	}
+	if err := ioutil.WriteFile(output, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// genDecoder writes the unmarshalJSONFast method of the struct type t
+// to buf. It returns the struct types of t's fields, which also need
+// decoders.
+func genDecoder(buf *bytes.Buffer, t reflect.Type) (deps []reflect.Type) {
+	fields := jsonFields(t, "")
+	seen := map[string]bool{}
+	for _, f := range fields {
+		if seen[f.name] {
+			log.Fatalf("%s: duplicate JSON field %q", t, f.name)
+		}
+		seen[f.name] = true
+	}
+
+	fmt.Fprintf(buf, `
+// unmarshalJSONFast decodes the JSON object that l is positioned at
+// into m. It returns false if the object has fields or values that
+// only encoding/json handles (see jsonLexer), leaving m partially
+// decoded.
+func (m *%s) unmarshalJSONFast(l *jsonLexer) bool {
+	if !l.beginObject() {
+		return false
+	}
+	for i := 0; !l.endObject(); i++ {
+		key, ok := l.key(i > 0)
+		if !ok {
+			return false
+		}
+		switch string(key) {
+`, t.Name())
+	for _, f := range fields {
+		fmt.Fprintf(buf, "case %q:\n", f.name)
+		deps = append(deps, genField(buf, f)...)
+	}
+	fmt.Fprint(buf, `		default:
+			return false
+		}
+	}
+	return true
+}
+`)
+	return deps
+}
+
+// genField writes the code that decodes the value of the JSON field f
+// to buf.
+func genField(buf *bytes.Buffer, f field) (deps []reflect.Type) {
+	m := "m." + f.goExpr
+	switch {
+	case f.typ.Name() == "RawMessage":
+		fmt.Fprintf(buf, "if %s, ok = l.rawValue(); !ok {\nreturn false\n}\n", m)
+	case f.typ.Kind() == reflect.String:
+		fmt.Fprintf(buf, "if %s, ok = l.string(); !ok {\nreturn false\n}\n", m)
+	case f.typ.Kind() == reflect.Bool:
+		fmt.Fprintf(buf, "if %s, ok = l.bool(); !ok {\nreturn false\n}\n", m)
+	case f.typ.Kind() == reflect.Uint32:
+		fmt.Fprintf(buf, "if %s, ok = l.uint32(); !ok {\nreturn false\n}\n", m)
+	case f.typ.Kind() == reflect.Slice && f.typ.Elem().Kind() == reflect.String:
+		fmt.Fprintf(buf, "if %s, ok = l.strings(); !ok {\nreturn false\n}\n", m)
+	case f.typ.Kind() == reflect.Slice && f.typ.Elem().Kind() == reflect.Ptr && f.typ.Elem().Elem().Kind() == reflect.Struct:
+		elem := f.typ.Elem().Elem()
+		fmt.Fprintf(buf, `if !l.beginArray() {
+	return false
+}
+%s = []*%s{}
+for j := 0; !l.endArray(); j++ {
+	if j > 0 && !l.comma() {
+		return false
+	}
+	e := &%s{}
+	if !e.unmarshalJSONFast(l) {
+		return false
+	}
+	%s = append(%s, e)
+}
+`, m, elem.Name(), elem.Name(), m, m)
+		deps = append(deps, elem)
+	default:
+		log.Fatalf("field %s: unsupported type %s", f.goExpr, f.typ)
+	}
+	return deps
+}
+
+// jsonFields returns the JSON object fields of the struct type t, in
+// the same way that encoding/json determines them (for the kinds of
+// structs in the graph package).
+func jsonFields(t reflect.Type, prefix string) []field {
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			fields = append(fields, jsonFields(f.Type, prefix+f.Name+".")...)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, field{name: name, goExpr: prefix + f.Name, typ: f.Type})
+	}
+	return fields
+}
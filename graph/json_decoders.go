@@ -0,0 +1,210 @@
+// Code generated by gen_json_decoders.go.
+// DO NOT EDIT!
+
+package graph
+
+// unmarshalJSONFast decodes the JSON object that l is positioned at
+// into m. It returns false if the object has fields or values that
+// only encoding/json handles (see jsonLexer), leaving m partially
+// decoded.
+func (m *Def) unmarshalJSONFast(l *jsonLexer) bool {
+	if !l.beginObject() {
+		return false
+	}
+	for i := 0; !l.endObject(); i++ {
+		key, ok := l.key(i > 0)
+		if !ok {
+			return false
+		}
+		switch string(key) {
+		case "Repo":
+			if m.DefKey.Repo, ok = l.string(); !ok {
+				return false
+			}
+		case "CommitID":
+			if m.DefKey.CommitID, ok = l.string(); !ok {
+				return false
+			}
+		case "UnitType":
+			if m.DefKey.UnitType, ok = l.string(); !ok {
+				return false
+			}
+		case "Unit":
+			if m.DefKey.Unit, ok = l.string(); !ok {
+				return false
+			}
+		case "Path":
+			if m.DefKey.Path, ok = l.string(); !ok {
+				return false
+			}
+		case "Name":
+			if m.Name, ok = l.string(); !ok {
+				return false
+			}
+		case "Kind":
+			if m.Kind, ok = l.string(); !ok {
+				return false
+			}
+		case "File":
+			if m.File, ok = l.string(); !ok {
+				return false
+			}
+		case "DefStart":
+			if m.DefStart, ok = l.uint32(); !ok {
+				return false
+			}
+		case "DefEnd":
+			if m.DefEnd, ok = l.uint32(); !ok {
+				return false
+			}
+		case "Exported":
+			if m.Exported, ok = l.bool(); !ok {
+				return false
+			}
+		case "Local":
+			if m.Local, ok = l.bool(); !ok {
+				return false
+			}
+		case "Test":
+			if m.Test, ok = l.bool(); !ok {
+				return false
+			}
+		case "Data":
+			if m.Data, ok = l.rawValue(); !ok {
+				return false
+			}
+		case "Docs":
+			if !l.beginArray() {
+				return false
+			}
+			m.Docs = []*DefDoc{}
+			for j := 0; !l.endArray(); j++ {
+				if j > 0 && !l.comma() {
+					return false
+				}
+				e := &DefDoc{}
+				if !e.unmarshalJSONFast(l) {
+					return false
+				}
+				m.Docs = append(m.Docs, e)
+			}
+		case "TreePath":
+			if m.TreePath, ok = l.string(); !ok {
+				return false
+			}
+		case "Author":
+			if m.Author, ok = l.string(); !ok {
+				return false
+			}
+		case "AuthorCommitID":
+			if m.AuthorCommitID, ok = l.string(); !ok {
+				return false
+			}
+		case "Owners":
+			if m.Owners, ok = l.strings(); !ok {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// unmarshalJSONFast decodes the JSON object that l is positioned at
+// into m. It returns false if the object has fields or values that
+// only encoding/json handles (see jsonLexer), leaving m partially
+// decoded.
+func (m *Ref) unmarshalJSONFast(l *jsonLexer) bool {
+	if !l.beginObject() {
+		return false
+	}
+	for i := 0; !l.endObject(); i++ {
+		key, ok := l.key(i > 0)
+		if !ok {
+			return false
+		}
+		switch string(key) {
+		case "DefRepo":
+			if m.DefRepo, ok = l.string(); !ok {
+				return false
+			}
+		case "DefUnitType":
+			if m.DefUnitType, ok = l.string(); !ok {
+				return false
+			}
+		case "DefUnit":
+			if m.DefUnit, ok = l.string(); !ok {
+				return false
+			}
+		case "DefPath":
+			if m.DefPath, ok = l.string(); !ok {
+				return false
+			}
+		case "Repo":
+			if m.Repo, ok = l.string(); !ok {
+				return false
+			}
+		case "CommitID":
+			if m.CommitID, ok = l.string(); !ok {
+				return false
+			}
+		case "UnitType":
+			if m.UnitType, ok = l.string(); !ok {
+				return false
+			}
+		case "Unit":
+			if m.Unit, ok = l.string(); !ok {
+				return false
+			}
+		case "Def":
+			if m.Def, ok = l.bool(); !ok {
+				return false
+			}
+		case "File":
+			if m.File, ok = l.string(); !ok {
+				return false
+			}
+		case "Start":
+			if m.Start, ok = l.uint32(); !ok {
+				return false
+			}
+		case "End":
+			if m.End, ok = l.uint32(); !ok {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// unmarshalJSONFast decodes the JSON object that l is positioned at
+// into m. It returns false if the object has fields or values that
+// only encoding/json handles (see jsonLexer), leaving m partially
+// decoded.
+func (m *DefDoc) unmarshalJSONFast(l *jsonLexer) bool {
+	if !l.beginObject() {
+		return false
+	}
+	for i := 0; !l.endObject(); i++ {
+		key, ok := l.key(i > 0)
+		if !ok {
+			return false
+		}
+		switch string(key) {
+		case "Format":
+			if m.Format, ok = l.string(); !ok {
+				return false
+			}
+		case "Data":
+			if m.Data, ok = l.string(); !ok {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+package graph
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestUnmarshalJSONFast(t *testing.T) {
+	tests := []struct {
+		input string
+		fast  bool // whether the generated decoder handles input
+	}{
+		{`{"Path":"p","Name":"n","File":"f","DefStart":1,"DefEnd":4294967295}`, true},
+		{` { "Repo" : "r" , "Exported" : true, "Local": false } `, true},
+		{`{"Path":"a\"\\\/\b\f\n\r\té😀<","Name":"héllo"}`, true},
+		{`{"Data":{"a": [1, -2.5e3, "x", true, null]},"Docs":[{"Format":"text/plain","Data":"d"}],"Owners":["o1","o2"]}`, true},
+		{`{"Docs":[],"Owners":[]}`, true},
+		{`{}`, true},
+
+		// Left to encoding/json.
+		{`{"Path":"p","Future":1}`, false},
+		{`{"path":"p"}`, false},
+		{`{"P\u0061th":"p"}`, false},
+		{`{"Path":null}`, false},
+		{`{"Data":null}`, false},
+		{`{"DefStart":1.0}`, false},
+		{`{"DefStart":4294967296}`, false},
+		{`{"Path":"\ud83d"}`, false},
+		{"{\"Path\":\"\xff\"}", false},
+
+		// Invalid.
+		{`{"DefStart":-1}`, false},
+		{`{"DefStart":01}`, false},
+		{`{"Path":"p",}`, false},
+		{`{"Path":"p"} x`, false},
+		{`{"Path":"p"`, false},
+		{`{"Data":[1,]}`, false},
+		{`{"Path":1}`, false},
+		{`[]`, false},
+	}
+	for _, test := range tests {
+		var def Def
+		fast := def.UnmarshalJSONFast([]byte(test.input))
+		if fast != test.fast {
+			t.Errorf("%s: got fast %v, want %v", test.input, fast, test.fast)
+			continue
+		}
+		if !fast {
+			if !reflect.DeepEqual(def, Def{}) {
+				t.Errorf("%s: def was modified: %+v", test.input, def)
+			}
+			continue
+		}
+
+		var want Def
+		if err := json.Unmarshal([]byte(test.input), (*jsonDef)(&want)); err != nil {
+			t.Errorf("%s: %s", test.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(def, want) {
+			t.Errorf("%s: got %+v, want %+v (as decoded by encoding/json)", test.input, def, want)
+		}
+	}
+
+	ref := Ref{UnknownFields: []byte(`{"x":1}`)}
+	if !ref.UnmarshalJSONFast([]byte(`{"DefPath":"p","Def":true,"Start":1,"End":2}`)) {
+		t.Fatal("ref not decoded")
+	}
+	if want := (Ref{DefPath: "p", Def: true, Start: 1, End: 2}); !reflect.DeepEqual(ref, want) {
+		t.Errorf("got ref %+v, want %+v", ref, want)
+	}
+}
+
+var benchDefJSON = []byte(`{"Repo":"github.com/foo/bar","CommitID":"0123456789abcdef0123456789abcdef01234567","UnitType":"GoPackage","Unit":"github.com/foo/bar/baz","Path":"Server/ServeHTTP","Name":"ServeHTTP","Kind":"method","File":"baz/server.go","DefStart":1234,"DefEnd":1290,"Exported":true,"Data":{"Recv":"*Server","Params":["w","r"]},"TreePath":"Server/ServeHTTP"}`)
+
+func BenchmarkDefUnmarshalJSON_generated(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		var def Def
+		if !def.UnmarshalJSONFast(benchDefJSON) {
+			b.Fatal("not decoded")
+		}
+	}
+}
+
+func BenchmarkDefUnmarshalJSON_encodingJSON(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		var def Def
+		if err := json.Unmarshal(benchDefJSON, (*jsonDef)(&def)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
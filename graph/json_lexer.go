@@ -0,0 +1,379 @@
+package graph
+
+import (
+	"math"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// A jsonLexer reads the JSON values in data for the generated JSON
+// decoders (see json_decoders.go and gen_json_decoders.go), which
+// decode defs and refs much faster than encoding/json.
+//
+// Its methods skip leading whitespace and report whether the next
+// value has the expected type. To keep the generated decoders simple,
+// they also report false for the (rare) values whose decoding
+// encoding/json defines in detail: nulls, escaped object keys, numbers
+// with fractions or exponents, and strings with invalid UTF-8 or
+// unpaired surrogates. Records with such values (or with unknown
+// fields) are decoded with encoding/json instead.
+type jsonLexer struct {
+	data []byte
+	pos  int
+}
+
+// maxJSONDepth is the maximum nesting depth of the values that
+// rawValue reads.
+const maxJSONDepth = 10000
+
+func (l *jsonLexer) skipSpace() {
+	for l.pos < len(l.data) {
+		switch l.data[l.pos] {
+		case ' ', '\t', '\n', '\r':
+			l.pos++
+		default:
+			return
+		}
+	}
+}
+
+// consume reads the byte c.
+func (l *jsonLexer) consume(c byte) bool {
+	l.skipSpace()
+	if l.pos < len(l.data) && l.data[l.pos] == c {
+		l.pos++
+		return true
+	}
+	return false
+}
+
+func (l *jsonLexer) beginObject() bool { return l.consume('{') }
+func (l *jsonLexer) endObject() bool   { return l.consume('}') }
+func (l *jsonLexer) beginArray() bool  { return l.consume('[') }
+func (l *jsonLexer) endArray() bool    { return l.consume(']') }
+func (l *jsonLexer) comma() bool       { return l.consume(',') }
+
+// end reports whether only whitespace remains.
+func (l *jsonLexer) end() bool {
+	l.skipSpace()
+	return l.pos == len(l.data)
+}
+
+// key reads an object key (preceded by a comma if more is true) and
+// the colon after it. The returned key is only valid until data is
+// modified.
+func (l *jsonLexer) key(more bool) ([]byte, bool) {
+	if more && !l.comma() {
+		return nil, false
+	}
+	l.skipSpace()
+	if l.pos >= len(l.data) || l.data[l.pos] != '"' {
+		return nil, false
+	}
+	start := l.pos + 1
+	for i := start; i < len(l.data); i++ {
+		switch c := l.data[i]; {
+		case c == '"':
+			l.pos = i + 1
+			if !l.consume(':') {
+				return nil, false
+			}
+			return l.data[start:i], true
+		case c == '\\' || c < 0x20:
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+func (l *jsonLexer) string() (string, bool) {
+	l.skipSpace()
+	if l.pos >= len(l.data) || l.data[l.pos] != '"' {
+		return "", false
+	}
+	start := l.pos + 1
+	ascii := true
+	for i := start; i < len(l.data); i++ {
+		switch c := l.data[i]; {
+		case c == '"':
+			s := l.data[start:i]
+			if !ascii && !utf8.Valid(s) {
+				return "", false
+			}
+			l.pos = i + 1
+			return string(s), true
+		case c == '\\':
+			return l.unquote(start)
+		case c < 0x20:
+			return "", false
+		case c >= utf8.RuneSelf:
+			ascii = false
+		}
+	}
+	return "", false
+}
+
+// unquote reads the rest of a string (that starts at data[start]) that
+// has escape sequences.
+func (l *jsonLexer) unquote(start int) (string, bool) {
+	buf := make([]byte, 0, len(l.data)-start)
+	for i := start; i < len(l.data); {
+		c := l.data[i]
+		switch {
+		case c == '"':
+			if !utf8.Valid(buf) {
+				return "", false
+			}
+			l.pos = i + 1
+			return string(buf), true
+		case c < 0x20:
+			return "", false
+		case c != '\\':
+			buf = append(buf, c)
+			i++
+			continue
+		}
+
+		if i+1 >= len(l.data) {
+			return "", false
+		}
+		switch e := l.data[i+1]; e {
+		case '"', '\\', '/':
+			buf = append(buf, e)
+		case 'b':
+			buf = append(buf, '\b')
+		case 'f':
+			buf = append(buf, '\f')
+		case 'n':
+			buf = append(buf, '\n')
+		case 'r':
+			buf = append(buf, '\r')
+		case 't':
+			buf = append(buf, '\t')
+		case 'u':
+			r, ok := l.hex4(i + 2)
+			if !ok {
+				return "", false
+			}
+			if utf16.IsSurrogate(r) {
+				if i+7 >= len(l.data) || l.data[i+6] != '\\' || l.data[i+7] != 'u' {
+					return "", false
+				}
+				r2, ok := l.hex4(i + 8)
+				if !ok {
+					return "", false
+				}
+				if r = utf16.DecodeRune(r, r2); r == utf8.RuneError {
+					return "", false
+				}
+				i += 6
+			}
+			var b [utf8.UTFMax]byte
+			buf = append(buf, b[:utf8.EncodeRune(b[:], r)]...)
+			i += 6
+			continue
+		default:
+			return "", false
+		}
+		i += 2
+	}
+	return "", false
+}
+
+// hex4 returns the rune encoded by the 4 hex digits at data[i].
+func (l *jsonLexer) hex4(i int) (rune, bool) {
+	if i+4 > len(l.data) {
+		return 0, false
+	}
+	var r rune
+	for _, c := range l.data[i : i+4] {
+		switch {
+		case '0' <= c && c <= '9':
+			c -= '0'
+		case 'a' <= c && c <= 'f':
+			c = c - 'a' + 10
+		case 'A' <= c && c <= 'F':
+			c = c - 'A' + 10
+		default:
+			return 0, false
+		}
+		r = r*16 + rune(c)
+	}
+	return r, true
+}
+
+func (l *jsonLexer) bool() (bool, bool) {
+	l.skipSpace()
+	if l.literal("true") {
+		return true, true
+	}
+	return false, l.literal("false")
+}
+
+// literal reads the literal s (true, false, or null).
+func (l *jsonLexer) literal(s string) bool {
+	if len(l.data)-l.pos < len(s) || string(l.data[l.pos:l.pos+len(s)]) != s {
+		return false
+	}
+	l.pos += len(s)
+	return true
+}
+
+func (l *jsonLexer) uint32() (uint32, bool) {
+	l.skipSpace()
+	start := l.pos
+	var n uint64
+	for ; l.pos < len(l.data) && '0' <= l.data[l.pos] && l.data[l.pos] <= '9'; l.pos++ {
+		if n = n*10 + uint64(l.data[l.pos]-'0'); n > math.MaxUint32 {
+			return 0, false
+		}
+	}
+	if digits := l.data[start:l.pos]; len(digits) == 0 || (digits[0] == '0' && len(digits) > 1) {
+		return 0, false
+	}
+	if l.pos < len(l.data) {
+		switch l.data[l.pos] {
+		case '.', 'e', 'E':
+			return 0, false
+		}
+	}
+	return uint32(n), true
+}
+
+func (l *jsonLexer) strings() ([]string, bool) {
+	if !l.beginArray() {
+		return nil, false
+	}
+	v := []string{}
+	for i := 0; !l.endArray(); i++ {
+		if i > 0 && !l.comma() {
+			return nil, false
+		}
+		s, ok := l.string()
+		if !ok {
+			return nil, false
+		}
+		v = append(v, s)
+	}
+	return v, true
+}
+
+// rawValue reads a JSON value (which is not null) and returns a copy
+// of its encoding, like json.RawMessage does.
+func (l *jsonLexer) rawValue() ([]byte, bool) {
+	l.skipSpace()
+	start := l.pos
+	if l.literal("null") || !l.skipValue(0) {
+		return nil, false
+	}
+	return append([]byte(nil), l.data[start:l.pos]...), true
+}
+
+// skipValue reads and validates a JSON value.
+func (l *jsonLexer) skipValue(depth int) bool {
+	if depth > maxJSONDepth {
+		return false
+	}
+	l.skipSpace()
+	if l.pos >= len(l.data) {
+		return false
+	}
+	switch c := l.data[l.pos]; {
+	case c == '{':
+		l.pos++
+		for i := 0; !l.endObject(); i++ {
+			if i > 0 && !l.comma() {
+				return false
+			}
+			l.skipSpace()
+			if !l.skipString() || !l.consume(':') || !l.skipValue(depth+1) {
+				return false
+			}
+		}
+		return true
+	case c == '[':
+		l.pos++
+		for i := 0; !l.endArray(); i++ {
+			if i > 0 && !l.comma() {
+				return false
+			}
+			if !l.skipValue(depth + 1) {
+				return false
+			}
+		}
+		return true
+	case c == '"':
+		return l.skipString()
+	case c == '-' || ('0' <= c && c <= '9'):
+		return l.skipNumber()
+	default:
+		return l.literal("true") || l.literal("false") || l.literal("null")
+	}
+}
+
+// skipString reads and validates a string, without decoding it.
+func (l *jsonLexer) skipString() bool {
+	if l.pos >= len(l.data) || l.data[l.pos] != '"' {
+		return false
+	}
+	for i := l.pos + 1; i < len(l.data); i++ {
+		switch c := l.data[i]; {
+		case c == '"':
+			l.pos = i + 1
+			return true
+		case c < 0x20:
+			return false
+		case c == '\\':
+			if i+1 >= len(l.data) {
+				return false
+			}
+			switch l.data[i+1] {
+			case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+				i++
+			case 'u':
+				if _, ok := l.hex4(i + 2); !ok {
+					return false
+				}
+				i += 5
+			default:
+				return false
+			}
+		}
+	}
+	return false
+}
+
+// skipNumber reads and validates a number.
+func (l *jsonLexer) skipNumber() bool {
+	digits := func() int {
+		start := l.pos
+		for l.pos < len(l.data) && '0' <= l.data[l.pos] && l.data[l.pos] <= '9' {
+			l.pos++
+		}
+		return l.pos - start
+	}
+	if l.pos < len(l.data) && l.data[l.pos] == '-' {
+		l.pos++
+	}
+	if l.pos < len(l.data) && l.data[l.pos] == '0' {
+		l.pos++
+	} else if digits() == 0 {
+		return false
+	}
+	if l.pos < len(l.data) && l.data[l.pos] == '.' {
+		l.pos++
+		if digits() == 0 {
+			return false
+		}
+	}
+	if l.pos < len(l.data) && (l.data[l.pos] == 'e' || l.data[l.pos] == 'E') {
+		l.pos++
+		if l.pos < len(l.data) && (l.data[l.pos] == '+' || l.data[l.pos] == '-') {
+			l.pos++
+		}
+		if digits() == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -79,22 +79,25 @@ func (vs Refs) Swap(i, j int)      { vs[i], vs[j] = vs[j], vs[i] }
 func (vs Refs) Less(i, j int) bool { return vs[i].sortKey() < vs[j].sortKey() }
 
 // RefSet is a set of Refs. It can used to determine whether a grapher emits
-// duplicate refs.
+// duplicate refs. Refs that differ only in their unknown fields are
+// considered duplicates.
 type RefSet struct {
-	refs map[Ref]struct{}
+	refs map[RefKey]struct{}
 }
 
 func NewRefSet() *RefSet {
-	return &RefSet{make(map[Ref]struct{})}
+	return &RefSet{make(map[RefKey]struct{})}
 }
 
 // AddAndCheckUnique adds ref to the set of seen refs, and returns whether the
 // ref already existed in the set.
 func (c *RefSet) AddAndCheckUnique(ref Ref) (duplicate bool) {
-	_, present := c.refs[ref]
+	key := ref.RefKey()
+	key.CommitID = ref.CommitID
+	_, present := c.refs[key]
 	if present {
 		return true
 	}
-	c.refs[ref] = struct{}{}
+	c.refs[key] = struct{}{}
 	return false
 }
@@ -10,6 +10,8 @@ import math "math"
 
 // discarding unused import gogoproto "github.com/gogo/protobuf/gogoproto"
 
+import sourcegraph_com_sqs_pbtypes "sourcegraph.com/sqs/pbtypes"
+
 import io "io"
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -47,6 +49,15 @@ type Ref struct {
 	Start uint32 `protobuf:"varint,11,opt,name=Start,proto3" json:"Start"`
 	// End is the byte offset of this ref's last byte in File.
 	End uint32 `protobuf:"varint,12,opt,name=End,proto3" json:"End"`
+	// UnknownFields holds the fields of the JSON-encoded ref that are
+	// not known to this version of the Ref type (e.g., because it was
+	// emitted by a newer toolchain), as a JSON object. They are
+	// re-emitted when the ref is JSON-encoded.
+	UnknownFields sourcegraph_com_sqs_pbtypes.RawMessage `protobuf:"bytes,18,opt,name=UnknownFields,proto3,casttype=sourcegraph.com/sqs/pbtypes.RawMessage" json:"-"`
+	// XXX_unrecognized holds the protobuf-encoded fields that are not
+	// known to this version of the Ref type. They are re-emitted when
+	// the ref is protobuf-encoded.
+	XXX_unrecognized []byte `json:"-"`
 }
 
 func (m *Ref) Reset()         { *m = Ref{} }
@@ -155,6 +166,19 @@ func (m *Ref) MarshalTo(data []byte) (int, error) {
 		}
 		i++
 	}
+	if m.UnknownFields != nil {
+		if len(m.UnknownFields) > 0 {
+			data[i] = 0x92
+			i++
+			data[i] = 0x1
+			i++
+			i = encodeVarintRef(data, i, uint64(len(m.UnknownFields)))
+			i += copy(data[i:], m.UnknownFields)
+		}
+	}
+	if m.XXX_unrecognized != nil {
+		i += copy(data[i:], m.XXX_unrecognized)
+	}
 	return i, nil
 }
 
@@ -275,6 +299,15 @@ func (m *Ref) Size() (n int) {
 	if m.Def {
 		n += 3
 	}
+	if m.UnknownFields != nil {
+		l = len(m.UnknownFields)
+		if l > 0 {
+			n += 2 + l + sovRef(uint64(l))
+		}
+	}
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
 	return n
 }
 
@@ -661,6 +694,34 @@ func (m *Ref) Unmarshal(data []byte) error {
 				}
 			}
 			m.Def = bool(v != 0)
+		case 18:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field UnknownFields", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRef
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthRef
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.UnknownFields = append([]byte{}, data[iNdEx:postIndex]...)
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipRef(data[iNdEx:])
@@ -673,6 +734,7 @@ func (m *Ref) Unmarshal(data []byte) error {
 			if (iNdEx + skippy) > l {
 				return io.ErrUnexpectedEOF
 			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, data[iNdEx:iNdEx+skippy]...)
 			iNdEx += skippy
 		}
 	}
@@ -73,6 +73,46 @@ func URIEqual(a, b string) bool {
 	return strings.EqualFold(a, b)
 }
 
+// RepoHostAliases maps alternate hostnames to the canonical hostname
+// that NormalizeRepoURI uses for them.
+var RepoHostAliases = map[string]string{
+	"www.github.com":    "github.com",
+	"www.bitbucket.org": "bitbucket.org",
+	"www.gitlab.com":    "gitlab.com",
+}
+
+// NormalizeRepoURI returns the canonical form of a repository URI or
+// clone URL. The canonical form has no scheme, no ".git" suffix and no
+// trailing slash, is lowercase (repo URIs are compared case
+// insensitively, see URIEqual), and uses the canonical hostname for
+// hosts listed in RepoHostAliases. For example,
+// "https://www.GitHub.com/User/Repo.git" and "github.com/user/repo"
+// both normalize to "github.com/user/repo".
+//
+// NormalizeRepoURI is idempotent. Values that are not valid clone URLs
+// are normalized lexically. An empty uri is returned unchanged.
+func NormalizeRepoURI(uri string) string {
+	if uri == "" {
+		return ""
+	}
+	if strings.Contains(uri, ":") {
+		if uri2, err := TryMakeURI(uri); err == nil {
+			uri = uri2
+		}
+	}
+	uri = strings.ToLower(strings.TrimSuffix(uri, "/"))
+	uri = strings.TrimSuffix(uri, ".git")
+
+	host, path := splitRepoURI(uri)
+	if canonical, present := RepoHostAliases[host]; present {
+		host = canonical
+	}
+	if path == "" {
+		return host
+	}
+	return host + "/" + path
+}
+
 // removeVCSPart removes VCS part from URL if any, git:http://.. => http://..
 func removeVCSPart(url string) string {
 	parts := strings.SplitN(url, ":", 3)
@@ -57,3 +57,30 @@ func TestTryMakeURI(t *testing.T) {
 		}
 	}
 }
+
+func TestNormalizeRepoURI(t *testing.T) {
+	tests := map[string]string{
+		"":                                   "",
+		"github.com/foo/bar":                 "github.com/foo/bar",
+		"github.com/Foo/Bar":                 "github.com/foo/bar",
+		"GitHub.com/foo/bar/":                "github.com/foo/bar",
+		"github.com/foo/bar.git":             "github.com/foo/bar",
+		"www.github.com/foo/bar":             "github.com/foo/bar",
+		"https://github.com/foo/bar":         "github.com/foo/bar",
+		"https://www.GitHub.com/Foo/Bar.git": "github.com/foo/bar",
+		"git://github.com/foo/bar.git":       "github.com/foo/bar",
+		"git@github.com:foo/bar.git":         "github.com/foo/bar",
+		"scm:git:https://github.com/foo/bar": "github.com/foo/bar",
+		"sourcegraph.com/sourcegraph/srclib": "sourcegraph.com/sourcegraph/srclib",
+		"www.example.com/foo":                "www.example.com/foo",
+	}
+	for input, want := range tests {
+		got := NormalizeRepoURI(input)
+		if got != want {
+			t.Errorf("%q: got %q, want %q", input, got, want)
+		}
+		if again := NormalizeRepoURI(got); again != got {
+			t.Errorf("%q: not idempotent: %q then %q", input, got, again)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package graph
+
+import "encoding/json"
+
+// DefSignature is the typed signature of a function-like def (a
+// function, method, constructor, etc.). Toolchains that know the types
+// of a def's parameters and results record them in a "Signature"
+// field of the def's Data, for example:
+//
+//	{"Signature": {"Params": ["context.Context", "string"], "Results": ["error"]}}
+//
+// Types are written as they would be in the def's language (and, where
+// possible, qualified by their package or module).
+type DefSignature struct {
+	Params  []string `json:",omitempty"` // the parameter types, in order
+	Results []string `json:",omitempty"` // the result (return) types, in order
+}
+
+// Signature returns the typed signature recorded in the def's Data, or
+// nil if there is none.
+func (d *Def) Signature() *DefSignature {
+	if len(d.Data) == 0 {
+		return nil
+	}
+	var data struct{ Signature *DefSignature }
+	if err := json.Unmarshal(d.Data, &data); err != nil {
+		return nil
+	}
+	return data.Signature
+}
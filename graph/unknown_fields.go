@@ -0,0 +1,202 @@
+package graph
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+
+	"sourcegraph.com/sqs/pbtypes"
+)
+
+// Defs and refs retain the fields that are not known to this version
+// of their types, so that data emitted by newer toolchains (or stored
+// by newer versions of srclib) passes through unchanged. Unknown JSON
+// fields are kept in UnknownFields (which is itself stored as a
+// protobuf field), and unknown protobuf fields are kept in
+// XXX_unrecognized.
+
+// jsonDef and jsonRef have the same fields as Def and Ref but none of
+// their methods, so they are encoded with the default JSON encoding.
+type (
+	jsonDef Def
+	jsonRef Ref
+)
+
+var (
+	defJSONFields = jsonFieldNames(reflect.TypeOf(Def{}))
+	refJSONFields = jsonFieldNames(reflect.TypeOf(Ref{}))
+)
+
+func (d Def) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(jsonDef(d))
+	if err != nil {
+		return nil, err
+	}
+	return appendUnknownFields(b, d.UnknownFields)
+}
+
+func (d *Def) UnmarshalJSON(data []byte) error {
+	if d.UnmarshalJSONFast(data) {
+		return nil
+	}
+	unknown, err := unmarshalKnownJSON(data, (*jsonDef)(d), defJSONFields)
+	if err != nil {
+		return err
+	}
+	d.UnknownFields = unknown
+	return nil
+}
+
+func (r Ref) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(jsonRef(r))
+	if err != nil {
+		return nil, err
+	}
+	return appendUnknownFields(b, r.UnknownFields)
+}
+
+func (r *Ref) UnmarshalJSON(data []byte) error {
+	if r.UnmarshalJSONFast(data) {
+		return nil
+	}
+	unknown, err := unmarshalKnownJSON(data, (*jsonRef)(r), refJSONFields)
+	if err != nil {
+		return err
+	}
+	r.UnknownFields = unknown
+	return nil
+}
+
+// UnmarshalJSONFast decodes the JSON-encoded def in data with its
+// generated decoder (see jsonLexer). It returns false, leaving d
+// unchanged, if data must be decoded with UnmarshalJSON instead (e.g.,
+// because it has unknown fields or is invalid).
+func (d *Def) UnmarshalJSONFast(data []byte) bool {
+	v, l := *d, jsonLexer{data: data}
+	if !v.unmarshalJSONFast(&l) || !l.end() {
+		return false
+	}
+	v.UnknownFields = nil
+	*d = v
+	return true
+}
+
+// UnmarshalJSONFast decodes the JSON-encoded ref in data with its
+// generated decoder (see jsonLexer). It returns false, leaving r
+// unchanged, if data must be decoded with UnmarshalJSON instead.
+func (r *Ref) UnmarshalJSONFast(data []byte) bool {
+	v, l := *r, jsonLexer{data: data}
+	if !v.unmarshalJSONFast(&l) || !l.end() {
+		return false
+	}
+	v.UnknownFields = nil
+	*r = v
+	return true
+}
+
+// jsonFieldNames returns the (lowercased) names of the JSON object
+// fields that a struct of type t is encoded to.
+func jsonFieldNames(t reflect.Type) map[string]struct{} {
+	names := map[string]struct{}{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for name := range jsonFieldNames(f.Type) {
+				names[name] = struct{}{}
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		if name == "" {
+			name = f.Name
+		}
+		names[strings.ToLower(name)] = struct{}{}
+	}
+	return names
+}
+
+// unmarshalKnownJSON unmarshals the JSON object in data into v and
+// returns a JSON object with the fields in data that are not in known
+// (or nil if there are none).
+func unmarshalKnownJSON(data []byte, v interface{}, known map[string]struct{}) (pbtypes.RawMessage, error) {
+	// Most data has no unknown fields, so try that first to avoid
+	// decoding the object twice.
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err == nil {
+		return nil, nil
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	var unknownNames []string
+	for name := range fields {
+		if _, present := known[strings.ToLower(name)]; !present {
+			unknownNames = append(unknownNames, name)
+		}
+	}
+	if len(unknownNames) == 0 {
+		return nil, nil
+	}
+	sort.Strings(unknownNames)
+
+	var buf bytes.Buffer
+	for i, name := range unknownNames {
+		if i == 0 {
+			buf.WriteByte('{')
+		} else {
+			buf.WriteByte(',')
+		}
+		b, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+		buf.WriteByte(':')
+		if err := json.Compact(&buf, fields[name]); err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// appendUnknownFields adds the fields of the JSON object unknown to
+// the JSON object b.
+func appendUnknownFields(b []byte, unknown pbtypes.RawMessage) ([]byte, error) {
+	unknown = bytes.TrimSpace(unknown)
+	if len(unknown) == 0 {
+		return b, nil
+	}
+	if len(unknown) < 2 || unknown[0] != '{' || unknown[len(unknown)-1] != '}' {
+		return nil, errors.New("UnknownFields is not a JSON object")
+	}
+	inner := bytes.TrimSpace(unknown[1 : len(unknown)-1])
+	if len(inner) == 0 {
+		return b, nil
+	}
+
+	var buf bytes.Buffer
+	buf.Write(b[:len(b)-1]) // without the closing '}'
+	if !bytes.Equal(b, []byte("{}")) {
+		buf.WriteByte(',')
+	}
+	buf.Write(inner)
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
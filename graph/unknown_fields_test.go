@@ -0,0 +1,85 @@
+package graph
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestUnknownFields_JSON(t *testing.T) {
+	tests := []struct {
+		v           interface{ proto.Message }
+		input, want string
+	}{
+		{
+			v:     &Def{},
+			input: `{"Path":"p","Name":"n","Future":{"a": [1, 2]},"path2":"x","Kind":"k"}`,
+			want:  `{"Path":"p","Name":"n","Kind":"k","File":"","DefStart":0,"DefEnd":0,"Future":{"a":[1,2]},"path2":"x"}`,
+		},
+		{
+			v:     &Def{},
+			input: `{"Path":"p","Name":"n"}`,
+			want:  `{"Path":"p","Name":"n","File":"","DefStart":0,"DefEnd":0}`,
+		},
+		{
+			v:     &Ref{},
+			input: `{"DefPath":"p","Future":true,"start":1}`,
+			want:  `{"DefPath":"p","Start":1,"End":0,"Future":true}`,
+		},
+	}
+	for _, test := range tests {
+		if err := json.Unmarshal([]byte(test.input), test.v); err != nil {
+			t.Errorf("%s: %s", test.input, err)
+			continue
+		}
+
+		// Round-trip through the protobuf encoding (as the store does).
+		b, err := proto.Marshal(test.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v2 := reflect.New(reflect.TypeOf(test.v).Elem()).Interface().(proto.Message)
+		if err := proto.Unmarshal(b, v2); err != nil {
+			t.Fatal(err)
+		}
+
+		out, err := json.Marshal(v2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != test.want {
+			t.Errorf("%s: got JSON %s, want %s", test.input, out, test.want)
+		}
+	}
+
+	if err := json.Unmarshal([]byte(`{"Path":1}`), &Def{}); err == nil {
+		t.Error("got no error for invalid def JSON")
+	}
+}
+
+func TestUnknownFields_protobuf(t *testing.T) {
+	b, err := proto.Marshal(&Def{DefKey: DefKey{Path: "p"}, Name: "n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Append a field (number 100, string "x") that Def doesn't know.
+	unknown := []byte{0xa2, 0x06, 0x01, 'x'}
+	b = append(b, unknown...)
+
+	var def Def
+	if err := proto.Unmarshal(b, &def); err != nil {
+		t.Fatal(err)
+	}
+	if def.Path != "p" || def.Name != "n" || !reflect.DeepEqual(def.XXX_unrecognized, unknown) {
+		t.Errorf("got def %+v", def)
+	}
+	b2, err := proto.Marshal(&def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(b2, b) {
+		t.Errorf("got re-encoded def %v, want %v", b2, b)
+	}
+}
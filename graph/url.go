@@ -0,0 +1,170 @@
+package graph
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// URLTemplate specifies how to construct URLs that link to code on a
+// code hosting site.
+//
+// Templates may contain the following placeholders, which are
+// replaced with (escaped) values from the def or ref being linked
+// to:
+//
+//	{repo}        the normalized repo URI (e.g., "github.com/user/repo")
+//	{host}        the repo URI's host (e.g., "github.com")
+//	{repo_path}   the repo URI's path (e.g., "user/repo")
+//	{commit}      the commit ID
+//	{unit_type}   the source unit type
+//	{unit}        the source unit name
+//	{path}        the def path
+//	{file}        the file path
+//	{start_line}  the 1-indexed start line
+//	{end_line}    the 1-indexed end line
+type URLTemplate struct {
+	// File is the template for a URL to a range of lines in a file
+	// (e.g., "https://{host}/{repo_path}/blob/{commit}/{file}#L{start_line}-L{end_line}").
+	File string
+
+	// Def is the template for a URL to a def that refers to the def
+	// only by its DefKey (e.g., the def's page on a documentation
+	// site). If empty, DefURL uses File instead.
+	Def string
+}
+
+// URLTemplates maps repo URI hosts (e.g., "github.com") to the URL
+// templates for repos on that host.
+type URLTemplates map[string]URLTemplate
+
+// DefaultURLTemplates contains URL templates for common code hosting
+// sites.
+var DefaultURLTemplates = URLTemplates{
+	"github.com": {
+		File: "https://{host}/{repo_path}/blob/{commit}/{file}#L{start_line}-L{end_line}",
+	},
+	"bitbucket.org": {
+		File: "https://{host}/{repo_path}/src/{commit}/{file}#lines-{start_line}:{end_line}",
+	},
+	"gitlab.com": {
+		File: "https://{host}/{repo_path}/blob/{commit}/{file}#L{start_line}-{end_line}",
+	},
+}
+
+// DefURL returns the URL for def. If the template for def's repo host
+// has a Def template, it is used (and src is ignored); otherwise the
+// File template is used to link to the lines of def's file that its
+// definition (from DefStart to DefEnd) spans. The lines are determined
+// from src, the contents of def's file at def's commit.
+func (t URLTemplates) DefURL(def *Def, src []byte) (string, error) {
+	tmpl, err := t.lookup(def.Repo)
+	if err != nil {
+		return "", err
+	}
+	if tmpl.Def != "" {
+		return t.DefKeyURL(def.DefKey)
+	}
+	startLine, endLine, err := lineRange(src, def.DefStart, def.DefEnd)
+	if err != nil {
+		return "", fmt.Errorf("def %s in %s: %s", def.Path, def.File, err)
+	}
+	return expandURLTemplate(tmpl.File, def.DefKey, def.File, startLine, endLine)
+}
+
+// DefKeyURL returns the URL for the def identified by key, using the
+// Def template for key's repo host. It returns an error if there is no
+// such template.
+func (t URLTemplates) DefKeyURL(key DefKey) (string, error) {
+	tmpl, err := t.lookup(key.Repo)
+	if err != nil {
+		return "", err
+	}
+	if tmpl.Def == "" {
+		return "", fmt.Errorf("no def URL template for repo %q", key.Repo)
+	}
+	return expandURLTemplate(tmpl.Def, key, "", 0, 0)
+}
+
+// RefURL returns the URL for the lines that ref (from Start to End)
+// spans in its file, using the File template for ref's repo host. The lines are determined from src, the contents of
+// ref's file at ref's commit.
+func (t URLTemplates) RefURL(ref *Ref, src []byte) (string, error) {
+	tmpl, err := t.lookup(ref.Repo)
+	if err != nil {
+		return "", err
+	}
+	startLine, endLine, err := lineRange(src, ref.Start, ref.End)
+	if err != nil {
+		return "", fmt.Errorf("ref in %s: %s", ref.File, err)
+	}
+	key := DefKey{Repo: ref.Repo, CommitID: ref.CommitID, UnitType: ref.UnitType, Unit: ref.Unit}
+	return expandURLTemplate(tmpl.File, key, ref.File, startLine, endLine)
+}
+
+// lineRange returns the 1-indexed lines of src that the byte range
+// [start, end) spans.
+func lineRange(src []byte, start, end uint32) (startLine, endLine int, err error) {
+	if start > end || int(end) > len(src) {
+		return 0, 0, fmt.Errorf("byte range %d-%d is out of bounds (file is %d bytes)", start, end, len(src))
+	}
+	startLine = 1 + bytes.Count(src[:start], []byte("\n"))
+	endLine = startLine
+	if end > start {
+		// A newline that ends the range doesn't start another line.
+		endLine += bytes.Count(src[start:end-1], []byte("\n"))
+	}
+	return startLine, endLine, nil
+}
+
+func (t URLTemplates) lookup(repo string) (URLTemplate, error) {
+	if repo == "" {
+		return URLTemplate{}, fmt.Errorf("no repo to construct URL for")
+	}
+	host, _ := splitRepoURI(NormalizeRepoURI(repo))
+	tmpl, present := t[host]
+	if !present {
+		return URLTemplate{}, fmt.Errorf("no URL template for repo host %q", host)
+	}
+	return tmpl, nil
+}
+
+func expandURLTemplate(tmpl string, key DefKey, file string, startLine, endLine int) (string, error) {
+	if tmpl == "" {
+		return "", fmt.Errorf("empty URL template")
+	}
+	repo := NormalizeRepoURI(key.Repo)
+	host, repoPath := splitRepoURI(repo)
+	r := strings.NewReplacer(
+		"{repo}", repo,
+		"{host}", host,
+		"{repo_path}", repoPath,
+		"{commit}", url.QueryEscape(key.CommitID),
+		"{unit_type}", url.QueryEscape(key.UnitType),
+		"{unit}", escapePath(key.Unit),
+		"{path}", escapePath(key.Path),
+		"{file}", escapePath(file),
+		"{start_line}", strconv.Itoa(startLine),
+		"{end_line}", strconv.Itoa(endLine),
+	)
+	return r.Replace(tmpl), nil
+}
+
+// escapePath escapes each component of the slash-separated path p.
+func escapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = (&url.URL{Path: part}).EscapedPath()
+	}
+	return strings.Join(parts, "/")
+}
+
+// splitRepoURI splits a repo URI into its host and path.
+func splitRepoURI(uri string) (host, path string) {
+	if i := strings.Index(uri, "/"); i != -1 {
+		return uri[:i], uri[i+1:]
+	}
+	return uri, ""
+}
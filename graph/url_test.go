@@ -0,0 +1,56 @@
+package graph
+
+import "testing"
+
+func TestURLTemplates(t *testing.T) {
+	tmpls := URLTemplates{
+		"github.com": DefaultURLTemplates["github.com"],
+		"example.com": {
+			File: "https://{host}/{repo_path}/{commit}/{file}?l={start_line}",
+			Def:  "https://docs.example.com/{repo}/-/{unit_type}/{unit}/-/{path}",
+		},
+	}
+
+	src := []byte("package b\n\nfunc (T) m() {\n\tx()\n}\n")
+	def := &Def{
+		DefKey:   DefKey{Repo: "https://www.github.com/Foo/Bar.git", CommitID: "c", UnitType: "GoPackage", Unit: "a/b", Path: "T/m"},
+		File:     "dir/my file.go",
+		DefStart: 11,
+		DefEnd:   uint32(len(src)),
+	}
+	got, err := tmpls.DefURL(def, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://github.com/foo/bar/blob/c/dir/my%20file.go#L3-L5"; got != want {
+		t.Errorf("DefURL: got %q, want %q", got, want)
+	}
+
+	def.Repo = "example.com/x/y"
+	got, err = tmpls.DefURL(def, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://docs.example.com/example.com/x/y/-/GoPackage/a/b/-/T/m"; got != want {
+		t.Errorf("DefURL (Def template): got %q, want %q", got, want)
+	}
+
+	ref := &Ref{Repo: "example.com/x/y", CommitID: "c", File: "f.go", Start: 27, End: 28}
+	got, err = tmpls.RefURL(ref, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://example.com/x/y/c/f.go?l=4"; got != want {
+		t.Errorf("RefURL: got %q, want %q", got, want)
+	}
+
+	if _, err := tmpls.DefKeyURL(DefKey{Repo: "github.com/foo/bar", Path: "p"}); err == nil {
+		t.Error("DefKeyURL: got nil error for host without Def template")
+	}
+	if _, err := tmpls.RefURL(&Ref{Repo: "unknown.com/a/b"}, src); err == nil {
+		t.Error("RefURL: got nil error for unknown host")
+	}
+	if _, err := tmpls.RefURL(&Ref{Repo: "example.com/x/y", Start: 1, End: 100}, src); err == nil {
+		t.Error("RefURL: got nil error for out-of-bounds ref")
+	}
+}
@@ -0,0 +1,73 @@
+package grapher
+
+import (
+	"sourcegraph.com/sourcegraph/srclib/dep"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+// ResolveStats records the outcome of a call to ResolveRefDefRepos.
+type ResolveStats struct {
+	// Refs is the number of refs that were examined.
+	Refs int
+
+	// Rewritten is the number of refs whose DefRepo was rewritten
+	// from a clone URL to a repo URI.
+	Rewritten int
+
+	// Unresolved is the number of refs whose DefRepo looked like a
+	// clone URL but did not match any resolved dependency. These
+	// refs are left unchanged.
+	Unresolved int
+}
+
+// Add adds the counts in other to s.
+func (s *ResolveStats) Add(other ResolveStats) {
+	s.Refs += other.Refs
+	s.Rewritten += other.Rewritten
+	s.Unresolved += other.Unresolved
+}
+
+// ResolveRefDefRepos rewrites the DefRepo of each ref that refers to
+// a dependency by its clone URL (e.g., "git://github.com/user/repo.git")
+// so that it refers to the dependency's canonical repo URI (e.g.,
+// "github.com/user/repo"). Only clone URLs that appear as the
+// ToRepoCloneURL of a successfully resolved dependency in deps are
+// rewritten.
+//
+// Toolchains that emit clone URLs in DefRepo produce refs that
+// can't be joined to the defs of the repository they point to, since
+// defs are always stored under repo URIs.
+func ResolveRefDefRepos(refs []*graph.Ref, deps []*dep.Resolution) ResolveStats {
+	uris := make(map[string]string, len(deps))
+	for _, d := range deps {
+		if d.Target == nil || d.Target.ToRepoCloneURL == "" {
+			continue
+		}
+		uri, err := graph.TryMakeURI(d.Target.ToRepoCloneURL)
+		if err != nil {
+			continue
+		}
+		uris[d.Target.ToRepoCloneURL] = uri
+	}
+
+	var stats ResolveStats
+	for _, ref := range refs {
+		stats.Refs++
+		if ref.DefRepo == "" {
+			continue
+		}
+		if uri, present := uris[ref.DefRepo]; present {
+			if uri != ref.DefRepo {
+				ref.DefRepo = uri
+				stats.Rewritten++
+			}
+			continue
+		}
+		if uri, err := graph.TryMakeURI(ref.DefRepo); err == nil && uri != ref.DefRepo {
+			// It's a clone URL, but it's not one that we know how
+			// to resolve.
+			stats.Unresolved++
+		}
+	}
+	return stats
+}
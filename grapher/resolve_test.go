@@ -0,0 +1,35 @@
+package grapher
+
+import (
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/dep"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+func TestResolveRefDefRepos(t *testing.T) {
+	deps := []*dep.Resolution{
+		{Target: &dep.ResolvedTarget{ToRepoCloneURL: "git://github.com/a/b.git"}},
+		{Target: &dep.ResolvedTarget{ToRepoCloneURL: "https://github.com/c/d"}},
+		{Error: "failed"},
+	}
+	refs := []*graph.Ref{
+		{DefRepo: "git://github.com/a/b.git", DefPath: "p1"},
+		{DefRepo: "https://github.com/c/d", DefPath: "p2"},
+		{DefRepo: "github.com/a/b", DefPath: "p3"},
+		{DefRepo: "https://github.com/x/y.git", DefPath: "p4"},
+		{DefPath: "p5"},
+	}
+
+	stats := ResolveRefDefRepos(refs, deps)
+	if want := (ResolveStats{Refs: 5, Rewritten: 2, Unresolved: 1}); stats != want {
+		t.Errorf("got stats %+v, want %+v", stats, want)
+	}
+
+	wantDefRepos := []string{"github.com/a/b", "github.com/c/d", "github.com/a/b", "https://github.com/x/y.git", ""}
+	for i, ref := range refs {
+		if ref.DefRepo != wantDefRepos[i] {
+			t.Errorf("ref %d: got DefRepo %q, want %q", i, ref.DefRepo, wantDefRepos[i])
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Package gittest creates git repositories for tests.
+package gittest
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A Repo is a git repository in a temporary directory. Call Remove
+// when done with it.
+type Repo struct {
+	Dir string // the repository's root directory
+
+	t *testing.T
+}
+
+// New creates an empty git repository. It skips the test if git isn't
+// installed.
+func New(t *testing.T) *Repo {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir, err := ioutil.TempDir("", "srclib-gittest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Repo{Dir: dir, t: t}
+	r.Git("init", "-q")
+	return r
+}
+
+// Git runs git with the given args in the repository and returns its
+// output (with surrounding whitespace trimmed). Commits are made with
+// a fixed author and committer.
+func (r *Repo) Git(args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = r.Dir
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=a@example.com", "GIT_COMMITTER_NAME=a", "GIT_COMMITTER_EMAIL=a@example.com")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		r.t.Fatalf("git %v: %s (%s)", args, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// WriteFile writes data to the file at name (a slash-separated path
+// relative to the repository's root) in the working tree, creating its
+// parent directories if needed.
+func (r *Repo) WriteFile(name, data string) {
+	path := filepath.Join(r.Dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		r.t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+// Commit commits all of the working tree's changes and returns the
+// new commit's ID.
+func (r *Repo) Commit(msg string) string {
+	r.Git("add", "-A")
+	r.Git("commit", "-q", "-m", msg)
+	return r.Git("rev-parse", "HEAD")
+}
+
+// Remove removes the repository's directory.
+func (r *Repo) Remove() {
+	os.RemoveAll(r.Dir)
+}
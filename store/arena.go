@@ -0,0 +1,211 @@
+package store
+
+import (
+	"sync"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+// An Arena allocates the defs and refs that queries return in large
+// blocks, instead of one at a time, and reuses the blocks after they
+// are released. Servers that materialize huge numbers of refs per
+// request and immediately serialize them use arenas to avoid most of
+// the allocations (and hence most of the garbage collection work) of
+// such queries.
+//
+// To allocate a query's results in an arena, pass the *Arena as one of
+// the query's filters (it implements DefFilter and RefFilter and
+// selects everything); stores that read defs and refs from files
+// allocate them in it, and other stores ignore it. Only the Def and
+// Ref structs are allocated in the arena; the memory they refer to
+// (such as their strings) is allocated normally and remains valid
+// after the arena is released.
+//
+// Call Release when the results are no longer needed. After that, the
+// results (and any pointers to them) must not be used, because their
+// memory is reused by later queries. An Arena may be used by multiple
+// queries (including concurrently) before it is released, but not
+// after.
+type Arena struct {
+	mu       sync.Mutex
+	defs     []*[arenaBlockSize]graph.Def
+	refs     []*[arenaBlockSize]graph.Ref
+	ndefs    int // number of defs allocated in the last def block
+	nrefs    int // number of refs allocated in the last ref block
+	released bool
+}
+
+// NewArena returns a new arena. Call Release when you are done with
+// the results of the queries that used it.
+func NewArena() *Arena { return &Arena{} }
+
+// arenaBlockSize is the number of defs or refs in an arena block.
+const arenaBlockSize = 512
+
+var (
+	arenaDefBlocks = sync.Pool{New: func() interface{} { return new([arenaBlockSize]graph.Def) }}
+	arenaRefBlocks = sync.Pool{New: func() interface{} { return new([arenaBlockSize]graph.Ref) }}
+)
+
+func (*Arena) SelectDef(*graph.Def) bool { return true }
+func (*Arena) SelectRef(*graph.Ref) bool { return true }
+func (*Arena) String() string            { return "Arena" }
+
+// getArena returns the *Arena filter in filters, or nil if there is
+// none.
+func getArena(filters interface{}) *Arena {
+	for _, f := range storeFilters(filters) {
+		if a, ok := f.(*Arena); ok {
+			return a
+		}
+	}
+	return nil
+}
+
+// nextDef returns the def to decode the next record into. If a is nil,
+// it's a new def; otherwise it's scratch (reset), which selectDef
+// copies into the arena if the record is selected.
+func (a *Arena) nextDef(scratch *graph.Def) *graph.Def {
+	if a == nil {
+		return &graph.Def{}
+	}
+	*scratch = graph.Def{}
+	return scratch
+}
+
+// A defStateFilter is a DefFilter that records state about the defs
+// it selects, keyed by their *graph.Def (such as ByDefQueryMatches).
+type defStateFilter interface {
+	DefFilter
+	recordsDefState()
+}
+
+// selectDef returns the def to add to a query's results if def (as
+// returned by nextDef or decoded into a local variable) is selected by
+// the filters, or nil if it isn't. If a is non-nil, def is copied into
+// the arena (with keepDef) before it is passed to the filters that
+// record per-def state, so that their state refers to the def that
+// the query returns.
+func (a *Arena) selectDef(def *graph.Def, fs []DefFilter) *graph.Def {
+	if a == nil {
+		if DefFilters(fs).SelectDef(def) {
+			return def
+		}
+		return nil
+	}
+	for _, f := range fs {
+		if _, ok := f.(defStateFilter); !ok && !f.SelectDef(def) {
+			return nil
+		}
+	}
+	def = a.keepDef(def)
+	for _, f := range fs {
+		if _, ok := f.(defStateFilter); ok && !f.SelectDef(def) {
+			a.discardDef(def)
+			return nil
+		}
+	}
+	return def
+}
+
+// keepDef returns the def to add to a query's results: def itself if a
+// is nil, or else a copy of def allocated in a.
+func (a *Arena) keepDef(def *graph.Def) *graph.Def {
+	if a == nil {
+		return def
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.released {
+		panic("store: Arena used after Release")
+	}
+	if len(a.defs) == 0 || a.ndefs == arenaBlockSize {
+		a.defs = append(a.defs, arenaDefBlocks.Get().(*[arenaBlockSize]graph.Def))
+		a.ndefs = 0
+	}
+	p := &a.defs[len(a.defs)-1][a.ndefs]
+	*p = *def
+	a.ndefs++
+	return p
+}
+
+// discardDef frees def (as returned by keepDef) if it is the last def
+// allocated in a, so that the def that wasn't selected doesn't use up
+// an arena slot. (Otherwise its slot is just cleared.)
+func (a *Arena) discardDef(def *graph.Def) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	*def = graph.Def{}
+	if n := len(a.defs); n > 0 && a.ndefs > 0 && def == &a.defs[n-1][a.ndefs-1] {
+		a.ndefs--
+	}
+}
+
+// nextRef is like nextDef, but for refs.
+func (a *Arena) nextRef(scratch *graph.Ref) *graph.Ref {
+	if a == nil {
+		return &graph.Ref{}
+	}
+	*scratch = graph.Ref{}
+	return scratch
+}
+
+// keepRef is like keepDef, but for refs.
+func (a *Arena) keepRef(ref *graph.Ref) *graph.Ref {
+	if a == nil {
+		return ref
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.released {
+		panic("store: Arena used after Release")
+	}
+	if len(a.refs) == 0 || a.nrefs == arenaBlockSize {
+		a.refs = append(a.refs, arenaRefBlocks.Get().(*[arenaBlockSize]graph.Ref))
+		a.nrefs = 0
+	}
+	p := &a.refs[len(a.refs)-1][a.nrefs]
+	*p = *ref
+	a.nrefs++
+	return p
+}
+
+// Release releases the memory of the defs and refs allocated in the
+// arena, so that it can be reused by other queries. The arena must not
+// be used after it is released.
+func (a *Arena) Release() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.released {
+		return
+	}
+	a.released = true
+	for i, b := range a.defs {
+		// Clear the blocks so that they don't keep the memory that
+		// the defs refer to alive while they're in the pool.
+		n := arenaBlockSize
+		if i == len(a.defs)-1 {
+			n = a.ndefs
+		}
+		for j := 0; j < n; j++ {
+			b[j] = graph.Def{}
+		}
+		arenaDefBlocks.Put(b)
+	}
+	for i, b := range a.refs {
+		n := arenaBlockSize
+		if i == len(a.refs)-1 {
+			n = a.nrefs
+		}
+		for j := 0; j < n; j++ {
+			b[j] = graph.Ref{}
+		}
+		arenaRefBlocks.Put(b)
+	}
+	a.defs, a.refs = nil, nil
+}
+
+var (
+	_ DefFilter = (*Arena)(nil)
+	_ RefFilter = (*Arena)(nil)
+)
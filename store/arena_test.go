@@ -0,0 +1,115 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+func TestArena(t *testing.T) {
+	defer func(n int) { ScanWorkers = n }(ScanWorkers)
+
+	us := &fsUnitStore{fs: newTestFS(), label: "test"}
+	var data graph.Output
+	for i := 0; i < arenaBlockSize+5; i++ {
+		data.Defs = append(data.Defs, &graph.Def{DefKey: graph.DefKey{Path: fmt.Sprintf("p%04d", i)}, Name: fmt.Sprint(i % 2), File: "f"})
+		data.Refs = append(data.Refs, &graph.Ref{DefPath: fmt.Sprintf("p%04d", i), File: "f", Start: uint32(i), End: uint32(i + 1)})
+	}
+	if err := us.Import(data); err != nil {
+		t.Fatal(err)
+	}
+	wantDefs, err := us.Defs(ByDefQuery("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRefs, err := us.Refs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, workers := range []int{1, 4} {
+		ScanWorkers = workers
+		a := NewArena()
+		raw := newRawRecordsFilter(Codec)
+		defs, err := us.Defs(ByDefQuery("1"), a, raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs, err := us.Refs(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(defs, wantDefs) {
+			t.Errorf("ScanWorkers=%d: got %d defs, want %d", workers, len(defs), len(wantDefs))
+		}
+		if !reflect.DeepEqual(refs, wantRefs) {
+			t.Errorf("ScanWorkers=%d: got %d refs, want %d", workers, len(refs), len(wantRefs))
+		}
+
+		// Only the selected records are allocated in the arena, and
+		// the results are the arena's records.
+		if got, want := (len(a.defs)-1)*arenaBlockSize+a.ndefs, len(wantDefs); got != want {
+			t.Errorf("ScanWorkers=%d: %d defs allocated in arena, want %d", workers, got, want)
+		}
+		if len(a.refs) != 2 || a.nrefs != 5 {
+			t.Errorf("ScanWorkers=%d: got %d ref blocks (%d refs in last), want 2 (5)", workers, len(a.refs), a.nrefs)
+		}
+		slots := map[*graph.Ref]bool{}
+		for _, b := range a.refs {
+			for i := range b {
+				slots[&b[i]] = true
+			}
+		}
+		for _, ref := range refs {
+			if !slots[ref] {
+				t.Errorf("ScanWorkers=%d: ref %v is not allocated in the arena", workers, ref)
+				break
+			}
+		}
+		if _, ok := raw.defs[defs[0]]; !ok {
+			t.Errorf("ScanWorkers=%d: raw record of arena def was not observed", workers)
+		}
+
+		blocks := a.refs
+		a.Release()
+		if !reflect.DeepEqual(blocks[1][0], graph.Ref{}) {
+			t.Errorf("ScanWorkers=%d: released block was not cleared", workers)
+		}
+		a.Release() // no-op
+	}
+}
+
+func TestArena_indexed(t *testing.T) {
+	mrs := NewFSMultiRepoStore(newTestFS(), nil)
+	testSyncImport(t, mrs, "r", "c", "u1", "u2")
+
+	a := NewArena()
+	defer a.Release()
+	want, err := mrs.Refs(ByRepoCommitIDs(Version{Repo: "r", CommitID: "c"}), ByFiles(true, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs, err := mrs.Refs(ByRepoCommitIDs(Version{Repo: "r", CommitID: "c"}), ByFiles(true, "f"), a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(refs, want) {
+		t.Errorf("got refs %v, want %v", refs, want)
+	}
+	if len(a.refs) != 1 || a.nrefs != len(want) {
+		t.Errorf("got %d refs allocated in arena, want %d", a.nrefs, len(want))
+	}
+}
+
+func TestArena_useAfterRelease(t *testing.T) {
+	a := NewArena()
+	a.Release()
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic")
+		}
+	}()
+	a.keepRef(&graph.Ref{})
+}
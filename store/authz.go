@@ -0,0 +1,210 @@
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// A RepoAuthorizer decides which repos a query may access. It lets a
+// server that embeds a multi-repo store enforce per-user repo
+// permissions.
+type RepoAuthorizer interface {
+	// AuthorizeRepos is called with the name of the MultiRepoStore
+	// method being called (e.g., "Defs") and the repos that the query
+	// would touch, before any of their data is read. It returns the
+	// subset of repos that may be accessed. Repos that are omitted are
+	// treated as though they do not exist.
+	//
+	// A non-nil error aborts the query.
+	AuthorizeRepos(op string, repos []string) ([]string, error)
+}
+
+// RepoAuthorizerFunc is a RepoAuthorizer that calls the func.
+type RepoAuthorizerFunc func(op string, repos []string) ([]string, error)
+
+func (f RepoAuthorizerFunc) AuthorizeRepos(op string, repos []string) ([]string, error) {
+	return f(op, repos)
+}
+
+// NewAuthorizedMultiRepoStore returns a MultiRepoStore that only
+// allows queries to access repos that authz authorizes. Unauthorized
+// repos are excluded from each query before it is run (instead of
+// their data being filtered out of the results afterwards), so
+// callers can't infer anything about them from query results or
+// timing.
+//
+// The returned store is read-only. It is typically created for each
+// request, with an authz that knows the current user's permissions.
+func NewAuthorizedMultiRepoStore(mrs MultiRepoStore, authz RepoAuthorizer) MultiRepoStore {
+	return &authorizedMultiRepoStore{mrs: mrs, authz: authz}
+}
+
+type authorizedMultiRepoStore struct {
+	mrs   MultiRepoStore
+	authz RepoAuthorizer
+}
+
+var _ MultiRepoStore = (*authorizedMultiRepoStore)(nil)
+
+// canonicalFilters returns filters with their repos normalized and
+// redirected to the names under which the underlying store reads
+// their data, so that repos are authorized under those names (and not
+// under another spelling of them).
+func (s *authorizedMultiRepoStore) canonicalFilters(filters interface{}) (interface{}, error) {
+	canonical := graph.NormalizeRepoURI
+	switch mrs := s.mrs.(type) {
+	case repoCanonicalizer:
+		canonical = func(repo string) string { return mrs.canonicalRepo(graph.NormalizeRepoURI(repo)) }
+	case MultiRepoRenamer:
+		redirects, err := mrs.RepoRedirects()
+		if err != nil {
+			return nil, err
+		}
+		canonical = func(repo string) string {
+			repo = graph.NormalizeRepoURI(repo)
+			if newRepo, present := redirects[repo]; present {
+				return newRepo
+			}
+			return repo
+		}
+	}
+	return canonicalizeRepoFilters(canonical, filters), nil
+}
+
+// authorizedRepos returns the repos that a query with the given
+// (canonical) filters is authorized to access.
+func (s *authorizedMultiRepoStore) authorizedRepos(op string, filters interface{}) ([]string, error) {
+	repos, err := scopeRepos(storeFilters(filters))
+	if err != nil {
+		return nil, err
+	}
+	if repos == nil {
+		// The query potentially touches all repos.
+		repos, err = s.mrs.Repos()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(repos) == 0 {
+		return nil, nil
+	}
+	return s.authz.AuthorizeRepos(op, repos)
+}
+
+func (s *authorizedMultiRepoStore) Repos(f ...RepoFilter) ([]string, error) {
+	// Page the authorized repos, not the underlying store's repos.
+	if repos, paged, err := PagedRepos(s.Repos, f); paged {
+		return repos, err
+	}
+
+	repos, err := s.mrs.Repos(withoutScanLimit(f).([]RepoFilter)...)
+	if err != nil || len(repos) == 0 {
+		return repos, err
+	}
+	return s.authz.AuthorizeRepos("Repos", repos)
+}
+
+func (s *authorizedMultiRepoStore) Versions(f ...VersionFilter) ([]*Version, error) {
+	cf, err := s.canonicalFilters(f)
+	if err != nil {
+		return nil, err
+	}
+	f = cf.([]VersionFilter)
+	repos, err := s.authorizedRepos("Versions", f)
+	if err != nil || len(repos) == 0 {
+		return nil, err
+	}
+	return s.mrs.Versions(append(f[:len(f):len(f)], ByRepos(repos...))...)
+}
+
+func (s *authorizedMultiRepoStore) Units(f ...UnitFilter) ([]*unit.SourceUnit, error) {
+	cf, err := s.canonicalFilters(f)
+	if err != nil {
+		return nil, err
+	}
+	f = cf.([]UnitFilter)
+	repos, err := s.authorizedRepos("Units", f)
+	if err != nil || len(repos) == 0 {
+		return nil, err
+	}
+	return s.mrs.Units(append(f[:len(f):len(f)], ByRepos(repos...))...)
+}
+
+func (s *authorizedMultiRepoStore) Defs(f ...DefFilter) ([]*graph.Def, error) {
+	cf, err := s.canonicalFilters(f)
+	if err != nil {
+		return nil, err
+	}
+	f = cf.([]DefFilter)
+	repos, err := s.authorizedRepos("Defs", f)
+	if err != nil || len(repos) == 0 {
+		return nil, err
+	}
+	return s.mrs.Defs(append(f[:len(f):len(f)], ByRepos(repos...))...)
+}
+
+func (s *authorizedMultiRepoStore) Refs(f ...RefFilter) ([]*graph.Ref, error) {
+	cf, err := s.canonicalFilters(f)
+	if err != nil {
+		return nil, err
+	}
+	f = cf.([]RefFilter)
+	repos, err := s.authorizedRepos("Refs", f)
+	if err != nil || len(repos) == 0 {
+		return nil, err
+	}
+	return s.mrs.Refs(append(f[:len(f):len(f)], ByRepos(repos...))...)
+}
+
+// PresignDefs implements MultiRepoPresigner, if the underlying store
+// does.
+func (s *authorizedMultiRepoStore) PresignDefs(expires time.Duration, f ...DefFilter) (*PresignedRecords, error) {
+	p, ok := s.mrs.(MultiRepoPresigner)
+	if !ok {
+		return nil, fmt.Errorf("store %s does not support pre-signed URLs", s.mrs)
+	}
+	cf, err := s.canonicalFilters(f)
+	if err != nil {
+		return nil, err
+	}
+	f = cf.([]DefFilter)
+	repos, err := s.authorizedRepos("PresignDefs", f)
+	if err != nil {
+		return nil, err
+	}
+	if len(repos) == 0 {
+		return &PresignedRecords{}, nil
+	}
+	return p.PresignDefs(expires, append(f[:len(f):len(f)], ByRepos(repos...))...)
+}
+
+// PresignRefs implements MultiRepoPresigner, if the underlying store
+// does.
+func (s *authorizedMultiRepoStore) PresignRefs(expires time.Duration, f ...RefFilter) (*PresignedRecords, error) {
+	p, ok := s.mrs.(MultiRepoPresigner)
+	if !ok {
+		return nil, fmt.Errorf("store %s does not support pre-signed URLs", s.mrs)
+	}
+	cf, err := s.canonicalFilters(f)
+	if err != nil {
+		return nil, err
+	}
+	f = cf.([]RefFilter)
+	repos, err := s.authorizedRepos("PresignRefs", f)
+	if err != nil {
+		return nil, err
+	}
+	if len(repos) == 0 {
+		return &PresignedRecords{}, nil
+	}
+	return p.PresignRefs(expires, append(f[:len(f):len(f)], ByRepos(repos...))...)
+}
+
+var _ MultiRepoPresigner = (*authorizedMultiRepoStore)(nil)
+
+func (s *authorizedMultiRepoStore) String() string {
+	return fmt.Sprintf("authorized(%s)", s.mrs)
+}
@@ -0,0 +1,196 @@
+package store
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestAuthorizedMultiRepoStore(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+	useIndexedStore = false
+	mrs := NewFSMultiRepoStore(newTestFS(), nil)
+	for _, repo := range []string{"r1", "r2"} {
+		u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
+		data := graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}}}}
+		if err := mrs.Import(repo, "c", u, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.CreateVersion(repo, "c"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var calls [][]string
+	authz := RepoAuthorizerFunc(func(op string, repos []string) ([]string, error) {
+		sort.Strings(repos)
+		calls = append(calls, append([]string{op}, repos...))
+		var allowed []string
+		for _, repo := range repos {
+			if repo == "r1" {
+				allowed = append(allowed, repo)
+			}
+		}
+		return allowed, nil
+	})
+	s := NewAuthorizedMultiRepoStore(mrs, authz)
+
+	repos, err := s.Repos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"r1"}; !reflect.DeepEqual(repos, want) {
+		t.Errorf("Repos: got %v, want %v", repos, want)
+	}
+
+	calls = nil
+	defs, err := s.Defs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 1 || defs[0].Repo != "r1" {
+		t.Errorf("Defs: got %v, want 1 def in r1", defs)
+	}
+	if want := [][]string{{"Defs", "r1", "r2"}}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("Defs: got authz calls %v, want %v", calls, want)
+	}
+
+	calls = nil
+	units, err := s.Units(ByRepos("r2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(units) != 0 {
+		t.Errorf("Units(ByRepos r2): got %v, want none", units)
+	}
+	if want := [][]string{{"Units", "r2"}}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("Units(ByRepos r2): got authz calls %v, want %v", calls, want)
+	}
+
+	versions, err := s.Versions(ByRepoCommitIDs(Version{Repo: "r1", CommitID: "c"}, Version{Repo: "r2", CommitID: "c"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0].Repo != "r1" {
+		t.Errorf("Versions: got %v, want 1 version in r1", versions)
+	}
+
+	errAuthz := errors.New("authz")
+	s = NewAuthorizedMultiRepoStore(mrs, RepoAuthorizerFunc(func(string, []string) ([]string, error) { return nil, errAuthz }))
+	if _, err := s.Refs(); err != errAuthz {
+		t.Errorf("Refs: got error %v, want %v", err, errAuthz)
+	}
+}
+
+func TestAuthorizedMultiRepoStore_canonicalRepos(t *testing.T) {
+	mrs := NewFSMultiRepoStore(newTestFS(), nil)
+	for _, repo := range []string{"github.com/public/repo", "github.com/secret/old"} {
+		u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
+		data := graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}}}}
+		if err := mrs.Import(repo, "c", u, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.CreateVersion(repo, "c"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mrs.(MultiRepoRenamer).RenameRepo("github.com/secret/old", "github.com/secret/repo"); err != nil {
+		t.Fatal(err)
+	}
+
+	var authorized []string
+	s := NewAuthorizedMultiRepoStore(mrs, RepoAuthorizerFunc(func(op string, repos []string) ([]string, error) {
+		var allowed []string
+		for _, repo := range repos {
+			authorized = append(authorized, repo)
+			if repo != "github.com/secret/repo" {
+				allowed = append(allowed, repo)
+			}
+		}
+		return allowed, nil
+	}))
+
+	// The denied repo can't be reached by another spelling of its
+	// name, or by the name it was renamed from.
+	for _, repo := range []string{"GitHub.com/Secret/Repo", "https://github.com/secret/repo.git", "github.com/secret/old"} {
+		authorized = nil
+		defs, err := s.Defs(ByRepos(repo))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(defs) != 0 {
+			t.Errorf("%s: got defs %v, want none", repo, defs)
+		}
+		if want := []string{"github.com/secret/repo"}; !reflect.DeepEqual(authorized, want) {
+			t.Errorf("%s: authorized %v, want %v", repo, authorized, want)
+		}
+		units, err := s.Units(ByRepoCommitIDs(Version{Repo: repo, CommitID: "c"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(units) != 0 {
+			t.Errorf("%s: got units %v, want none", repo, units)
+		}
+	}
+
+	defs, err := s.Defs(ByRepos("GitHub.com/Public/Repo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 1 || defs[0].Repo != "github.com/public/repo" {
+		t.Errorf("got defs %v, want 1 def in github.com/public/repo", defs)
+	}
+}
+
+func TestAuthorizedMultiRepoStore_Presign(t *testing.T) {
+	mrs := NewFSMultiRepoStore(presigningFS{newTestFS()}, nil)
+	for _, repo := range []string{"r1", "r2"} {
+		u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
+		data := graph.Output{
+			Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}}},
+			Refs: []*graph.Ref{{DefPath: "p", File: "f", Start: 1, End: 2}},
+		}
+		if err := mrs.Import(repo, "c", u, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.CreateVersion(repo, "c"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := NewAuthorizedMultiRepoStore(mrs, RepoAuthorizerFunc(func(op string, repos []string) ([]string, error) {
+		var allowed []string
+		for _, repo := range repos {
+			if repo == "r1" {
+				allowed = append(allowed, repo)
+			}
+		}
+		return allowed, nil
+	})).(MultiRepoPresigner)
+
+	defs, err := s.PresignDefs(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs, err := s.PresignRefs(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, recs := range []*PresignedRecords{defs, refs} {
+		if len(recs.Segments) != 1 || recs.Segments[0].Repo != "r1" {
+			t.Errorf("got segments %+v, want 1 segment in r1", recs.Segments)
+		}
+	}
+
+	defs, err = s.PresignDefs(time.Hour, ByRepos("r2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs.Segments) != 0 {
+		t.Errorf("got segments %+v in unauthorized repo, want none", defs.Segments)
+	}
+}
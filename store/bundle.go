@@ -0,0 +1,245 @@
+package store
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kr/fs"
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+// A bundle is a single file that contains the graph data of selected
+// versions from a store, for use in environments without access to
+// the store (e.g., air-gapped networks). It is a gzipped tar archive
+// whose first entry is the bundle's manifest (bundleManifestName) and
+// whose other entries are the files of an FS-backed MultiRepoStore
+// (under bundleStoreDir).
+
+// bundleManifestName is the name of the manifest entry in a bundle.
+const bundleManifestName = "bundle.json"
+
+// bundleStoreDir is the dir (in a bundle) that contains the store's
+// files.
+const bundleStoreDir = "store/"
+
+// ErrNotBundle is returned when reading a file that is not a bundle.
+var ErrNotBundle = errors.New("not a srclib store bundle (no bundle manifest)")
+
+// A BundleManifest describes the contents of a bundle.
+type BundleManifest struct {
+	// Versions are the versions (repo commits) whose data is in the
+	// bundle.
+	Versions []Version
+
+	// Units is the number of source units in the bundle.
+	Units int
+
+	// Indexed is whether the bundle contains indexes.
+	Indexed bool
+
+	// Created is when the bundle was created.
+	Created time.Time
+}
+
+// BundleOptions configures CreateBundle.
+type BundleOptions struct {
+	// Repos, if set, restricts the bundle to these repos.
+	Repos []string
+
+	// Versions, if set, restricts the bundle to these versions.
+	Versions []Version
+
+	// Index is whether to build indexes and include them in the
+	// bundle. It makes the bundle larger but queries on it faster.
+	Index bool
+
+	// Clock provides the bundle's creation time. If nil, the clock of
+	// src (see FSStoreConf) is used.
+	Clock Clock
+}
+
+// CreateBundle writes a bundle containing the data of the versions in
+// src that match opt to w. The data is staged in memory before it is
+// written.
+func CreateBundle(w io.Writer, src MultiRepoStoreImporter, opt *BundleOptions) (*BundleManifest, error) {
+	if opt == nil {
+		opt = &BundleOptions{}
+	}
+	clock := opt.Clock
+	if clock == nil {
+		clock = clockOf(src)
+	}
+
+	stage := rwvfs.Walkable(rwvfs.Map(map[string]string{}))
+	stats, err := Sync(src, NewFSMultiRepoStore(stage, nil), &SyncOptions{
+		Repos:    opt.Repos,
+		Versions: opt.Versions,
+		Index:    opt.Index,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(stats.Copied) == 0 {
+		return nil, errors.New("no versions to bundle")
+	}
+	m := &BundleManifest{
+		Versions: stats.Copied,
+		Units:    stats.Units,
+		Indexed:  opt.Index,
+		Created:  clock.Now().UTC(),
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	hdr := &tar.Header{Name: bundleManifestName, Mode: 0644, Size: int64(len(b)), ModTime: m.Created}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(b); err != nil {
+		return nil, err
+	}
+
+	walker := fs.WalkFS(".", stage)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, err
+		}
+		fi := walker.Stat()
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		name := filepath.ToSlash(walker.Path())
+		hdr := &tar.Header{Name: bundleStoreDir + name, Mode: 0644, Size: fi.Size(), ModTime: m.Created}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if err := copyFileTo(tw, stage, name); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func copyFileTo(w io.Writer, vfs rwvfs.FileSystem, name string) error {
+	f, err := vfs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// ExtractBundle reads the bundle from r and writes its store's files
+// to dst. The store can then be opened with NewFSMultiRepoStore. The
+// extracted trees are verified against their manifests (see
+// TreeManifest), if they have them.
+func ExtractBundle(r io.Reader, dst rwvfs.FileSystem) (*BundleManifest, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		if err == gzip.ErrHeader {
+			return nil, ErrNotBundle
+		}
+		return nil, err
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+
+	hdr, err := tr.Next()
+	if err == io.EOF || err == nil && hdr.Name != bundleManifestName {
+		return nil, ErrNotBundle
+	} else if err != nil {
+		return nil, err
+	}
+	var m BundleManifest
+	if err := json.NewDecoder(tr).Decode(&m); err != nil {
+		return nil, fmt.Errorf("invalid bundle manifest: %s", err)
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		if !strings.HasPrefix(hdr.Name, bundleStoreDir) {
+			return nil, fmt.Errorf("unexpected file %q in bundle", hdr.Name)
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, bundleStoreDir))
+		if path.IsAbs(name) || name == "." || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("invalid file path %q in bundle", hdr.Name)
+		}
+		if err := rwvfs.MkdirAll(dst, path.Dir(name)); err != nil {
+			return nil, err
+		}
+		if err := writeFileFrom(dst, name, tr); err != nil {
+			return nil, err
+		}
+	}
+
+	mrs := NewFSMultiRepoStore(rwvfs.Walkable(dst), nil).(MultiRepoTreeManifests)
+	for _, v := range m.Versions {
+		mismatches, err := mrs.VerifyTreeManifest(v.Repo, v.CommitID)
+		if err == ErrNoTreeManifest {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if len(mismatches) > 0 {
+			return nil, fmt.Errorf("bundle tree %s@%s does not match its manifest (%s)", v.Repo, v.CommitID, mismatches[0])
+		}
+	}
+	return &m, nil
+}
+
+func writeFileFrom(vfs rwvfs.FileSystem, name string, r io.Reader) (err error) {
+	f, err := vfs.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := f.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+	_, err = io.Copy(f, r)
+	return err
+}
+
+// OpenBundle reads the bundle from r into memory and returns a store
+// that serves queries from it.
+func OpenBundle(r io.Reader) (MultiRepoStore, *BundleManifest, error) {
+	vfs := rwvfs.Map(map[string]string{})
+	m, err := ExtractBundle(r, vfs)
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := OpenFSMultiRepoStore(rwvfs.Walkable(vfs), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, m, nil
+}
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBundle(t *testing.T) {
+	src := NewFSMultiRepoStore(newTestFS(), nil)
+	testSyncImport(t, src, "r1", "c1", "u1", "u2")
+	testSyncImport(t, src, "r1", "c2", "u1")
+	testSyncImport(t, src, "r2", "c3", "u")
+
+	var buf bytes.Buffer
+	want := []Version{{Repo: "r1", CommitID: "c1"}, {Repo: "r2", CommitID: "c3"}}
+	m, err := CreateBundle(&buf, src, &BundleOptions{Versions: want})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.Versions, want) || m.Units != 3 {
+		t.Errorf("got manifest %+v, want versions %v and 3 units", m, want)
+	}
+
+	s, m2, err := OpenBundle(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m2.Versions, m.Versions) || !m2.Created.Equal(m.Created) {
+		t.Errorf("got manifest %+v from bundle, want %+v", m2, m)
+	}
+
+	versions, err := s.Versions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sortVersions(versions)
+	if len(versions) != 2 || *versions[0] != want[0] || *versions[1] != want[1] {
+		t.Errorf("got versions %v, want %v", versions, want)
+	}
+	defs, err := s.Defs(ByRepoCommitIDs(want[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 2 {
+		t.Errorf("got %d defs in %v, want 2", len(defs), want[0])
+	}
+
+	if _, err := CreateBundle(&buf, src, &BundleOptions{Repos: []string{"r3"}}); err == nil {
+		t.Error("got no error creating an empty bundle")
+	}
+}
+
+func TestBundle_clock(t *testing.T) {
+	// Index files aren't reproducible (their hash functions are
+	// randomly seeded), so the bundles are of unindexed stores.
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+	useIndexedStore = false
+
+	created := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	src := NewFSMultiRepoStore(newTestFS(), &FSMultiRepoStoreConf{FSStoreConf: FSStoreConf{Clock: NewManualClock(created)}})
+	testSyncImport(t, src, "r", "c", "u")
+
+	// Bundles of the same data are identical.
+	var bufs [2]bytes.Buffer
+	for i := range bufs {
+		m, err := CreateBundle(&bufs[i], src, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !m.Created.Equal(created) {
+			t.Errorf("got created %s, want %s", m.Created, created)
+		}
+	}
+	if !bytes.Equal(bufs[0].Bytes(), bufs[1].Bytes()) {
+		t.Error("bundles differ")
+	}
+}
+
+func TestExtractBundle_invalid(t *testing.T) {
+	if _, _, err := OpenBundle(strings.NewReader("not a bundle")); err != ErrNotBundle {
+		t.Errorf("got error %v, want ErrNotBundle", err)
+	}
+
+	makeBundle := func(names ...string) *bytes.Buffer {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gw)
+		for _, name := range names {
+			data := "{}"
+			if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write([]byte(data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tw.Close()
+		gw.Close()
+		return &buf
+	}
+	if _, _, err := OpenBundle(makeBundle("store/x")); err != ErrNotBundle {
+		t.Errorf("no manifest: got error %v, want ErrNotBundle", err)
+	}
+	for _, name := range []string{"store/../x", "store/a/../../x", "other/x"} {
+		if _, _, err := OpenBundle(makeBundle(bundleManifestName, name)); err == nil {
+			t.Errorf("%q: got no error", name)
+		}
+	}
+}
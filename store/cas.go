@@ -0,0 +1,345 @@
+package store
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/kr/fs"
+
+	"golang.org/x/tools/godoc/vfs"
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// A MultiRepoContentStoreGC removes the objects of a content-addressed
+// store (see FSMultiRepoStoreConf.ContentAddressed) that no tree
+// refers to.
+type MultiRepoContentStoreGC interface {
+	// GCContentStore removes the content-addressed objects that
+	// aren't referred to by any file in the store (in any repo's
+	// trees, including trees whose import is still in progress).
+	//
+	// It must not run concurrently with imports into the store by
+	// other processes, because it could remove the objects of a unit
+	// whose pointer files haven't been written yet.
+	GCContentStore() (*ContentStoreGCStats, error)
+}
+
+// ContentStoreGCStats describes the result of a GCContentStore call.
+type ContentStoreGCStats struct {
+	Objects int   // number of objects that are still referred to
+	Removed int   // number of unreferenced objects that were removed
+	Bytes   int64 // total size of the removed objects
+}
+
+// casDir is the dir (in a multi-repo store's VFS) that holds the
+// objects of a content-addressed store, each named by the SHA-256
+// digest of its content (in a subdir named by the digest's first 2
+// hex digits). It begins with a "." so that it isn't listed as a
+// repo.
+const casDir = ".srclib-cas"
+
+// casPointerMagic begins each pointer file, which replaces a unit data
+// file in a tree of a content-addressed store. It is followed by the
+// hex-encoded SHA-256 digest of the file's content (i.e., the name of
+// its object) and a newline.
+const casPointerMagic = "srclib-cas sha256:"
+
+// casPointerSize is the size of a pointer file. Only files of this
+// size need to be read to determine whether they are pointers.
+const casPointerSize = len(casPointerMagic) + 2*32 + 1
+
+// casObjectPath returns the path of the object with the given digest.
+func casObjectPath(digest string) string {
+	return path.Join(casDir, digest[:2], digest)
+}
+
+// casPointer returns the content of a pointer file to the object with
+// the given digest.
+func casPointer(digest string) []byte {
+	return []byte(casPointerMagic + digest + "\n")
+}
+
+// parseCASPointer returns the digest of the object that the pointer
+// file content p refers to, or false if p is not a pointer file.
+func parseCASPointer(p []byte) (digest string, ok bool) {
+	if len(p) != casPointerSize || !bytes.HasPrefix(p, []byte(casPointerMagic)) || p[len(p)-1] != '\n' {
+		return "", false
+	}
+	digest = string(p[len(casPointerMagic) : len(p)-1])
+	if _, err := hex.DecodeString(digest); err != nil || strings.ToLower(digest) != digest {
+		return "", false
+	}
+	return digest, true
+}
+
+// newCASFS returns a filesystem that transparently resolves the
+// pointer files on fs to the content-addressed objects they refer to:
+// opening a pointer file opens its object, and its size is reported
+// as the object's size (so that, e.g., bundles and usage accounting
+// see the unit data files' real content and sizes).
+//
+// Files are written to fs as-is; pointer files are written by
+// fsMultiRepoStore.addUnitDataToCAS after a unit is imported.
+func newCASFS(fs rwvfs.WalkableFileSystem) *casFS {
+	return &casFS{WalkableFileSystem: fs}
+}
+
+type casFS struct {
+	rwvfs.WalkableFileSystem
+}
+
+// readPointer reads the file at name on the underlying filesystem
+// and returns the digest of the object it refers to, or false if the
+// file is not a pointer file.
+func (fs *casFS) readPointer(name string) (digest string, ok bool, err error) {
+	f, err := fs.WalkableFileSystem.Open(name)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+	digest, ok, err = readCASPointer(f)
+	return
+}
+
+// readCASPointer reads the beginning of f and returns the digest of
+// the object it refers to, or false if f is not a pointer file.
+func readCASPointer(f io.Reader) (digest string, ok bool, err error) {
+	buf := make([]byte, casPointerSize+1)
+	n, err := io.ReadFull(f, buf)
+	if err != io.ErrUnexpectedEOF {
+		if err == nil || err == io.EOF {
+			err = nil // the file is too long or empty
+		}
+		return "", false, err
+	}
+	digest, ok = parseCASPointer(buf[:n])
+	return digest, ok, nil
+}
+
+func (fs *casFS) Open(name string) (vfs.ReadSeekCloser, error) {
+	return fs.open(name, fs.WalkableFileSystem.Open)
+}
+
+// open opens name with openFile, or, if name is a pointer file, the
+// object it refers to.
+func (fs *casFS) open(name string, openFile func(string) (vfs.ReadSeekCloser, error)) (vfs.ReadSeekCloser, error) {
+	f, err := openFile(name)
+	if err != nil {
+		return nil, err
+	}
+	digest, ok, err := readCASPointer(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if ok {
+		f.Close()
+		return openFile(casObjectPath(digest))
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// resolve returns the file info of the object that the file described
+// by fi refers to, if it is a pointer file whose object exists.
+// Otherwise it returns fi.
+func (fs *casFS) resolve(name string, fi os.FileInfo) (os.FileInfo, error) {
+	if !fi.Mode().IsRegular() || fi.Size() != int64(casPointerSize) {
+		return fi, nil
+	}
+	digest, ok, err := fs.readPointer(name)
+	if err != nil || !ok {
+		return fi, err
+	}
+	ofi, err := fs.WalkableFileSystem.Stat(casObjectPath(digest))
+	if os.IsNotExist(err) {
+		return fi, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return casFileInfo{FileInfo: fi, size: ofi.Size()}, nil
+}
+
+func (fs *casFS) Stat(name string) (os.FileInfo, error) {
+	fi, err := fs.WalkableFileSystem.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.resolve(name, fi)
+}
+
+func (fs *casFS) Lstat(name string) (os.FileInfo, error) {
+	fi, err := fs.WalkableFileSystem.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.resolve(name, fi)
+}
+
+func (fs *casFS) ReadDir(name string) ([]os.FileInfo, error) {
+	fis, err := fs.WalkableFileSystem.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	for i, fi := range fis {
+		if fis[i], err = fs.resolve(path.Join(name, fi.Name()), fi); err != nil {
+			return nil, err
+		}
+	}
+	return fis, nil
+}
+
+func (fs *casFS) String() string { return "CAS(" + fs.WalkableFileSystem.String() + ")" }
+
+func (fs *casFS) CreateParentDirs(b bool) {
+	type createParents interface {
+		CreateParentDirs(bool)
+	}
+	if cfs, ok := fs.WalkableFileSystem.(createParents); ok {
+		cfs.CreateParentDirs(b)
+	}
+}
+
+func (fs *casFS) Link(oldname, newname string) error {
+	return link(fs.WalkableFileSystem, oldname, newname)
+}
+
+func (fs *casFS) syncWrites() error { return syncWrites(fs.WalkableFileSystem) }
+
+var (
+	_ linkFS      = (*casFS)(nil)
+	_ writeSyncer = (*casFS)(nil)
+)
+
+// casFileInfo reports the size of the object that a pointer file
+// refers to.
+type casFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi casFileInfo) Size() int64 { return fi.size }
+
+// addUnitDataToCAS moves each of a source unit's data files in a tree
+// to the content-addressed object for its content (unless the object
+// already exists) and replaces the file with a pointer to the object,
+// so that identical unit data files (in any trees of any repos, such
+// as the unchanged units of successive commits or vendored copies of
+// the same code) are stored only once.
+func (s *fsMultiRepoStore) addUnitDataToCAS(repo, commitID string, u unit.ID2) error {
+	cfs := s.fs.(*casFS)
+
+	s.casMu.Lock()
+	defer s.casMu.Unlock()
+
+	w := fs.WalkFS(s.fs.Join(s.repoPath(repo), commitID, unitDataDir(u)), cfs.WalkableFileSystem)
+	for w.Step() {
+		if err := w.Err(); err != nil {
+			return err
+		}
+		if !w.Stat().Mode().IsRegular() {
+			continue
+		}
+		if w.Stat().Size() == int64(casPointerSize) {
+			if _, ok, err := cfs.readPointer(w.Path()); err != nil {
+				return err
+			} else if ok {
+				continue // not rewritten by this import
+			}
+		}
+
+		digest, err := s.fileDigest(w.Path())
+		if err != nil {
+			return err
+		}
+		// An object that was only partially written (e.g., because
+		// the process crashed) is rewritten. The import is not visible
+		// until its version is created, so if writing the object or
+		// the pointer fails, the import can be retried.
+		obj := casObjectPath(digest)
+		if fi, err := cfs.WalkableFileSystem.Stat(obj); err == nil && fi.Size() == w.Stat().Size() {
+			// The object already exists.
+		} else if err == nil || os.IsNotExist(err) {
+			if err := rwvfs.MkdirAll(cfs.WalkableFileSystem, path.Dir(obj)); err != nil {
+				return err
+			}
+			if err := copyFile(cfs.WalkableFileSystem, w.Path(), obj); err != nil {
+				return err
+			}
+		} else {
+			return err
+		}
+		if err := writeFileFrom(cfs.WalkableFileSystem, w.Path(), bytes.NewReader(casPointer(digest))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fsMultiRepoStore) GCContentStore() (*ContentStoreGCStats, error) {
+	cfs, ok := s.fs.(*casFS)
+	if !ok {
+		return &ContentStoreGCStats{}, nil
+	}
+
+	s.casMu.Lock()
+	defer s.casMu.Unlock()
+
+	// Mark the objects that are reachable from the pointer files.
+	referenced := map[string]struct{}{}
+	w := fs.WalkFS(".", cfs.WalkableFileSystem)
+	for w.Step() {
+		if err := w.Err(); err != nil {
+			return nil, err
+		}
+		if w.Path() == casDir {
+			w.SkipDir()
+			continue
+		}
+		if !w.Stat().Mode().IsRegular() || w.Stat().Size() != int64(casPointerSize) {
+			continue
+		}
+		digest, ok, err := cfs.readPointer(w.Path())
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			referenced[digest] = struct{}{}
+		}
+	}
+
+	// Sweep the unreachable objects.
+	stats := &ContentStoreGCStats{}
+	w = fs.WalkFS(casDir, cfs.WalkableFileSystem)
+	for w.Step() {
+		if err := w.Err(); err != nil {
+			if os.IsNotExist(err) && w.Path() == casDir {
+				break // no objects
+			}
+			return stats, err
+		}
+		if w.Stat().IsDir() {
+			continue
+		}
+		if _, present := referenced[path.Base(w.Path())]; present {
+			stats.Objects++
+			continue
+		}
+		if err := cfs.WalkableFileSystem.Remove(w.Path()); err != nil && !os.IsNotExist(err) {
+			return stats, err
+		}
+		stats.Removed++
+		stats.Bytes += w.Stat().Size()
+	}
+	return stats, nil
+}
+
+var _ MultiRepoContentStoreGC = (*fsMultiRepoStore)(nil)
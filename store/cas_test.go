@@ -0,0 +1,118 @@
+package store
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/kr/fs"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestFSMultiRepoStore_ContentAddressed(t *testing.T) {
+	vfs := newTestFS()
+	mrs := NewFSMultiRepoStore(vfs, &FSMultiRepoStoreConf{ContentAddressed: true}).(*fsMultiRepoStore)
+
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
+	importTree := func(repo, commitID, defName string) {
+		data := graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}, Name: defName}}}
+		if err := mrs.Import(repo, commitID, u, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.CreateVersion(repo, commitID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defsFile := func(repo, commitID string) string {
+		return path.Join(mrs.repoPath(repo), commitID, unitDataDir(u.ID2()), unitDefsFilename)
+	}
+	defsDigest := func(repo, commitID string) string {
+		f, err := vfs.Open(defsFile(repo, commitID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		p, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest, ok := parseCASPointer(p)
+		if !ok {
+			t.Fatalf("%s@%s: got tree defs file %q, want a pointer", repo, commitID, p)
+		}
+		return digest
+	}
+	countObjects := func() int {
+		n := 0
+		w := fs.WalkFS(casDir, rwvfs.Walkable(vfs))
+		for w.Step() {
+			if err := w.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if w.Stat().Mode().IsRegular() {
+				n++
+			}
+		}
+		return n
+	}
+	checkDefName := func(repo, commitID, want string) {
+		defs, err := mrs.Defs(ByRepoCommitIDs(Version{Repo: repo, CommitID: commitID}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(defs) != 1 || defs[0].Name != want {
+			t.Errorf("%s@%s: got defs %v, want 1 def named %q", repo, commitID, defs, want)
+		}
+	}
+
+	importTree("r1", "c", "a")
+	digest := defsDigest("r1", "c")
+	ofi, err := vfs.Stat(casObjectPath(digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := mrs.fs.Stat(defsFile("r1", "c")); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() != ofi.Size() {
+		t.Errorf("got defs file size %d, want object size %d", fi.Size(), ofi.Size())
+	}
+	checkDefName("r1", "c", "a")
+
+	// A repo with identical unit data (e.g., a vendored copy) shares
+	// the objects.
+	importTree("r2", "c", "a")
+	if got := defsDigest("r2", "c"); got != digest {
+		t.Errorf("got defs object %s after importing identical data, want %s", got, digest)
+	}
+	checkDefName("r2", "c", "a")
+
+	// Reimporting a unit doesn't modify the data of the trees that
+	// shared its objects.
+	importTree("r2", "c", "b")
+	checkDefName("r1", "c", "a")
+	checkDefName("r2", "c", "b")
+
+	if _, err := mrs.GCContentStore(); err != nil {
+		t.Fatal(err)
+	}
+	checkDefName("r1", "c", "a")
+	checkDefName("r2", "c", "b")
+
+	if err := mrs.removeVersion("r1", "c"); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := mrs.GCContentStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Removed == 0 || stats.Objects == 0 {
+		t.Errorf("after removing tree: got %+v, want some objects removed and some kept", stats)
+	}
+	if n := countObjects(); n != stats.Objects {
+		t.Errorf("got %d objects after GC, want %d", n, stats.Objects)
+	}
+	checkDefName("r2", "c", "b")
+}
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+// A Clock tells time for a store. Stores use it (instead of the
+// system clock) for the timestamps and durations that they record and
+// for time-based limits, so that tests can inject a ManualClock to
+// make store contents and timing behavior deterministic.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// Sleep pauses the current goroutine for at least d.
+	Sleep(d time.Duration)
+}
+
+// SystemClock is the Clock that uses the system's time. It is used by
+// stores whose FSStoreConf doesn't specify a Clock.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time        { return time.Now() }
+func (systemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// A ManualClock is a Clock whose time only changes when it is
+// advanced. Sleeping on it advances it (and returns immediately), so
+// that time-based limits can be tested without waiting.
+type ManualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewManualClock returns a ManualClock whose time is t.
+func NewManualClock(t time.Time) *ManualClock {
+	return &ManualClock{now: t}
+}
+
+// Now implements Clock.
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Sleep implements Clock by advancing the clock by d.
+func (c *ManualClock) Sleep(d time.Duration) { c.Advance(d) }
+
+// Advance advances the clock by d.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// clock returns the Clock that stores configured by c use.
+func (c FSStoreConf) clock() Clock {
+	if c.Clock != nil {
+		return c.Clock
+	}
+	return SystemClock
+}
+
+// clockOf returns the Clock that store s uses, or SystemClock if s
+// doesn't have a configurable clock.
+func clockOf(s interface{}) Clock {
+	if s, ok := s.(interface {
+		clock() Clock
+	}); ok {
+		return s.clock()
+	}
+	return SystemClock
+}
@@ -3,7 +3,9 @@ package store
 import (
 	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"io"
+	"reflect"
 
 	"sourcegraph.com/sourcegraph/srclib/store/pbio"
 	"sourcegraph.com/sourcegraph/srclib/unit"
@@ -11,11 +13,62 @@ import (
 	"github.com/gogo/protobuf/proto"
 )
 
-// Codec is the codec used by all file-backed stores. It should only be
-// set at init time or when you can guarantee that no stores will be
-// using the codec.
+// Codec is the codec used by file-backed stores that don't record their
+// own codec (see FSMultiRepoStoreConf.Codec). It should only be set at
+// init time or when you can guarantee that no stores will be using the
+// codec.
 var Codec codec = ProtobufCodec{}
 
+// codecsByName maps the names of the codecs (see ParseCodec) to the
+// codecs.
+var codecsByName = map[string]codec{
+	"json":     JSONCodec{},
+	"protobuf": ProtobufCodec{},
+}
+
+// ParseCodec returns the codec with the given name ("json" or
+// "protobuf"), for use with MigrateCodec or as Codec.
+func ParseCodec(name string) (codec, error) {
+	c, ok := codecsByName[name]
+	if !ok {
+		return nil, fmt.Errorf("unrecognized codec %q (valid codecs are json and protobuf)", name)
+	}
+	return c, nil
+}
+
+// codecName returns the name of c (see ParseCodec).
+func codecName(c codec) string {
+	for name, c2 := range codecsByName {
+		if c2 == c {
+			return name
+		}
+	}
+	return fmt.Sprintf("%T", c)
+}
+
+// A codecStore is a file-backed store whose data files are encoded
+// with a codec of its own.
+type codecStore interface {
+	// codec returns the codec of the store's data files.
+	codec() codec
+}
+
+// codecOf returns the codec of s's data files, or Codec if s doesn't
+// record its own codec.
+func codecOf(s interface{}) codec {
+	if s, ok := s.(codecStore); ok {
+		return s.codec()
+	}
+	return Codec
+}
+
+var (
+	_ codecStore = (*fsMultiRepoStore)(nil)
+	_ codecStore = (*fsRepoStore)(nil)
+	_ codecStore = (*fsTreeStore)(nil)
+	_ codecStore = (*fsUnitStore)(nil)
+)
+
 // A codec is an encoder and decoder pair used by the FS-backed store
 // to encode and decode data stored in files.
 type codec interface {
@@ -26,6 +79,19 @@ type codec interface {
 	NewDecoder(r io.Reader) decoder
 }
 
+// unknownCodec is the codec of a store whose codec couldn't be
+// determined (see fsMultiRepoStore.settings). Its encoders and
+// decoders fail with the error.
+type unknownCodec struct{ err error }
+
+func (c unknownCodec) NewEncoder(w io.Writer) encoder { return c }
+
+func (c unknownCodec) NewDecoder(r io.Reader) decoder { return c }
+
+func (c unknownCodec) Encode(v interface{}) (uint64, error) { return 0, c.err }
+
+func (c unknownCodec) Decode(v interface{}) (uint64, error) { return 0, c.err }
+
 type encoder interface {
 	// Encode encodes the next value into v. It returns the number of
 	// bytes that make up v's serialization, including any length
@@ -40,6 +106,26 @@ type decoder interface {
 	Decode(v interface{}) (uint64, error)
 }
 
+// A rawDecoder is a decoder that can return the encoded bytes of the
+// last value it decoded (see RawDefs and RawRefs).
+type rawDecoder interface {
+	// lastRaw returns the encoded bytes (without any length header)
+	// of the last value decoded. They are only valid until the next
+	// call to Decode.
+	lastRaw() []byte
+}
+
+// A rawCodec is a codec whose encoded values can be passed through to
+// clients as-is (see RawDefs and RawRefs).
+type rawCodec interface {
+	// contentType returns the media type of a single encoded value
+	// of v's type.
+	contentType(v interface{}) string
+
+	// marshal returns the encoding of v (without any length header).
+	marshal(v interface{}) ([]byte, error)
+}
+
 type JSONCodec struct{}
 
 func (JSONCodec) NewEncoder(w io.Writer) encoder {
@@ -68,16 +154,37 @@ func (JSONCodec) NewDecoder(r io.Reader) decoder {
 	return &jsonDecoder{Reader: r}
 }
 
-type jsonDecoder struct{ io.Reader }
+type jsonDecoder struct {
+	io.Reader
+	last []byte
+}
 
 func (d *jsonDecoder) Decode(v interface{}) (uint64, error) {
 	var n uint64
+	d.last = nil
 	if err := binary.Read(d.Reader, binary.LittleEndian, &n); err != nil {
 		return 0, err
 	}
-	return uint64(binary.Size(n)) + n, json.NewDecoder(io.LimitReader(d.Reader, int64(n))).Decode(v)
+	if n > uint64(MaxRecordSize) {
+		return 0, &RecordTooLargeError{Size: n, Max: MaxRecordSize}
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.Reader, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	d.last = b
+	return uint64(binary.Size(n)) + n, unmarshalJSON(b, v)
 }
 
+func (d *jsonDecoder) lastRaw() []byte { return d.last }
+
+func (JSONCodec) contentType(v interface{}) string { return "application/json" }
+
+func (JSONCodec) marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
 type ProtobufCodec struct{}
 
 func (ProtobufCodec) NewEncoder(w io.Writer) encoder {
@@ -128,8 +235,35 @@ func (d *protobufDecoder) Decode(v interface{}) (uint64, error) {
 		return d.j.Decode(v)
 	default:
 		if d.pbr == nil {
-			d.pbr = pbio.NewDelimitedReader(d.r, decodeBufSize, 2*1024*1024)
+			d.pbr = pbio.NewSizeCheckedDelimitedReader(d.r, decodeBufSize, MaxRecordSize)
+		}
+		n, err := d.pbr.ReadMsg(v.(proto.Message))
+		if e, ok := err.(*pbio.MsgTooLargeError); ok {
+			err = &RecordTooLargeError{Size: e.Size, Max: e.Max}
 		}
-		return d.pbr.ReadMsg(v.(proto.Message))
+		return n, err
+	}
+}
+
+func (d *protobufDecoder) lastRaw() []byte {
+	if r, ok := d.pbr.(pbio.RawReader); ok {
+		return r.LastMsg()
 	}
+	return nil
 }
+
+func (ProtobufCodec) contentType(v interface{}) string {
+	// The graph package's messages aren't registered with the proto
+	// package, but their Go type names match their proto names
+	// (e.g., graph.Def).
+	return fmt.Sprintf("application/x-protobuf; messageType=%q", reflect.TypeOf(v).Elem())
+}
+
+func (ProtobufCodec) marshal(v interface{}) ([]byte, error) { return proto.Marshal(v.(proto.Message)) }
+
+var (
+	_ rawCodec   = JSONCodec{}
+	_ rawCodec   = ProtobufCodec{}
+	_ rawDecoder = (*jsonDecoder)(nil)
+	_ rawDecoder = (*protobufDecoder)(nil)
+)
@@ -0,0 +1,472 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// CodecMigrationOptions configures MigrateCodec.
+type CodecMigrationOptions struct {
+	// Repos, if set, restricts the migration to these repos. By
+	// default, all repos in the store are migrated.
+	Repos []string
+
+	// KeepOld is whether to keep each tree's original files (in the
+	// repo's __codec_migration dir) after the tree's migration is
+	// verified. By default, they are removed.
+	KeepOld bool
+
+	// Log, if set, receives a line for each tree that is migrated or
+	// skipped.
+	Log *log.Logger
+}
+
+// CodecMigrationStats describes the result of MigrateCodec.
+type CodecMigrationStats struct {
+	Migrated []Version // trees that were migrated
+	Skipped  []Version // trees that were already migrated
+	Units    int       // number of source units migrated
+	Defs     int       // number of defs migrated
+	Refs     int       // number of refs migrated
+}
+
+// A codecMigrator is a store whose trees' data files can be rewritten
+// from one codec to another.
+type codecMigrator interface {
+	MultiRepoStore
+
+	// migrateTreeCodec rewrites the tree's data files from codec from
+	// to codec to. It returns whether the tree was already migrated.
+	migrateTreeCodec(repo, commitID string, from, to codec, keepOld bool, stats *CodecMigrationStats) (skipped bool, err error)
+
+	// recordedCodec returns the codec recorded in (or, if the store
+	// has no manifest, detected for) the store's manifest, or nil if
+	// none is recorded.
+	recordedCodec() (codec, error)
+
+	// setStoreCodec records c in the store's manifest as the codec of
+	// the store's data files, and uses c from then on.
+	setStoreCodec(c codec) error
+}
+
+// MigrateCodec rewrites the data files of the trees (versions) in mrs,
+// which must be a store returned by NewFSMultiRepoStore, from codec
+// from (e.g., JSONCodec{}) to codec to (e.g., ProtobufCodec{}), one
+// tree at a time. Afterwards, to is recorded in the store's manifest
+// (see StoreManifest), so the store is opened with it from then on. If
+// the migration is restricted to some repos, the manifest is left
+// unchanged, so the store can't be used until the rest of its repos are
+// migrated too.
+//
+// Each tree's original files are copied aside before the tree is
+// rewritten, and they are only removed after the rewritten tree's
+// source units, defs, refs, and scan results are verified to be equal
+// (record for record) to the original ones. If the rewrite or the
+// verification fails, the original files are restored. Indexes are
+// rebuilt (if the store is indexed) and tree signatures are removed
+// (because they cover the encoded data), so migrated trees must be
+// signed again.
+//
+// A tree with records that can't be decoded with from isn't migrated
+// (unlike queries, which skip corrupt records).
+//
+// Migrated trees are marked with their codec, so an interrupted
+// migration can be resumed by running MigrateCodec again: trees that
+// were already migrated are skipped, and a tree whose rewrite was
+// interrupted is restored from its original files and migrated again.
+//
+// Other stores (in this or other processes) must not read or write the
+// trees being migrated.
+func MigrateCodec(mrs MultiRepoStore, from, to codec, opt *CodecMigrationOptions) (*CodecMigrationStats, error) {
+	if opt == nil {
+		opt = &CodecMigrationOptions{}
+	}
+	m, ok := mrs.(codecMigrator)
+	if !ok {
+		return nil, fmt.Errorf("store %s does not support codec migration", mrs)
+	}
+	if from == to {
+		return nil, fmt.Errorf("codec migration: source and destination codecs are both %s", codecName(from))
+	}
+	if c, err := m.recordedCodec(); err != nil {
+		return nil, err
+	} else if c != nil && c != from && c != to {
+		return nil, fmt.Errorf("codec migration: store is encoded with codec %s, not %s", codecName(c), codecName(from))
+	}
+
+	var vf []VersionFilter
+	if len(opt.Repos) > 0 {
+		vf = append(vf, ByRepos(opt.Repos...))
+	}
+	versions, err := m.Versions(vf...)
+	if err != nil {
+		return nil, err
+	}
+	sortVersions(versions)
+
+	stats := &CodecMigrationStats{}
+	for _, v := range versions {
+		skipped, err := m.migrateTreeCodec(v.Repo, v.CommitID, from, to, opt.KeepOld, stats)
+		if err != nil {
+			return stats, fmt.Errorf("codec migration of %s@%s: %s", v.Repo, v.CommitID, err)
+		}
+		if skipped {
+			stats.Skipped = append(stats.Skipped, *v)
+			if opt.Log != nil {
+				opt.Log.Printf("Skipping %s@%s (already migrated to %s)", v.Repo, v.CommitID, codecName(to))
+			}
+			continue
+		}
+		stats.Migrated = append(stats.Migrated, *v)
+		if opt.Log != nil {
+			opt.Log.Printf("Migrated %s@%s from %s to %s", v.Repo, v.CommitID, codecName(from), codecName(to))
+		}
+	}
+	if len(opt.Repos) == 0 {
+		if err := m.setStoreCodec(to); err != nil {
+			return stats, fmt.Errorf("codec migration: recording codec %s in store manifest: %s", codecName(to), err)
+		}
+	}
+	return stats, nil
+}
+
+const (
+	// codecMigrationDir is the name of the dir (in a repo's dir) that
+	// holds the original files of trees being migrated by
+	// MigrateCodec, in a subdir for each tree.
+	codecMigrationDir = "__codec_migration"
+
+	// codecMigrationBackupComplete is the name of the file (in a
+	// tree's codec migration subdir) that is created once all of the
+	// tree's original files have been copied aside.
+	codecMigrationBackupComplete = "complete"
+
+	// codecMigrationBackupTree is the name of the dir (in a tree's
+	// codec migration subdir) that holds the tree's original files.
+	codecMigrationBackupTree = "tree"
+
+	// treeCodecFilename is the name of the file (in a tree's dir) that
+	// holds the name of the codec that a tree was migrated to by
+	// MigrateCodec.
+	treeCodecFilename = "codec"
+)
+
+// codecMigrationCarriedFiles are the files (in a tree's dir) that
+// aren't encoded with the codec or rebuilt from the tree's data, and
+// that are copied as-is to a migrated tree.
+var codecMigrationCarriedFiles = []string{lineTablesFilename, tokensFilename, deprecationsFilename}
+
+func (s *fsMultiRepoStore) migrateTreeCodec(repo, commitID string, from, to codec, keepOld bool, stats *CodecMigrationStats) (skipped bool, err error) {
+	defer s.wrote()
+	repo = graph.NormalizeRepoURI(repo)
+	rs := s.openRepoStore(repo).(*fsRepoStore)
+	vfs := rwvfs.Walkable(rs.fs)
+	backupDir := vfs.Join(codecMigrationDir, commitID)
+	backup := vfs.Join(backupDir, codecMigrationBackupTree)
+
+	if name, err := readTreeCodec(vfs, commitID); err != nil {
+		return false, err
+	} else if name == codecName(to) {
+		return true, nil
+	} else if name != "" && name != codecName(from) {
+		return false, fmt.Errorf("tree is encoded with codec %s, not %s", name, codecName(from))
+	}
+
+	// Recover from an interrupted migration of the tree. If its
+	// original files were completely copied aside, the tree may have
+	// been partially rewritten, so restore it. Otherwise the tree is
+	// intact, and the partial copy is discarded.
+	if _, err := vfs.Stat(vfs.Join(backupDir, codecMigrationBackupComplete)); err == nil {
+		if err := restoreCodecMigrationBackup(rs, commitID, backupDir); err != nil {
+			return false, fmt.Errorf("restoring tree from interrupted migration: %s", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	if err := removeTreeIfExists(vfs, backupDir); err != nil {
+		return false, err
+	}
+
+	// Shared (hard-linked) data files are replaced by the rewrite.
+	if err := s.unshareTree(repo, commitID); err != nil {
+		return false, err
+	}
+
+	if err := copyTree(vfs, commitID, backup); err != nil {
+		return false, err
+	}
+	if err := writeFile(vfs, vfs.Join(backupDir, codecMigrationBackupComplete), nil); err != nil {
+		return false, err
+	}
+
+	var treeStats CodecMigrationStats
+	err = rewriteTreeCodec(rs, commitID, backup, from, to, &treeStats)
+	if err == nil {
+		err = verifyTreeCodec(rs, commitID, backup, from, to)
+	}
+	if err == nil {
+		err = writeFile(vfs, vfs.Join(commitID, treeCodecFilename), []byte(codecName(to)))
+	}
+	if err != nil {
+		if err2 := restoreCodecMigrationBackup(rs, commitID, backupDir); err2 != nil {
+			return false, fmt.Errorf("%s (and restoring the original tree failed: %s; its original files are in %s)", err, err2, backupDir)
+		}
+		if err2 := removeTreeIfExists(vfs, backupDir); err2 != nil {
+			return false, fmt.Errorf("%s (and removing the original tree's copy failed: %s)", err, err2)
+		}
+		return false, err
+	}
+
+	if keepOld {
+		err = vfs.Remove(vfs.Join(backupDir, codecMigrationBackupComplete))
+	} else {
+		err = removeTree(vfs, backupDir)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	stats.Units += treeStats.Units
+	stats.Defs += treeStats.Defs
+	stats.Refs += treeStats.Refs
+	return false, s.UpdateUsage(repo, commitID)
+}
+
+// rewriteTreeCodec replaces the tree at commitID with the data of the
+// tree at backup (a path in rs's dir), decoded with codec from and
+// encoded with codec to.
+func rewriteTreeCodec(rs *fsRepoStore, commitID, backup string, from, to codec, stats *CodecMigrationStats) error {
+	rs = newFSRepoStoreWithSettings(rs.fs, rs.withCodec(to))
+	vfs := rwvfs.Walkable(rs.fs)
+	if err := removeTreeIfExists(vfs, commitID); err != nil {
+		return err
+	}
+	cacheRemove(rs.treeStoreFS(commitID).String()) // see fsRepoStore.newTreeStore
+	if err := rs.Import(commitID, nil, graph.Output{}); err != nil {
+		return err
+	}
+
+	src := newFSTreeStore(rwvfs.Sub(rs.fs, backup), rs.withCodec(from))
+	units, err := src.Units()
+	if err != nil {
+		return err
+	}
+	sortUnits(units)
+	for _, u := range units {
+		data, err := codecMigrationUnitData(src, u)
+		if err != nil {
+			return err
+		}
+		if err := rs.Import(commitID, u, data); err != nil {
+			return err
+		}
+		stats.Units++
+		stats.Defs += len(data.Defs)
+		stats.Refs += len(data.Refs)
+	}
+
+	scanned, err := src.ScannedUnits()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := newFSTreeStore(rs.treeStoreFS(commitID), rs.fsStoreSettings).ImportScan(scanned); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range codecMigrationCarriedFiles {
+		if err := copyFile(vfs, vfs.Join(backup, name), vfs.Join(commitID, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := rs.Index(commitID); err != nil {
+		return err
+	}
+	// The tree's version already exists, so finalize it again.
+	_, err = rs.WriteTreeManifest(commitID)
+	return err
+}
+
+// verifyTreeCodec checks that the data of the tree at commitID,
+// decoded with codec to, is equal to the data of the tree at backup,
+// decoded with codec from.
+func verifyTreeCodec(rs *fsRepoStore, commitID, backup string, from, to codec) error {
+	orig := newFSTreeStore(rwvfs.Sub(rs.fs, backup), rs.withCodec(from))
+	migrated := newFSTreeStore(rs.treeStoreFS(commitID), rs.withCodec(to))
+
+	read := func(ts *fsTreeStore) (units []*unit.SourceUnit, data map[unit.ID2]graph.Output, scanned []*unit.SourceUnit, err error) {
+		units, err = ts.Units()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		sortUnits(units)
+		data = make(map[unit.ID2]graph.Output, len(units))
+		for _, u := range units {
+			if data[u.ID2()], err = codecMigrationUnitData(ts, u); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+		scanned, err = ts.ScannedUnits()
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return units, data, scanned, err
+	}
+	origUnits, origData, origScanned, err := read(orig)
+	if err != nil {
+		return fmt.Errorf("verification: reading original tree: %s", err)
+	}
+	units, data, scanned, err := read(migrated)
+	if err != nil {
+		return fmt.Errorf("verification: reading migrated tree: %s", err)
+	}
+
+	if err := codecMigrationCompare("source units", origUnits, units); err != nil {
+		return err
+	}
+	if err := codecMigrationCompare("scanned source units", origScanned, scanned); err != nil {
+		return err
+	}
+	for _, u := range origUnits {
+		what := fmt.Sprintf("source unit %s %s", u.Type, u.Name)
+		if err := codecMigrationCompare(what+" defs", origData[u.ID2()].Defs, data[u.ID2()].Defs); err != nil {
+			return err
+		}
+		if err := codecMigrationCompare(what+" refs", origData[u.ID2()].Refs, data[u.ID2()].Refs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// codecMigrationUnitData reads the defs and refs of source unit u in
+// ts. Unlike queries, it returns an error if any of the records are
+// corrupt (instead of skipping them), so that data isn't lost (e.g.,
+// if the tree isn't encoded with ts's codec).
+func codecMigrationUnitData(ts *fsTreeStore, u *unit.SourceUnit) (graph.Output, error) {
+	skipped := c_fsUnitStore_corruptRecordsSkipped.get()
+	ufilter := ByUnits(u.ID2())
+	defs, err := ts.Defs(ufilter)
+	if err != nil {
+		return graph.Output{}, err
+	}
+	refs, err := ts.Refs(ufilter)
+	if err != nil {
+		return graph.Output{}, err
+	}
+	if n := c_fsUnitStore_corruptRecordsSkipped.get() - skipped; n > 0 {
+		return graph.Output{}, fmt.Errorf("source unit %s %s has %d corrupt records (is it encoded with codec %s?)", u.Type, u.Name, n, codecName(ts.codec()))
+	}
+	return graph.Output{Defs: defs, Refs: refs}, nil
+}
+
+// codecMigrationCompare returns an error unless the two slices (of
+// pointers to records) hold equal records, ignoring order. Records
+// are compared by their JSON encodings.
+func codecMigrationCompare(what string, orig, migrated interface{}) error {
+	origJSON, err := sortedJSONRecords(orig)
+	if err != nil {
+		return err
+	}
+	migratedJSON, err := sortedJSONRecords(migrated)
+	if err != nil {
+		return err
+	}
+	if len(origJSON) != len(migratedJSON) {
+		return fmt.Errorf("verification: migrated tree has %d %s, want %d", len(migratedJSON), what, len(origJSON))
+	}
+	for i := range origJSON {
+		if origJSON[i] != migratedJSON[i] {
+			return fmt.Errorf("verification: migrated tree's %s differ from the original ones (first difference: %s, want %s)", what, migratedJSON[i], origJSON[i])
+		}
+	}
+	return nil
+}
+
+func sortedJSONRecords(v interface{}) ([]string, error) {
+	var records []json.RawMessage
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &records); err != nil {
+		return nil, err
+	}
+	s := make([]string, len(records))
+	for i, r := range records {
+		s[i] = string(r)
+	}
+	sort.Strings(s)
+	return s, nil
+}
+
+// restoreCodecMigrationBackup replaces the tree with the original
+// files in backupDir.
+func restoreCodecMigrationBackup(rs *fsRepoStore, commitID, backupDir string) error {
+	vfs := rwvfs.Walkable(rs.fs)
+	if err := removeTreeIfExists(vfs, commitID); err != nil {
+		return err
+	}
+	cacheRemove(rs.treeStoreFS(commitID).String()) // see fsRepoStore.newTreeStore
+	return copyTree(vfs, vfs.Join(backupDir, codecMigrationBackupTree), commitID)
+}
+
+func (s *fsMultiRepoStore) recordedCodec() (codec, error) {
+	st, err := s.settings()
+	return st.dataCodec, err
+}
+
+func (s *fsMultiRepoStore) setStoreCodec(c codec) error {
+	s.manifestMu.Lock()
+	defer s.manifestMu.Unlock()
+	if err := s.writeStoreManifest(&StoreManifest{Codec: codecName(c)}); err != nil {
+		return err
+	}
+	s.dataCodec, s.codecKnown, s.manifestPending = c, true, false
+	return nil
+}
+
+// readTreeCodec returns the name of the codec that the tree was
+// migrated to, or "" if it was never migrated.
+func readTreeCodec(vfs rwvfs.WalkableFileSystem, tree string) (string, error) {
+	f, err := vfs.Open(vfs.Join(tree, treeCodecFilename))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	return string(b), err
+}
+
+func removeTreeIfExists(vfs rwvfs.WalkableFileSystem, dir string) error {
+	if _, err := vfs.Stat(dir); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return removeTree(vfs, dir)
+}
+
+func writeFile(vfs rwvfs.FileSystem, name string, data []byte) error {
+	f, err := vfs.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
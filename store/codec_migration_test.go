@@ -0,0 +1,134 @@
+package store
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestMigrateCodec(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+	defer func(c codec) { Codec = c }(Codec)
+
+	for _, indexed := range []bool{false, true} {
+		useIndexedStore = indexed
+		Codec = JSONCodec{}
+
+		fs := newTestFS()
+		mrs := NewFSMultiRepoStore(fs, nil)
+		for _, u := range []string{"u1", "u2"} {
+			data := graph.Output{
+				Defs: []*graph.Def{
+					{DefKey: graph.DefKey{Path: u + "/p1"}, Name: "Reader", Exported: true, File: u + "/f", DefStart: 1, DefEnd: 5},
+					{DefKey: graph.DefKey{Path: u + "/p2"}, Name: "Writer", Exported: true, File: u + "/f", DefStart: 7, DefEnd: 9},
+				},
+				Refs: []*graph.Ref{
+					{DefPath: u + "/p1", File: u + "/f", Start: 1, End: 5, Def: true},
+					{DefRepo: "r2", DefUnitType: "t", DefUnit: "u", DefPath: "x", File: u + "/f", Start: 11, End: 12},
+				},
+			}
+			if err := mrs.Import("r", "c", &unit.SourceUnit{Key: unit.Key{Type: "t", Name: u}, Info: unit.Info{Files: []string{u + "/f"}}}, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := mrs.(MultiRepoScanResults).ImportScan("r", "c", []*unit.SourceUnit{{Key: unit.Key{Type: "t", Name: "u3"}}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.Index("r", "c"); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.CreateVersion("r", "c"); err != nil {
+			t.Fatal(err)
+		}
+
+		query := func() (units []*unit.SourceUnit, defs []*graph.Def, refs []*graph.Ref, queried []*graph.Def) {
+			var err error
+			if units, err = mrs.Units(); err != nil {
+				t.Fatal(err)
+			}
+			if defs, err = mrs.Defs(); err != nil {
+				t.Fatal(err)
+			}
+			if refs, err = mrs.Refs(); err != nil {
+				t.Fatal(err)
+			}
+			if queried, err = mrs.Defs(ByDefQuery("writ")); err != nil {
+				t.Fatal(err)
+			}
+			sortUnits(units)
+			sort.Sort(graph.Defs(defs))
+			sort.Sort(refsByFileStartEnd(refs))
+			sort.Sort(graph.Defs(queried))
+			return
+		}
+		units, defs, refs, queried := query()
+		if len(queried) != 2 {
+			t.Fatalf("indexed=%v: got %d defs for query, want 2", indexed, len(queried))
+		}
+
+		// Migrating with the wrong source codec fails, and the tree is
+		// left intact.
+		if _, err := MigrateCodec(mrs, ProtobufCodec{}, JSONCodec{}, nil); err == nil {
+			t.Fatalf("indexed=%v: MigrateCodec from wrong codec: got nil error, want error", indexed)
+		}
+		if Codec != (JSONCodec{}) {
+			t.Errorf("indexed=%v: MigrateCodec did not restore Codec", indexed)
+		}
+		if units2, defs2, refs2, queried2 := query(); !reflect.DeepEqual(units2, units) || !reflect.DeepEqual(defs2, defs) || !reflect.DeepEqual(refs2, refs) || !reflect.DeepEqual(queried2, queried) {
+			t.Errorf("indexed=%v: after failed migration, data changed", indexed)
+		}
+
+		stats, err := MigrateCodec(mrs, JSONCodec{}, ProtobufCodec{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []Version{{Repo: "r", CommitID: "c"}}; !reflect.DeepEqual(stats.Migrated, want) {
+			t.Errorf("indexed=%v: got migrated %v, want %v", indexed, stats.Migrated, want)
+		}
+		if stats.Units != 2 || stats.Defs != 4 || stats.Refs != 4 {
+			t.Errorf("indexed=%v: got stats %+v, want 2 units, 4 defs, and 4 refs", indexed, stats)
+		}
+		if _, err := fs.Stat("r/.srclib-store/" + codecMigrationDir + "/c"); err == nil {
+			t.Errorf("indexed=%v: original tree was not removed", indexed)
+		}
+		if m, err := mrs.(MultiRepoStoreManifester).StoreManifest(); err != nil {
+			t.Fatal(err)
+		} else if m.Codec != "protobuf" {
+			t.Errorf("indexed=%v: after migration, got store manifest codec %q, want protobuf", indexed, m.Codec)
+		}
+
+		Codec = ProtobufCodec{}
+		units2, defs2, refs2, queried2 := query()
+		if !reflect.DeepEqual(units2, units) {
+			t.Errorf("indexed=%v: after migration, got units %v, want %v", indexed, units2, units)
+		}
+		if !reflect.DeepEqual(defs2, defs) {
+			t.Errorf("indexed=%v: after migration, got defs %v, want %v", indexed, defs2, defs)
+		}
+		if !reflect.DeepEqual(refs2, refs) {
+			t.Errorf("indexed=%v: after migration, got refs %v, want %v", indexed, refs2, refs)
+		}
+		if !reflect.DeepEqual(queried2, queried) {
+			t.Errorf("indexed=%v: after migration, got queried defs %v, want %v", indexed, queried2, queried)
+		}
+		scanned, err := mrs.(MultiRepoScanResults).ScannedUnits("r", "c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(scanned) != 1 || scanned[0].Name != "u3" {
+			t.Errorf("indexed=%v: after migration, got scanned units %v, want u3", indexed, scanned)
+		}
+
+		// Running the migration again skips the migrated tree.
+		stats, err = MigrateCodec(mrs, JSONCodec{}, ProtobufCodec{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stats.Migrated) != 0 || len(stats.Skipped) != 1 {
+			t.Errorf("indexed=%v: second migration: got stats %+v, want 1 skipped tree", indexed, stats)
+		}
+	}
+}
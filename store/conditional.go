@@ -0,0 +1,144 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// ErrNotModified is returned by a conditional query (see
+// ConditionalQuery) when the trees it covers have not changed since
+// the token it was given was issued.
+var ErrNotModified = errors.New("not modified")
+
+// A ConditionalQuery makes a query short-circuit (with ErrNotModified)
+// if the data it would read has not changed since a previous query.
+// This lets polling clients avoid repeating queries whose results
+// they already have.
+//
+// To make a conditional query, pass a *ConditionalQuery as one of the
+// query's filters. Stores that support conditional queries (such as
+// the store returned by NewFSMultiRepoStore) set Token to the current
+// token of the trees in the query's scope; if IfNoneMatch equals it,
+// they return ErrNotModified instead of performing the query. A
+// *ConditionalQuery implements all filter interfaces and selects
+// everything, so it may be passed to any store.
+type ConditionalQuery struct {
+	// IfNoneMatch is the Token from a previous query (or "" to always
+	// perform the query).
+	IfNoneMatch string
+
+	// Token is set by the store to the current token of the trees in
+	// the query's scope. It changes whenever data is imported into any
+	// of the trees or a version is added to or removed from the
+	// scope.
+	Token string
+}
+
+func (*ConditionalQuery) SelectDef(*graph.Def) bool        { return true }
+func (*ConditionalQuery) SelectRef(*graph.Ref) bool        { return true }
+func (*ConditionalQuery) SelectUnit(*unit.SourceUnit) bool { return true }
+func (*ConditionalQuery) SelectVersion(*Version) bool      { return true }
+func (*ConditionalQuery) SelectRepo(string) bool           { return true }
+func (q *ConditionalQuery) String() string                 { return fmt.Sprintf("ConditionalQuery(%+v)", *q) }
+
+// conditionalQueryFilters returns the *ConditionalQuery filters in
+// filters, and filters without them.
+func conditionalQueryFilters(filters []interface{}) (conds []*ConditionalQuery, others []interface{}) {
+	for _, f := range filters {
+		if c, ok := f.(*ConditionalQuery); ok {
+			conds = append(conds, c)
+		} else {
+			others = append(others, f)
+		}
+	}
+	return conds, others
+}
+
+// scopeToken returns the token of the trees (in s) in the scope of a
+// query with the given filters. It is a digest of the scope's versions
+// and their content digests.
+func scopeToken(s interface {
+	MultiRepoStore
+	MultiRepoContentDigester
+}, filters []interface{}) (string, error) {
+	var vf []VersionFilter
+	for _, f := range filters {
+		if f, ok := f.(VersionFilter); ok {
+			vf = append(vf, f)
+		}
+	}
+	versions, err := s.Versions(vf...)
+	if err != nil {
+		return "", err
+	}
+	sortVersions(versions)
+
+	h := sha256.New()
+	for _, v := range versions {
+		d, err := s.ContentDigest(v.Repo, v.CommitID)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%s\x00%s\n", v.Repo, v.CommitID, d)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkConditional evaluates the *ConditionalQuery filters (if any) in
+// filters against s. It returns the other filters (to pass on to the
+// underlying query), or ErrNotModified if any of the conditional
+// queries' IfNoneMatch tokens is current.
+func checkConditional(s interface {
+	MultiRepoStore
+	MultiRepoContentDigester
+}, filters interface{}) (interface{}, error) {
+	conds, others := conditionalQueryFilters(storeFilters(filters))
+	if len(conds) == 0 {
+		return filters, nil
+	}
+	token, err := scopeToken(s, others)
+	if err != nil {
+		return nil, err
+	}
+	notModified := false
+	for _, c := range conds {
+		c.Token = token
+		if c.IfNoneMatch == token {
+			notModified = true
+		}
+	}
+	if notModified {
+		return nil, ErrNotModified
+	}
+	return toTypedFilterSlice(reflect.TypeOf(filters), others), nil
+}
+
+func (s *fsMultiRepoStore) Units(f ...UnitFilter) ([]*unit.SourceUnit, error) {
+	fs, err := checkConditional(s, f)
+	if err != nil {
+		return nil, err
+	}
+	return s.repoStores.Units(fs.([]UnitFilter)...)
+}
+
+func (s *fsMultiRepoStore) Defs(f ...DefFilter) ([]*graph.Def, error) {
+	fs, err := checkConditional(s, f)
+	if err != nil {
+		return nil, err
+	}
+	return s.repoStores.Defs(fs.([]DefFilter)...)
+}
+
+func (s *fsMultiRepoStore) Refs(f ...RefFilter) ([]*graph.Ref, error) {
+	fs, err := checkConditional(s, f)
+	if err != nil {
+		return nil, err
+	}
+	return s.repoStores.Refs(fs.([]RefFilter)...)
+}
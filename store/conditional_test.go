@@ -0,0 +1,56 @@
+package store
+
+import "testing"
+
+func TestFSMultiRepoStore_ConditionalQuery(t *testing.T) {
+	mrs := NewFSMultiRepoStore(newTestFS(), nil)
+	testSyncImport(t, mrs, "r1", "c1", "u1")
+	testSyncImport(t, mrs, "r2", "c2", "u2")
+
+	cond := &ConditionalQuery{}
+	defs, err := mrs.Defs(ByRepos("r1"), cond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 1 {
+		t.Errorf("got %d defs, want 1", len(defs))
+	}
+	if cond.Token == "" {
+		t.Fatal("no token was set")
+	}
+	token := cond.Token
+
+	// Polling with the token short-circuits while the data is
+	// unchanged, even if other repos change.
+	testSyncImport(t, mrs, "r2", "c2", "u3")
+	for _, err := range []error{
+		func() error { _, err := mrs.Defs(ByRepos("r1"), &ConditionalQuery{IfNoneMatch: token}); return err }(),
+		func() error { _, err := mrs.Refs(ByRepos("r1"), &ConditionalQuery{IfNoneMatch: token}); return err }(),
+		func() error { _, err := mrs.Units(ByRepos("r1"), &ConditionalQuery{IfNoneMatch: token}); return err }(),
+	} {
+		if err != ErrNotModified {
+			t.Errorf("got error %v, want ErrNotModified", err)
+		}
+	}
+
+	// Changes to the data in the scope invalidate the token.
+	testSyncImport(t, mrs, "r1", "c1", "u2")
+	cond = &ConditionalQuery{IfNoneMatch: token}
+	defs, err = mrs.Defs(ByRepos("r1"), cond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 2 {
+		t.Errorf("got %d defs, want 2", len(defs))
+	}
+	if cond.Token == token {
+		t.Error("token did not change after import")
+	}
+
+	// So do new versions in the scope.
+	token = cond.Token
+	testSyncImport(t, mrs, "r1", "c3", "u1")
+	if _, err := mrs.Defs(ByRepos("r1"), &ConditionalQuery{IfNoneMatch: token}); err != nil {
+		t.Errorf("got error %v after adding a version, want nil", err)
+	}
+}
@@ -0,0 +1,90 @@
+package store
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+)
+
+// A TreeContentDigester computes a stable digest of a tree's content,
+// for use as a cache key (e.g., an HTTP ETag) that changes if and only
+// if the tree's imported data changes.
+type TreeContentDigester interface {
+	// ContentDigest returns the hex-encoded SHA-256 digest of the
+	// tree's imported data (see TreeSigning.TreeDigest). Because
+	// imports are deterministic, importing the same data again yields
+	// the same digest.
+	ContentDigest() (string, error)
+}
+
+// A RepoContentDigester computes content digests of a repo's trees.
+type RepoContentDigester interface {
+	ContentDigest(commitID string) (string, error)
+}
+
+// A MultiRepoContentDigester computes content digests of trees in
+// multiple repos.
+type MultiRepoContentDigester interface {
+	ContentDigest(repo, commitID string) (string, error)
+}
+
+// contentDigestFilename is the name of the file (in a tree's dir) that
+// caches the tree's content digest. It is removed whenever data is
+// imported into the tree.
+const contentDigestFilename = "content-digest"
+
+func (s *fsTreeStore) ContentDigest() (string, error) {
+	if f, err := s.fs.Open(contentDigestFilename); err == nil {
+		b, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	digest, err := s.TreeDigest()
+	if err != nil {
+		return "", err
+	}
+	d := hex.EncodeToString(digest)
+
+	// Cache the digest. If the store is read-only, the digest is
+	// recomputed each time.
+	if f, err := s.fs.Create(contentDigestFilename); err == nil {
+		_, err := f.Write([]byte(d))
+		if err2 := f.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			s.fs.Remove(contentDigestFilename)
+		}
+	}
+	return d, nil
+}
+
+// invalidateContentDigest removes the tree's cached content digest
+// (and its manifest, which would also be stale). It must be called
+// before the tree's imported data is modified.
+func (s *fsTreeStore) invalidateContentDigest() error {
+	if err := s.fs.Remove(contentDigestFilename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.removeTreeManifest()
+}
+
+func (s *fsRepoStore) ContentDigest(commitID string) (string, error) {
+	return s.newTreeStore(commitID).(TreeContentDigester).ContentDigest()
+}
+
+func (s *fsMultiRepoStore) ContentDigest(repo, commitID string) (string, error) {
+	return s.openRepoStore(repo).(RepoContentDigester).ContentDigest(commitID)
+}
+
+var (
+	_ TreeContentDigester      = (*fsTreeStore)(nil)
+	_ RepoContentDigester      = (*fsRepoStore)(nil)
+	_ MultiRepoContentDigester = (*fsMultiRepoStore)(nil)
+)
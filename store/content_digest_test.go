@@ -0,0 +1,57 @@
+package store
+
+import (
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestFSMultiRepoStore_ContentDigest(t *testing.T) {
+	mrs1 := NewFSMultiRepoStore(newTestFS(), nil)
+	mrs2 := NewFSMultiRepoStore(newTestFS(), nil)
+	testSyncImport(t, mrs1, "r", "c", "u1", "u2")
+	testSyncImport(t, mrs2, "r", "c", "u2", "u1")
+
+	d1, err := mrs1.(MultiRepoContentDigester).ContentDigest("r", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d1) != 64 {
+		t.Errorf("got digest %q, want 64 hex chars", d1)
+	}
+
+	// The same data yields the same digest, regardless of import
+	// order or whether the digest is cached or indexes are built.
+	if err := mrs2.Index("r", "c"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		d2, err := mrs2.(MultiRepoContentDigester).ContentDigest("r", "c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d2 != d1 {
+			t.Errorf("got digest %q, want %q", d2, d1)
+		}
+	}
+
+	// Importing different data changes the digest.
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u1"}}
+	if err := mrs2.Import("r", "c", u, graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p2"}}}}); err != nil {
+		t.Fatal(err)
+	}
+	d3, err := mrs2.(MultiRepoContentDigester).ContentDigest("r", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d3 == d1 {
+		t.Error("digest did not change after import")
+	}
+	if err := mrs1.(MultiRepoLineTables).ImportLineTables("r", "c", map[string]LineTable{"f": NewLineTable([]byte("a"))}); err != nil {
+		t.Fatal(err)
+	}
+	if d4, _ := mrs1.(MultiRepoContentDigester).ContentDigest("r", "c"); d4 == d1 {
+		t.Error("digest did not change after importing line tables")
+	}
+}
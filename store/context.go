@@ -0,0 +1,89 @@
+package store
+
+import (
+	"io"
+
+	"golang.org/x/net/context"
+	"golang.org/x/tools/godoc/vfs"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// WithContext returns a filter that binds a query to ctx. Once ctx is
+// done, the stores stop issuing reads of the query's data and index
+// files (and stop waiting on reads from VFSs that implement
+// ContextFetcherOpener), and the query fails with ctx's error. It
+// selects everything.
+//
+// Queries with a WithContext filter are never shared with other
+// queries (see NewSingleflightStore), so one caller's cancellation
+// doesn't fail another's query.
+func WithContext(ctx context.Context) interface {
+	DefFilter
+	RefFilter
+	UnitFilter
+	VersionFilter
+	RepoFilter
+} {
+	if ctx == nil {
+		panic("WithContext: nil context")
+	}
+	return contextFilter{ctx}
+}
+
+type contextFilter struct{ ctx context.Context }
+
+func (contextFilter) SelectDef(*graph.Def) bool        { return true }
+func (contextFilter) SelectRef(*graph.Ref) bool        { return true }
+func (contextFilter) SelectUnit(*unit.SourceUnit) bool { return true }
+func (contextFilter) SelectVersion(*Version) bool      { return true }
+func (contextFilter) SelectRepo(string) bool           { return true }
+func (contextFilter) String() string                   { return "WithContext" }
+
+// queryContext returns the context of the WithContext filter in
+// filters, or context.Background() if there is none.
+func queryContext(filters interface{}) context.Context {
+	for _, f := range storeFilters(filters) {
+		if f, ok := f.(contextFilter); ok {
+			return f.ctx
+		}
+	}
+	return context.Background()
+}
+
+// A ContextFetcherOpener is a VFS (typically one backed by a remote
+// service, such as S3) whose fetches can be bound to a context. Stores
+// use it instead of rwvfs.FetcherOpener (if the VFS implements both),
+// so that the fetches of a cancelled query are abandoned promptly.
+type ContextFetcherOpener interface {
+	// OpenFetcherContext is like rwvfs.FetcherOpener's OpenFetcher
+	// (and the returned file must implement rwvfs.Fetcher), except
+	// that once ctx is done, the file's in-flight and subsequent
+	// fetches and reads fail with ctx's error.
+	OpenFetcherContext(ctx context.Context, name string) (vfs.ReadSeekCloser, error)
+}
+
+// ctxReader is a reader whose reads fail with ctx's error once ctx is
+// done. It stops further reads from VFSs that can't abandon
+// in-flight reads.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// withContext returns r, with reads that fail once ctx is done (if ctx
+// can be done).
+func withContext(ctx context.Context, r io.Reader) io.Reader {
+	if ctx.Done() == nil {
+		return r
+	}
+	return &ctxReader{ctx: ctx, r: r}
+}
@@ -0,0 +1,103 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/tools/godoc/vfs"
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// blockingFetcherFS is a VFS whose fetches block until their context
+// is done.
+type blockingFetcherFS struct {
+	rwvfs.FileSystem
+}
+
+func (fs blockingFetcherFS) OpenFetcherContext(ctx context.Context, name string) (vfs.ReadSeekCloser, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &blockingFetcher{ReadSeekCloser: f, ctx: ctx}, nil
+}
+
+type blockingFetcher struct {
+	vfs.ReadSeekCloser
+	ctx context.Context
+}
+
+func (f *blockingFetcher) Fetch(start, end int64) error {
+	<-f.ctx.Done()
+	return f.ctx.Err()
+}
+
+func TestWithContext_cancelFetch(t *testing.T) {
+	us := &fsUnitStore{fs: blockingFetcherFS{newTestFS()}}
+	if err := us.Import(graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}}}}); err != nil {
+		t.Fatal(err)
+	}
+	_, ofs, err := us.readDefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	done := make(chan error)
+	go func() {
+		_, err := us.Defs(defOffsetsFilter(ofs), WithContext(ctx))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("got error %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("query did not stop after its context was cancelled")
+	}
+}
+
+func TestWithContext_cancelled(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+
+	for _, indexed := range []bool{false, true} {
+		useIndexedStore = indexed
+		mrs := NewFSMultiRepoStore(newTestFS(), nil)
+		data := graph.Output{
+			Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}}},
+			Refs: []*graph.Ref{{DefPath: "p", File: "f", Start: 1, End: 2}},
+		}
+		if err := mrs.Import("r", "c", &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}, Info: unit.Info{Files: []string{"f"}}}, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.CreateVersion("r", "c"); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.Index("r", "c"); err != nil {
+			t.Fatal(err)
+		}
+
+		if defs, err := mrs.Defs(ByDefPath("p"), WithContext(context.Background())); err != nil {
+			t.Fatal(err)
+		} else if len(defs) != 1 {
+			t.Errorf("indexed=%v: got defs %v, want 1", indexed, defs)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := mrs.Defs(WithContext(ctx)); err != context.Canceled {
+			t.Errorf("indexed=%v: Defs: got error %v, want %v", indexed, err, context.Canceled)
+		}
+		if _, err := mrs.Defs(ByDefPath("p"), WithContext(ctx)); err != context.Canceled {
+			t.Errorf("indexed=%v: Defs(ByDefPath): got error %v, want %v", indexed, err, context.Canceled)
+		}
+		if _, err := mrs.Refs(ByFiles(false, "f"), WithContext(ctx)); err != context.Canceled {
+			t.Errorf("indexed=%v: Refs: got error %v, want %v", indexed, err, context.Canceled)
+		}
+	}
+}
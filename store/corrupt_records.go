@@ -0,0 +1,205 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+
+	"golang.org/x/net/context"
+)
+
+// MaxRecordSize is the maximum size (in bytes) of a single encoded
+// def, ref, or source unit that the FS-backed stores decode. A record
+// whose length header exceeds it is treated as corrupt (see
+// RecordTooLargeError), so that a corrupt length header can't cause a
+// huge allocation. Like Codec, it should only be set at init time or
+// when you can guarantee that no stores will be reading data.
+//
+// The default is large enough for the source units of big repos
+// (whose records list all of their files).
+var MaxRecordSize = 16 * 1024 * 1024
+
+// A RecordTooLargeError is returned when the length header of a
+// record exceeds MaxRecordSize.
+type RecordTooLargeError struct {
+	Size uint64 // the length in the record's header
+	Max  int    // the value of MaxRecordSize
+}
+
+func (e *RecordTooLargeError) Error() string {
+	return fmt.Sprintf("record size %d exceeds the maximum of %d bytes (see MaxRecordSize)", e.Size, e.Max)
+}
+
+// A CorruptRecordError describes a record in a source unit's data
+// file that can't be decoded.
+//
+// When a query reads a corrupt record, the record is skipped (and a
+// warning is logged), so that one bad record doesn't make the whole
+// unit unreadable. Reads at index-provided offsets skip just the bad
+// record; scans resync to the next record using the unit's indexes
+// (which record the offsets of all records). A CorruptRecordError is
+// returned only if a scan can't resync because the unit has no such
+// index. (Parallel scans, see ScanWorkers, split the records using
+// their length headers, so they only need to resync if a length
+// header is corrupt.)
+type CorruptRecordError struct {
+	Store  string // the unit store (as returned by its String method)
+	File   string // the data file (e.g., "def.dat")
+	Offset int64  // the byte offset of the record in the data file
+	Err    error  // the decode error
+}
+
+func (e *CorruptRecordError) Error() string {
+	return fmt.Sprintf("corrupt record at offset %d in %s in %s: %s", e.Offset, e.File, e.Store, e.Err)
+}
+
+var c_fsUnitStore_corruptRecordsSkipped = &counter{count: new(int64)}
+
+// recordReader reads a data file and records the errors that reading
+// the file returns (other than io.EOF), so that decode errors caused
+// by reading (such as network errors) can be told apart from corrupt
+// records.
+type recordReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *recordReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// corruptRecord returns the error for a record in the named data file
+// at byte offset ofs that failed to decode with err. It returns a
+// *CorruptRecordError unless the error was caused by reading rr (or
+// the store's codec is unknown).
+func (s *fsUnitStore) corruptRecord(rr *recordReader, name string, ofs int64, err error) error {
+	if _, unknown := s.codec().(unknownCodec); unknown || rr.err != nil {
+		return err
+	}
+	return &CorruptRecordError{Store: s.String(), File: name, Offset: ofs, Err: err}
+}
+
+// skipCorruptRecord logs that the corrupt record described by err is
+// skipped.
+func skipCorruptRecord(err error) {
+	c_fsUnitStore_corruptRecordsSkipped.increment()
+	log.Printf("Warning: skipping %s.", err)
+}
+
+// resyncScan is called when a scan of the named data file (read
+// through rr) fails to decode the record at byte offset ofs with err.
+// If the record is corrupt, it skips the record and returns the data
+// file opened at the next record, along with that record's offset (or
+// a nil file if there are no more records). Otherwise, or if the scan
+// can't resync, it returns the error.
+func (s *fsUnitStore) resyncScan(rr *recordReader, name string, ofs int64, err error) (io.ReadCloser, int64, error) {
+	corruptErr := s.corruptRecord(rr, name, ofs, err)
+	if _, ok := corruptErr.(*CorruptRecordError); !ok {
+		return nil, 0, corruptErr
+	}
+	next, ok, err := s.nextRecordOffset(name, ofs, corruptErr)
+	if err != nil {
+		return nil, 0, err
+	}
+	skipCorruptRecord(corruptErr)
+	if !ok {
+		return nil, 0, nil
+	}
+	f, err := s.openAt(name, next)
+	if err != nil {
+		return nil, 0, err
+	}
+	return f, next, nil
+}
+
+// nextRecordOffset returns the byte offset of the first record after
+// the record at ofs in the named data file, using the offsets of all
+// of its records that are stored in the unit's indexes. It returns
+// false if there is no next record, and a *CorruptRecordError (err) if
+// the file's record offsets aren't indexed.
+func (s *fsUnitStore) nextRecordOffset(name string, ofs int64, err error) (int64, bool, error) {
+	offsets, err2 := s.recordOffsets(name)
+	if err2 != nil {
+		vlog.Printf("%s: can't resync after corrupt record: %s.", s, err2)
+		return 0, false, err
+	} else if offsets == nil {
+		return 0, false, err
+	}
+	i := sort.Search(len(offsets), func(i int) bool { return offsets[i] > ofs })
+	if i == len(offsets) {
+		return 0, false, nil
+	}
+	return offsets[i], true, nil
+}
+
+// recordOffsets returns the sorted byte offsets of all records in the
+// named data file, as stored in the unit's indexes. It returns nil if
+// they aren't indexed.
+func (s *fsUnitStore) recordOffsets(name string) ([]int64, error) {
+	var offsets []int64
+	switch name {
+	case unitDefsFilename:
+		x := &defPathIndex{}
+		if err := readIndex(s.fs, defPathIndexName, x); err != nil {
+			return nil, err
+		}
+		offsets = x.offsets()
+
+	case unitRefsFilename:
+		x := &refFileIndex{}
+		if err := readIndex(s.fs, "file_to_refs", x); err != nil {
+			return nil, err
+		}
+		brs, err := x.byteRanges()
+		if err != nil {
+			return nil, err
+		}
+		for _, br := range brs {
+			o := br.start()
+			for _, n := range br[1:] {
+				offsets = append(offsets, o)
+				o += n
+			}
+		}
+
+	default:
+		return nil, nil
+	}
+
+	sort.Sort(int64s(offsets))
+	return offsets, nil
+}
+
+type int64s []int64
+
+func (v int64s) Len() int           { return len(v) }
+func (v int64s) Less(i, j int) bool { return v[i] < v[j] }
+func (v int64s) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+
+// openAt opens the named data file for reading from byte offset ofs
+// to the end of the file (e.g., to resume a scan after a corrupt
+// record).
+func (s *fsUnitStore) openAt(name string, ofs int64) (io.ReadCloser, error) {
+	fi, err := s.fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	f, _, err := openForOffsets(context.Background(), s.fs, name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := rangeReader(context.Background(), s.fs, name, f, ofs, fi.Size()-ofs)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, f}, nil
+}
@@ -0,0 +1,136 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestCodec_maxRecordSize(t *testing.T) {
+	defer func(max int) { MaxRecordSize = max }(MaxRecordSize)
+
+	for _, c := range []codec{JSONCodec{}, ProtobufCodec{}} {
+		var buf bytes.Buffer
+		if _, err := c.NewEncoder(&buf).Encode(&graph.Def{DefKey: graph.DefKey{Path: "p"}, Name: "n"}); err != nil {
+			t.Fatal(err)
+		}
+		MaxRecordSize = 4
+		_, err := c.NewDecoder(&buf).Decode(&graph.Def{})
+		if err, ok := err.(*RecordTooLargeError); !ok || err.Max != 4 {
+			t.Errorf("%T: got error %v, want *RecordTooLargeError", c, err)
+		}
+	}
+}
+
+func TestFSUnitStore_corruptRecords(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+	defer func(c codec) { Codec = c }(Codec)
+	useIndexedStore = true
+	Codec = ProtobufCodec{}
+
+	vfs := newTestFS()
+	mrs := NewFSMultiRepoStore(vfs, nil).(*fsMultiRepoStore)
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}, Info: unit.Info{Files: []string{"f"}}}
+	var data graph.Output
+	for i := 0; i < 3; i++ {
+		data.Defs = append(data.Defs, &graph.Def{DefKey: graph.DefKey{Path: fmt.Sprintf("p%d", i)}, File: "f"})
+		data.Refs = append(data.Refs, &graph.Ref{DefPath: fmt.Sprintf("p%d", i), File: "f", Start: uint32(i), End: uint32(i + 1)})
+	}
+	if err := mrs.Import("r", "c", u, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := mrs.Index("r", "c"); err != nil {
+		t.Fatal(err)
+	}
+	unitFS := rwvfs.Sub(vfs, path.Join(mrs.repoPath("r"), "c", unitDataDir(u.ID2())))
+	us := &fsUnitStore{fs: unitFS, label: "test"}
+
+	// Corrupt the second def and ref by making their first field
+	// number 0 (which is illegal).
+	_, defOfs, err := us.readDefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, fbr, refOfs, err := us.readRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := func(name string, ofs int64) {
+		f, err := unitFS.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b[ofs+1] = 0 // after the 1-byte length header
+		w, err := unitFS.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	corrupt(unitDefsFilename, defOfs[1])
+	corrupt(unitRefsFilename, refOfs[1])
+
+	checkDefs := func(label string, defs []*graph.Def, err error, want ...string) {
+		if err != nil {
+			t.Errorf("%s: %s", label, err)
+			return
+		}
+		var paths []string
+		for _, def := range defs {
+			paths = append(paths, def.Path)
+		}
+		if fmt.Sprint(paths) != fmt.Sprint(want) {
+			t.Errorf("%s: got defs %v, want %v", label, paths, want)
+		}
+	}
+	checkRefs := func(label string, refs []*graph.Ref, err error, want int) {
+		if err != nil {
+			t.Errorf("%s: %s", label, err)
+			return
+		}
+		if len(refs) != want {
+			t.Errorf("%s: got %d refs, want %d", label, len(refs), want)
+		}
+	}
+
+	skipped := c_fsUnitStore_corruptRecordsSkipped.get()
+	defs, err := us.Defs()
+	checkDefs("scan", defs, err, "p0", "p2")
+	defs, err = us.Defs(defOffsetsFilter(defOfs))
+	checkDefs("offsets", defs, err, "p0", "p2")
+	refs, err := us.Refs()
+	checkRefs("scan", refs, err, 2)
+	refs, err = us.refsAtOffsets(refOfs, nil)
+	checkRefs("offsets", refs, err, 2)
+	refs, err = us.refsAtByteRanges([]byteRanges{fbr["f"]}, nil)
+	checkRefs("byte ranges", refs, err, 2)
+	if n := c_fsUnitStore_corruptRecordsSkipped.get() - skipped; n != 5 {
+		t.Errorf("got %d corrupt records skipped, want 5", n)
+	}
+
+	// Scans can't resync without the indexes that store the offsets
+	// of all records.
+	if err := unitFS.Remove(fmt.Sprintf(indexFilename, defPathIndexName)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = us.Defs()
+	if err, ok := err.(*CorruptRecordError); !ok || err.File != unitDefsFilename || err.Offset != defOfs[1] {
+		t.Errorf("without index: got error %v, want *CorruptRecordError at offset %d", err, defOfs[1])
+	}
+}
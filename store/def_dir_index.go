@@ -0,0 +1,219 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/alecthomas/binary"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/store/phtable"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// defDirTreeIndex makes it fast to list the defs (in all of a tree's
+// source units) that are defined in the files of a directory (see
+// ByDirs), e.g., to browse a package or namespace. Without it, such
+// queries must check the files of the defs of every source unit that
+// has files in the directory.
+type defDirTreeIndex struct {
+	units   []unit.ID2   // indexed by the unit numbers in the phtable's values
+	phtable *phtable.CHD // dir -> binary-encoded []unitOffsets
+	ready   bool
+	sync.RWMutex
+}
+
+var _ interface {
+	Index
+	persistedIndex
+	defNameTreeIndexBuilder
+	defTreeIndex
+} = (*defDirTreeIndex)(nil)
+
+const defDirTreeIndexName = "def_dir_to_units"
+
+var c_defDirTreeIndex_getByDir = &counter{count: new(int64)}
+
+func (x *defDirTreeIndex) String() string {
+	return fmt.Sprintf("defDirTreeIndex(ready=%v)", x.ready)
+}
+
+// defDir returns the directory of the file that def is defined in,
+// or "" if def has no file.
+func defDir(def *graph.Def) string {
+	if def.File == "" {
+		return ""
+	}
+	return path.Dir(def.File)
+}
+
+// getByDir returns the byte offsets of the defs in dir's files in
+// each unit.
+func (x *defDirTreeIndex) getByDir(dir string) (map[unit.ID2]byteOffsets, error) {
+	vlog.Printf("defDirTreeIndex.getByDir(%q)", dir)
+	c_defDirTreeIndex_getByDir.increment()
+
+	if x.phtable == nil {
+		panic("phtable not built/read")
+	}
+	v := x.phtable.Get([]byte(dir))
+	if v == nil {
+		return nil, nil
+	}
+	var uoffss []unitOffsets
+	if err := binary.Unmarshal(v, &uoffss); err != nil {
+		return nil, err
+	}
+	uofMap := make(map[unit.ID2]byteOffsets, len(uoffss))
+	for _, uofs := range uoffss {
+		if int(uofs.Unit) >= len(x.units) {
+			return nil, fmt.Errorf("def dir index refers to unit %d, but it only has %d units", uofs.Unit, len(x.units))
+		}
+		u := x.units[uofs.Unit]
+		uofMap[u] = append(uofMap[u], uofs.byteOffsets...)
+	}
+	return uofMap, nil
+}
+
+// Covers implements defTreeIndex.
+func (x *defDirTreeIndex) Covers(filters interface{}) int {
+	cov := 0
+	for _, f := range storeFilters(filters) {
+		if _, ok := f.(ByDirsFilter); ok {
+			cov++
+		}
+	}
+	return cov
+}
+
+// Defs implements defTreeIndex.
+func (x *defDirTreeIndex) Defs(f ...DefFilter) (map[unit.ID2]byteOffsets, error) {
+	x.RLock()
+	defer x.RUnlock()
+	for _, ff := range f {
+		if df, ok := ff.(ByDirsFilter); ok {
+			uofMap := map[unit.ID2]byteOffsets{}
+			for _, dir := range df.ByDirs() {
+				dirUOfMap, err := x.getByDir(dir)
+				if err != nil {
+					return nil, err
+				}
+				for u, ofs := range dirUOfMap {
+					uofMap[u] = append(uofMap[u], ofs...)
+				}
+			}
+			return uofMap, nil
+		}
+	}
+	return nil, nil
+}
+
+// Build implements defNameTreeIndexBuilder (whose Build method has
+// the same signature).
+func (x *defDirTreeIndex) Build(units []*unit.SourceUnit, readDefs func(unit.ID2) ([]*graph.Def, byteOffsets, error)) error {
+	x.Lock()
+	defer x.Unlock()
+	vlog.Printf("defDirTreeIndex: building index... (%d units)", len(units))
+
+	unitIDs := make([]unit.ID2, len(units))
+	for i, u := range units {
+		unitIDs[i] = u.ID2()
+	}
+	sort.Sort(unitID2s(unitIDs))
+
+	const maxUnits = math.MaxUint16
+	if len(unitIDs) > maxUnits {
+		log.Printf("Warning: the def dir index supports a maximum of %d source units in a tree, but this tree has %d. Source units that exceed the limit will not be indexed for dir listings.", maxUnits, len(unitIDs))
+		unitIDs = unitIDs[:maxUnits]
+	}
+
+	dirToUOffs := map[string][]unitOffsets{}
+	for i, u := range unitIDs {
+		defs, ofs, err := readDefs(u)
+		if err != nil {
+			return err
+		}
+		unitDirOfs := map[string]byteOffsets{}
+		for j, def := range defs {
+			if dir := defDir(def); dir != "" {
+				unitDirOfs[dir] = append(unitDirOfs[dir], ofs[j])
+			}
+		}
+		for dir, ofs := range unitDirOfs {
+			dirToUOffs[dir] = append(dirToUOffs[dir], unitOffsets{Unit: uint16(i), byteOffsets: ofs})
+		}
+	}
+
+	vlog.Printf("defDirTreeIndex: adding %d index phtable keys...", len(dirToUOffs))
+	b := phtable.Builder(len(dirToUOffs))
+	for dir, uoffss := range dirToUOffs {
+		v, err := binary.Marshal(uoffss)
+		if err != nil {
+			return err
+		}
+		b.Add([]byte(dir), v)
+	}
+	h, err := b.Build()
+	if err != nil {
+		return err
+	}
+	// Store the keys so that lookups of dirs that aren't in the index
+	// can't return another dir's defs.
+	h.StoreKeys = true
+	x.units = unitIDs
+	x.phtable = h
+	x.ready = true
+	vlog.Printf("defDirTreeIndex: done building index (%d dirs).", len(dirToUOffs))
+	return nil
+}
+
+// Write implements persistedIndex. The index is serialized in the
+// same form as a defNameTreeIndex.
+func (x *defDirTreeIndex) Write(w io.Writer) error {
+	x.RLock()
+	defer x.RUnlock()
+	if x.phtable == nil {
+		panic("no phtable to write")
+	}
+	var buf bytes.Buffer
+	if err := x.phtable.Write(&buf); err != nil {
+		return err
+	}
+	b, err := binary.Marshal(&defNameTable{Units: x.units, B: buf.Bytes()})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// Read implements persistedIndex.
+func (x *defDirTreeIndex) Read(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	x.Lock()
+	defer x.Unlock()
+	var t defNameTable
+	if err = binary.Unmarshal(b, &t); err == nil {
+		x.units = t.Units
+		x.phtable, err = phtable.Read(bytes.NewReader(t.B))
+	}
+	x.ready = (err == nil)
+	return err
+}
+
+// Ready implements persistedIndex.
+func (x *defDirTreeIndex) Ready() bool {
+	x.RLock()
+	defer x.RUnlock()
+	return x.ready
+}
@@ -0,0 +1,68 @@
+package store
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestByDirs(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+
+	fileDef := func(path, file string) *graph.Def {
+		return &graph.Def{DefKey: graph.DefKey{Path: path}, Name: path, File: file}
+	}
+	unitData := map[string]graph.Output{
+		"u1": {Defs: []*graph.Def{fileDef("a", "a/a.go"), fileDef("ab", "a/b/b.go"), fileDef("root", "root.go")}},
+		"u2": {Defs: []*graph.Def{fileDef("a2", "a/a2.go"), fileDef("c", "c/c.go"), fileDef("nofile", "")}},
+	}
+
+	tests := []struct {
+		dirs []string
+		want []string
+	}{
+		{[]string{"a"}, []string{"a", "a2"}},
+		{[]string{"a/"}, []string{"a", "a2"}},
+		{[]string{"a/b"}, []string{"ab"}},
+		{[]string{"."}, []string{"root"}},
+		{[]string{"a/b", "c"}, []string{"ab", "c"}},
+		{[]string{"b"}, nil},
+	}
+	for _, indexed := range []bool{false, true} {
+		useIndexedStore = indexed
+		mrs := NewFSMultiRepoStore(newTestFS(), nil)
+		for name, data := range unitData {
+			if err := mrs.Import("r", "c", &unit.SourceUnit{Key: unit.Key{Type: "t", Name: name}}, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := mrs.CreateVersion("r", "c"); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.Index("r", "c"); err != nil {
+			t.Fatal(err)
+		}
+
+		c_defDirTreeIndex_getByDir.set(0)
+		for _, test := range tests {
+			defs, err := mrs.Defs(ByRepos("r"), ByDirs(test.dirs...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, def := range defs {
+				got = append(got, def.Path)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("indexed=%v %v: got defs %v, want %v", indexed, test.dirs, got, test.want)
+			}
+		}
+		if got := c_defDirTreeIndex_getByDir.get(); (got > 0) != indexed {
+			t.Errorf("indexed=%v: got %d def dir index lookups", indexed, got)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+// A MatchRange is the range [Start, End) of byte offsets in a string
+// that matched a query.
+type MatchRange struct {
+	Start, End int
+}
+
+// DefMatches records which characters of each def's name matched the
+// query of a ByDefQueryMatches filter, so that UIs can highlight the
+// matches in search results without re-matching the query themselves.
+// It is safe for concurrent use.
+type DefMatches struct {
+	mu sync.Mutex
+
+	// indexMatchLen is the number of runes (of the query) that the
+	// def query index matched during its traversal, or -1 if no index
+	// was used.
+	indexMatchLen int
+
+	byDef map[*graph.Def][]MatchRange
+}
+
+// Get returns the ranges of def's name that matched the query, or nil
+// if def was not in the query's results. Defs are compared by
+// identity, so def must be one of the (unmodified) *graph.Def values
+// returned by the query.
+func (m *DefMatches) Get(def *graph.Def) []MatchRange {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.byDef[def]
+}
+
+func (m *DefMatches) add(def *graph.Def, r []MatchRange) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.byDef == nil {
+		m.byDef = map[*graph.Def][]MatchRange{}
+	}
+	m.byDef[def] = r
+}
+
+// ByDefQueryMatches is like ByDefQuery, but it also records the
+// ranges of the names of the selected defs that matched q in m. If a
+// def query index is used to satisfy the query, the ranges are
+// computed from the index traversal. It panics if q is empty or m is
+// nil.
+func ByDefQueryMatches(q string, m *DefMatches) interface {
+	DefFilter
+	ByDefQueryFilter
+} {
+	if q == "" {
+		panic("ByDefQueryMatches: empty")
+	}
+	if m == nil {
+		panic("ByDefQueryMatches: nil DefMatches")
+	}
+	m.mu.Lock()
+	m.indexMatchLen = -1
+	m.mu.Unlock()
+	return &byDefQueryMatchesFilter{q: q, m: m}
+}
+
+// defQueryTraversalRecorder is implemented by def query filters that
+// want to know the result of a def query index traversal.
+type defQueryTraversalRecorder interface {
+	// recordTraversal records that the index matched the first n
+	// runes of each def name it returned.
+	recordTraversal(n int)
+}
+
+type byDefQueryMatchesFilter struct {
+	q string
+	m *DefMatches
+}
+
+func (f *byDefQueryMatchesFilter) String() string {
+	return fmt.Sprintf("ByDefQueryMatches(%q)", f.q)
+}
+func (f *byDefQueryMatchesFilter) ByDefQuery() string { return f.q }
+
+func (f *byDefQueryMatchesFilter) recordsDefState() {}
+
+func (f *byDefQueryMatchesFilter) recordTraversal(n int) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	f.m.indexMatchLen = n
+}
+
+func (f *byDefQueryMatchesFilter) SelectDef(def *graph.Def) bool {
+	f.m.mu.Lock()
+	n := f.m.indexMatchLen
+	f.m.mu.Unlock()
+
+	// Defs are always checked here, even if an index was used, because
+	// not all of the units in a query's scope are necessarily indexed.
+	if !byDefQueryFilter(f.q).SelectDef(def) {
+		return false
+	}
+	if n == -1 {
+		n = utf8.RuneCountInString(strings.ToLower(f.q))
+	}
+	f.m.add(def, []MatchRange{{Start: 0, End: runeByteOffset(def.Name, n)}})
+	return true
+}
+
+// runeByteOffset returns the byte offset of the nth rune in s (or
+// len(s) if s has fewer than n runes).
+func runeByteOffset(s string, n int) int {
+	for i := range s {
+		if n == 0 {
+			return i
+		}
+		n--
+	}
+	return len(s)
+}
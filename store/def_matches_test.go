@@ -0,0 +1,84 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestByDefQueryMatches(t *testing.T) {
+	defer func(n int) { ScanWorkers = n }(ScanWorkers)
+	for _, indexed := range []bool{false, true} {
+		useIndexedStore = indexed
+		var ts TreeStoreImporter = newFSTreeStore(newTestFS(), fsStoreSettings{})
+		if indexed {
+			ts = newIndexedTreeStore(newTestFS(), "test", fsStoreSettings{})
+		}
+		u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
+		data := graph.Output{Defs: []*graph.Def{
+			{DefKey: graph.DefKey{Path: "p1"}, Name: "FooBar"},
+			{DefKey: graph.DefKey{Path: "p2"}, Name: "Ünïcode"},
+			{DefKey: graph.DefKey{Path: "p3"}, Name: "Other"},
+		}}
+		if err := ts.Import(u, data); err != nil {
+			t.Fatal(err)
+		}
+		if indexed {
+			if err := ts.(TreeIndexer).Index(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var m DefMatches
+		defs, err := ts.Defs(ByDefQueryMatches("foob", &m))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(defs) != 1 {
+			t.Fatalf("indexed=%v: got %d defs, want 1", indexed, len(defs))
+		}
+		if got, want := m.Get(defs[0]), []MatchRange{{0, 4}}; !reflect.DeepEqual(got, want) {
+			t.Errorf("indexed=%v: got matches %v, want %v", indexed, got, want)
+		}
+		if usedIndex := m.indexMatchLen != -1; usedIndex != indexed {
+			t.Errorf("indexed=%v: got usedIndex == %v", indexed, usedIndex)
+		}
+		if got := m.Get(&graph.Def{DefKey: graph.DefKey{Path: "p3"}}); got != nil {
+			t.Errorf("indexed=%v: got matches %v for unselected def, want none", indexed, got)
+		}
+
+		// The matches are recorded for the defs that are returned when
+		// they are allocated in an arena.
+		for _, workers := range []int{1, 4} {
+			ScanWorkers = workers
+			a := NewArena()
+			var m DefMatches
+			defs, err := ts.Defs(ByDefQueryMatches("foob", &m), a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(defs) != 1 {
+				t.Fatalf("indexed=%v ScanWorkers=%d arena: got %d defs, want 1", indexed, workers, len(defs))
+			}
+			if got, want := m.Get(defs[0]), []MatchRange{{0, 4}}; !reflect.DeepEqual(got, want) {
+				t.Errorf("indexed=%v ScanWorkers=%d arena: got matches %v, want %v", indexed, workers, got, want)
+			}
+			if got := (len(a.defs)-1)*arenaBlockSize + a.ndefs; got != 1 {
+				t.Errorf("indexed=%v ScanWorkers=%d arena: %d defs allocated in arena, want 1", indexed, workers, got)
+			}
+			a.Release()
+		}
+	}
+
+	// Match ranges are byte offsets.
+	var m DefMatches
+	def := &graph.Def{Name: "Ünïcode"}
+	if !ByDefQueryMatches("üNï", &m).SelectDef(def) {
+		t.Fatal("def not selected")
+	}
+	if got, want := m.Get(def), []MatchRange{{0, len("Ünï")}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got matches %v, want %v", got, want)
+	}
+}
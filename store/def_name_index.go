@@ -0,0 +1,203 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/alecthomas/binary"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/store/phtable"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// defNameTreeIndex makes it fast to find the defs (in all of a tree's
+// source units) with an exact name (see ByDefName). Unlike the def
+// query indexes, it maps a name directly to the byte offsets of the
+// defs in each unit, so a lookup needs neither a MAFSA traversal nor
+// a lookup in each unit's index.
+type defNameTreeIndex struct {
+	units   []unit.ID2   // indexed by the unit numbers in the phtable's values
+	phtable *phtable.CHD // def name -> binary-encoded []unitOffsets
+	ready   bool
+	sync.RWMutex
+}
+
+var _ interface {
+	Index
+	persistedIndex
+	defNameTreeIndexBuilder
+	defTreeIndex
+} = (*defNameTreeIndex)(nil)
+
+const defNameTreeIndexName = "def_name_to_units"
+
+var c_defNameTreeIndex_getByName = &counter{count: new(int64)}
+
+func (x *defNameTreeIndex) String() string {
+	return fmt.Sprintf("defNameTreeIndex(ready=%v)", x.ready)
+}
+
+// getByName returns the byte offsets of the defs named name in each
+// unit.
+func (x *defNameTreeIndex) getByName(name string) (map[unit.ID2]byteOffsets, error) {
+	vlog.Printf("defNameTreeIndex.getByName(%q)", name)
+	c_defNameTreeIndex_getByName.increment()
+
+	if x.phtable == nil {
+		panic("phtable not built/read")
+	}
+	v := x.phtable.Get([]byte(name))
+	if v == nil {
+		return nil, nil
+	}
+	var uoffss []unitOffsets
+	if err := binary.Unmarshal(v, &uoffss); err != nil {
+		return nil, err
+	}
+	uofMap := make(map[unit.ID2]byteOffsets, len(uoffss))
+	for _, uofs := range uoffss {
+		if int(uofs.Unit) >= len(x.units) {
+			return nil, fmt.Errorf("def name index refers to unit %d, but it only has %d units", uofs.Unit, len(x.units))
+		}
+		u := x.units[uofs.Unit]
+		uofMap[u] = append(uofMap[u], uofs.byteOffsets...)
+	}
+	return uofMap, nil
+}
+
+// Covers implements defTreeIndex.
+func (x *defNameTreeIndex) Covers(filters interface{}) int {
+	cov := 0
+	for _, f := range storeFilters(filters) {
+		if _, ok := f.(ByDefNameFilter); ok {
+			cov++
+		}
+	}
+	return cov
+}
+
+// Defs implements defTreeIndex.
+func (x *defNameTreeIndex) Defs(f ...DefFilter) (map[unit.ID2]byteOffsets, error) {
+	x.RLock()
+	defer x.RUnlock()
+	for _, ff := range f {
+		if nf, ok := ff.(ByDefNameFilter); ok {
+			return x.getByName(nf.ByDefName())
+		}
+	}
+	return nil, nil
+}
+
+// Build implements defNameTreeIndexBuilder.
+func (x *defNameTreeIndex) Build(units []*unit.SourceUnit, readDefs func(unit.ID2) ([]*graph.Def, byteOffsets, error)) error {
+	x.Lock()
+	defer x.Unlock()
+	vlog.Printf("defNameTreeIndex: building index... (%d units)", len(units))
+
+	unitIDs := make([]unit.ID2, len(units))
+	for i, u := range units {
+		unitIDs[i] = u.ID2()
+	}
+	sort.Sort(unitID2s(unitIDs))
+
+	const maxUnits = math.MaxUint16
+	if len(unitIDs) > maxUnits {
+		log.Printf("Warning: the def name index supports a maximum of %d source units in a tree, but this tree has %d. Source units that exceed the limit will not be indexed for def name lookups.", maxUnits, len(unitIDs))
+		unitIDs = unitIDs[:maxUnits]
+	}
+
+	nameToUOffs := map[string][]unitOffsets{}
+	for i, u := range unitIDs {
+		defs, ofs, err := readDefs(u)
+		if err != nil {
+			return err
+		}
+		unitNameOfs := map[string]byteOffsets{}
+		for j, def := range defs {
+			if def.Name != "" {
+				unitNameOfs[def.Name] = append(unitNameOfs[def.Name], ofs[j])
+			}
+		}
+		for name, ofs := range unitNameOfs {
+			nameToUOffs[name] = append(nameToUOffs[name], unitOffsets{Unit: uint16(i), byteOffsets: ofs})
+		}
+	}
+
+	vlog.Printf("defNameTreeIndex: adding %d index phtable keys...", len(nameToUOffs))
+	b := phtable.Builder(len(nameToUOffs))
+	for name, uoffss := range nameToUOffs {
+		v, err := binary.Marshal(uoffss)
+		if err != nil {
+			return err
+		}
+		b.Add([]byte(name), v)
+	}
+	h, err := b.Build()
+	if err != nil {
+		return err
+	}
+	// Store the keys so that lookups of names that aren't in the index
+	// can't return another name's defs.
+	h.StoreKeys = true
+	x.units = unitIDs
+	x.phtable = h
+	x.ready = true
+	vlog.Printf("defNameTreeIndex: done building index (%d names).", len(nameToUOffs))
+	return nil
+}
+
+// defNameTable is the serialized form of a defNameTreeIndex.
+type defNameTable struct {
+	Units []unit.ID2
+	B     []byte // the serialized phtable
+}
+
+// Write implements persistedIndex.
+func (x *defNameTreeIndex) Write(w io.Writer) error {
+	x.RLock()
+	defer x.RUnlock()
+	if x.phtable == nil {
+		panic("no phtable to write")
+	}
+	var buf bytes.Buffer
+	if err := x.phtable.Write(&buf); err != nil {
+		return err
+	}
+	b, err := binary.Marshal(&defNameTable{Units: x.units, B: buf.Bytes()})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// Read implements persistedIndex.
+func (x *defNameTreeIndex) Read(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	x.Lock()
+	defer x.Unlock()
+	var t defNameTable
+	if err = binary.Unmarshal(b, &t); err == nil {
+		x.units = t.Units
+		x.phtable, err = phtable.Read(bytes.NewReader(t.B))
+	}
+	x.ready = (err == nil)
+	return err
+}
+
+// Ready implements persistedIndex.
+func (x *defNameTreeIndex) Ready() bool {
+	x.RLock()
+	defer x.RUnlock()
+	return x.ready
+}
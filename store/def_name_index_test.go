@@ -0,0 +1,69 @@
+package store
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestByDefName(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+
+	namedDef := func(path, name string) *graph.Def {
+		return &graph.Def{DefKey: graph.DefKey{Path: path}, Name: name}
+	}
+	unitData := map[string]graph.Output{
+		"u1": {Defs: []*graph.Def{namedDef("a/Foo", "Foo"), namedDef("a/foo", "foo"), namedDef("a/FooBar", "FooBar")}},
+		"u2": {Defs: []*graph.Def{namedDef("b/Foo", "Foo"), namedDef("b/Bar", "Bar")}},
+	}
+
+	tests := map[string][]string{
+		"Foo":    {"a/Foo", "b/Foo"},
+		"foo":    {"a/foo"},
+		"FooBar": {"a/FooBar"},
+		"Bar":    {"b/Bar"},
+		"Fo":     nil,
+		"Baz":    nil,
+	}
+	for _, indexed := range []bool{false, true} {
+		useIndexedStore = indexed
+		mrs := NewFSMultiRepoStore(newTestFS(), nil)
+		for name, data := range unitData {
+			if err := mrs.Import("r", "c", &unit.SourceUnit{Key: unit.Key{Type: "t", Name: name}}, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := mrs.CreateVersion("r", "c"); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.Index("r", "c"); err != nil {
+			t.Fatal(err)
+		}
+
+		c_defNameTreeIndex_getByName.set(0)
+		c_defQueryIndex_getByQuery.set(0)
+		for name, want := range tests {
+			defs, err := mrs.Defs(ByRepos("r"), ByDefName(name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, def := range defs {
+				got = append(got, def.Path)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("indexed=%v %q: got defs %v, want %v", indexed, name, got, want)
+			}
+		}
+		if got := c_defNameTreeIndex_getByName.get(); (got > 0) != indexed {
+			t.Errorf("indexed=%v: got %d def name index lookups", indexed, got)
+		}
+		if got := c_defQueryIndex_getByQuery.get(); got != 0 {
+			t.Errorf("indexed=%v: got %d unit def query index lookups, want 0", indexed, got)
+		}
+	}
+}
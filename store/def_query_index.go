@@ -77,16 +77,42 @@ func (x *defQueryIndex) Defs(f ...DefFilter) (byteOffsets, error) {
 	defer x.RUnlock()
 	for _, ff := range f {
 		if pf, ok := ff.(ByDefQueryFilter); ok {
+			if a, ok := ff.(defQueryAlternatives); ok {
+				return x.getByQueries(a.defQueryAlternatives()), nil
+			}
 			ofs, found := x.getByQuery(pf.ByDefQuery())
 			if !found {
+				if sg, ok := ff.(defQuerySuggester); ok {
+					sg.suggest(x.mt.t)
+				}
 				return nil, nil
 			}
+			if r, ok := ff.(defQueryTraversalRecorder); ok {
+				r.recordTraversal(len([]rune(strings.ToLower(pf.ByDefQuery()))))
+			}
 			return ofs, nil
 		}
 	}
 	return nil, nil
 }
 
+// getByQueries returns the union of getByQuery's results for each of
+// qs.
+func (x *defQueryIndex) getByQueries(qs []string) byteOffsets {
+	var ofs byteOffsets
+	seen := map[int64]struct{}{}
+	for _, q := range qs {
+		qofs, _ := x.getByQuery(q)
+		for _, o := range qofs {
+			if _, present := seen[o]; !present {
+				seen[o] = struct{}{}
+				ofs = append(ofs, o)
+			}
+		}
+	}
+	return ofs
+}
+
 type defLowerNameAndOffset struct {
 	lowerName string
 	ofs       int64
@@ -208,18 +234,7 @@ func (x *defQueryIndex) Fprint(w io.Writer) error {
 		panic("mafsaTable not built/read")
 	}
 
-	allTerms := make([]string, 0, len(x.mt.Values))
-	var getAllTerms func(term string, n *mafsa.MinTreeNode)
-	getAllTerms = func(term string, n *mafsa.MinTreeNode) {
-		if n.Final {
-			allTerms = append(allTerms, term)
-		}
-		for _, c := range n.OrderedEdges() {
-			getAllTerms(term+string([]rune{c}), n.Edges[c])
-		}
-	}
-
-	getAllTerms("", x.mt.t.Root)
+	allTerms := mafsaTerms(x.mt.t)
 	fmt.Fprintln(w, "Terms")
 	for i, term := range allTerms {
 		fmt.Fprintf(w, "  %d - %q\n", i, term)
@@ -71,6 +71,28 @@ func (x *defQueryTreeIndex) getByQuery(q string) (map[unit.ID2]byteOffsets, bool
 	return uofMap, true
 }
 
+// getByQueries returns the union of getByQuery's results for each of
+// qs.
+func (x *defQueryTreeIndex) getByQueries(qs []string) map[unit.ID2]byteOffsets {
+	uofMap := map[unit.ID2]byteOffsets{}
+	seen := map[unit.ID2]map[int64]struct{}{}
+	for _, q := range qs {
+		quofMap, _ := x.getByQuery(q)
+		for u, qofs := range quofMap {
+			if seen[u] == nil {
+				seen[u] = map[int64]struct{}{}
+			}
+			for _, o := range qofs {
+				if _, present := seen[u][o]; !present {
+					seen[u][o] = struct{}{}
+					uofMap[u] = append(uofMap[u], o)
+				}
+			}
+		}
+	}
+	return uofMap
+}
+
 // Covers implements defIndex. If the filters list includes exactly 1
 // source unit filter, then this index reports that it does not cover
 // the query (so that the smaller source unit-level index is used).
@@ -97,10 +119,19 @@ func (x *defQueryTreeIndex) Defs(f ...DefFilter) (map[unit.ID2]byteOffsets, erro
 	defer x.RUnlock()
 	for _, ff := range f {
 		if pf, ok := ff.(ByDefQueryFilter); ok {
+			if a, ok := ff.(defQueryAlternatives); ok {
+				return x.getByQueries(a.defQueryAlternatives()), nil
+			}
 			uofmap, found := x.getByQuery(pf.ByDefQuery())
 			if !found {
+				if sg, ok := ff.(defQuerySuggester); ok {
+					sg.suggest(x.mt.t)
+				}
 				return nil, nil
 			}
+			if r, ok := ff.(defQueryTraversalRecorder); ok {
+				r.recordTraversal(len([]rune(strings.ToLower(pf.ByDefQuery()))))
+			}
 			return uofmap, nil
 		}
 	}
@@ -245,18 +276,7 @@ func (x *defQueryTreeIndex) Fprint(w io.Writer) error {
 		panic("mafsaTable not built/read")
 	}
 
-	allTerms := make([]string, 0, len(x.mt.Values))
-	var getAllTerms func(term string, n *mafsa.MinTreeNode)
-	getAllTerms = func(term string, n *mafsa.MinTreeNode) {
-		if n.Final {
-			allTerms = append(allTerms, term)
-		}
-		for _, c := range n.OrderedEdges() {
-			getAllTerms(term+string([]rune{c}), n.Edges[c])
-		}
-	}
-
-	getAllTerms("", x.mt.t.Root)
+	allTerms := mafsaTerms(x.mt.t)
 	fmt.Fprintln(w, "Terms")
 	for i, term := range allTerms {
 		fmt.Fprintf(w, "  %d - %q\n", i, term)
@@ -278,6 +298,26 @@ func (x *defQueryTreeIndex) Fprint(w io.Writer) error {
 	return nil
 }
 
+// mafsaTreeMemFactor is the approximate ratio of the memory used by a
+// decoded MAFSA MinTree to the size of its binary encoding.
+const mafsaTreeMemFactor = 4
+
+// memSize implements memSizer.
+func (x *defQueryTreeIndex) memSize() int64 {
+	x.RLock()
+	defer x.RUnlock()
+	if x.mt == nil {
+		return 0
+	}
+	size := int64(len(x.mt.B)) * (1 + mafsaTreeMemFactor)
+	for _, uofss := range x.mt.Values {
+		for _, uofs := range uofss {
+			size += 2 + 8*int64(len(uofs.byteOffsets))
+		}
+	}
+	return size
+}
+
 // Ready implements persistedIndex.
 func (x *defQueryTreeIndex) Ready() bool {
 	x.RLock()
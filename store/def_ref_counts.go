@@ -0,0 +1,306 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/alecthomas/binary"
+	"github.com/gogo/protobuf/proto"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/store/phtable"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// A VersionRefCount is the number of refs to a def in a version (i.e.,
+// a tree) of a repo.
+type VersionRefCount struct {
+	// Repo is the repo URI. It is only set by multi-repo stores.
+	Repo string `json:",omitempty"`
+
+	CommitID string
+
+	// Refs is the number of refs (in all of the tree's source units)
+	// to the def.
+	Refs int
+}
+
+// A TreeDefRefCounts counts the refs to a def in a tree.
+type TreeDefRefCounts interface {
+	// DefRefCount returns the number of refs in the tree to def. A
+	// def whose DefRepo is empty is in the tree's own repo.
+	DefRefCount(def graph.RefDefKey) (int, error)
+}
+
+// A RepoDefRefCounts counts the refs to a def in each version of a
+// repo, for tracking the def's usage (e.g., its adoption or the
+// removal of its uses after it was deprecated) over time.
+//
+// The counts are read from per-tree summaries, which are built (from
+// ref counts recorded when each source unit is imported) the first
+// time a tree is queried, and are rebuilt after data is imported into
+// the tree.
+type RepoDefRefCounts interface {
+	// DefRefCounts returns the number of refs to def in each version
+	// that matches the filters. A def whose DefRepo is empty is in the
+	// repo itself. Versions with no refs to the def are included
+	// (with a zero count). The counts are sorted by commit ID.
+	DefRefCounts(def graph.RefDefKey, f ...VersionFilter) ([]*VersionRefCount, error)
+}
+
+// A MultiRepoDefRefCounts counts the refs to a def in each version of
+// multiple repos.
+type MultiRepoDefRefCounts interface {
+	// DefRefCounts returns the number of refs to def in each version
+	// that matches the filters. The def's DefRepo must be set. If the
+	// filters don't restrict the repos, only the versions of the
+	// def's repo and the repos that depend on it (see
+	// MultiRepoDependents) are counted. The counts are sorted by
+	// repo and commit ID.
+	DefRefCounts(def graph.RefDefKey, f ...VersionFilter) ([]*VersionRefCount, error)
+}
+
+const (
+	// unitRefCountsFilename is the name of the file (in a unit's dir)
+	// that holds the number of refs in the unit to each def. If it
+	// doesn't exist, the unit was imported before the counts were
+	// written, and they are computed from the unit's refs when
+	// needed.
+	unitRefCountsFilename = "ref_counts.json"
+
+	// defRefCountsIndexName is the name of the per-tree summary of the
+	// number of refs to each def (in all of the tree's units). Like
+	// other indexes, it isn't covered by the tree's content digest.
+	defRefCountsIndexName = "def_ref_counts"
+)
+
+func (s *fsTreeStore) unitRefCountsFilename(u unit.ID2) string {
+	return path.Join(s.unitDir(u), unitRefCountsFilename)
+}
+
+func (s *fsTreeStore) writeUnitRefCounts(u unit.ID2, refs []*graph.Ref) (err error) {
+	f, err := s.fs.Create(s.unitRefCountsFilename(u))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := f.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+	return json.NewEncoder(f).Encode(countRefDefs(u, refs, false))
+}
+
+// readUnitRefCounts reads the unit's ref counts, or computes them from
+// the unit's refs if they weren't written.
+func (s *fsTreeStore) readUnitRefCounts(u unit.ID2) ([]refDefCount, error) {
+	f, err := s.fs.Open(s.unitRefCountsFilename(u))
+	if os.IsNotExist(err) {
+		refs, err := s.openUnitStore(u).Refs()
+		if err != nil {
+			return nil, err
+		}
+		return countRefDefs(u, refs, false), nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var counts []refDefCount
+	if err := json.NewDecoder(f).Decode(&counts); err != nil {
+		return nil, fmt.Errorf("%s: invalid %s: %s", u, unitRefCountsFilename, err)
+	}
+	return counts, nil
+}
+
+// buildDefRefCounts builds the tree's summary of the number of refs to
+// each def from its units' ref counts.
+func (s *fsTreeStore) buildDefRefCounts() (*phtable.CHD, error) {
+	units, err := s.Units()
+	if err != nil {
+		return nil, err
+	}
+	totals := map[graph.RefDefKey]uint64{}
+	for _, u := range units {
+		counts, err := s.readUnitRefCounts(u.ID2())
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range counts {
+			totals[c.RefDefKey] += uint64(c.Count)
+		}
+	}
+
+	b := phtable.Builder(len(totals))
+	for def, n := range totals {
+		k, err := proto.Marshal(&def)
+		if err != nil {
+			return nil, err
+		}
+		v, err := binary.Marshal(n)
+		if err != nil {
+			return nil, err
+		}
+		b.Add(k, v)
+	}
+	h, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	// Store the keys so that lookups of defs that have no refs can't
+	// return another def's count.
+	h.StoreKeys = true
+	return h, nil
+}
+
+// defRefCounts returns the tree's summary of the number of refs to
+// each def, building (and caching) it if needed.
+func (s *fsTreeStore) defRefCounts() (*phtable.CHD, error) {
+	filename := fmt.Sprintf(indexFilename, defRefCountsIndexName)
+	if f, err := s.fs.Open(filename); err == nil {
+		h, err := phtable.Read(f)
+		f.Close()
+		if err == nil {
+			return h, nil
+		}
+		vlog.Printf("%s: rebuilding invalid %s: %s", s, filename, err)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	h, err := s.buildDefRefCounts()
+	if err != nil {
+		return nil, err
+	}
+
+	// Cache the summary. If the store is read-only, the summary is
+	// rebuilt each time.
+	if f, err := s.fs.Create(filename); err == nil {
+		err := h.Write(f)
+		if err2 := f.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			s.fs.Remove(filename)
+		}
+	}
+	return h, nil
+}
+
+// invalidateDefRefCounts removes the tree's cached summary of the
+// number of refs to each def. It must be called before the tree's
+// imported data is modified.
+func (s *fsTreeStore) invalidateDefRefCounts() error {
+	if err := s.fs.Remove(fmt.Sprintf(indexFilename, defRefCountsIndexName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *fsTreeStore) DefRefCount(def graph.RefDefKey) (int, error) {
+	if _, err := s.fs.Stat("."); err != nil {
+		if os.IsNotExist(err) {
+			return 0, errTreeNoInit
+		}
+		return 0, err
+	}
+	h, err := s.defRefCounts()
+	if err != nil {
+		return 0, err
+	}
+	k, err := proto.Marshal(&def)
+	if err != nil {
+		return 0, err
+	}
+	v := h.Get(k)
+	if v == nil {
+		return 0, nil
+	}
+	var n uint64
+	if err := binary.Unmarshal(v, &n); err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+func (s *fsRepoStore) DefRefCounts(def graph.RefDefKey, f ...VersionFilter) ([]*VersionRefCount, error) {
+	versions, err := s.Versions(f...)
+	if err != nil {
+		return nil, err
+	}
+	counts := make([]*VersionRefCount, len(versions))
+	for i, v := range versions {
+		n, err := s.newTreeStore(v.CommitID).(TreeDefRefCounts).DefRefCount(def)
+		if err != nil {
+			return nil, err
+		}
+		counts[i] = &VersionRefCount{CommitID: v.CommitID, Refs: n}
+	}
+	sort.Sort(versionRefCountsByVersion(counts))
+	return counts, nil
+}
+
+func (s *fsMultiRepoStore) DefRefCounts(def graph.RefDefKey, f ...VersionFilter) ([]*VersionRefCount, error) {
+	if def.DefRepo == "" {
+		return nil, fmt.Errorf("ref counts of def %+v: DefRepo must be set", def)
+	}
+	def.DefRepo = graph.NormalizeRepoURI(def.DefRepo)
+
+	if scope, err := scopeRepos(storeFilters(f)); err != nil {
+		return nil, err
+	} else if scope == nil {
+		deps, err := s.Dependents(def.DefRepo)
+		if err != nil {
+			return nil, err
+		}
+		repos := []string{def.DefRepo}
+		for _, d := range deps {
+			if d.Repo != repos[len(repos)-1] {
+				repos = append(repos, d.Repo)
+			}
+		}
+		f = append(f, ByRepos(repos...))
+	}
+
+	versions, err := s.Versions(f...)
+	if err != nil {
+		return nil, err
+	}
+	counts := make([]*VersionRefCount, len(versions))
+	for i, v := range versions {
+		// Refs to defs in the same repo are stored with an empty
+		// DefRepo.
+		key := def
+		if key.DefRepo == v.Repo {
+			key.DefRepo = ""
+		}
+		ts := s.openRepoStore(v.Repo).(*fsRepoStore).newTreeStore(v.CommitID)
+		n, err := ts.(TreeDefRefCounts).DefRefCount(key)
+		if err != nil {
+			return nil, err
+		}
+		counts[i] = &VersionRefCount{Repo: v.Repo, CommitID: v.CommitID, Refs: n}
+	}
+	sort.Sort(versionRefCountsByVersion(counts))
+	return counts, nil
+}
+
+type versionRefCountsByVersion []*VersionRefCount
+
+func (v versionRefCountsByVersion) Len() int { return len(v) }
+func (v versionRefCountsByVersion) Less(i, j int) bool {
+	if v[i].Repo != v[j].Repo {
+		return v[i].Repo < v[j].Repo
+	}
+	return v[i].CommitID < v[j].CommitID
+}
+func (v versionRefCountsByVersion) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+
+var (
+	_ TreeDefRefCounts      = (*fsTreeStore)(nil)
+	_ TreeDefRefCounts      = (*indexedTreeStore)(nil)
+	_ RepoDefRefCounts      = (*fsRepoStore)(nil)
+	_ MultiRepoDefRefCounts = (*fsMultiRepoStore)(nil)
+)
@@ -0,0 +1,104 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestFSMultiRepoStore_DefRefCounts(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+
+	u1 := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u1"}}
+	u2 := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u2"}}
+	refsTo := func(defRepo, defUnit, defPath string, n int) []*graph.Ref {
+		refs := make([]*graph.Ref, n)
+		for i := range refs {
+			refs[i] = &graph.Ref{DefRepo: defRepo, DefUnitType: "t", DefUnit: defUnit, DefPath: defPath, File: "f", Start: uint32(i), End: uint32(i + 1)}
+		}
+		return refs
+	}
+	def := graph.RefDefKey{DefRepo: "d", DefUnitType: "t", DefUnit: "u1", DefPath: "p"}
+
+	for _, indexed := range []bool{false, true} {
+		useIndexedStore = indexed
+		mrs := NewFSMultiRepoStore(newTestFS(), nil)
+		imp := func(repo, commitID string, u *unit.SourceUnit, refs []*graph.Ref) {
+			if err := mrs.Import(repo, commitID, u, graph.Output{Refs: refs}); err != nil {
+				t.Fatal(err)
+			}
+			if err := mrs.CreateVersion(repo, commitID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		imp("d", "c1", u1, refsTo("d", "u1", "p", 3))
+		imp("d", "c1", u2, append(refsTo("d", "u1", "p", 2), refsTo("d", "u1", "q", 1)...))
+		imp("d", "c2", u1, refsTo("d", "u1", "p", 1))
+		imp("d", "c3", u1, refsTo("d", "u1", "q", 1))
+		imp("a", "c", u1, refsTo("d", "u1", "p", 4))
+		imp("b", "c", u1, refsTo("d", "u1", "q", 4))
+		imp("e", "c", u1, refsTo("e", "u1", "p", 1))
+
+		check := func(label string, f []VersionFilter, want []*VersionRefCount) {
+			counts, err := mrs.(MultiRepoDefRefCounts).DefRefCounts(def, f...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(counts, want) {
+				t.Errorf("indexed=%v %s: got %s, want %s", indexed, label, versionRefCountsString(counts), versionRefCountsString(want))
+			}
+		}
+		check("all", nil, []*VersionRefCount{
+			{Repo: "a", CommitID: "c", Refs: 4},
+			{Repo: "b", CommitID: "c", Refs: 0},
+			{Repo: "d", CommitID: "c1", Refs: 5},
+			{Repo: "d", CommitID: "c2", Refs: 1},
+			{Repo: "d", CommitID: "c3", Refs: 0},
+		})
+		check("repo e", []VersionFilter{ByRepos("e")}, []*VersionRefCount{{Repo: "e", CommitID: "c", Refs: 0}})
+
+		// The per-tree summaries are rebuilt after imports.
+		imp("d", "c3", u2, refsTo("d", "u1", "p", 7))
+		check("after import", []VersionFilter{ByRepos("d")}, []*VersionRefCount{
+			{Repo: "d", CommitID: "c1", Refs: 5},
+			{Repo: "d", CommitID: "c2", Refs: 1},
+			{Repo: "d", CommitID: "c3", Refs: 7},
+		})
+
+		// Units imported before their ref counts were recorded are
+		// counted from their refs.
+		for _, u := range []*unit.SourceUnit{u1, u2} {
+			ts := mrs.(*fsMultiRepoStore).openRepoStore("d").(*fsRepoStore).newTreeStore("c1")
+			var fts *fsTreeStore
+			switch ts := ts.(type) {
+			case *fsTreeStore:
+				fts = ts
+			case *indexedTreeStore:
+				fts = ts.fsTreeStore
+			}
+			if err := fts.fs.Remove(fts.unitRefCountsFilename(u.ID2())); err != nil {
+				t.Fatal(err)
+			}
+			if err := fts.invalidateDefRefCounts(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		check("computed", []VersionFilter{ByRepoCommitIDs(Version{Repo: "d", CommitID: "c1"})}, []*VersionRefCount{{Repo: "d", CommitID: "c1", Refs: 5}})
+
+		if _, err := mrs.(MultiRepoDefRefCounts).DefRefCounts(graph.RefDefKey{DefPath: "p"}); err == nil {
+			t.Errorf("indexed=%v: got no error for def without DefRepo", indexed)
+		}
+	}
+}
+
+func versionRefCountsString(counts []*VersionRefCount) string {
+	s := make([]string, len(counts))
+	for i, c := range counts {
+		s[i] = fmt.Sprintf("%+v", *c)
+	}
+	return "[" + strings.Join(s, " ") + "]"
+}
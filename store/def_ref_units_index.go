@@ -91,34 +91,40 @@ func (x *defRefUnitsIndex) Units(fs ...UnitFilter) ([]unit.ID2, error) {
 }
 
 // Build implements unitRefIndexBuilder.
-func (x *defRefUnitsIndex) Build(unitRefIndexes map[unit.ID2]*defRefsIndex) error {
+func (x *defRefUnitsIndex) Build(unitRefIndexes map[unit.ID2][]*defRefsIndex) error {
 	x.Lock()
 	defer x.Unlock()
 	vlog.Printf("defRefUnitsIndex: building inverted def->units index (%d units)...", len(unitRefIndexes))
 	defToUnits := map[graph.RefDefKey][]unit.ID2{}
-	for u, x := range unitRefIndexes {
-		it := x.phtable.Iterate()
-		for {
-			if it == nil {
-				break
-			}
-
-			kb, _ := it.Get()
-			var def graph.RefDefKey
-			if err := proto.Unmarshal(kb, &def); err != nil {
-				return err
-			}
-
-			// Set implied fields.
-			if def.DefUnit == "" {
-				def.DefUnit = u.Name
-			}
-			if def.DefUnitType == "" {
-				def.DefUnitType = u.Type
+	for u, xs := range unitRefIndexes {
+		unitDefs := map[graph.RefDefKey]struct{}{}
+		for _, x := range xs {
+			it := x.phtable.Iterate()
+			for {
+				if it == nil {
+					break
+				}
+
+				kb, _ := it.Get()
+				var def graph.RefDefKey
+				if err := proto.Unmarshal(kb, &def); err != nil {
+					return err
+				}
+
+				// Set implied fields.
+				if def.DefUnit == "" {
+					def.DefUnit = u.Name
+				}
+				if def.DefUnitType == "" {
+					def.DefUnitType = u.Type
+				}
+				unitDefs[def] = struct{}{}
+
+				it = it.Next()
 			}
+		}
+		for def := range unitDefs {
 			defToUnits[def] = append(defToUnits[def], u)
-
-			it = it.Next()
 		}
 	}
 	vlog.Printf("defRefUnitsIndex: adding %d index phtable keys...", len(defToUnits))
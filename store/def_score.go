@@ -0,0 +1,127 @@
+package store
+
+import (
+	"sort"
+	"sync"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+// DefScoreStats are stats about a candidate def (derived from its
+// tree's indexes) that a ScoreFunc can use to score it.
+type DefScoreStats struct {
+	// Refs is the number of refs to the def in its tree (see
+	// TreeDefRefCounts), or -1 if the def's store doesn't count refs.
+	Refs int
+}
+
+// A ScoreFunc scores a candidate def of a search. Defs with higher
+// scores are ranked first. It must be safe for concurrent use.
+//
+// To score defs by how well their names matched the search's free
+// text, use ByDefQueryMatches and read the matches (from the
+// DefMatches) in the ScoreFunc.
+type ScoreFunc func(def *graph.Def, stats DefScoreStats) float64
+
+// RankDefs returns a filter that sorts the defs of a query by the
+// scores that fn gives them (highest first, with ties in the canonical
+// order) instead of in the canonical order (see "CONVENTION - RESULT
+// ORDERING" in the package docs). It selects all defs. Embedders use
+// it to customize the ranking of search results (e.g., to boost their
+// first-party repos) without modifying the stores or their indexes.
+//
+// The defs are sorted (and scored) by each level of the store that
+// combines results (e.g., each tree, repo, and the multi-repo store),
+// so fn may be called more than once for a def. Only the final sort
+// (by the store that the query was made on) determines the order of
+// the results, and only then are all of the defs' fields (such as
+// Repo) set.
+func RankDefs(fn ScoreFunc) interface {
+	DefFilter
+	DefsSorter
+} {
+	if fn == nil {
+		panic("RankDefs: nil ScoreFunc")
+	}
+	return &defRanker{fn: fn}
+}
+
+type defRanker struct {
+	fn ScoreFunc
+
+	mu    sync.Mutex
+	stats map[*graph.Def]DefScoreStats
+}
+
+func (r *defRanker) String() string                { return "RankDefs" }
+func (r *defRanker) SelectDef(def *graph.Def) bool { return true }
+
+// recordStats records the stats of defs, all of which are in the tree
+// whose store is ts.
+func (r *defRanker) recordStats(ts TreeStore, defs []*graph.Def) error {
+	rc, ok := ts.(TreeDefRefCounts)
+	if !ok {
+		return nil
+	}
+	stats := make([]DefScoreStats, len(defs))
+	for i, def := range defs {
+		n, err := rc.DefRefCount(graph.RefDefKey{DefUnitType: def.UnitType, DefUnit: def.Unit, DefPath: def.Path})
+		if err != nil {
+			return err
+		}
+		stats[i].Refs = n
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stats == nil {
+		r.stats = make(map[*graph.Def]DefScoreStats, len(defs))
+	}
+	for i, def := range defs {
+		r.stats[def] = stats[i]
+	}
+	return nil
+}
+
+// DefsSort implements DefsSorter.
+func (r *defRanker) DefsSort(defs []*graph.Def) {
+	scored := defsByScore{defs: defs, scores: make([]float64, len(defs))}
+	for i, def := range defs {
+		r.mu.Lock()
+		stats, present := r.stats[def]
+		r.mu.Unlock()
+		if !present {
+			stats.Refs = -1
+		}
+		scored.scores[i] = r.fn(def, stats)
+	}
+	sort.Sort(scored)
+}
+
+// recordDefScoreStats records the stats of defs (all of which are in
+// the tree whose store is ts) for the RankDefs filter in fs, if any.
+func recordDefScoreStats(ts TreeStore, defs []*graph.Def, fs []DefFilter) error {
+	for _, f := range fs {
+		if r, ok := f.(*defRanker); ok {
+			return r.recordStats(ts, defs)
+		}
+	}
+	return nil
+}
+
+type defsByScore struct {
+	defs   []*graph.Def
+	scores []float64
+}
+
+func (v defsByScore) Len() int { return len(v.defs) }
+func (v defsByScore) Swap(i, j int) {
+	v.defs[i], v.defs[j] = v.defs[j], v.defs[i]
+	v.scores[i], v.scores[j] = v.scores[j], v.scores[i]
+}
+func (v defsByScore) Less(i, j int) bool {
+	if v.scores[i] != v.scores[j] {
+		return v.scores[i] > v.scores[j]
+	}
+	return defsInCanonicalOrder(v.defs).Less(i, j)
+}
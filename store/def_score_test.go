@@ -0,0 +1,64 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestRankDefs(t *testing.T) {
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
+	ref := func(defPath string, start uint32) *graph.Ref {
+		return &graph.Ref{DefUnitType: "t", DefUnit: "u", DefPath: defPath, File: "f", Start: start, End: start + 1}
+	}
+	data := func() graph.Output {
+		return graph.Output{
+			Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "x"}}, {DefKey: graph.DefKey{Path: "y"}}},
+			Refs: []*graph.Ref{ref("x", 1), ref("y", 2), ref("y", 3)},
+		}
+	}
+
+	type key struct{ repo, path string }
+	byRefs := func(def *graph.Def, stats DefScoreStats) float64 { return float64(stats.Refs) }
+	boostB := func(def *graph.Def, stats DefScoreStats) float64 {
+		if def.Repo == "b" {
+			return 1
+		}
+		return 0
+	}
+
+	tests := map[string]struct {
+		mrs  MultiRepoStoreImporter
+		fn   ScoreFunc
+		want []key
+	}{
+		"fs by refs":     {NewFSMultiRepoStore(newTestFS(), nil), byRefs, []key{{"a", "y"}, {"b", "y"}, {"a", "x"}, {"b", "x"}}},
+		"fs boost":       {NewFSMultiRepoStore(newTestFS(), nil), boostB, []key{{"b", "x"}, {"b", "y"}, {"a", "x"}, {"a", "y"}}},
+		"memory by refs": {newMemoryMultiRepoStore(), byRefs, []key{{"a", "x"}, {"a", "y"}, {"b", "x"}, {"b", "y"}}},
+		"memory boost":   {newMemoryMultiRepoStore(), boostB, []key{{"b", "x"}, {"b", "y"}, {"a", "x"}, {"a", "y"}}},
+	}
+	for label, test := range tests {
+		for _, repo := range []string{"a", "b"} {
+			if err := test.mrs.Import(repo, "c", u, data()); err != nil {
+				t.Fatal(err)
+			}
+			if err := test.mrs.CreateVersion(repo, "c"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		defs, err := test.mrs.Defs(RankDefs(test.fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []key
+		for _, def := range defs {
+			got = append(got, key{def.Repo, def.Path})
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got defs %v, want %v", label, got, test.want)
+		}
+	}
+}
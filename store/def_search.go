@@ -0,0 +1,194 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+// A DefSearch is a parsed def search query. Search queries consist of
+// free text (matched against def names, as with ByDefQuery) and
+// qualifiers that restrict the search:
+//
+//	repo:REPO      defs in the repo
+//	unit:NAME      defs in source units with the name (of any type)
+//	file:PATH      defs in the file (or in files under the dir)
+//	kind:KIND      defs of the kind (e.g., "func")
+//	is:exported    only exported defs
+//
+// Repeated qualifiers of the same kind are ORed (e.g., "repo:a repo:b"
+// matches defs in either repo); different kinds of qualifiers are
+// ANDed. Qualifier values may be double-quoted to include spaces
+// (e.g., file:"a b/c.go"). Terms that look like qualifiers but have
+// an unrecognized key are treated as free text.
+type DefSearch struct {
+	Text     string   // free text to match against def names
+	Repos    []string // from repo: qualifiers
+	Units    []string // from unit: qualifiers (unit names)
+	Files    []string // from file: qualifiers
+	Kinds    []string // from kind: qualifiers
+	Exported bool     // from the is:exported qualifier
+}
+
+// ParseDefSearch parses a def search query. See DefSearch for the
+// query syntax.
+func ParseDefSearch(q string) (*DefSearch, error) {
+	terms, err := splitSearchTerms(q)
+	if err != nil {
+		return nil, err
+	}
+	var s DefSearch
+	var text []string
+	for _, term := range terms {
+		key, val, isQualifier := term.qualifier()
+		if !isQualifier {
+			text = append(text, term.raw)
+			continue
+		}
+		if val == "" {
+			return nil, fmt.Errorf("search qualifier %s: has no value", key)
+		}
+		switch key {
+		case "repo":
+			s.Repos = append(s.Repos, val)
+		case "unit":
+			s.Units = append(s.Units, val)
+		case "file":
+			s.Files = append(s.Files, val)
+		case "kind":
+			s.Kinds = append(s.Kinds, val)
+		case "is":
+			if val != "exported" {
+				return nil, fmt.Errorf("search qualifier is:%s: unrecognized value (only is:exported is supported)", val)
+			}
+			s.Exported = true
+		}
+	}
+	s.Text = strings.Join(text, " ")
+	return &s, nil
+}
+
+// Filters returns the store filters that select the defs matched by s.
+// It returns an error if any qualifier value is invalid (e.g., a file
+// path outside of the tree).
+func (s *DefSearch) Filters() ([]DefFilter, error) { return s.filters(nil) }
+
+// FiltersWithMatches is like Filters, but the ranges of the names of
+// the selected defs that matched s's free text are recorded in m (see
+// ByDefQueryMatches).
+func (s *DefSearch) FiltersWithMatches(m *DefMatches) ([]DefFilter, error) { return s.filters(m) }
+
+func (s *DefSearch) filters(m *DefMatches) ([]DefFilter, error) {
+	var fs []DefFilter
+	if len(s.Repos) > 0 {
+		f, err := NewByReposFilter(s.Repos...)
+		if err != nil {
+			return nil, err
+		}
+		fs = append(fs, f)
+	}
+	if len(s.Units) > 0 {
+		fs = append(fs, byUnitNamesFilter(s.Units))
+	}
+	if len(s.Files) > 0 {
+		f, err := NewByFilesFilter(false, s.Files...)
+		if err != nil {
+			return nil, err
+		}
+		fs = append(fs, f)
+	}
+	if len(s.Kinds) > 0 {
+		fs = append(fs, ByDefKinds(s.Kinds...))
+	}
+	if s.Exported {
+		fs = append(fs, ByExported())
+	}
+	if s.Text != "" {
+		if m != nil {
+			fs = append(fs, ByDefQueryMatches(s.Text, m))
+		} else {
+			fs = append(fs, ByDefQuery(s.Text))
+		}
+	}
+	return fs, nil
+}
+
+// ParseDefSearchFilters parses a def search query and returns the
+// store filters that select the defs it matches. It is shorthand for
+// ParseDefSearch followed by (*DefSearch).Filters.
+func ParseDefSearchFilters(q string) ([]DefFilter, error) {
+	s, err := ParseDefSearch(q)
+	if err != nil {
+		return nil, err
+	}
+	return s.Filters()
+}
+
+// defSearchKeys are the recognized qualifier keys.
+var defSearchKeys = map[string]bool{"repo": true, "unit": true, "file": true, "kind": true, "is": true}
+
+// A searchTerm is a whitespace-separated term in a search query.
+type searchTerm struct {
+	raw    string // the term as written in the query (minus quotes)
+	quoted bool   // whether the whole term was double-quoted
+}
+
+// qualifier returns the key and value of the term if it is a
+// qualifier (KEY:VALUE with a recognized key).
+func (t searchTerm) qualifier() (key, val string, ok bool) {
+	if t.quoted {
+		return "", "", false
+	}
+	i := strings.Index(t.raw, ":")
+	if i == -1 || !defSearchKeys[t.raw[:i]] {
+		return "", "", false
+	}
+	return t.raw[:i], t.raw[i+1:], true
+}
+
+// splitSearchTerms splits q into whitespace-separated terms. Double
+// quotes group text containing spaces, either as a whole term ("a b")
+// or as a qualifier value (key:"a b").
+func splitSearchTerms(q string) ([]searchTerm, error) {
+	var terms []searchTerm
+	for i := 0; i < len(q); {
+		if isSearchSpace(q[i]) {
+			i++
+			continue
+		}
+		var raw []byte
+		quoted := q[i] == '"'
+		for i < len(q) && !isSearchSpace(q[i]) {
+			if q[i] != '"' {
+				raw = append(raw, q[i])
+				i++
+				continue
+			}
+			end := strings.IndexByte(q[i+1:], '"')
+			if end == -1 {
+				return nil, fmt.Errorf("search query %q: unterminated quoted string", q)
+			}
+			raw = append(raw, q[i+1:i+1+end]...)
+			i += 1 + end + 1
+		}
+		terms = append(terms, searchTerm{raw: string(raw), quoted: quoted})
+	}
+	return terms, nil
+}
+
+func isSearchSpace(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' }
+
+// byUnitNamesFilter selects defs in source units with any of the
+// names (of any unit type).
+type byUnitNamesFilter []string
+
+func (f byUnitNamesFilter) String() string { return fmt.Sprintf("byUnitNames(%v)", []string(f)) }
+func (f byUnitNamesFilter) SelectDef(def *graph.Def) bool {
+	for _, u := range f {
+		if def.Unit == u {
+			return true
+		}
+	}
+	return false
+}
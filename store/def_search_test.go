@@ -0,0 +1,68 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+func TestParseDefSearch(t *testing.T) {
+	tests := map[string]*DefSearch{
+		"":                        {},
+		"foo":                     {Text: "foo"},
+		"repo:r1 foo repo:r2 bar": {Text: "foo bar", Repos: []string{"r1", "r2"}},
+		"unit:u file:a/b.go kind:func is:exported": {Units: []string{"u"}, Files: []string{"a/b.go"}, Kinds: []string{"func"}, Exported: true},
+		`file:"a b/c.go" "x:y z"`:                  {Text: "x:y z", Files: []string{"a b/c.go"}},
+		"std::vector other:q":                      {Text: "std::vector other:q"},
+	}
+	for q, want := range tests {
+		got, err := ParseDefSearch(q)
+		if err != nil {
+			t.Errorf("%q: %s", q, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %+v, want %+v", q, got, want)
+		}
+	}
+
+	for _, q := range []string{"repo:", `foo "bar`, "is:unexported"} {
+		if _, err := ParseDefSearch(q); err == nil {
+			t.Errorf("%q: got no error", q)
+		}
+	}
+	if _, err := ParseDefSearchFilters("file:../x"); err == nil {
+		t.Error("file:../x: got no error")
+	}
+}
+
+func TestParseDefSearchFilters(t *testing.T) {
+	defs := []*graph.Def{
+		{DefKey: graph.DefKey{Repo: "r1", Unit: "u1", Path: "a"}, Name: "Foo", Kind: "func", File: "a/a.go", Exported: true},
+		{DefKey: graph.DefKey{Repo: "r1", Unit: "u2", Path: "b"}, Name: "foobar", Kind: "var", File: "b/b.go"},
+		{DefKey: graph.DefKey{Repo: "r2", Unit: "u1", Path: "c"}, Name: "Bar", Kind: "func", File: "a/c.go", Exported: true},
+	}
+	tests := map[string][]string{
+		"foo":                      {"a", "b"},
+		"foo is:exported":          {"a"},
+		"kind:FUNC":                {"a", "c"},
+		"unit:u1 file:a":           {"a", "c"},
+		"repo:r1 repo:r2 kind:var": {"b"},
+		"repo:r2 foo":              nil,
+	}
+	for q, want := range tests {
+		fs, err := ParseDefSearchFilters(q)
+		if err != nil {
+			t.Errorf("%q: %s", q, err)
+			continue
+		}
+		var got []string
+		for _, def := range DefFilters(fs).SelectDefs(defs...) {
+			got = append(got, def.Path)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %v, want %v", q, got, want)
+		}
+	}
+}
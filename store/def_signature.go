@@ -0,0 +1,342 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/alecthomas/binary"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/store/phtable"
+)
+
+// A SignatureQuery matches defs by the types in their signatures (see
+// graph.DefSignature). A def matches if each of the query's parameter
+// types is the type of a distinct parameter of the def, and likewise
+// for the result types. The order of the types doesn't matter, and the
+// def may have other parameters and results. Types are compared
+// exactly, ignoring whitespace.
+type SignatureQuery struct {
+	Params  []string
+	Results []string
+}
+
+// ParseSignatureQuery parses a signature query of the form
+// "PARAMS -> RESULTS", where PARAMS and RESULTS are comma-separated
+// lists of types. Either list may be empty, and the "->" may be
+// omitted if RESULTS is. For example, "context.Context -> error"
+// matches functions that take a context.Context and return an error,
+// and "-> error" matches functions that return an error. Commas
+// inside brackets (e.g., "map[K, V]" or "Map<K, V>") don't separate
+// types.
+func ParseSignatureQuery(q string) (*SignatureQuery, error) {
+	params, results := q, ""
+	if i := strings.Index(q, "->"); i != -1 {
+		params, results = q[:i], q[i+len("->"):]
+	}
+	var sq SignatureQuery
+	var err error
+	if sq.Params, err = splitSignatureTypes(params); err != nil {
+		return nil, err
+	}
+	if sq.Results, err = splitSignatureTypes(results); err != nil {
+		return nil, err
+	}
+	if sq.empty() {
+		return nil, fmt.Errorf("signature query %q: no types", q)
+	}
+	return &sq, nil
+}
+
+// splitSignatureTypes splits a comma-separated list of types.
+func splitSignatureTypes(s string) ([]string, error) {
+	var types []string
+	depth, start := 0, 0
+	for i := 0; i <= len(s); i++ {
+		if i < len(s) {
+			switch s[i] {
+			case '(', '[', '{', '<':
+				depth++
+				continue
+			case ')', ']', '}', '>':
+				depth--
+				continue
+			case ',':
+				if depth > 0 {
+					continue
+				}
+			default:
+				continue
+			}
+		}
+		t := normalizeSignatureType(s[start:i])
+		if t == "" {
+			if strings.TrimSpace(s) == "" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("signature query: empty type in %q", strings.TrimSpace(s))
+		}
+		types = append(types, t)
+		start = i + 1
+	}
+	return types, nil
+}
+
+// normalizeSignatureType removes whitespace from a type.
+func normalizeSignatureType(t string) string { return strings.Join(strings.Fields(t), "") }
+
+func (q SignatureQuery) empty() bool { return len(q.Params) == 0 && len(q.Results) == 0 }
+
+func (q SignatureQuery) String() string {
+	s := strings.Join(q.Params, ", ")
+	if len(q.Results) > 0 {
+		s += " -> " + strings.Join(q.Results, ", ")
+	}
+	return strings.TrimSpace(s)
+}
+
+// Match reports whether sig matches the query.
+func (q SignatureQuery) Match(sig *graph.DefSignature) bool {
+	if sig == nil {
+		return false
+	}
+	return containsSignatureTypes(sig.Params, q.Params) && containsSignatureTypes(sig.Results, q.Results)
+}
+
+// containsSignatureTypes reports whether each of want is a distinct
+// element of types.
+func containsSignatureTypes(types, want []string) bool {
+	if len(want) > len(types) {
+		return false
+	}
+	used := make([]bool, len(types))
+	for _, w := range want {
+		w = normalizeSignatureType(w)
+		found := false
+		for i, t := range types {
+			if !used[i] && normalizeSignatureType(t) == w {
+				used[i] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// BySignatureQueryFilter is implemented by filters that restrict their
+// selection to defs whose signatures match a query.
+type BySignatureQueryFilter interface {
+	BySignatureQuery() SignatureQuery
+}
+
+// BySignatureQuery returns a filter that selects defs whose typed
+// signatures (see graph.DefSignature) match q. Defs without signatures
+// are never selected. It panics if q has no types.
+func BySignatureQuery(q SignatureQuery) interface {
+	DefFilter
+	BySignatureQueryFilter
+} {
+	if q.empty() {
+		panic("BySignatureQuery: empty query")
+	}
+	return &bySignatureQueryFilter{q: q}
+}
+
+type bySignatureQueryFilter struct{ q SignatureQuery }
+
+func (f *bySignatureQueryFilter) String() string                   { return fmt.Sprintf("BySignatureQuery(%q)", f.q) }
+func (f *bySignatureQueryFilter) BySignatureQuery() SignatureQuery { return f.q }
+func (f *bySignatureQueryFilter) SelectDef(def *graph.Def) bool {
+	return f.q.Match(def.Signature())
+}
+
+const defSignatureIndexName = "def_signature"
+
+// defSignatureIndex makes it fast to find the defs (within a source
+// unit) whose signatures have specific parameter and result types.
+type defSignatureIndex struct {
+	phtable *phtable.CHD
+	ready   bool
+	sync.RWMutex
+}
+
+var _ interface {
+	Index
+	persistedIndex
+	defIndexBuilder
+	defIndex
+} = (*defSignatureIndex)(nil)
+
+var c_defSignatureIndex_getByType = &counter{count: new(int64)}
+
+func (x *defSignatureIndex) String() string { return "defSignatureIndex" }
+
+// The index keys are a param or result prefix followed by the
+// normalized type.
+const (
+	defSignatureParamKey  = "p:"
+	defSignatureResultKey = "r:"
+)
+
+func (x *defSignatureIndex) getByType(key string) (byteOffsets, error) {
+	c_defSignatureIndex_getByType.increment()
+	if x.phtable == nil {
+		panic("phtable not built/read")
+	}
+	v := x.phtable.Get([]byte(key))
+	if v == nil {
+		return nil, nil
+	}
+	var ofs byteOffsets
+	if err := binary.Unmarshal(v, &ofs); err != nil {
+		return nil, err
+	}
+	return ofs, nil
+}
+
+// Covers implements defIndex.
+func (x *defSignatureIndex) Covers(filters interface{}) int {
+	cov := 0
+	for _, f := range storeFilters(filters) {
+		if _, ok := f.(BySignatureQueryFilter); ok {
+			cov++
+		}
+	}
+	return cov
+}
+
+// Defs implements defIndex. It returns the offsets of the defs whose
+// signatures have all of the query's types (the filter itself checks
+// that the types are of distinct params and results).
+func (x *defSignatureIndex) Defs(fs ...DefFilter) (byteOffsets, error) {
+	x.RLock()
+	defer x.RUnlock()
+	for _, f := range fs {
+		sf, ok := f.(BySignatureQueryFilter)
+		if !ok {
+			continue
+		}
+		q := sf.BySignatureQuery()
+		var keys []string
+		for _, t := range q.Params {
+			keys = append(keys, defSignatureParamKey+normalizeSignatureType(t))
+		}
+		for _, t := range q.Results {
+			keys = append(keys, defSignatureResultKey+normalizeSignatureType(t))
+		}
+
+		var ofs byteOffsets
+		for i, key := range keys {
+			keyOfs, err := x.getByType(key)
+			if err != nil {
+				return nil, err
+			}
+			if i == 0 {
+				ofs = keyOfs
+			} else {
+				ofs = intersectByteOffsets(ofs, keyOfs)
+			}
+			if len(ofs) == 0 {
+				return nil, nil
+			}
+		}
+		return ofs, nil
+	}
+	return nil, nil
+}
+
+// intersectByteOffsets returns the offsets that are in both a and b
+// (which must be sorted).
+func intersectByteOffsets(a, b byteOffsets) byteOffsets {
+	var ofs byteOffsets
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			ofs = append(ofs, a[i])
+			i++
+			j++
+		}
+	}
+	return ofs
+}
+
+// Build implements defIndexBuilder.
+func (x *defSignatureIndex) Build(defs []*graph.Def, ofs byteOffsets) error {
+	x.Lock()
+	defer x.Unlock()
+	vlog.Printf("defSignatureIndex: building index... (%d defs)", len(defs))
+	typeOfs := map[string]byteOffsets{}
+	add := func(prefix string, types []string, o int64) {
+		for _, t := range types {
+			key := prefix + normalizeSignatureType(t)
+			if v := typeOfs[key]; len(v) == 0 || v[len(v)-1] != o {
+				typeOfs[key] = append(v, o)
+			}
+		}
+	}
+	for i, def := range defs {
+		if sig := def.Signature(); sig != nil {
+			add(defSignatureParamKey, sig.Params, ofs[i])
+			add(defSignatureResultKey, sig.Results, ofs[i])
+		}
+	}
+
+	// The offsets of each type are sorted (because defs are in offset
+	// order), which Defs relies on to intersect them.
+	b := phtable.Builder(len(typeOfs))
+	for key, ofs := range typeOfs {
+		v, err := binary.Marshal(ofs)
+		if err != nil {
+			return err
+		}
+		b.Add([]byte(key), v)
+	}
+	h, err := b.Build()
+	if err != nil {
+		return err
+	}
+	// Store the keys so that lookups of types that aren't in the index
+	// can't return another type's defs.
+	h.StoreKeys = true
+	x.phtable = h
+	x.ready = true
+	vlog.Printf("defSignatureIndex: done building index (%d types).", len(typeOfs))
+	return nil
+}
+
+// Write implements persistedIndex.
+func (x *defSignatureIndex) Write(w io.Writer) error {
+	x.RLock()
+	defer x.RUnlock()
+	if x.phtable == nil {
+		panic("no phtable to write")
+	}
+	return x.phtable.Write(w)
+}
+
+// Read implements persistedIndex.
+func (x *defSignatureIndex) Read(r io.Reader) error {
+	phtable, err := phtable.Read(r)
+	x.Lock()
+	defer x.Unlock()
+	x.phtable = phtable
+	x.ready = (err == nil)
+	return err
+}
+
+// Ready implements persistedIndex.
+func (x *defSignatureIndex) Ready() bool {
+	x.RLock()
+	defer x.RUnlock()
+	return x.ready
+}
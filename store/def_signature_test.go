@@ -0,0 +1,97 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestParseSignatureQuery(t *testing.T) {
+	tests := map[string]*SignatureQuery{
+		"context.Context -> error":           {Params: []string{"context.Context"}, Results: []string{"error"}},
+		"-> error":                           {Results: []string{"error"}},
+		"string, int":                        {Params: []string{"string", "int"}},
+		"map[string, int], Map<K, V> -> *T ": {Params: []string{"map[string,int]", "Map<K,V>"}, Results: []string{"*T"}},
+		"":                                   nil,
+		"->":                                 nil,
+		"a, -> b":                            nil,
+	}
+	for input, want := range tests {
+		q, err := ParseSignatureQuery(input)
+		if want == nil {
+			if err == nil {
+				t.Errorf("%q: got no error", input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", input, err)
+			continue
+		}
+		if !reflect.DeepEqual(q, want) {
+			t.Errorf("%q: got %+v, want %+v", input, q, want)
+		}
+	}
+}
+
+func TestBySignatureQuery(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+
+	sigDef := func(path, data string) *graph.Def {
+		return &graph.Def{DefKey: graph.DefKey{Path: path}, Name: path, Data: []byte(data)}
+	}
+	data := graph.Output{Defs: []*graph.Def{
+		sigDef("f1", `{"Signature":{"Params":["context.Context","string"],"Results":["error"]}}`),
+		sigDef("f2", `{"Signature":{"Params":["string"],"Results":["int","error"]}}`),
+		sigDef("f3", `{"Signature":{"Params":["context.Context"]}}`),
+		sigDef("f4", `{"Signature":{"Params":["string","string"]}}`),
+		sigDef("v", `{"Kind":"var"}`),
+		sigDef("x", `"not an object"`),
+	}}
+
+	tests := map[string][]string{
+		"context.Context -> error": {"f1"},
+		"-> error":                 {"f1", "f2"},
+		"string":                   {"f1", "f2", "f4"},
+		"string, string":           {"f4"},
+		"context.Context":          {"f1", "f3"},
+		"int":                      nil,
+	}
+	for _, indexed := range []bool{false, true} {
+		useIndexedStore = indexed
+		mrs := NewFSMultiRepoStore(newTestFS(), nil)
+		if err := mrs.Import("r", "c", &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.CreateVersion("r", "c"); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.Index("r", "c"); err != nil {
+			t.Fatal(err)
+		}
+
+		c_defSignatureIndex_getByType.set(0)
+		for input, want := range tests {
+			q, err := ParseSignatureQuery(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defs, err := mrs.Defs(ByRepos("r"), BySignatureQuery(*q))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, def := range defs {
+				got = append(got, def.Path)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("indexed=%v %q: got defs %v, want %v", indexed, input, got, want)
+			}
+		}
+		if got := c_defSignatureIndex_getByType.get(); (got > 0) != indexed {
+			t.Errorf("indexed=%v: got %d signature index lookups", indexed, got)
+		}
+	}
+}
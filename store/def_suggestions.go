@@ -0,0 +1,206 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/smartystreets/mafsa"
+)
+
+// DefSuggestions records "did you mean" corrections for the query of
+// a ByDefQuerySuggest filter, so that search UIs can offer them when
+// the query returns no defs. It is safe for concurrent use.
+//
+// The suggestions are computed from the def query indexes that the
+// query consults: an index that has no def names beginning with the
+// query suggests the prefixes of its def names that are within
+// MaxEdits edits (insertions, deletions, or substitutions of a
+// character) of the query. Each suggestion, used as a def query,
+// matches defs in the index that suggested it. Stores that aren't
+// indexed make no suggestions.
+type DefSuggestions struct {
+	// MaxEdits is the maximum edit distance between the query and
+	// a suggestion (0 means 2).
+	MaxEdits int
+
+	// Max is the maximum number of suggestions returned by Terms (0
+	// means 5).
+	Max int
+
+	mu     sync.Mutex
+	qlen   int            // the length of the (lowercased) query
+	byTerm map[string]int // suggestion -> edit distance
+}
+
+func (s *DefSuggestions) maxEdits() int {
+	if s.MaxEdits <= 0 {
+		return 2
+	}
+	return s.MaxEdits
+}
+
+// Terms returns the suggestions, best first. Suggestions with fewer
+// edits are better; of those with the same number of edits, those
+// closer in length to the query are better. A suggestion that is a
+// prefix or an extension of a better suggestion is omitted (because
+// def queries match prefixes, their results overlap).
+func (s *DefSuggestions) Terms() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	terms := make([]string, 0, len(s.byTerm))
+	for term := range s.byTerm {
+		terms = append(terms, term)
+	}
+	sort.Sort(suggestionsByRank{terms: terms, dist: s.byTerm, qlen: s.qlen})
+
+	max := s.Max
+	if max <= 0 {
+		max = 5
+	}
+	var best []string
+	for _, term := range terms {
+		if len(best) == max {
+			break
+		}
+		redundant := false
+		for _, b := range best {
+			if strings.HasPrefix(b, term) || strings.HasPrefix(term, b) {
+				redundant = true
+				break
+			}
+		}
+		if !redundant {
+			best = append(best, term)
+		}
+	}
+	return best
+}
+
+func (s *DefSuggestions) add(term string, dist int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.byTerm == nil {
+		s.byTerm = map[string]int{}
+	}
+	if d, present := s.byTerm[term]; !present || dist < d {
+		s.byTerm[term] = dist
+	}
+}
+
+type suggestionsByRank struct {
+	terms []string
+	dist  map[string]int
+	qlen  int
+}
+
+func (v suggestionsByRank) Len() int      { return len(v.terms) }
+func (v suggestionsByRank) Swap(i, j int) { v.terms[i], v.terms[j] = v.terms[j], v.terms[i] }
+func (v suggestionsByRank) Less(i, j int) bool {
+	a, b := v.terms[i], v.terms[j]
+	if v.dist[a] != v.dist[b] {
+		return v.dist[a] < v.dist[b]
+	}
+	if da, db := absInt(len(a)-v.qlen), absInt(len(b)-v.qlen); da != db {
+		return da < db
+	}
+	return a < b
+}
+
+func absInt(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// ByDefQuerySuggest is like ByDefQuery, but if a def query index has
+// no matches for q, it records corrections of q in s (see
+// DefSuggestions). It panics if q is empty or s is nil.
+func ByDefQuerySuggest(q string, s *DefSuggestions) interface {
+	DefFilter
+	ByDefQueryFilter
+} {
+	if q == "" {
+		panic("ByDefQuerySuggest: empty")
+	}
+	if s == nil {
+		panic("ByDefQuerySuggest: nil DefSuggestions")
+	}
+	s.mu.Lock()
+	s.qlen = len(strings.ToLower(q))
+	s.mu.Unlock()
+	return &byDefQuerySuggestFilter{byDefQueryFilter: byDefQueryFilter(q), s: s}
+}
+
+// defQuerySuggester is implemented by def query filters that want
+// corrections of their query from the def query indexes that have no
+// matches for it.
+type defQuerySuggester interface {
+	// suggest records corrections of the query from the terms in t.
+	suggest(t *mafsa.MinTree)
+}
+
+type byDefQuerySuggestFilter struct {
+	byDefQueryFilter
+	s *DefSuggestions
+}
+
+func (f *byDefQuerySuggestFilter) String() string {
+	return fmt.Sprintf("ByDefQuerySuggest(%q)", string(f.byDefQueryFilter))
+}
+
+func (f *byDefQuerySuggestFilter) suggest(t *mafsa.MinTree) {
+	if t == nil {
+		return
+	}
+	q := []rune(strings.ToLower(string(f.byDefQueryFilter)))
+	max := f.s.maxEdits()
+
+	// Walk the MA-FSA, computing the edit distance between q and
+	// each prefix of its terms one row of the Levenshtein matrix at
+	// a time, and stop descending once every entry of the row
+	// exceeds max (because the entries never decrease below a node).
+	row := make([]int, len(q)+1)
+	for i := range row {
+		row[i] = i
+	}
+	var walk func(prefix []rune, n *mafsa.MinTreeNode, prev []int)
+	walk = func(prefix []rune, n *mafsa.MinTreeNode, prev []int) {
+		for _, c := range n.OrderedEdges() {
+			cur := make([]int, len(q)+1)
+			cur[0] = prev[0] + 1
+			min := cur[0]
+			for i := 1; i <= len(q); i++ {
+				cost := 1
+				if q[i-1] == c {
+					cost = 0
+				}
+				cur[i] = minInt(prev[i]+1, cur[i-1]+1, prev[i-1]+cost)
+				if cur[i] < min {
+					min = cur[i]
+				}
+			}
+			if min > max {
+				continue
+			}
+			p := append(prefix, c)
+			if cur[len(q)] <= max {
+				f.s.add(string(p), cur[len(q)])
+			}
+			walk(p, n.Edges[c], cur)
+		}
+	}
+	walk(make([]rune, 0, len(q)+max), t.Root, row)
+}
+
+func minInt(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
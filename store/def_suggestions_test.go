@@ -0,0 +1,71 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestByDefQuerySuggest(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+	useIndexedStore = true
+
+	mrs := NewFSMultiRepoStore(newTestFS(), nil)
+	for _, u := range []string{"u1", "u2"} {
+		data := graph.Output{Defs: []*graph.Def{
+			{DefKey: graph.DefKey{Path: u + "/a"}, Name: "HTTPServer", Exported: true},
+			{DefKey: graph.DefKey{Path: u + "/b"}, Name: "HTTPClient", Exported: true},
+			{DefKey: graph.DefKey{Path: u + "/c"}, Name: "Reader", Exported: true},
+		}}
+		if err := mrs.Import("r", "c", &unit.SourceUnit{Key: unit.Key{Type: "t", Name: u}}, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mrs.Index("r", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mrs.CreateVersion("r", "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		q       string
+		scope   []DefFilter
+		maxDist int
+		want    []string
+	}{
+		"tree index":      {q: "htpserver", want: []string{"httpserver"}},
+		"unit index":      {q: "htpserver", scope: []DefFilter{ByUnits(unit.ID2{Type: "t", Name: "u1"})}, want: []string{"httpserver"}},
+		"prefix":          {q: "rwad", want: []string{"read"}},
+		"max edits":       {q: "htpsrvr", maxDist: 1},
+		"more max edits":  {q: "htpsrvr", maxDist: 3, want: []string{"httpser"}},
+		"found (no sugg)": {q: "http"},
+	}
+	for label, test := range tests {
+		s := &DefSuggestions{MaxEdits: test.maxDist}
+		defs, err := mrs.Defs(append(test.scope, ByDefQuerySuggest(test.q, s))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.Terms(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got suggestions %q, want %q", label, got, test.want)
+		}
+		if test.want == nil {
+			continue
+		}
+		if len(defs) != 0 {
+			t.Errorf("%s: got %d defs, want none", label, len(defs))
+		}
+
+		// The best suggestion finds defs.
+		defs, err = mrs.Defs(append(test.scope, ByDefQuery(test.want[0]))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(defs) == 0 {
+			t.Errorf("%s: suggestion %q found no defs", label, test.want[0])
+		}
+	}
+}
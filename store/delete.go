@@ -0,0 +1,363 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/kr/fs"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// A RepoDeleter removes imported srclib build data from a RepoStore.
+type RepoDeleter interface {
+	// Delete removes the version entry and all of the data of the
+	// tree at commitID. The version entry is removed first, so the
+	// tree's data is no longer visible to queries even if removing
+	// its data files fails.
+	Delete(commitID string) error
+
+	// DeleteUnit removes the data of exactly one source unit (which
+	// must have been imported) from the tree at commitID, and
+	// rebuilds the tree's indexes (if they were built) without it.
+	// The data of the tree's other source units is not rewritten.
+	DeleteUnit(commitID string, u unit.ID2) error
+}
+
+// A MultiRepoDeleter removes imported srclib build data from a
+// MultiRepoStore.
+type MultiRepoDeleter interface {
+	// Delete removes the version entry and all of the data of the
+	// tree at commitID in repo (see RepoDeleter.Delete).
+	Delete(repo, commitID string) error
+
+	// DeleteUnit removes the data of exactly one source unit from
+	// the tree at commitID in repo (see RepoDeleter.DeleteUnit).
+	DeleteUnit(repo, commitID string, u unit.ID2) error
+
+	// DeleteRepo removes all of the versions and data of repo, so
+	// that it is no longer listed by Repos.
+	DeleteRepo(repo string) error
+}
+
+func (s *fsMultiRepoStore) Delete(repo, commitID string) error {
+	return s.removeVersion(s.redirectRepo(graph.NormalizeRepoURI(repo)), commitID)
+}
+
+func (s *fsMultiRepoStore) removeVersion(repo, commitID string) error {
+	defer s.wrote()
+	repo = graph.NormalizeRepoURI(repo)
+	rs := s.openRepoStore(repo).(*fsRepoStore)
+
+	// Remove the tree's source units from the dependents of the
+	// repos they refer to.
+	units, err := rs.newTreeStore(commitID).Units()
+	if err != nil && !isStoreNotExist(err) {
+		return err
+	}
+	for _, u := range units {
+		prevDeps, err := s.externalRefsByRepo(repo, commitID, u.ID2())
+		if err != nil {
+			return err
+		}
+		if err := s.updateDependents(repo, commitID, u.ID2(), prevDeps, nil); err != nil {
+			return err
+		}
+	}
+
+	if err := s.invalidateFileNamesIndex(); err != nil {
+		return err
+	}
+	if err := s.unshareTree(repo, commitID); err != nil {
+		return err
+	}
+	if err := s.removeUnitTypeHints(repo, commitID); err != nil {
+		return err
+	}
+	if err := rs.removeVersion(commitID); err != nil {
+		return err
+	}
+	if _, err := s.fs.Stat(s.repoPath(repo)); os.IsNotExist(err) {
+		return nil
+	}
+	return s.UpdateUsage(repo, commitID)
+}
+
+// removeVersion removes the tree's version entry (if any) and all of
+// its data files.
+func (s *fsRepoStore) removeVersion(commitID string) error {
+	if err := s.fs.Remove(s.fs.Join(versionsDir, commitID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var files, dirs []string
+	w := fs.WalkFS(commitID, rwvfs.Walkable(s.fs))
+	for w.Step() {
+		if err := w.Err(); err != nil {
+			if os.IsNotExist(err) {
+				return nil // the tree has no data
+			}
+			return err
+		}
+		if w.Stat().IsDir() {
+			dirs = append(dirs, w.Path())
+		} else {
+			files = append(files, w.Path())
+		}
+	}
+	for _, f := range files {
+		if err := s.fs.Remove(f); err != nil {
+			return err
+		}
+	}
+	// Remove the dirs deepest first. Some VFSs don't have real dirs
+	// (and remove them along with their last file).
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := s.fs.Remove(dirs[i]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fsMultiRepoStore) DeleteUnit(repo, commitID string, u unit.ID2) error {
+	defer s.wrote()
+	repo = s.redirectRepo(graph.NormalizeRepoURI(repo))
+	rs := s.openRepoStore(repo).(*fsRepoStore)
+	if err := s.invalidateFileNamesIndex(); err != nil {
+		return err
+	}
+	prevDeps, err := s.externalRefsByRepo(repo, commitID, u)
+	if err != nil {
+		return err
+	}
+	if err := rs.deleteUnit(commitID, u); err != nil {
+		return err
+	}
+	if err := s.updateDependents(repo, commitID, u, prevDeps, nil); err != nil {
+		return err
+	}
+	if s.ShareUnitData {
+		if err := s.unshareDir(repo, path.Join(commitID, unitDataDir(u))); err != nil {
+			return err
+		}
+	}
+	if err := s.setUnitTypeHints(repo, commitID); err != nil {
+		return err
+	}
+	// Finalize the tree again (see ImportUnit).
+	if _, err := s.WriteTreeManifest(repo, commitID); err != nil && err != errTreeNoInit {
+		return err
+	}
+	return s.UpdateUsage(repo, commitID)
+}
+
+func (s *fsMultiRepoStore) DeleteRepo(repo string) error {
+	defer s.wrote()
+	repo = s.redirectRepo(graph.NormalizeRepoURI(repo))
+	rs := s.openRepoStore(repo).(*fsRepoStore)
+
+	// Remove each tree individually (including those whose versions
+	// haven't been created yet) so that the repo's source units are
+	// removed from the dependents of the repos they refer to.
+	commitIDs, err := rs.allCommitIDs()
+	if err != nil {
+		return err
+	}
+	for _, commitID := range commitIDs {
+		if err := s.removeVersion(repo, commitID); err != nil {
+			return err
+		}
+	}
+	if err := removeTreeIfExists(s.fs, s.repoPath(repo)); err != nil {
+		return err
+	}
+	return s.invalidateFileNamesIndex()
+}
+
+func (s *fsRepoStore) Delete(commitID string) error {
+	if err := s.removeVersion(commitID); err != nil {
+		return err
+	}
+	if _, err := s.fs.Stat("."); os.IsNotExist(err) {
+		return nil
+	}
+	return s.UpdateUsage(commitID)
+}
+
+func (s *fsRepoStore) DeleteUnit(commitID string, u unit.ID2) error {
+	if err := s.deleteUnit(commitID, u); err != nil {
+		return err
+	}
+	return s.UpdateUsage(commitID)
+}
+
+// deleteUnit removes a source unit's data from a tree and rebuilds
+// the tree's indexes (if they were built) without it.
+func (s *fsRepoStore) deleteUnit(commitID string, u unit.ID2) error {
+	ts := s.newTreeStore(commitID)
+	units, err := ts.Units(ByUnits(u))
+	if err != nil && !isStoreNotExist(err) {
+		return err
+	}
+	if len(units) == 0 {
+		return errUnitNotInTree(commitID, u)
+	}
+
+	var (
+		fts   *fsTreeStore
+		built map[string]Index
+	)
+	switch ts := ts.(type) {
+	case *indexedTreeStore:
+		fts = ts.fsTreeStore
+
+		// Remove the tree's indexes before the unit, so that queries
+		// made until they are rebuilt fall back to scans instead of
+		// following the indexes to the removed unit (and so that no
+		// stale indexes are left behind if rebuilding them fails).
+		built, err = ts.removeBuiltIndexes()
+		if err != nil {
+			return err
+		}
+	case *fsTreeStore:
+		fts = ts
+	}
+	if err := fts.deleteUnit(u); err != nil {
+		return err
+	}
+
+	// Rebuild the tree indexes that were built for the tree (see
+	// ImportUnit).
+	if len(built) == 0 {
+		return nil
+	}
+	xs := ts.(*indexedTreeStore)
+	defer cacheRemove(xs.StoreKey())
+	return xs.buildIndexes(built, nil, nil, nil)
+}
+
+// removeBuiltIndexes removes the files of the tree's indexes that
+// were built (and their cached copies), and returns those indexes.
+func (s *indexedTreeStore) removeBuiltIndexes() (map[string]Index, error) {
+	built := map[string]Index{}
+	for name, x := range s.Indexes() {
+		if _, err := s.statIndex(name); err == nil {
+			built[name] = x
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	for name := range built {
+		if err := s.fs.Remove(fmt.Sprintf(indexFilename, name)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	cacheRemove(s.StoreKey())
+	return built, nil
+}
+
+// allCommitIDs returns the commit IDs of all of the repo's trees,
+// including those whose versions haven't been created yet and
+// versions whose trees have no data.
+func (s *fsRepoStore) allCommitIDs() ([]string, error) {
+	dirs, err := s.listAllVersions_old()
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	entries, err := s.fs.ReadDir(versionsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	seen := make(map[string]struct{}, len(dirs))
+	for _, dir := range dirs {
+		seen[dir] = struct{}{}
+	}
+	for _, e := range entries {
+		if _, present := seen[e.Name()]; !present {
+			dirs = append(dirs, e.Name())
+		}
+	}
+	return dirs, nil
+}
+
+// deleteUnit removes a source unit's definition file and data files
+// from the tree. The unit is no longer listed by Units (and so no
+// longer visible to queries) once its definition file is removed,
+// which happens before its data files are removed.
+func (s *fsTreeStore) deleteUnit(u unit.ID2) error {
+	if err := s.invalidateContentDigest(); err != nil {
+		return err
+	}
+	if err := s.invalidateDefRefCounts(); err != nil {
+		return err
+	}
+	if err := s.invalidateIndexCheckpoint(); err != nil {
+		return err
+	}
+	dir := s.unitDir(u)
+	if err := s.fs.Remove(dir + unitFileSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return removeTreeIfExists(rwvfs.Walkable(s.fs), dir)
+}
+
+func (s *memoryMultiRepoStore) Delete(repo, commitID string) error {
+	rs, present := s.repos[repo]
+	if !present {
+		return nil
+	}
+	return rs.Delete(commitID)
+}
+
+func (s *memoryMultiRepoStore) DeleteUnit(repo, commitID string, u unit.ID2) error {
+	rs, present := s.repos[repo]
+	if !present {
+		return errUnitNotInTree(commitID, u)
+	}
+	return rs.DeleteUnit(commitID, u)
+}
+
+func (s *memoryMultiRepoStore) DeleteRepo(repo string) error {
+	delete(s.repos, repo)
+	return nil
+}
+
+func (s *memoryRepoStore) Delete(commitID string) error {
+	versions := s.versions[:0]
+	for _, v := range s.versions {
+		if v.CommitID != commitID {
+			versions = append(versions, v)
+		}
+	}
+	s.versions = versions
+	delete(s.trees, commitID)
+	return nil
+}
+
+func (s *memoryRepoStore) DeleteUnit(commitID string, u unit.ID2) error {
+	ts, present := s.trees[commitID]
+	if !present || ts.data[u] == nil {
+		return errUnitNotInTree(commitID, u)
+	}
+	for i, u2 := range ts.units {
+		if u2.ID2() == u {
+			ts.units = append(ts.units[:i], ts.units[i+1:]...)
+			break
+		}
+	}
+	delete(ts.data, u)
+	return nil
+}
+
+var (
+	_ RepoDeleter      = (*fsRepoStore)(nil)
+	_ RepoDeleter      = (*memoryRepoStore)(nil)
+	_ MultiRepoDeleter = (*fsMultiRepoStore)(nil)
+	_ MultiRepoDeleter = (*memoryMultiRepoStore)(nil)
+)
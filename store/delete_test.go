@@ -0,0 +1,200 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestFSMultiRepoStore_DeleteUnit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srclib-delete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mrs := NewFSMultiRepoStore(NewHardLinkOSFS(dir), &FSMultiRepoStoreConf{ShareUnitData: true}).(*fsMultiRepoStore)
+
+	u1 := &unit.SourceUnit{Key: unit.Key{Type: "t1", Name: "u1"}}
+	u2 := &unit.SourceUnit{Key: unit.Key{Type: "t2", Name: "u2"}}
+	for _, u := range []*unit.SourceUnit{u1, u2} {
+		data := graph.Output{
+			Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}, Name: u.Name}},
+			Refs: []*graph.Ref{{DefRepo: "d", DefUnitType: "t", DefUnit: "x", DefPath: "p", File: "f", Start: 1, End: 2}},
+		}
+		if err := mrs.Import("r", "c", u, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mrs.Index("r", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mrs.CreateVersion("r", "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mrs.DeleteUnit("r", "c", u1.ID2()); err != nil {
+		t.Fatal(err)
+	}
+
+	defs, err := mrs.Defs(ByRepoCommitIDs(Version{Repo: "r", CommitID: "c"}), ByDefQuery("u"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 1 || defs[0].Name != "u2" {
+		t.Errorf("got defs %v, want only u2's def", defs)
+	}
+	deps, err := mrs.Dependents("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []*Dependent{{Repo: "r", CommitID: "c", Units: 1, Refs: 1}}; !reflect.DeepEqual(deps, want) {
+		t.Errorf("got dependents %+v, want %+v", deps, want)
+	}
+	hints, err := mrs.openRepoStore("r").(*fsRepoStore).readUnitTypeHints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"t2"}; !reflect.DeepEqual(hints["c"], want) {
+		t.Errorf("got unit type hints %v, want %v", hints["c"], want)
+	}
+	refs, err := mrs.readSharedDataRefs("r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file := range refs {
+		if strings.HasPrefix(file, "c/"+unitDataDir(u1.ID2())+"/") {
+			t.Errorf("deleted unit's file %s is still shared", file)
+		}
+	}
+	if len(refs) == 0 {
+		t.Error("remaining unit's files are not shared")
+	}
+	if _, err := mrs.VerifyTreeManifest("r", "c"); err != nil {
+		t.Errorf("tree manifest was not rewritten: %s", err)
+	}
+
+	if err := mrs.DeleteUnit("r", "c", u1.ID2()); err == nil {
+		t.Error("DeleteUnit of deleted unit: no error")
+	}
+}
+
+// TestFSRepoStore_deleteUnit_removesIndexesFirst tests that the tree
+// indexes are removed before the unit's data, so that queries made
+// while the unit is being deleted fall back to scans.
+func TestFSRepoStore_deleteUnit_removesIndexesFirst(t *testing.T) {
+	mrs := NewFSMultiRepoStore(rwvfs.Walkable(rwvfs.Map(map[string]string{})), nil).(*fsMultiRepoStore)
+	u1 := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u1"}, Files: []string{"f1"}}
+	u2 := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u2"}, Files: []string{"f2"}}
+	for _, u := range []*unit.SourceUnit{u1, u2} {
+		data := graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}, Name: u.Name, File: u.Files[0]}}}
+		if err := mrs.Import("r", "c", u, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mrs.Index("r", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mrs.CreateVersion("r", "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	rs := mrs.openRepoStore("r").(*fsRepoStore)
+	xs := rs.newTreeStore("c").(*indexedTreeStore)
+	built, err := xs.removeBuiltIndexes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(built) == 0 {
+		t.Fatal("no tree indexes were built")
+	}
+	if err := xs.fsTreeStore.deleteUnit(u1.ID2()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Query through the indexed tree store before the indexes are
+	// rebuilt.
+	for name := range built {
+		if _, err := xs.statIndex(name); !os.IsNotExist(err) {
+			t.Errorf("%s: got stat error %v, want not-exist", name, err)
+		}
+	}
+	ts := rs.newTreeStore("c")
+	for _, f := range []DefFilter{ByDefQuery("u"), ByFiles(false, "f1", "f2")} {
+		defs, err := ts.Defs(f)
+		if err != nil {
+			t.Fatalf("%v: %s", f, err)
+		}
+		if len(defs) != 1 || defs[0].Name != "u2" {
+			t.Errorf("%v: got defs %v, want only u2's def", f, defs)
+		}
+	}
+	units, err := ts.Units(ByFiles(false, "f1", "f2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(units) != 1 || units[0].Name != "u2" {
+		t.Errorf("got units %v, want only u2", units)
+	}
+
+	if err := xs.buildIndexes(built, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for name := range built {
+		if _, err := xs.statIndex(name); err != nil {
+			t.Errorf("%s: index was not rebuilt: %s", name, err)
+		}
+	}
+}
+
+func TestFSMultiRepoStore_DeleteRepo(t *testing.T) {
+	mrs := NewFSMultiRepoStore(newTestFS(), nil).(*fsMultiRepoStore)
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
+	refs := []*graph.Ref{{DefRepo: "d", DefUnitType: "t", DefUnit: "x", DefPath: "p", File: "f", Start: 1, End: 2}}
+	for _, v := range []Version{{Repo: "a", CommitID: "c1"}, {Repo: "a", CommitID: "c2"}, {Repo: "b", CommitID: "c"}} {
+		if err := mrs.Import(v.Repo, v.CommitID, u, graph.Output{Refs: refs}); err != nil {
+			t.Fatal(err)
+		}
+		// Leave a's c2 unversioned, as if its import were
+		// interrupted.
+		if v.CommitID != "c2" {
+			if err := mrs.CreateVersion(v.Repo, v.CommitID); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := mrs.DeleteRepo("a"); err != nil {
+		t.Fatal(err)
+	}
+	if repos, err := mrs.Repos(); err != nil {
+		t.Fatal(err)
+	} else if want := []string{"b"}; !reflect.DeepEqual(repos, want) {
+		t.Errorf("got repos %v, want %v", repos, want)
+	}
+	deps, err := mrs.Dependents("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []*Dependent{{Repo: "b", CommitID: "c", Units: 1, Refs: 1}}; !reflect.DeepEqual(deps, want) {
+		t.Errorf("got dependents %+v, want %+v", deps, want)
+	}
+
+	// A deleted repo can be imported again.
+	if err := mrs.Import("a", "c1", u, graph.Output{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mrs.CreateVersion("a", "c1"); err != nil {
+		t.Fatal(err)
+	}
+	if units, err := mrs.Units(ByRepos("a")); err != nil {
+		t.Fatal(err)
+	} else if len(units) != 1 {
+		t.Errorf("got units %v after reimport, want 1", units)
+	}
+}
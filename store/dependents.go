@@ -0,0 +1,280 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/kr/fs"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// A Dependent is a tree (in another repo) that has refs to defs in a
+// repo.
+type Dependent struct {
+	// Repo and CommitID identify the dependent tree. A repo with
+	// multiple trees that refer to the repo is listed once per tree.
+	Repo, CommitID string
+
+	// Units is the number of source units in the tree that have refs
+	// to defs in the repo.
+	Units int
+
+	// Refs is the total number of refs in the tree to defs in the
+	// repo.
+	Refs int
+}
+
+// A MultiRepoDependents reports which repos in a multi-repo store
+// depend on (i.e., have refs to defs in) a repo.
+//
+// The dependents of each repo are recorded as source units are
+// imported into the multi-repo store, using the same counts as
+// MultiRepoExternalRefs. Data that was imported before the dependents
+// were recorded (or directly into a repo's store) is only reflected
+// after RebuildDependents is called.
+type MultiRepoDependents interface {
+	// Dependents returns the trees (in other repos) that have refs to
+	// defs in repo, sorted by repo and commit ID. The repo need not
+	// exist in the store.
+	Dependents(repo string) ([]*Dependent, error)
+
+	// RebuildDependents recomputes the dependents of all repos from
+	// the external refs summaries of all source units in the store.
+	RebuildDependents() error
+}
+
+// dependentsDir is the dir (in a multi-repo store's VFS) that holds
+// the dependents of each repo. It begins with a "." so that it isn't
+// listed as a repo.
+const dependentsDir = ".srclib-dependents"
+
+// dependentUnit is the number of refs in a single dependent source
+// unit to defs in a repo. A repo's dependents file is a list of
+// dependentUnits.
+type dependentUnit struct {
+	Repo, CommitID, UnitType, Unit string
+	Refs                           int
+}
+
+func (u *dependentUnit) sameUnit(repo, commitID string, u2 unit.ID2) bool {
+	return u.Repo == repo && u.CommitID == commitID && u.UnitType == u2.Type && u.Unit == u2.Name
+}
+
+type dependentUnitsByID []*dependentUnit
+
+func (v dependentUnitsByID) Len() int { return len(v) }
+func (v dependentUnitsByID) Less(i, j int) bool {
+	a, b := v[i], v[j]
+	if a.Repo != b.Repo {
+		return a.Repo < b.Repo
+	}
+	if a.CommitID != b.CommitID {
+		return a.CommitID < b.CommitID
+	}
+	if a.UnitType != b.UnitType {
+		return a.UnitType < b.UnitType
+	}
+	return a.Unit < b.Unit
+}
+func (v dependentUnitsByID) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+
+func dependentsFilename(repo string) string {
+	return path.Join(dependentsDir, encodeStorePath(repo)+".json")
+}
+
+func (s *fsMultiRepoStore) readDependentUnits(repo string) ([]*dependentUnit, error) {
+	f, err := s.fs.Open(dependentsFilename(repo))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var units []*dependentUnit
+	if err := json.NewDecoder(f).Decode(&units); err != nil {
+		return nil, fmt.Errorf("reading dependents of repo %s: %s", repo, err)
+	}
+	return units, nil
+}
+
+func (s *fsMultiRepoStore) writeDependentUnits(repo string, units []*dependentUnit) (err error) {
+	filename := dependentsFilename(repo)
+	if len(units) == 0 {
+		if err := s.fs.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := rwvfs.MkdirAll(s.fs, path.Dir(filename)); err != nil {
+		return err
+	}
+	sort.Sort(dependentUnitsByID(units))
+	f, err := s.fs.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := f.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+	return json.NewEncoder(f).Encode(units)
+}
+
+func (s *fsMultiRepoStore) Dependents(repo string) ([]*Dependent, error) {
+	repo = graph.NormalizeRepoURI(repo)
+	s.dependentsMu.Lock()
+	units, err := s.readDependentUnits(repo)
+	s.dependentsMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// The units are sorted by repo and commit ID, so each tree's
+	// units are adjacent.
+	s.tombstonesMu.Lock()
+	hidden, err := s.readTombstones()
+	s.tombstonesMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var deps []*Dependent
+	for _, u := range units {
+		if _, present := hidden[u.Repo]; present {
+			continue
+		}
+		if len(deps) == 0 || deps[len(deps)-1].Repo != u.Repo || deps[len(deps)-1].CommitID != u.CommitID {
+			deps = append(deps, &Dependent{Repo: u.Repo, CommitID: u.CommitID})
+		}
+		d := deps[len(deps)-1]
+		d.Units++
+		d.Refs += u.Refs
+	}
+	return deps, nil
+}
+
+// externalRefsByRepo returns the number of refs to defs in each other
+// repo from a source unit, as summarized when the unit was imported.
+// If the unit doesn't exist, it returns nil.
+func (s *fsMultiRepoStore) externalRefsByRepo(repo, commitID string, u unit.ID2) (map[string]int, error) {
+	ts := s.openRepoStore(repo).(*fsRepoStore).newTreeStore(commitID)
+	counts, err := ts.(TreeExternalRefs).ExternalRefs("", ByUnits(u))
+	if isStoreNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	byRepo := map[string]int{}
+	for _, c := range counts {
+		byRepo[c.Def.DefRepo] += c.Count
+	}
+	return byRepo, nil
+}
+
+// updateDependents records that a source unit (in repo) has the given
+// number of refs to defs in each other repo, replacing the counts
+// that were recorded for it (in the dependents of the repos in prev)
+// when it was previously imported.
+func (s *fsMultiRepoStore) updateDependents(repo, commitID string, u unit.ID2, prev, cur map[string]int) error {
+	s.dependentsMu.Lock()
+	defer s.dependentsMu.Unlock()
+	defRepos := make(map[string]struct{}, len(prev)+len(cur))
+	for defRepo := range prev {
+		defRepos[defRepo] = struct{}{}
+	}
+	for defRepo := range cur {
+		defRepos[defRepo] = struct{}{}
+	}
+	for defRepo := range defRepos {
+		units, err := s.readDependentUnits(defRepo)
+		if err != nil {
+			return err
+		}
+		units2 := units[:0]
+		for _, du := range units {
+			if !du.sameUnit(repo, commitID, u) {
+				units2 = append(units2, du)
+			}
+		}
+		if n := cur[defRepo]; n > 0 {
+			units2 = append(units2, &dependentUnit{Repo: repo, CommitID: commitID, UnitType: u.Type, Unit: u.Name, Refs: n})
+		}
+		if err := s.writeDependentUnits(defRepo, units2); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fsMultiRepoStore) RebuildDependents() error {
+	repos, err := s.Repos()
+	if err != nil {
+		return err
+	}
+	deps := map[string][]*dependentUnit{}
+	for _, repo := range repos {
+		rs := s.openRepoStore(repo).(*fsRepoStore)
+		commitIDs, err := rs.listAllVersions_old()
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, commitID := range commitIDs {
+			counts, err := rs.newTreeStore(commitID).(TreeExternalRefs).ExternalRefs("")
+			if err != nil {
+				return err
+			}
+			for _, c := range counts {
+				units := deps[c.Def.DefRepo]
+				if n := len(units); n > 0 && units[n-1].sameUnit(repo, commitID, unit.ID2{Type: c.UnitType, Name: c.Unit}) {
+					units[n-1].Refs += c.Count
+					continue
+				}
+				deps[c.Def.DefRepo] = append(units, &dependentUnit{Repo: repo, CommitID: commitID, UnitType: c.UnitType, Unit: c.Unit, Refs: c.Count})
+			}
+		}
+	}
+
+	s.dependentsMu.Lock()
+	defer s.dependentsMu.Unlock()
+	if err := s.removeAllDependents(); err != nil {
+		return err
+	}
+	for defRepo, units := range deps {
+		if err := s.writeDependentUnits(defRepo, units); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeAllDependents removes all of the dependents files.
+func (s *fsMultiRepoStore) removeAllDependents() error {
+	if _, err := s.fs.Stat(dependentsDir); os.IsNotExist(err) {
+		return nil
+	}
+	var files []string
+	w := fs.WalkFS(dependentsDir, rwvfs.Walkable(s.fs))
+	for w.Step() {
+		if err := w.Err(); err != nil {
+			return err
+		}
+		if w.Stat().Mode().IsRegular() {
+			files = append(files, w.Path())
+		}
+	}
+	for _, file := range files {
+		if err := s.fs.Remove(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ MultiRepoDependents = (*fsMultiRepoStore)(nil)
@@ -0,0 +1,80 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestFSMultiRepoStore_Dependents(t *testing.T) {
+	u1 := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u1"}}
+	u2 := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u2"}}
+	refsTo := func(defRepo string, n int) []*graph.Ref {
+		refs := make([]*graph.Ref, n)
+		for i := range refs {
+			refs[i] = &graph.Ref{DefRepo: defRepo, DefUnitType: "t", DefUnit: "x", DefPath: "p", File: "f", Start: uint32(i), End: uint32(i + 1)}
+		}
+		return refs
+	}
+
+	mrs := NewFSMultiRepoStore(newTestFS(), nil)
+	imp := func(repo, commitID string, u *unit.SourceUnit, refs []*graph.Ref) {
+		if err := mrs.Import(repo, commitID, u, graph.Output{Refs: refs}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	imp("a", "c1", u1, append(refsTo("d", 2), refsTo("e", 1)...))
+	imp("a", "c1", u2, refsTo("d", 3))
+	imp("a", "c2", u1, refsTo("d", 1))
+	imp("b", "c", u1, append(refsTo("d", 1), refsTo("b", 5)...))
+	imp("d", "c", u1, refsTo("a", 1))
+
+	check := func(label string, want map[string][]*Dependent) {
+		for repo, wantDeps := range want {
+			deps, err := mrs.(MultiRepoDependents).Dependents(repo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(deps, wantDeps) {
+				t.Errorf("%s: repo %s: got dependents %+v, want %+v", label, repo, deps, wantDeps)
+			}
+		}
+	}
+	want := map[string][]*Dependent{
+		"d": {
+			{Repo: "a", CommitID: "c1", Units: 2, Refs: 5},
+			{Repo: "a", CommitID: "c2", Units: 1, Refs: 1},
+			{Repo: "b", CommitID: "c", Units: 1, Refs: 1},
+		},
+		"e": {{Repo: "a", CommitID: "c1", Units: 1, Refs: 1}},
+		"a": {{Repo: "d", CommitID: "c", Units: 1, Refs: 1}},
+		"b": nil,
+		"x": nil,
+	}
+	check("after import", want)
+
+	// Reimporting a unit replaces its counts.
+	imp("a", "c1", u1, refsTo("d", 4))
+	want["d"][0] = &Dependent{Repo: "a", CommitID: "c1", Units: 2, Refs: 7}
+	want["e"] = nil
+	check("after reimport", want)
+
+	// Rebuilding the dependents (e.g., after they were lost)
+	// recomputes them from the units' external refs.
+	fsMRS := mrs.(*fsMultiRepoStore)
+	if err := fsMRS.removeAllDependents(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsMRS.RebuildDependents(); err != nil {
+		t.Fatal(err)
+	}
+	check("after rebuild", want)
+
+	if repos, err := mrs.Repos(); err != nil {
+		t.Fatal(err)
+	} else if wantRepos := []string{"a", "b", "d"}; !reflect.DeepEqual(repos, wantRepos) {
+		t.Errorf("got repos %v, want %v", repos, wantRepos)
+	}
+}
@@ -0,0 +1,410 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/alecthomas/binary"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// A DefDeprecation marks a def as deprecated in a tree's deprecations
+// overlay. The overlay marks defs as deprecated without reimporting
+// them (e.g., for defs whose toolchain doesn't report deprecations;
+// see graph.Def.Deprecation).
+type DefDeprecation struct {
+	UnitType, Unit, Path string
+
+	// Message optionally describes what to use instead of the def.
+	Message string `json:",omitempty"`
+}
+
+// A TreeDeprecations manages a tree's deprecations overlay.
+type TreeDeprecations interface {
+	// Deprecations returns the defs that are marked deprecated in the
+	// tree's overlay.
+	Deprecations() ([]*DefDeprecation, error)
+
+	// SetDeprecations replaces the tree's overlay. Defs that are
+	// deprecated in their imported data remain deprecated.
+	SetDeprecations([]*DefDeprecation) error
+}
+
+// A RepoDeprecations manages the deprecations overlays of a repo's
+// trees.
+type RepoDeprecations interface {
+	Deprecations(commitID string) ([]*DefDeprecation, error)
+	SetDeprecations(commitID string, deps []*DefDeprecation) error
+}
+
+// A MultiRepoDeprecations manages the deprecations overlays of trees in
+// multiple repos.
+type MultiRepoDeprecations interface {
+	Deprecations(repo, commitID string) ([]*DefDeprecation, error)
+	SetDeprecations(repo, commitID string, deps []*DefDeprecation) error
+
+	// DeprecatedRefs reports the remaining refs (in the tree and in
+	// the trees that depend on its repo) to each deprecated def in a
+	// tree.
+	DeprecatedRefs(repo, commitID string) ([]*DeprecatedDefRefs, error)
+}
+
+// DeprecatedDefRefs describes the refs to a deprecated def.
+type DeprecatedDefRefs struct {
+	Def     graph.DefKey
+	Message string `json:",omitempty"`
+
+	// Refs is the total number of refs to the def.
+	Refs int
+
+	// Trees are the trees that contain refs to the def (see
+	// ImpactReport).
+	Trees []*TreeImpact
+}
+
+// ByDeprecatedFilter is implemented by filters that restrict their
+// selection to deprecated defs.
+type ByDeprecatedFilter interface {
+	ByDeprecated() bool
+}
+
+// ByDeprecated returns a filter that selects deprecated defs: those
+// that are marked deprecated in their data (see
+// graph.Def.Deprecation) or in their tree's deprecations overlay (if
+// the store supports overlays).
+func ByDeprecated() interface {
+	DefFilter
+	ByDeprecatedFilter
+} {
+	return &byDeprecatedFilter{}
+}
+
+type byDeprecatedFilter struct {
+	// overlay is the tree's deprecations overlay (the deprecated def
+	// paths in each unit). It is set by the tree store (see
+	// fsTreeStore.withDeprecations).
+	overlay map[unit.ID2]map[string]struct{}
+
+	// unitOverlay is the deprecated def paths in the unit that the
+	// filter is applied to (see filtersForUnit).
+	unitOverlay map[string]struct{}
+}
+
+func (f *byDeprecatedFilter) String() string     { return "ByDeprecated" }
+func (f *byDeprecatedFilter) ByDeprecated() bool { return true }
+func (f *byDeprecatedFilter) SelectDef(def *graph.Def) bool {
+	if deprecated, _ := def.Deprecation(); deprecated {
+		return true
+	}
+	if f.unitOverlay != nil {
+		_, present := f.unitOverlay[def.Path]
+		return present
+	}
+	if f.overlay != nil {
+		_, present := f.overlay[unit.ID2{Type: def.UnitType, Name: def.Unit}][def.Path]
+		return present
+	}
+	return false
+}
+
+// forUnit returns a copy of the filter to apply to defs in unit u
+// (whose UnitType and Unit fields are empty).
+func (f *byDeprecatedFilter) forUnit(u unit.ID2) *byDeprecatedFilter {
+	paths := f.overlay[u]
+	if paths == nil {
+		paths = map[string]struct{}{}
+	}
+	return &byDeprecatedFilter{unitOverlay: paths}
+}
+
+// hasUnitOverlay reports whether the filter selects defs in the
+// overlay (in addition to those deprecated in their data).
+func (f *byDeprecatedFilter) hasUnitOverlay() bool { return len(f.unitOverlay) > 0 }
+
+// deprecationsFilename is the name of the file (in a tree's dir) that
+// holds the tree's deprecations overlay.
+const deprecationsFilename = "deprecations.json"
+
+func (s *fsTreeStore) Deprecations() ([]*DefDeprecation, error) {
+	f, err := s.fs.Open(deprecationsFilename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var deps []*DefDeprecation
+	if err := json.NewDecoder(f).Decode(&deps); err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", deprecationsFilename, err)
+	}
+	return deps, nil
+}
+
+func (s *fsTreeStore) SetDeprecations(deps []*DefDeprecation) (err error) {
+	for _, d := range deps {
+		if d.UnitType == "" || d.Unit == "" || d.Path == "" {
+			return fmt.Errorf("deprecation %+v: UnitType, Unit, and Path must be set", d)
+		}
+	}
+	if _, err := s.fs.Stat("."); err != nil {
+		if os.IsNotExist(err) {
+			return errTreeNoInit
+		}
+		return err
+	}
+	if err := s.invalidateContentDigest(); err != nil {
+		return err
+	}
+	if len(deps) == 0 {
+		if err := s.fs.Remove(deprecationsFilename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	deps = append([]*DefDeprecation(nil), deps...)
+	sort.Sort(defDeprecationsByKey(deps))
+	f, err := s.fs.Create(deprecationsFilename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := f.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+	return json.NewEncoder(f).Encode(deps)
+}
+
+type defDeprecationsByKey []*DefDeprecation
+
+func (v defDeprecationsByKey) Len() int { return len(v) }
+func (v defDeprecationsByKey) Less(i, j int) bool {
+	a, b := v[i], v[j]
+	if a.UnitType != b.UnitType {
+		return a.UnitType < b.UnitType
+	}
+	if a.Unit != b.Unit {
+		return a.Unit < b.Unit
+	}
+	return a.Path < b.Path
+}
+func (v defDeprecationsByKey) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+
+// withDeprecations returns a copy of fs whose ByDeprecated filters
+// also select the defs in the tree's deprecations overlay.
+func (s *fsTreeStore) withDeprecations(fs []DefFilter) ([]DefFilter, error) {
+	var overlay map[unit.ID2]map[string]struct{}
+	var fCopy []DefFilter
+	for i, f := range fs {
+		if f, ok := f.(*byDeprecatedFilter); !ok || f.overlay != nil || f.unitOverlay != nil {
+			continue
+		}
+		if overlay == nil {
+			deps, err := s.Deprecations()
+			if err != nil {
+				return nil, err
+			}
+			overlay = make(map[unit.ID2]map[string]struct{}, len(deps))
+			for _, d := range deps {
+				u := unit.ID2{Type: d.UnitType, Name: d.Unit}
+				if overlay[u] == nil {
+					overlay[u] = map[string]struct{}{}
+				}
+				overlay[u][d.Path] = struct{}{}
+			}
+			fCopy = make([]DefFilter, len(fs))
+			copy(fCopy, fs)
+		}
+		fCopy[i] = &byDeprecatedFilter{overlay: overlay}
+	}
+	if fCopy == nil {
+		return fs, nil
+	}
+	return fCopy, nil
+}
+
+func (s *fsTreeStore) Defs(fs ...DefFilter) ([]*graph.Def, error) {
+	fs, err := s.withDeprecations(fs)
+	if err != nil {
+		return nil, err
+	}
+	return s.unitStores.Defs(fs...)
+}
+
+func (s *fsRepoStore) Deprecations(commitID string) ([]*DefDeprecation, error) {
+	return s.newTreeStore(commitID).(TreeDeprecations).Deprecations()
+}
+
+func (s *fsRepoStore) SetDeprecations(commitID string, deps []*DefDeprecation) error {
+	return s.newTreeStore(commitID).(TreeDeprecations).SetDeprecations(deps)
+}
+
+func (s *fsMultiRepoStore) Deprecations(repo, commitID string) ([]*DefDeprecation, error) {
+	return s.openRepoStore(repo).(RepoDeprecations).Deprecations(commitID)
+}
+
+func (s *fsMultiRepoStore) SetDeprecations(repo, commitID string, deps []*DefDeprecation) error {
+	defer s.wrote()
+	if err := s.CheckImportAllowed(repo, commitID); err != nil {
+		return err
+	}
+	return s.openRepoStore(repo).(RepoDeprecations).SetDeprecations(commitID, deps)
+}
+
+func (s *fsMultiRepoStore) DeprecatedRefs(repo, commitID string) ([]*DeprecatedDefRefs, error) {
+	repo = graph.NormalizeRepoURI(repo)
+	defs, err := s.Defs(ByRepoCommitIDs(Version{Repo: repo, CommitID: commitID}), ByDeprecated())
+	if err != nil {
+		return nil, err
+	}
+	deps, err := s.Deprecations(repo, commitID)
+	if err != nil {
+		return nil, err
+	}
+	messages := make(map[graph.DefKey]string, len(deps))
+	for _, d := range deps {
+		messages[graph.DefKey{UnitType: d.UnitType, Unit: d.Unit, Path: d.Path}] = d.Message
+	}
+
+	sort.Sort(defsByKey(defs))
+	report := make([]*DeprecatedDefRefs, len(defs))
+	for i, def := range defs {
+		_, msg := def.Deprecation()
+		if overlayMsg := messages[graph.DefKey{UnitType: def.UnitType, Unit: def.Unit, Path: def.Path}]; overlayMsg != "" {
+			msg = overlayMsg
+		}
+		key := graph.DefKey{Repo: repo, CommitID: commitID, UnitType: def.UnitType, Unit: def.Unit, Path: def.Path}
+		impact, err := s.Impact([]graph.DefKey{key})
+		if err != nil {
+			return nil, err
+		}
+		report[i] = &DeprecatedDefRefs{Def: key, Message: msg, Refs: impact.Refs, Trees: impact.Trees}
+	}
+	return report, nil
+}
+
+type defsByKey []*graph.Def
+
+func (v defsByKey) Len() int { return len(v) }
+func (v defsByKey) Less(i, j int) bool {
+	a, b := v[i], v[j]
+	if a.UnitType != b.UnitType {
+		return a.UnitType < b.UnitType
+	}
+	if a.Unit != b.Unit {
+		return a.Unit < b.Unit
+	}
+	return a.Path < b.Path
+}
+func (v defsByKey) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+
+const defDeprecatedIndexName = "def_deprecated"
+
+// defDeprecatedIndex makes it fast to find the defs (within a source
+// unit) that are marked deprecated in their data. It doesn't cover
+// queries in units with deprecations in their tree's overlay.
+type defDeprecatedIndex struct {
+	ofs   byteOffsets
+	ready bool
+	sync.RWMutex
+}
+
+var _ interface {
+	Index
+	persistedIndex
+	defIndexBuilder
+	defIndex
+} = (*defDeprecatedIndex)(nil)
+
+var c_defDeprecatedIndex_getAll = &counter{count: new(int64)}
+
+func (x *defDeprecatedIndex) String() string { return "defDeprecatedIndex" }
+
+// Covers implements defIndex.
+func (x *defDeprecatedIndex) Covers(filters interface{}) int {
+	cov := 0
+	for _, f := range storeFilters(filters) {
+		if f, ok := f.(*byDeprecatedFilter); ok && !f.hasUnitOverlay() {
+			cov++
+		}
+	}
+	return cov
+}
+
+// Defs implements defIndex.
+func (x *defDeprecatedIndex) Defs(fs ...DefFilter) (byteOffsets, error) {
+	x.RLock()
+	defer x.RUnlock()
+	c_defDeprecatedIndex_getAll.increment()
+	if x.ofs == nil {
+		return byteOffsets{}, nil
+	}
+	return x.ofs, nil
+}
+
+// Build implements defIndexBuilder.
+func (x *defDeprecatedIndex) Build(defs []*graph.Def, ofs byteOffsets) error {
+	x.Lock()
+	defer x.Unlock()
+	x.ofs = nil
+	for i, def := range defs {
+		if deprecated, _ := def.Deprecation(); deprecated {
+			x.ofs = append(x.ofs, ofs[i])
+		}
+	}
+	x.ready = true
+	return nil
+}
+
+// Write implements persistedIndex.
+func (x *defDeprecatedIndex) Write(w io.Writer) error {
+	x.RLock()
+	defer x.RUnlock()
+	b, err := binary.Marshal(x.ofs)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// Read implements persistedIndex.
+func (x *defDeprecatedIndex) Read(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err == nil {
+		var ofs byteOffsets
+		if err = binary.Unmarshal(b, &ofs); err == nil {
+			x.Lock()
+			x.ofs = ofs
+			x.ready = true
+			x.Unlock()
+			return nil
+		}
+	}
+	x.Lock()
+	x.ready = false
+	x.Unlock()
+	return err
+}
+
+// Ready implements persistedIndex.
+func (x *defDeprecatedIndex) Ready() bool {
+	x.RLock()
+	defer x.RUnlock()
+	return x.ready
+}
+
+var (
+	_ TreeDeprecations      = (*fsTreeStore)(nil)
+	_ TreeDeprecations      = (*indexedTreeStore)(nil)
+	_ RepoDeprecations      = (*fsRepoStore)(nil)
+	_ MultiRepoDeprecations = (*fsMultiRepoStore)(nil)
+)
@@ -0,0 +1,113 @@
+package store
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestFSMultiRepoStore_Deprecations(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+
+	u1 := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u1"}}
+	u2 := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u2"}}
+	def := func(path, data string) *graph.Def {
+		d := &graph.Def{DefKey: graph.DefKey{Path: path}, Name: path}
+		if data != "" {
+			d.Data = []byte(data)
+		}
+		return d
+	}
+	ref := func(defRepo, defUnit, defPath string, start uint32) *graph.Ref {
+		return &graph.Ref{DefRepo: defRepo, DefUnitType: "t", DefUnit: defUnit, DefPath: defPath, File: "f", Start: start, End: start + 1}
+	}
+	deprecatedPaths := func(defs []*graph.Def) []string {
+		paths := make([]string, len(defs))
+		for i, d := range defs {
+			paths[i] = d.Unit + "/" + d.Path
+		}
+		sort.Strings(paths)
+		return paths
+	}
+
+	for _, indexed := range []bool{false, true} {
+		useIndexedStore = indexed
+		mrs := NewFSMultiRepoStore(newTestFS(), nil)
+		if err := mrs.Import("d", "c", u1, graph.Output{
+			Defs: []*graph.Def{def("p", `{"Deprecated": "Use q."}`), def("q", ""), def("r", `{"Deprecated": true}`)},
+			Refs: []*graph.Ref{ref("", "u1", "p", 1)},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.Import("d", "c", u2, graph.Output{Defs: []*graph.Def{def("p", ""), def("s", "")}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.Import("a", "c", u1, graph.Output{Refs: []*graph.Ref{ref("d", "u1", "p", 1), ref("d", "u1", "p", 2), ref("d", "u2", "s", 3)}}); err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range []Version{{"d", "c"}, {"a", "c"}} {
+			if err := mrs.CreateVersion(v.Repo, v.CommitID); err != nil {
+				t.Fatal(err)
+			}
+			if err := mrs.Index(v.Repo, v.CommitID); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		checkDefs := func(label string, want []string) {
+			defs, err := mrs.Defs(ByRepoCommitIDs(Version{Repo: "d", CommitID: "c"}), ByDeprecated())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := deprecatedPaths(defs); !reflect.DeepEqual(got, want) {
+				t.Errorf("indexed=%v %s: got deprecated defs %v, want %v", indexed, label, got, want)
+			}
+		}
+		checkDefs("data", []string{"u1/p", "u1/r"})
+
+		mds := mrs.(MultiRepoDeprecations)
+		overlay := []*DefDeprecation{{UnitType: "t", Unit: "u2", Path: "s", Message: "Use u1 q."}}
+		if err := mds.SetDeprecations("d", "c", overlay); err != nil {
+			t.Fatal(err)
+		}
+		if deps, err := mds.Deprecations("d", "c"); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(deps, overlay) {
+			t.Errorf("indexed=%v: got overlay %+v, want %+v", indexed, deps, overlay)
+		}
+		checkDefs("overlay", []string{"u1/p", "u1/r", "u2/s"})
+
+		report, err := mds.DeprecatedRefs("d", "c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		type usage struct {
+			Path, Message string
+			Refs, Trees   int
+		}
+		var got []usage
+		for _, d := range report {
+			got = append(got, usage{Path: d.Def.Unit + "/" + d.Def.Path, Message: d.Message, Refs: d.Refs, Trees: len(d.Trees)})
+		}
+		want := []usage{
+			{Path: "u1/p", Message: "Use q.", Refs: 3, Trees: 2},
+			{Path: "u1/r"},
+			{Path: "u2/s", Message: "Use u1 q.", Refs: 1, Trees: 1},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("indexed=%v: got deprecated refs %+v, want %+v", indexed, got, want)
+		}
+
+		if err := mds.SetDeprecations("d", "c", nil); err != nil {
+			t.Fatal(err)
+		}
+		checkDefs("overlay removed", []string{"u1/p", "u1/r"})
+
+		if err := mds.SetDeprecations("d", "c", []*DefDeprecation{{Path: "s"}}); err == nil {
+			t.Errorf("indexed=%v: got no error for incomplete deprecation", indexed)
+		}
+	}
+}
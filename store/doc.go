@@ -20,13 +20,18 @@ lookups by certain fields or criteria.
   example, the search query index (which maps prefix queries by def
   names to the defs that match, repo-wide) builds a MAFSA and writes
   it to the def_query index file. Check the *_index.go files for the
-  full set of indexes in use.
+  full set of indexes in use. A multi-repo store can be configured
+  not to build some rarely-used indexes (see IndexProfiles and
+  SkippableIndexes), and NewWriteCountingFS reports how many bytes an
+  import writes to each index.
 
   See the godoc for Index for more information.
 
 * Data files consist of packed, varint-length-encoded protobufs of a
-  certain type (defs, refs, etc.). The indexes typically contain byte
-  offsets that refer to positions in the data files.
+  certain type (defs, refs, etc.), or of length-prefixed JSON records
+  in stores that use the JSON codec. Each multi-repo store records its
+  codec in its manifest (see StoreManifest). The indexes typically
+  contain byte offsets that refer to positions in the data files.
 
 
 CONVENTION - ZERO VALUES FOR FIELDS OUTSIDE OF A STORE'S SCOPE
@@ -79,6 +84,36 @@ narrowing to use techniques that may yield false positives (e.g.,
 bloom filters).
 
 
+CONVENTION - RESULT ORDERING
+
+The Defs and Refs methods of all multi-repo, repo, and tree stores
+return their results in a canonical order, so that clients can rely on
+results being stable across queries and store implementations:
+
+* Defs are sorted by Repo, CommitID, UnitType, Unit, and Path.
+
+* Refs are sorted by Repo, CommitID, UnitType, Unit, File, Start, and
+  End (and then by the key of the def they refer to).
+
+Unit stores (which hold a single source unit's data) are excluded:
+they return defs and refs in whatever order is cheapest for them to
+read (e.g., the order the data is stored in, or the order of an
+index's matches), because the tree stores that combine their results
+sort them anyway, and sorting each unit's results again would be
+wasted work. Clients that query a unit store directly and need a
+stable order must sort its results themselves.
+
+If a query's filters include a DefsSorter (such as DefsSortByKey or
+RankDefs), the defs are sorted by it instead. If they include the
+Unordered filter, results are returned in arbitrary order, which avoids
+the cost of sorting them.
+
+The First and Offset filters page through results in this order (and
+through units and repos in sorted order), so a client can fetch a large
+result set one page at a time. Stores stop reading data once they have
+found a page's results, where the way they store it allows them to.
+
+
 DEBUGGING
 
 The `srclib store` subcommands allow you to perform most store
@@ -0,0 +1,519 @@
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/binary"
+	"github.com/gogo/protobuf/proto"
+	"github.com/smartystreets/mafsa"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/store/phtable"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// IndexFormat describes the format of a kind of persisted index file.
+type IndexFormat struct {
+	// Name is the index's name. Its files are named NAME.idx.
+	Name string
+
+	// Scope is where the index's files are: "store" (at the root of a
+	// multi-repo store), "tree" (in a tree's dir), or "unit" (in a
+	// source unit's dir).
+	Scope string
+
+	// Gzipped is whether the index's files are gzip-compressed.
+	// (Indexes that are queried using range reads are not.)
+	Gzipped bool
+
+	// Description describes the index's contents and encoding.
+	Description string
+
+	// dump decodes an (uncompressed) index file.
+	dump func(r io.Reader) (interface{}, error)
+}
+
+// indexFormats are the formats of all persisted indexes.
+var indexFormats = []IndexFormat{
+	{
+		Name: fileNamesIndexName, Scope: "store", Gzipped: true,
+		Description: "The files in each visible tree, for FilesByName. JSON array of {Repo, CommitID, Files} objects, sorted by repo and commit ID.",
+		dump: func(r io.Reader) (interface{}, error) {
+			x := &multiRepoFileNamesIndex{}
+			if err := x.Read(r); err != nil {
+				return nil, err
+			}
+			return x.serialized(), nil
+		},
+	},
+	{
+		Name: "file_to_units", Scope: "tree", Gzipped: true,
+		Description: "The source units that contain each file (and each of its parent dirs). phtable keyed on the file path, whose values are binary-encoded arrays of unit IDs, plus case-folded file keys.",
+		dump: func(r io.Reader) (interface{}, error) {
+			x := &unitFilesIndex{}
+			if err := x.Read(r); err != nil {
+				return nil, err
+			}
+			return x.dump()
+		},
+	},
+	{
+		Name: "def_to_ref_units", Scope: "tree", Gzipped: true,
+		Description: "The source units that contain refs to each def. phtable keyed on the protobuf-encoded RefDefKey (keys are not stored), whose values are binary-encoded arrays of unit IDs.",
+		dump: func(r io.Reader) (interface{}, error) {
+			x := &defRefUnitsIndex{}
+			if err := x.Read(r); err != nil {
+				return nil, err
+			}
+			return x.dump()
+		},
+	},
+	{
+		Name: "def_query_to_defs16", Scope: "tree", Gzipped: true,
+		Description: "The defs (in all source units) with each lowercased name, for def queries (which match name prefixes). Binary-encoded MA-FSA of the names with a table (indexed on each name's number) of the byte offsets of each unit's defs.",
+		dump: func(r io.Reader) (interface{}, error) {
+			x := &defQueryTreeIndex{}
+			if err := x.Read(r); err != nil {
+				return nil, err
+			}
+			return x.dump(), nil
+		},
+	},
+	{
+		Name: defNameTreeIndexName, Scope: "tree", Gzipped: true,
+		Description: "The defs (in all source units) with each exact name, for ByDefName lookups. Binary-encoded list of unit IDs followed by a phtable keyed on the def name, whose values are binary-encoded arrays of (unit number, def byte offsets).",
+		dump: func(r io.Reader) (interface{}, error) {
+			x := &defNameTreeIndex{}
+			if err := x.Read(r); err != nil {
+				return nil, err
+			}
+			return x.dump()
+		},
+	},
+	{
+		Name: defDirTreeIndexName, Scope: "tree", Gzipped: true,
+		Description: "The defs (in all source units) in the files of each dir, for ByDirs listings. Binary-encoded list of unit IDs followed by a phtable keyed on the dir, whose values are binary-encoded arrays of (unit number, def byte offsets).",
+		dump: func(r io.Reader) (interface{}, error) {
+			x := &defDirTreeIndex{}
+			if err := x.Read(r); err != nil {
+				return nil, err
+			}
+			return x.dump()
+		},
+	},
+	{
+		Name: fileNamesIndexName, Scope: "tree", Gzipped: true,
+		Description: "The sorted, de-duplicated files of the tree's source units. JSON array of file paths.",
+		dump: func(r io.Reader) (interface{}, error) {
+			x := &fileNamesIndex{}
+			if err := x.Read(r); err != nil {
+				return nil, err
+			}
+			return x.files, nil
+		},
+	},
+	{
+		Name: unitsIndexName, Scope: "tree", Gzipped: true,
+		Description: "The tree's source units. JSON array of source units.",
+		dump: func(r io.Reader) (interface{}, error) {
+			x := &unitsIndex{}
+			if err := x.Read(r); err != nil {
+				return nil, err
+			}
+			return x.units, nil
+		},
+	},
+	{
+		Name: defRefCountsIndexName, Scope: "tree", Gzipped: false,
+		Description: "The number of refs to each def (in all source units). phtable keyed on the protobuf-encoded RefDefKey, whose values are binary-encoded counts.",
+		dump:        dumpDefRefCounts,
+	},
+	{
+		Name: defPathIndexName, Scope: "unit", Gzipped: false,
+		Description: `The byte offset of each def, sorted by def path. A header ("SDP1", the key width as a big-endian uint32, and the number of entries as a big-endian uint64) followed by the entries, each a def path (truncated to the key width and padded with NUL bytes) and a big-endian uint64 byte offset.`,
+		dump: func(r io.Reader) (interface{}, error) {
+			x := &defPathIndex{}
+			if err := x.Read(r); err != nil {
+				return nil, err
+			}
+			return x.dump(), nil
+		},
+	},
+	{
+		Name: "file_to_refs", Scope: "unit", Gzipped: true,
+		Description: "The byte range of each file's refs (which are stored in file order). phtable keyed on the file path, whose values are binary-encoded byte ranges (the first ref's byte offset followed by each ref's length), plus case-folded file keys.",
+		dump: func(r io.Reader) (interface{}, error) {
+			x := &refFileIndex{}
+			if err := x.Read(r); err != nil {
+				return nil, err
+			}
+			return x.dump()
+		},
+	},
+	{
+		Name: defToRefsIndexName, Scope: "unit", Gzipped: true,
+		Description: "The byte offsets of the refs to each def. phtable keyed on the protobuf-encoded RefDefKey, whose values are binary-encoded byte offsets.",
+		dump: func(r io.Reader) (interface{}, error) {
+			x := &defRefsIndex{}
+			if err := x.Read(r); err != nil {
+				return nil, err
+			}
+			return dumpRefDefPHTable(x.phtable, func(v []byte) (interface{}, error) {
+				var ofs byteOffsets
+				err := binary.Unmarshal(v, &ofs)
+				return ofs, err
+			})
+		},
+	},
+	{
+		Name: defToRefRangesIndexName, Scope: "unit", Gzipped: true,
+		Description: "The byte range of the refs to each def in the unit's copy of its refs in def order. phtable keyed on the protobuf-encoded RefDefKey, whose values are binary-encoded byte ranges.",
+		dump: func(r io.Reader) (interface{}, error) {
+			x := &defRefRangesIndex{}
+			if err := x.Read(r); err != nil {
+				return nil, err
+			}
+			return dumpRefDefPHTable(x.phtable, func(v []byte) (interface{}, error) {
+				var br byteRanges
+				err := binary.Unmarshal(v, &br)
+				return dumpByteRanges(br), err
+			})
+		},
+	},
+	{
+		Name: defQueryIndexName, Scope: "unit", Gzipped: true,
+		Description: "The defs with each lowercased name (only non-local defs with ASCII names), for def queries (which match name prefixes). Binary-encoded MA-FSA of the names with a table (indexed on each name's number) of def byte offsets.",
+		dump: func(r io.Reader) (interface{}, error) {
+			x := &defQueryIndex{}
+			if err := x.Read(r); err != nil {
+				return nil, err
+			}
+			return x.dump(), nil
+		},
+	},
+	{
+		Name: defSignatureIndexName, Scope: "unit", Gzipped: true,
+		Description: `The defs whose signatures have each parameter or result type. phtable keyed on "p:" or "r:" followed by the normalized type, whose values are binary-encoded sorted def byte offsets.`,
+		dump: func(r io.Reader) (interface{}, error) {
+			x := &defSignatureIndex{}
+			if err := x.Read(r); err != nil {
+				return nil, err
+			}
+			return dumpPHTable(x.phtable, func(k, v []byte) (interface{}, error) {
+				var ofs byteOffsets
+				err := binary.Unmarshal(v, &ofs)
+				return struct {
+					Key     string
+					Offsets byteOffsets
+				}{string(k), ofs}, err
+			})
+		},
+	},
+	{
+		Name: defDeprecatedIndexName, Scope: "unit", Gzipped: true,
+		Description: "The byte offsets of the deprecated defs. Binary-encoded byte offsets.",
+		dump: func(r io.Reader) (interface{}, error) {
+			x := &defDeprecatedIndex{}
+			if err := x.Read(r); err != nil {
+				return nil, err
+			}
+			return x.ofs, nil
+		},
+	},
+}
+
+// IndexFormats returns the formats of all persisted indexes.
+func IndexFormats() []IndexFormat {
+	return append([]IndexFormat(nil), indexFormats...)
+}
+
+// IndexDump is the decoded contents of a persisted index file.
+type IndexDump struct {
+	IndexFormat
+
+	// Entries is the index's decoded contents. Its structure depends
+	// on the index, but it is always JSON-encodable.
+	Entries interface{}
+}
+
+// DumpIndex decodes the persisted index file at filename in fs, for
+// debugging wrong query results. The index's format is determined by
+// the file's name; filename must be relative to the root of the store
+// (to distinguish the multi-repo file names index from trees' file
+// names indexes).
+func DumpIndex(fs rwvfs.FileSystem, filename string) (*IndexDump, error) {
+	dir, base := path.Split(path.Clean("/" + filename))
+	if !strings.HasSuffix(base, ".idx") {
+		return nil, fmt.Errorf("%s is not an index file (name must end in .idx)", filename)
+	}
+	name := strings.TrimSuffix(base, ".idx")
+	var format *IndexFormat
+	for i, f := range indexFormats {
+		if f.Name == name && (format == nil || (f.Scope == "store") == (dir == "/")) {
+			format = &indexFormats[i]
+		}
+	}
+	if format == nil {
+		return nil, fmt.Errorf("%s: unknown index %q", filename, name)
+	}
+
+	f, err := fs.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if format.Gzipped {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	entries, err := format.dump(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return &IndexDump{IndexFormat: *format, Entries: entries}, nil
+}
+
+// dumpPHTable decodes the entries of h (using decode), sorted by key.
+func dumpPHTable(h *phtable.CHD, decode func(k, v []byte) (interface{}, error)) ([]interface{}, error) {
+	var es []phtableEntry
+	for it := h.Iterate(); it != nil; it = it.Next() {
+		if k, v := it.Get(); len(k) > 0 || len(v) > 0 { // skip unused slots
+			es = append(es, phtableEntry{k, v})
+		}
+	}
+	sort.Sort(phtableEntries(es))
+	dump := make([]interface{}, len(es))
+	for i, e := range es {
+		var err error
+		if dump[i], err = decode(e.k, e.v); err != nil {
+			return nil, fmt.Errorf("key %q: %s", e.k, err)
+		}
+	}
+	return dump, nil
+}
+
+type phtableEntry struct{ k, v []byte }
+
+type phtableEntries []phtableEntry
+
+func (v phtableEntries) Len() int           { return len(v) }
+func (v phtableEntries) Less(i, j int) bool { return bytes.Compare(v[i].k, v[j].k) < 0 }
+func (v phtableEntries) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+
+// dumpRefDefPHTable decodes the entries of h, which is keyed on
+// protobuf-encoded RefDefKeys.
+func dumpRefDefPHTable(h *phtable.CHD, decode func(v []byte) (interface{}, error)) ([]interface{}, error) {
+	return dumpPHTable(h, func(k, v []byte) (interface{}, error) {
+		var def graph.RefDefKey
+		if err := proto.Unmarshal(k, &def); err != nil {
+			return nil, err
+		}
+		value, err := decode(v)
+		return struct {
+			Def   graph.RefDefKey
+			Value interface{}
+		}{def, value}, err
+	})
+}
+
+// dumpFilePHTable decodes the entries of h, which is a file index (see
+// foldedFileKeys).
+func dumpFilePHTable(h *phtable.CHD, decode func(v []byte) (interface{}, error)) ([]interface{}, error) {
+	return dumpPHTable(h, func(k, v []byte) (interface{}, error) {
+		switch key := string(k); {
+		case key == foldedFilesMarkerKey:
+			return struct{ FoldedFilesMarker bool }{true}, nil
+		case strings.HasPrefix(key, foldedFileKeyPrefix):
+			var files []string
+			err := binary.Unmarshal(v, &files)
+			return struct {
+				FoldedFile string
+				Files      []string
+			}{strings.TrimPrefix(key, foldedFileKeyPrefix), files}, err
+		default:
+			value, err := decode(v)
+			return struct {
+				File  string
+				Value interface{}
+			}{key, value}, err
+		}
+	})
+}
+
+type byteRangesDump struct {
+	Start   int64   // byte offset of the first object
+	Lengths []int64 // byte length of each object
+}
+
+func dumpByteRanges(br byteRanges) byteRangesDump {
+	if len(br) == 0 {
+		return byteRangesDump{}
+	}
+	return byteRangesDump{Start: br[0], Lengths: br[1:]}
+}
+
+func dumpDefRefCounts(r io.Reader) (interface{}, error) {
+	h, err := phtable.Read(r)
+	if err != nil {
+		return nil, err
+	}
+	return dumpRefDefPHTable(h, func(v []byte) (interface{}, error) {
+		var n uint64
+		err := binary.Unmarshal(v, &n)
+		return n, err
+	})
+}
+
+func (x *unitFilesIndex) dump() (interface{}, error) {
+	return dumpFilePHTable(x.phtable, func(v []byte) (interface{}, error) {
+		var units []unit.ID2
+		err := binary.Unmarshal(v, &units)
+		return units, err
+	})
+}
+
+func (x *refFileIndex) dump() (interface{}, error) {
+	return dumpFilePHTable(x.phtable, func(v []byte) (interface{}, error) {
+		var br byteRanges
+		err := binary.Unmarshal(v, &br)
+		return dumpByteRanges(br), err
+	})
+}
+
+func (x *defRefUnitsIndex) dump() (interface{}, error) {
+	// The defs (keys) aren't stored, so only the units are dumped.
+	var dump [][]unit.ID2
+	for _, v := range x.phtable.Values() {
+		if len(v) == 0 {
+			continue // unused slot
+		}
+		var units []unit.ID2
+		if err := binary.Unmarshal(v, &units); err != nil {
+			return nil, err
+		}
+		dump = append(dump, units)
+	}
+	return dump, nil
+}
+
+func (x *defNameTreeIndex) dump() (interface{}, error) {
+	type unitOfs struct {
+		Unit    unit.ID2
+		Offsets byteOffsets
+	}
+	return dumpPHTable(x.phtable, func(k, v []byte) (interface{}, error) {
+		var uoffss []unitOffsets
+		if err := binary.Unmarshal(v, &uoffss); err != nil {
+			return nil, err
+		}
+		units := make([]unitOfs, len(uoffss))
+		for i, uofs := range uoffss {
+			if int(uofs.Unit) < len(x.units) {
+				units[i].Unit = x.units[uofs.Unit]
+			}
+			units[i].Offsets = uofs.byteOffsets
+		}
+		return struct {
+			Name  string
+			Units []unitOfs
+		}{string(k), units}, nil
+	})
+}
+
+func (x *defDirTreeIndex) dump() (interface{}, error) {
+	type unitOfs struct {
+		Unit    unit.ID2
+		Offsets byteOffsets
+	}
+	return dumpPHTable(x.phtable, func(k, v []byte) (interface{}, error) {
+		var uoffss []unitOffsets
+		if err := binary.Unmarshal(v, &uoffss); err != nil {
+			return nil, err
+		}
+		units := make([]unitOfs, len(uoffss))
+		for i, uofs := range uoffss {
+			if int(uofs.Unit) < len(x.units) {
+				units[i].Unit = x.units[uofs.Unit]
+			}
+			units[i].Offsets = uofs.byteOffsets
+		}
+		return struct {
+			Dir   string
+			Units []unitOfs
+		}{string(k), units}, nil
+	})
+}
+
+func (x *defQueryIndex) dump() interface{} {
+	type term struct {
+		Term    string
+		Offsets byteOffsets
+	}
+	terms := mafsaTerms(x.mt.t)
+	dump := make([]term, len(terms))
+	for i, t := range terms {
+		dump[i] = term{Term: t}
+		if i < len(x.mt.Values) {
+			dump[i].Offsets = x.mt.Values[i]
+		}
+	}
+	return dump
+}
+
+func (x *defQueryTreeIndex) dump() interface{} {
+	type unitOfs struct {
+		Unit    unit.ID2
+		Offsets byteOffsets
+	}
+	type term struct {
+		Term  string
+		Units []unitOfs
+	}
+	terms := mafsaTerms(x.mt.t)
+	dump := make([]term, len(terms))
+	for i, t := range terms {
+		dump[i] = term{Term: t}
+		if i < len(x.mt.Values) {
+			for _, uofs := range x.mt.Values[i] {
+				var u unit.ID2
+				if int(uofs.Unit) < len(x.mt.Units) {
+					u = x.mt.Units[uofs.Unit]
+				}
+				dump[i].Units = append(dump[i].Units, unitOfs{Unit: u, Offsets: uofs.byteOffsets})
+			}
+		}
+	}
+	return dump
+}
+
+// mafsaTerms returns the terms in t, in the order of their numbers
+// (which index the values of mafsaTable and mafsaUnitTable).
+func mafsaTerms(t *mafsa.MinTree) []string {
+	if t == nil {
+		return nil
+	}
+	var terms []string
+	var walk func(term string, n *mafsa.MinTreeNode)
+	walk = func(term string, n *mafsa.MinTreeNode) {
+		if n.Final {
+			terms = append(terms, term)
+		}
+		for _, c := range n.OrderedEdges() {
+			walk(term+string([]rune{c}), n.Edges[c])
+		}
+	}
+	walk("", t.Root)
+	return terms
+}
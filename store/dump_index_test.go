@@ -0,0 +1,83 @@
+package store
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/kr/fs"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+func TestDumpIndex(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+	useIndexedStore = true
+
+	tfs := newTestFS()
+	mrs := NewFSMultiRepoStore(tfs, nil)
+	testSyncImport(t, mrs, "r", "c", "u1", "u2")
+	if err := mrs.(MultiRepoIndexer).Index("r", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mrs.(MultiRepoFileNamesIndexer).IndexFileNames(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mrs.(MultiRepoDefRefCounts).DefRefCounts(graph.RefDefKey{DefRepo: "r", DefUnitType: "t", DefUnit: "u1", DefPath: "p"}); err != nil {
+		t.Fatal(err)
+	}
+
+	dumps := map[string]string{} // index name -> JSON dump
+	walker := fs.WalkFS(".", tfs)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(walker.Path(), ".idx") {
+			continue
+		}
+		dump, err := DumpIndex(tfs, walker.Path())
+		if err != nil {
+			t.Errorf("%s: %s", walker.Path(), err)
+			continue
+		}
+		b, err := json.Marshal(dump)
+		if err != nil {
+			t.Errorf("%s: %s", walker.Path(), err)
+			continue
+		}
+		name := dump.Name
+		if path.Dir(walker.Path()) == "." {
+			name = "store " + name
+		}
+		dumps[name] = string(b)
+	}
+
+	want := map[string]string{
+		"store " + fileNamesIndexName: `"Repo":"r","CommitID":"c","Files":["f"]`,
+		fileNamesIndexName:            `"Entries":["f"]`,
+		"file_to_units":               `{"File":"f","Value":[{"Type":"t","Name":"u1"},{"Type":"t","Name":"u2"}]}`,
+		defRefCountsIndexName:         `"DefPath":"p"},"Value":2}`,
+		defPathIndexName:              `{"Path":"p","Offset":0}`,
+		defQueryIndexName:             `{"Term":"n","Offsets":[0]}`,
+		"def_query_to_defs16":         `{"Term":"n","Units":[{"Unit":{"Type":"t","Name":"u`,
+		defNameTreeIndexName:          `{"Name":"n","Units":[{"Unit":{"Type":"t","Name":"u`,
+		defToRefsIndexName:            `"DefPath":"p"},"Value":[`,
+		"file_to_refs":                `{"File":"f","Value":{"Start":0,"Lengths":[`,
+	}
+	for name, substr := range want {
+		dump, present := dumps[name]
+		if !present {
+			t.Errorf("%s: no index file found", name)
+			continue
+		}
+		if !strings.Contains(dump, substr) {
+			t.Errorf("%s: got dump %s, want it to contain %s", name, dump, substr)
+		}
+	}
+
+	if _, err := DumpIndex(tfs, "r/c/x.idx"); err == nil {
+		t.Error("unknown index: got nil error")
+	}
+}
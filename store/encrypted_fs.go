@@ -0,0 +1,250 @@
+package store
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/tools/godoc/vfs"
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+// A KeyFunc returns the AES key (16, 24, or 32 bytes long) used to
+// encrypt and decrypt store data. It may fetch the key from a key
+// management service; it is called the first time the key is needed,
+// and again after each failed call.
+type KeyFunc func() ([]byte, error)
+
+// EnvKey returns a KeyFunc that reads a base64-encoded AES key from the
+// named environment variable.
+func EnvKey(name string) KeyFunc {
+	return func() ([]byte, error) {
+		v := os.Getenv(name)
+		if v == "" {
+			return nil, fmt.Errorf("no encryption key in environment variable %s", name)
+		}
+		key, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key in environment variable %s: %s", name, err)
+		}
+		return key, nil
+	}
+}
+
+// ErrDecrypt is returned when reading a file from an encrypted FS
+// fails because the file is corrupt, was not encrypted, or was
+// encrypted with a different key.
+var ErrDecrypt = errors.New("unable to decrypt file (corrupt, unencrypted, or wrong key)")
+
+// encryptedFileMagic begins every file written by an encrypted FS.
+const encryptedFileMagic = "SGE1"
+
+// encryptedFileOverhead is the number of bytes that encryption adds
+// to each file: the magic string, the nonce, and the GCM tag.
+const encryptedFileOverhead = len(encryptedFileMagic) + 12 + 16
+
+// NewEncryptedFS returns a filesystem that encrypts (with AES-GCM) the
+// contents of files written to fs and decrypts them when read. File
+// names and directory structure are not encrypted.
+//
+// Files are encrypted and decrypted as a whole, so each file that is
+// being written or read is held in memory.
+//
+// Each file's ciphertext is bound to its path on fs (which is
+// authenticated as additional data), so that someone with write access
+// to the underlying storage can't swap or move encrypted files (e.g.,
+// to make one tree's data appear in another's). So the encrypted FS
+// must be the root of the store's filesystem (as set up by
+// FSMultiRepoStoreConf.EncryptionKey), and files may only be moved or
+// linked through it, which re-encrypts them for their new paths (see
+// Link).
+func NewEncryptedFS(fs rwvfs.FileSystem, key KeyFunc) rwvfs.WalkableFileSystem {
+	return rwvfs.Walkable(&encryptedFS{fs: fs, key: key})
+}
+
+type encryptedFS struct {
+	fs  rwvfs.FileSystem
+	key KeyFunc
+
+	mu   sync.Mutex
+	aead cipher.AEAD
+}
+
+func (fs *encryptedFS) getAEAD() (cipher.AEAD, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.aead != nil {
+		return fs.aead, nil
+	}
+	key, err := fs.key()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	fs.aead = aead
+	return aead, nil
+}
+
+func (fs *encryptedFS) Open(name string) (vfs.ReadSeekCloser, error) {
+	f, err := fs.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := fs.decrypt(name, f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	return nopCloser{plaintext}, nil
+}
+
+// decrypt reads and decrypts the file at name, whose (encrypted) data
+// is read from r.
+func (fs *encryptedFS) decrypt(name string, r io.Reader) (*bytes.Reader, error) {
+	aead, err := fs.getAEAD()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < encryptedFileOverhead || string(data[:len(encryptedFileMagic)]) != encryptedFileMagic {
+		return nil, &os.PathError{Op: "Open", Path: name, Err: ErrDecrypt}
+	}
+	data = data[len(encryptedFileMagic):]
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(ciphertext[:0], nonce, ciphertext, encryptedFileAAD(name))
+	if err != nil {
+		return nil, &os.PathError{Op: "Open", Path: name, Err: ErrDecrypt}
+	}
+	return bytes.NewReader(plaintext), nil
+}
+
+func (fs *encryptedFS) Create(name string) (io.WriteCloser, error) {
+	aead, err := fs.getAEAD()
+	if err != nil {
+		return nil, err
+	}
+	f, err := fs.fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedFileWriter{f: f, aead: aead, aad: encryptedFileAAD(name)}, nil
+}
+
+// encryptedFileAAD returns the additional data that the file at name
+// is encrypted with: its clean path, so that it decrypts only at the
+// path it was written to.
+func encryptedFileAAD(name string) []byte {
+	return []byte(strings.TrimPrefix(path.Clean("/"+name), "/"))
+}
+
+func (fs *encryptedFS) Lstat(name string) (os.FileInfo, error) {
+	fi, err := fs.fs.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return plaintextFileInfo{fi}, nil
+}
+
+func (fs *encryptedFS) Stat(name string) (os.FileInfo, error) {
+	fi, err := fs.fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return plaintextFileInfo{fi}, nil
+}
+
+func (fs *encryptedFS) ReadDir(name string) ([]os.FileInfo, error) {
+	fis, err := fs.fs.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	for i, fi := range fis {
+		fis[i] = plaintextFileInfo{fi}
+	}
+	return fis, nil
+}
+
+func (fs *encryptedFS) Mkdir(name string) error  { return fs.fs.Mkdir(name) }
+func (fs *encryptedFS) Remove(name string) error { return fs.fs.Remove(name) }
+func (fs *encryptedFS) String() string           { return "Encrypted(" + fs.fs.String() + ")" }
+
+func (fs *encryptedFS) CreateParentDirs(b bool) {
+	type createParents interface {
+		CreateParentDirs(bool)
+	}
+	if cfs, ok := fs.fs.(createParents); ok {
+		cfs.CreateParentDirs(b)
+	}
+}
+
+// Join implements rwvfs.WalkableFileSystem using the underlying FS's
+// Join (if any).
+func (fs *encryptedFS) Join(elem ...string) string {
+	if wfs, ok := fs.fs.(rwvfs.WalkableFileSystem); ok {
+		return wfs.Join(elem...)
+	}
+	return path.Join(elem...)
+}
+
+// encryptedFileWriter buffers a file's contents and encrypts and
+// writes them to the underlying file when closed.
+type encryptedFileWriter struct {
+	f    io.WriteCloser
+	aead cipher.AEAD
+	aad  []byte
+	buf  bytes.Buffer
+}
+
+func (w *encryptedFileWriter) Write(p []byte) (int, error) { return w.buf.Write(p) }
+
+func (w *encryptedFileWriter) Close() error {
+	out := make([]byte, len(encryptedFileMagic)+w.aead.NonceSize(), encryptedFileOverhead+w.buf.Len())
+	copy(out, encryptedFileMagic)
+	nonce := out[len(encryptedFileMagic):]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		w.f.Close()
+		return err
+	}
+	out = w.aead.Seal(out, nonce, w.buf.Bytes(), w.aad)
+	if _, err := w.f.Write(out); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+// plaintextFileInfo reports the size of the plaintext of an
+// encrypted file.
+type plaintextFileInfo struct{ os.FileInfo }
+
+func (fi plaintextFileInfo) Size() int64 {
+	if !fi.Mode().IsRegular() || fi.FileInfo.Size() < int64(encryptedFileOverhead) {
+		return fi.FileInfo.Size()
+	}
+	return fi.FileInfo.Size() - int64(encryptedFileOverhead)
+}
+
+type nopCloser struct{ io.ReadSeeker }
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,165 @@
+package store
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/tools/godoc/vfs"
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func staticKey(key []byte) KeyFunc {
+	return func() ([]byte, error) { return key, nil }
+}
+
+func TestEncryptedFS(t *testing.T) {
+	underlying := rwvfs.Map(map[string]string{})
+	fs := NewEncryptedFS(underlying, staticKey(bytes.Repeat([]byte{1}, 32)))
+
+	plaintext := []byte("hello, world")
+	w, err := fs.Create("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext, err := vfs.ReadFile(underlying, "f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(ciphertext, plaintext) {
+		t.Errorf("underlying file contains plaintext: %q", ciphertext)
+	}
+
+	f, err := fs.Open("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("got %q, want %q", got, plaintext)
+	}
+
+	fi, err := fs.Stat("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(plaintext)) {
+		t.Errorf("got size %d, want %d", fi.Size(), len(plaintext))
+	}
+
+	otherFS := NewEncryptedFS(underlying, staticKey(bytes.Repeat([]byte{2}, 32)))
+	if _, err := otherFS.Open("f"); err == nil || err.(*os.PathError).Err != ErrDecrypt {
+		t.Errorf("Open with wrong key: got error %v, want %v", err, ErrDecrypt)
+	}
+
+	w, err = underlying.Create("g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("unencrypted")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Open("g"); err == nil || err.(*os.PathError).Err != ErrDecrypt {
+		t.Errorf("Open unencrypted file: got error %v, want %v", err, ErrDecrypt)
+	}
+}
+
+func TestEncryptedFS_pathBound(t *testing.T) {
+	underlying := rwvfs.Map(map[string]string{})
+	key := bytes.Repeat([]byte{1}, 32)
+	fs := NewEncryptedFS(underlying, staticKey(key))
+	if err := writeFile(fs, "d/f", []byte("f")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file moved on the underlying storage doesn't decrypt.
+	ciphertext, err := vfs.ReadFile(underlying, "d/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(underlying, "d/g", ciphertext); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Open("d/g"); err == nil || err.(*os.PathError).Err != ErrDecrypt {
+		t.Errorf("Open moved file: got error %v, want %v", err, ErrDecrypt)
+	}
+
+	// A file linked through the encrypted FS is re-encrypted for its
+	// new path.
+	if err := fs.(linkFS).Link("d/f", "d/h"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := vfs.ReadFile(fs, "/d/h"); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "f" {
+		t.Errorf("linked file: got %q, want %q", data, "f")
+	}
+
+}
+
+func TestEnvKey(t *testing.T) {
+	const name = "SRCLIB_TEST_ENCRYPTION_KEY"
+	defer os.Setenv(name, os.Getenv(name))
+
+	os.Setenv(name, "")
+	if _, err := EnvKey(name)(); err == nil {
+		t.Error("got nil error for unset key")
+	}
+
+	key := bytes.Repeat([]byte{3}, 16)
+	os.Setenv(name, base64.StdEncoding.EncodeToString(key))
+	got, err := EnvKey(name)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, key) {
+		t.Errorf("got key %v, want %v", got, key)
+	}
+}
+
+func TestFSMultiRepoStore_encrypted(t *testing.T) {
+	useIndexedStore = true
+	testMultiRepoStore(t, func() MultiRepoStoreImporter {
+		return NewFSMultiRepoStore(newTestFS(), &FSMultiRepoStoreConf{EncryptionKey: staticKey(bytes.Repeat([]byte{1}, 16))})
+	})
+}
+
+func TestFSMultiRepoStore_encrypted_RenameRepo(t *testing.T) {
+	mrs := NewFSMultiRepoStore(newTestFS(), &FSMultiRepoStoreConf{EncryptionKey: staticKey(bytes.Repeat([]byte{1}, 16)), ShareUnitData: true})
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
+	data := graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}, Name: "n"}}}
+	if err := mrs.Import("r1", "c", u, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := mrs.CreateVersion("r1", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mrs.(MultiRepoRenamer).RenameRepo("r1", "r2"); err != nil {
+		t.Fatal(err)
+	}
+	defs, err := mrs.Defs(ByRepos("r2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 1 || defs[0].Name != "n" {
+		t.Errorf("got defs %v, want the renamed repo's def", defs)
+	}
+}
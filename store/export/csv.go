@@ -0,0 +1,44 @@
+package export
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+)
+
+type csvWriter struct {
+	w   *csv.Writer
+	rec []string
+}
+
+func newCSVWriter(w io.Writer, cols []column) (*csvWriter, error) {
+	cw := &csvWriter{w: csv.NewWriter(w), rec: make([]string, len(cols))}
+	for i, c := range cols {
+		cw.rec[i] = c.name
+	}
+	if err := cw.w.Write(cw.rec); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *csvWriter) writeRow(vals []interface{}) error {
+	for i, v := range vals {
+		switch v := v.(type) {
+		case nil:
+			cw.rec[i] = ""
+		case string:
+			cw.rec[i] = v
+		case uint32:
+			cw.rec[i] = strconv.FormatUint(uint64(v), 10)
+		case bool:
+			cw.rec[i] = strconv.FormatBool(v)
+		}
+	}
+	return cw.w.Write(cw.rec)
+}
+
+func (cw *csvWriter) close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
@@ -0,0 +1,7 @@
+// Package export writes the data in a store in formats that other
+// tools can load: SQLite databases (for ad-hoc analytics with SQL),
+// and CSV and Parquet tables of defs and refs (for loading into data
+// warehouses). Exporters query and write the store's data one version
+// at a time, so they can export stores that are much larger than
+// memory.
+package export
@@ -0,0 +1,32 @@
+package export
+
+import (
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/store"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func newTestStore(t *testing.T) store.MultiRepoStore {
+	mrs := store.NewFSMultiRepoStore(rwvfs.Walkable(rwvfs.Map(map[string]string{})), nil)
+	for _, repo := range []string{"r1", "r2"} {
+		u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}, Info: unit.Info{Files: []string{"f"}}}
+		if err := mrs.Import(repo, "c", u, graph.Output{
+			Defs: []*graph.Def{
+				{DefKey: graph.DefKey{Path: "p"}, Name: "it's", Kind: "func", File: "f", DefStart: 1, DefEnd: 2, Exported: true, Docs: []*graph.DefDoc{{Format: "text/plain", Data: "doc"}}},
+			},
+			Refs: []*graph.Ref{
+				{DefPath: "p", File: "f", Start: 1, End: 2, Def: true},
+				{DefRepo: "r1", DefUnitType: "t", DefUnit: "u", DefPath: "p", File: "f", Start: 3, End: 4},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.CreateVersion(repo, "c"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return mrs
+}
@@ -0,0 +1,317 @@
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// defaultRowGroupSize is the number of rows that parquetWriter buffers
+// (in memory) before writing them as a row group.
+const defaultRowGroupSize = 64 * 1024
+
+const parquetMagic = "PAR1"
+
+// Parquet physical types, encodings, and other enum values (from
+// parquet.thrift).
+const (
+	parquetBoolean   = 0
+	parquetInt64     = 2
+	parquetByteArray = 6
+
+	parquetRequired = 0 // FieldRepetitionType
+	parquetUTF8     = 0 // ConvertedType
+
+	parquetPlain = 0 // Encoding
+	parquetRLE   = 3 // Encoding
+
+	parquetUncompressed = 0 // CompressionCodec
+	parquetDataPage     = 0 // PageType
+)
+
+// parquetWriter writes a Parquet file with a required (non-nullable)
+// column for each table column. Strings are BYTE_ARRAY (UTF8), ints
+// are INT64, and bools are BOOLEAN. Each row group has a single
+// PLAIN-encoded and uncompressed data page per column.
+type parquetWriter struct {
+	w            io.Writer
+	off          int64 // bytes written to w
+	cols         []column
+	rowGroupSize int
+
+	// the current row group's encoded values
+	vals  []bytes.Buffer
+	bits  []byte // the current byte of each boolean column's bit-packed values
+	nrows int
+
+	rowGroups []parquetRowGroup
+	totalRows int64
+	err       error
+}
+
+type parquetRowGroup struct {
+	cols      []parquetColumnChunk
+	nrows     int64
+	totalSize int64
+}
+
+type parquetColumnChunk struct {
+	offset int64 // of the data page (header)
+	size   int64 // of the data page (header and data)
+}
+
+func newParquetWriter(w io.Writer, cols []column, rowGroupSize int) *parquetWriter {
+	return &parquetWriter{
+		w:            w,
+		cols:         cols,
+		rowGroupSize: rowGroupSize,
+		vals:         make([]bytes.Buffer, len(cols)),
+		bits:         make([]byte, len(cols)),
+	}
+}
+
+func (pw *parquetWriter) write(p []byte) {
+	if pw.err != nil {
+		return
+	}
+	var n int
+	n, pw.err = pw.w.Write(p)
+	pw.off += int64(n)
+}
+
+func (pw *parquetWriter) writeRow(vals []interface{}) error {
+	if pw.off == 0 {
+		pw.write([]byte(parquetMagic))
+	}
+	for i, v := range vals {
+		buf := &pw.vals[i]
+		switch pw.cols[i].typ {
+		case stringColumn:
+			s, _ := v.(string)
+			var n [4]byte
+			binary.LittleEndian.PutUint32(n[:], uint32(len(s)))
+			buf.Write(n[:])
+			buf.WriteString(s)
+		case intColumn:
+			var n [8]byte
+			binary.LittleEndian.PutUint64(n[:], uint64(v.(uint32)))
+			buf.Write(n[:])
+		case boolColumn:
+			// Bit-packed, least significant bit first.
+			if v.(bool) {
+				pw.bits[i] |= 1 << uint(pw.nrows%8)
+			}
+			if pw.nrows%8 == 7 {
+				buf.WriteByte(pw.bits[i])
+				pw.bits[i] = 0
+			}
+		}
+	}
+	pw.nrows++
+	if pw.nrows == pw.rowGroupSize {
+		pw.flushRowGroup()
+	}
+	return pw.err
+}
+
+// flushRowGroup writes the buffered rows as a row group.
+func (pw *parquetWriter) flushRowGroup() {
+	rg := parquetRowGroup{nrows: int64(pw.nrows)}
+	for i, c := range pw.cols {
+		buf := &pw.vals[i]
+		if c.typ == boolColumn && pw.nrows%8 != 0 {
+			buf.WriteByte(pw.bits[i])
+			pw.bits[i] = 0
+		}
+
+		var hdr compactWriter
+		hdr.begin()
+		hdr.i32(1, parquetDataPage)
+		hdr.i32(2, int32(buf.Len())) // uncompressed_page_size
+		hdr.i32(3, int32(buf.Len())) // compressed_page_size
+		hdr.beginStruct(5)           // data_page_header
+		hdr.i32(1, int32(pw.nrows))  // num_values
+		hdr.i32(2, parquetPlain)     // encoding
+		hdr.i32(3, parquetRLE)       // definition_level_encoding
+		hdr.i32(4, parquetRLE)       // repetition_level_encoding
+		hdr.end()
+		hdr.end()
+
+		chunk := parquetColumnChunk{offset: pw.off, size: int64(len(hdr.b) + buf.Len())}
+		pw.write(hdr.b)
+		pw.write(buf.Bytes())
+		buf.Reset()
+		rg.cols = append(rg.cols, chunk)
+		rg.totalSize += chunk.size
+	}
+	pw.rowGroups = append(pw.rowGroups, rg)
+	pw.totalRows += int64(pw.nrows)
+	pw.nrows = 0
+}
+
+func (pw *parquetWriter) close() error {
+	if pw.off == 0 {
+		pw.write([]byte(parquetMagic))
+	}
+	if pw.nrows > 0 {
+		pw.flushRowGroup()
+	}
+
+	// FileMetaData
+	var md compactWriter
+	md.begin()
+	md.i32(1, 1) // version
+	md.list(2, ctStruct, len(pw.cols)+1)
+	md.begin() // root SchemaElement
+	md.str(4, "schema")
+	md.i32(5, int32(len(pw.cols))) // num_children
+	md.end()
+	for _, c := range pw.cols {
+		md.begin()
+		md.i32(1, parquetType(c.typ))
+		md.i32(3, parquetRequired)
+		md.str(4, c.name)
+		if c.typ == stringColumn {
+			md.i32(6, parquetUTF8)
+		}
+		md.end()
+	}
+	md.i64(3, pw.totalRows)
+	md.list(4, ctStruct, len(pw.rowGroups))
+	for _, rg := range pw.rowGroups {
+		md.begin()
+		md.list(1, ctStruct, len(rg.cols))
+		for i, chunk := range rg.cols {
+			md.begin()              // ColumnChunk
+			md.i64(2, chunk.offset) // file_offset
+			md.beginStruct(3)       // meta_data
+			md.i32(1, parquetType(pw.cols[i].typ))
+			md.list(2, ctI32, 2) // encodings
+			md.listI32(parquetPlain)
+			md.listI32(parquetRLE)
+			md.list(3, ctBinary, 1) // path_in_schema
+			md.listStr(pw.cols[i].name)
+			md.i32(4, parquetUncompressed)
+			md.i64(5, rg.nrows)     // num_values
+			md.i64(6, chunk.size)   // total_uncompressed_size
+			md.i64(7, chunk.size)   // total_compressed_size
+			md.i64(9, chunk.offset) // data_page_offset
+			md.end()
+			md.end()
+		}
+		md.i64(2, rg.totalSize)
+		md.i64(3, rg.nrows)
+		md.end()
+	}
+	md.str(6, "srclib")
+	md.end()
+
+	pw.write(md.b)
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(len(md.b)))
+	pw.write(n[:])
+	pw.write([]byte(parquetMagic))
+	return pw.err
+}
+
+func parquetType(t columnType) int32 {
+	switch t {
+	case intColumn:
+		return parquetInt64
+	case boolColumn:
+		return parquetBoolean
+	}
+	return parquetByteArray
+}
+
+// Thrift compact protocol types.
+const (
+	ctI32    = 5
+	ctI64    = 6
+	ctBinary = 8
+	ctList   = 9
+	ctStruct = 12
+)
+
+// compactWriter encodes structs in the Thrift compact protocol (which
+// Parquet uses for its metadata). Only the types that Parquet metadata
+// needs are supported.
+type compactWriter struct {
+	b     []byte
+	last  int16   // the last field ID written in the current struct
+	stack []int16 // the last field IDs of the enclosing structs
+}
+
+// begin begins a struct (at the top level or as a list element).
+func (w *compactWriter) begin() {
+	w.stack = append(w.stack, w.last)
+	w.last = 0
+}
+
+// beginStruct begins a struct-valued field.
+func (w *compactWriter) beginStruct(id int16) {
+	w.field(id, ctStruct)
+	w.begin()
+}
+
+// end ends the current struct.
+func (w *compactWriter) end() {
+	w.b = append(w.b, 0) // stop field
+	w.last = w.stack[len(w.stack)-1]
+	w.stack = w.stack[:len(w.stack)-1]
+}
+
+func (w *compactWriter) field(id int16, typ byte) {
+	if d := id - w.last; d > 0 && d <= 15 {
+		w.b = append(w.b, byte(d)<<4|typ)
+	} else {
+		w.b = append(w.b, typ)
+		w.varint(int64(id))
+	}
+	w.last = id
+}
+
+func (w *compactWriter) uvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	w.b = append(w.b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// varint writes a zigzag-encoded varint.
+func (w *compactWriter) varint(v int64) {
+	w.uvarint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (w *compactWriter) i32(id int16, v int32) {
+	w.field(id, ctI32)
+	w.varint(int64(v))
+}
+
+func (w *compactWriter) i64(id int16, v int64) {
+	w.field(id, ctI64)
+	w.varint(v)
+}
+
+func (w *compactWriter) str(id int16, s string) {
+	w.field(id, ctBinary)
+	w.listStr(s)
+}
+
+// list begins a list-valued field with n elements of the given type,
+// which the caller must write next (with listI32, listStr, or
+// begin/end).
+func (w *compactWriter) list(id int16, elemType byte, n int) {
+	w.field(id, ctList)
+	if n < 15 {
+		w.b = append(w.b, byte(n)<<4|elemType)
+	} else {
+		w.b = append(w.b, 0xF0|elemType)
+		w.uvarint(uint64(n))
+	}
+}
+
+func (w *compactWriter) listI32(v int32) { w.varint(int64(v)) }
+
+func (w *compactWriter) listStr(s string) {
+	w.uvarint(uint64(len(s)))
+	w.b = append(w.b, s...)
+}
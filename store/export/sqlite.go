@@ -0,0 +1,156 @@
+package export
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"sourcegraph.com/sourcegraph/srclib/store"
+)
+
+// SQLiteSchema is the SQLite schema of the database that WriteSQLite
+// creates. Byte offsets are in the start_offset and end_offset
+// columns, and booleans are 0 or 1.
+const SQLiteSchema = `CREATE TABLE units (
+  repo TEXT NOT NULL,
+  commit_id TEXT NOT NULL,
+  type TEXT NOT NULL,
+  name TEXT NOT NULL,
+  dir TEXT NOT NULL,
+  files TEXT NOT NULL -- JSON array
+);
+CREATE TABLE defs (
+  repo TEXT NOT NULL,
+  commit_id TEXT NOT NULL,
+  unit_type TEXT NOT NULL,
+  unit TEXT NOT NULL,
+  path TEXT NOT NULL,
+  tree_path TEXT NOT NULL,
+  name TEXT NOT NULL,
+  kind TEXT NOT NULL,
+  file TEXT NOT NULL,
+  start_offset INTEGER NOT NULL,
+  end_offset INTEGER NOT NULL,
+  exported INTEGER NOT NULL,
+  local INTEGER NOT NULL,
+  test INTEGER NOT NULL,
+  data TEXT, -- JSON
+  doc TEXT -- the first of the def's docs, if any
+);
+CREATE TABLE refs (
+  repo TEXT NOT NULL,
+  commit_id TEXT NOT NULL,
+  unit_type TEXT NOT NULL,
+  unit TEXT NOT NULL,
+  file TEXT NOT NULL,
+  start_offset INTEGER NOT NULL,
+  end_offset INTEGER NOT NULL,
+  is_def INTEGER NOT NULL,
+  def_repo TEXT NOT NULL,
+  def_unit_type TEXT NOT NULL,
+  def_unit TEXT NOT NULL,
+  def_path TEXT NOT NULL
+);
+`
+
+// sqliteIndexes are created after the rows are inserted (which is
+// faster than updating them on each insert).
+const sqliteIndexes = `CREATE UNIQUE INDEX units_key ON units (repo, commit_id, type, name);
+CREATE INDEX defs_key ON defs (repo, commit_id, unit_type, unit, path);
+CREATE INDEX defs_name ON defs (name);
+CREATE INDEX defs_kind ON defs (kind);
+CREATE INDEX defs_file ON defs (repo, commit_id, file);
+CREATE INDEX refs_def ON refs (def_repo, def_unit_type, def_unit, def_path);
+CREATE INDEX refs_file ON refs (repo, commit_id, file, start_offset);
+`
+
+// WriteSQLite writes an SQL script that creates a SQLite database
+// (with the tables in SQLiteSchema, plus indexes) holding the units,
+// defs, and refs of the versions in s that match the filters (or all
+// versions, if there are none). Pipe the script to the sqlite3
+// command to create the database.
+func WriteSQLite(w io.Writer, s store.MultiRepoStore, f ...store.VersionFilter) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "PRAGMA journal_mode = OFF;")
+	fmt.Fprintln(bw, "PRAGMA synchronous = OFF;")
+	fmt.Fprintln(bw, "BEGIN TRANSACTION;")
+	fmt.Fprint(bw, SQLiteSchema)
+
+	err := eachVersion(s, f, func(scope versionScope) error {
+		units, err := s.Units(scope)
+		if err != nil {
+			return err
+		}
+		for _, u := range units {
+			files, err := json.Marshal(u.Files)
+			if err != nil {
+				return err
+			}
+			writeSQLInsert(bw, "units", u.Repo, u.CommitID, u.Type, u.Name, u.Dir, string(files))
+		}
+
+		arena := store.NewArena()
+		defer arena.Release()
+		defs, err := s.Defs(scope, arena)
+		if err != nil {
+			return err
+		}
+		for _, d := range defs {
+			writeSQLInsert(bw, "defs", defRow(d)...)
+		}
+
+		refs, err := s.Refs(scope, arena)
+		if err != nil {
+			return err
+		}
+		for _, r := range refs {
+			writeSQLInsert(bw, "refs", refRow(r)...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprint(bw, sqliteIndexes)
+	fmt.Fprintln(bw, "COMMIT;")
+	return bw.Flush()
+}
+
+// writeSQLInsert writes an INSERT statement for a row with the given
+// values.
+func writeSQLInsert(w *bufio.Writer, table string, vals ...interface{}) {
+	w.WriteString("INSERT INTO ")
+	w.WriteString(table)
+	w.WriteString(" VALUES(")
+	for i, v := range vals {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		switch v := v.(type) {
+		case nil:
+			w.WriteString("NULL")
+		case string:
+			w.WriteString(sqlQuote(v))
+		case uint32:
+			w.WriteString(strconv.FormatUint(uint64(v), 10))
+		case bool:
+			if v {
+				w.WriteByte('1')
+			} else {
+				w.WriteByte('0')
+			}
+		default:
+			panic(fmt.Sprintf("unexpected SQL value type %T", v))
+		}
+	}
+	w.WriteString(");\n")
+}
+
+// sqlQuote returns s as an SQL string literal.
+func sqlQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
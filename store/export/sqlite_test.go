@@ -0,0 +1,51 @@
+package export
+
+import (
+	"bytes"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/store"
+)
+
+func TestWriteSQLite(t *testing.T) {
+	mrs := newTestStore(t)
+
+	var buf bytes.Buffer
+	if err := WriteSQLite(&buf, mrs, store.ByRepos("r2")); err != nil {
+		t.Fatal(err)
+	}
+	script := buf.String()
+	for _, want := range []string{
+		`INSERT INTO units VALUES('r2','c','t','u','','["f"]');`,
+		`INSERT INTO defs VALUES('r2','c','t','u','p','','it''s','func','f',1,2,1,0,0,NULL,'doc');`,
+		`INSERT INTO refs VALUES('r2','c','t','u','f',3,4,0,'r1','t','u','p');`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script does not contain %q:\n%s", want, script)
+		}
+	}
+	if strings.Contains(script, "'r1','c'") {
+		t.Errorf("script contains data of filtered-out repo r1:\n%s", script)
+	}
+
+	sqlite3, err := exec.LookPath("sqlite3")
+	if err != nil {
+		t.Skip("sqlite3 not found; skipping loading the database")
+	}
+	db := filepath.Join(t.TempDir(), "test.db")
+	cmd := exec.Command(sqlite3, db)
+	cmd.Stdin = &buf
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("sqlite3: %s\n%s", err, out)
+	}
+	out, err := exec.Command(sqlite3, db, "SELECT d.name, count(*) FROM refs r JOIN defs d ON d.repo = r.def_repo AND d.path = r.def_path GROUP BY d.name").CombinedOutput()
+	if err != nil {
+		t.Fatalf("sqlite3 query: %s\n%s", err, out)
+	}
+	if got, want := strings.TrimSpace(string(out)), "it's|1"; got != want {
+		t.Errorf("got query result %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,205 @@
+package export
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/store"
+)
+
+// A Format is a bulk export format for tables of defs or refs.
+type Format string
+
+const (
+	// CSV is the comma-separated values format (RFC 4180), with a
+	// header row of column names.
+	CSV Format = "csv"
+
+	// Parquet is the Apache Parquet columnar format, with PLAIN-encoded
+	// and uncompressed columns (which all data warehouses can load).
+	Parquet Format = "parquet"
+)
+
+// columnType is the type of a column's values.
+type columnType int
+
+const (
+	stringColumn columnType = iota // string (or nil, for an empty string)
+	intColumn                      // uint32
+	boolColumn                     // bool
+)
+
+type column struct {
+	name string
+	typ  columnType
+}
+
+// defColumns are the columns of exported defs tables (which
+// correspond to the SQLite defs table in SQLiteSchema).
+var defColumns = []column{
+	{"repo", stringColumn},
+	{"commit_id", stringColumn},
+	{"unit_type", stringColumn},
+	{"unit", stringColumn},
+	{"path", stringColumn},
+	{"tree_path", stringColumn},
+	{"name", stringColumn},
+	{"kind", stringColumn},
+	{"file", stringColumn},
+	{"start_offset", intColumn},
+	{"end_offset", intColumn},
+	{"exported", boolColumn},
+	{"local", boolColumn},
+	{"test", boolColumn},
+	{"data", stringColumn},
+	{"doc", stringColumn},
+}
+
+// defRow returns the values of def's row in a defs table.
+func defRow(d *graph.Def) []interface{} {
+	var data, doc interface{}
+	if len(d.Data) > 0 {
+		data = string(d.Data)
+	}
+	if len(d.Docs) > 0 {
+		doc = d.Docs[0].Data
+	}
+	return []interface{}{d.Repo, d.CommitID, d.UnitType, d.Unit, d.Path, d.TreePath, d.Name, d.Kind, d.File, d.DefStart, d.DefEnd, d.Exported, d.Local, d.Test, data, doc}
+}
+
+// refColumns are the columns of exported refs tables (which
+// correspond to the SQLite refs table in SQLiteSchema).
+var refColumns = []column{
+	{"repo", stringColumn},
+	{"commit_id", stringColumn},
+	{"unit_type", stringColumn},
+	{"unit", stringColumn},
+	{"file", stringColumn},
+	{"start_offset", intColumn},
+	{"end_offset", intColumn},
+	{"is_def", boolColumn},
+	{"def_repo", stringColumn},
+	{"def_unit_type", stringColumn},
+	{"def_unit", stringColumn},
+	{"def_path", stringColumn},
+}
+
+// refRow returns the values of ref's row in a refs table.
+func refRow(r *graph.Ref) []interface{} {
+	return []interface{}{r.Repo, r.CommitID, r.UnitType, r.Unit, r.File, r.Start, r.End, r.Def, r.DefRepo, r.DefUnitType, r.DefUnit, r.DefPath}
+}
+
+// A tableWriter writes the rows of a table in an export format.
+type tableWriter interface {
+	writeRow(vals []interface{}) error
+
+	// close writes any buffered rows and the table's trailer (if
+	// any). It does not close the underlying writer.
+	close() error
+}
+
+func newTableWriter(w io.Writer, format Format, cols []column) (tableWriter, error) {
+	switch format {
+	case CSV:
+		return newCSVWriter(w, cols)
+	case Parquet:
+		return newParquetWriter(w, cols, defaultRowGroupSize), nil
+	}
+	return nil, fmt.Errorf("unknown export format %q (valid formats are %q and %q)", format, CSV, Parquet)
+}
+
+// WriteDefs writes a table of the defs in the versions in s that match
+// the filters (or all versions, if there are none) in the given
+// format. The defs are queried and written one version at a time.
+func WriteDefs(w io.Writer, format Format, s store.MultiRepoStore, f ...store.VersionFilter) error {
+	tw, err := newTableWriter(w, format, defColumns)
+	if err != nil {
+		return err
+	}
+	err = eachVersion(s, f, func(scope versionScope) error {
+		// The defs are only needed until they're written, so they're
+		// allocated in an arena.
+		arena := store.NewArena()
+		defer arena.Release()
+		defs, err := s.Defs(scope, arena)
+		if err != nil {
+			return err
+		}
+		for _, d := range defs {
+			if err := tw.writeRow(defRow(d)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.close()
+}
+
+// WriteRefs writes a table of the refs in the versions in s that match
+// the filters (or all versions, if there are none) in the given
+// format. The refs are queried and written one version at a time.
+func WriteRefs(w io.Writer, format Format, s store.MultiRepoStore, f ...store.VersionFilter) error {
+	tw, err := newTableWriter(w, format, refColumns)
+	if err != nil {
+		return err
+	}
+	err = eachVersion(s, f, func(scope versionScope) error {
+		arena := store.NewArena()
+		defer arena.Release()
+		refs, err := s.Refs(scope, arena)
+		if err != nil {
+			return err
+		}
+		for _, r := range refs {
+			if err := tw.writeRow(refRow(r)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.close()
+}
+
+// A versionScope is a filter that selects the data in a single
+// version.
+type versionScope interface {
+	store.UnitFilter
+	store.DefFilter
+	store.RefFilter
+}
+
+// eachVersion calls fn with a filter for each version in s that
+// matches the filters, sorted by repo and commit ID (so that exports
+// of the same data are identical).
+func eachVersion(s store.MultiRepoStore, f []store.VersionFilter, fn func(versionScope) error) error {
+	versions, err := s.Versions(f...)
+	if err != nil {
+		return err
+	}
+	sort.Sort(versionsByRepoAndCommitID(versions))
+	for _, v := range versions {
+		if err := fn(store.ByRepoCommitIDs(*v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type versionsByRepoAndCommitID []*store.Version
+
+func (v versionsByRepoAndCommitID) Len() int      { return len(v) }
+func (v versionsByRepoAndCommitID) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+func (v versionsByRepoAndCommitID) Less(i, j int) bool {
+	if v[i].Repo != v[j].Repo {
+		return v[i].Repo < v[j].Repo
+	}
+	return v[i].CommitID < v[j].CommitID
+}
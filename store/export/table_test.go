@@ -0,0 +1,219 @@
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/store"
+)
+
+func TestWriteDefs_csv(t *testing.T) {
+	mrs := newTestStore(t)
+
+	var buf bytes.Buffer
+	if err := WriteDefs(&buf, CSV, mrs); err != nil {
+		t.Fatal(err)
+	}
+	want := `repo,commit_id,unit_type,unit,path,tree_path,name,kind,file,start_offset,end_offset,exported,local,test,data,doc
+r1,c,t,u,p,,it's,func,f,1,2,true,false,false,,doc
+r2,c,t,u,p,,it's,func,f,1,2,true,false,false,,doc
+`
+	if buf.String() != want {
+		t.Errorf("got CSV\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestWriteRefs_csv(t *testing.T) {
+	mrs := newTestStore(t)
+
+	var buf bytes.Buffer
+	if err := WriteRefs(&buf, CSV, mrs, store.ByRepos("r1")); err != nil {
+		t.Fatal(err)
+	}
+	want := `repo,commit_id,unit_type,unit,file,start_offset,end_offset,is_def,def_repo,def_unit_type,def_unit,def_path
+r1,c,t,u,f,1,2,true,r1,t,u,p
+r1,c,t,u,f,3,4,false,r1,t,u,p
+`
+	if buf.String() != want {
+		t.Errorf("got CSV\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestWriteDefs_unknownFormat(t *testing.T) {
+	if err := WriteDefs(&bytes.Buffer{}, "xml", newTestStore(t)); err == nil {
+		t.Error("got nil error for unknown format")
+	}
+}
+
+func TestParquetWriter(t *testing.T) {
+	cols := []column{{"s", stringColumn}, {"n", intColumn}, {"b", boolColumn}}
+	rows := [][]interface{}{
+		{"a", uint32(1), true},
+		{nil, uint32(2), false},
+		{"ccc", uint32(3), true},
+	}
+
+	var buf bytes.Buffer
+	pw := newParquetWriter(&buf, cols, 2) // 2 row groups
+	for _, row := range rows {
+		if err := pw.writeRow(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pw.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	md := readParquetMetadata(t, buf.Bytes())
+	if numRows := md[3]; numRows != int64(len(rows)) {
+		t.Errorf("got num_rows %v, want %d", numRows, len(rows))
+	}
+	var names []interface{}
+	for _, elem := range md[2].([]interface{}) {
+		names = append(names, elem.(map[int16]interface{})[4])
+	}
+	if want := []interface{}{"schema", "s", "n", "b"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got schema names %v, want %v", names, want)
+	}
+
+	// Read the columns' values back.
+	got := make([][]interface{}, len(cols))
+	rowGroups := md[4].([]interface{})
+	if len(rowGroups) != 2 {
+		t.Fatalf("got %d row groups, want 2", len(rowGroups))
+	}
+	for _, rg := range rowGroups {
+		for i, chunk := range rg.(map[int16]interface{})[1].([]interface{}) {
+			meta := chunk.(map[int16]interface{})[3].(map[int16]interface{})
+			r := &compactReader{b: buf.Bytes(), pos: int(meta[9].(int64))}
+			hdr := r.readStruct()
+			n := int(hdr[5].(map[int16]interface{})[1].(int64))
+			data := buf.Bytes()[r.pos : r.pos+int(hdr[3].(int64))]
+			for j := 0; j < n; j++ {
+				switch cols[i].typ {
+				case stringColumn:
+					l := binary.LittleEndian.Uint32(data)
+					got[i] = append(got[i], string(data[4:4+l]))
+					data = data[4+l:]
+				case intColumn:
+					got[i] = append(got[i], uint32(binary.LittleEndian.Uint64(data)))
+					data = data[8:]
+				case boolColumn:
+					got[i] = append(got[i], data[j/8]&(1<<uint(j%8)) != 0)
+				}
+			}
+		}
+	}
+	want := [][]interface{}{{"a", "", "ccc"}, {uint32(1), uint32(2), uint32(3)}, {true, false, true}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got column values %v, want %v", got, want)
+	}
+}
+
+func TestWriteRefs_parquet(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteRefs(&buf, Parquet, newTestStore(t)); err != nil {
+		t.Fatal(err)
+	}
+	if md := readParquetMetadata(t, buf.Bytes()); md[3] != int64(4) {
+		t.Errorf("got num_rows %v, want 4", md[3])
+	}
+}
+
+func TestParquetWriter_empty(t *testing.T) {
+	var buf bytes.Buffer
+	pw := newParquetWriter(&buf, refColumns, 2)
+	if err := pw.close(); err != nil {
+		t.Fatal(err)
+	}
+	if md := readParquetMetadata(t, buf.Bytes()); md[3] != int64(0) {
+		t.Errorf("got num_rows %v, want 0", md[3])
+	}
+}
+
+// readParquetMetadata checks the Parquet file's magic numbers and
+// returns its decoded FileMetaData.
+func readParquetMetadata(t *testing.T, file []byte) map[int16]interface{} {
+	if len(file) < 12 || string(file[:4]) != parquetMagic || string(file[len(file)-4:]) != parquetMagic {
+		t.Fatalf("bad Parquet magic in %q", file)
+	}
+	n := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	r := &compactReader{b: file[len(file)-8-n : len(file)-8]}
+	md := r.readStruct()
+	if r.pos != n {
+		t.Fatalf("read %d bytes of FileMetaData, want %d", r.pos, n)
+	}
+	return md
+}
+
+// compactReader decodes Thrift compact protocol structs (into maps
+// from field ID to value).
+type compactReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *compactReader) byte() byte {
+	c := r.b[r.pos]
+	r.pos++
+	return c
+}
+
+func (r *compactReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b[r.pos:])
+	r.pos += n
+	return v
+}
+
+func (r *compactReader) varint() int64 {
+	v := r.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *compactReader) readStruct() map[int16]interface{} {
+	fields := map[int16]interface{}{}
+	var last int16
+	for {
+		c := r.byte()
+		if c == 0 {
+			return fields
+		}
+		id := last + int16(c>>4)
+		if c>>4 == 0 {
+			id = int16(r.varint())
+		}
+		last = id
+		fields[id] = r.value(c & 0xF)
+	}
+}
+
+func (r *compactReader) value(typ byte) interface{} {
+	switch typ {
+	case 1:
+		return true
+	case 2:
+		return false
+	case ctI32, ctI64:
+		return r.varint()
+	case ctBinary:
+		n := int(r.uvarint())
+		r.pos += n
+		return string(r.b[r.pos-n : r.pos])
+	case ctList:
+		c := r.byte()
+		n := int(c >> 4)
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			list[i] = r.value(c & 0xF)
+		}
+		return list
+	case ctStruct:
+		return r.readStruct()
+	}
+	panic("unsupported Thrift compact type")
+}
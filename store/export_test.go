@@ -0,0 +1,10 @@
+package store
+
+// The store test suites, exported for the tests of the stores in
+// other packages (which are in package store_test).
+var (
+	UnitStoreSuite      = testUnitStore
+	TreeStoreSuite      = testTreeStore
+	RepoStoreSuite      = testRepoStore
+	MultiRepoStoreSuite = testMultiRepoStore
+)
@@ -0,0 +1,193 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// An ExternalRefCount is the number of refs in a source unit to a def
+// in another repo.
+type ExternalRefCount struct {
+	// UnitType and Unit are the source unit that contains the refs.
+	UnitType, Unit string
+
+	// Def is the def (in another repo) that the refs point to.
+	Def graph.RefDefKey
+
+	// Count is the number of refs in the unit to the def.
+	Count int
+}
+
+// A TreeExternalRefs reports the usage of defs in other repos (e.g.,
+// dependencies) by a tree's source units. The counts are summarized
+// when each unit is imported, so querying them doesn't require reading
+// the units' refs.
+type TreeExternalRefs interface {
+	// ExternalRefs returns the number of refs to each def in another
+	// repo from each of the source units that match the filters. If
+	// defRepo is non-empty, only refs to defs in that repo are
+	// counted. The counts are sorted by unit and then by def.
+	ExternalRefs(defRepo string, f ...UnitFilter) ([]*ExternalRefCount, error)
+}
+
+// A RepoExternalRefs reports the usage of defs in other repos by the
+// source units in a repo's trees.
+type RepoExternalRefs interface {
+	ExternalRefs(commitID, defRepo string, f ...UnitFilter) ([]*ExternalRefCount, error)
+}
+
+// A MultiRepoExternalRefs reports the usage of defs in other repos by
+// the source units in trees in multiple repos.
+type MultiRepoExternalRefs interface {
+	ExternalRefs(repo, commitID, defRepo string, f ...UnitFilter) ([]*ExternalRefCount, error)
+}
+
+// unitExternalRefsFilename is the name of the file (in a unit's dir)
+// that holds the summary of the unit's refs to defs in other repos. If
+// it doesn't exist, the unit was imported before the summary was
+// written, and the summary is computed from the unit's refs when
+// needed.
+const unitExternalRefsFilename = "external_refs.json"
+
+// refDefCount is the number of refs (in a source unit) to a def. It is
+// the persisted form of an ExternalRefCount (the unit is implied by the
+// file's location).
+type refDefCount struct {
+	graph.RefDefKey
+	Count int
+}
+
+// summarizeExternalRefs counts the refs (in unit u) to each def in
+// another repo. Refs are external if their DefRepo is set; when
+// importing into a multi-repo store, DefRepo is cleared for refs to
+// defs in the same repo.
+func summarizeExternalRefs(u unit.ID2, refs []*graph.Ref) []refDefCount {
+	return countRefDefs(u, refs, true)
+}
+
+// countRefDefs counts the refs (in unit u) to each def (or only to
+// defs in other repos, if externalOnly). The DefUnitType and DefUnit
+// of the counted defs are set to u's if they are empty.
+func countRefDefs(u unit.ID2, refs []*graph.Ref, externalOnly bool) []refDefCount {
+	counts := map[graph.RefDefKey]int{}
+	for _, ref := range refs {
+		if externalOnly && ref.DefRepo == "" {
+			continue
+		}
+		def := ref.RefDefKey()
+		if def.DefUnitType == "" {
+			def.DefUnitType = u.Type
+		}
+		if def.DefUnit == "" {
+			def.DefUnit = u.Name
+		}
+		counts[def]++
+	}
+
+	summary := make([]refDefCount, 0, len(counts))
+	for def, n := range counts {
+		summary = append(summary, refDefCount{RefDefKey: def, Count: n})
+	}
+	sort.Sort(refDefCountsByDef(summary))
+	return summary
+}
+
+type refDefCountsByDef []refDefCount
+
+func (v refDefCountsByDef) Len() int { return len(v) }
+func (v refDefCountsByDef) Less(i, j int) bool {
+	a, b := v[i].RefDefKey, v[j].RefDefKey
+	if a.DefRepo != b.DefRepo {
+		return a.DefRepo < b.DefRepo
+	}
+	if a.DefUnitType != b.DefUnitType {
+		return a.DefUnitType < b.DefUnitType
+	}
+	if a.DefUnit != b.DefUnit {
+		return a.DefUnit < b.DefUnit
+	}
+	return a.DefPath < b.DefPath
+}
+func (v refDefCountsByDef) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+
+func (s *fsTreeStore) unitExternalRefsFilename(u unit.ID2) string {
+	return path.Join(s.unitDir(u), unitExternalRefsFilename)
+}
+
+func (s *fsTreeStore) writeExternalRefs(u unit.ID2, refs []*graph.Ref) (err error) {
+	f, err := s.fs.Create(s.unitExternalRefsFilename(u))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := f.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+	return json.NewEncoder(f).Encode(summarizeExternalRefs(u, refs))
+}
+
+// readExternalRefs reads the unit's external refs summary, or computes
+// it from the unit's refs if it wasn't written.
+func (s *fsTreeStore) readExternalRefs(u unit.ID2) ([]refDefCount, error) {
+	f, err := s.fs.Open(s.unitExternalRefsFilename(u))
+	if os.IsNotExist(err) {
+		refs, err := s.openUnitStore(u).Refs()
+		if err != nil {
+			return nil, err
+		}
+		return summarizeExternalRefs(u, refs), nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var summary []refDefCount
+	if err := json.NewDecoder(f).Decode(&summary); err != nil {
+		return nil, fmt.Errorf("%s: invalid %s: %s", u, unitExternalRefsFilename, err)
+	}
+	return summary, nil
+}
+
+func (s *fsTreeStore) ExternalRefs(defRepo string, f ...UnitFilter) ([]*ExternalRefCount, error) {
+	units, err := s.Units(f...)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(unitsByID2(units))
+
+	var counts []*ExternalRefCount
+	for _, u := range units {
+		summary, err := s.readExternalRefs(u.ID2())
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range summary {
+			if defRepo != "" && c.DefRepo != defRepo {
+				continue
+			}
+			counts = append(counts, &ExternalRefCount{UnitType: u.Type, Unit: u.Name, Def: c.RefDefKey, Count: c.Count})
+		}
+	}
+	return counts, nil
+}
+
+func (s *fsRepoStore) ExternalRefs(commitID, defRepo string, f ...UnitFilter) ([]*ExternalRefCount, error) {
+	return s.newTreeStore(commitID).(TreeExternalRefs).ExternalRefs(defRepo, f...)
+}
+
+func (s *fsMultiRepoStore) ExternalRefs(repo, commitID, defRepo string, f ...UnitFilter) ([]*ExternalRefCount, error) {
+	return s.openRepoStore(repo).(RepoExternalRefs).ExternalRefs(commitID, defRepo, f...)
+}
+
+var (
+	_ TreeExternalRefs      = (*fsTreeStore)(nil)
+	_ TreeExternalRefs      = (*indexedTreeStore)(nil)
+	_ RepoExternalRefs      = (*fsRepoStore)(nil)
+	_ MultiRepoExternalRefs = (*fsMultiRepoStore)(nil)
+)
@@ -0,0 +1,86 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestFSMultiRepoStore_ExternalRefs(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+
+	u1 := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u1"}}
+	u2 := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u2"}}
+	data1 := graph.Output{Refs: []*graph.Ref{
+		{DefRepo: "r", DefUnitType: "t", DefUnit: "u2", DefPath: "p", File: "f", Start: 1, End: 2},
+		{DefPath: "p", File: "f", Start: 3, End: 4},
+		{DefRepo: "d1", DefUnitType: "t", DefUnit: "x", DefPath: "p1", File: "f", Start: 5, End: 6},
+		{DefRepo: "d1", DefUnitType: "t", DefUnit: "x", DefPath: "p1", File: "f", Start: 7, End: 8},
+		{DefRepo: "d2", DefUnitType: "t", DefUnit: "y", DefPath: "p2", File: "f", Start: 9, End: 10},
+	}}
+	data2 := graph.Output{Refs: []*graph.Ref{
+		{DefRepo: "d1", DefUnitType: "t", DefUnit: "u2", DefPath: "p3", File: "g", Start: 1, End: 2},
+	}}
+
+	all := []*ExternalRefCount{
+		{UnitType: "t", Unit: "u1", Def: graph.RefDefKey{DefRepo: "d1", DefUnitType: "t", DefUnit: "x", DefPath: "p1"}, Count: 2},
+		{UnitType: "t", Unit: "u1", Def: graph.RefDefKey{DefRepo: "d2", DefUnitType: "t", DefUnit: "y", DefPath: "p2"}, Count: 1},
+		{UnitType: "t", Unit: "u2", Def: graph.RefDefKey{DefRepo: "d1", DefUnitType: "t", DefUnit: "u2", DefPath: "p3"}, Count: 1},
+	}
+	tests := []struct {
+		defRepo string
+		filters []UnitFilter
+		want    []*ExternalRefCount
+	}{
+		{"", nil, all},
+		{"d1", nil, []*ExternalRefCount{all[0], all[2]}},
+		{"d1", []UnitFilter{ByUnits(u2.ID2())}, []*ExternalRefCount{all[2]}},
+		{"d3", nil, nil},
+	}
+
+	for _, indexed := range []bool{false, true} {
+		useIndexedStore = indexed
+		mrs := NewFSMultiRepoStore(newTestFS(), nil)
+		if err := mrs.Import("r", "c", u1, data1); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.Import("r", "c", u2, data2); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.CreateVersion("r", "c"); err != nil {
+			t.Fatal(err)
+		}
+
+		check := func(label string) {
+			for _, test := range tests {
+				counts, err := mrs.(MultiRepoExternalRefs).ExternalRefs("r", "c", test.defRepo, test.filters...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(counts, test.want) {
+					t.Errorf("indexed=%v %s: defRepo %q filters %v: got %v, want %v", indexed, label, test.defRepo, test.filters, counts, test.want)
+				}
+			}
+		}
+		check("summarized")
+
+		// Units imported before their external refs were summarized
+		// are summarized from their refs.
+		ts := mrs.(*fsMultiRepoStore).openRepoStore("r").(*fsRepoStore).newTreeStore("c")
+		var fts *fsTreeStore
+		switch ts := ts.(type) {
+		case *fsTreeStore:
+			fts = ts
+		case *indexedTreeStore:
+			fts = ts.fsTreeStore
+		}
+		for _, u := range []*unit.SourceUnit{u1, u2} {
+			if err := fts.fs.Remove(fts.unitExternalRefsFilename(u.ID2())); err != nil {
+				t.Fatal(err)
+			}
+		}
+		check("computed")
+	}
+}
@@ -0,0 +1,187 @@
+package store
+
+import (
+	"golang.org/x/net/context"
+	"golang.org/x/tools/godoc/vfs"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+// The store's VFS wrappers (throttledFS, encryptedFS, casFS, etc.)
+// implement ContextFetcherOpener and rwvfs.FetcherOpener by forwarding
+// to the VFS they wrap, so that a store on a network VFS still opens
+// its files with fetchers (and binds their fetches to the query's
+// context) when it is throttled, encrypted, etc.
+//
+// Because a wrapper implements the interfaces even if the VFS it wraps
+// doesn't, it also implements fetcherForwarder to report whether
+// its files are actually fetched (see isFetcherFS).
+type fetcherForwarder interface {
+	// fetches reports whether the files of the wrapped VFS are
+	// fetched (i.e., whether it implements ContextFetcherOpener or
+	// rwvfs.FetcherOpener).
+	fetches() bool
+}
+
+// isFetcherFS reports whether fs is a network VFS whose files are read
+// with fetchers (see fetcherForwarder).
+func isFetcherFS(fs rwvfs.FileSystem) bool {
+	if fw, ok := fs.(fetcherForwarder); ok {
+		return fw.fetches()
+	}
+	_, ctxFetcher := fs.(ContextFetcherOpener)
+	_, fetcher := fs.(rwvfs.FetcherOpener)
+	return ctxFetcher || fetcher
+}
+
+// openFetcher is like openFetcherOrOpen, except that the returned file
+// always implements rwvfs.Fetcher. If fs doesn't fetch, its Fetch
+// does nothing.
+func openFetcher(ctx context.Context, fs rwvfs.FileSystem, name string) (vfs.ReadSeekCloser, error) {
+	f, err := openFetcherOrOpen(ctx, fs, name)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := f.(rwvfs.Fetcher); ok {
+		return f, nil
+	}
+	return nopFetcher{f}, nil
+}
+
+// nopFetcher is a file (from a VFS that doesn't fetch) whose Fetch
+// does nothing.
+type nopFetcher struct {
+	vfs.ReadSeekCloser
+}
+
+func (nopFetcher) Fetch(start, end int64) error { return nil }
+
+// fetch calls Fetch on f if it is a rwvfs.Fetcher.
+func fetch(f vfs.ReadSeekCloser, start, end int64) error {
+	if f, ok := f.(rwvfs.Fetcher); ok {
+		return f.Fetch(start, end)
+	}
+	return nil
+}
+
+func (fs *throttledFS) OpenFetcher(name string) (vfs.ReadSeekCloser, error) {
+	return fs.OpenFetcherContext(context.Background(), name)
+}
+
+func (fs *throttledFS) OpenFetcherContext(ctx context.Context, name string) (vfs.ReadSeekCloser, error) {
+	if err := fs.begin("Open", name, fs.opens, "OpensPerSecond"); err != nil {
+		return nil, err
+	}
+	defer fs.end()
+	f, err := openFetcher(ctx, fs.fs, name)
+	if err != nil {
+		return nil, err
+	}
+	return &throttledFile{ReadSeekCloser: f, fs: fs, name: name}, nil
+}
+
+func (fs *throttledFS) fetches() bool { return isFetcherFS(fs.fs) }
+
+// Fetch implements rwvfs.Fetcher. Fetches count as reads (for
+// FSStoreConf.ReadsPerSecond).
+func (f *throttledFile) Fetch(start, end int64) error {
+	if err := f.fs.begin("Read", f.name, f.fs.reads, "ReadsPerSecond"); err != nil {
+		return err
+	}
+	defer f.fs.end()
+	return fetch(f.ReadSeekCloser, start, end)
+}
+
+func (fs *encryptedFS) OpenFetcher(name string) (vfs.ReadSeekCloser, error) {
+	return fs.OpenFetcherContext(context.Background(), name)
+}
+
+// OpenFetcherContext implements ContextFetcherOpener. The whole file
+// must be read to decrypt it, so it is fetched from the underlying VFS
+// at once, and the returned file's Fetch does nothing.
+func (fs *encryptedFS) OpenFetcherContext(ctx context.Context, name string) (vfs.ReadSeekCloser, error) {
+	f, err := openFetcherOrOpen(ctx, fs.fs, name)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := fs.decrypt(name, withContext(ctx, f))
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	return nopFetcher{nopCloser{plaintext}}, nil
+}
+
+// fetches reports false, because ranges of an encrypted file can't be
+// fetched separately (see OpenFetcherContext).
+func (fs *encryptedFS) fetches() bool { return false }
+
+func (fs *readCountingFS) OpenFetcher(name string) (vfs.ReadSeekCloser, error) {
+	return fs.OpenFetcherContext(context.Background(), name)
+}
+
+func (fs *readCountingFS) OpenFetcherContext(ctx context.Context, name string) (vfs.ReadSeekCloser, error) {
+	f, err := openFetcher(ctx, fs.FileSystem, name)
+	if err != nil {
+		return nil, err
+	}
+	return &readCountingFile{ReadSeekCloser: f, n: &fs.n}, nil
+}
+
+func (fs *readCountingFS) fetches() bool { return isFetcherFS(fs.FileSystem) }
+
+// Fetch implements rwvfs.Fetcher. Fetched bytes are counted when
+// they are read.
+func (f *readCountingFile) Fetch(start, end int64) error {
+	return fetch(f.ReadSeekCloser, start, end)
+}
+
+func (fs *writeCountingFS) OpenFetcher(name string) (vfs.ReadSeekCloser, error) {
+	return fs.OpenFetcherContext(context.Background(), name)
+}
+
+func (fs *writeCountingFS) OpenFetcherContext(ctx context.Context, name string) (vfs.ReadSeekCloser, error) {
+	return openFetcher(ctx, fs.FileSystem, name)
+}
+
+func (fs *writeCountingFS) fetches() bool { return isFetcherFS(fs.FileSystem) }
+
+func (fs *writePolicyFS) OpenFetcher(name string) (vfs.ReadSeekCloser, error) {
+	return fs.OpenFetcherContext(context.Background(), name)
+}
+
+func (fs *writePolicyFS) OpenFetcherContext(ctx context.Context, name string) (vfs.ReadSeekCloser, error) {
+	return openFetcher(ctx, fs.FileSystem, name)
+}
+
+func (fs *writePolicyFS) fetches() bool { return isFetcherFS(fs.FileSystem) }
+
+func (fs *casFS) OpenFetcher(name string) (vfs.ReadSeekCloser, error) {
+	return fs.OpenFetcherContext(context.Background(), name)
+}
+
+// OpenFetcherContext implements ContextFetcherOpener. If name is a
+// pointer file, it opens the object it refers to.
+func (fs *casFS) OpenFetcherContext(ctx context.Context, name string) (vfs.ReadSeekCloser, error) {
+	return fs.open(name, func(name string) (vfs.ReadSeekCloser, error) {
+		return openFetcher(ctx, fs.WalkableFileSystem, name)
+	})
+}
+
+func (fs *casFS) fetches() bool { return isFetcherFS(fs.WalkableFileSystem) }
+
+var (
+	_ ContextFetcherOpener = (*throttledFS)(nil)
+	_ ContextFetcherOpener = (*encryptedFS)(nil)
+	_ ContextFetcherOpener = (*readCountingFS)(nil)
+	_ ContextFetcherOpener = (*writeCountingFS)(nil)
+	_ ContextFetcherOpener = (*writePolicyFS)(nil)
+	_ ContextFetcherOpener = (*casFS)(nil)
+
+	_ rwvfs.FetcherOpener = (*throttledFS)(nil)
+	_ rwvfs.FetcherOpener = (*encryptedFS)(nil)
+	_ rwvfs.FetcherOpener = (*readCountingFS)(nil)
+	_ rwvfs.FetcherOpener = (*writeCountingFS)(nil)
+	_ rwvfs.FetcherOpener = (*writePolicyFS)(nil)
+	_ rwvfs.FetcherOpener = (*casFS)(nil)
+)
@@ -0,0 +1,132 @@
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/tools/godoc/vfs"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+// fetcherFS is a network-like VFS that records the files opened with
+// fetchers and the ranges fetched.
+type fetcherFS struct {
+	rwvfs.FileSystem
+
+	mu      sync.Mutex
+	opened  []string
+	fetched []string
+}
+
+func (fs *fetcherFS) OpenFetcher(name string) (vfs.ReadSeekCloser, error) {
+	return fs.OpenFetcherContext(context.Background(), name)
+}
+
+func (fs *fetcherFS) OpenFetcherContext(ctx context.Context, name string) (vfs.ReadSeekCloser, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fs.mu.Lock()
+	fs.opened = append(fs.opened, name)
+	fs.mu.Unlock()
+	return &fetcherFile{ReadSeekCloser: f, fs: fs, name: name}, nil
+}
+
+func (fs *fetcherFS) Join(elem ...string) string { return path.Join(elem...) }
+
+type fetcherFile struct {
+	vfs.ReadSeekCloser
+	fs   *fetcherFS
+	name string
+}
+
+func (f *fetcherFile) Fetch(start, end int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	f.fs.fetched = append(f.fs.fetched, f.name)
+	return nil
+}
+
+func TestFetcherForwarding(t *testing.T) {
+	tests := map[string]struct {
+		wrap    func(rwvfs.FileSystem) rwvfs.FileSystem
+		fetches bool // whether ranges are fetched (and not read from the whole file)
+	}{
+		"throttled": {
+			wrap: func(fs rwvfs.FileSystem) rwvfs.FileSystem {
+				return NewThrottledFS(fs, FSStoreConf{MaxConcurrentOps: 2})
+			},
+			fetches: true,
+		},
+		"encrypted": {
+			wrap: func(fs rwvfs.FileSystem) rwvfs.FileSystem {
+				return NewEncryptedFS(fs, staticKey(bytes.Repeat([]byte{1}, 32)))
+			},
+		},
+		"encrypted, throttled": {
+			wrap: func(fs rwvfs.FileSystem) rwvfs.FileSystem {
+				return NewEncryptedFS(NewThrottledFS(fs, FSStoreConf{MaxConcurrentOps: 2}), staticKey(bytes.Repeat([]byte{1}, 32)))
+			},
+		},
+		"write policy": {
+			wrap: func(fs rwvfs.FileSystem) rwvfs.FileSystem {
+				fs, err := NewWritePolicyFS(fs, FSStoreConf{WriteBufferSize: 4096})
+				if err != nil {
+					panic(err)
+				}
+				return fs
+			},
+			fetches: true,
+		},
+		"CAS": {
+			wrap: func(fs rwvfs.FileSystem) rwvfs.FileSystem {
+				return newCASFS(rwvfs.Walkable(fs))
+			},
+			fetches: true,
+		},
+	}
+	for label, test := range tests {
+		underlying := &fetcherFS{FileSystem: rwvfs.Map(map[string]string{})}
+		fs := test.wrap(underlying)
+		if err := writeFile(fs, "f", []byte("hello, world")); err != nil {
+			t.Fatalf("%s: %s", label, err)
+		}
+
+		if got := isFetcherFS(fs); got != test.fetches {
+			t.Errorf("%s: got isFetcherFS %v, want %v", label, got, test.fetches)
+		}
+		if got := isFetcherFS(test.wrap(rwvfs.Map(map[string]string{}))); got {
+			t.Errorf("%s: got isFetcherFS true for a wrapped VFS that doesn't fetch", label)
+		}
+
+		f, err := openFetcherOrOpen(context.Background(), fs, "f")
+		if err != nil {
+			t.Fatalf("%s: %s", label, err)
+		}
+		r, err := rangeReader(context.Background(), fs, "f", f, 7, 5)
+		if err != nil {
+			t.Fatalf("%s: %s", label, err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: %s", label, err)
+		}
+		f.Close()
+		if want := "world"; string(b) != want {
+			t.Errorf("%s: got %q, want %q", label, b, want)
+		}
+
+		if len(underlying.opened) == 0 {
+			t.Errorf("%s: the wrapped VFS's files were not opened with a fetcher", label)
+		}
+		if fetched := len(underlying.fetched) > 0; fetched != test.fetches {
+			t.Errorf("%s: got fetched %v, want %v", label, fetched, test.fetches)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package store
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/binary"
+
+	"sourcegraph.com/sourcegraph/srclib/store/phtable"
+)
+
+// File indexes (which are keyed on file paths) also contain entries
+// that map case-folded file paths to the actual file paths, to support
+// case-insensitive ByFiles lookups. File paths never begin with a NUL
+// byte, so these keys can't collide with file path keys. The indexes
+// store their keys, so that lookups of keys that aren't present
+// reliably fail.
+const (
+	// foldedFileKeyPrefix begins the keys that map case-folded file
+	// paths to actual file paths.
+	foldedFileKeyPrefix = "\x00fold:"
+
+	// foldedFilesMarkerKey is present in file indexes that contain
+	// case-folded file path keys. (Indexes built by older versions do
+	// not.)
+	foldedFilesMarkerKey = "\x00folded"
+)
+
+// errFileIndexNotFolded is returned by file indexes that were built
+// without case-folded file path keys when they are used for a
+// case-insensitive lookup. The caller should fall back to a scan.
+var errFileIndexNotFolded = &errIndexNotReady{name: "file index with case-folded keys"}
+
+// foldedFileKeys returns the keys (and values) to add to a file index
+// that maps the given files to values so that it supports
+// case-insensitive lookups.
+func foldedFileKeys(files []string) (map[string][]byte, error) {
+	folded := map[string][]string{}
+	for _, f := range files {
+		k := foldedFileKeyPrefix + strings.ToLower(f)
+		folded[k] = append(folded[k], f)
+	}
+	keys := make(map[string][]byte, len(folded)+1)
+	for k, files := range folded {
+		sort.Strings(files)
+		v, err := binary.Marshal(files)
+		if err != nil {
+			return nil, err
+		}
+		keys[k] = v
+	}
+	keys[foldedFilesMarkerKey] = []byte{1}
+	return keys, nil
+}
+
+// indexFilesForLookup returns the file path keys to look up in a file
+// index (that is backed by h) for the files in f. If f is case
+// insensitive, each file is mapped to the actual file paths that are
+// equal to it under case folding.
+func indexFilesForLookup(h *phtable.CHD, f ByFilesFilter) ([]string, error) {
+	if !filesIgnoreCase(f) {
+		return f.ByFiles(), nil
+	}
+	if !h.StoreKeys || h.Get([]byte(foldedFilesMarkerKey)) == nil {
+		return nil, errFileIndexNotFolded
+	}
+	var files []string
+	for _, file := range f.ByFiles() {
+		v := h.Get([]byte(foldedFileKeyPrefix + strings.ToLower(file)))
+		if v == nil {
+			continue
+		}
+		var actual []string
+		if err := binary.Unmarshal(v, &actual); err != nil {
+			return nil, err
+		}
+		files = append(files, actual...)
+	}
+	return files, nil
+}
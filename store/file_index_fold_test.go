@@ -0,0 +1,41 @@
+package store
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestIndexFilesForLookup(t *testing.T) {
+	x := &refFileIndex{}
+	fbr := fileByteRanges{"a/B": byteRanges{0, 1}, "a/b": byteRanges{1, 1}, "c": byteRanges{2, 1}}
+	if err := x.Build(nil, fbr, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := indexFilesForLookup(x.phtable, ByFilesIgnoreCase(true, "A/b", "x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	if want := []string{"a/B", "a/b"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("got files %v, want %v", files, want)
+	}
+
+	// Case-sensitive lookups use the files as-is.
+	files, err = indexFilesForLookup(x.phtable, ByFiles(true, "A/b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"A/b"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("got files %v, want %v", files, want)
+	}
+
+	// Indexes built by older versions don't store keys (or have
+	// case-folded keys), so they can't be used for case-insensitive
+	// lookups.
+	x.phtable.StoreKeys = false
+	if _, err := indexFilesForLookup(x.phtable, ByFilesIgnoreCase(true, "A/b")); !isIndexUnavailable(err) {
+		t.Errorf("got error %v, want index unavailable", err)
+	}
+}
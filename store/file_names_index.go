@@ -0,0 +1,158 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// fileNamesIndex makes it fast to list all of the files in a tree
+// (e.g., to find files by name) without needing to read all of the
+// source unit files.
+type fileNamesIndex struct {
+	files []string // sorted
+	ready bool
+}
+
+var _ interface {
+	Index
+	persistedIndex
+	unitIndexBuilder
+} = (*fileNamesIndex)(nil)
+
+var c_fileNamesIndex_filesByName = &counter{count: new(int64)}
+
+func (x *fileNamesIndex) String() string { return fmt.Sprintf("fileNamesIndex(ready=%v)", x.ready) }
+
+// Covers returns -1 because the fileNamesIndex does not satisfy
+// queries with filters. It is only used by FilesByName.
+func (x *fileNamesIndex) Covers(filters interface{}) int { return -1 }
+
+// FilesByName returns the files in the index whose names match
+// pattern (see matchFileName).
+func (x *fileNamesIndex) FilesByName(pattern string) ([]string, error) {
+	if x.files == nil {
+		panic("files not built/read")
+	}
+
+	c_fileNamesIndex_filesByName.increment()
+
+	return filesMatchingName(x.files, pattern)
+}
+
+// Build implements unitIndexBuilder.
+func (x *fileNamesIndex) Build(units []*unit.SourceUnit) error {
+	x.files = unitFileNames(units)
+	x.ready = true
+	return nil
+}
+
+// Write implements persistedIndex.
+func (x *fileNamesIndex) Write(w io.Writer) error {
+	if x.files == nil {
+		panic("no files to write")
+	}
+	return json.NewEncoder(w).Encode(x.files)
+}
+
+// Read implements persistedIndex.
+func (x *fileNamesIndex) Read(r io.Reader) error {
+	err := json.NewDecoder(r).Decode(&x.files)
+	x.ready = (err == nil)
+	return err
+}
+
+// Ready implements persistedIndex.
+func (x *fileNamesIndex) Ready() bool { return x.ready }
+
+// unitFileNames returns the sorted, de-duplicated list of files in
+// units. It never returns nil.
+func unitFileNames(units []*unit.SourceUnit) []string {
+	seen := map[string]struct{}{}
+	files := []string{}
+	for _, u := range units {
+		for _, f := range u.Files {
+			f = path.Clean(f)
+			if _, present := seen[f]; present {
+				continue
+			}
+			seen[f] = struct{}{}
+			files = append(files, f)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// multiRepoFileNamesIndex lists the files in every version in a
+// multi-repo store, so that FilesByName queries across all repos need
+// only read a single file. It is stored at the root of the multi-repo
+// store and removed whenever data is imported into the store.
+type multiRepoFileNamesIndex struct {
+	trees map[Version][]string
+	ready bool
+}
+
+var _ persistedIndex = (*multiRepoFileNamesIndex)(nil)
+
+var c_multiRepoFileNamesIndex_read = &counter{count: new(int64)}
+
+func (x *multiRepoFileNamesIndex) String() string {
+	return fmt.Sprintf("multiRepoFileNamesIndex(ready=%v)", x.ready)
+}
+
+// multiRepoFileNamesTree is the serialized form of an entry in a
+// multiRepoFileNamesIndex.
+type multiRepoFileNamesTree struct {
+	Repo, CommitID string
+	Files          []string
+}
+
+// Write implements persistedIndex.
+func (x *multiRepoFileNamesIndex) Write(w io.Writer) error {
+	if x.trees == nil {
+		panic("no trees to write")
+	}
+	return json.NewEncoder(w).Encode(x.serialized())
+}
+
+// serialized returns the index's trees in their serialized form,
+// sorted by repo and commit ID.
+func (x *multiRepoFileNamesIndex) serialized() []multiRepoFileNamesTree {
+	versions := make([]*Version, 0, len(x.trees))
+	for v := range x.trees {
+		v := v
+		versions = append(versions, &v)
+	}
+	sortVersions(versions)
+
+	trees := make([]multiRepoFileNamesTree, len(versions))
+	for i, v := range versions {
+		trees[i] = multiRepoFileNamesTree{Repo: v.Repo, CommitID: v.CommitID, Files: x.trees[*v]}
+	}
+	return trees
+}
+
+// Read implements persistedIndex.
+func (x *multiRepoFileNamesIndex) Read(r io.Reader) error {
+	c_multiRepoFileNamesIndex_read.increment()
+
+	var trees []multiRepoFileNamesTree
+	if err := json.NewDecoder(r).Decode(&trees); err != nil {
+		x.ready = false
+		return err
+	}
+	x.trees = make(map[Version][]string, len(trees))
+	for _, t := range trees {
+		x.trees[Version{Repo: t.Repo, CommitID: t.CommitID}] = t.Files
+	}
+	x.ready = true
+	return nil
+}
+
+// Ready implements persistedIndex.
+func (x *multiRepoFileNamesIndex) Ready() bool { return x.ready }
@@ -0,0 +1,75 @@
+package store
+
+import (
+	"sort"
+
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// A TreeFileUnits finds the source units that contain a file (e.g., to
+// route an editor request for a file to the unit that owns it).
+type TreeFileUnits interface {
+	// FileUnits returns the IDs of the source units that contain
+	// file (or, if file is a dir, files underneath it), sorted by
+	// name and then type. In indexed stores, it is a single lookup in
+	// the tree's file-to-units index; source unit files are only read
+	// if the index is unavailable.
+	FileUnits(file string) ([]unit.ID2, error)
+}
+
+// A RepoFileUnits finds the source units in a repo's trees that
+// contain a file.
+type RepoFileUnits interface {
+	FileUnits(commitID, file string) ([]unit.ID2, error)
+}
+
+// A MultiRepoFileUnits finds the source units in trees in multiple
+// repos that contain a file.
+type MultiRepoFileUnits interface {
+	FileUnits(repo, commitID, file string) ([]unit.ID2, error)
+}
+
+func (s *fsTreeStore) FileUnits(file string) ([]unit.ID2, error) {
+	f, err := NewByFilesFilter(false, file)
+	if err != nil {
+		return nil, err
+	}
+	units, err := s.Units(f)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]unit.ID2, len(units))
+	for i, u := range units {
+		ids[i] = u.ID2()
+	}
+	sort.Sort(unitID2s(ids))
+	return ids, nil
+}
+
+func (s *indexedTreeStore) FileUnits(file string) ([]unit.ID2, error) {
+	f, err := NewByFilesFilter(false, file)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := s.unitIDs(false, f)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(unitID2s(ids))
+	return ids, nil
+}
+
+func (s *fsRepoStore) FileUnits(commitID, file string) ([]unit.ID2, error) {
+	return s.newTreeStore(commitID).(TreeFileUnits).FileUnits(file)
+}
+
+func (s *fsMultiRepoStore) FileUnits(repo, commitID, file string) ([]unit.ID2, error) {
+	return s.openRepoStore(repo).(RepoFileUnits).FileUnits(commitID, file)
+}
+
+var (
+	_ TreeFileUnits      = (*fsTreeStore)(nil)
+	_ TreeFileUnits      = (*indexedTreeStore)(nil)
+	_ RepoFileUnits      = (*fsRepoStore)(nil)
+	_ MultiRepoFileUnits = (*fsMultiRepoStore)(nil)
+)
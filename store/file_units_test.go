@@ -0,0 +1,57 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestFSMultiRepoStore_FileUnits(t *testing.T) {
+	for _, indexed := range []bool{false, true} {
+		useIndexedStore = indexed
+		mrs := NewFSMultiRepoStore(newTestFS(), nil)
+		for _, u := range []*unit.SourceUnit{
+			{Key: unit.Key{Type: "t", Name: "u2"}, Info: unit.Info{Files: []string{"a/x.go", "b/y.go"}}},
+			{Key: unit.Key{Type: "t", Name: "u1"}, Info: unit.Info{Files: []string{"a/x.go"}}},
+			{Key: unit.Key{Type: "t", Name: "u3"}, Info: unit.Info{Files: []string{"c/z.go"}}},
+		} {
+			if err := mrs.Import("r", "c", u, graph.Output{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := mrs.Index("r", "c"); err != nil {
+			t.Fatal(err)
+		}
+
+		c_unitFilesIndex_getByPath.set(0)
+		tests := map[string][]unit.ID2{
+			"a/x.go":   {{Type: "t", Name: "u1"}, {Type: "t", Name: "u2"}},
+			"./b/y.go": {{Type: "t", Name: "u2"}},
+			"b":        {{Type: "t", Name: "u2"}},
+			"d.go":     {},
+		}
+		for file, want := range tests {
+			got, err := mrs.(MultiRepoFileUnits).FileUnits("r", "c", file)
+			if err != nil {
+				t.Errorf("indexed=%v: %s: %s", indexed, file, err)
+				continue
+			}
+			if len(got) != 0 || len(want) != 0 {
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("indexed=%v: %s: got units %v, want %v", indexed, file, got, want)
+				}
+			}
+		}
+		if indexed {
+			if got, want := c_unitFilesIndex_getByPath.get(), len(tests); got != want {
+				t.Errorf("got %d index lookups, want %d", got, want)
+			}
+		}
+
+		if _, err := mrs.(MultiRepoFileUnits).FileUnits("r", "c", "../x"); err == nil {
+			t.Errorf("indexed=%v: got no error for file outside tree", indexed)
+		}
+	}
+}
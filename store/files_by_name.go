@@ -0,0 +1,200 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// A TreeFilesByName finds files in a tree by name (e.g., to implement
+// "open file by name").
+type TreeFilesByName interface {
+	// FilesByName returns the sorted list of files in the tree's
+	// source units whose names match pattern (see FilesByName in
+	// MultiRepoFilesByName for the pattern syntax). In indexed
+	// stores, only the tree's file names index is read; source unit
+	// files are only read if the index is unavailable.
+	FilesByName(pattern string) ([]string, error)
+}
+
+// A RepoFilesByName finds files in a repo's trees by name.
+type RepoFilesByName interface {
+	FilesByName(commitID, pattern string) ([]string, error)
+}
+
+// A MultiRepoFilesByName finds files by name in trees in multiple
+// repos.
+type MultiRepoFilesByName interface {
+	// FilesByName returns the files whose names match pattern in all
+	// versions that match the filters, sorted by repo, commit ID, and
+	// path.
+	//
+	// Matching is case-insensitive. If pattern contains a "/", it is
+	// matched against the file's path; otherwise it is matched
+	// against the file's base name. If pattern contains any glob
+	// metacharacters (see path.Match), the whole name must match it;
+	// otherwise, the name must contain it. An empty pattern matches
+	// all files.
+	FilesByName(pattern string, f ...VersionFilter) ([]*VersionFile, error)
+}
+
+// A MultiRepoFileNamesIndexer builds an index of the file names in
+// all versions in a multi-repo store, so that FilesByName queries
+// need only read a single file instead of one index per version.
+//
+// The index is optional. It is removed whenever data is imported into
+// the store (or a version is created); until it is rebuilt,
+// FilesByName reads the per-tree indexes instead.
+type MultiRepoFileNamesIndexer interface {
+	IndexFileNames() error
+}
+
+// A VersionFile is a file in a version of a repo.
+type VersionFile struct {
+	Repo, CommitID string
+
+	// Path is the file's path, relative to the repo root.
+	Path string
+}
+
+const fileNamesIndexName = "file_names"
+
+// validateFileNamePattern returns path.ErrBadPattern if pattern is a
+// malformed glob pattern.
+func validateFileNamePattern(pattern string) error {
+	_, err := path.Match(strings.ToLower(pattern), "")
+	return err
+}
+
+// matchFileName reports whether file's name matches pattern, as
+// described in the FilesByName docs in MultiRepoFilesByName. The
+// pattern must be valid (see validateFileNamePattern).
+func matchFileName(pattern, file string) bool {
+	pattern = strings.ToLower(pattern)
+	name := strings.ToLower(file)
+	if !strings.Contains(pattern, "/") {
+		name = path.Base(name)
+	}
+	if strings.ContainsAny(pattern, `*?[\`) {
+		ok, _ := path.Match(pattern, name)
+		return ok
+	}
+	return strings.Contains(name, pattern)
+}
+
+// filesMatchingName returns the files (which must be sorted) whose
+// names match pattern.
+func filesMatchingName(files []string, pattern string) ([]string, error) {
+	if err := validateFileNamePattern(pattern); err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, f := range files {
+		if matchFileName(pattern, f) {
+			matches = append(matches, f)
+		}
+	}
+	return matches, nil
+}
+
+func (s *fsTreeStore) FilesByName(pattern string) ([]string, error) {
+	if err := validateFileNamePattern(pattern); err != nil {
+		return nil, err
+	}
+	units, err := s.Units()
+	if err != nil {
+		return nil, err
+	}
+	return filesMatchingName(unitFileNames(units), pattern)
+}
+
+func (s *indexedTreeStore) FilesByName(pattern string) ([]string, error) {
+	if err := validateFileNamePattern(pattern); err != nil {
+		return nil, err
+	}
+	x, err := s.prepareCachedIndex(fileNamesIndexName, s.indexes[fileNamesIndexName])
+	if isIndexUnavailable(err) {
+		return s.fsTreeStore.FilesByName(pattern)
+	} else if err != nil {
+		return nil, err
+	}
+	return x.(*fileNamesIndex).FilesByName(pattern)
+}
+
+func (s *fsRepoStore) FilesByName(commitID, pattern string) ([]string, error) {
+	return s.newTreeStore(commitID).(TreeFilesByName).FilesByName(pattern)
+}
+
+func (s *fsMultiRepoStore) FilesByName(pattern string, f ...VersionFilter) ([]*VersionFile, error) {
+	if err := validateFileNamePattern(pattern); err != nil {
+		return nil, err
+	}
+
+	versions, err := s.Versions(f...)
+	if err != nil {
+		return nil, err
+	}
+	sortVersions(versions)
+
+	// Use the multi-repo index for the versions it contains (if it
+	// exists), and the per-tree indexes for the rest.
+	x := &multiRepoFileNamesIndex{}
+	if err := readIndex(s.fs, fileNamesIndexName, x); err != nil && !isIndexUnavailable(err) {
+		return nil, err
+	}
+
+	var files []*VersionFile
+	for _, v := range versions {
+		var names []string
+		if treeFiles, present := x.trees[*v]; present {
+			names, err = filesMatchingName(treeFiles, pattern)
+		} else {
+			names, err = s.openRepoStore(v.Repo).(RepoFilesByName).FilesByName(v.CommitID, pattern)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			files = append(files, &VersionFile{Repo: v.Repo, CommitID: v.CommitID, Path: name})
+		}
+	}
+	return files, nil
+}
+
+func (s *fsMultiRepoStore) IndexFileNames() error {
+	versions, err := s.Versions()
+	if err != nil {
+		return err
+	}
+	x := &multiRepoFileNamesIndex{trees: make(map[Version][]string, len(versions))}
+	for _, v := range versions {
+		files, err := s.openRepoStore(v.Repo).(RepoFilesByName).FilesByName(v.CommitID, "")
+		if err != nil {
+			return err
+		}
+		if files == nil {
+			files = []string{}
+		}
+		x.trees[*v] = files
+	}
+	x.ready = true
+	return writeIndex(s.fs, fileNamesIndexName, x)
+}
+
+// invalidateFileNamesIndex removes the multi-repo file names index. It
+// must be called before data is imported into the store.
+func (s *fsMultiRepoStore) invalidateFileNamesIndex() error {
+	if err := s.fs.Remove(fmt.Sprintf(indexFilename, fileNamesIndexName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+var (
+	_ TreeFilesByName           = (*fsTreeStore)(nil)
+	_ TreeFilesByName           = (*indexedTreeStore)(nil)
+	_ RepoFilesByName           = (*fsRepoStore)(nil)
+	_ MultiRepoFilesByName      = (*fsMultiRepoStore)(nil)
+	_ MultiRepoFileNamesIndexer = (*fsMultiRepoStore)(nil)
+)
@@ -0,0 +1,126 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestFSMultiRepoStore_FilesByName(t *testing.T) {
+	for _, indexed := range []bool{false, true} {
+		useIndexedStore = indexed
+		mrs := NewFSMultiRepoStore(newTestFS(), nil)
+		imports := map[string][]*unit.SourceUnit{
+			"r1": {
+				{Key: unit.Key{Type: "t", Name: "u1"}, Info: unit.Info{Files: []string{"a/Main.go", "a/util.go"}}},
+				{Key: unit.Key{Type: "t", Name: "u2"}, Info: unit.Info{Files: []string{"./a/util.go", "b/main_test.go"}}},
+			},
+			"r2": {
+				{Key: unit.Key{Type: "t", Name: "u"}, Info: unit.Info{Files: []string{"main.c", "x/y.c"}}},
+			},
+		}
+		for repo, units := range imports {
+			for _, u := range units {
+				if err := mrs.Import(repo, "c", u, graph.Output{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := mrs.CreateVersion(repo, "c"); err != nil {
+				t.Fatal(err)
+			}
+			if err := mrs.Index(repo, "c"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tests := map[string][]*VersionFile{
+			"main": {
+				{Repo: "r1", CommitID: "c", Path: "a/Main.go"},
+				{Repo: "r1", CommitID: "c", Path: "b/main_test.go"},
+				{Repo: "r2", CommitID: "c", Path: "main.c"},
+			},
+			"*.c": {
+				{Repo: "r2", CommitID: "c", Path: "main.c"},
+				{Repo: "r2", CommitID: "c", Path: "x/y.c"},
+			},
+			"a/": {
+				{Repo: "r1", CommitID: "c", Path: "a/Main.go"},
+				{Repo: "r1", CommitID: "c", Path: "a/util.go"},
+			},
+			"x/*": {
+				{Repo: "r2", CommitID: "c", Path: "x/y.c"},
+			},
+			"nomatch": nil,
+		}
+		check := func(label string) {
+			for pattern, want := range tests {
+				got, err := mrs.(MultiRepoFilesByName).FilesByName(pattern)
+				if err != nil {
+					t.Errorf("indexed=%v %s: %q: %s", indexed, label, pattern, err)
+					continue
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("indexed=%v %s: %q: got %v, want %v", indexed, label, pattern, got, want)
+				}
+			}
+		}
+
+		c_fileNamesIndex_filesByName.set(0)
+		check("per-tree")
+		if indexed {
+			if got, want := c_fileNamesIndex_filesByName.get(), len(tests)*len(imports); got != want {
+				t.Errorf("got %d tree index lookups, want %d", got, want)
+			}
+		}
+
+		if err := mrs.(MultiRepoFileNamesIndexer).IndexFileNames(); err != nil {
+			t.Fatal(err)
+		}
+		c_fileNamesIndex_filesByName.set(0)
+		c_multiRepoFileNamesIndex_read.set(0)
+		check("multi-repo index")
+		if got := c_fileNamesIndex_filesByName.get(); got != 0 {
+			t.Errorf("indexed=%v: got %d tree index lookups with multi-repo index, want 0", indexed, got)
+		}
+		if got, want := c_multiRepoFileNamesIndex_read.get(), len(tests); got != want {
+			t.Errorf("indexed=%v: got %d multi-repo index reads, want %d", indexed, got, want)
+		}
+
+		got, err := mrs.(MultiRepoFilesByName).FilesByName("main", ByRepos("r2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []*VersionFile{{Repo: "r2", CommitID: "c", Path: "main.c"}}; !reflect.DeepEqual(got, want) {
+			t.Errorf("indexed=%v: ByRepos: got %v, want %v", indexed, got, want)
+		}
+
+		// Importing invalidates the multi-repo index.
+		u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u3"}, Info: unit.Info{Files: []string{"new/main.h"}}}
+		if err := mrs.Import("r2", "c2", u, graph.Output{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.CreateVersion("r2", "c2"); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.Index("r2", "c2"); err != nil {
+			t.Fatal(err)
+		}
+		c_multiRepoFileNamesIndex_read.set(0)
+		got, err = mrs.(MultiRepoFilesByName).FilesByName("*.h")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []*VersionFile{{Repo: "r2", CommitID: "c2", Path: "new/main.h"}}; !reflect.DeepEqual(got, want) {
+			t.Errorf("indexed=%v: after import: got %v, want %v", indexed, got, want)
+		}
+		if got := c_multiRepoFileNamesIndex_read.get(); got != 0 {
+			t.Errorf("indexed=%v: read stale multi-repo index", indexed)
+		}
+
+		if _, err := mrs.(MultiRepoFilesByName).FilesByName("[a-"); err == nil {
+			t.Errorf("indexed=%v: got no error for bad pattern", indexed)
+		}
+	}
+}
@@ -5,8 +5,10 @@ import (
 	"log"
 	"path"
 	"reflect"
+	"regexp"
+	"regexp/syntax"
 	"strings"
-	"sync"
+	"unicode/utf8"
 
 	"sort"
 
@@ -203,6 +205,55 @@ func (f byUnitsFilter) SelectUnit(unit *unit.SourceUnit) bool {
 	return (unit.Type == "" && unit.Name == "") || f.contains(unit.ID2())
 }
 
+// ByUnitTypesFilter is implemented by filters that restrict their
+// selections to items in source units of a set of unit types (e.g.,
+// "GoPackage"). It allows the store to optimize calls by skipping
+// source units (and, in a multi-repo store, repos) that it knows
+// contain no units of the specified types.
+type ByUnitTypesFilter interface {
+	ByUnitTypes() []string
+}
+
+// ByUnitTypes creates a new filter that matches objects in source
+// units of any of the given unit types. It panics if any unit type
+// is empty.
+func ByUnitTypes(unitTypes ...string) interface {
+	DefFilter
+	RefFilter
+	UnitFilter
+	ByUnitTypesFilter
+} {
+	for _, t := range unitTypes {
+		if t == "" {
+			panic("empty unit type")
+		}
+	}
+	return byUnitTypesFilter(unitTypes)
+}
+
+type byUnitTypesFilter []string
+
+func (f byUnitTypesFilter) contains(unitType string) bool {
+	for _, t := range f {
+		if t == unitType {
+			return true
+		}
+	}
+	return false
+}
+
+func (f byUnitTypesFilter) String() string        { return fmt.Sprintf("ByUnitTypes(%v)", []string(f)) }
+func (f byUnitTypesFilter) ByUnitTypes() []string { return []string(f) }
+func (f byUnitTypesFilter) SelectDef(def *graph.Def) bool {
+	return def.UnitType == "" || f.contains(def.UnitType)
+}
+func (f byUnitTypesFilter) SelectRef(ref *graph.Ref) bool {
+	return ref.UnitType == "" || f.contains(ref.UnitType)
+}
+func (f byUnitTypesFilter) SelectUnit(unit *unit.SourceUnit) bool {
+	return unit.Type == "" || f.contains(unit.Type)
+}
+
 // ByCommitIDsFilter is implemented by filters that restrict their
 // selection to items at specific commit IDs. It allows the store to
 // optimize calls by skipping data that it knows is not at any of the
@@ -664,6 +715,72 @@ func (f byDefPathFilter) SelectDef(def *graph.Def) bool {
 	return def.Path == string(f)
 }
 
+// ByDefNameFilter is implemented by filters that restrict their
+// selection to defs with a specific name.
+type ByDefNameFilter interface {
+	ByDefName() string
+}
+
+// ByDefName returns a filter that selects defs whose name is exactly
+// name (unlike ByDefQuery, which matches name prefixes
+// case-insensitively). It panics if name is empty.
+func ByDefName(name string) interface {
+	DefFilter
+	ByDefNameFilter
+} {
+	if name == "" {
+		panic("ByDefName: empty")
+	}
+	return byDefNameFilter(name)
+}
+
+type byDefNameFilter string
+
+func (f byDefNameFilter) String() string    { return fmt.Sprintf("ByDefName(%q)", string(f)) }
+func (f byDefNameFilter) ByDefName() string { return string(f) }
+func (f byDefNameFilter) SelectDef(def *graph.Def) bool {
+	return def.Name == string(f)
+}
+
+// ByDirsFilter is implemented by filters that restrict their
+// selection to defs defined in the files of specific directories.
+type ByDirsFilter interface {
+	ByDirs() []string
+}
+
+// ByDirs returns a filter that selects defs defined in files that are
+// directly in any of the listed directories (not in their
+// subdirectories), e.g., to list the defs of a package or namespace.
+// The dir paths are normalized (with path.Clean), and "." is the
+// tree's root dir. It panics if any dir path is empty.
+func ByDirs(dirs ...string) interface {
+	DefFilter
+	ByDirsFilter
+} {
+	cleaned := make([]string, len(dirs))
+	for i, dir := range dirs {
+		if dir == "" {
+			panic("ByDirs: empty")
+		}
+		cleaned[i] = path.Clean(dir)
+	}
+	return byDirsFilter(cleaned)
+}
+
+type byDirsFilter []string
+
+func (f byDirsFilter) String() string   { return fmt.Sprintf("ByDirs(%v)", []string(f)) }
+func (f byDirsFilter) ByDirs() []string { return f }
+func (f byDirsFilter) SelectDef(def *graph.Def) bool {
+	dir := defDir(def)
+	for _, d := range f {
+		if dir == d && dir != "" {
+			return true
+		}
+	}
+	return false
+}
+
 // ByDefQueryFilter is implemented by filters that restrict their
 // selection to defs whose names match the query.
 type ByDefQueryFilter interface {
@@ -690,6 +807,121 @@ func (f byDefQueryFilter) SelectDef(def *graph.Def) bool {
 	return strings.HasPrefix(strings.ToLower(def.Name), strings.ToLower(string(f)))
 }
 
+// ByDefNameRegexpFilter is implemented by filters that restrict their
+// selection to defs whose names match a regexp.
+type ByDefNameRegexpFilter interface {
+	ByDefNameRegexp() *regexp.Regexp
+}
+
+// ByDefNameRegexp returns a filter that selects defs whose names match
+// re. It panics if re is nil.
+//
+// If re only matches names that begin with a literal prefix (e.g.,
+// "^New[A-Z]" or "(?i)^http"), the filter also implements
+// ByDefQueryFilter with that prefix, so indexed stores use their def
+// query indexes to narrow the candidate defs before matching them
+// against re. (Like ByDefQuery, it then only selects defs that are in
+// those indexes, which omit local defs.) Other regexps are matched
+// against every def's name.
+func ByDefNameRegexp(re *regexp.Regexp) interface {
+	DefFilter
+	ByDefNameRegexpFilter
+} {
+	if re == nil {
+		panic("ByDefNameRegexp: nil regexp")
+	}
+	f := byDefNameRegexpFilter{re}
+	if prefix := regexpLiteralPrefix(re); prefix != "" {
+		return byDefNameRegexpPrefixFilter{f, prefix}
+	}
+	return f
+}
+
+type byDefNameRegexpFilter struct{ re *regexp.Regexp }
+
+func (f byDefNameRegexpFilter) String() string                  { return fmt.Sprintf("ByDefNameRegexp(%q)", f.re) }
+func (f byDefNameRegexpFilter) ByDefNameRegexp() *regexp.Regexp { return f.re }
+func (f byDefNameRegexpFilter) SelectDef(def *graph.Def) bool {
+	return f.re.MatchString(def.Name)
+}
+
+// byDefNameRegexpPrefixFilter is a byDefNameRegexpFilter whose regexp
+// only matches names that begin with prefix.
+type byDefNameRegexpPrefixFilter struct {
+	byDefNameRegexpFilter
+	prefix string
+}
+
+func (f byDefNameRegexpPrefixFilter) ByDefQuery() string { return f.prefix }
+
+// regexpLiteralPrefix returns the lowercased literal prefix that every
+// string that re matches begins with (ignoring case), or "" if there is
+// none. The def query indexes are case-insensitive, so a prefix that is
+// matched case-sensitively still prunes correctly.
+func regexpLiteralPrefix(re *regexp.Regexp) string {
+	r, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	r = r.Simplify()
+	if r.Op != syntax.OpConcat || len(r.Sub) < 2 {
+		return ""
+	}
+	if r.Sub[0].Op != syntax.OpBeginText {
+		return "" // unanchored regexps can match anywhere in the name
+	}
+	var prefix []rune
+	for _, sub := range r.Sub[1:] {
+		if sub.Op != syntax.OpLiteral {
+			break
+		}
+		prefix = append(prefix, sub.Rune...)
+	}
+	return strings.ToLower(string(prefix))
+}
+
+// ByDefKindsFilter is implemented by filters that restrict their
+// selection to defs of specific kinds.
+type ByDefKindsFilter interface {
+	ByDefKinds() []string
+}
+
+// ByDefKinds returns a filter that selects defs whose Kind is any of
+// the given kinds (compared case insensitively). It panics if any kind
+// is empty.
+func ByDefKinds(kinds ...string) interface {
+	DefFilter
+	ByDefKindsFilter
+} {
+	for _, k := range kinds {
+		if k == "" {
+			panic("ByDefKinds: empty kind")
+		}
+	}
+	return byDefKindsFilter(kinds)
+}
+
+type byDefKindsFilter []string
+
+func (f byDefKindsFilter) String() string       { return fmt.Sprintf("ByDefKinds(%v)", []string(f)) }
+func (f byDefKindsFilter) ByDefKinds() []string { return []string(f) }
+func (f byDefKindsFilter) SelectDef(def *graph.Def) bool {
+	for _, k := range f {
+		if strings.EqualFold(def.Kind, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// ByExported returns a filter that selects only exported defs.
+func ByExported() DefFilter { return byExportedFilter{} }
+
+type byExportedFilter struct{}
+
+func (byExportedFilter) String() string                { return "ByExported" }
+func (byExportedFilter) SelectDef(def *graph.Def) bool { return def.Exported }
+
 // ByFilesFilter is implemented by filters that restrict their
 // selection to defs, refs, etc., that exist in any file in a set, or
 // source units that contain any of the files in the set.
@@ -698,9 +930,9 @@ type ByFilesFilter interface {
 }
 
 // ByFiles returns a filter that selects objects that are defined in
-// or contain any of the listed files. It panics if any file path is
-// empty, or if the file path has not been cleaned (i.e., if file !=
-// path.Clean(file)).
+// or contain any of the listed files. The file paths are normalized
+// (with path.Clean), so "./dir/file.go" and "dir/file.go" are
+// equivalent. It panics if any file path is empty.
 //
 // If exact == true, then only the exact files are accepted (i.e. a directory
 // path will not include all files in that directory as it would normally).
@@ -710,126 +942,216 @@ func ByFiles(exact bool, files ...string) interface {
 	UnitFilter
 	ByFilesFilter
 } {
-	for _, f := range files {
+	return byFilesFilter{files: cleanFilterFiles(files), exact: exact}
+}
+
+// ByFilesIgnoreCase is like ByFiles, but file paths are compared case
+// insensitively (e.g., for data produced on case-insensitive
+// filesystems). File indexes built before case-insensitive matching
+// was supported can't be used for these queries, so they fall back
+// to scans until the indexes are rebuilt.
+func ByFilesIgnoreCase(exact bool, files ...string) interface {
+	DefFilter
+	RefFilter
+	UnitFilter
+	ByFilesFilter
+} {
+	return byFilesFilter{files: cleanFilterFiles(files), exact: exact, ignoreCase: true}
+}
+
+// cleanFilterFiles returns the cleaned file paths. It panics if any
+// file path is empty.
+func cleanFilterFiles(files []string) []string {
+	cleaned := make([]string, len(files))
+	for i, f := range files {
 		if f == "" {
 			panic("file: empty")
 		}
-		if f != path.Clean(f) {
-			panic("file: not cleaned (file != path.Clean(file))")
-		}
+		cleaned[i] = path.Clean(f)
 	}
-	return byFilesFilter{files: files, exact: exact}
+	return cleaned
+}
+
+// filesIgnoreCase reports whether f's file paths are compared case
+// insensitively.
+func filesIgnoreCase(f ByFilesFilter) bool {
+	if f, ok := f.(interface {
+		IgnoreCase() bool
+	}); ok {
+		return f.IgnoreCase()
+	}
+	return false
 }
 
 type byFilesFilter struct {
-	files []string
-	exact bool
+	files      []string
+	exact      bool
+	ignoreCase bool
 }
 
 func (f byFilesFilter) String() string {
+	if f.ignoreCase {
+		return fmt.Sprintf("ByFiles(%v, exact=%t, ignoreCase=true)", ([]string)(f.files), f.exact)
+	}
 	return fmt.Sprintf("ByFiles(%v, exact=%t)", ([]string)(f.files), f.exact)
 }
 func (f byFilesFilter) ByFiles() []string { return f.files }
-func (f byFilesFilter) SelectDef(def *graph.Def) bool {
+func (f byFilesFilter) IgnoreCase() bool  { return f.ignoreCase }
+
+// match reports whether file is (or, if !f.exact, is underneath) any
+// of f's files.
+func (f byFilesFilter) match(file string) bool {
 	for _, ff := range f.files {
-		if def.File == ff || (!f.exact && strings.HasPrefix(def.File, ff+"/")) {
+		if f.ignoreCase {
+			if rest, ok := trimPrefixFold(file, ff); ok && (rest == "" || (!f.exact && rest[0] == '/')) {
+				return true
+			}
+		} else if file == ff || (!f.exact && strings.HasPrefix(file, ff+"/")) {
 			return true
 		}
 	}
 	return false
 }
-func (f byFilesFilter) SelectRef(ref *graph.Ref) bool {
-	for _, ff := range f.files {
-		if ref.File == ff || (!f.exact && strings.HasPrefix(ref.File, ff+"/")) {
-			return true
+
+// trimPrefixFold returns s without prefix (compared case
+// insensitively, like strings.EqualFold) and true, or false if s
+// doesn't have the prefix. The case-folded forms of a character may
+// have different lengths in bytes, so the strings are compared rune
+// by rune.
+func trimPrefixFold(s, prefix string) (string, bool) {
+	for prefix != "" {
+		if s == "" {
+			return "", false
+		}
+		_, n1 := utf8.DecodeRuneInString(s)
+		_, n2 := utf8.DecodeRuneInString(prefix)
+		if !strings.EqualFold(s[:n1], prefix[:n2]) {
+			return "", false
 		}
+		s, prefix = s[n1:], prefix[n2:]
 	}
-	return false
+	return s, true
 }
+
+func (f byFilesFilter) SelectDef(def *graph.Def) bool { return f.match(def.File) }
+func (f byFilesFilter) SelectRef(ref *graph.Ref) bool { return f.match(ref.File) }
 func (f byFilesFilter) SelectUnit(unit *unit.SourceUnit) bool {
 	for _, unitFile := range unit.Files {
-		for _, ff := range f.files {
-			if ff == unitFile || (!f.exact && strings.HasPrefix(unitFile, ff+"/")) {
-				return true
-			}
+		if f.match(unitFile) {
+			return true
 		}
 	}
 	return false
 }
 
-// Limit is an EXPERIMENTAL filter for limiting the number of
-// results. It is not correct because it assumes that if it is called
-// on an object, it gets to decide whether that object appears in the
-// final results. In reality, other filters could reject the object,
-// and then those would count toward the limit for this filter but
-// would never get returned. We could guarantee that Limit always runs
-// last (after all other filters have accepted something).
-func Limit(limit, offset int) interface {
+// ByAuthorFilter is implemented by filters that restrict their
+// selection to defs authored by specific people.
+type ByAuthorFilter interface {
+	ByAuthor() []string
+}
+
+// ByAuthor returns a filter that selects defs whose Author is any of
+// the given authors (compared case insensitively). Def authors are
+// only known if authorship information was recorded at import time
+// (see the blame package). It panics if any author is empty.
+func ByAuthor(authors ...string) interface {
 	DefFilter
-	RefFilter
+	ByAuthorFilter
 } {
-	return &limiter{n: limit, ofs: offset}
+	for _, a := range authors {
+		if a == "" {
+			panic("ByAuthor: empty author")
+		}
+	}
+	return byAuthorFilter(authors)
 }
 
-type limiter struct {
-	n   int
-	ofs int
+type byAuthorFilter []string
 
-	mu      sync.Mutex
-	skipped map[interface{}]struct{}
-	seen    map[interface{}]struct{}
+func (f byAuthorFilter) String() string     { return fmt.Sprintf("ByAuthor(%v)", []string(f)) }
+func (f byAuthorFilter) ByAuthor() []string { return []string(f) }
+func (f byAuthorFilter) SelectDef(def *graph.Def) bool {
+	for _, a := range f {
+		if strings.EqualFold(def.Author, a) {
+			return true
+		}
+	}
+	return false
 }
 
-func (l *limiter) String() string {
-	return fmt.Sprintf("Limit(%d offset %d: %d remaining)", l.n, l.ofs, l.remainingOffsetPlusLimit())
+// ByOwnerFilter is implemented by filters that restrict their
+// selection to defs and source units owned by specific owners.
+type ByOwnerFilter interface {
+	ByOwner() []string
 }
-func (l *limiter) remainingOffsetPlusLimit() int {
-	l.mu.Lock()
-	r := l.n + l.ofs - len(l.seen) - len(l.skipped)
-	l.mu.Unlock()
-	return r
-}
-func (l *limiter) SelectDef(def *graph.Def) bool { return l.selectObj(def) }
-func (l *limiter) SelectRef(ref *graph.Ref) bool { return l.selectObj(ref) }
-func (l *limiter) selectObj(obj interface{}) bool {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	if l.ofs > 0 && l.skipped == nil {
-		l.skipped = make(map[interface{}]struct{}, l.ofs)
-	}
-	if len(l.skipped) < l.ofs {
-		l.skipped[obj] = struct{}{}
-		return false
-	}
-	if _, skipped := l.skipped[obj]; skipped {
-		return false
-	}
-	if l.seen == nil {
-		l.seen = make(map[interface{}]struct{}, l.n)
-	}
-	if _, seen := l.seen[obj]; seen {
-		return true
+
+// ByOwner returns a filter that selects defs and source units that
+// have any of the given owners (compared case insensitively). Owners
+// are only known if ownership information was recorded at import time
+// (see the codeowners package). It panics if any owner is empty.
+func ByOwner(owners ...string) interface {
+	DefFilter
+	UnitFilter
+	ByOwnerFilter
+} {
+	for _, o := range owners {
+		if o == "" {
+			panic("ByOwner: empty owner")
+		}
 	}
-	if len(l.seen) < l.n {
-		l.seen[obj] = struct{}{}
-		return true
+	return byOwnerFilter(owners)
+}
+
+type byOwnerFilter []string
+
+func (f byOwnerFilter) String() string    { return fmt.Sprintf("ByOwner(%v)", []string(f)) }
+func (f byOwnerFilter) ByOwner() []string { return []string(f) }
+func (f byOwnerFilter) SelectDef(def *graph.Def) bool {
+	return f.selectOwners(def.Owners)
+}
+func (f byOwnerFilter) SelectUnit(unit *unit.SourceUnit) bool {
+	return f.selectOwners(unit.Owners)
+}
+func (f byOwnerFilter) selectOwners(owners []string) bool {
+	for _, want := range f {
+		for _, o := range owners {
+			if strings.EqualFold(o, want) {
+				return true
+			}
+		}
 	}
 	return false
 }
 
-// LimitRemaining returns how many more results may be added before
-// the limit is exceeded (specified by the Limit filter, for
-// example). If additional results may be added (either because the
-// limit has not been reached, or there is no limit), moreOK is true.
-func LimitRemaining(filters interface{}) (remaining int, moreOK bool) {
-	for _, f := range storeFilters(filters) {
-		switch f := f.(type) {
-		case *limiter:
-			m := f.remainingOffsetPlusLimit()
-			return m, m > 0
-		}
+// ByUnitMetadataFilter is implemented by filters that restrict their
+// selection to source units with a specific metadata value.
+type ByUnitMetadataFilter interface {
+	ByUnitMetadata() (key, value string)
+}
+
+// ByUnitMetadata returns a filter that selects source units whose
+// Metadata maps key to value (compared exactly). Metadata is only
+// known if it was set on the source units at import time. It panics
+// if key is empty.
+func ByUnitMetadata(key, value string) interface {
+	UnitFilter
+	ByUnitMetadataFilter
+} {
+	if key == "" {
+		panic("ByUnitMetadata: empty key")
 	}
-	return 0, true
+	return byUnitMetadataFilter{key: key, value: value}
+}
+
+type byUnitMetadataFilter struct{ key, value string }
+
+func (f byUnitMetadataFilter) String() string {
+	return fmt.Sprintf("ByUnitMetadata(%q, %q)", f.key, f.value)
+}
+func (f byUnitMetadataFilter) ByUnitMetadata() (key, value string) { return f.key, f.value }
+func (f byUnitMetadataFilter) SelectUnit(unit *unit.SourceUnit) bool {
+	v, present := unit.Metadata[f.key]
+	return present && v == f.value
 }
 
 // storeFilters converts from slice-of-filter-type (e.g., []DefFilter,
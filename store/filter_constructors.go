@@ -0,0 +1,273 @@
+package store
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// The NewBy*Filter funcs in this file are like the corresponding By*
+// filter constructors, but they validate and normalize their
+// arguments and return an error instead of panicking (or silently
+// producing a filter that can never select anything). Use them when
+// constructing filters from untrusted or user-supplied input.
+
+// A FilterError describes invalid arguments passed to a NewBy*Filter
+// constructor.
+type FilterError struct {
+	Filter string // the filter name (e.g., "ByRepos")
+	Err    string // the reason the arguments are invalid
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("invalid %s filter: %s", e.Filter, e.Err)
+}
+
+// normalizeStrings removes duplicate values (preserving order). It
+// returns an error if no values are given or any value is blank.
+func normalizeStrings(filter, what string, vals []string) ([]string, error) {
+	if len(vals) == 0 {
+		return nil, &FilterError{Filter: filter, Err: "no " + what + "s given (the filter would select nothing)"}
+	}
+	seen := make(map[string]struct{}, len(vals))
+	norm := make([]string, 0, len(vals))
+	for _, v := range vals {
+		if strings.TrimSpace(v) == "" {
+			return nil, &FilterError{Filter: filter, Err: "empty " + what}
+		}
+		if _, dup := seen[v]; dup {
+			continue
+		}
+		seen[v] = struct{}{}
+		norm = append(norm, v)
+	}
+	return norm, nil
+}
+
+// NewByReposFilter is like ByRepos, but it returns an error if no
+// repos are given or any repo is blank, and it removes duplicate
+// repos.
+func NewByReposFilter(repos ...string) (interface {
+	DefFilter
+	RefFilter
+	UnitFilter
+	VersionFilter
+	RepoFilter
+	ByReposFilter
+}, error) {
+	repos, err := normalizeStrings("ByRepos", "repo", repos)
+	if err != nil {
+		return nil, err
+	}
+	return ByRepos(repos...), nil
+}
+
+// NewByCommitIDsFilter is like ByCommitIDs, but it returns an error if
+// no commit IDs are given or any commit ID is blank, and it removes
+// duplicate commit IDs.
+func NewByCommitIDsFilter(commitIDs ...string) (interface {
+	DefFilter
+	RefFilter
+	UnitFilter
+	VersionFilter
+	ByCommitIDsFilter
+}, error) {
+	commitIDs, err := normalizeStrings("ByCommitIDs", "commit ID", commitIDs)
+	if err != nil {
+		return nil, err
+	}
+	return ByCommitIDs(commitIDs...), nil
+}
+
+// NewByRepoCommitIDsFilter is like ByRepoCommitIDs, but it returns an
+// error if no versions are given or any version's repo or commit ID is
+// blank, and it removes duplicate versions.
+func NewByRepoCommitIDsFilter(versions ...Version) (interface {
+	DefFilter
+	RefFilter
+	UnitFilter
+	VersionFilter
+	RepoFilter
+	ByReposFilter
+	ByRepoCommitIDsFilter
+}, error) {
+	const filter = "ByRepoCommitIDs"
+	if len(versions) == 0 {
+		return nil, &FilterError{Filter: filter, Err: "no versions given (the filter would select nothing)"}
+	}
+	seen := make(map[Version]struct{}, len(versions))
+	norm := make([]Version, 0, len(versions))
+	for _, v := range versions {
+		if strings.TrimSpace(v.Repo) == "" {
+			return nil, &FilterError{Filter: filter, Err: "empty repo"}
+		}
+		if strings.TrimSpace(v.CommitID) == "" {
+			return nil, &FilterError{Filter: filter, Err: fmt.Sprintf("empty commit ID for repo %q", v.Repo)}
+		}
+		if _, dup := seen[v]; dup {
+			continue
+		}
+		seen[v] = struct{}{}
+		norm = append(norm, v)
+	}
+	return ByRepoCommitIDs(norm...), nil
+}
+
+// NewByUnitsFilter is like ByUnits, but it returns an error if no
+// units are given or any unit's type or name is empty, and it removes
+// duplicate units.
+func NewByUnitsFilter(units ...unit.ID2) (interface {
+	DefFilter
+	RefFilter
+	UnitFilter
+	ByUnitsFilter
+}, error) {
+	const filter = "ByUnits"
+	if len(units) == 0 {
+		return nil, &FilterError{Filter: filter, Err: "no source units given (the filter would select nothing)"}
+	}
+	seen := make(map[unit.ID2]struct{}, len(units))
+	norm := make([]unit.ID2, 0, len(units))
+	for _, u := range units {
+		if u.Type == "" {
+			return nil, &FilterError{Filter: filter, Err: fmt.Sprintf("empty type for source unit %q", u.Name)}
+		}
+		if u.Name == "" {
+			return nil, &FilterError{Filter: filter, Err: fmt.Sprintf("empty name for source unit of type %q", u.Type)}
+		}
+		if _, dup := seen[u]; dup {
+			continue
+		}
+		seen[u] = struct{}{}
+		norm = append(norm, u)
+	}
+	return ByUnits(norm...), nil
+}
+
+// NewByUnitTypesFilter is like ByUnitTypes, but it returns an error
+// if no unit types are given or any unit type is blank, and it removes
+// duplicate unit types.
+func NewByUnitTypesFilter(unitTypes ...string) (interface {
+	DefFilter
+	RefFilter
+	UnitFilter
+	ByUnitTypesFilter
+}, error) {
+	unitTypes, err := normalizeStrings("ByUnitTypes", "unit type", unitTypes)
+	if err != nil {
+		return nil, err
+	}
+	return ByUnitTypes(unitTypes...), nil
+}
+
+// NewByUnitMetadataFilter is like ByUnitMetadata, but it returns an
+// error if key is blank.
+func NewByUnitMetadataFilter(key, value string) (interface {
+	UnitFilter
+	ByUnitMetadataFilter
+}, error) {
+	if strings.TrimSpace(key) == "" {
+		return nil, &FilterError{Filter: "ByUnitMetadata", Err: "empty metadata key"}
+	}
+	return ByUnitMetadata(key, value), nil
+}
+
+// NewByFilesFilter is like ByFiles, but it cleans the file paths
+// (instead of panicking if they are not clean) and removes duplicates.
+// It returns an error if no files are given or if any file path is
+// blank, absolute, refers to the root directory, or refers to a file
+// outside of the tree (e.g., "../foo").
+func NewByFilesFilter(exact bool, files ...string) (interface {
+	DefFilter
+	RefFilter
+	UnitFilter
+	ByFilesFilter
+}, error) {
+	const filter = "ByFiles"
+	files, err := normalizeStrings(filter, "file", files)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]struct{}, len(files))
+	norm := make([]string, 0, len(files))
+	for _, f := range files {
+		if path.IsAbs(f) {
+			return nil, &FilterError{Filter: filter, Err: fmt.Sprintf("absolute file path %q (paths must be relative to the tree root)", f)}
+		}
+		f = path.Clean(f)
+		if f == "." {
+			return nil, &FilterError{Filter: filter, Err: "file path refers to the tree root (omit the filter to select all files)"}
+		}
+		if f == ".." || strings.HasPrefix(f, "../") {
+			return nil, &FilterError{Filter: filter, Err: fmt.Sprintf("file path %q is outside of the tree", f)}
+		}
+		if _, dup := seen[f]; dup {
+			continue
+		}
+		seen[f] = struct{}{}
+		norm = append(norm, f)
+	}
+	return ByFiles(exact, norm...), nil
+}
+
+// NewByDefPathFilter is like ByDefPath, but it returns an error if
+// defPath is empty (or, if StrictDefKeys is set, not clean).
+func NewByDefPathFilter(defPath string) (interface {
+	DefFilter
+	ByDefPathFilter
+}, error) {
+	const filter = "ByDefPath"
+	if defPath == "" {
+		return nil, &FilterError{Filter: filter, Err: "empty def path"}
+	}
+	if StrictDefKeys {
+		if err := graph.ValidateDefPath("Path", defPath); err != nil {
+			return nil, &FilterError{Filter: filter, Err: err.Error()}
+		}
+	}
+	return ByDefPath(defPath), nil
+}
+
+// NewByDefKeyFilter is like ByDefKey, but it returns an error instead
+// of panicking if key.Path is empty, and it normalizes key.Repo. If
+// StrictDefKeys is set, it also returns an error if the key is
+// malformed (see graph.ValidateDefKey).
+func NewByDefKeyFilter(key graph.DefKey) (interface {
+	DefFilter
+	ByReposFilter
+	ByCommitIDsFilter
+	ByUnitsFilter
+}, error) {
+	const filter = "ByDefKey"
+	if key.Path == "" {
+		return nil, &FilterError{Filter: filter, Err: "empty def path"}
+	}
+	if StrictDefKeys {
+		if err := graph.ValidateDefKey(key); err != nil {
+			return nil, &FilterError{Filter: filter, Err: err.Error()}
+		}
+	}
+	key.Repo = graph.NormalizeRepoURI(key.Repo)
+	return ByDefKey(key), nil
+}
+
+// NewByRefDefFilter is like ByRefDef, but it returns an error instead
+// of panicking if def.DefPath is empty, and it normalizes def.DefRepo.
+// If StrictDefKeys is set, it also returns an error if the key is
+// malformed (see graph.ValidateRefDefKey).
+func NewByRefDefFilter(def graph.RefDefKey) (RefFilter, error) {
+	const filter = "ByRefDef"
+	if def.DefPath == "" {
+		return nil, &FilterError{Filter: filter, Err: "empty def path"}
+	}
+	if StrictDefKeys {
+		if err := graph.ValidateRefDefKey(def); err != nil {
+			return nil, &FilterError{Filter: filter, Err: err.Error()}
+		}
+	}
+	def.DefRepo = graph.NormalizeRepoURI(def.DefRepo)
+	return ByRefDef(def), nil
+}
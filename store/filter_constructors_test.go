@@ -0,0 +1,126 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestNewByReposFilter(t *testing.T) {
+	f, err := NewByReposFilter("r1", "r2", "r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"r1", "r2"}; !reflect.DeepEqual(f.ByRepos(), want) {
+		t.Errorf("got repos %v, want %v", f.ByRepos(), want)
+	}
+
+	for _, repos := range [][]string{nil, {"r", ""}, {" "}} {
+		if _, err := NewByReposFilter(repos...); err == nil {
+			t.Errorf("%q: got no error", repos)
+		} else if _, ok := err.(*FilterError); !ok {
+			t.Errorf("%q: got error %v, want *FilterError", repos, err)
+		}
+	}
+}
+
+func TestNewByRepoCommitIDsFilter(t *testing.T) {
+	v := Version{Repo: "r", CommitID: "c"}
+	f, err := NewByRepoCommitIDsFilter(v, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Version{v}; !reflect.DeepEqual(f.ByRepoCommitIDs(), want) {
+		t.Errorf("got versions %v, want %v", f.ByRepoCommitIDs(), want)
+	}
+
+	for _, vs := range [][]Version{nil, {{Repo: "r"}}, {{CommitID: "c"}}} {
+		if _, err := NewByRepoCommitIDsFilter(vs...); err == nil {
+			t.Errorf("%v: got no error", vs)
+		}
+	}
+}
+
+func TestNewByUnitsFilter(t *testing.T) {
+	u := unit.ID2{Type: "t", Name: "u"}
+	f, err := NewByUnitsFilter(u, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []unit.ID2{u}; !reflect.DeepEqual(f.ByUnits(), want) {
+		t.Errorf("got units %v, want %v", f.ByUnits(), want)
+	}
+
+	for _, us := range [][]unit.ID2{nil, {{Type: "t"}}, {{Name: "u"}}} {
+		if _, err := NewByUnitsFilter(us...); err == nil {
+			t.Errorf("%v: got no error", us)
+		}
+	}
+}
+
+func TestNewByFilesFilter(t *testing.T) {
+	f, err := NewByFilesFilter(true, "a/b", "./a/b", "a//c/", "d/../e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a/b", "a/c", "e"}; !reflect.DeepEqual(f.ByFiles(), want) {
+		t.Errorf("got files %v, want %v", f.ByFiles(), want)
+	}
+
+	for _, files := range [][]string{nil, {""}, {"/a"}, {"."}, {"a/.."}, {"../a"}, {"a/../../b"}} {
+		if _, err := NewByFilesFilter(false, files...); err == nil {
+			t.Errorf("%q: got no error", files)
+		}
+	}
+}
+
+func TestNewByDefPathFilter(t *testing.T) {
+	if _, err := NewByDefPathFilter(""); err == nil {
+		t.Error("got no error for empty def path")
+	}
+	f, err := NewByDefPathFilter("p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.ByDefPath() != "p" {
+		t.Errorf("got def path %q, want %q", f.ByDefPath(), "p")
+	}
+}
+
+func TestNewByDefKeyFilter(t *testing.T) {
+	defer func(strict bool) { StrictDefKeys = strict }(StrictDefKeys)
+
+	key := graph.DefKey{Repo: "https://github.com/a/b.git", UnitType: "t", Unit: "u", Path: "p"}
+	f, err := NewByDefKeyFilter(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"github.com/a/b"}; !reflect.DeepEqual(f.ByRepos(), want) {
+		t.Errorf("got repos %v, want %v", f.ByRepos(), want)
+	}
+	if _, err := NewByDefKeyFilter(graph.DefKey{}); err == nil {
+		t.Error("got no error for empty def path")
+	}
+	if _, err := NewByRefDefFilter(graph.RefDefKey{}); err == nil {
+		t.Error("ByRefDef: got no error for empty def path")
+	}
+
+	malformed := graph.DefKey{Unit: "u", Path: "p/"}
+	for _, strict := range []bool{false, true} {
+		StrictDefKeys = strict
+		_, err1 := NewByDefKeyFilter(malformed)
+		_, err2 := NewByRefDefFilter(graph.RefDefKey{DefUnit: malformed.Unit, DefPath: malformed.Path})
+		_, err3 := NewByDefPathFilter(malformed.Path)
+		for i, err := range []error{err1, err2, err3} {
+			if strict {
+				if _, ok := err.(*FilterError); !ok {
+					t.Errorf("strict, filter %d: got error %v, want *FilterError", i, err)
+				}
+			} else if err != nil {
+				t.Errorf("non-strict, filter %d: got error %v, want nil", i, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package store
+
+import (
+	"reflect"
+	"regexp"
+	"sort"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestRegexpLiteralPrefix(t *testing.T) {
+	tests := map[string]string{
+		"^New":         "new",
+		"^New[A-Z]":    "new",
+		"(?i)^http":    "http",
+		"^ab*":         "a",
+		"^fo(o|x)":     "fo",
+		"New":          "",
+		"^(New|Make)":  "",
+		"(?m)^New":     "",
+		"^[Nn]ew":      "new",
+		"^":            "",
+		"^New|^Make":   "",
+		`^New\.Thing$`: "new.thing",
+	}
+	for expr, want := range tests {
+		if got := regexpLiteralPrefix(regexp.MustCompile(expr)); got != want {
+			t.Errorf("%q: got prefix %q, want %q", expr, got, want)
+		}
+	}
+}
+
+func TestByDefNameRegexp(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+
+	var data graph.Output
+	for _, name := range []string{"NewFoo", "NewBar", "newlower", "Other", "Newline"} {
+		data.Defs = append(data.Defs, &graph.Def{DefKey: graph.DefKey{Path: name}, Name: name})
+	}
+
+	tests := []struct {
+		expr      string
+		want      []string
+		usesIndex bool
+		hasPrefix bool
+	}{
+		{"^New[A-Z]", []string{"NewBar", "NewFoo"}, true, true},
+		{"(?i)^new", []string{"NewBar", "NewFoo", "Newline", "newlower"}, true, true},
+		{"^Newx", nil, true, true},
+		{"Foo$", []string{"NewFoo"}, false, false},
+		{"e", []string{"NewBar", "NewFoo", "Newline", "Other", "newlower"}, false, false},
+	}
+	for _, indexed := range []bool{false, true} {
+		useIndexedStore = indexed
+		mrs := NewFSMultiRepoStore(newTestFS(), nil)
+		for _, name := range []string{"u1", "u2"} {
+			if err := mrs.Import("r", "c", &unit.SourceUnit{Key: unit.Key{Type: "t", Name: name}}, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := mrs.CreateVersion("r", "c"); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.Index("r", "c"); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range tests {
+			f := ByDefNameRegexp(regexp.MustCompile(test.expr))
+			if _, ok := f.(ByDefQueryFilter); ok != test.hasPrefix {
+				t.Errorf("%q: got ByDefQueryFilter %v, want %v", test.expr, ok, test.hasPrefix)
+			}
+
+			c_defQueryIndex_getByQuery.set(0)
+			c_defQueryTreeIndex_getByQuery.set(0)
+			for _, u := range []string{"u1", ""} {
+				fs := []DefFilter{ByRepos("r"), f}
+				if u != "" {
+					fs = append(fs, ByUnits(unit.ID2{Type: "t", Name: u}))
+				}
+				defs, err := mrs.Defs(fs...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				names := map[string]struct{}{}
+				for _, def := range defs {
+					names[def.Name] = struct{}{}
+				}
+				var got []string
+				for name := range names {
+					got = append(got, name)
+				}
+				sort.Strings(got)
+				if !reflect.DeepEqual(got, test.want) {
+					t.Errorf("indexed=%v %q unit=%q: got defs %v, want %v", indexed, test.expr, u, got, test.want)
+				}
+			}
+			lookups := c_defQueryIndex_getByQuery.get() + c_defQueryTreeIndex_getByQuery.get()
+			if want := indexed && test.usesIndex; (lookups > 0) != want {
+				t.Errorf("indexed=%v %q: got %d def query index lookups", indexed, test.expr, lookups)
+			}
+		}
+	}
+}
+
+func TestByFilesIgnoreCase_match(t *testing.T) {
+	tests := []struct {
+		exact bool
+		file  string
+		ff    string
+		want  bool
+	}{
+		{true, "A/b.go", "a/B.go", true},
+		{false, "A/b.go", "a", true},
+		{false, "ab.go", "a", false},
+		{true, "a/b.go", "a", false},
+
+		// The Kelvin sign (3 bytes in UTF-8) folds to "k" (1 byte).
+		{false, "k/a.go", "K", true},
+		{false, "K/a.go", "K", true},
+		{true, "K.go", "k.go", true},
+		{false, "Ka/b.go", "k", false},
+	}
+	for _, test := range tests {
+		if got := ByFilesIgnoreCase(test.exact, test.ff).(byFilesFilter).match(test.file); got != test.want {
+			t.Errorf("ByFilesIgnoreCase(%t, %q) on %q: got %t, want %t", test.exact, test.ff, test.file, got, test.want)
+		}
+	}
+}
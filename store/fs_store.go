@@ -15,6 +15,7 @@ import (
 	"github.com/neelance/parallel"
 
 	"github.com/kr/fs"
+	"golang.org/x/net/context"
 	"golang.org/x/tools/godoc/vfs"
 
 	"sort"
@@ -37,13 +38,48 @@ type fsMultiRepoStore struct {
 	fs rwvfs.WalkableFileSystem
 	FSMultiRepoStoreConf
 	repoStores
+
+	usageMu      sync.Mutex // guards the repos' usage accounting files
+	dependentsMu sync.Mutex // guards the repos' dependents files
+	tombstonesMu sync.Mutex // guards the hidden repos' tombstones file
+	redirectsMu  sync.Mutex // guards the renamed repos' redirects file (and redirectsCache)
+	sharedDataMu sync.Mutex // guards the repos' shared data refs files
+	casMu        sync.Mutex // guards the content-addressed objects (ContentAddressed only)
+
+	unitTypeHintsMu sync.Mutex // guards the repos' unit type hints files
+
+	gen uint64 // write generation (see generationOf); accessed atomically
+
+	redirectsCache repoRedirects // cached redirects of renamed repos
+
+	pinned *PinnedIndexStats // indexes pinned at open (PinIndexes only)
+	pinErr error             // error that occurred while pinning indexes
+
+	fsStoreSettings            // settings passed down to repo stores (see settings)
+	confCodec       codec      // the codec that the store was opened with (nil if FSMultiRepoStoreConf.Codec is empty)
+	manifestMu      sync.Mutex // guards dataCodec, codecKnown, and manifestPending
+	codecKnown      bool       // whether the store's codec was determined (see settings)
+	manifestPending bool       // whether the store manifest must be written before importing
 }
 
 var _ MultiRepoStoreImporterIndexer = (*fsMultiRepoStore)(nil)
 
 // NewFSMultiRepoStore creates a new repository store (that can be
-// imported into) that is backed by files on a filesystem.
+// imported into) that is backed by files on a filesystem. It panics if
+// the store can't be opened (e.g., because conf is invalid); use
+// OpenFSMultiRepoStore to handle the error.
 func NewFSMultiRepoStore(fs rwvfs.WalkableFileSystem, conf *FSMultiRepoStoreConf) MultiRepoStoreImporterIndexer {
+	mrs, err := OpenFSMultiRepoStore(fs, conf)
+	if err != nil {
+		panic("NewFSMultiRepoStore: " + err.Error())
+	}
+	return mrs
+}
+
+// OpenFSMultiRepoStore is like NewFSMultiRepoStore, except that it
+// returns an error if the store can't be opened (e.g., because conf is
+// invalid).
+func OpenFSMultiRepoStore(fs rwvfs.WalkableFileSystem, conf *FSMultiRepoStoreConf) (MultiRepoStoreImporterIndexer, error) {
 	if conf == nil {
 		conf = &FSMultiRepoStoreConf{}
 	}
@@ -51,10 +87,38 @@ func NewFSMultiRepoStore(fs rwvfs.WalkableFileSystem, conf *FSMultiRepoStoreConf
 		conf.RepoPaths = DefaultRepoPaths
 	}
 
+	fs, err := NewWritePolicyFS(fs, conf.FSStoreConf)
+	if err != nil {
+		return nil, err
+	}
+	fs = NewThrottledFS(fs, conf.FSStoreConf)
+	if conf.EncryptionKey != nil {
+		fs = NewEncryptedFS(fs, conf.EncryptionKey)
+	}
+	if conf.ContentAddressed {
+		// Objects are named by the digest of their plaintext, so
+		// that encryption's random nonces don't prevent sharing.
+		fs = newCASFS(fs)
+	}
+
 	setCreateParentDirs(fs)
 	mrs := &fsMultiRepoStore{fs: fs, FSMultiRepoStoreConf: *conf}
 	mrs.repoStores = repoStores{mrs}
-	return mrs
+	if conf.Codec != "" {
+		if mrs.confCodec, err = ParseCodec(conf.Codec); err != nil {
+			return nil, err
+		}
+	}
+	mrs.importLimits = conf.ImportLimits
+	mrs.lazyIndexes = conf.LazyIndexes
+	mrs.skipIndexes, err = skippedIndexes(conf.IndexProfile, conf.SkipIndexes)
+	if err != nil {
+		return nil, err
+	}
+	if len(conf.PinIndexes) > 0 {
+		mrs.pinned, mrs.pinErr = mrs.pinIndexes(conf.PinIndexes)
+	}
+	return mrs, nil
 }
 
 // FSMultiRepoStoreConf configures an FS-backed multi-repo store. Pass
@@ -65,12 +129,114 @@ type FSMultiRepoStoreConf struct {
 	// repository data. If nil, DefaultRepoPaths is used, which stores
 	// repos at "${REPO}/.srclib-store".
 	RepoPaths
+
+	// EncryptionKey, if set, causes all data and index files to be
+	// encrypted at rest (see NewEncryptedFS) using the key it returns.
+	EncryptionKey KeyFunc
+
+	// FSStoreConf limits the store's VFS operations (see
+	// NewThrottledFS) and sets its write policy (see
+	// NewWritePolicyFS).
+	FSStoreConf
+
+	// Quotas limits the storage that each repo's data may use (see
+	// RepoQuotas and MultiRepoStoreUsage).
+	Quotas RepoQuotas
+
+	// Notifiers are notified after each tree import completes (when
+	// CreateVersion is called).
+	Notifiers []ImportNotifier
+
+	// ShareUnitData is whether to share identical source unit data
+	// files between the trees of a repo (e.g., the unchanged units of
+	// successive commits), so that they are stored only once. Each
+	// imported data file is linked to a shared copy, so the store's
+	// filesystem must support links (see NewHardLinkOSFS). In an
+	// encrypted store, the links are re-encrypted copies (see
+	// NewEncryptedFS), so no space is saved. Shared copies that no
+	// tree refers to anymore are removed by GCSharedData.
+	ShareUnitData bool
+
+	// ContentAddressed is whether to store source unit data files in
+	// a content-addressed layout: each imported data file is moved to
+	// an object named by the digest of its content (which is written
+	// only if no identical object exists), and the tree refers to the
+	// object by its digest. Identical unit data files are thereby
+	// stored once in the whole store (e.g., across commits, and
+	// across repos with vendored copies of the same code). Objects
+	// that no tree refers to anymore are removed by GCContentStore.
+	//
+	// A content-addressed store must always be opened with
+	// ContentAddressed set, or else the unit data files' pointers are
+	// read instead of their content.
+	ContentAddressed bool
+
+	// PinIndexes lists the trees whose indexes (and the indexes of
+	// their source units) are read into memory in full when the store
+	// is opened, and kept loaded for as long as the process runs
+	// (they are never evicted, and they don't count toward the index
+	// memory budget). It trades memory for deterministic low query
+	// latency on hot repos. A Version with an empty CommitID selects
+	// all of the repo's versions. Pinned trees must not be imported
+	// into or re-indexed while the store is open. See PinnedIndexes
+	// for the pinned indexes' memory usage.
+	PinIndexes []Version
+
+	// ImportAllowList, if set, restricts the repos and commits that
+	// may be imported into (see ImportAllowList).
+	ImportAllowList ImportAllowList
+
+	// Codec is the name of the codec ("json" or "protobuf"; see
+	// ParseCodec) that the store's data files are encoded with. It is
+	// recorded in the store's manifest (see StoreManifest) when data
+	// is first imported, and afterwards the recorded codec is used
+	// (it is an error to open the store with a different Codec). If
+	// empty, a new store records the package's Codec. The codec of a
+	// store that was created before stores had manifests is detected
+	// from its def data files when it is first used, and recorded
+	// when data is next imported (a store without any defs keeps
+	// using the package's Codec). If the store is encoded with
+	// another codec, its queries and imports fail.
+	Codec string
+
+	// IndexProfile is the name of the index profile (see
+	// IndexProfiles) that selects which rarely-used indexes the store
+	// doesn't build, trading query speed for import cost. If empty,
+	// all indexes are built.
+	IndexProfile string
+
+	// SkipIndexes lists more indexes (see SkippableIndexes) that the
+	// store doesn't build, in addition to those skipped by
+	// IndexProfile. Queries that would have used a skipped index use
+	// another index or fall back to a scan, and index files that were
+	// built before the index was skipped are ignored.
+	SkipIndexes []string
+
+	// LazyIndexes is whether indexes that are missing when a query
+	// needs them are built (and written back to the store) on first
+	// use, instead of the query falling back to a scan. This lets
+	// stores imported with NOINDEX=1 or by older versions gradually
+	// become fully indexed without an explicit rebuild.
+	LazyIndexes bool
+
+	// ImportLimits limits the size of each source unit's graph data
+	// that is imported into the store (see ImportLimits). By
+	// default, there are no limits.
+	ImportLimits ImportLimits
+}
+
+// repoPath returns the path under which repo's data is stored. The
+// repo URI is normalized (using graph.NormalizeRepoURI) first, so that
+// all spellings of a repo URI refer to the same data, and if the repo
+// was renamed, the path of its new name is returned (see
+// MultiRepoRenamer).
+func (s *fsMultiRepoStore) repoPath(repo string) string {
+	return s.fs.Join(s.RepoToPath(s.redirectRepo(graph.NormalizeRepoURI(repo)))...)
 }
 
 // getRepo gets a single repo.
 func (s *fsMultiRepoStore) getRepo(repo string) (string, error) {
-	repoPath := s.fs.Join(s.RepoToPath(repo)...)
-	fi, err := s.fs.Stat(repoPath)
+	fi, err := s.fs.Stat(s.repoPath(repo))
 	if err != nil {
 		if os.IsNotExist(err) {
 			return "", nil
@@ -84,6 +250,11 @@ func (s *fsMultiRepoStore) getRepo(repo string) (string, error) {
 }
 
 func (s *fsMultiRepoStore) Repos(f ...RepoFilter) ([]string, error) {
+	if repos, paged, err := PagedRepos(s.Repos, f); paged {
+		return repos, err
+	}
+
+	f = normalizeRepoFilters(s, f).([]RepoFilter)
 	scopeRepos, err := scopeRepos(storeFilters(f))
 	if err != nil {
 		return nil, err
@@ -132,9 +303,14 @@ func (s *fsMultiRepoStore) Repos(f ...RepoFilter) ([]string, error) {
 			}
 			after = s.fs.Join(paths[len(paths)-1]...)
 		}
-		repos = make([]string, len(allPaths))
-		for i, path := range allPaths {
-			repos[i] = s.PathToRepo(path)
+		repos = make([]string, 0, len(allPaths))
+		for _, path := range allPaths {
+			if len(path) == 1 && strings.HasPrefix(path[0], ".") {
+				// The store's own files (such as its manifest) aren't
+				// repos, even if s.RepoPaths lists them.
+				continue
+			}
+			repos = append(repos, s.PathToRepo(path))
 		}
 	}
 
@@ -144,12 +320,12 @@ func (s *fsMultiRepoStore) Repos(f ...RepoFilter) ([]string, error) {
 			filteredRepos = append(filteredRepos, repo)
 		}
 	}
-	return filteredRepos, nil
+	return s.withoutHiddenRepos(filteredRepos)
 }
 
 func (s *fsMultiRepoStore) openRepoStore(repo string) RepoStore {
-	subpath := s.fs.Join(s.RepoToPath(repo)...)
-	return NewFSRepoStore(rwvfs.Walkable(rwvfs.Sub(s.fs, subpath)))
+	st, _ := s.settings() // if the codec is unknown, the repo store's reads and writes fail
+	return newFSRepoStoreWithSettings(rwvfs.Walkable(rwvfs.Sub(s.fs, s.repoPath(repo))), st)
 }
 
 func (s *fsMultiRepoStore) openAllRepoStores() (map[string]RepoStore, error) {
@@ -168,33 +344,150 @@ func (s *fsMultiRepoStore) openAllRepoStores() (map[string]RepoStore, error) {
 var _ repoStoreOpener = (*fsMultiRepoStore)(nil)
 
 func (s *fsMultiRepoStore) Import(repo, commitID string, unit *unit.SourceUnit, data graph.Output) error {
+	defer s.wrote()
+	repo = s.redirectRepo(graph.NormalizeRepoURI(repo))
+	if err := s.CheckImportAllowed(repo, commitID); err != nil {
+		return err
+	}
+	if err := checkImportDefKeys(unit, &data); err != nil {
+		return err
+	}
+	for _, ref := range data.Refs {
+		ref.DefRepo = graph.NormalizeRepoURI(ref.DefRepo)
+	}
+	if err := s.redirectRefDefRepos(data.Refs); err != nil {
+		return err
+	}
 	if unit != nil {
 		cleanForImport(&data, repo, unit.Type, unit.Name)
 	}
-	subpath := s.fs.Join(s.RepoToPath(repo)...)
-	if err := rwvfs.MkdirAll(s.fs, subpath); err != nil {
+	if err := s.ensureStoreManifest(); err != nil {
 		return err
 	}
-	return s.openRepoStore(repo).(RepoImporter).Import(commitID, unit, data)
+	if err := rwvfs.MkdirAll(s.fs, s.repoPath(repo)); err != nil {
+		return err
+	}
+	if err := s.invalidateFileNamesIndex(); err != nil {
+		return err
+	}
+	size := EstimateOutputSize(&data).Bytes
+	if err := s.reserveUsage(repo, commitID, size); err != nil {
+		return err
+	}
+	var prevDeps map[string]int
+	if unit != nil {
+		var err error
+		prevDeps, err = s.externalRefsByRepo(repo, commitID, unit.ID2())
+		if err != nil {
+			return err
+		}
+	}
+	if err := s.openRepoStore(repo).(RepoImporter).Import(commitID, unit, data); err != nil {
+		s.reserveUsage(repo, commitID, -size)
+		return err
+	}
+	if unit != nil && s.ContentAddressed {
+		if err := s.addUnitDataToCAS(repo, commitID, unit.ID2()); err != nil {
+			return err
+		}
+	}
+	if unit != nil && s.ShareUnitData {
+		if err := s.shareUnitData(repo, commitID, unit.ID2()); err != nil {
+			return err
+		}
+	}
+	if unit != nil {
+		if err := s.addUnitTypeHint(repo, commitID, unit.Type); err != nil {
+			return err
+		}
+	}
+	if unit != nil {
+		deps, err := s.externalRefsByRepo(repo, commitID, unit.ID2())
+		if err != nil {
+			return err
+		}
+		return s.updateDependents(repo, commitID, unit.ID2(), prevDeps, deps)
+	}
+	return nil
 }
 
 func (s *fsMultiRepoStore) CreateVersion(repo, commitID string) error {
-	return s.openRepoStore(repo).(RepoImporter).CreateVersion(commitID)
+	defer s.wrote()
+	if err := s.CheckImportAllowed(repo, commitID); err != nil {
+		return err
+	}
+	if err := s.invalidateFileNamesIndex(); err != nil {
+		return err
+	}
+	// Make the tree's data durable before its version entry, and then
+	// the version entry (if the store's policy is SyncImport).
+	if err := syncWrites(s.fs); err != nil {
+		return err
+	}
+	if err := s.openRepoStore(repo).(RepoImporter).CreateVersion(commitID); err != nil {
+		return err
+	}
+	if err := syncWrites(s.fs); err != nil {
+		return err
+	}
+	if err := s.setUnitTypeHints(repo, commitID); err != nil {
+		return err
+	}
+	if err := s.UpdateUsage(repo, commitID); err != nil {
+		return err
+	}
+	s.notifyImport(repo, commitID)
+	return nil
 }
 
 func (s *fsMultiRepoStore) Index(repo, commitID string) error {
+	if err := s.CheckImportAllowed(repo, commitID); err != nil {
+		return err
+	}
 	switch rs := s.openRepoStore(repo).(type) {
 	case RepoIndexer:
-		return rs.Index(commitID)
+		if err := rs.Index(commitID); err != nil {
+			return err
+		}
+		return s.UpdateUsage(repo, commitID)
 	}
 	return nil
 }
 
 func (s *fsMultiRepoStore) String() string { return "fsMultiRepoStore" }
 
+// fsStoreSettings are the settings that an FS-backed multi-repo store
+// passes down to its repo, tree, and unit stores. The zero value
+// encodes data files with Codec and uses all indexes.
+type fsStoreSettings struct {
+	dataCodec   codec           // codec of the data files (nil means Codec)
+	skipIndexes map[string]bool // names of the indexes that aren't built or used (see FSMultiRepoStoreConf.SkipIndexes)
+
+	importLimits ImportLimits // limits on each imported unit's data (see FSMultiRepoStoreConf.ImportLimits)
+	lazyIndexes  bool         // build missing indexes on first use (see FSMultiRepoStoreConf.LazyIndexes)
+}
+
+func (st fsStoreSettings) buildsIndexesLazily() bool { return st.lazyIndexes }
+
+// codec returns the codec of the store's data files.
+func (st fsStoreSettings) codec() codec {
+	if st.dataCodec != nil {
+		return st.dataCodec
+	}
+	return Codec
+}
+
+// withCodec returns a copy of st whose data files are encoded with
+// codec c.
+func (st fsStoreSettings) withCodec(c codec) fsStoreSettings {
+	st.dataCodec = c
+	return st
+}
+
 // A fsRepoStore is a RepoStore that stores data on a VFS.
 type fsRepoStore struct {
 	fs rwvfs.WalkableFileSystem
+	fsStoreSettings
 	treeStores
 }
 
@@ -204,8 +497,14 @@ const SrclibStoreDir = ".srclib-store"
 // NewFSRepoStore creates a new repository store (that can be
 // imported into) that is backed by files on a filesystem.
 func NewFSRepoStore(fs rwvfs.WalkableFileSystem) RepoStoreImporter {
+	return newFSRepoStoreWithSettings(fs, fsStoreSettings{})
+}
+
+// newFSRepoStoreWithSettings is like NewFSRepoStore, but it (and its
+// tree and unit stores) use the given settings.
+func newFSRepoStoreWithSettings(fs rwvfs.WalkableFileSystem, st fsStoreSettings) *fsRepoStore {
 	setCreateParentDirs(fs)
-	rs := &fsRepoStore{fs: fs}
+	rs := &fsRepoStore{fs: fs, fsStoreSettings: st}
 	rs.treeStores = treeStores{rs}
 	return rs
 }
@@ -294,7 +593,7 @@ func (s *fsRepoStore) listAllVersions_old() ([]string, error) {
 	}
 	dirs := make([]string, 0, len(entries))
 	for _, e := range entries {
-		if e.Name() == versionsDir {
+		if e.Name() == versionsDir || e.Name() == usageFilename || e.Name() == sharedDataDir || e.Name() == unitTypeHintsFilename || e.Name() == codecMigrationDir {
 			continue
 		}
 		dirs = append(dirs, e.Name())
@@ -314,6 +613,13 @@ func (s *fsRepoStore) Import(commitID string, unit *unit.SourceUnit, data graph.
 }
 
 func (s *fsRepoStore) CreateVersion(commitID string) error {
+	// Finalize the tree by listing its files in its manifest.
+	if _, err := s.WriteTreeManifest(commitID); err != nil && err != errTreeNoInit {
+		return err
+	}
+	if err := syncWrites(s.fs); err != nil {
+		return err
+	}
 	if err := s.fs.Mkdir(versionsDir); err != nil && !os.IsExist(err) {
 		return err
 	}
@@ -322,12 +628,18 @@ func (s *fsRepoStore) CreateVersion(commitID string) error {
 		return err
 	}
 	f.Write(nil)
-	return f.Close()
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return syncWrites(s.fs)
 }
 
 func (s *fsRepoStore) Index(commitID string) error {
 	if xs, ok := s.newTreeStore(commitID).(*indexedTreeStore); ok {
-		return xs.Index()
+		if err := xs.Index(); err != nil {
+			return err
+		}
+		return xs.refreshTreeManifest()
 	}
 	return nil // nothing to do
 }
@@ -340,9 +652,9 @@ func (s *fsRepoStore) newTreeStore(commitID string) TreeStoreImporter {
 	fs := s.treeStoreFS(commitID)
 	if useIndexedStore {
 		cacheKey := fs.String()
-		return newIndexedTreeStore(fs, cacheKey)
+		return newIndexedTreeStore(fs, cacheKey, s.fsStoreSettings)
 	}
-	return newFSTreeStore(fs)
+	return newFSTreeStore(fs, s.fsStoreSettings)
 }
 
 func (s *fsRepoStore) openTreeStore(commitID string) TreeStore {
@@ -370,11 +682,14 @@ func (s *fsRepoStore) String() string { return "fsRepoStore" }
 // A fsTreeStore is a TreeStore that stores data on a VFS.
 type fsTreeStore struct {
 	fs rwvfs.FileSystem
+	fsStoreSettings
 	unitStores
 }
 
-func newFSTreeStore(fs rwvfs.FileSystem) *fsTreeStore {
-	ts := &fsTreeStore{fs: fs}
+// newFSTreeStore creates a tree store (whose unit stores use the given
+// settings).
+func newFSTreeStore(fs rwvfs.FileSystem, st fsStoreSettings) *fsTreeStore {
+	ts := &fsTreeStore{fs: fs, fsStoreSettings: st}
 	ts.unitStores = unitStores{ts}
 	return ts
 }
@@ -382,6 +697,10 @@ func newFSTreeStore(fs rwvfs.FileSystem) *fsTreeStore {
 var c_fsTreeStore_unitsOpened = &counter{count: new(int64)}
 
 func (s *fsTreeStore) Units(f ...UnitFilter) ([]*unit.SourceUnit, error) {
+	if units, paged, err := PagedUnits(s.Units, f); paged {
+		return units, err
+	}
+
 	var unitFilenames []string
 
 	unitIDs, err := scopeUnits(storeFilters(f))
@@ -392,7 +711,7 @@ func (s *fsTreeStore) Units(f ...UnitFilter) ([]*unit.SourceUnit, error) {
 	if len(unitIDs) > 0 {
 		unitFilenames = make([]string, len(unitIDs))
 		for i, u := range unitIDs {
-			unitFilenames[i] = s.unitFilename(u.Type, u.Name)
+			unitFilenames[i] = existingUnitFilename(s.fs, u.Type, u.Name)
 		}
 	} else {
 		unitFilenames, err = s.unitFilenames()
@@ -431,11 +750,25 @@ func (s *fsTreeStore) openUnitFile(filename string) (u *unit.SourceUnit, err err
 	}()
 
 	var unit unit.SourceUnit
-	_, err = Codec.NewDecoder(f).Decode(&unit)
+	_, err = s.codec().NewDecoder(f).Decode(&unit)
 	return &unit, err
 }
 
 func (s *fsTreeStore) unitFilenames() ([]string, error) {
+	// Use the tree's manifest (if any) to avoid walking the tree's
+	// dir.
+	if m, err := s.TreeManifest(); err == nil {
+		var files []string
+		for _, f := range m.Files {
+			if strings.HasSuffix(f.Path, unitFileSuffix) {
+				files = append(files, f.Path)
+			}
+		}
+		return files, nil
+	} else if err != ErrNoTreeManifest {
+		return nil, err
+	}
+
 	var files []string
 	w := fs.WalkFS(".", rwvfs.Walkable(s.fs))
 	for w.Step() {
@@ -450,8 +783,78 @@ func (s *fsTreeStore) unitFilenames() ([]string, error) {
 	return files, nil
 }
 
+// unitFilename returns the name of the file that holds the source unit
+// definition. The unit's name and type are encoded (see
+// encodeStorePath) so that they are safe to use as paths, and
+// unitIDForFilename is the inverse.
 func (s *fsTreeStore) unitFilename(unitType, unit string) string {
-	return path.Join(unit, unitType+unitFileSuffix)
+	return path.Join(encodeStorePath(unit), encodeStorePathComponent(unitType)+unitFileSuffix)
+}
+
+// legacyUnitFilename returns the name of the file that held the
+// source unit definition in stores written before unit names and types
+// were encoded, when they were used as paths verbatim. It returns "" if
+// that is the same as unitFilename, or if the unit's name or type
+// can't be used as a path verbatim (e.g., because it has ".."
+// components), in which case the unit can only be stored at
+// unitFilename.
+func legacyUnitFilename(unitType, unit string) string {
+	filename := unit + "/" + unitType + unitFileSuffix
+	if filename != path.Join(unit, unitType+unitFileSuffix) || path.IsAbs(filename) || strings.HasPrefix(filename, "../") {
+		return ""
+	}
+	if filename == (*fsTreeStore)(nil).unitFilename(unitType, unit) {
+		return ""
+	}
+	return filename
+}
+
+// existingUnitFilename returns the name of the file in fs (a tree's
+// dir) that holds the source unit definition. It is unitFilename,
+// unless the unit was imported before unit names and types were
+// encoded and is still stored at its legacyUnitFilename.
+func existingUnitFilename(fs rwvfs.FileSystem, unitType, unit string) string {
+	filename := (*fsTreeStore)(nil).unitFilename(unitType, unit)
+	legacy := legacyUnitFilename(unitType, unit)
+	if legacy == "" {
+		return filename
+	}
+	if _, err := fs.Stat(filename); !os.IsNotExist(err) {
+		return filename
+	}
+	if _, err := fs.Stat(legacy); err != nil {
+		return filename
+	}
+	return legacy
+}
+
+// unitDir returns the dir that holds the source unit's data files
+// (next to its existingUnitFilename).
+func (s *fsTreeStore) unitDir(u unit.ID2) string {
+	return strings.TrimSuffix(existingUnitFilename(s.fs, u.Type, u.Name), unitFileSuffix)
+}
+
+// unitIDForFilename returns the ID of the source unit whose definition
+// is stored in unitFile (as returned by unitFilename or
+// legacyUnitFilename).
+func (s *fsTreeStore) unitIDForFilename(unitFile string) (unit.ID2, error) {
+	dir := strings.TrimSuffix(unitFile, unitFileSuffix)
+	unitType, err := readStorePathComponent(s.fs, path.Dir(dir), path.Base(dir))
+	if err == nil {
+		var unitName string
+		unitName, err = decodeStorePath(s.fs, path.Dir(dir))
+		if err == nil && s.unitFilename(unitType, unitName) == unitFile {
+			return unit.ID2{Type: unitType, Name: unitName}, nil
+		}
+	}
+
+	// The unit is stored at its legacy filename, which can't be
+	// decoded, so read its ID from the unit file.
+	u, err := s.openUnitFile(unitFile)
+	if err != nil {
+		return unit.ID2{}, err
+	}
+	return u.ID2(), nil
 }
 
 const unitFileSuffix = ".unit.json"
@@ -460,6 +863,18 @@ func (s *fsTreeStore) Import(u *unit.SourceUnit, data graph.Output) (err error)
 	if u == nil {
 		return rwvfs.MkdirAll(s.fs, ".")
 	}
+	if err := s.importLimits.Check(u.Type+" "+u.Name, &data); err != nil {
+		return err
+	}
+	if err := s.invalidateContentDigest(); err != nil {
+		return err
+	}
+	if err := s.invalidateDefRefCounts(); err != nil {
+		return err
+	}
+	if err := s.invalidateIndexCheckpoint(); err != nil {
+		return err
+	}
 
 	unitFilename := s.unitFilename(u.Type, u.Name)
 	if err := rwvfs.MkdirAll(s.fs, path.Dir(unitFilename)); err != nil {
@@ -475,25 +890,58 @@ func (s *fsTreeStore) Import(u *unit.SourceUnit, data graph.Output) (err error)
 			err = err2
 		}
 	}()
-	if _, err := Codec.NewEncoder(f).Encode(u); err != nil {
+	if _, err := s.codec().NewEncoder(f).Encode(u); err != nil {
 		return err
 	}
+	if err := s.writeUnitPathNames(u.Type, u.Name); err != nil {
+		return err
+	}
+	if legacy := legacyUnitFilename(u.Type, u.Name); legacy != "" {
+		// Remove the unit's previous data at its legacy filename (if
+		// any), which is superseded by this import.
+		if _, err := s.fs.Stat(legacy); err == nil {
+			if err := s.fs.Remove(legacy); err != nil {
+				return err
+			}
+			if err := removeTreeIfExists(rwvfs.Walkable(s.fs), strings.TrimSuffix(legacy, unitFileSuffix)); err != nil {
+				return err
+			}
+		}
+	}
 
 	dir := strings.TrimSuffix(unitFilename, unitFileSuffix)
 	if err := rwvfs.MkdirAll(s.fs, dir); err != nil {
 		return err
 	}
 	cleanForImport(&data, "", u.Type, u.Name)
-	return s.openUnitStore(unit.ID2{Type: u.Type, Name: u.Name}).(UnitStoreImporter).Import(data)
+	if err := s.openUnitStore(unit.ID2{Type: u.Type, Name: u.Name}).(UnitStoreImporter).Import(data); err != nil {
+		return err
+	}
+	if err := s.writeUnitStats(u, &data); err != nil {
+		return err
+	}
+	if err := s.writeExternalRefs(u.ID2(), data.Refs); err != nil {
+		return err
+	}
+	return s.writeUnitRefCounts(u.ID2(), data.Refs)
+}
+
+// writeUnitPathNames writes the sidecar name files for the hashed
+// components (if any) of the unit's filename. See
+// writeStorePathNames.
+func (s *fsTreeStore) writeUnitPathNames(unitType, unit string) error {
+	if err := writeStorePathNames(s.fs, unit); err != nil {
+		return err
+	}
+	return writeStorePathName(s.fs, encodeStorePath(unit), unitType, encodeStorePathComponent(unitType))
 }
 
 func (s *fsTreeStore) openUnitStore(u unit.ID2) UnitStore {
-	filename := s.unitFilename(u.Type, u.Name)
-	dir := strings.TrimSuffix(filename, unitFileSuffix)
+	dir := s.unitDir(u)
 	if useIndexedStore {
-		return newIndexedUnitStore(rwvfs.Sub(s.fs, dir), u.String())
+		return newIndexedUnitStore(rwvfs.Sub(s.fs, dir), u.String(), s.fsStoreSettings)
 	}
-	return &fsUnitStore{fs: rwvfs.Sub(s.fs, dir), label: u.String()}
+	return &fsUnitStore{fs: rwvfs.Sub(s.fs, dir), label: u.String(), fsStoreSettings: s.fsStoreSettings}
 }
 
 func (s *fsTreeStore) openAllUnitStores() (map[unit.ID2]UnitStore, error) {
@@ -504,10 +952,10 @@ func (s *fsTreeStore) openAllUnitStores() (map[unit.ID2]UnitStore, error) {
 
 	uss := make(map[unit.ID2]UnitStore, len(unitFiles))
 	for _, unitFile := range unitFiles {
-		// TODO(sqs): duplicated code both here and in openUnitStore
-		// for "dir" and "u".
-		dir := strings.TrimSuffix(unitFile, unitFileSuffix)
-		u := unit.ID2{Type: path.Base(dir), Name: path.Dir(dir)}
+		u, err := s.unitIDForFilename(unitFile)
+		if err != nil {
+			return nil, err
+		}
 		uss[u] = s.openUnitStore(u)
 	}
 	return uss, nil
@@ -530,6 +978,13 @@ type fsUnitStore struct {
 	fs rwvfs.FileSystem
 
 	label string // a human-readable label (included in String() output)
+
+	// refShardDir is the dir (relative to the unit's dir) of the
+	// bucket of the unit's sharded refs that the store holds, or ""
+	// if it isn't a bucket (see RefShards).
+	refShardDir string
+
+	fsStoreSettings
 }
 
 const (
@@ -538,12 +993,38 @@ const (
 )
 
 func (s *fsUnitStore) Defs(fs ...DefFilter) (defs []*graph.Def, err error) {
+	if defs, paged, err := PagedDefs(s.Defs, fs); paged {
+		return defs, err
+	}
+
 	if f := getDefOffsetsFilter(fs); f != nil {
 		return s.defsAtOffsets(byteOffsets(f), fs)
 	}
 
+	if err := checkScanAllowed(s, fs); err != nil {
+		return nil, err
+	}
+
+	if useParallelScan(s.codec(), fs) {
+		defs, err := s.parallelDefs(fs)
+		if _, corrupt := err.(*CorruptRecordError); !corrupt {
+			if err != nil {
+				return nil, err
+			}
+			for _, filter := range fs {
+				if dSort, ok := filter.(DefsSorter); ok {
+					dSort.DefsSort(defs)
+					break
+				}
+			}
+			vlog.Printf("%s: read %v defs with filters %v (parallel scan).", s, len(defs), fs)
+			return defs, nil
+		}
+		vlog.Printf("%s: parallel scan failed (%s); falling back to sequential scan.", s, err)
+	}
+
 	vlog.Printf("%s: reading defs with filters %v...", s, fs)
-	f, err := s.fs.Open(unitDefsFilename)
+	f, err := openForScan(queryContext(fs), s.fs, unitDefsFilename)
 	if err != nil {
 		return nil, err
 	}
@@ -554,15 +1035,36 @@ func (s *fsUnitStore) Defs(fs ...DefFilter) (defs []*graph.Def, err error) {
 		}
 	}()
 
-	dec := Codec.NewDecoder(f)
+	obs := getRecordObservers(fs)
+	arena := getArena(fs)
+	var scratch graph.Def
+	rr := &recordReader{r: f}
+	dec := s.codec().NewDecoder(rr)
+	var ofs int64
 	for {
-		def := &graph.Def{}
-		if _, err := dec.Decode(def); err == io.EOF {
+		def := arena.nextDef(&scratch)
+		n, err := dec.Decode(def)
+		if err == io.EOF {
 			break
 		} else if err != nil {
-			return nil, err
+			f2, next, err := s.resyncScan(rr, unitDefsFilename, ofs, err)
+			if err != nil {
+				return nil, err
+			}
+			if f2 == nil {
+				break // the corrupt record was the last one
+			}
+			f.Close()
+			f, ofs = f2, next
+			rr = &recordReader{r: f}
+			dec = s.codec().NewDecoder(rr)
+			continue
 		}
-		if DefFilters(fs).SelectDef(def) {
+		ofs += int64(n)
+		if def = arena.selectDef(def, fs); def != nil {
+			if obs != nil {
+				obs.observeDef(def, &storedRecord{store: s, file: unitDefsFilename, offset: ofs - int64(n), size: int64(n), dec: dec})
+			}
 			defs = append(defs, def)
 		}
 	}
@@ -580,7 +1082,8 @@ func (s *fsUnitStore) Defs(fs ...DefFilter) (defs []*graph.Def, err error) {
 // from the def data file and returns them in arbitrary order.
 func (s *fsUnitStore) defsAtOffsets(ofs byteOffsets, fs []DefFilter) (defs []*graph.Def, err error) {
 	vlog.Printf("%s: reading defs at %d offsets with filters %v...", s, len(ofs), fs)
-	f, err := openFetcherOrOpen(s.fs, unitDefsFilename)
+	ctx := queryContext(fs)
+	f, st, err := openForOffsets(ctx, s.fs, unitDefsFilename)
 	if err != nil {
 		return nil, err
 	}
@@ -591,12 +1094,10 @@ func (s *fsUnitStore) defsAtOffsets(ofs byteOffsets, fs []DefFilter) (defs []*gr
 		}
 	}()
 
-	ffs := DefFilters(fs)
+	obs := getRecordObservers(fs)
+	arena := getArena(fs)
 
-	p := parFetches(s.fs, fs)
-	if p == 0 {
-		return nil, nil
-	}
+	p := parFetches(st)
 
 	var defsLock sync.Mutex
 	par := parallel.NewRun(p)
@@ -606,27 +1107,33 @@ func (s *fsUnitStore) defsAtOffsets(ofs byteOffsets, fs []DefFilter) (defs []*gr
 		go func() {
 			defer par.Release()
 
-			if _, moreOK := LimitRemaining(fs); !moreOK {
-				return
-			}
-
 			// Guess how many bytes this def is. The s3vfs (if that's the
 			// VFS impl in use) will autofetch beyond that if needed.
 			const byteEstimate = 2 * decodeBufSize
-			r, err := rangeReader(s.fs, unitDefsFilename, f, ofs, byteEstimate)
+			r, err := rangeReader(ctx, s.fs, unitDefsFilename, f, ofs, st.fetchSize(byteEstimate))
 			if err != nil {
 				par.Error(err)
 				return
 			}
-			dec := Codec.NewDecoder(r)
+			rr := &recordReader{r: r}
+			dec := s.codec().NewDecoder(rr)
 			var def graph.Def
-			if _, err := dec.Decode(&def); err != nil {
+			n, err := dec.Decode(&def)
+			if err != nil {
+				err = s.corruptRecord(rr, unitDefsFilename, ofs, err)
+				if _, ok := err.(*CorruptRecordError); ok {
+					skipCorruptRecord(err)
+					return
+				}
 				par.Error(err)
 				return
 			}
-			if ffs.SelectDef(&def) {
+			if kept := arena.selectDef(&def, fs); kept != nil {
+				if obs != nil {
+					obs.observeDef(kept, &storedRecord{store: s, file: unitDefsFilename, offset: ofs, size: int64(n), dec: dec})
+				}
 				defsLock.Lock()
-				defs = append(defs, &def)
+				defs = append(defs, kept)
 				defsLock.Unlock()
 			}
 		}()
@@ -643,7 +1150,7 @@ func (s *fsUnitStore) defsAtOffsets(ofs byteOffsets, fs []DefFilter) (defs []*gr
 // along with their serialized byte offsets.
 func (s *fsUnitStore) readDefs() (defs []*graph.Def, ofs byteOffsets, err error) {
 	vlog.Printf("%s: reading defs and byte offsets...", s)
-	f, err := s.fs.Open(unitDefsFilename)
+	f, err := openForScan(context.Background(), s.fs, unitDefsFilename)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -655,7 +1162,7 @@ func (s *fsUnitStore) readDefs() (defs []*graph.Def, ofs byteOffsets, err error)
 	}()
 
 	n := uint64(0)
-	dec := Codec.NewDecoder(f)
+	dec := s.codec().NewDecoder(f)
 	for {
 		var def graph.Def
 		o, err := dec.Decode(&def)
@@ -675,8 +1182,34 @@ func (s *fsUnitStore) readDefs() (defs []*graph.Def, ofs byteOffsets, err error)
 }
 
 func (s *fsUnitStore) Refs(fs ...RefFilter) (refs []*graph.Ref, err error) {
+	if refs, paged, err := PagedRefs(s.Refs, fs); paged {
+		return refs, err
+	}
+
+	if n, err := s.refShards(); err != nil {
+		return nil, err
+	} else if n > 0 {
+		return s.shardedRefs(n, fs, openFSRefShard)
+	}
+
+	if err := checkScanAllowed(s, fs); err != nil {
+		return nil, err
+	}
+
+	if useParallelScan(s.codec(), fs) {
+		refs, err := s.parallelRefs(fs)
+		if _, corrupt := err.(*CorruptRecordError); !corrupt {
+			if err != nil {
+				return nil, err
+			}
+			vlog.Printf("%s: read %d refs with filters %v (parallel scan).", s, len(refs), fs)
+			return refs, nil
+		}
+		vlog.Printf("%s: parallel scan failed (%s); falling back to sequential scan.", s, err)
+	}
+
 	vlog.Printf("%s: reading refs with filters %v...", s, fs)
-	f, err := s.fs.Open(unitRefsFilename)
+	f, err := openForScan(queryContext(fs), s.fs, unitRefsFilename)
 	if err != nil {
 		return nil, err
 	}
@@ -687,27 +1220,71 @@ func (s *fsUnitStore) Refs(fs ...RefFilter) (refs []*graph.Ref, err error) {
 		}
 	}()
 
-	dec := Codec.NewDecoder(f)
+	// The refs are stored sorted by (file, start, end), so if only the
+	// first refs are needed, the scan stops at the first ref after them
+	// that doesn't share their last ref's position.
+	limit, limited := ScanLimit(fs)
+
+	obs := getRecordObservers(fs)
+	arena := getArena(fs)
+	var scratch graph.Ref
+	rr := &recordReader{r: f}
+	dec := s.codec().NewDecoder(rr)
+	var ofs int64
 	for {
-		var ref graph.Ref
-		if _, err := dec.Decode(&ref); err == io.EOF {
+		ref := arena.nextRef(&scratch)
+		n, err := dec.Decode(ref)
+		if err == io.EOF {
 			break
 		} else if err != nil {
-			return nil, err
+			f2, next, err := s.resyncScan(rr, unitRefsFilename, ofs, err)
+			if err != nil {
+				return nil, err
+			}
+			if f2 == nil {
+				break // the corrupt record was the last one
+			}
+			f.Close()
+			f, ofs = f2, next
+			rr = &recordReader{r: f}
+			dec = s.codec().NewDecoder(rr)
+			continue
 		}
-		if refFilters(fs).SelectRef(&ref) {
-			refs = append(refs, &ref)
+		ofs += int64(n)
+		if refFilters(fs).SelectRef(ref) {
+			if limited && len(refs) >= limit && (len(refs) == 0 || !samePosition(ref, refs[len(refs)-1])) {
+				break
+			}
+			ref = arena.keepRef(ref)
+			if obs != nil {
+				obs.observeRef(ref, &storedRecord{store: s, file: unitRefsFilename, offset: ofs - int64(n), size: int64(n), dec: dec})
+			}
+			refs = append(refs, ref)
 		}
 	}
 	vlog.Printf("%s: read %d refs with filters %v.", s, len(refs), fs)
 	return refs, nil
 }
 
+// samePosition reports whether a and b have the same file, start, and
+// end.
+func samePosition(a, b *graph.Ref) bool {
+	return a.File == b.File && a.Start == b.Start && a.End == b.End
+}
+
 // refsAtByteRanges reads the refs at the given serialized byte ranges
 // from the ref data file and returns them in arbitrary order.
 func (s *fsUnitStore) refsAtByteRanges(brs []byteRanges, fs []RefFilter) (refs []*graph.Ref, err error) {
-	vlog.Printf("%s: reading refs at %d byte ranges with filters %v...", s, len(brs), fs)
-	f, err := openFetcherOrOpen(s.fs, unitRefsFilename)
+	return s.refsAtByteRangesIn(unitRefsFilename, brs, fs)
+}
+
+// refsAtByteRangesIn is like refsAtByteRanges, but it reads from the
+// named ref data file (which may hold the refs in a different order;
+// see RefSortOrder).
+func (s *fsUnitStore) refsAtByteRangesIn(name string, brs []byteRanges, fs []RefFilter) (refs []*graph.Ref, err error) {
+	vlog.Printf("%s: reading refs at %d byte ranges in %s with filters %v...", s, len(brs), name, fs)
+	ctx := queryContext(fs)
+	f, st, err := openForOffsets(ctx, s.fs, name)
 	if err != nil {
 		return nil, err
 	}
@@ -719,11 +1296,10 @@ func (s *fsUnitStore) refsAtByteRanges(brs []byteRanges, fs []RefFilter) (refs [
 	}()
 
 	ffs := refFilters(fs)
+	obs := getRecordObservers(fs)
+	arena := getArena(fs)
 
-	p := parFetches(s.fs, fs)
-	if p == 0 {
-		return nil, nil
-	}
+	p := parFetches(st)
 
 	// See how many bytes we need to read to get the refs in all
 	// byteRanges.
@@ -746,25 +1322,44 @@ func (s *fsUnitStore) refsAtByteRanges(brs []byteRanges, fs []RefFilter) (refs [
 		go func() {
 			defer par.Release()
 
-			if _, moreOK := LimitRemaining(fs); !moreOK {
-				return
-			}
-
-			r, err := rangeReader(s.fs, unitRefsFilename, f, br.start(), readLengths[i])
+			r, err := rangeReader(ctx, s.fs, name, f, br.start(), readLengths[i])
 			if err != nil {
 				par.Error(err)
 				return
 			}
-			dec := Codec.NewDecoder(r)
-			for range br[1:] {
-				var ref graph.Ref
-				if _, err := dec.Decode(&ref); err != nil {
-					par.Error(err)
-					return
+			rr := &recordReader{r: r}
+			dec := s.codec().NewDecoder(rr)
+			ofs := br.start()
+			var scratch graph.Ref
+			for _, n := range br[1:] {
+				ref := arena.nextRef(&scratch)
+				_, err := dec.Decode(ref)
+				ofs += n
+				if err != nil {
+					err = s.corruptRecord(rr, name, ofs-n, err)
+					if _, ok := err.(*CorruptRecordError); !ok {
+						par.Error(err)
+						return
+					}
+					// Resume reading at the next ref (whose offset is
+					// known from the byte ranges).
+					skipCorruptRecord(err)
+					r, err := rangeReader(ctx, s.fs, name, f, ofs, br.start()+readLengths[i]-ofs)
+					if err != nil {
+						par.Error(err)
+						return
+					}
+					rr = &recordReader{r: r}
+					dec = s.codec().NewDecoder(rr)
+					continue
 				}
-				if ffs.SelectRef(&ref) {
+				if ffs.SelectRef(ref) {
+					ref = arena.keepRef(ref)
+					if obs != nil {
+						obs.observeRef(ref, &storedRecord{store: s, file: name, offset: ofs - n, size: n, dec: dec})
+					}
 					refsLock.Lock()
-					refs = append(refs, &ref)
+					refs = append(refs, ref)
 					refsLock.Unlock()
 				}
 			}
@@ -782,7 +1377,8 @@ func (s *fsUnitStore) refsAtByteRanges(brs []byteRanges, fs []RefFilter) (refs [
 // from the ref data file and returns them in arbitrary order.
 func (s *fsUnitStore) refsAtOffsets(ofs byteOffsets, fs []RefFilter) (refs []*graph.Ref, err error) {
 	vlog.Printf("%s: reading refs at %d offsets with filters %v...", s, len(ofs), fs)
-	f, err := openFetcherOrOpen(s.fs, unitRefsFilename)
+	ctx := queryContext(fs)
+	f, st, err := openForOffsets(ctx, s.fs, unitRefsFilename)
 	if err != nil {
 		return nil, err
 	}
@@ -794,11 +1390,10 @@ func (s *fsUnitStore) refsAtOffsets(ofs byteOffsets, fs []RefFilter) (refs []*gr
 	}()
 
 	ffs := refFilters(fs)
+	obs := getRecordObservers(fs)
+	arena := getArena(fs)
 
-	p := parFetches(s.fs, fs)
-	if p == 0 {
-		return nil, nil
-	}
+	p := parFetches(st)
 
 	var refsLock sync.Mutex
 	par := parallel.NewRun(p)
@@ -808,27 +1403,34 @@ func (s *fsUnitStore) refsAtOffsets(ofs byteOffsets, fs []RefFilter) (refs []*gr
 		go func() {
 			defer par.Release()
 
-			if _, moreOK := LimitRemaining(fs); !moreOK {
-				return
-			}
-
 			// Guess how many bytes this ref is. The s3vfs (if that's the
 			// VFS impl in use) will autofetch beyond that if needed.
 			const byteEstimate = decodeBufSize
-			r, err := rangeReader(s.fs, unitRefsFilename, f, ofs, byteEstimate)
+			r, err := rangeReader(ctx, s.fs, unitRefsFilename, f, ofs, st.fetchSize(byteEstimate))
 			if err != nil {
 				par.Error(err)
 				return
 			}
-			dec := Codec.NewDecoder(r)
+			rr := &recordReader{r: r}
+			dec := s.codec().NewDecoder(rr)
 			var ref graph.Ref
-			if _, err := dec.Decode(&ref); err != nil {
+			n, err := dec.Decode(&ref)
+			if err != nil {
+				err = s.corruptRecord(rr, unitRefsFilename, ofs, err)
+				if _, ok := err.(*CorruptRecordError); ok {
+					skipCorruptRecord(err)
+					return
+				}
 				par.Error(err)
 				return
 			}
 			if ffs.SelectRef(&ref) {
+				kept := arena.keepRef(&ref)
+				if obs != nil {
+					obs.observeRef(kept, &storedRecord{store: s, file: unitRefsFilename, offset: ofs, size: int64(n), dec: dec})
+				}
 				refsLock.Lock()
-				refs = append(refs, &ref)
+				refs = append(refs, kept)
 				refsLock.Unlock()
 			}
 		}()
@@ -844,27 +1446,27 @@ func (s *fsUnitStore) refsAtOffsets(ofs byteOffsets, fs []RefFilter) (refs []*gr
 const maxNetPar = 4
 
 // parFetches returns the number of parallel fetches that should be
-// attempted given the VFS and filters.
-func parFetches(fs rwvfs.FileSystem, filters interface{}) int {
-	// It's almost always faster to read local files serially
-	// (FetcherOpener is currently only implemented by network VFSs).
-	if _, ok := fs.(rwvfs.FetcherOpener); !ok {
+// attempted given the read strategy.
+func parFetches(st ReadStrategy) int {
+	// It's almost always faster to read local files serially (see
+	// DefaultReadPolicy).
+	if st.Parallelism <= 1 {
 		return 1
 	}
-
-	n, moreOK := LimitRemaining(filters)
-	if moreOK {
-		if n == 0 {
-			return maxNetPar
-		}
-		return min(maxNetPar, n)
-	}
-	return 0
+	return st.Parallelism
 }
 
-// openFetcher calls fs.OpenFetcher if it implemented the
-// FetcherOpener interface; otherwise it calls fs.Open.
-func openFetcherOrOpen(fs rwvfs.FileSystem, name string) (vfs.ReadSeekCloser, error) {
+// openFetcherOrOpen calls fs.OpenFetcherContext or fs.OpenFetcher if it
+// implements the ContextFetcherOpener or FetcherOpener interface;
+// otherwise it calls fs.Open. If ctx is done, it returns ctx's error
+// without opening the file.
+func openFetcherOrOpen(ctx context.Context, fs rwvfs.FileSystem, name string) (vfs.ReadSeekCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if fo, ok := fs.(ContextFetcherOpener); ok {
+		return fo.OpenFetcherContext(ctx, name)
+	}
 	if fo, ok := fs.(rwvfs.FetcherOpener); ok {
 		return fo.OpenFetcher(name)
 	}
@@ -872,30 +1474,38 @@ func openFetcherOrOpen(fs rwvfs.FileSystem, name string) (vfs.ReadSeekCloser, er
 }
 
 // rangeReader calls ioutil.ReadAll on the given byte range [start, n). It uses
-// optimizations for different kinds of VFSs.
-func rangeReader(fs rwvfs.FileSystem, name string, f io.ReadSeeker, start, n int64) (io.Reader, error) {
-	if fs, ok := fs.(rwvfs.FetcherOpener); ok {
+// optimizations for different kinds of VFSs. If ctx is done, it
+// returns ctx's error without issuing a read, and reads from the
+// returned reader fail once ctx is done.
+func rangeReader(ctx context.Context, fs rwvfs.FileSystem, name string, f io.ReadSeeker, start, n int64) (io.Reader, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if isFetcherFS(fs) {
 		// Clone f so we can parallelize it.
 		var err error
-		f, err = fs.OpenFetcher(name)
+		f, err = openFetcherOrOpen(ctx, fs, name)
 		if err != nil {
 			return nil, err
 		}
 		if err := f.(rwvfs.Fetcher).Fetch(start, start+n); err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
 			return nil, err
 		}
 	}
 	if _, err := f.Seek(start, 0); err != nil {
 		return nil, err
 	}
-	return f, nil
+	return withContext(ctx, f), nil
 }
 
 // readDefs reads all defs from the def data file and returns them
 // along with their serialized byte offsets.
 func (s *fsUnitStore) readRefs() (refs []*graph.Ref, fbrs fileByteRanges, ofs byteOffsets, err error) {
 	vlog.Println("fsUnitStore: reading all refs and byte ranges...")
-	f, err := s.fs.Open(unitRefsFilename)
+	f, err := openForScan(context.Background(), s.fs, unitRefsFilename)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -907,7 +1517,7 @@ func (s *fsUnitStore) readRefs() (refs []*graph.Ref, fbrs fileByteRanges, ofs by
 	}()
 
 	o := int64(0)
-	dec := Codec.NewDecoder(f)
+	dec := s.codec().NewDecoder(f)
 	fbrs = fileByteRanges{}
 	lastFile := ""
 	for {
@@ -951,9 +1561,18 @@ func (s *fsUnitStore) Import(data graph.Output) error {
 	if _, err := s.writeDefs(data.Defs); err != nil {
 		return err
 	}
+	if n := s.numRefShards(len(data.Refs)); n > 0 {
+		return s.importRefShards(data.Refs, n, openFSRefShard)
+	}
+	if err := s.removeRefShards(); err != nil {
+		return err
+	}
 	if _, _, err := s.writeRefs(data.Refs); err != nil {
 		return err
 	}
+	if _, err := s.writeRefOrders(data.Refs); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -974,7 +1593,7 @@ func (s *fsUnitStore) writeDefs(defs []*graph.Def) (ofs byteOffsets, err error)
 	}()
 
 	bw := bufio.NewWriter(f)
-	enc := Codec.NewEncoder(bw)
+	enc := s.codec().NewEncoder(bw)
 	ofs = make(byteOffsets, len(defs))
 	var o uint64 // number of bytes read
 	for i, def := range defs {
@@ -1016,7 +1635,7 @@ func (s *fsUnitStore) writeRefs(refs []*graph.Ref) (fbr fileByteRanges, ofs byte
 	}
 
 	bw := bufio.NewWriter(f)
-	enc := Codec.NewEncoder(bw)
+	enc := s.codec().NewEncoder(bw)
 	var o uint64
 	fbr = fileByteRanges{}
 	ofs = make(byteOffsets, len(refs))
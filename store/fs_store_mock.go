@@ -9,15 +9,30 @@ import (
 type MockRepoStoreImporter struct {
 	MockRepoStore
 	Import_        func(commitID string, unit *unit.SourceUnit, data graph.Output) error
+	ImportUnit_    func(commitID string, unit *unit.SourceUnit, data graph.Output) error
 	CreateVersion_ func(commitID string) error
+	Delete_        func(commitID string) error
+	DeleteUnit_    func(commitID string, u unit.ID2) error
 }
 
 func (m MockRepoStoreImporter) Import(commitID string, unit *unit.SourceUnit, data graph.Output) error {
 	return m.Import_(commitID, unit, data)
 }
 
+func (m MockRepoStoreImporter) ImportUnit(commitID string, unit *unit.SourceUnit, data graph.Output) error {
+	return m.ImportUnit_(commitID, unit, data)
+}
+
 func (m MockRepoStoreImporter) CreateVersion(commitID string) error {
 	return m.CreateVersion_(commitID)
 }
 
+func (m MockRepoStoreImporter) Delete(commitID string) error {
+	return m.Delete_(commitID)
+}
+
+func (m MockRepoStoreImporter) DeleteUnit(commitID string, u unit.ID2) error {
+	return m.DeleteUnit_(commitID, u)
+}
+
 var _ RepoStoreImporter = (*MockRepoStoreImporter)(nil)
@@ -12,7 +12,7 @@ func TestFSUnitStore(t *testing.T) {
 func TestFSTreeStore(t *testing.T) {
 	useIndexedStore = false
 	testTreeStore(t, func() TreeStoreImporter {
-		return newFSTreeStore(newTestFS())
+		return newFSTreeStore(newTestFS(), fsStoreSettings{})
 	})
 }
 
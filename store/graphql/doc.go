@@ -0,0 +1,18 @@
+// Package graphql implements a GraphQL API over a multi-repo store, so
+// that clients (such as web frontends) can fetch exactly the fields
+// they need, including nested traversals such as def -> refs -> file
+// -> defs, in a single request. See Schema for the supported types and
+// fields.
+//
+// Queries are executed directly against the store's Repos, Versions,
+// Units, Defs, and Refs methods, so they use the store's indexes like
+// any other query. Fragments, directives, mutations, and subscriptions
+// are not supported. The depth and cost of queries and the number of
+// items of list fields are limited (see MaxDepth, MaxCost, and
+// DefaultFirst), and root defs and refs queries must be scoped to a
+// repo, so that a single query can't read the whole store.
+//
+// To serve the API over HTTP, use Handler:
+//
+//	http.Handle("/graphql", graphql.Handler(mrs))
+package graphql
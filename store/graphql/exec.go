@@ -0,0 +1,372 @@
+package graphql
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"sourcegraph.com/sourcegraph/srclib/store"
+)
+
+// Response is the result of executing a query.
+type Response struct {
+	// Data holds the selected fields (in the order they were
+	// selected). It is nil if the query could not be parsed.
+	Data interface{} `json:"data"`
+
+	// Errors holds the errors that occurred. Fields whose resolution
+	// failed are null in Data.
+	Errors []*Error `json:"errors,omitempty"`
+}
+
+// Error is an error that occurred while executing a query.
+type Error struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"` // the response keys (and list indexes) of the field that failed
+}
+
+func (e *Error) Error() string { return e.Message }
+
+// Limits on the resources that a query may use, so that a single
+// query can't make the store read (or the server hold) an unbounded
+// amount of data.
+const (
+	// MaxDepth is the max nesting depth of a query's selections (a
+	// query that selects only scalar fields of the root has depth 1).
+	MaxDepth = 10
+
+	// MaxCost is the max number of objects that a query may resolve
+	// (counting each item of a list field). Fields that are resolved
+	// after the limit is reached are null, and an error is reported.
+	MaxCost = 10000
+
+	// DefaultFirst is the number of items that a list field returns
+	// if its "first" argument is absent.
+	DefaultFirst = 100
+
+	// MaxFirst is the max value of a list field's "first" argument.
+	MaxFirst = 1000
+)
+
+// Execute executes the query on s with the given variables (which may
+// be nil). Queries that are deeper than MaxDepth are rejected, and
+// resolution stops once a query has resolved MaxCost objects.
+func Execute(s store.MultiRepoStore, query string, variables map[string]interface{}) *Response {
+	doc, err := parse(query)
+	if err != nil {
+		return &Response{Errors: []*Error{{Message: err.Error()}}}
+	}
+	if d := selectionDepth(doc.selections); d > MaxDepth {
+		return &Response{Errors: []*Error{{Message: fmt.Sprintf("query depth %d exceeds the max depth (%d)", d, MaxDepth)}}}
+	}
+	e := &executor{s: s, vars: variables}
+	data := e.selectFields(queryRoot{}, doc.selections, nil)
+	return &Response{Data: data, Errors: e.errs}
+}
+
+// selectionDepth returns the max nesting depth of sels.
+func selectionDepth(sels []*field) int {
+	max := 0
+	for _, f := range sels {
+		if d := selectionDepth(f.selections); d > max {
+			max = d
+		}
+	}
+	if len(sels) == 0 {
+		return 0
+	}
+	return max + 1
+}
+
+// An object is a value of a GraphQL object type.
+type object interface {
+	typeName() string
+
+	// resolve returns the value of the named field. The value is a
+	// scalar (string, bool, or integer), a []string, an object, or an
+	// []object; nil (or a nil object) means null.
+	resolve(e *executor, name string, args *arguments) (interface{}, error)
+}
+
+type executor struct {
+	s    store.MultiRepoStore
+	vars map[string]interface{}
+	errs []*Error
+
+	cost int // the number of objects resolved so far (see MaxCost)
+}
+
+func (e *executor) addError(path []interface{}, err error) {
+	e.errs = append(e.errs, &Error{Message: err.Error(), Path: append([]interface{}(nil), path...)})
+}
+
+// selectFields returns the selected fields of obj.
+func (e *executor) selectFields(obj object, sels []*field, path []interface{}) orderedObject {
+	res := make(orderedObject, 0, len(sels))
+	for _, f := range sels {
+		fpath := append(path, f.key())
+		if e.cost > MaxCost {
+			res = append(res, orderedField{key: f.key(), value: nil})
+			continue
+		}
+		v, err := e.resolveField(obj, f, fpath)
+		if err != nil {
+			e.addError(fpath, err)
+			v = nil
+		}
+		res = append(res, orderedField{key: f.key(), value: v})
+	}
+	return res
+}
+
+func (e *executor) resolveField(obj object, f *field, path []interface{}) (interface{}, error) {
+	if f.name == "__typename" {
+		return obj.typeName(), nil
+	}
+
+	args := &arguments{field: f.name, args: f.args, vars: e.vars, used: map[string]bool{}}
+	v, err := obj.resolve(e, f.name, args)
+	if err == nil {
+		err = args.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := args.checkUnused(); err != nil {
+		return nil, err
+	}
+
+	switch v := v.(type) {
+	case object:
+		if isNilObject(v) {
+			return nil, nil
+		}
+		if f.selections == nil {
+			return nil, fmt.Errorf("field %q of type %s must have a selection of subfields", f.name, v.typeName())
+		}
+		if err := e.addCost(1); err != nil {
+			return nil, err
+		}
+		return e.selectFields(v, f.selections, path), nil
+	case []object:
+		if f.selections == nil {
+			return nil, fmt.Errorf("field %q must have a selection of subfields", f.name)
+		}
+		if err := e.addCost(len(v)); err != nil {
+			return nil, err
+		}
+		list := make([]interface{}, len(v))
+		for i, o := range v {
+			list[i] = e.selectFields(o, f.selections, append(path, i))
+		}
+		return list, nil
+	case nil:
+		return nil, nil
+	default:
+		if f.selections != nil {
+			return nil, fmt.Errorf("field %q is a scalar and can't have a selection of subfields", f.name)
+		}
+		return v, nil
+	}
+}
+
+// addCost adds n resolved objects to the query's cost. It returns an
+// error if the cost exceeds MaxCost.
+func (e *executor) addCost(n int) error {
+	e.cost += n
+	if e.cost > MaxCost {
+		return fmt.Errorf("query exceeds the max cost (%d objects)", MaxCost)
+	}
+	return nil
+}
+
+// isNilObject reports whether obj is a nil pointer (which resolvers
+// return for objects that don't exist).
+func isNilObject(obj object) bool {
+	v := reflect.ValueOf(obj)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
+
+// errUnknownField returns the error for a query of a field that the
+// object's type doesn't have.
+func errUnknownField(obj object, name string) error {
+	return fmt.Errorf("cannot query field %q on type %s", name, obj.typeName())
+}
+
+// arguments holds a field's arguments. Resolvers access them with the
+// typed getters, which record which arguments were used (so that
+// unknown arguments can be reported) and the first invalid argument
+// (in err).
+type arguments struct {
+	field string
+	args  map[string]value
+	vars  map[string]interface{}
+	used  map[string]bool
+	err   error
+}
+
+// get returns the value of the named argument (with variables
+// substituted), or nil if it is absent or null.
+func (a *arguments) get(name string) interface{} {
+	a.used[name] = true
+	return a.resolve(a.args[name])
+}
+
+func (a *arguments) resolve(v value) interface{} {
+	switch v := v.(type) {
+	case variable:
+		return a.vars[string(v)]
+	case []value:
+		list := make([]interface{}, len(v))
+		for i, elem := range v {
+			list[i] = a.resolve(elem)
+		}
+		return list
+	}
+	return v
+}
+
+func (a *arguments) setTypeError(name, want string, v interface{}) {
+	if a.err == nil {
+		a.err = fmt.Errorf("argument %q of field %q must be %s, got %v", name, a.field, want, v)
+	}
+}
+
+// string returns the named string argument, or "" if it was not
+// given.
+func (a *arguments) string(name string) string {
+	switch v := a.get(name).(type) {
+	case nil:
+	case string:
+		return v
+	default:
+		a.setTypeError(name, "a string", v)
+	}
+	return ""
+}
+
+// requiredString is like string, but it sets a.err if the argument is
+// absent or empty.
+func (a *arguments) requiredString(name string) string {
+	s := a.string(name)
+	if s == "" && a.err == nil {
+		a.err = fmt.Errorf("field %q requires argument %q", a.field, name)
+	}
+	return s
+}
+
+// strings returns the named list-of-strings argument.
+func (a *arguments) strings(name string) []string {
+	switch v := a.get(name).(type) {
+	case nil:
+	case string:
+		return []string{v} // GraphQL coerces a single value to a list
+	case []interface{}:
+		strs := make([]string, len(v))
+		for i, elem := range v {
+			s, ok := elem.(string)
+			if !ok {
+				a.setTypeError(name, "a list of strings", v)
+				return nil
+			}
+			strs[i] = s
+		}
+		return strs
+	default:
+		a.setTypeError(name, "a list of strings", v)
+	}
+	return nil
+}
+
+// bool returns the named boolean argument and whether it was given.
+func (a *arguments) bool(name string) (val, present bool) {
+	switch v := a.get(name).(type) {
+	case nil:
+	case bool:
+		return v, true
+	default:
+		a.setTypeError(name, "a boolean", v)
+	}
+	return false, false
+}
+
+// int returns the named integer argument, or 0 if it was not given.
+func (a *arguments) int(name string) int {
+	switch v := a.get(name).(type) {
+	case nil:
+	case int64:
+		return int(v)
+	case float64: // from JSON-decoded variables
+		if v == float64(int(v)) {
+			return int(v)
+		}
+		a.setTypeError(name, "an integer", v)
+	default:
+		a.setTypeError(name, "an integer", v)
+	}
+	return 0
+}
+
+// first returns the max number of items that a list field may return:
+// its "first" argument, or DefaultFirst if it is absent. It sets a.err
+// if the argument is not between 1 and MaxFirst.
+func (a *arguments) first() int {
+	v := a.get("first")
+	n := a.int("first")
+	if v == nil {
+		return DefaultFirst
+	}
+	if (n < 1 || n > MaxFirst) && a.err == nil {
+		a.err = fmt.Errorf("argument \"first\" of field %q must be between 1 and %d, got %d", a.field, MaxFirst, n)
+	}
+	return n
+}
+
+func (a *arguments) checkUnused() error {
+	var unknown []string
+	for name := range a.args {
+		if !a.used[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown arguments %s for field %q", strings.Join(unknown, ", "), a.field)
+	}
+	return nil
+}
+
+// orderedObject is a response object. It is encoded as a JSON object
+// whose keys are in selection order.
+type orderedObject []orderedField
+
+type orderedField struct {
+	key   string
+	value interface{}
+}
+
+func (o orderedObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(f.key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		val, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,188 @@
+package graphql
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/store"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func newTestStore(t *testing.T) store.MultiRepoStore {
+	mrs := store.NewFSMultiRepoStore(rwvfs.Walkable(rwvfs.Map(map[string]string{})), nil)
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}, Info: unit.Info{Files: []string{"f1", "f2"}}}
+	if err := mrs.Import("r", "c", u, graph.Output{
+		Defs: []*graph.Def{
+			{DefKey: graph.DefKey{Path: "A"}, Name: "A", Kind: "func", File: "f1", DefStart: 1, DefEnd: 2, Exported: true, Docs: []*graph.DefDoc{{Format: "text/plain", Data: "A doc"}}},
+			{DefKey: graph.DefKey{Path: "B"}, Name: "B", Kind: "type", File: "f2", DefStart: 3, DefEnd: 4},
+		},
+		Refs: []*graph.Ref{
+			{DefPath: "A", File: "f1", Start: 1, End: 2, Def: true},
+			{DefPath: "A", File: "f2", Start: 5, End: 6},
+			{DefPath: "B", File: "f2", Start: 3, End: 4, Def: true},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	u2 := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u2"}, Info: unit.Info{Files: []string{"g"}}}
+	if err := mrs.Import("r2", "c2", u2, graph.Output{
+		Refs: []*graph.Ref{{DefRepo: "r", DefUnitType: "t", DefUnit: "u", DefPath: "A", File: "g", Start: 7, End: 8}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []store.Version{{Repo: "r", CommitID: "c"}, {Repo: "r2", CommitID: "c2"}} {
+		if err := mrs.CreateVersion(v.Repo, v.CommitID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return mrs
+}
+
+func TestExecute(t *testing.T) {
+	mrs := newTestStore(t)
+
+	tests := map[string]struct {
+		query string
+		vars  map[string]interface{}
+		want  string
+	}{
+		"repos": {
+			query: `{ repos { name versions { commitID } } }`,
+			want:  `{"data":{"repos":[{"name":"r","versions":[{"commitID":"c"}]},{"name":"r2","versions":[{"commitID":"c2"}]}]}}`,
+		},
+		"nested traversal": {
+			query: `query Q {
+				version(repo: "r", commitID: "c") {
+					units { type name files { path } }
+					defs(path: "A") {
+						name kind start end exported
+						docs { data }
+						refs {
+							start isDef
+							file { path defs { name } }
+						}
+					}
+				}
+			}`,
+			want: `{"data":{"version":{"units":[{"type":"t","name":"u","files":[{"path":"f1"},{"path":"f2"}]}],"defs":[{"name":"A","kind":"func","start":1,"end":2,"exported":true,"docs":[{"data":"A doc"}],"refs":[{"start":1,"isDef":true,"file":{"path":"f1","defs":[{"name":"A"}]}},{"start":5,"isDef":false,"file":{"path":"f2","defs":[{"name":"B"}]}}]}]}}}`,
+		},
+		"aliases and variables": {
+			query: `query ($kinds: [String], $n: Int) {
+				a: defs(repo: "r", kinds: $kinds) { name }
+				b: defs(repo: "r", first: $n) { __typename name }
+			}`,
+			vars: map[string]interface{}{"kinds": []interface{}{"type"}, "n": 1.0},
+			want: `{"data":{"a":[{"name":"B"}],"b":[{"__typename":"Def","name":"A"}]}}`,
+		},
+		"cross-repo refs": {
+			query: `{ refs(repo: "r2") { repo defPath def { repo name } } }`,
+			want:  `{"data":{"refs":[{"repo":"r2","defPath":"A","def":{"repo":"r","name":"A"}}]}}`,
+		},
+		"def refs in all repos": {
+			query: `{ defs(repo: "r", path: "A") { refs(allRepos: true) { repo start } } }`,
+			want:  `{"data":{"defs":[{"refs":[{"repo":"r","start":1},{"repo":"r","start":5},{"repo":"r2","start":7}]}]}}`,
+		},
+		"nonexistent": {
+			query: `{ repo(name: "x") { name } version(repo: "r", commitID: "x") { commitID } }`,
+			want:  `{"data":{"repo":null,"version":null}}`,
+		},
+		"field errors": {
+			query: `{ repo(name: "r") { name foo } defs(repo: "r", bar: 1) { name } }`,
+			want:  `{"data":{"repo":{"name":"r","foo":null},"defs":null},"errors":[{"message":"cannot query field \"foo\" on type Repo","path":["repo","foo"]},{"message":"unknown arguments bar for field \"defs\"","path":["defs"]}]}`,
+		},
+		"first": {
+			query: `{ repos(first: 1) { name } version(repo: "r", commitID: "c") { files(first: 1) { path } } }`,
+			want:  `{"data":{"repos":[{"name":"r"}],"version":{"files":[{"path":"f1"}]}}}`,
+		},
+		"first out of range": {
+			query: `{ repos(first: 1001) { name } }`,
+			want:  `{"data":{"repos":null},"errors":[{"message":"argument \"first\" of field \"repos\" must be between 1 and 1000, got 1001","path":["repos"]}]}`,
+		},
+		"unscoped root query": {
+			query: `{ defs(path: "A") { name } }`,
+			want:  `{"data":{"defs":null},"errors":[{"message":"field \"defs\" requires argument \"repo\"","path":["defs"]}]}`,
+		},
+		"too deep": {
+			query: `{ defs(repo: "r") { refs { def { refs { def { refs { def { refs { def { refs { start } } } } } } } } } } }`,
+			want:  `{"data":null,"errors":[{"message":"query depth 11 exceeds the max depth (10)"}]}`,
+		},
+		"syntax error": {
+			query: `{ repos { name }`,
+			want:  `{"data":null,"errors":[{"message":"syntax error at offset 16: expected field name, got '\\x00'"}]}`,
+		},
+		"fragments": {
+			query: `{ repos { ...F } }`,
+			want:  `{"data":null,"errors":[{"message":"syntax error at offset 10: fragments are not supported"}]}`,
+		},
+	}
+	for label, test := range tests {
+		resp, err := json.Marshal(Execute(mrs, test.query, test.vars))
+		if err != nil {
+			t.Errorf("%s: %s", label, err)
+			continue
+		}
+		if string(resp) != test.want {
+			t.Errorf("%s: got response\n%s\nwant\n%s", label, resp, test.want)
+		}
+	}
+}
+
+func TestExecute_maxCost(t *testing.T) {
+	doc, err := parse(`{ repos { name } repo(name: "r") { name } }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &executor{s: newTestStore(t), cost: MaxCost - 1}
+	resp, err := json.Marshal(&Response{Data: e.selectFields(queryRoot{}, doc.selections, nil), Errors: e.errs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"data":{"repos":null,"repo":null},"errors":[{"message":"query exceeds the max cost (10000 objects)","path":["repos"]}]}`; string(resp) != want {
+		t.Errorf("got response\n%s\nwant\n%s", resp, want)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	srv := httptest.NewServer(Handler(newTestStore(t)))
+	defer srv.Close()
+
+	const want = `{"data":{"repo":{"name":"r"}}}` + "\n"
+	check := func(label string, resp *http.Response, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var buf strings.Builder
+		if _, err := io.Copy(&buf, resp.Body); err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || buf.String() != want {
+			t.Errorf("%s: got %d %q, want 200 %q", label, resp.StatusCode, buf.String(), want)
+		}
+	}
+
+	q := url.Values{"query": {`query($r: String) { repo(name: $r) { name } }`}, "variables": {`{"r":"r"}`}}
+	resp, err := http.Get(srv.URL + "?" + q.Encode())
+	check("GET", resp, err)
+
+	resp, err = http.Post(srv.URL, "application/json", strings.NewReader(`{"query":"{ repo(name: \"r\") { name } }"}`))
+	check("POST", resp, err)
+
+	// Request bodies are limited.
+	body := `{"query":"{ repo(name: \"r\") { name } }","variables":{"x":"` + strings.Repeat("x", MaxRequestBytes) + `"}}`
+	resp, err = http.Post(srv.URL, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("too large request: got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
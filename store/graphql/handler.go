@@ -0,0 +1,61 @@
+package graphql
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"sourcegraph.com/sourcegraph/srclib/store"
+)
+
+// A Request is the body of a GraphQL HTTP POST request.
+type Request struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+// MaxRequestBytes is the max size of the body of a GraphQL POST
+// request.
+const MaxRequestBytes = 1 << 20
+
+// Handler returns an HTTP handler that executes GraphQL queries on s.
+// It accepts POST requests whose JSON body is a Request (of at most
+// MaxRequestBytes), and GET requests with "query" and (optionally)
+// JSON-encoded "variables" URL query parameters. Query errors
+// (including queries that exceed the limits described in Execute) are
+// reported in the response's "errors" field, with status 200.
+func Handler(s store.MultiRepoStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req Request
+		switch r.Method {
+		case "GET":
+			req.Query = r.URL.Query().Get("query")
+			if vars := r.URL.Query().Get("variables"); vars != "" {
+				if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+					http.Error(w, "invalid variables: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+		case "POST":
+			r.Body = http.MaxBytesReader(w, r.Body, MaxRequestBytes)
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if req.Query == "" {
+			http.Error(w, "no query given", http.StatusBadRequest)
+			return
+		}
+
+		resp := Execute(s, req.Query, req.Variables)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error writing GraphQL response: %s", err)
+		}
+	})
+}
@@ -0,0 +1,320 @@
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A document is a parsed query document. Only a single operation (a
+// query) is supported.
+type document struct {
+	name       string
+	selections []*field
+}
+
+// A field is a selected field, with its arguments and (for fields
+// whose values are objects) its own selections.
+type field struct {
+	alias      string // the response key, if different from name
+	name       string
+	args       map[string]value
+	selections []*field
+}
+
+// key returns the field's key in the response object.
+func (f *field) key() string {
+	if f.alias != "" {
+		return f.alias
+	}
+	return f.name
+}
+
+// A value is an argument value: a string, int64, float64, bool, nil,
+// []value, or variable.
+type value interface{}
+
+// A variable is a reference ("$name") to a query variable.
+type variable string
+
+// parse parses a query document. It supports the GraphQL query
+// language except for fragments, directives, and mutations and
+// subscriptions.
+func parse(query string) (*document, error) {
+	p := &parser{s: query}
+	doc, err := p.document()
+	if err != nil {
+		return nil, &SyntaxError{Offset: p.pos, Msg: err.Error()}
+	}
+	return doc, nil
+}
+
+// SyntaxError is the error returned for queries that can't be
+// parsed.
+type SyntaxError struct {
+	Offset int // byte offset in the query where the error occurred
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at offset %d: %s", e.Offset, e.Msg)
+}
+
+type parser struct {
+	s   string
+	pos int
+}
+
+func (p *parser) document() (*document, error) {
+	var doc document
+	p.skipSpace()
+	if p.peek() != '{' {
+		op := p.name()
+		switch op {
+		case "query":
+		case "mutation", "subscription":
+			return nil, fmt.Errorf("%s operations are not supported", op)
+		case "fragment":
+			return nil, fmt.Errorf("fragments are not supported")
+		default:
+			return nil, fmt.Errorf("expected query, got %q", op)
+		}
+		p.skipSpace()
+		if p.peek() != '{' && p.peek() != '(' {
+			doc.name = p.name()
+			if doc.name == "" {
+				return nil, fmt.Errorf("expected operation name")
+			}
+			p.skipSpace()
+		}
+		if p.peek() == '(' {
+			if err := p.skipVariableDefinitions(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	sels, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	doc.selections = sels
+	p.skipSpace()
+	if p.pos < len(p.s) {
+		return nil, fmt.Errorf("unexpected %q after query (only one operation is supported)", p.peek())
+	}
+	return &doc, nil
+}
+
+// skipVariableDefinitions skips over the operation's variable
+// definitions. Variables' types are not checked; their values are
+// checked when they are used as arguments.
+func (p *parser) skipVariableDefinitions() error {
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		p.pos++
+		if c == ')' {
+			p.skipSpace()
+			return nil
+		}
+	}
+	return fmt.Errorf("unterminated variable definitions")
+}
+
+func (p *parser) selectionSet() ([]*field, error) {
+	if err := p.expect('{'); err != nil {
+		return nil, err
+	}
+	var sels []*field
+	for {
+		p.skipSpace()
+		switch p.peek() {
+		case '}':
+			p.pos++
+			if len(sels) == 0 {
+				return nil, fmt.Errorf("empty selection set")
+			}
+			return sels, nil
+		case '.':
+			return nil, fmt.Errorf("fragments are not supported")
+		case '@':
+			return nil, fmt.Errorf("directives are not supported")
+		}
+		f, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		sels = append(sels, f)
+	}
+}
+
+func (p *parser) field() (*field, error) {
+	var f field
+	f.name = p.name()
+	if f.name == "" {
+		return nil, fmt.Errorf("expected field name, got %q", p.peek())
+	}
+	p.skipSpace()
+	if p.peek() == ':' {
+		p.pos++
+		p.skipSpace()
+		f.alias, f.name = f.name, p.name()
+		if f.name == "" {
+			return nil, fmt.Errorf("expected field name after alias %q", f.alias)
+		}
+		p.skipSpace()
+	}
+	if p.peek() == '(' {
+		p.pos++
+		f.args = map[string]value{}
+		for {
+			p.skipSpace()
+			if p.peek() == ')' {
+				p.pos++
+				break
+			}
+			name := p.name()
+			if name == "" {
+				return nil, fmt.Errorf("expected argument name, got %q", p.peek())
+			}
+			p.skipSpace()
+			if err := p.expect(':'); err != nil {
+				return nil, err
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			f.args[name] = v
+		}
+		p.skipSpace()
+	}
+	if p.peek() == '{' {
+		sels, err := p.selectionSet()
+		if err != nil {
+			return nil, err
+		}
+		f.selections = sels
+	}
+	return &f, nil
+}
+
+func (p *parser) value() (value, error) {
+	p.skipSpace()
+	switch c := p.peek(); {
+	case c == '$':
+		p.pos++
+		name := p.name()
+		if name == "" {
+			return nil, fmt.Errorf("expected variable name")
+		}
+		return variable(name), nil
+	case c == '"':
+		return p.string()
+	case c == '[':
+		p.pos++
+		var list []value
+		for {
+			p.skipSpace()
+			if p.peek() == ']' {
+				p.pos++
+				return list, nil
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+	case c == '-' || (c >= '0' && c <= '9'):
+		start := p.pos
+		p.pos++
+		for p.pos < len(p.s) && strings.IndexByte("0123456789.eE+-", p.s[p.pos]) != -1 {
+			p.pos++
+		}
+		lit := p.s[start:p.pos]
+		if n, err := strconv.ParseInt(lit, 10, 64); err == nil {
+			return n, nil
+		}
+		return strconv.ParseFloat(lit, 64)
+	default:
+		switch name := p.name(); name {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		case "":
+			return nil, fmt.Errorf("expected value, got %q", c)
+		default:
+			// Enum values are passed as strings.
+			return name, nil
+		}
+	}
+}
+
+func (p *parser) string() (string, error) {
+	start := p.pos
+	p.pos++
+	for p.pos < len(p.s) {
+		switch p.s[p.pos] {
+		case '\\':
+			p.pos += 2
+			continue
+		case '"':
+			p.pos++
+			return strconv.Unquote(p.s[start:p.pos])
+		case '\n':
+			return "", fmt.Errorf("unterminated string")
+		}
+		p.pos++
+	}
+	return "", fmt.Errorf("unterminated string")
+}
+
+func (p *parser) name() string {
+	start := p.pos
+	for p.pos < len(p.s) {
+		c := rune(p.s[p.pos])
+		if c != '_' && !unicode.IsLetter(c) && !(p.pos > start && unicode.IsDigit(c)) {
+			break
+		}
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+func (p *parser) expect(c byte) error {
+	p.skipSpace()
+	if p.peek() != c {
+		return fmt.Errorf("expected %q, got %q", c, p.peek())
+	}
+	p.pos++
+	return nil
+}
+
+// peek returns the next byte, or 0 at the end of the query.
+func (p *parser) peek() byte {
+	if p.pos < len(p.s) {
+		return p.s[p.pos]
+	}
+	return 0
+}
+
+// skipSpace skips whitespace, commas (which are insignificant in
+// GraphQL), and comments.
+func (p *parser) skipSpace() {
+	for p.pos < len(p.s) {
+		switch p.s[p.pos] {
+		case ' ', '\t', '\n', '\r', ',':
+			p.pos++
+		case '#':
+			for p.pos < len(p.s) && p.s[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,638 @@
+package graphql
+
+import (
+	"sort"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/store"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// Schema is the GraphQL schema of the queries that Execute supports,
+// in the GraphQL schema language.
+//
+// List fields with a "first" argument return at most that many items
+// (which must be at most MaxFirst), or at most DefaultFirst items if
+// it is absent.
+const Schema = `
+type Query {
+  repos(first: Int): [Repo]
+  repo(name: String!): Repo
+  version(repo: String!, commitID: String!): Version
+  defs(repo: String!, commitID: String, unitType: String, unit: String, ` + defArgs + `): [Def]
+  refs(repo: String!, commitID: String, unitType: String, unit: String, ` + refArgs + `): [Ref]
+}
+
+type Repo {
+  name: String
+  versions(first: Int): [Version]
+  version(commitID: String!): Version
+  defs(` + defArgs + `): [Def]
+  refs(` + refArgs + `): [Ref]
+}
+
+type Version {
+  repo: String
+  commitID: String
+  units(first: Int): [Unit]
+  unit(type: String!, name: String!): Unit
+  files(first: Int): [File]
+  file(path: String!): File
+  defs(` + defArgs + `): [Def]
+  refs(` + refArgs + `): [Ref]
+}
+
+type Unit {
+  repo: String
+  commitID: String
+  type: String
+  name: String
+  dir: String
+  files(first: Int): [File]
+  defs(` + defArgs + `): [Def]
+  refs(` + refArgs + `): [Ref]
+}
+
+type File {
+  repo: String
+  commitID: String
+  path: String
+  defs(` + defArgs + `): [Def]
+  refs(` + refArgs + `): [Ref]
+}
+
+type Def {
+  repo: String
+  commitID: String
+  unitType: String
+  unit: String
+  path: String
+  treePath: String
+  name: String
+  kind: String
+  file: File
+  start: Int
+  end: Int
+  exported: Boolean
+  local: Boolean
+  test: Boolean
+  data: String
+  docs: [Doc]
+  # refs are the refs to the def in its version (or in all versions of
+  # all repos, if allRepos is true).
+  refs(allRepos: Boolean, ` + refArgs + `): [Ref]
+}
+
+type Ref {
+  repo: String
+  commitID: String
+  unitType: String
+  unit: String
+  file: File
+  start: Int
+  end: Int
+  isDef: Boolean
+  defRepo: String
+  defUnitType: String
+  defUnit: String
+  defPath: String
+  # def is the def that the ref refers to, or null if it's not in the
+  # store.
+  def: Def
+}
+
+type Doc {
+  format: String
+  data: String
+}
+`
+
+const (
+	defArgs = "path: String, kinds: [String], query: String, file: String, exported: Boolean, first: Int"
+	refArgs = "file: String, defRepo: String, defUnitType: String, defUnit: String, defPath: String, first: Int"
+)
+
+// A scopeFilter restricts a def or ref query to the data of the
+// object whose field is being resolved.
+type scopeFilter interface {
+	store.DefFilter
+	store.RefFilter
+}
+
+// queryDefs resolves a defs field (with the arguments in defArgs) on
+// an object whose data is selected by scope.
+func queryDefs(e *executor, args *arguments, scope ...scopeFilter) (interface{}, error) {
+	fs := make([]store.DefFilter, 0, len(scope))
+	for _, f := range scope {
+		fs = append(fs, f)
+	}
+	if path := args.string("path"); path != "" {
+		f, err := store.NewByDefPathFilter(path)
+		if err != nil {
+			return nil, err
+		}
+		fs = append(fs, f)
+	}
+	if kinds := args.strings("kinds"); len(kinds) > 0 {
+		for _, k := range kinds {
+			if k == "" {
+				return nil, &store.FilterError{Filter: "ByDefKinds", Err: "empty kind"}
+			}
+		}
+		fs = append(fs, store.ByDefKinds(kinds...))
+	}
+	if q := args.string("query"); q != "" {
+		fs = append(fs, store.ByDefQuery(q))
+	}
+	if file := args.string("file"); file != "" {
+		f, err := store.NewByFilesFilter(true, file)
+		if err != nil {
+			return nil, err
+		}
+		fs = append(fs, f)
+	}
+	if exported, present := args.bool("exported"); present {
+		if exported {
+			fs = append(fs, store.ByExported())
+		} else {
+			fs = append(fs, store.DefFilterFunc(func(def *graph.Def) bool { return !def.Exported }))
+		}
+	}
+	fs = append(fs, store.First(args.first()))
+	if args.err != nil {
+		return nil, args.err
+	}
+
+	defs, err := e.s.Defs(fs...)
+	if err != nil {
+		return nil, err
+	}
+	objs := make([]object, len(defs))
+	for i, def := range defs {
+		objs[i] = &defObj{def}
+	}
+	return objs, nil
+}
+
+// queryRefs resolves a refs field (with the arguments in refArgs) on
+// an object whose data is selected by scope.
+func queryRefs(e *executor, args *arguments, scope ...store.RefFilter) (interface{}, error) {
+	fs := append([]store.RefFilter(nil), scope...)
+	if file := args.string("file"); file != "" {
+		f, err := store.NewByFilesFilter(true, file)
+		if err != nil {
+			return nil, err
+		}
+		fs = append(fs, f)
+	}
+	def := graph.RefDefKey{
+		DefRepo:     args.string("defRepo"),
+		DefUnitType: args.string("defUnitType"),
+		DefUnit:     args.string("defUnit"),
+		DefPath:     args.string("defPath"),
+	}
+	if def != (graph.RefDefKey{}) {
+		if def.DefPath == "" {
+			return nil, &store.FilterError{Filter: "ByRefDef", Err: "defPath is required with defRepo, defUnitType, and defUnit"}
+		}
+		fs = append(fs, store.ByRefDef(def))
+	}
+	fs = append(fs, store.First(args.first()))
+	if args.err != nil {
+		return nil, args.err
+	}
+
+	refs, err := e.s.Refs(fs...)
+	if err != nil {
+		return nil, err
+	}
+	objs := make([]object, len(refs))
+	for i, ref := range refs {
+		objs[i] = &refObj{ref}
+	}
+	return objs, nil
+}
+
+// rootScope returns the filters specified by the repo, commitID,
+// unitType, and unit arguments of the root defs and refs fields. The
+// repo argument is required, so that root queries never scan all
+// repos.
+func rootScope(args *arguments) ([]scopeFilter, error) {
+	var scope []scopeFilter
+	repo := args.requiredString("repo")
+	if args.err != nil {
+		return nil, args.err
+	}
+	f, err := store.NewByReposFilter(repo)
+	if err != nil {
+		return nil, err
+	}
+	scope = append(scope, f)
+	if commitID := args.string("commitID"); commitID != "" {
+		f, err := store.NewByCommitIDsFilter(commitID)
+		if err != nil {
+			return nil, err
+		}
+		scope = append(scope, f)
+	}
+	if unitType, unitName := args.string("unitType"), args.string("unit"); unitType != "" || unitName != "" {
+		f, err := store.NewByUnitsFilter(unit.ID2{Type: unitType, Name: unitName})
+		if err != nil {
+			return nil, err
+		}
+		scope = append(scope, f)
+	}
+	return scope, args.err
+}
+
+// versionScope returns a filter that selects the data in a version.
+func versionScope(repo, commitID string) interface {
+	scopeFilter
+	store.UnitFilter
+	store.VersionFilter
+} {
+	return store.ByRepoCommitIDs(store.Version{Repo: repo, CommitID: commitID})
+}
+
+type queryRoot struct{}
+
+func (queryRoot) typeName() string { return "Query" }
+
+func (q queryRoot) resolve(e *executor, name string, args *arguments) (interface{}, error) {
+	switch name {
+	case "repos":
+		first := args.first()
+		if args.err != nil {
+			return nil, args.err
+		}
+		repos, err := e.s.Repos(store.First(first))
+		if err != nil {
+			return nil, err
+		}
+		objs := make([]object, len(repos))
+		for i, repo := range repos {
+			objs[i] = &repoObj{repo}
+		}
+		return objs, nil
+	case "repo":
+		name := args.requiredString("name")
+		if args.err != nil {
+			return nil, args.err
+		}
+		repos, err := e.s.Repos(store.ByRepos(name))
+		if err != nil || len(repos) == 0 {
+			return (*repoObj)(nil), err
+		}
+		return &repoObj{repos[0]}, nil
+	case "version":
+		repo, commitID := args.requiredString("repo"), args.requiredString("commitID")
+		if args.err != nil {
+			return nil, args.err
+		}
+		return findVersion(e, repo, commitID)
+	case "defs", "refs":
+		scope, err := rootScope(args)
+		if err != nil {
+			return nil, err
+		}
+		if name == "defs" {
+			return queryDefs(e, args, scope...)
+		}
+		rscope := make([]store.RefFilter, len(scope))
+		for i, f := range scope {
+			rscope[i] = f
+		}
+		return queryRefs(e, args, rscope...)
+	}
+	return nil, errUnknownField(q, name)
+}
+
+func findVersion(e *executor, repo, commitID string) (object, error) {
+	versions, err := e.s.Versions(versionScope(repo, commitID))
+	if err != nil || len(versions) == 0 {
+		return (*versionObj)(nil), err
+	}
+	return &versionObj{versions[0]}, nil
+}
+
+type repoObj struct{ name string }
+
+func (*repoObj) typeName() string { return "Repo" }
+
+func (r *repoObj) resolve(e *executor, name string, args *arguments) (interface{}, error) {
+	switch name {
+	case "name":
+		return r.name, nil
+	case "versions":
+		first := args.first()
+		if args.err != nil {
+			return nil, args.err
+		}
+		versions, err := e.s.Versions(store.ByRepos(r.name))
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) > first {
+			versions = versions[:first]
+		}
+		objs := make([]object, len(versions))
+		for i, v := range versions {
+			objs[i] = &versionObj{v}
+		}
+		return objs, nil
+	case "version":
+		commitID := args.requiredString("commitID")
+		if args.err != nil {
+			return nil, args.err
+		}
+		return findVersion(e, r.name, commitID)
+	case "defs":
+		return queryDefs(e, args, store.ByRepos(r.name))
+	case "refs":
+		return queryRefs(e, args, store.ByRepos(r.name))
+	}
+	return nil, errUnknownField(r, name)
+}
+
+type versionObj struct{ *store.Version }
+
+func (*versionObj) typeName() string { return "Version" }
+
+func (v *versionObj) resolve(e *executor, name string, args *arguments) (interface{}, error) {
+	switch name {
+	case "repo":
+		return v.Repo, nil
+	case "commitID":
+		return v.CommitID, nil
+	case "units":
+		first := args.first()
+		if args.err != nil {
+			return nil, args.err
+		}
+		units, err := e.s.Units(versionScope(v.Repo, v.CommitID), store.First(first))
+		if err != nil {
+			return nil, err
+		}
+		objs := make([]object, len(units))
+		for i, u := range units {
+			objs[i] = &unitObj{u}
+		}
+		return objs, nil
+	case "unit":
+		typ, unitName := args.requiredString("type"), args.requiredString("name")
+		if args.err != nil {
+			return nil, args.err
+		}
+		units, err := e.s.Units(versionScope(v.Repo, v.CommitID), store.ByUnits(unit.ID2{Type: typ, Name: unitName}))
+		if err != nil || len(units) == 0 {
+			return (*unitObj)(nil), err
+		}
+		return &unitObj{units[0]}, nil
+	case "files":
+		first := args.first()
+		if args.err != nil {
+			return nil, args.err
+		}
+		units, err := e.s.Units(versionScope(v.Repo, v.CommitID))
+		if err != nil {
+			return nil, err
+		}
+		return fileObjs(first, v.Repo, v.CommitID, units...), nil
+	case "file":
+		path := args.requiredString("path")
+		if args.err != nil {
+			return nil, args.err
+		}
+		f, err := store.NewByFilesFilter(true, path)
+		if err != nil {
+			return nil, err
+		}
+		units, err := e.s.Units(versionScope(v.Repo, v.CommitID), f)
+		if err != nil || len(units) == 0 {
+			return (*fileObj)(nil), err
+		}
+		return &fileObj{repo: v.Repo, commitID: v.CommitID, path: f.ByFiles()[0]}, nil
+	case "defs":
+		return queryDefs(e, args, versionScope(v.Repo, v.CommitID))
+	case "refs":
+		return queryRefs(e, args, versionScope(v.Repo, v.CommitID))
+	}
+	return nil, errUnknownField(v, name)
+}
+
+// fileObjs returns the first n (sorted and deduplicated) files in
+// units.
+func fileObjs(n int, repo, commitID string, units ...*unit.SourceUnit) []object {
+	seen := map[string]struct{}{}
+	var files []string
+	for _, u := range units {
+		for _, file := range u.Files {
+			if _, seen := seen[file]; !seen {
+				files = append(files, file)
+			}
+			seen[file] = struct{}{}
+		}
+	}
+	sort.Strings(files)
+	if len(files) > n {
+		files = files[:n]
+	}
+	objs := make([]object, len(files))
+	for i, file := range files {
+		objs[i] = &fileObj{repo: repo, commitID: commitID, path: file}
+	}
+	return objs
+}
+
+type unitObj struct{ *unit.SourceUnit }
+
+func (*unitObj) typeName() string { return "Unit" }
+
+func (u *unitObj) resolve(e *executor, name string, args *arguments) (interface{}, error) {
+	switch name {
+	case "repo":
+		return u.Repo, nil
+	case "commitID":
+		return u.CommitID, nil
+	case "type":
+		return u.Type, nil
+	case "name":
+		return u.Name, nil
+	case "dir":
+		return u.Dir, nil
+	case "files":
+		first := args.first()
+		if args.err != nil {
+			return nil, args.err
+		}
+		return fileObjs(first, u.Repo, u.CommitID, u.SourceUnit), nil
+	case "defs":
+		return queryDefs(e, args, versionScope(u.Repo, u.CommitID), store.ByUnits(u.ID2()))
+	case "refs":
+		return queryRefs(e, args, versionScope(u.Repo, u.CommitID), store.ByUnits(u.ID2()))
+	}
+	return nil, errUnknownField(u, name)
+}
+
+type fileObj struct{ repo, commitID, path string }
+
+// newFileObj returns the file at path in the version, or a nil
+// *fileObj if path is empty.
+func newFileObj(repo, commitID, path string) *fileObj {
+	if path == "" {
+		return nil
+	}
+	return &fileObj{repo: repo, commitID: commitID, path: path}
+}
+
+func (*fileObj) typeName() string { return "File" }
+
+func (f *fileObj) resolve(e *executor, name string, args *arguments) (interface{}, error) {
+	switch name {
+	case "repo":
+		return f.repo, nil
+	case "commitID":
+		return f.commitID, nil
+	case "path":
+		return f.path, nil
+	case "defs":
+		return queryDefs(e, args, versionScope(f.repo, f.commitID), store.ByFiles(true, f.path))
+	case "refs":
+		return queryRefs(e, args, versionScope(f.repo, f.commitID), store.ByFiles(true, f.path))
+	}
+	return nil, errUnknownField(f, name)
+}
+
+type defObj struct{ *graph.Def }
+
+func (*defObj) typeName() string { return "Def" }
+
+func (d *defObj) resolve(e *executor, name string, args *arguments) (interface{}, error) {
+	switch name {
+	case "repo":
+		return d.Repo, nil
+	case "commitID":
+		return d.CommitID, nil
+	case "unitType":
+		return d.UnitType, nil
+	case "unit":
+		return d.Unit, nil
+	case "path":
+		return d.Path, nil
+	case "treePath":
+		return d.TreePath, nil
+	case "name":
+		return d.Name, nil
+	case "kind":
+		return d.Kind, nil
+	case "file":
+		return newFileObj(d.Repo, d.CommitID, d.File), nil
+	case "start":
+		return d.DefStart, nil
+	case "end":
+		return d.DefEnd, nil
+	case "exported":
+		return d.Exported, nil
+	case "local":
+		return d.Local, nil
+	case "test":
+		return d.Test, nil
+	case "data":
+		if len(d.Data) == 0 {
+			return nil, nil
+		}
+		return string(d.Data), nil
+	case "docs":
+		objs := make([]object, len(d.Docs))
+		for i, doc := range d.Docs {
+			objs[i] = &docObj{doc}
+		}
+		return objs, nil
+	case "refs":
+		scope := []store.RefFilter{store.ByRefDef(graph.RefDefKey{
+			DefRepo:     d.Repo,
+			DefUnitType: d.UnitType,
+			DefUnit:     d.Unit,
+			DefPath:     d.Path,
+		})}
+		if allRepos, _ := args.bool("allRepos"); !allRepos {
+			scope = append(scope, versionScope(d.Repo, d.CommitID))
+		}
+		return queryRefs(e, args, scope...)
+	}
+	return nil, errUnknownField(d, name)
+}
+
+type refObj struct{ *graph.Ref }
+
+func (*refObj) typeName() string { return "Ref" }
+
+func (r *refObj) resolve(e *executor, name string, args *arguments) (interface{}, error) {
+	switch name {
+	case "repo":
+		return r.Repo, nil
+	case "commitID":
+		return r.CommitID, nil
+	case "unitType":
+		return r.UnitType, nil
+	case "unit":
+		return r.Unit, nil
+	case "file":
+		return newFileObj(r.Repo, r.CommitID, r.File), nil
+	case "start":
+		return r.Start, nil
+	case "end":
+		return r.End, nil
+	case "isDef":
+		return r.Def, nil
+	case "defRepo":
+		return r.DefRepo, nil
+	case "defUnitType":
+		return r.DefUnitType, nil
+	case "defUnit":
+		return r.DefUnit, nil
+	case "defPath":
+		return r.DefPath, nil
+	case "def":
+		return r.resolveDef(e)
+	}
+	return nil, errUnknownField(r, name)
+}
+
+// resolveDef returns the def that the ref refers to. Refs don't record
+// the commit of defs in other repos, so for those it returns the def
+// in any version of the def's repo.
+func (r *refObj) resolveDef(e *executor) (object, error) {
+	if r.DefPath == "" || r.DefUnitType == "" {
+		return (*defObj)(nil), nil
+	}
+	fs := []store.DefFilter{
+		store.ByUnits(unit.ID2{Type: r.DefUnitType, Name: r.DefUnit}),
+		store.ByDefPath(r.DefPath),
+	}
+	switch r.DefRepo {
+	case "", r.Repo:
+		fs = append(fs, versionScope(r.Repo, r.CommitID))
+	default:
+		fs = append(fs, store.ByRepos(r.DefRepo))
+	}
+	defs, err := e.s.Defs(fs...)
+	if err != nil || len(defs) == 0 {
+		return (*defObj)(nil), err
+	}
+	return &defObj{defs[0]}, nil
+}
+
+type docObj struct{ *graph.DefDoc }
+
+func (*docObj) typeName() string { return "Doc" }
+
+func (d *docObj) resolve(e *executor, name string, args *arguments) (interface{}, error) {
+	switch name {
+	case "format":
+		return d.Format, nil
+	case "data":
+		return d.Data, nil
+	}
+	return nil, errUnknownField(d, name)
+}
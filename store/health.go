@@ -0,0 +1,242 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// HealthCheckOptions configures HealthCheck.
+type HealthCheckOptions struct {
+	// WriteProbe, if set, checks that the store is writable by
+	// writing, reading back, and removing a small file. Only
+	// file-backed stores support write probes.
+	WriteProbe bool
+
+	// SampleRepos is the maximum number of repos that the read probe
+	// lists (and that the tree whose indexes are checked is sampled
+	// from). If 0, a default of 10 is used.
+	SampleRepos int
+
+	// MaxLatency, if nonzero, is the maximum latency of each probe.
+	// Slower probes are reported as failed (but HealthCheck still
+	// waits for them, unless ctx is done).
+	MaxLatency time.Duration
+}
+
+// HealthReport is the result of a health check.
+type HealthReport struct {
+	// Healthy is whether all probes succeeded.
+	Healthy bool
+
+	Probes []*HealthProbe
+}
+
+// HealthProbe is the result of a single health check probe.
+type HealthProbe struct {
+	// Name is the probe's name ("read", "write", or "indexes").
+	Name string
+
+	// Target describes what was probed (e.g., the sampled tree), if
+	// applicable.
+	Target string `json:",omitempty"`
+
+	// Latency is how long the probe took.
+	Latency time.Duration
+
+	// Error is the probe's error message, or "" if it succeeded.
+	Error string `json:",omitempty"`
+
+	// Skipped is whether the probe was skipped (because the store
+	// doesn't support it or there was nothing to probe).
+	Skipped bool `json:",omitempty"`
+}
+
+// healthProbeFilename is the name of the file that write probes write
+// (at the root of the store).
+const healthProbeFilename = "__health_probe"
+
+// HealthCheck performs a cheap health check of s: a read probe (which
+// lists repos), an optional write probe, and a check that the indexes
+// of a sampled tree are readable. It reports each probe's latency
+// (i.e., the latency of the store's backend) so that systems embedding
+// the store can wire it into their health endpoints.
+//
+// If ctx is done before a probe completes, the probe fails with ctx's
+// error and the remaining probes are skipped.
+func HealthCheck(ctx context.Context, s MultiRepoStore, opt *HealthCheckOptions) *HealthReport {
+	if opt == nil {
+		opt = &HealthCheckOptions{}
+	}
+	sampleRepos := opt.SampleRepos
+	if sampleRepos == 0 {
+		sampleRepos = 10
+	}
+	fss, _ := s.(*fsMultiRepoStore)
+
+	rep := &HealthReport{Healthy: true}
+	probe := func(name string, f func() (string, error)) {
+		p := &HealthProbe{Name: name}
+		rep.Probes = append(rep.Probes, p)
+		if err := ctx.Err(); err != nil {
+			p.Skipped = true
+			p.Error = err.Error()
+			rep.Healthy = false
+			return
+		}
+
+		type result struct {
+			target string
+			err    error
+		}
+		done := make(chan result, 1)
+		start := time.Now()
+		go func() {
+			target, err := f()
+			done <- result{target, err}
+		}()
+		var err error
+		select {
+		case res := <-done:
+			p.Target, err = res.target, res.err
+			if err == errHealthProbeSkipped {
+				p.Skipped, err = true, nil
+			}
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		p.Latency = time.Since(start)
+		if err == nil && opt.MaxLatency != 0 && p.Latency > opt.MaxLatency {
+			err = fmt.Errorf("latency %s exceeds maximum %s", p.Latency, opt.MaxLatency)
+		}
+		if err != nil {
+			p.Error = err.Error()
+			rep.Healthy = false
+		}
+	}
+
+	var repos []string
+	probe("read", func() (string, error) {
+		if fss != nil {
+			// List only a few repos (instead of all of them, as Repos
+			// does).
+			paths, err := fss.ListRepoPaths(fss.fs, "", sampleRepos)
+			if os.IsNotExist(err) {
+				return "", nil // nothing has been imported yet
+			} else if err != nil {
+				return "", err
+			}
+			for _, path := range paths {
+				repos = append(repos, fss.PathToRepo(path))
+			}
+			return "", nil
+		}
+		var err error
+		repos, err = s.Repos()
+		if len(repos) > sampleRepos {
+			repos = repos[:sampleRepos]
+		}
+		return "", err
+	})
+
+	if opt.WriteProbe {
+		probe("write", func() (string, error) {
+			if fss == nil {
+				return "", errHealthProbeSkipped
+			}
+			return healthProbeFilename, fss.probeWrite()
+		})
+	}
+
+	probe("indexes", func() (string, error) {
+		if fss == nil || len(repos) == 0 {
+			return "", errHealthProbeSkipped
+		}
+		repo := repos[rand.Intn(len(repos))]
+		versions, err := fss.openRepoStore(repo).Versions()
+		if err != nil {
+			return repo, err
+		}
+		if len(versions) == 0 {
+			return repo, errHealthProbeSkipped
+		}
+		commitID := versions[rand.Intn(len(versions))].CommitID
+		target := repo + "@" + commitID
+		return target, fss.checkTreeIndexes(repo, commitID)
+	})
+
+	return rep
+}
+
+var errHealthProbeSkipped = errors.New("health probe skipped")
+
+// probeWrite writes, reads back, and removes the health probe file.
+func (s *fsMultiRepoStore) probeWrite() error {
+	data := strconv.FormatInt(time.Now().UnixNano(), 10)
+	f, err := s.fs.Create(healthProbeFilename)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte(data)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	rf, err := s.fs.Open(healthProbeFilename)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, len(data)+1)
+	n, _ := rf.Read(buf)
+	rf.Close()
+	if string(buf[:n]) != data {
+		return fmt.Errorf("read %q from health probe file, want %q", buf[:n], data)
+	}
+	return s.fs.Remove(healthProbeFilename)
+}
+
+// checkTreeIndexes reads each of the tree's built indexes.
+func (s *fsMultiRepoStore) checkTreeIndexes(repo, commitID string) error {
+	xs, ok := s.openRepoStore(repo).(*fsRepoStore).newTreeStore(commitID).(*indexedTreeStore)
+	if !ok {
+		return nil
+	}
+	for name, x := range xs.Indexes() {
+		px, ok := x.(persistedIndex)
+		if !ok {
+			continue
+		}
+		if _, err := xs.statIndex(name); os.IsNotExist(err) {
+			continue // not built
+		} else if err != nil {
+			return err
+		}
+		if err := xs.readIndex(name, px); err != nil {
+			return fmt.Errorf("index %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// HealthHandler returns an HTTP handler that responds with the JSON
+// HealthReport of a health check of s. The response status is 200 if
+// the store is healthy and 503 otherwise.
+func HealthHandler(s MultiRepoStore, opt *HealthCheckOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rep := HealthCheck(r.Context(), s, opt)
+		w.Header().Set("Content-Type", "application/json")
+		if !rep.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(rep)
+	})
+}
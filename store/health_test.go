@@ -0,0 +1,57 @@
+package store
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestHealthCheck(t *testing.T) {
+	mrs := NewFSMultiRepoStore(newTestFS(), nil)
+	testSyncImport(t, mrs, "r", "c", "u")
+	if err := mrs.(MultiRepoIndexer).Index("r", "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	rep := HealthCheck(context.Background(), mrs, &HealthCheckOptions{WriteProbe: true})
+	if !rep.Healthy {
+		t.Errorf("got unhealthy report: %+v", rep.Probes)
+	}
+	if len(rep.Probes) != 3 {
+		t.Fatalf("got %d probes, want 3", len(rep.Probes))
+	}
+	for _, p := range rep.Probes {
+		if p.Skipped {
+			t.Errorf("probe %s was skipped", p.Name)
+		}
+	}
+	if want := "r@c"; rep.Probes[2].Target != want {
+		t.Errorf("got indexes probe target %q, want %q", rep.Probes[2].Target, want)
+	}
+	if _, err := mrs.(*fsMultiRepoStore).fs.Stat(healthProbeFilename); err == nil {
+		t.Error("health probe file was not removed")
+	}
+	if repos, _ := mrs.Repos(); len(repos) != 1 {
+		t.Errorf("got repos %v, want [r]", repos)
+	}
+}
+
+func TestHealthCheck_canceled(t *testing.T) {
+	mrs := NewFSMultiRepoStore(newTestFS(), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if rep := HealthCheck(ctx, mrs, nil); rep.Healthy {
+		t.Error("got healthy report after ctx was canceled")
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	mrs := NewFSMultiRepoStore(newTestFS(), nil)
+	w := httptest.NewRecorder()
+	HealthHandler(mrs, nil).ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("got HTTP %d, want 200: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,157 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+// An ImpactReport describes the refs (in all repos) that would be
+// affected by changing a set of defs.
+type ImpactReport struct {
+	// Refs is the total number of refs to the defs.
+	Refs int
+
+	// Trees are the trees that contain refs to the defs, sorted by
+	// repo and commit ID.
+	Trees []*TreeImpact
+}
+
+// A TreeImpact describes the refs in a tree to the defs in an
+// ImpactReport.
+type TreeImpact struct {
+	Repo, CommitID string
+
+	// Refs is the number of refs in the tree to the defs.
+	Refs int
+
+	// Units are the source units in the tree that contain refs to the
+	// defs, sorted by unit type and name.
+	Units []*UnitImpact
+}
+
+// A UnitImpact describes the refs in a source unit to the defs in an
+// ImpactReport.
+type UnitImpact struct {
+	UnitType, Unit string
+
+	// Refs is the number of refs in the unit to the defs.
+	Refs int
+
+	// Files is the number of refs to the defs in each file of the
+	// unit.
+	Files map[string]int
+}
+
+// A MultiRepoImpact reports which repos, source units, and files would
+// be affected by changing defs.
+type MultiRepoImpact interface {
+	// Impact returns the refs to defs, in the trees of the defs' own
+	// repos and in the trees that depend on them (see
+	// MultiRepoDependents). If a def's CommitID is set, only that
+	// tree of the def's own repo is searched; otherwise all of its
+	// trees are. The defs' Repo, UnitType, Unit, and Path must be
+	// set.
+	Impact(defs []graph.DefKey) (*ImpactReport, error)
+}
+
+func (s *fsMultiRepoStore) Impact(defs []graph.DefKey) (*ImpactReport, error) {
+	// Find the trees that may contain refs to each def: the def's own
+	// tree(s) and the trees that depend on the def's repo. Searching
+	// each tree for all of the defs at once means that a tree's ref
+	// indexes are only loaded once.
+	treeDefs := map[Version][]graph.RefDefKey{}
+	var trees []Version
+	addTree := func(v Version, def graph.RefDefKey) {
+		if _, present := treeDefs[v]; !present {
+			trees = append(trees, v)
+		}
+		treeDefs[v] = append(treeDefs[v], def)
+	}
+	for _, def := range defs {
+		if def.Repo == "" || def.UnitType == "" || def.Unit == "" || def.Path == "" {
+			return nil, fmt.Errorf("impact of def %+v: Repo, UnitType, Unit, and Path must be set", def)
+		}
+		def.Repo = graph.NormalizeRepoURI(def.Repo)
+		refDef := graph.RefDefKey{DefRepo: def.Repo, DefUnitType: def.UnitType, DefUnit: def.Unit, DefPath: def.Path}
+
+		vf := []VersionFilter{ByRepos(def.Repo)}
+		if def.CommitID != "" {
+			vf = []VersionFilter{ByRepoCommitIDs(Version{Repo: def.Repo, CommitID: def.CommitID})}
+		}
+		versions, err := s.Versions(vf...)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range versions {
+			addTree(*v, refDef)
+		}
+
+		deps, err := s.Dependents(def.Repo)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range deps {
+			addTree(Version{Repo: d.Repo, CommitID: d.CommitID}, refDef)
+		}
+	}
+
+	report := &ImpactReport{}
+	for _, v := range trees {
+		ti := &TreeImpact{Repo: v.Repo, CommitID: v.CommitID}
+		units := map[string]*UnitImpact{}
+		for _, def := range treeDefs[v] {
+			refs, err := s.Refs(ByRepoCommitIDs(v), ByRefDef(def))
+			if isStoreNotExist(err) {
+				break // the tree was removed after its dependents were recorded
+			} else if err != nil {
+				return nil, err
+			}
+			for _, ref := range refs {
+				key := ref.UnitType + "\x00" + ref.Unit
+				ui := units[key]
+				if ui == nil {
+					ui = &UnitImpact{UnitType: ref.UnitType, Unit: ref.Unit, Files: map[string]int{}}
+					units[key] = ui
+					ti.Units = append(ti.Units, ui)
+				}
+				ui.Refs++
+				ui.Files[ref.File]++
+				ti.Refs++
+			}
+		}
+		if ti.Refs == 0 {
+			continue
+		}
+		sort.Sort(unitImpactsByID(ti.Units))
+		report.Trees = append(report.Trees, ti)
+		report.Refs += ti.Refs
+	}
+	sort.Sort(treeImpactsByVersion(report.Trees))
+	return report, nil
+}
+
+type treeImpactsByVersion []*TreeImpact
+
+func (v treeImpactsByVersion) Len() int { return len(v) }
+func (v treeImpactsByVersion) Less(i, j int) bool {
+	if v[i].Repo != v[j].Repo {
+		return v[i].Repo < v[j].Repo
+	}
+	return v[i].CommitID < v[j].CommitID
+}
+func (v treeImpactsByVersion) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+
+type unitImpactsByID []*UnitImpact
+
+func (v unitImpactsByID) Len() int { return len(v) }
+func (v unitImpactsByID) Less(i, j int) bool {
+	if v[i].UnitType != v[j].UnitType {
+		return v[i].UnitType < v[j].UnitType
+	}
+	return v[i].Unit < v[j].Unit
+}
+func (v unitImpactsByID) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+
+var _ MultiRepoImpact = (*fsMultiRepoStore)(nil)
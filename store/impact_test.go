@@ -0,0 +1,113 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestFSMultiRepoStore_Impact(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
+	u2 := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u2"}}
+	ref := func(defRepo, defPath, file string, start uint32) *graph.Ref {
+		return &graph.Ref{DefRepo: defRepo, DefUnitType: "t", DefUnit: "u", DefPath: defPath, File: file, Start: start, End: start + 1}
+	}
+	imports := []struct {
+		repo, commitID string
+		unit           *unit.SourceUnit
+		data           graph.Output
+	}{
+		{"d", "c", u, graph.Output{
+			Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}}, {DefKey: graph.DefKey{Path: "q"}}},
+			Refs: []*graph.Ref{ref("", "p", "d.go", 1), ref("", "q", "d.go", 2)},
+		}},
+		{"a", "c1", u, graph.Output{Refs: []*graph.Ref{ref("d", "p", "a.go", 1), ref("d", "p", "a.go", 2), ref("d", "q", "b.go", 1)}}},
+		{"a", "c1", u2, graph.Output{Refs: []*graph.Ref{ref("d", "p", "c.go", 1)}}},
+		{"a", "c2", u, graph.Output{Refs: []*graph.Ref{ref("d", "q", "a.go", 1)}}},
+		{"b", "c", u, graph.Output{Refs: []*graph.Ref{ref("e", "p", "b.go", 1)}}},
+	}
+
+	tests := []struct {
+		defs []graph.DefKey
+		want *ImpactReport
+	}{
+		{
+			defs: []graph.DefKey{{Repo: "d", UnitType: "t", Unit: "u", Path: "p"}},
+			want: &ImpactReport{Refs: 4, Trees: []*TreeImpact{
+				{Repo: "a", CommitID: "c1", Refs: 3, Units: []*UnitImpact{
+					{UnitType: "t", Unit: "u", Refs: 2, Files: map[string]int{"a.go": 2}},
+					{UnitType: "t", Unit: "u2", Refs: 1, Files: map[string]int{"c.go": 1}},
+				}},
+				{Repo: "d", CommitID: "c", Refs: 1, Units: []*UnitImpact{
+					{UnitType: "t", Unit: "u", Refs: 1, Files: map[string]int{"d.go": 1}},
+				}},
+			}},
+		},
+		{
+			defs: []graph.DefKey{{Repo: "d", UnitType: "t", Unit: "u", Path: "p"}, {Repo: "d", UnitType: "t", Unit: "u", Path: "q"}},
+			want: &ImpactReport{Refs: 7, Trees: []*TreeImpact{
+				{Repo: "a", CommitID: "c1", Refs: 4, Units: []*UnitImpact{
+					{UnitType: "t", Unit: "u", Refs: 3, Files: map[string]int{"a.go": 2, "b.go": 1}},
+					{UnitType: "t", Unit: "u2", Refs: 1, Files: map[string]int{"c.go": 1}},
+				}},
+				{Repo: "a", CommitID: "c2", Refs: 1, Units: []*UnitImpact{
+					{UnitType: "t", Unit: "u", Refs: 1, Files: map[string]int{"a.go": 1}},
+				}},
+				{Repo: "d", CommitID: "c", Refs: 2, Units: []*UnitImpact{
+					{UnitType: "t", Unit: "u", Refs: 2, Files: map[string]int{"d.go": 2}},
+				}},
+			}},
+		},
+		{
+			defs: []graph.DefKey{{Repo: "d", CommitID: "x", UnitType: "t", Unit: "u", Path: "q"}},
+			want: &ImpactReport{Refs: 2, Trees: []*TreeImpact{
+				{Repo: "a", CommitID: "c1", Refs: 1, Units: []*UnitImpact{
+					{UnitType: "t", Unit: "u", Refs: 1, Files: map[string]int{"b.go": 1}},
+				}},
+				{Repo: "a", CommitID: "c2", Refs: 1, Units: []*UnitImpact{
+					{UnitType: "t", Unit: "u", Refs: 1, Files: map[string]int{"a.go": 1}},
+				}},
+			}},
+		},
+		{
+			defs: []graph.DefKey{{Repo: "d", UnitType: "t", Unit: "u", Path: "x"}},
+			want: &ImpactReport{},
+		},
+	}
+
+	for _, indexed := range []bool{false, true} {
+		useIndexedStore = indexed
+		mrs := NewFSMultiRepoStore(newTestFS(), nil)
+		for _, imp := range imports {
+			if err := mrs.Import(imp.repo, imp.commitID, imp.unit, imp.data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, v := range []Version{{"d", "c"}, {"a", "c1"}, {"a", "c2"}, {"b", "c"}} {
+			if err := mrs.CreateVersion(v.Repo, v.CommitID); err != nil {
+				t.Fatal(err)
+			}
+			if err := mrs.Index(v.Repo, v.CommitID); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, test := range tests {
+			report, err := mrs.(MultiRepoImpact).Impact(test.defs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(report, test.want) {
+				t.Errorf("indexed=%v %+v: got %+v, want %+v", indexed, test.defs, report, test.want)
+			}
+		}
+
+		if _, err := mrs.(MultiRepoImpact).Impact([]graph.DefKey{{Repo: "d", Path: "p"}}); err == nil {
+			t.Errorf("indexed=%v: got no error for incomplete def key", indexed)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package store
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+// An ImportAllowRule allows imports into the repos that match Repo, at
+// the commits that match Commits.
+type ImportAllowRule struct {
+	// Repo is a repo URI, or a pattern (in path.Match syntax, e.g.,
+	// "github.com/myorg/*") that repo URIs must match. Repo URIs are
+	// normalized (using graph.NormalizeRepoURI) before they are
+	// matched.
+	Repo string
+
+	// Commits, if set, is a regexp that commit IDs must match in full
+	// (e.g., "[0-9a-f]{40}" to only allow full Git commit IDs). By
+	// default, all commits are allowed.
+	Commits string `json:",omitempty"`
+}
+
+// match reports whether the rule allows imports into repo at
+// commitID. A rule with an invalid pattern matches nothing.
+func (r ImportAllowRule) match(repo, commitID string) bool {
+	if ok, err := path.Match(graph.NormalizeRepoURI(r.Repo), repo); !ok || err != nil {
+		return false
+	}
+	if r.Commits == "" {
+		return true
+	}
+	re, err := regexp.Compile("^(?:" + r.Commits + ")$")
+	return err == nil && re.MatchString(commitID)
+}
+
+// An ImportAllowList restricts which repos and commits may be imported
+// into a multi-repo store (e.g., so that a shared import endpoint only
+// accepts data for the repos of the CI jobs that use it). An import is
+// allowed if any of the rules match it. Imports that are not allowed
+// fail with an *ErrImportNotAllowed error before any data is written.
+//
+// A nil ImportAllowList allows all imports, and an empty non-nil one
+// allows none.
+type ImportAllowList []ImportAllowRule
+
+// Validate returns an error if any of the rules' patterns are invalid.
+func (l ImportAllowList) Validate() error {
+	for _, r := range l {
+		if r.Repo == "" {
+			return fmt.Errorf("import allow rule %+v has no repo", r)
+		}
+		if _, err := path.Match(r.Repo, ""); err != nil {
+			return fmt.Errorf("import allow rule %+v has invalid repo pattern: %s", r, err)
+		}
+		if _, err := regexp.Compile(r.Commits); err != nil {
+			return fmt.Errorf("import allow rule %+v has invalid commits regexp: %s", r, err)
+		}
+	}
+	return nil
+}
+
+// Check returns an *ErrImportNotAllowed error if the allow list doesn't
+// allow imports into repo at commitID.
+func (l ImportAllowList) Check(repo, commitID string) error {
+	if l == nil {
+		return nil
+	}
+	repo = graph.NormalizeRepoURI(repo)
+	for _, r := range l {
+		if r.match(repo, commitID) {
+			return nil
+		}
+	}
+	return &ErrImportNotAllowed{Repo: repo, CommitID: commitID}
+}
+
+// ErrImportNotAllowed is returned when an import into a repo at a
+// commit is not allowed by a store's ImportAllowList.
+type ErrImportNotAllowed struct {
+	Repo     string
+	CommitID string
+}
+
+func (e *ErrImportNotAllowed) Error() string {
+	return fmt.Sprintf("import into repo %s at commit %s is not allowed by the store's import allow list", e.Repo, e.CommitID)
+}
+
+// IsImportNotAllowed reports whether err is an *ErrImportNotAllowed
+// error.
+func IsImportNotAllowed(err error) bool {
+	_, ok := err.(*ErrImportNotAllowed)
+	return ok
+}
+
+// MultiRepoImportAllower is implemented by multi-repo stores that
+// restrict imports with an ImportAllowList (see
+// FSMultiRepoStoreConf.ImportAllowList).
+type MultiRepoImportAllower interface {
+	// CheckImportAllowed returns an *ErrImportNotAllowed error if
+	// imports into repo at commitID are not allowed. It lets callers
+	// (such as import servers) reject an import before reading its
+	// data.
+	CheckImportAllowed(repo, commitID string) error
+}
+
+var _ MultiRepoImportAllower = (*fsMultiRepoStore)(nil)
+
+func (s *fsMultiRepoStore) CheckImportAllowed(repo, commitID string) error {
+	return s.ImportAllowList.Check(repo, commitID)
+}
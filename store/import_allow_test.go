@@ -0,0 +1,75 @@
+package store
+
+import (
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestImportAllowList(t *testing.T) {
+	l := ImportAllowList{
+		{Repo: "github.com/o/r1"},
+		{Repo: "github.com/p/*", Commits: "[0-9a-f]{40}"},
+	}
+	if err := l.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	const commit = "0123456789abcdef0123456789abcdef01234567"
+	tests := []struct {
+		repo, commitID string
+		allowed        bool
+	}{
+		{"github.com/o/r1", "c", true},
+		{"https://github.com/o/r1.git", "c", true},
+		{"github.com/o/r2", "c", false},
+		{"github.com/p/r", commit, true},
+		{"github.com/p/r", "c", false},
+		{"github.com/p/r", commit + "x", false},
+		{"github.com/p/r/sub", commit, false},
+	}
+	for _, test := range tests {
+		err := l.Check(test.repo, test.commitID)
+		if test.allowed && err != nil {
+			t.Errorf("%s@%s: got error %v, want allowed", test.repo, test.commitID, err)
+		} else if !test.allowed && !IsImportNotAllowed(err) {
+			t.Errorf("%s@%s: got error %v, want *ErrImportNotAllowed", test.repo, test.commitID, err)
+		}
+	}
+
+	if err := (ImportAllowList)(nil).Check("r", "c"); err != nil {
+		t.Errorf("nil allow list: got error %v, want nil", err)
+	}
+	if err := (ImportAllowList{}).Check("r", "c"); !IsImportNotAllowed(err) {
+		t.Errorf("empty allow list: got error %v, want *ErrImportNotAllowed", err)
+	}
+	for _, bad := range []ImportAllowList{{{Repo: ""}}, {{Repo: "a["}}, {{Repo: "a", Commits: "("}}} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("%+v: got nil Validate error, want error", bad)
+		}
+	}
+}
+
+func TestFSMultiRepoStore_ImportAllowList(t *testing.T) {
+	fs := newTestFS()
+	mrs := NewFSMultiRepoStore(fs, &FSMultiRepoStoreConf{ImportAllowList: ImportAllowList{{Repo: "r1"}}})
+
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
+	data := graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}}}}
+	if err := mrs.Import("r2", "c", u, data); !IsImportNotAllowed(err) {
+		t.Fatalf("Import: got error %v, want *ErrImportNotAllowed", err)
+	}
+	if err := mrs.CreateVersion("r2", "c"); !IsImportNotAllowed(err) {
+		t.Fatalf("CreateVersion: got error %v, want *ErrImportNotAllowed", err)
+	}
+	if _, err := fs.Stat("r2"); err == nil {
+		t.Error("rejected import created repo dir")
+	}
+
+	if err := mrs.Import("r1", "c", u, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := mrs.CreateVersion("r1", "c"); err != nil {
+		t.Fatal(err)
+	}
+}
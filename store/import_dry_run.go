@@ -0,0 +1,315 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"sync"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// An ImportAction describes what an import would do to a source
+// unit's data.
+type ImportAction string
+
+const (
+	// ImportWrite means that the unit is not in the tree and would be
+	// written.
+	ImportWrite ImportAction = "write"
+
+	// ImportUpdate means that the unit is in the tree but its data
+	// differs, so it would be overwritten.
+	ImportUpdate ImportAction = "update"
+
+	// ImportSkip means that the unit's data in the tree is identical
+	// to the data being imported, so importing it would not change
+	// the tree.
+	ImportSkip ImportAction = "skip"
+)
+
+// A UnitImportPlan describes what importing a source unit's data
+// would do, as determined by a dry run.
+type UnitImportPlan struct {
+	Unit   unit.ID2
+	Action ImportAction
+
+	// Digest is the hex-encoded SHA-256 digest of the unit's data (as
+	// it would be stored). Data that is identical except for the order
+	// of its defs and refs has the same digest.
+	Digest string
+
+	// Defs and Refs are the number of defs and refs in the unit's
+	// data, and Bytes is the total size of the unit's encoded data.
+	Defs, Refs int
+	Bytes      int64
+
+	// UnitIndexes and TreeIndexes are the names of the unit's indexes
+	// and the tree's indexes that would need to be rebuilt after the
+	// import. They are empty if the action is ImportSkip or the store
+	// is not indexed.
+	UnitIndexes, TreeIndexes []string
+}
+
+// A TreeImportDryRunner reports what importing data into a tree would
+// do, without writing anything.
+type TreeImportDryRunner interface {
+	// DryRunImport reports what Import(u, data) would do. Like
+	// Import, it fails if the data exceeds the store's import limits
+	// (see FSMultiRepoStoreConf.ImportLimits). It
+	// may modify data (in the same ways that Import does).
+	DryRunImport(u *unit.SourceUnit, data graph.Output) (*UnitImportPlan, error)
+}
+
+// A RepoImportDryRunner reports what importing data into a repo's
+// trees would do, without writing anything.
+type RepoImportDryRunner interface {
+	DryRunImport(commitID string, u *unit.SourceUnit, data graph.Output) (*UnitImportPlan, error)
+}
+
+// A MultiRepoImportDryRunner reports what importing data into trees in
+// multiple repos would do, without writing anything.
+type MultiRepoImportDryRunner interface {
+	DryRunImport(repo, commitID string, u *unit.SourceUnit, data graph.Output) (*UnitImportPlan, error)
+}
+
+func (s *fsTreeStore) DryRunImport(u *unit.SourceUnit, data graph.Output) (*UnitImportPlan, error) {
+	if err := s.importLimits.Check(u.Type+" "+u.Name, &data); err != nil {
+		return nil, err
+	}
+	cleanForImport(&data, "", u.Type, u.Name)
+	digest, size, err := unitDataDigest(s.codec(), u, data.Defs, data.Refs)
+	if err != nil {
+		return nil, err
+	}
+	plan := &UnitImportPlan{
+		Unit:   u.ID2(),
+		Digest: digest,
+		Defs:   len(data.Defs),
+		Refs:   len(data.Refs),
+		Bytes:  size,
+	}
+
+	existing, err := s.openUnitFile(existingUnitFilename(s.fs, u.Type, u.Name))
+	if err == errUnitNoInit {
+		plan.Action = ImportWrite
+		return plan, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Read the stored data directly (instead of with openUnitStore) so
+	// that the dry run never reads or builds indexes.
+	dir := s.unitDir(u.ID2())
+	us := &fsUnitStore{fs: rwvfs.Sub(s.fs, dir), label: u.ID2().String(), fsStoreSettings: s.fsStoreSettings}
+	defs, err := us.Defs()
+	if err != nil {
+		return nil, err
+	}
+	refs, err := us.Refs()
+	if err != nil {
+		return nil, err
+	}
+	existingDigest, _, err := unitDataDigest(s.codec(), existing, defs, refs)
+	if err != nil {
+		return nil, err
+	}
+	if existingDigest == digest {
+		plan.Action = ImportSkip
+	} else {
+		plan.Action = ImportUpdate
+	}
+	return plan, nil
+}
+
+func (s *indexedTreeStore) DryRunImport(u *unit.SourceUnit, data graph.Output) (*UnitImportPlan, error) {
+	plan, err := s.fsTreeStore.DryRunImport(u, data)
+	if err != nil {
+		return nil, err
+	}
+	if plan.Action != ImportSkip {
+		plan.UnitIndexes = indexNames(newIndexedUnitStore(nil, "", s.fsStoreSettings).(*indexedUnitStore).indexes)
+		plan.TreeIndexes = indexNames(s.indexes)
+	}
+	return plan, nil
+}
+
+// indexNames returns the sorted names of the indexes.
+func indexNames(xs map[string]Index) []string {
+	names := make([]string, 0, len(xs))
+	for name := range xs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// unitDataDigest returns the digest (see UnitImportPlan.Digest) and
+// encoded size of a source unit's data.
+func unitDataDigest(c codec, u *unit.SourceUnit, defs []*graph.Def, refs []*graph.Ref) (string, int64, error) {
+	var size int64
+	encode := func(v interface{}) ([]byte, error) {
+		var buf bytes.Buffer
+		n, err := c.NewEncoder(&buf).Encode(v)
+		size += int64(n)
+		return buf.Bytes(), err
+	}
+
+	h := sha256.New()
+	b, err := encode(u)
+	if err != nil {
+		return "", 0, err
+	}
+	h.Write(b)
+
+	// Hash the encoded defs and refs in sorted order, because the
+	// stores may reorder them when they are written.
+	records := make([][]byte, 0, len(defs))
+	for _, def := range defs {
+		b, err := encode(def)
+		if err != nil {
+			return "", 0, err
+		}
+		records = append(records, b)
+	}
+	sort.Sort(byteSlices(records))
+	h.Write([]byte("\x00defs\x00"))
+	for _, b := range records {
+		h.Write(b)
+	}
+
+	records = make([][]byte, 0, len(refs))
+	for _, ref := range refs {
+		b, err := encode(ref)
+		if err != nil {
+			return "", 0, err
+		}
+		records = append(records, b)
+	}
+	sort.Sort(byteSlices(records))
+	h.Write([]byte("\x00refs\x00"))
+	for _, b := range records {
+		h.Write(b)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+type byteSlices [][]byte
+
+func (v byteSlices) Len() int           { return len(v) }
+func (v byteSlices) Less(i, j int) bool { return bytes.Compare(v[i], v[j]) < 0 }
+func (v byteSlices) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+
+func (s *fsRepoStore) DryRunImport(commitID string, u *unit.SourceUnit, data graph.Output) (*UnitImportPlan, error) {
+	cleanForImport(&data, "", u.Type, u.Name)
+	return s.newTreeStore(commitID).(TreeImportDryRunner).DryRunImport(u, data)
+}
+
+func (s *fsMultiRepoStore) DryRunImport(repo, commitID string, u *unit.SourceUnit, data graph.Output) (*UnitImportPlan, error) {
+	repo = s.redirectRepo(graph.NormalizeRepoURI(repo))
+	if err := s.CheckImportAllowed(repo, commitID); err != nil {
+		return nil, err
+	}
+	if err := checkImportDefKeys(u, &data); err != nil {
+		return nil, err
+	}
+	for _, ref := range data.Refs {
+		ref.DefRepo = graph.NormalizeRepoURI(ref.DefRepo)
+	}
+	if err := s.redirectRefDefRepos(data.Refs); err != nil {
+		return nil, err
+	}
+	cleanForImport(&data, repo, u.Type, u.Name)
+	return s.openRepoStore(repo).(RepoImportDryRunner).DryRunImport(commitID, u, data)
+}
+
+var (
+	_ TreeImportDryRunner      = (*fsTreeStore)(nil)
+	_ TreeImportDryRunner      = (*indexedTreeStore)(nil)
+	_ RepoImportDryRunner      = (*fsRepoStore)(nil)
+	_ MultiRepoImportDryRunner = (*fsMultiRepoStore)(nil)
+)
+
+// An ImportDryRun summarizes the plans of the units in a dry-run
+// import. It is safe for concurrent use.
+type ImportDryRun struct {
+	mu    sync.Mutex
+	plans []*UnitImportPlan
+}
+
+// Add adds a unit's plan to the summary.
+func (r *ImportDryRun) Add(plan *UnitImportPlan) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.plans = append(r.plans, plan)
+}
+
+// Plans returns the plans that were added, sorted by unit name and
+// then type.
+func (r *ImportDryRun) Plans() []*UnitImportPlan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	plans := make([]*UnitImportPlan, len(r.plans))
+	copy(plans, r.plans)
+	sort.Sort(unitImportPlansByUnit(plans))
+	return plans
+}
+
+// Count returns the number of units with the given action.
+func (r *ImportDryRun) Count(action ImportAction) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int
+	for _, p := range r.plans {
+		if p.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+// Bytes returns the total size of the data that would be written
+// (i.e., of the units that would not be skipped).
+func (r *ImportDryRun) Bytes() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int64
+	for _, p := range r.plans {
+		if p.Action != ImportSkip {
+			n += p.Bytes
+		}
+	}
+	return n
+}
+
+// TreeIndexes returns the sorted names of the tree indexes that would
+// need to be rebuilt.
+func (r *ImportDryRun) TreeIndexes() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seen := map[string]struct{}{}
+	var names []string
+	for _, p := range r.plans {
+		for _, name := range p.TreeIndexes {
+			if _, present := seen[name]; !present {
+				seen[name] = struct{}{}
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+type unitImportPlansByUnit []*UnitImportPlan
+
+func (v unitImportPlansByUnit) Len() int { return len(v) }
+func (v unitImportPlansByUnit) Less(i, j int) bool {
+	a, b := v[i].Unit, v[j].Unit
+	return a.Name < b.Name || (a.Name == b.Name && a.Type < b.Type)
+}
+func (v unitImportPlansByUnit) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
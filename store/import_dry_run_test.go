@@ -0,0 +1,89 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestFSMultiRepoStore_DryRunImport(t *testing.T) {
+	for _, indexed := range []bool{false, true} {
+		useIndexedStore = indexed
+		mrs := NewFSMultiRepoStore(newTestFS(), nil)
+		makeData := func(defName string) graph.Output {
+			return graph.Output{
+				Defs: []*graph.Def{
+					{DefKey: graph.DefKey{Path: "p1"}, Name: defName, File: "f"},
+					{DefKey: graph.DefKey{Path: "p2"}, Name: "m", File: "f"},
+				},
+				Refs: []*graph.Ref{
+					{DefRepo: "r", DefUnitType: "t", DefUnit: "u1", DefPath: "p1", File: "f", Start: 3, End: 4},
+					{DefPath: "p2", File: "f", Start: 1, End: 2},
+				},
+			}
+		}
+		u1 := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u1"}, Info: unit.Info{Files: []string{"f"}}}
+		u2 := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u2"}, Info: unit.Info{Files: []string{"f"}}}
+		if err := mrs.Import("r", "c", u1, makeData("n")); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.Index("r", "c"); err != nil {
+			t.Fatal(err)
+		}
+		digest, err := mrs.(MultiRepoContentDigester).ContentDigest("r", "c")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dr := mrs.(MultiRepoImportDryRunner)
+		var report ImportDryRun
+		tests := []struct {
+			u    *unit.SourceUnit
+			data graph.Output
+			want ImportAction
+		}{
+			{u1, makeData("n"), ImportSkip},
+			{u1, makeData("n2"), ImportUpdate},
+			{u2, makeData("n"), ImportWrite},
+		}
+		for _, test := range tests {
+			data := test.data
+			// Reverse the refs to check that ordering doesn't matter.
+			data.Refs[0], data.Refs[1] = data.Refs[1], data.Refs[0]
+			plan, err := dr.DryRunImport("r", "c", test.u, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if plan.Action != test.want {
+				t.Errorf("indexed=%v: %s: got action %q, want %q", indexed, test.u.Name, plan.Action, test.want)
+			}
+			if plan.Defs != 2 || plan.Refs != 2 || plan.Bytes <= 0 || plan.Digest == "" {
+				t.Errorf("indexed=%v: %s: got plan %+v", indexed, test.u.Name, plan)
+			}
+			if got := len(plan.TreeIndexes) > 0 && len(plan.UnitIndexes) > 0; got != (indexed && test.want != ImportSkip) {
+				t.Errorf("indexed=%v: %s: got index rebuilds %v %v", indexed, test.u.Name, plan.UnitIndexes, plan.TreeIndexes)
+			}
+			report.Add(plan)
+		}
+
+		if got, want := []int{report.Count(ImportWrite), report.Count(ImportUpdate), report.Count(ImportSkip)}, []int{1, 1, 1}; !reflect.DeepEqual(got, want) {
+			t.Errorf("indexed=%v: got action counts %v, want %v", indexed, got, want)
+		}
+		plans := report.Plans()
+		if plans[0].Unit.Name != "u1" || plans[2].Unit.Name != "u2" {
+			t.Errorf("indexed=%v: plans are not sorted by unit", indexed)
+		}
+		if indexed && len(report.TreeIndexes()) == 0 {
+			t.Errorf("indexed=%v: got no tree index rebuilds", indexed)
+		}
+
+		// The dry runs must not have changed the tree.
+		if digest2, err := mrs.(MultiRepoContentDigester).ContentDigest("r", "c"); err != nil {
+			t.Fatal(err)
+		} else if digest2 != digest {
+			t.Errorf("indexed=%v: dry run changed the tree's content digest", indexed)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+// OutputSize is the estimated size of a source unit's graph data when
+// it is imported into a store.
+type OutputSize struct {
+	Defs int // number of defs
+	Refs int // number of refs
+
+	// Bytes is the approximate number of bytes that the unit's def
+	// and ref data files occupy (not including indexes). Docs are
+	// counted as part of their defs.
+	Bytes int64
+}
+
+// EstimateOutputSize estimates the size of data when it is imported.
+// The estimate is computed without serializing data, so it is cheap
+// enough to call before every import. It is exact for the
+// ProtobufCodec (ignoring docs for defs that don't exist) and
+// approximate for other codecs.
+func EstimateOutputSize(data *graph.Output) OutputSize {
+	sz := OutputSize{Defs: len(data.Defs), Refs: len(data.Refs)}
+	for _, def := range data.Defs {
+		sz.Bytes += delimitedSize(def.Size())
+	}
+	for _, ref := range data.Refs {
+		sz.Bytes += delimitedSize(ref.Size())
+	}
+	for _, doc := range data.Docs {
+		sz.Bytes += int64(doc.Size())
+	}
+	return sz
+}
+
+// delimitedSize returns the size of a length-delimited record with n
+// bytes of data.
+func delimitedSize(n int) int64 {
+	var buf [binary.MaxVarintLen64]byte
+	return int64(binary.PutUvarint(buf[:], uint64(n)) + n)
+}
+
+// ImportLimits are guardrails on the size of a single source unit's
+// graph data. Imports that exceed them fail before any data is
+// written, instead of exhausting disk or memory partway through (see
+// FSMultiRepoStoreConf.ImportLimits). Graph data read with DecodeOutput
+// is checked as it is decoded. Zero-valued limits are not enforced.
+type ImportLimits struct {
+	MaxDefs  int   `json:",omitempty"` // max number of defs per unit
+	MaxRefs  int   `json:",omitempty"` // max number of refs per unit
+	MaxBytes int64 `json:",omitempty"` // max estimated bytes per unit (see EstimateOutputSize)
+}
+
+// ImportTooLargeError is returned when a source unit's graph data exceeds
+// an ImportLimits limit.
+type ImportTooLargeError struct {
+	Unit  string // the source unit's type and name (if known)
+	Limit string // the name of the limit (e.g., "MaxRefs")
+	Size  int64  // the size of the data
+	Max   int64  // the value of the limit
+}
+
+func (e *ImportTooLargeError) Error() string {
+	unit := "source unit"
+	if e.Unit != "" {
+		unit += " " + e.Unit
+	}
+	return fmt.Sprintf("import of %s is too large: %d exceeds %s (%d)", unit, e.Size, e.Limit, e.Max)
+}
+
+// IsImportTooLarge reports whether err is an *ImportTooLargeError.
+func IsImportTooLarge(err error) bool {
+	_, ok := err.(*ImportTooLargeError)
+	return ok
+}
+
+// Check returns an *ImportTooLargeError if data (for the named
+// source unit) exceeds any of the limits. The cheaper count limits are
+// checked before the size is estimated.
+func (l ImportLimits) Check(unit string, data *graph.Output) error {
+	if l.MaxDefs > 0 && len(data.Defs) > l.MaxDefs {
+		return &ImportTooLargeError{Unit: unit, Limit: "MaxDefs", Size: int64(len(data.Defs)), Max: int64(l.MaxDefs)}
+	}
+	if l.MaxRefs > 0 && len(data.Refs) > l.MaxRefs {
+		return &ImportTooLargeError{Unit: unit, Limit: "MaxRefs", Size: int64(len(data.Refs)), Max: int64(l.MaxRefs)}
+	}
+	if l.MaxBytes > 0 {
+		if sz := EstimateOutputSize(data); sz.Bytes > l.MaxBytes {
+			return &ImportTooLargeError{Unit: unit, Limit: "MaxBytes", Size: sz.Bytes, Max: l.MaxBytes}
+		}
+	}
+	return nil
+}
+
+// DecodeOutput decodes the JSON-encoded graph data of the named source
+// unit from r. It checks the limits as it decodes each def, ref, and
+// doc, and returns an *ImportTooLargeError as soon as the data exceeds
+// one, so that the data of a unit that is too large is never decoded
+// in full.
+func (l ImportLimits) DecodeOutput(r io.Reader, unit string) (*graph.Output, error) {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil {
+		return nil, err
+	} else if tok != json.Delim('{') {
+		return nil, fmt.Errorf("graph data of source unit %s is not a JSON object", unit)
+	}
+
+	var data graph.Output
+	var size int64
+	checkSize := func(n int64) error {
+		if size += n; l.MaxBytes > 0 && size > l.MaxBytes {
+			return &ImportTooLargeError{Unit: unit, Limit: "MaxBytes", Size: size, Max: l.MaxBytes}
+		}
+		return nil
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := tok.(string)
+		switch {
+		case strings.EqualFold(key, "Defs"):
+			err = decodeJSONArray(dec, func() error {
+				var def graph.Def
+				if err := dec.Decode(&def); err != nil {
+					return err
+				}
+				if data.Defs = append(data.Defs, &def); l.MaxDefs > 0 && len(data.Defs) > l.MaxDefs {
+					return &ImportTooLargeError{Unit: unit, Limit: "MaxDefs", Size: int64(len(data.Defs)), Max: int64(l.MaxDefs)}
+				}
+				return checkSize(delimitedSize(def.Size()))
+			})
+		case strings.EqualFold(key, "Refs"):
+			err = decodeJSONArray(dec, func() error {
+				var ref graph.Ref
+				if err := dec.Decode(&ref); err != nil {
+					return err
+				}
+				if data.Refs = append(data.Refs, &ref); l.MaxRefs > 0 && len(data.Refs) > l.MaxRefs {
+					return &ImportTooLargeError{Unit: unit, Limit: "MaxRefs", Size: int64(len(data.Refs)), Max: int64(l.MaxRefs)}
+				}
+				return checkSize(delimitedSize(ref.Size()))
+			})
+		case strings.EqualFold(key, "Docs"):
+			err = decodeJSONArray(dec, func() error {
+				var doc graph.Doc
+				if err := dec.Decode(&doc); err != nil {
+					return err
+				}
+				data.Docs = append(data.Docs, &doc)
+				return checkSize(int64(doc.Size()))
+			})
+		case strings.EqualFold(key, "Anns"):
+			err = dec.Decode(&data.Anns)
+		default:
+			var v json.RawMessage
+			err = dec.Decode(&v)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, err := dec.Token(); err != nil { // the closing "}"
+		return nil, err
+	}
+	return &data, nil
+}
+
+// decodeJSONArray calls decodeElem to decode each element of the JSON
+// array (or null) that dec reads next.
+func decodeJSONArray(dec *json.Decoder, decodeElem func() error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if tok != json.Delim('[') {
+		return fmt.Errorf("got JSON %v, want array", tok)
+	}
+	for dec.More() {
+		if err := decodeElem(); err != nil {
+			return err
+		}
+	}
+	_, err = dec.Token() // the closing "]"
+	return err
+}
@@ -0,0 +1,138 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func testImportLimitsData() graph.Output {
+	return graph.Output{
+		Defs: []*graph.Def{
+			{DefKey: graph.DefKey{Path: "p1"}, Name: "n1", File: "f"},
+			{DefKey: graph.DefKey{Path: "p2"}, Name: "n2", File: "f"},
+		},
+		Refs: []*graph.Ref{
+			{DefPath: "p1", File: "f", Start: 1, End: 2},
+			{DefPath: "p2", File: "f", Start: 3, End: 4},
+			{DefPath: "p2", File: "f", Start: 5, End: 6},
+		},
+	}
+}
+
+func TestEstimateOutputSize(t *testing.T) {
+	data := testImportLimitsData()
+	sz := EstimateOutputSize(&data)
+	if sz.Defs != 2 || sz.Refs != 3 {
+		t.Errorf("got %d defs and %d refs, want 2 and 3", sz.Defs, sz.Refs)
+	}
+
+	// The estimate is exact for the ProtobufCodec.
+	origCodec := Codec
+	Codec = ProtobufCodec{}
+	defer func() { Codec = origCodec }()
+	fs := newTestFS()
+	us := &fsUnitStore{fs: fs}
+	if err := us.Import(data); err != nil {
+		t.Fatal(err)
+	}
+	var written int64
+	for _, name := range []string{unitDefsFilename, unitRefsFilename} {
+		fi, err := fs.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		written += fi.Size()
+	}
+	if sz.Bytes != written {
+		t.Errorf("got estimated size %d, want %d (written size)", sz.Bytes, written)
+	}
+}
+
+func TestImportLimits_Check(t *testing.T) {
+	data := testImportLimitsData()
+	sz := EstimateOutputSize(&data)
+	tests := []struct {
+		limits    ImportLimits
+		wantLimit string
+	}{
+		{ImportLimits{}, ""},
+		{ImportLimits{MaxDefs: 2, MaxRefs: 3, MaxBytes: sz.Bytes}, ""},
+		{ImportLimits{MaxDefs: 1}, "MaxDefs"},
+		{ImportLimits{MaxRefs: 2}, "MaxRefs"},
+		{ImportLimits{MaxBytes: sz.Bytes - 1}, "MaxBytes"},
+	}
+	for _, test := range tests {
+		err := test.limits.Check("t u", &data)
+		if test.wantLimit == "" {
+			if err != nil {
+				t.Errorf("%+v: got error %s, want nil", test.limits, err)
+			}
+			continue
+		}
+		if e, ok := err.(*ImportTooLargeError); !ok || e.Limit != test.wantLimit {
+			t.Errorf("%+v: got error %v, want ImportTooLargeError for %s", test.limits, err, test.wantLimit)
+		}
+	}
+}
+
+func TestFSTreeStore_Import_limits(t *testing.T) {
+	fs := newTestFS()
+	ts := newFSTreeStore(fs, fsStoreSettings{importLimits: ImportLimits{MaxRefs: 1}})
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
+	if err := ts.Import(u, testImportLimitsData()); !IsImportTooLarge(err) {
+		t.Fatalf("got error %v, want ImportTooLargeError", err)
+	}
+	if _, err := fs.Stat(ts.unitFilename(u.Type, u.Name)); !os.IsNotExist(err) {
+		t.Errorf("got Stat error %v for unit file, want not-exist (no data should be written)", err)
+	}
+}
+
+func TestFSMultiRepoStore_ImportLimits(t *testing.T) {
+	mrs := NewFSMultiRepoStore(newTestFS(), &FSMultiRepoStoreConf{ImportLimits: ImportLimits{MaxDefs: 1}})
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
+	if err := mrs.Import("r", "c", u, testImportLimitsData()); !IsImportTooLarge(err) {
+		t.Errorf("got error %v, want ImportTooLargeError", err)
+	}
+}
+
+func TestImportLimits_DecodeOutput(t *testing.T) {
+	data := testImportLimitsData()
+	b, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ImportLimits{}.DecodeOutput(bytes.NewReader(b), "t u")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*got, data) {
+		t.Errorf("got %+v, want %+v", got, data)
+	}
+
+	for _, test := range []struct {
+		limits    ImportLimits
+		wantLimit string
+	}{
+		{ImportLimits{MaxDefs: 1}, "MaxDefs"},
+		{ImportLimits{MaxRefs: 2}, "MaxRefs"},
+		{ImportLimits{MaxBytes: EstimateOutputSize(&data).Bytes - 1}, "MaxBytes"},
+	} {
+		if _, err := test.limits.DecodeOutput(bytes.NewReader(b), "t u"); !IsImportTooLarge(err) || err.(*ImportTooLargeError).Limit != test.wantLimit {
+			t.Errorf("%+v: got error %v, want ImportTooLargeError for %s", test.limits, err, test.wantLimit)
+		}
+	}
+
+	// The limits are checked while decoding, before the rest of the
+	// data is read.
+	truncated := `{"Refs":[{"DefPath":"a"},{"DefPath":"b"},{"DefPath":"c"},` + strings.Repeat(" ", 1<<16) + "!"
+	if _, err := (ImportLimits{MaxRefs: 2}).DecodeOutput(strings.NewReader(truncated), "t u"); !IsImportTooLarge(err) {
+		t.Errorf("got error %v, want ImportTooLargeError before the invalid JSON is read", err)
+	}
+}
@@ -0,0 +1,147 @@
+package store
+
+import (
+	"fmt"
+	"os"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// A MultiRepoUnitImporter can replace a single source unit's data in
+// an existing tree (see RepoImporter.ImportUnit).
+type MultiRepoUnitImporter interface {
+	ImportUnit(repo, commitID string, u *unit.SourceUnit, data graph.Output) error
+}
+
+// errUnitNotInTree returns the error for an ImportUnit call whose unit
+// is not in the tree.
+func errUnitNotInTree(commitID string, u unit.ID2) error {
+	return fmt.Errorf("source unit %s %s is not in the tree at commit %s (use Import to add source units)", u.Type, u.Name, commitID)
+}
+
+func (s *fsMultiRepoStore) ImportUnit(repo, commitID string, u *unit.SourceUnit, data graph.Output) error {
+	if u == nil {
+		return fmt.Errorf("import unit: source unit must be set")
+	}
+	defer s.wrote()
+	repo = s.redirectRepo(graph.NormalizeRepoURI(repo))
+	if err := s.CheckImportAllowed(repo, commitID); err != nil {
+		return err
+	}
+	if err := checkImportDefKeys(u, &data); err != nil {
+		return err
+	}
+	for _, ref := range data.Refs {
+		ref.DefRepo = graph.NormalizeRepoURI(ref.DefRepo)
+	}
+	if err := s.redirectRefDefRepos(data.Refs); err != nil {
+		return err
+	}
+	cleanForImport(&data, repo, u.Type, u.Name)
+	rs, ok := s.openRepoStore(repo).(RepoImporter)
+	if !ok {
+		return fmt.Errorf("repo %s not found", repo)
+	}
+	if err := s.invalidateFileNamesIndex(); err != nil {
+		return err
+	}
+	size := EstimateOutputSize(&data).Bytes
+	if err := s.reserveUsage(repo, commitID, size); err != nil {
+		return err
+	}
+	prevDeps, err := s.externalRefsByRepo(repo, commitID, u.ID2())
+	if err != nil {
+		s.reserveUsage(repo, commitID, -size)
+		return err
+	}
+	if err := rs.ImportUnit(commitID, u, data); err != nil {
+		s.reserveUsage(repo, commitID, -size)
+		return err
+	}
+	if s.ContentAddressed {
+		if err := s.addUnitDataToCAS(repo, commitID, u.ID2()); err != nil {
+			return err
+		}
+	}
+	if s.ShareUnitData {
+		if err := s.shareUnitData(repo, commitID, u.ID2()); err != nil {
+			return err
+		}
+	}
+	if err := s.addUnitTypeHint(repo, commitID, u.Type); err != nil {
+		return err
+	}
+	deps, err := s.externalRefsByRepo(repo, commitID, u.ID2())
+	if err != nil {
+		return err
+	}
+	if err := s.updateDependents(repo, commitID, u.ID2(), prevDeps, deps); err != nil {
+		return err
+	}
+	// The tree's version already exists, so finalize it again.
+	if _, err := s.WriteTreeManifest(repo, commitID); err != nil {
+		return err
+	}
+	// Replace the reservation with the tree's actual usage (which no
+	// longer includes the unit's previous data).
+	return s.UpdateUsage(repo, commitID)
+}
+
+func (s *fsRepoStore) ImportUnit(commitID string, u *unit.SourceUnit, data graph.Output) error {
+	if u == nil {
+		return fmt.Errorf("import unit: source unit must be set")
+	}
+	ts := s.newTreeStore(commitID)
+	units, err := ts.Units(ByUnits(u.ID2()))
+	if err != nil && !isStoreNotExist(err) {
+		return err
+	}
+	if len(units) == 0 {
+		return errUnitNotInTree(commitID, u.ID2())
+	}
+
+	cleanForImport(&data, "", u.Type, u.Name)
+	if err := ts.Import(u, data); err != nil {
+		return err
+	}
+
+	// The unit's own indexes were rebuilt by Import. Rebuild the tree
+	// indexes that were built for the tree (from the per-unit indexes,
+	// which are only read, not rebuilt, for the other units).
+	xs, ok := ts.(*indexedTreeStore)
+	if !ok {
+		return nil
+	}
+	built := map[string]Index{}
+	for name, x := range xs.Indexes() {
+		if _, err := xs.statIndex(name); err == nil {
+			built[name] = x
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if len(built) == 0 {
+		return nil
+	}
+	return xs.buildIndexes(built, nil, nil, nil)
+}
+
+func (s *memoryRepoStore) ImportUnit(commitID string, u *unit.SourceUnit, data graph.Output) error {
+	if u == nil {
+		return fmt.Errorf("import unit: source unit must be set")
+	}
+	ts, present := s.trees[commitID]
+	if !present || ts.data[u.ID2()] == nil {
+		return errUnitNotInTree(commitID, u.ID2())
+	}
+	for i, u2 := range ts.units {
+		if u2.ID2() == u.ID2() {
+			ts.units = append(ts.units[:i], ts.units[i+1:]...)
+			break
+		}
+	}
+	return s.Import(commitID, u, data)
+}
+
+var _ MultiRepoUnitImporter = (*fsMultiRepoStore)(nil)
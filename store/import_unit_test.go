@@ -0,0 +1,87 @@
+package store
+
+import (
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestFSMultiRepoStore_ImportUnit(t *testing.T) {
+	mrs := NewFSMultiRepoStore(newTestFS(), nil)
+	testSyncImport(t, mrs, "r", "c", "u1", "u2")
+	if err := mrs.(MultiRepoIndexer).Index("r", "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	u1 := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u1"}, Info: unit.Info{Files: []string{"g"}}}
+	data := graph.Output{
+		Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "q"}, Name: "m", File: "g"}},
+		Refs: []*graph.Ref{{DefPath: "q", File: "g", Start: 1, End: 2}},
+	}
+	if err := mrs.(MultiRepoUnitImporter).ImportUnit("r", "c", u1, data); err != nil {
+		t.Fatal(err)
+	}
+
+	units, err := mrs.Units(ByRepoCommitIDs(Version{Repo: "r", CommitID: "c"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(units) != 2 {
+		t.Errorf("got %d units, want 2", len(units))
+	}
+	defs, err := mrs.Defs(ByRepoCommitIDs(Version{Repo: "r", CommitID: "c"}), ByUnits(u1.ID2()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 1 || defs[0].Path != "q" {
+		t.Errorf("got u1 defs %+v, want [q]", defs)
+	}
+	defs, err = mrs.Defs(ByRepoCommitIDs(Version{Repo: "r", CommitID: "c"}), ByUnits(unit.ID2{Type: "t", Name: "u2"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 1 || defs[0].Path != "p" {
+		t.Errorf("got u2 defs %+v, want [p] (unchanged)", defs)
+	}
+
+	// The tree's file index includes the unit's new file.
+	fileUnits, err := mrs.Units(ByRepoCommitIDs(Version{Repo: "r", CommitID: "c"}), ByFiles(false, "g"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fileUnits) != 1 || fileUnits[0].Name != "u1" {
+		t.Errorf("got units for file g %+v, want [u1]", fileUnits)
+	}
+
+	// Units that aren't in the tree can't be imported with ImportUnit.
+	u3 := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u3"}}
+	if err := mrs.(MultiRepoUnitImporter).ImportUnit("r", "c", u3, graph.Output{}); err == nil {
+		t.Error("u3: got nil error")
+	}
+}
+
+func TestMemoryRepoStore_ImportUnit(t *testing.T) {
+	rs := newMemoryRepoStore()
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
+	if err := rs.Import("c", u, graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.ImportUnit("c", u, graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "q"}}}}); err != nil {
+		t.Fatal(err)
+	}
+	units, err := rs.trees["c"].Units()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(units) != 1 {
+		t.Errorf("got %d units, want 1", len(units))
+	}
+	defs, err := rs.trees["c"].Defs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 1 || defs[0].Path != "q" {
+		t.Errorf("got defs %+v, want [q]", defs)
+	}
+}
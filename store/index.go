@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 
+	"sourcegraph.com/sourcegraph/rwvfs"
 	"sourcegraph.com/sourcegraph/srclib/graph"
 	"sourcegraph.com/sourcegraph/srclib/unit"
 )
@@ -47,6 +48,17 @@ type persistedIndex interface {
 	Read(io.Reader) error
 }
 
+// A rangeReadIndex is a persisted index whose file is written
+// uncompressed so that it can be queried directly using range reads,
+// instead of being read into memory in full before use.
+type rangeReadIndex interface {
+	persistedIndex
+
+	// open makes the index ready to be queried by reading from the
+	// named file in fs as needed.
+	open(fs rwvfs.FileSystem, filename string) error
+}
+
 // The rest of this file contains helpers used by many index
 // implementations.
 
@@ -221,13 +233,19 @@ type unitIndexBuilder interface {
 }
 
 type unitRefIndexBuilder interface {
-	Build(map[unit.ID2]*defRefsIndex) error
+	Build(map[unit.ID2][]*defRefsIndex) error
 }
 
 type defQueryTreeIndexBuilder interface {
 	Build(map[unit.ID2]*defQueryIndex) error
 }
 
+type defNameTreeIndexBuilder interface {
+	// Build constructs the index in memory from the defs (and their
+	// byte offsets) of each unit, which it reads using readDefs.
+	Build(units []*unit.SourceUnit, readDefs func(unit.ID2) ([]*graph.Def, byteOffsets, error)) error
+}
+
 // unitIndexOnlyFilter wraps a non-UnitFilter that can be used by an
 // IndexedUnitStore to scope the list of source units. Currently there
 // is only a RefFilter that does this, so we simplify it by using that
@@ -2,6 +2,9 @@ package store
 
 import (
 	"container/list"
+	"log"
+	"os"
+	"strconv"
 	"sync"
 )
 
@@ -23,14 +26,37 @@ type indexCacheKey struct {
 type indexCacheElement struct {
 	key   indexCacheKey
 	index Index
+	size  int64 // approximate memory used by index (see memSizer)
+}
+
+// A memSizer is an index that can report the approximate amount of
+// memory (in bytes) that it uses. Indexes that don't implement
+// memSizer are assumed to be small and don't count toward the index
+// cache's memory budget.
+type memSizer interface {
+	memSize() int64
+}
+
+func indexMemSize(x Index) int64 {
+	if x, ok := x.(memSizer); ok {
+		return x.memSize()
+	}
+	return 0
 }
 
 // indexCache stores indexes for use across stores. This is to prevent the
 // cost of deserializing the index from the underlying VFS store
+//
+// If maxBytes is set, the least recently used indexes are evicted
+// when the total size of the cached indexes exceeds it (and maxLen is
+// ignored). Otherwise, they are evicted when there are more than
+// maxLen cached indexes.
 type indexCache struct {
-	indexes map[indexCacheKey]*list.Element
-	lru     *list.List
-	maxLen  int
+	indexes  map[indexCacheKey]*list.Element
+	lru      *list.List
+	maxLen   int
+	maxBytes int64
+	bytes    int64 // total size of cached indexes
 	sync.RWMutex
 }
 
@@ -40,6 +66,50 @@ var defaultIndexCache *indexCache = &indexCache{
 	maxLen:  15,
 }
 
+var indexMemoryBudgetFromEnv sync.Once
+
+// loadIndexMemoryBudget sets the index memory budget from the
+// INDEX_MEMORY_BUDGET environment variable (if it is set) the first
+// time it is called. An invalid value is logged and ignored.
+func loadIndexMemoryBudget() {
+	indexMemoryBudgetFromEnv.Do(func() {
+		v := os.Getenv("INDEX_MEMORY_BUDGET")
+		if v == "" {
+			return
+		}
+		budget, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || budget < 0 {
+			log.Printf("Warning: ignoring invalid INDEX_MEMORY_BUDGET %q (must be a number of bytes).", v)
+			return
+		}
+		defaultIndexCache.setMaxBytes(budget)
+	})
+}
+
+// SetIndexMemoryBudget sets the approximate maximum amount of memory
+// (in bytes) used by indexes that are kept loaded across store opens
+// (such as the tree-level def query MAFSA tables). When the budget is
+// exceeded, the least recently used indexes are evicted (and must be
+// read from the VFS again the next time they are used). An index that
+// is larger than the entire budget is used by the query that loaded it
+// but is not kept loaded.
+//
+// If budget is 0 (the default), the number of loaded indexes is
+// limited instead of their size. The budget may also be set using the
+// INDEX_MEMORY_BUDGET environment variable (which SetIndexMemoryBudget
+// overrides).
+func SetIndexMemoryBudget(budget int64) {
+	loadIndexMemoryBudget()
+	defaultIndexCache.setMaxBytes(budget)
+}
+
+func (c *indexCache) setMaxBytes(maxBytes int64) {
+	c.Lock()
+	defer c.Unlock()
+	c.maxBytes = maxBytes
+	c.evict()
+}
+
 // cacheGet attempts to fetch an instance of a loaded Index from an in-memory
 // cache. If it fails, it will return the fallback index.
 //
@@ -47,11 +117,13 @@ var defaultIndexCache *indexCache = &indexCache{
 // concurrently. Pleasue ensure all uses of the Index are read-only to prevent
 // concurrency issues.
 func cacheGet(store cacheableIndexStore, name string, fallback Index) Index {
+	loadIndexMemoryBudget()
 	return defaultIndexCache.cacheGet(store, name, fallback)
 }
 
 // cachePut will store an index in the cache
 func cachePut(store cacheableIndexStore, name string, index Index) {
+	loadIndexMemoryBudget()
 	defaultIndexCache.cachePut(store, name, index)
 }
 
@@ -88,19 +160,57 @@ func (c *indexCache) cachePut(store cacheableIndexStore, name string, index Inde
 	}
 	c.RUnlock()
 
+	size := indexMemSize(index)
+
 	// Update cache
 	c.Lock()
 	defer c.Unlock()
+	if c.maxBytes > 0 && size > c.maxBytes {
+		vlog.Printf("%s: not caching index key=%v (size %d exceeds memory budget %d)", name, key, size, c.maxBytes)
+		return
+	}
+	if _, ok := c.indexes[key]; ok {
+		// Another goroutine cached it while we weren't holding the
+		// lock.
+		return
+	}
 	vlog.Printf("%s: updating cache key=%v", name, key)
-	el := indexCacheElement{key: key, index: index}
+	el := indexCacheElement{key: key, index: index, size: size}
 	c.indexes[key] = c.lru.PushFront(el)
+	c.bytes += size
+	c.evict()
+}
 
-	// Evict least recently used
-	if c.lru.Len() > c.maxLen {
+// evict evicts the least recently used indexes until the cache is
+// within its limits. The caller must hold c's lock.
+func (c *indexCache) evict() {
+	for c.lru.Len() > 0 && ((c.maxBytes > 0 && c.bytes > c.maxBytes) || (c.maxBytes <= 0 && c.lru.Len() > c.maxLen)) {
 		dead := c.lru.Back()
-		deadKey := dead.Value.(indexCacheElement).key
-		vlog.Printf("Evicting %v", deadKey)
+		deadEl := dead.Value.(indexCacheElement)
+		vlog.Printf("Evicting %v", deadEl.key)
 		c.lru.Remove(dead)
-		delete(c.indexes, deadKey)
+		delete(c.indexes, deadEl.key)
+		c.bytes -= deadEl.size
+	}
+}
+
+// cacheRemove removes the cached (and pinned) indexes of the store
+// with the given key (e.g., because the store's data files were
+// rewritten, which makes the offsets in its indexes stale).
+func cacheRemove(storeKey interface{}) {
+	defaultIndexCache.cacheRemove(storeKey)
+	unpinIndexes(storeKey)
+}
+
+func (c *indexCache) cacheRemove(storeKey interface{}) {
+	c.Lock()
+	defer c.Unlock()
+	for key, el := range c.indexes {
+		if key.storeKey == storeKey {
+			vlog.Printf("Removing %v", key)
+			c.lru.Remove(el)
+			delete(c.indexes, key)
+			c.bytes -= el.Value.(indexCacheElement).size
+		}
 	}
 }
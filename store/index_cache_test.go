@@ -3,6 +3,8 @@ package store
 import (
 	"container/list"
 	"fmt"
+	"os"
+	"sync"
 	"testing"
 )
 
@@ -91,3 +93,72 @@ func TestLRU(t *testing.T) {
 		}
 	}
 }
+
+type mockSizedIndex struct {
+	mockIndex
+	size int64
+}
+
+func (m *mockSizedIndex) memSize() int64 { return m.size }
+
+func TestLRU_memoryBudget(t *testing.T) {
+	store := &mockCacheableIndexStore{}
+	c := &indexCache{
+		indexes:  map[indexCacheKey]*list.Element{},
+		lru:      list.New(),
+		maxLen:   1, // ignored when maxBytes is set
+		maxBytes: 100,
+	}
+	for i := 0; i < 4; i++ {
+		c.cachePut(store, fmt.Sprintf("index_%d", i), &mockSizedIndex{mockIndex{i}, 30})
+	}
+
+	// Only the 3 most recently used indexes fit in the budget.
+	fallback := &mockIndex{-1}
+	for i := 0; i < 4; i++ {
+		index := c.cacheGet(store, fmt.Sprintf("index_%d", i), fallback)
+		if i == 0 && index != fallback {
+			t.Errorf("index_%d should have been evicted", i)
+		} else if i > 0 && index == fallback {
+			t.Errorf("index_%d should not have been evicted", i)
+		}
+	}
+	if want := int64(90); c.bytes != want {
+		t.Errorf("got cache size %d, want %d", c.bytes, want)
+	}
+
+	// An index larger than the budget is not cached (and doesn't
+	// evict anything).
+	c.cachePut(store, "big", &mockSizedIndex{mockIndex{100}, 101})
+	if index := c.cacheGet(store, "big", fallback); index != fallback {
+		t.Errorf("index larger than budget should not have been cached")
+	}
+	if n := c.lru.Len(); n != 3 {
+		t.Errorf("got %d cached indexes, want 3", n)
+	}
+
+	// Lowering the budget evicts the least recently used indexes
+	// (index_1 was used least recently).
+	c.setMaxBytes(60)
+	if index := c.cacheGet(store, "index_1", fallback); index != fallback {
+		t.Errorf("index_1 should have been evicted")
+	}
+	if want := int64(60); c.bytes != want {
+		t.Errorf("got cache size %d, want %d", c.bytes, want)
+	}
+}
+
+func TestLoadIndexMemoryBudget(t *testing.T) {
+	defer func(v string) { os.Setenv("INDEX_MEMORY_BUDGET", v) }(os.Getenv("INDEX_MEMORY_BUDGET"))
+	defer func(maxBytes int64) { defaultIndexCache.setMaxBytes(maxBytes) }(defaultIndexCache.maxBytes)
+
+	for v, want := range map[string]int64{"": 0, "x": 0, "-1": 0, "1000": 1000} {
+		defaultIndexCache.setMaxBytes(0)
+		indexMemoryBudgetFromEnv = sync.Once{}
+		os.Setenv("INDEX_MEMORY_BUDGET", v)
+		loadIndexMemoryBudget() // an invalid value must not panic
+		if got := defaultIndexCache.maxBytes; got != want {
+			t.Errorf("INDEX_MEMORY_BUDGET=%q: got budget %d, want %d", v, got, want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SkippableIndexes are the names of the indexes that a store can be
+// configured not to build (see FSMultiRepoStoreConf.SkipIndexes). They
+// only speed up some kinds of queries, which otherwise use another
+// index or scan the data; other indexes are required by (or are much
+// more important to) common queries, and are always built.
+var SkippableIndexes = []string{
+	defQueryIndexName,
+	"def_query_to_defs16",
+	defNameTreeIndexName,
+	defDirTreeIndexName,
+	defSignatureIndexName,
+	defDeprecatedIndexName,
+}
+
+// IndexProfiles maps the name of each index profile (see
+// FSMultiRepoStoreConf.IndexProfile) to the indexes that stores with
+// the profile don't build.
+var IndexProfiles = map[string][]string{
+	// "full" builds all indexes.
+	"full": nil,
+
+	// "archival" is for stores that are imported into often but
+	// rarely queried by def name or directory (e.g., stores that keep
+	// old versions of repos): it skips the def query indexes, which
+	// are the most expensive to build.
+	"archival": {defQueryIndexName, "def_query_to_defs16", defNameTreeIndexName, defDirTreeIndexName},
+}
+
+// skippedIndexes returns the set of indexes that aren't built in a
+// store with the given index profile and skipped index names.
+func skippedIndexes(profile string, names []string) (map[string]bool, error) {
+	if profile != "" {
+		pnames, ok := IndexProfiles[profile]
+		if !ok {
+			return nil, fmt.Errorf("unknown index profile %q (known profiles: %v)", profile, indexProfileNames())
+		}
+		names = append(pnames[:len(pnames):len(pnames)], names...)
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	skip := make(map[string]bool, len(names))
+	for _, name := range names {
+		if !isSkippableIndex(name) {
+			return nil, fmt.Errorf("index %q can't be skipped (skippable indexes: %v)", name, SkippableIndexes)
+		}
+		skip[name] = true
+	}
+	// The tree's def query index is built from its units' def query
+	// indexes.
+	if skip[defQueryIndexName] {
+		skip["def_query_to_defs16"] = true
+	}
+	return skip, nil
+}
+
+func isSkippableIndex(name string) bool {
+	for _, n := range SkippableIndexes {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func indexProfileNames() []string {
+	names := make([]string, 0, len(IndexProfiles))
+	for name := range IndexProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// removeSkippedIndexes removes the indexes that the store doesn't
+// build from xs, so that they are neither built nor used by queries.
+func (st fsStoreSettings) removeSkippedIndexes(xs map[string]Index) {
+	for name := range st.skipIndexes {
+		delete(xs, name)
+	}
+}
@@ -0,0 +1,68 @@
+package store
+
+import (
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestFSMultiRepoStore_indexProfile(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+	useIndexedStore = true
+
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}, Info: unit.Info{Files: []string{"f"}}}
+	data := graph.Output{
+		Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}, Name: "foo", File: "f"}},
+		Refs: []*graph.Ref{{DefPath: "p", File: "f", Start: 1, End: 2}},
+	}
+
+	for _, profile := range []string{"full", "archival"} {
+		fs, w := NewWriteCountingFS(newTestFS())
+		mrs := NewFSMultiRepoStore(fs, &FSMultiRepoStoreConf{IndexProfile: profile})
+		if err := mrs.Import("r", "c", u, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.Index("r", "c"); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.CreateVersion("r", "c"); err != nil {
+			t.Fatal(err)
+		}
+
+		indexes := w.Snapshot().Indexes
+		for _, name := range []string{defQueryIndexName, "def_query_to_defs16", defNameTreeIndexName, defDirTreeIndexName} {
+			if _, built := indexes[name]; built != (profile == "full") {
+				t.Errorf("%s: index %s built: got %v, want %v", profile, name, built, profile == "full")
+			}
+		}
+		if _, built := indexes[defToRefsIndexName]; !built {
+			t.Errorf("%s: index %s wasn't built", profile, defToRefsIndexName)
+		}
+
+		// Queries that would use the skipped indexes still work.
+		defs, err := mrs.Defs(ByDefQuery("fo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(defs) != 1 {
+			t.Errorf("%s: got %d defs matching query, want 1", profile, len(defs))
+		}
+	}
+}
+
+func TestFSMultiRepoStore_skipIndexes_invalid(t *testing.T) {
+	for _, conf := range []*FSMultiRepoStoreConf{
+		{IndexProfile: "x"},
+		{SkipIndexes: []string{unitsIndexName}},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%+v: NewFSMultiRepoStore did not panic", conf)
+				}
+			}()
+			NewFSMultiRepoStore(newTestFS(), conf)
+		}()
+	}
+}
@@ -0,0 +1,86 @@
+package store
+
+import (
+	"fmt"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+// ForceScan returns a filter that makes indexed stores perform the
+// query by scanning the data, without consulting any indexes. It
+// selects all defs and refs, so the results are the same as without
+// it (if the indexes are correct). Diff the results of a query with
+// and without ForceScan to debug index correctness (or see
+// NewShadowReadStore, which does so for a sample of queries).
+func ForceScan() interface {
+	DefFilter
+	RefFilter
+} {
+	return forceScanFilter{}
+}
+
+type forceScanFilter struct{}
+
+func (forceScanFilter) SelectDef(*graph.Def) bool { return true }
+func (forceScanFilter) SelectRef(*graph.Ref) bool { return true }
+func (forceScanFilter) String() string            { return "ForceScan" }
+
+// RequireIndex returns a filter that makes FS-backed stores fail a
+// query with an *ErrIndexRequired error instead of scanning a source
+// unit's data (because no index covers the query or because the index
+// is unavailable). Pass it in queries from latency-sensitive callers
+// to protect them from accidental full scans. It selects all defs and
+// refs.
+//
+// A query with both ForceScan and RequireIndex always fails.
+func RequireIndex() interface {
+	DefFilter
+	RefFilter
+} {
+	return requireIndexFilter{}
+}
+
+type requireIndexFilter struct{}
+
+func (requireIndexFilter) SelectDef(*graph.Def) bool { return true }
+func (requireIndexFilter) SelectRef(*graph.Ref) bool { return true }
+func (requireIndexFilter) String() string            { return "RequireIndex" }
+
+// ErrIndexRequired is the error returned by a query with the
+// RequireIndex filter that would have scanned data.
+type ErrIndexRequired struct {
+	Store   string // the store that would have scanned its data
+	Filters string // the query's filters
+}
+
+func (e *ErrIndexRequired) Error() string {
+	return fmt.Sprintf("%s: no index satisfies query %s (and RequireIndex forbids scans)", e.Store, e.Filters)
+}
+
+// IsIndexRequired reports whether err is an *ErrIndexRequired error.
+func IsIndexRequired(err error) bool {
+	_, ok := err.(*ErrIndexRequired)
+	return ok
+}
+
+// isForceScan reports whether filters contains a ForceScan filter.
+func isForceScan(filters interface{}) bool {
+	for _, f := range storeFilters(filters) {
+		if _, ok := f.(forceScanFilter); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkScanAllowed returns an *ErrIndexRequired error if filters
+// contains a RequireIndex filter. Stores call it before scanning their
+// data.
+func checkScanAllowed(store fmt.Stringer, filters interface{}) error {
+	for _, f := range storeFilters(filters) {
+		if _, ok := f.(requireIndexFilter); ok {
+			return &ErrIndexRequired{Store: store.String(), Filters: fmt.Sprint(filters)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+func TestIndexUsageFilters(t *testing.T) {
+	us := newIndexedUnitStore(newTestFS(), "u", fsStoreSettings{})
+	if err := us.Import(graph.Output{
+		Defs: []*graph.Def{
+			{DefKey: graph.DefKey{Path: "p"}, Name: "p", File: "f"},
+			{DefKey: graph.DefKey{Path: "q"}, Name: "q", File: "f"},
+		},
+		Refs: []*graph.Ref{
+			{DefPath: "p", File: "f", Start: 1, End: 2},
+			{DefPath: "q", File: "f", Start: 3, End: 4},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	defs, err := us.Defs(ByDefPath("p"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanned, err := us.Defs(ByDefPath("p"), ForceScan())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 1 || !reflect.DeepEqual(scanned, defs) {
+		t.Errorf("got ForceScan defs %v, want %v", scanned, defs)
+	}
+
+	// Indexed queries are allowed with RequireIndex.
+	if defs, err := us.Defs(ByDefPath("p"), RequireIndex()); err != nil {
+		t.Fatal(err)
+	} else if len(defs) != 1 {
+		t.Errorf("got %d defs, want 1", len(defs))
+	}
+	if refs, err := us.Refs(ByRefDef(graph.RefDefKey{DefPath: "q"}), RequireIndex()); err != nil {
+		t.Fatal(err)
+	} else if len(refs) != 1 {
+		t.Errorf("got %d refs, want 1", len(refs))
+	}
+
+	// Queries that would scan fail with RequireIndex.
+	if _, err := us.Defs(ByDefKinds("func"), RequireIndex()); !IsIndexRequired(err) {
+		t.Errorf("got err %v, want *ErrIndexRequired", err)
+	}
+	if _, err := us.Refs(RequireIndex()); !IsIndexRequired(err) {
+		t.Errorf("got err %v, want *ErrIndexRequired", err)
+	}
+	if _, err := us.Defs(ByDefPath("p"), ForceScan(), RequireIndex()); !IsIndexRequired(err) {
+		t.Errorf("got err %v with ForceScan, want *ErrIndexRequired", err)
+	}
+}
+
+func TestIndexUsageFilters_multiRepo(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+	useIndexedStore = true
+
+	mrs := NewFSMultiRepoStore(newTestFS(), nil)
+	testSyncImport(t, mrs, "r", "c", "u1", "u2")
+	if err := mrs.Index("r", "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := mrs.Defs(RequireIndex()); !IsIndexRequired(err) {
+		t.Errorf("got err %v, want *ErrIndexRequired", err)
+	}
+	defs, err := mrs.Defs(ForceScan())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 2 {
+		t.Errorf("got %d defs with ForceScan, want 2", len(defs))
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"sourcegraph.com/sourcegraph/rwvfs"
 	"sourcegraph.com/sourcegraph/srclib/graph"
@@ -35,6 +36,11 @@ type indexedStore interface {
 	// statIndex calls vfs.Stat on the index's backing file or
 	// directory.
 	statIndex(name string) (os.FileInfo, error)
+
+	// buildsIndexesLazily reports whether indexes that are missing
+	// when a query needs them are built on first use (see
+	// FSMultiRepoStoreConf.LazyIndexes).
+	buildsIndexesLazily() bool
 }
 
 // An indexedTreeStore is a VFS-backed tree store that generates
@@ -67,18 +73,24 @@ const (
 )
 
 // newIndexedTreeStore creates a new indexed tree store that stores
-// data and indexes in fs.
-func newIndexedTreeStore(fs rwvfs.FileSystem, cacheKey interface{}) TreeStoreImporter {
-	return &indexedTreeStore{
+// data and indexes in fs, using the given settings.
+func newIndexedTreeStore(fs rwvfs.FileSystem, cacheKey interface{}, st fsStoreSettings) TreeStoreImporter {
+	s := &indexedTreeStore{
 		indexes: map[string]Index{
 			"file_to_units":       &unitFilesIndex{},
 			"def_to_ref_units":    &defRefUnitsIndex{},
 			"def_query_to_defs16": &defQueryTreeIndex{},
+			defNameTreeIndexName:  &defNameTreeIndex{},
+			defDirTreeIndexName:   &defDirTreeIndex{},
+			fileNamesIndexName:    &fileNamesIndex{},
 			unitsIndexName:        &unitsIndex{},
 		},
 		cacheKey:    cacheKey,
-		fsTreeStore: newFSTreeStore(fs),
+		fsTreeStore: newFSTreeStore(fs, st),
 	}
+	usePinnedIndexes(fs, s.indexes)
+	st.removeSkippedIndexes(s.indexes)
+	return s
 }
 
 func (s *indexedTreeStore) StoreKey() interface{} { return s.cacheKey }
@@ -109,15 +121,17 @@ func (s *indexedTreeStore) unitIDs(indexOnly bool, fs ...UnitFilter) ([]unit.ID2
 
 	// Try to find an index that covers this query.
 	if xname, bx := bestCoverageIndex(s.indexes, fs, isUnitIndex); bx != nil {
-		if !bx.Ready() {
-			bx = cacheGet(s, xname, bx)
-		}
-		if err := prepareIndex(s.fs, xname, bx); err != nil {
+		bx, err := s.prepareCachedIndex(xname, bx)
+		if err == nil {
+			vlog.Printf("indexedTreeStore.unitIDs(%v): Found covering index %q (%v).", fs, xname, bx)
+			unitIDs, err := bx.(unitIndex).Units(fs...)
+			if !isIndexUnavailable(err) {
+				return unitIDs, err
+			}
+			logIndexFallback(s.fs, xname, err)
+		} else if !isIndexUnavailable(err) {
 			return nil, err
 		}
-		cachePut(s, xname, bx)
-		vlog.Printf("indexedTreeStore.unitIDs(%v): Found covering index %q (%v).", fs, xname, bx)
-		return bx.(unitIndex).Units(fs...)
 	}
 	if indexOnly {
 		return nil, errNotIndexed
@@ -142,6 +156,10 @@ func (s *indexedTreeStore) unitIDs(indexOnly bool, fs ...UnitFilter) ([]unit.ID2
 var maxIndividualFetches = 5
 
 func (s *indexedTreeStore) Units(fs ...UnitFilter) ([]*unit.SourceUnit, error) {
+	if units, paged, err := PagedUnits(s.Units, fs); paged {
+		return units, err
+	}
+
 	// Attempt to use the index.
 	scopedUnits, err := s.unitIDs(true, fs...)
 	if err != nil && err != errNotIndexed {
@@ -157,9 +175,29 @@ func (s *indexedTreeStore) Units(fs ...UnitFilter) ([]*unit.SourceUnit, error) {
 	return s.fsTreeStore.Units(fs...)
 }
 
+// prepareCachedIndex prepares an index for use by a query. If another
+// instance of the store has already loaded the index, that instance's
+// copy of the index is returned (from the index cache); otherwise the
+// index is read and then added to the cache (subject to its memory
+// budget). An index that is already ready (e.g., a pinned index) is
+// used as is. The returned index must only be used for reading.
+func (s *indexedTreeStore) prepareCachedIndex(name string, x Index) (Index, error) {
+	if x.Ready() {
+		return x, nil
+	}
+	x = cacheGet(s, name, x)
+	if err := prepareQueryIndex(s, s.fs, name, x); err != nil {
+		return x, err
+	}
+	cachePut(s, name, x)
+	return x, nil
+}
+
 func (s *indexedTreeStore) unitsUsingFullIndex(fs ...UnitFilter) ([]*unit.SourceUnit, error) {
 	x := s.indexes[unitsIndexName]
-	if err := prepareIndex(s.fs, unitsIndexName, x); err != nil {
+	if err := prepareQueryIndex(s, s.fs, unitsIndexName, x); isIndexUnavailable(err) {
+		return s.fsTreeStore.Units(fs...)
+	} else if err != nil {
 		return nil, err
 	}
 	return x.(unitFullIndex).Units(fs...)
@@ -168,18 +206,30 @@ func (s *indexedTreeStore) unitsUsingFullIndex(fs ...UnitFilter) ([]*unit.Source
 func (s *indexedTreeStore) Defs(fs ...DefFilter) ([]*graph.Def, error) {
 	vlog.Printf("indexedTreeStore.Defs(%v)", fs)
 
+	t := queryTraceOf(fs)
+	if isForceScan(fs) {
+		t.strategy("forced scan")
+		return s.fsTreeStore.Defs(fs...)
+	}
+
 	// First, check if any defs indexes at the tree level cover this
 	// query.
 	if xname, bx := bestCoverageIndex(s.indexes, fs, isDefTreeIndex); bx != nil {
-		if err := prepareIndex(s.fs, xname, bx); err != nil {
+		start := time.Now()
+		bx, err := s.prepareCachedIndex(xname, bx)
+		if err != nil && !isIndexUnavailable(err) {
 			return nil, err
 		}
-		vlog.Printf("indexedTreeStore.Defs(%v): Found covering index %q (%v).", fs, xname, bx)
-		uoffs, err := bx.(defTreeIndex).Defs(fs...)
-		if err != nil {
-			return nil, err
+		if err == nil {
+			vlog.Printf("indexedTreeStore.Defs(%v): Found covering index %q (%v).", fs, xname, bx)
+			t.strategy("tree index " + xname)
+			uoffs, err := bx.(defTreeIndex).Defs(fs...)
+			if err != nil {
+				return nil, err
+			}
+			fs = append(fs, unitDefOffsetsFilter(uoffs))
 		}
-		fs = append(fs, unitDefOffsetsFilter(uoffs))
+		t.stage("tree index lookup", start)
 	}
 
 	// We have File->Unit index (that tells us which source units
@@ -204,10 +254,13 @@ func (s *indexedTreeStore) Defs(fs ...DefFilter) ([]*graph.Def, error) {
 
 	// Find which source units match the unit filters; we'll restrict
 	// our defs query to those source units.
+	start := time.Now()
 	scopeUnits, err := s.unitIDs(false, ufs...)
+	t.stage("unit scope lookup", start)
 	if err != nil && err != errNotIndexed {
 		return nil, err
 	} else if err == nil {
+		t.strategy("units scoped by index")
 		// Add ByUnits filters that were implied by ByFiles (and other
 		// UnitFilters).
 		//
@@ -222,6 +275,12 @@ func (s *indexedTreeStore) Defs(fs ...DefFilter) ([]*graph.Def, error) {
 }
 
 func (s *indexedTreeStore) Refs(fs ...RefFilter) ([]*graph.Ref, error) {
+	t := queryTraceOf(fs)
+	if isForceScan(fs) {
+		t.strategy("forced scan")
+		return s.fsTreeStore.Refs(fs...)
+	}
+
 	// We have File->Unit index (that tells us which source units
 	// include a given file). If there's a ByFiles RefFilter, then we
 	// can convert that filter into a ByUnits scope filter (which is
@@ -249,10 +308,13 @@ func (s *indexedTreeStore) Refs(fs ...RefFilter) ([]*graph.Ref, error) {
 
 	// Find which source units match the unit filters; we'll restrict
 	// our refs query to those source units.
+	start := time.Now()
 	scopeUnits, err := s.unitIDs(false, ufs...)
+	t.stage("unit scope lookup", start)
 	if err != nil {
 		return nil, err
 	}
+	t.strategy("units scoped by index")
 
 	// Add ByUnits filters that were implied by ByFiles (and other
 	// UnitFilters).
@@ -330,7 +392,7 @@ func (s *indexedTreeStore) readIndex(name string, x persistedIndex) error {
 	return readIndex(s.fs, name, x)
 }
 
-func (s *indexedTreeStore) buildIndexes(xs map[string]Index, units []*unit.SourceUnit, unitRefIndexes map[unit.ID2]*defRefsIndex, unitDefQueryIndexes map[unit.ID2]*defQueryIndex) error {
+func (s *indexedTreeStore) buildIndexes(xs map[string]Index, units []*unit.SourceUnit, unitRefIndexes map[unit.ID2][]*defRefsIndex, unitDefQueryIndexes map[unit.ID2]*defQueryIndex) error {
 	// TODO(sqs): there's a race condition here if multiple imports
 	// are running concurrently, they could clobber each other's
 	// indexes. (S3 is eventually consistent.)
@@ -352,7 +414,7 @@ func (s *indexedTreeStore) buildIndexes(xs map[string]Index, units []*unit.Sourc
 	var getUnitRefIndexesErr error
 	var getUnitRefIndexesOnce sync.Once
 	var unitRefIndexesLock sync.Mutex
-	getUnitRefIndexes := func() (map[unit.ID2]*defRefsIndex, error) {
+	getUnitRefIndexes := func() (map[unit.ID2][]*defRefsIndex, error) {
 		getUnitRefIndexesOnce.Do(func() {
 			if getUnitRefIndexesErr == nil && unitRefIndexes == nil {
 				// Read in the defRefsIndex for all source units.
@@ -370,7 +432,7 @@ func (s *indexedTreeStore) buildIndexes(xs map[string]Index, units []*unit.Sourc
 					uss[u.ID2()] = s.fsTreeStore.openUnitStore(u.ID2())
 				}
 
-				unitRefIndexes = make(map[unit.ID2]*defRefsIndex, len(units))
+				unitRefIndexes = make(map[unit.ID2][]*defRefsIndex, len(units))
 				par := parallel.NewRun(runtime.GOMAXPROCS(0))
 				for u_, us_ := range uss {
 					u := u_
@@ -382,20 +444,40 @@ func (s *indexedTreeStore) buildIndexes(xs map[string]Index, units []*unit.Sourc
 					par.Acquire()
 					go func() {
 						defer par.Release()
-						x := us.indexes[defToRefsIndexName]
-						if err := prepareIndex(us.fs, defToRefsIndexName, x); err != nil {
+
+						// If the unit's refs are sharded, each
+						// shard has its own index.
+						n, err := us.refShards()
+						if err != nil {
 							par.Error(err)
 							return
 						}
+						uss := []*indexedUnitStore{us}
+						if n > 0 {
+							uss = make([]*indexedUnitStore, n)
+							for i := range uss {
+								uss[i] = us.openRefShard(i, openIndexedRefShard).(*indexedUnitStore)
+							}
+						}
+
+						xs := make([]*defRefsIndex, len(uss))
+						for i, us := range uss {
+							x := us.indexes[defToRefsIndexName]
+							if err := prepareIndexOrBuild(us, us.fs, defToRefsIndexName, x); err != nil {
+								par.Error(err)
+								return
+							}
+							xs[i] = x.(*defRefsIndex)
+						}
 						unitRefIndexesLock.Lock()
 						defer unitRefIndexesLock.Unlock()
-						unitRefIndexes[u] = x.(*defRefsIndex)
+						unitRefIndexes[u] = xs
 					}()
 				}
 				getUnitRefIndexesErr = par.Wait()
 			}
 			if unitRefIndexes == nil {
-				unitRefIndexes = map[unit.ID2]*defRefsIndex{}
+				unitRefIndexes = map[unit.ID2][]*defRefsIndex{}
 			}
 		})
 		return unitRefIndexes, getUnitRefIndexesErr
@@ -435,7 +517,7 @@ func (s *indexedTreeStore) buildIndexes(xs map[string]Index, units []*unit.Sourc
 					go func() {
 						defer par.Release()
 						x := us.indexes[defQueryIndexName]
-						if err := prepareIndex(us.fs, defQueryIndexName, x); err != nil {
+						if err := prepareIndexOrBuild(us, us.fs, defQueryIndexName, x); err != nil {
 							par.Error(err)
 							return
 						}
@@ -490,6 +572,22 @@ func (s *indexedTreeStore) buildIndexes(xs map[string]Index, units []*unit.Sourc
 					par.Error(err)
 					return
 				}
+			case defNameTreeIndexBuilder:
+				units, err := getUnits()
+				if err != nil {
+					par.Error(err)
+					return
+				}
+				readDefs := func(u unit.ID2) ([]*graph.Def, byteOffsets, error) {
+					us := s.fsTreeStore.openUnitStore(u).(interface {
+						readDefs() ([]*graph.Def, byteOffsets, error)
+					})
+					return us.readDefs()
+				}
+				if err := x.Build(units, readDefs); err != nil {
+					par.Error(err)
+					return
+				}
 			default:
 				par.Error(fmt.Errorf("don't know how to build index %q of type %T", name, x))
 				return
@@ -531,17 +629,23 @@ var _ interface {
 } = (*indexedUnitStore)(nil)
 
 // newIndexedUnitStore creates a new indexed unit store that stores
-// data and indexes in fs.
-func newIndexedUnitStore(fs rwvfs.FileSystem, label string) UnitStoreImporter {
-	return &indexedUnitStore{
+// data and indexes in fs, using the given settings.
+func newIndexedUnitStore(fs rwvfs.FileSystem, label string, st fsStoreSettings) UnitStoreImporter {
+	s := &indexedUnitStore{
 		indexes: map[string]Index{
-			"path_to_def":      &defPathIndex{},
+			defPathIndexName:   &defPathIndex{},
 			"file_to_refs":     &refFileIndex{},
 			defToRefsIndexName: &defRefsIndex{},
 			defQueryIndexName:  &defQueryIndex{f: defQueryFilter},
+
+			defSignatureIndexName:  &defSignatureIndex{},
+			defDeprecatedIndexName: &defDeprecatedIndex{},
 		},
-		fsUnitStore: &fsUnitStore{fs: fs, label: label},
+		fsUnitStore: &fsUnitStore{fs: fs, label: label, fsStoreSettings: st},
 	}
+	usePinnedIndexes(fs, s.indexes)
+	st.removeSkippedIndexes(s.indexes)
+	return s
 }
 
 const (
@@ -551,53 +655,119 @@ const (
 )
 
 func (s *indexedUnitStore) Defs(fs ...DefFilter) ([]*graph.Def, error) {
+	if defs, paged, err := PagedDefs(s.Defs, fs); paged {
+		return defs, err
+	}
+
+	t := queryTraceOf(fs)
+
 	// If there's a defOffsetsFilter, that'll be faster than
 	// consulting an index (since it already gives us the byte
 	// offsets).
-	if hasDefOffsetsFilter := getDefOffsetsFilter(fs) != nil; !hasDefOffsetsFilter {
+	if hasDefOffsetsFilter := getDefOffsetsFilter(fs) != nil; !hasDefOffsetsFilter && !isForceScan(fs) {
 		// Try to find an index that covers this query.
 		if xname, bx := bestCoverageIndex(s.indexes, fs, isDefIndex); bx != nil {
-			if err := prepareIndex(s.fs, xname, bx); err != nil {
+			start := time.Now()
+			if err := prepareQueryIndex(s, s.fs, xname, bx); isIndexUnavailable(err) {
+				t.strategy("unit scan (index " + xname + " unavailable)")
+				defer t.stage("unit scan", time.Now())
+				return s.fsUnitStore.Defs(fs...)
+			} else if err != nil {
 				return nil, err
 			}
 			vlog.Printf("indexedUnitStore.Defs(%v): Found covering index %q (%v).", fs, xname, bx)
+			t.strategy("unit index " + xname)
 			ofs, err := bx.(defIndex).Defs(fs...)
+			t.stage("unit index lookup", start)
 			if err != nil {
 				return nil, err
 			}
+			defer t.stage("read at offsets", time.Now())
 			return s.defsAtOffsets(ofs, fs)
 		}
+	} else if hasDefOffsetsFilter {
+		t.strategy("unit offsets from tree index")
+		defer t.stage("read at offsets", time.Now())
+		return s.fsUnitStore.Defs(fs...)
 	}
 
 	// Fall back to full scan.
+	t.strategy("unit scan")
+	defer t.stage("unit scan", time.Now())
 	return s.fsUnitStore.Defs(fs...)
 }
 
 // Refs implements UnitStore.
 func (s *indexedUnitStore) Refs(fs ...RefFilter) ([]*graph.Ref, error) {
+	if refs, paged, err := PagedRefs(s.Refs, fs); paged {
+		return refs, err
+	}
+
+	// Sharded refs are indexed per shard.
+	if n, err := s.refShards(); err != nil {
+		return nil, err
+	} else if n > 0 {
+		return s.shardedRefs(n, fs, openIndexedRefShard)
+	}
+
+	t := queryTraceOf(fs)
+	if isForceScan(fs) {
+		t.strategy("forced scan")
+		defer t.stage("unit scan", time.Now())
+		return s.fsUnitStore.Refs(fs...)
+	}
+
+	// Refs to a def are contiguous in the RefsByDef copy of the refs
+	// (if the unit has one).
+	start := time.Now()
+	if refs, ok, err := s.refsByDef(fs); err != nil {
+		return nil, err
+	} else if ok {
+		t.strategy("unit refs by def")
+		t.stage("read refs by def", start)
+		return refs, nil
+	}
+
 	// Try to find an index that covers this query.
 	if xname, bx := bestCoverageIndex(s.indexes, fs, isRefIndex); bx != nil {
-		if err := prepareIndex(s.fs, xname, bx); err != nil {
+		start := time.Now()
+		if err := prepareQueryIndex(s, s.fs, xname, bx); isIndexUnavailable(err) {
+			t.strategy("unit scan (index " + xname + " unavailable)")
+			defer t.stage("unit scan", time.Now())
+			return s.fsUnitStore.Refs(fs...)
+		} else if err != nil {
 			return nil, err
 		}
 		vlog.Printf("indexedUnitStore.Refs(%v): Found covering index %q (%v).", fs, xname, bx)
+		t.strategy("unit index " + xname)
 		switch bx := bx.(type) {
 		case refIndexByteRanges:
 			brs, err := bx.Refs(fs...)
-			if err != nil {
+			t.stage("unit index lookup", start)
+			if isIndexUnavailable(err) {
+				logIndexFallback(s.fs, xname, err)
+				t.strategy("unit scan (index " + xname + " unavailable)")
+				defer t.stage("unit scan", time.Now())
+				return s.fsUnitStore.Refs(fs...)
+			} else if err != nil {
 				return nil, err
 			}
+			defer t.stage("read at offsets", time.Now())
 			return s.refsAtByteRanges(brs, fs)
 		case refIndexByteOffsets:
 			ofs, err := bx.Refs(fs...)
+			t.stage("unit index lookup", start)
 			if err != nil {
 				return nil, err
 			}
+			defer t.stage("read at offsets", time.Now())
 			return s.refsAtOffsets(ofs, fs)
 		}
 	}
 
 	// Fall back to full scan.
+	t.strategy("unit scan")
+	defer t.stage("unit scan", time.Now())
 	return s.fsUnitStore.Refs(fs...)
 }
 
@@ -617,10 +787,30 @@ func (s *indexedUnitStore) Import(data graph.Output) error {
 	if err != nil {
 		return err
 	}
+	if n := s.fsUnitStore.numRefShards(len(data.Refs)); n > 0 {
+		// Each shard builds its own ref indexes, so only build the
+		// def indexes here.
+		if err := s.fsUnitStore.importRefShards(data.Refs, n, openIndexedRefShard); err != nil {
+			return err
+		}
+		defIndexes := map[string]Index{}
+		for name, x := range s.Indexes() {
+			if _, ok := x.(defIndexBuilder); ok {
+				defIndexes[name] = x
+			}
+		}
+		return s.buildIndexes(defIndexes, &graph.Output{Defs: data.Defs}, defOfs, nil, nil)
+	}
+	if err := s.fsUnitStore.removeRefShards(); err != nil {
+		return err
+	}
 	refFBRs, refOfs, err = s.fsUnitStore.writeRefs(data.Refs)
 	if err != nil {
 		return err
 	}
+	if err := s.importRefOrders(data.Refs); err != nil {
+		return err
+	}
 	if err := s.buildIndexes(s.Indexes(), &data, defOfs, refFBRs, refOfs); err != nil {
 		return err
 	}
@@ -747,6 +937,15 @@ func writeIndex(fs rwvfs.FileSystem, name string, x persistedIndex) (err error)
 		}
 	}()
 
+	if _, ok := x.(rangeReadIndex); ok {
+		// Range-read indexes are written uncompressed.
+		if err := x.Write(f); err != nil {
+			return err
+		}
+		vlog.Printf("%s: done writing index.", name)
+		return nil
+	}
+
 	w := gzip.NewWriter(f)
 
 	if err := x.Write(w); err != nil {
@@ -770,12 +969,139 @@ func prepareIndex(fs rwvfs.FileSystem, name string, x Index) error {
 	if x.Ready() {
 		return nil
 	}
+	if x, ok := x.(rangeReadIndex); ok {
+		return openIndex(fs, name, x)
+	}
 	if x, ok := x.(persistedIndex); ok {
 		return readIndex(fs, name, x)
 	}
 	return &errIndexNotReady{name: name}
 }
 
+// openIndex calls x.open with the index's backing file.
+func openIndex(fs rwvfs.FileSystem, name string, x rangeReadIndex) error {
+	filename := fmt.Sprintf(indexFilename, name)
+	if err := x.open(fs, filename); err != nil {
+		vlog.Printf("%s: failed to open index: %s.", name, err)
+		if os.IsNotExist(err) {
+			return &errIndexNotExist{name: name, err: err}
+		}
+		return err
+	}
+	return nil
+}
+
+// prepareQueryIndex prepares an index for use by a query. It is like
+// prepareIndexOrBuild, but it also logs the degradation if the index
+// is unavailable (in which case the caller should fall back to a
+// scan).
+func prepareQueryIndex(s indexedStore, fs rwvfs.FileSystem, name string, x Index) error {
+	err := prepareIndexOrBuild(s, fs, name, x)
+	if isIndexUnavailable(err) {
+		logIndexFallback(fs, name, err)
+	}
+	return err
+}
+
+// prepareIndexOrBuild is like prepareIndex, but if the index is
+// unavailable and the store builds missing indexes lazily (see
+// FSMultiRepoStoreConf.LazyIndexes), it builds the index (and writes
+// it back to fs).
+func prepareIndexOrBuild(s indexedStore, fs rwvfs.FileSystem, name string, x Index) error {
+	err := prepareIndex(fs, name, x)
+	if !isIndexUnavailable(err) || !s.buildsIndexesLazily() || !dirExists(fs) {
+		return err
+	}
+
+	// Only build each index once, even if multiple queries need it
+	// concurrently.
+	mu := lazyIndexLock(fs.String() + ":" + name)
+	mu.Lock()
+	defer mu.Unlock()
+	if err := prepareIndex(fs, name, x); !isIndexUnavailable(err) {
+		return err // another query built it while we were waiting
+	}
+
+	log.Printf("Building missing index %q (in %s) on first use.", name, fs)
+	if buildErr := s.BuildIndex(name, x); buildErr != nil {
+		if x.Ready() {
+			// The index was built but could not be written. It can
+			// still be used for this query.
+			log.Printf("Warning: failed to write lazily built index %q (in %s): %s.", name, fs, buildErr)
+			return nil
+		}
+		log.Printf("Warning: failed to lazily build index %q (in %s): %s.", name, fs, buildErr)
+		return err
+	}
+	c_lazyIndexBuilds.increment()
+	return nil
+}
+
+var c_lazyIndexBuilds = &counter{count: new(int64)}
+
+var (
+	lazyIndexLocksMu sync.Mutex
+	lazyIndexLocks   = map[string]*sync.Mutex{}
+)
+
+func lazyIndexLock(key string) *sync.Mutex {
+	lazyIndexLocksMu.Lock()
+	defer lazyIndexLocksMu.Unlock()
+	mu, present := lazyIndexLocks[key]
+	if !present {
+		mu = new(sync.Mutex)
+		lazyIndexLocks[key] = mu
+	}
+	return mu
+}
+
+// isIndexUnavailable reports whether err (returned by prepareIndex)
+// indicates that the index has not been built (e.g., because the data
+// was imported with NOINDEX=1 or by an older version that didn't have
+// the index). Queries should fall back to a scan in that case.
+func isIndexUnavailable(err error) bool {
+	switch err.(type) {
+	case *errIndexNotExist, *errIndexNotReady:
+		return true
+	}
+	return false
+}
+
+var c_indexFallbacks = &counter{count: new(int64)}
+
+var (
+	loggedIndexFallbacksMu sync.Mutex
+	loggedIndexFallbacks   = map[string]struct{}{}
+)
+
+// logIndexFallback logs that a query is being performed using a scan
+// because the named index is unavailable. To avoid flooding the log,
+// it only logs the first fallback for each index file.
+func logIndexFallback(fs rwvfs.FileSystem, name string, err error) {
+	c_indexFallbacks.increment()
+	if !dirExists(fs) {
+		// The store has no data, so there's nothing to scan
+		// (and nothing to warn about).
+		return
+	}
+	key := fs.String() + ":" + name
+	loggedIndexFallbacksMu.Lock()
+	_, logged := loggedIndexFallbacks[key]
+	loggedIndexFallbacks[key] = struct{}{}
+	loggedIndexFallbacksMu.Unlock()
+	if !logged {
+		log.Printf("Warning: %s (in %s); falling back to a (slower) full scan. Rebuild the indexes to restore performance.", err, fs)
+	} else {
+		vlog.Printf("%s: index unavailable (%s); falling back to full scan.", name, err)
+	}
+}
+
+// dirExists reports whether the root directory of fs exists.
+func dirExists(fs rwvfs.FileSystem) bool {
+	_, err := fs.Stat(".")
+	return err == nil
+}
+
 type errIndexNotReady struct {
 	name string
 }
@@ -810,6 +1136,15 @@ func readIndex(fs rwvfs.FileSystem, name string, x persistedIndex) (err error) {
 		}
 	}()
 
+	if _, ok := x.(rangeReadIndex); ok {
+		// Range-read indexes are written uncompressed.
+		if err := x.Read(f); err != nil {
+			return err
+		}
+		vlog.Printf("%s: done reading index.", name)
+		return nil
+	}
+
 	r, err := gzip.NewReader(f)
 	if err != nil {
 		return err
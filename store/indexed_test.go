@@ -1,25 +1,33 @@
 package store
 
-import "testing"
+import (
+	"strings"
+	"testing"
+
+	kfs "github.com/kr/fs"
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
 
 func TestIndexedUnitStore(t *testing.T) {
 	useIndexedStore = true
 	testUnitStore(t, func() UnitStoreImporter {
-		return newIndexedUnitStore(newTestFS(), "")
+		return newIndexedUnitStore(newTestFS(), "", fsStoreSettings{})
 	})
 }
 
 func TestIndexedTreeStore(t *testing.T) {
 	useIndexedStore = true
 	testTreeStore(t, func() TreeStoreImporter {
-		return newIndexedTreeStore(newTestFS(), "test")
+		return newIndexedTreeStore(newTestFS(), "test", fsStoreSettings{})
 	})
 }
 
 func TestIndexedFSTreeStore(t *testing.T) {
 	useIndexedStore = true
 	testTreeStore(t, func() TreeStoreImporter {
-		return newFSTreeStore(newTestFS())
+		return newFSTreeStore(newTestFS(), fsStoreSettings{})
 	})
 }
 
@@ -43,3 +51,125 @@ func TestIndexedFSMultiRepoStore_customRepoPaths(t *testing.T) {
 		return NewFSMultiRepoStore(newTestFS(), &FSMultiRepoStoreConf{RepoPaths: &customRepoPaths{}})
 	})
 }
+
+// newIndexedFSRepoStoreWithoutIndexes returns a repo store containing
+// a single tree (at commit "c") whose index files have been removed,
+// as though it were imported with NOINDEX=1.
+func newIndexedFSRepoStoreWithoutIndexes(t *testing.T) (rwvfs.WalkableFileSystem, RepoStore) {
+	fs := newTestFS()
+	rs := NewFSRepoStore(fs)
+
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}, Info: unit.Info{Files: []string{"f"}}}
+	data := graph.Output{
+		Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}, Name: "n", File: "f"}},
+		Refs: []*graph.Ref{{DefPath: "p", File: "f", Start: 1, End: 2}},
+	}
+	if err := rs.Import("c", u, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.(RepoIndexer).Index("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.CreateVersion("c"); err != nil {
+		t.Fatal(err)
+	}
+
+	idxFiles := indexFiles(t, fs)
+	if len(idxFiles) == 0 {
+		t.Fatal("no index files were built")
+	}
+	for _, f := range idxFiles {
+		if err := fs.Remove(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return fs, rs
+}
+
+func indexFiles(t *testing.T, fs rwvfs.WalkableFileSystem) []string {
+	var idxFiles []string
+	w := kfs.WalkFS(".", fs)
+	for w.Step() {
+		if err := w.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(w.Path(), ".idx") {
+			idxFiles = append(idxFiles, w.Path())
+		}
+	}
+	return idxFiles
+}
+
+// queryIndexedFSRepoStore performs queries that use each kind of
+// index on a store created by newIndexedFSRepoStoreWithoutIndexes.
+func queryIndexedFSRepoStore(t *testing.T, rs RepoStore) {
+	units, err := rs.Units(ByFiles(false, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(units) != 1 {
+		t.Errorf("Units(ByFiles): got %d units, want 1", len(units))
+	}
+
+	defs, err := rs.Defs(ByDefQuery("n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 1 {
+		t.Errorf("Defs(ByDefQuery): got %d defs, want 1", len(defs))
+	}
+
+	defs, err = rs.Defs(ByDefPath("p"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 1 {
+		t.Errorf("Defs(ByDefPath): got %d defs, want 1", len(defs))
+	}
+
+	refs, err := rs.Refs(ByRefDef(graph.RefDefKey{DefUnitType: "t", DefUnit: "u", DefPath: "p"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 {
+		t.Errorf("Refs(ByRefDef): got %d refs, want 1", len(refs))
+	}
+}
+
+func TestIndexedFSRepoStore_missingIndexes(t *testing.T) {
+	useIndexedStore = true
+	_, rs := newIndexedFSRepoStoreWithoutIndexes(t)
+
+	c_indexFallbacks.set(0)
+	queryIndexedFSRepoStore(t, rs)
+	if c_indexFallbacks.get() == 0 {
+		t.Error("got no index fallbacks, want > 0")
+	}
+}
+
+func TestIndexedFSRepoStore_lazyIndexes(t *testing.T) {
+	useIndexedStore = true
+	fs, _ := newIndexedFSRepoStoreWithoutIndexes(t)
+	rs := newFSRepoStoreWithSettings(fs, fsStoreSettings{lazyIndexes: true})
+
+	c_indexFallbacks.set(0)
+	c_lazyIndexBuilds.set(0)
+	queryIndexedFSRepoStore(t, rs)
+	if n := c_indexFallbacks.get(); n != 0 {
+		t.Errorf("got %d index fallbacks, want 0", n)
+	}
+	if c_lazyIndexBuilds.get() == 0 {
+		t.Error("got no lazy index builds, want > 0")
+	}
+	if len(indexFiles(t, fs)) == 0 {
+		t.Error("lazily built indexes were not written")
+	}
+
+	// The indexes are now built, so querying again doesn't build
+	// them again.
+	c_lazyIndexBuilds.set(0)
+	queryIndexedFSRepoStore(t, NewFSRepoStore(fs))
+	if n := c_lazyIndexBuilds.get(); n != 0 {
+		t.Errorf("got %d lazy index builds on second query, want 0", n)
+	}
+}
@@ -117,14 +117,15 @@ func BuildIndexes(store interface{}, c IndexCriteria, indexChan chan<- IndexStat
 	var builtMu sync.Mutex
 	indexChan2 := make(chan IndexStatus)
 	done := make(chan struct{})
+	clock := clockOf(store)
 	go func() {
 		var par *parallel.Run
 		lastDependsOnChildren := false
 		for sx := range indexChan2 {
 			doBuild := func(sx IndexStatus) {
-				start := time.Now()
+				start := clock.Now()
 				err := sx.store.BuildIndex(sx.Name, sx.index)
-				sx.BuildDuration = time.Since(start)
+				sx.BuildDuration = clock.Now().Sub(start)
 				if err == nil {
 					sx.Stale = false
 				} else {
@@ -0,0 +1,747 @@
+package store
+
+import (
+	"io"
+	"sort"
+
+	"golang.org/x/net/context"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// A DefIterator is a cursor over the results of a defs query. It
+// streams the defs from the store's data files, so (unlike Defs) the
+// query's results are never all held in memory at once.
+type DefIterator interface {
+	// Next returns the next def, or io.EOF if there are no more.
+	Next() (*graph.Def, error)
+
+	// Close releases the iterator's resources (such as open files).
+	// It must be called when the caller is done with the iterator,
+	// even if Next hasn't returned io.EOF.
+	Close() error
+}
+
+// A RefIterator is a cursor over the results of a refs query (see
+// DefIterator).
+type RefIterator interface {
+	// Next returns the next ref, or io.EOF if there are no more.
+	Next() (*graph.Ref, error)
+
+	// Close releases the iterator's resources (see
+	// DefIterator.Close).
+	Close() error
+}
+
+// DefRefIterators is implemented by stores that can stream the
+// results of defs and refs queries, for callers that query more defs
+// or refs (e.g., all refs in a repo with millions of them) than they
+// can hold in memory.
+//
+// Iterators return the same defs and refs as Defs and Refs, but not in
+// the canonical order (see "CONVENTION - RESULT ORDERING" in the
+// package docs), and DefsSorter filters are ignored. Results are
+// grouped by repo, commit ID, and source unit (each in sorted order),
+// and the results of each source unit are in the order they're stored.
+// First and Offset filters page through the results in this order.
+//
+// Queries that a source unit's indexes cover (e.g., ByDefPath) are
+// answered by reading the records at the offsets the index gives, as
+// with Defs and Refs; only each unit's results are held in memory.
+type DefRefIterators interface {
+	// DefsIter returns an iterator over the defs that match the
+	// filters.
+	DefsIter(f ...DefFilter) (DefIterator, error)
+
+	// RefsIter returns an iterator over the refs that match the
+	// filters.
+	RefsIter(f ...RefFilter) (RefIterator, error)
+}
+
+var (
+	_ DefRefIterators = (*fsMultiRepoStore)(nil)
+	_ DefRefIterators = (*fsRepoStore)(nil)
+	_ DefRefIterators = (*fsTreeStore)(nil)
+	_ DefRefIterators = (*indexedTreeStore)(nil)
+	_ DefRefIterators = (*fsUnitStore)(nil)
+	_ DefRefIterators = (*indexedUnitStore)(nil)
+)
+
+// DefsIter returns an iterator over the defs in s that match the
+// filters. If s doesn't implement DefRefIterators (e.g., it's a memory
+// store or a middleware that wraps another store), its defs are
+// queried with Defs and the iterator returns them in order.
+func DefsIter(s interface {
+	Defs(...DefFilter) ([]*graph.Def, error)
+}, f ...DefFilter) (DefIterator, error) {
+	if s, ok := s.(DefRefIterators); ok {
+		return s.DefsIter(f...)
+	}
+	defs, err := s.Defs(f...)
+	if err != nil {
+		return nil, err
+	}
+	return &defsSliceIter{defs: defs}, nil
+}
+
+// RefsIter returns an iterator over the refs in s that match the
+// filters. See DefsIter.
+func RefsIter(s interface {
+	Refs(...RefFilter) ([]*graph.Ref, error)
+}, f ...RefFilter) (RefIterator, error) {
+	if s, ok := s.(DefRefIterators); ok {
+		return s.RefsIter(f...)
+	}
+	refs, err := s.Refs(f...)
+	if err != nil {
+		return nil, err
+	}
+	return &refsSliceIter{refs: refs}, nil
+}
+
+func (s *fsMultiRepoStore) DefsIter(f ...DefFilter) (DefIterator, error) {
+	fs, err := checkConditional(s, f)
+	if err != nil {
+		return nil, err
+	}
+	return s.repoStores.DefsIter(fs.([]DefFilter)...)
+}
+
+func (s *fsMultiRepoStore) RefsIter(f ...RefFilter) (RefIterator, error) {
+	fs, err := checkConditional(s, f)
+	if err != nil {
+		return nil, err
+	}
+	return s.repoStores.RefsIter(fs.([]RefFilter)...)
+}
+
+func (s repoStores) DefsIter(f ...DefFilter) (DefIterator, error) {
+	if it, paged, err := pagedDefsIter(s.DefsIter, f); paged {
+		return it, err
+	}
+
+	f = normalizeRepoFilters(s.opener, f).([]DefFilter)
+	rss, err := openRepoStores(s.opener, f)
+	if err != nil {
+		return nil, err
+	}
+	repos := make([]string, 0, len(rss))
+	for repo, rs := range rss {
+		if rs != nil {
+			repos = append(repos, repo)
+		}
+	}
+	sort.Strings(repos)
+
+	return &defsConcatIter{n: len(repos), open: func(i int) (DefIterator, error) {
+		repo := repos[i]
+		it, err := DefsIter(rss[repo], filtersForRepo(repo, f).([]DefFilter)...)
+		if err != nil {
+			return nil, err
+		}
+		return &defsFixIter{DefIterator: it, fix: func(def *graph.Def) {
+			def.Repo = repo
+		}}, nil
+	}}, nil
+}
+
+func (s repoStores) RefsIter(f ...RefFilter) (RefIterator, error) {
+	if it, paged, err := pagedRefsIter(s.RefsIter, f); paged {
+		return it, err
+	}
+
+	f = normalizeRepoFilters(s.opener, f).([]RefFilter)
+	rss, err := openRepoStores(s.opener, f)
+	if err != nil {
+		return nil, err
+	}
+	repos := make([]string, 0, len(rss))
+	for repo, rs := range rss {
+		if rs != nil {
+			repos = append(repos, repo)
+		}
+	}
+	sort.Strings(repos)
+
+	// Each repo's iterator is opened (and the filters' implied repo
+	// is set) only after the previous repo's refs are exhausted.
+	return &refsConcatIter{n: len(repos), open: func(i int) (RefIterator, error) {
+		repo := repos[i]
+		setImpliedRepo(f, repo)
+		it, err := RefsIter(rss[repo], filtersForRepo(repo, f).([]RefFilter)...)
+		if err != nil {
+			return nil, err
+		}
+		return &refsFixIter{RefIterator: it, fix: func(ref *graph.Ref) {
+			ref.Repo = repo
+			if ref.DefRepo == "" {
+				ref.DefRepo = repo
+			}
+		}}, nil
+	}}, nil
+}
+
+func (s treeStores) DefsIter(f ...DefFilter) (DefIterator, error) {
+	if it, paged, err := pagedDefsIter(s.DefsIter, f); paged {
+		return it, err
+	}
+
+	tss, err := openTreeStores(s.opener, f)
+	if err != nil {
+		return nil, err
+	}
+	commitIDs := make([]string, 0, len(tss))
+	for commitID, ts := range tss {
+		if ts != nil {
+			commitIDs = append(commitIDs, commitID)
+		}
+	}
+	sort.Strings(commitIDs)
+
+	return &defsConcatIter{n: len(commitIDs), open: func(i int) (DefIterator, error) {
+		commitID := commitIDs[i]
+		it, err := DefsIter(tss[commitID], f...)
+		if err != nil {
+			return nil, err
+		}
+		return &defsFixIter{DefIterator: it, fix: func(def *graph.Def) {
+			def.CommitID = commitID
+		}}, nil
+	}}, nil
+}
+
+func (s treeStores) RefsIter(f ...RefFilter) (RefIterator, error) {
+	if it, paged, err := pagedRefsIter(s.RefsIter, f); paged {
+		return it, err
+	}
+
+	tss, err := openTreeStores(s.opener, f)
+	if err != nil {
+		return nil, err
+	}
+	commitIDs := make([]string, 0, len(tss))
+	for commitID, ts := range tss {
+		if ts != nil {
+			commitIDs = append(commitIDs, commitID)
+		}
+	}
+	sort.Strings(commitIDs)
+
+	return &refsConcatIter{n: len(commitIDs), open: func(i int) (RefIterator, error) {
+		commitID := commitIDs[i]
+		setImpliedCommitID(f, commitID)
+		it, err := RefsIter(tss[commitID], f...)
+		if err != nil {
+			return nil, err
+		}
+		return &refsFixIter{RefIterator: it, fix: func(ref *graph.Ref) {
+			ref.CommitID = commitID
+		}}, nil
+	}}, nil
+}
+
+func (s *fsTreeStore) DefsIter(fs ...DefFilter) (DefIterator, error) {
+	fs, err := s.withDeprecations(fs)
+	if err != nil {
+		return nil, err
+	}
+	return s.unitStores.DefsIter(fs...)
+}
+
+func (s unitStores) DefsIter(f ...DefFilter) (DefIterator, error) {
+	if it, paged, err := pagedDefsIter(s.DefsIter, f); paged {
+		return it, err
+	}
+
+	uss, err := openUnitStores(s.opener, f)
+	if err != nil {
+		return nil, err
+	}
+	units := make([]unit.ID2, 0, len(uss))
+	for u, us := range uss {
+		if us != nil {
+			units = append(units, u)
+		}
+	}
+	sort.Sort(unitID2s(units))
+
+	return &defsConcatIter{n: len(units), open: func(i int) (DefIterator, error) {
+		u := units[i]
+		it, err := DefsIter(uss[u], filtersForUnit(u, f).([]DefFilter)...)
+		if err != nil {
+			return nil, err
+		}
+		return &defsFixIter{DefIterator: it, fix: func(def *graph.Def) {
+			def.UnitType = u.Type
+			def.Unit = u.Name
+		}}, nil
+	}}, nil
+}
+
+func (s unitStores) RefsIter(f ...RefFilter) (RefIterator, error) {
+	if it, paged, err := pagedRefsIter(s.RefsIter, f); paged {
+		return it, err
+	}
+
+	uss, err := openUnitStores(s.opener, f)
+	if err != nil {
+		return nil, err
+	}
+	units := make([]unit.ID2, 0, len(uss))
+	for u, us := range uss {
+		if us != nil {
+			units = append(units, u)
+		}
+	}
+	sort.Sort(unitID2s(units))
+
+	return &refsConcatIter{n: len(units), open: func(i int) (RefIterator, error) {
+		u := units[i]
+		fCopy := withImpliedUnit(filtersForUnit(u, f).([]RefFilter), u)
+		it, err := RefsIter(uss[u], fCopy...)
+		if err != nil {
+			return nil, err
+		}
+		return &refsFixIter{RefIterator: it, fix: func(ref *graph.Ref) {
+			ref.UnitType = u.Type
+			ref.Unit = u.Name
+			if ref.DefUnitType == "" {
+				ref.DefUnitType = u.Type
+			}
+			if ref.DefUnit == "" {
+				ref.DefUnit = u.Name
+			}
+		}}, nil
+	}}, nil
+}
+
+// DefsIter implements DefRefIterators. Queries that an index covers
+// are answered with Defs (see DefRefIterators).
+func (s *indexedUnitStore) DefsIter(fs ...DefFilter) (DefIterator, error) {
+	if it, paged, err := pagedDefsIter(s.DefsIter, fs); paged {
+		return it, err
+	}
+
+	if !isForceScan(fs) {
+		if _, bx := bestCoverageIndex(s.indexes, fs, isDefIndex); bx != nil {
+			return DefsIter(unitStoreOnly{s}, fs...)
+		}
+	}
+	return s.fsUnitStore.DefsIter(fs...)
+}
+
+// RefsIter implements DefRefIterators. Queries that an index (or the
+// unit's RefsByDef order) covers are answered with Refs (see
+// DefRefIterators).
+func (s *indexedUnitStore) RefsIter(fs ...RefFilter) (RefIterator, error) {
+	if it, paged, err := pagedRefsIter(s.RefsIter, fs); paged {
+		return it, err
+	}
+
+	if n, err := s.refShards(); err != nil {
+		return nil, err
+	} else if n > 0 {
+		return s.shardedRefsIter(n, fs, openIndexedRefShard), nil
+	}
+	if !isForceScan(fs) {
+		byRefDef := false
+		for _, f := range fs {
+			if _, ok := f.(ByRefDefFilter); ok {
+				byRefDef = true
+			}
+		}
+		if _, bx := bestCoverageIndex(s.indexes, fs, isRefIndex); bx != nil || byRefDef {
+			return RefsIter(unitStoreOnly{s}, fs...)
+		}
+	}
+	return s.fsUnitStore.RefsIter(fs...)
+}
+
+// unitStoreOnly hides the DefRefIterators methods of a UnitStore, so
+// that DefsIter and RefsIter query it with Defs and Refs.
+type unitStoreOnly struct{ UnitStore }
+
+func (s *fsUnitStore) DefsIter(fs ...DefFilter) (DefIterator, error) {
+	if it, paged, err := pagedDefsIter(s.DefsIter, fs); paged {
+		return it, err
+	}
+
+	if getDefOffsetsFilter(fs) != nil {
+		return DefsIter(unitStoreOnly{s}, fs...)
+	}
+	if err := checkScanAllowed(s, fs); err != nil {
+		return nil, err
+	}
+	it, err := s.openScanIter(queryContext(fs), unitDefsFilename)
+	if err != nil {
+		return nil, err
+	}
+	vlog.Printf("%s: streaming defs with filters %v...", s, fs)
+	return &fsDefsScanIter{fsScanIter: it, fs: fs}, nil
+}
+
+func (s *fsUnitStore) RefsIter(fs ...RefFilter) (RefIterator, error) {
+	if it, paged, err := pagedRefsIter(s.RefsIter, fs); paged {
+		return it, err
+	}
+
+	if n, err := s.refShards(); err != nil {
+		return nil, err
+	} else if n > 0 {
+		return s.shardedRefsIter(n, fs, openFSRefShard), nil
+	}
+	if err := checkScanAllowed(s, fs); err != nil {
+		return nil, err
+	}
+	it, err := s.openScanIter(queryContext(fs), unitRefsFilename)
+	if err != nil {
+		return nil, err
+	}
+	vlog.Printf("%s: streaming refs with filters %v...", s, fs)
+	return &fsRefsScanIter{fsScanIter: it, fs: fs}, nil
+}
+
+// shardedRefsIter streams the refs in the buckets (out of n) that may
+// contain refs matching the filters, one bucket at a time, using
+// stores created by open.
+func (s *fsUnitStore) shardedRefsIter(n int, fs []RefFilter, open refShardOpener) RefIterator {
+	shards := refShardsForFilters(n, fs)
+	return &refsConcatIter{n: len(shards), open: func(i int) (RefIterator, error) {
+		return RefsIter(s.openRefShard(shards[i], open), fs...)
+	}}
+}
+
+// openScanIter opens the named data file for a streaming scan.
+func (s *fsUnitStore) openScanIter(ctx context.Context, name string) (*fsScanIter, error) {
+	f, err := openForScan(ctx, s.fs, name)
+	if err != nil {
+		return nil, err
+	}
+	rr := &recordReader{r: f}
+	return &fsScanIter{s: s, name: name, f: f, rr: rr, dec: s.codec().NewDecoder(rr)}, nil
+}
+
+// fsScanIter decodes the records of a unit's data file one at a time,
+// skipping corrupt records as the sequential scans of Defs and Refs
+// do.
+type fsScanIter struct {
+	s    *fsUnitStore
+	name string // data file name
+
+	f   io.ReadCloser // nil after the scan ends
+	rr  *recordReader
+	dec decoder
+	ofs int64 // offset of the next record in the data file
+}
+
+// next decodes the next record into v. It returns io.EOF if there are
+// no more records.
+func (it *fsScanIter) next(v interface{}) error {
+	for it.f != nil {
+		n, err := it.dec.Decode(v)
+		if err == io.EOF {
+			return err
+		} else if err != nil {
+			f2, next, err := it.s.resyncScan(it.rr, it.name, it.ofs, err)
+			if err != nil {
+				return err
+			}
+			it.f.Close()
+			it.f = nil
+			if f2 == nil {
+				break // the corrupt record was the last one
+			}
+			it.f, it.ofs = f2, next
+			it.rr = &recordReader{r: f2}
+			it.dec = it.s.codec().NewDecoder(it.rr)
+			continue
+		}
+		it.ofs += int64(n)
+		return nil
+	}
+	return io.EOF
+}
+
+func (it *fsScanIter) Close() error {
+	if it.f == nil {
+		return nil
+	}
+	err := it.f.Close()
+	it.f = nil
+	return err
+}
+
+type fsDefsScanIter struct {
+	*fsScanIter
+	fs []DefFilter
+}
+
+func (it *fsDefsScanIter) Next() (*graph.Def, error) {
+	for {
+		def := &graph.Def{}
+		if err := it.next(def); err != nil {
+			return nil, err
+		}
+		if DefFilters(it.fs).SelectDef(def) {
+			return def, nil
+		}
+	}
+}
+
+type fsRefsScanIter struct {
+	*fsScanIter
+	fs []RefFilter
+}
+
+func (it *fsRefsScanIter) Next() (*graph.Ref, error) {
+	for {
+		ref := &graph.Ref{}
+		if err := it.next(ref); err != nil {
+			return nil, err
+		}
+		if refFilters(it.fs).SelectRef(ref) {
+			return ref, nil
+		}
+	}
+}
+
+// defsSliceIter iterates over defs that have already been read.
+type defsSliceIter struct{ defs []*graph.Def }
+
+func (it *defsSliceIter) Next() (*graph.Def, error) {
+	if len(it.defs) == 0 {
+		return nil, io.EOF
+	}
+	def := it.defs[0]
+	it.defs = it.defs[1:]
+	return def, nil
+}
+
+func (it *defsSliceIter) Close() error {
+	it.defs = nil
+	return nil
+}
+
+// refsSliceIter iterates over refs that have already been read.
+type refsSliceIter struct{ refs []*graph.Ref }
+
+func (it *refsSliceIter) Next() (*graph.Ref, error) {
+	if len(it.refs) == 0 {
+		return nil, io.EOF
+	}
+	ref := it.refs[0]
+	it.refs = it.refs[1:]
+	return ref, nil
+}
+
+func (it *refsSliceIter) Close() error {
+	it.refs = nil
+	return nil
+}
+
+// defsFixIter calls fix on each def returned by the underlying
+// iterator (e.g., to set the fields implied by the def's store).
+type defsFixIter struct {
+	DefIterator
+	fix func(*graph.Def)
+}
+
+func (it *defsFixIter) Next() (*graph.Def, error) {
+	def, err := it.DefIterator.Next()
+	if err == nil {
+		it.fix(def)
+	}
+	return def, err
+}
+
+// refsFixIter is like defsFixIter, but for refs.
+type refsFixIter struct {
+	RefIterator
+	fix func(*graph.Ref)
+}
+
+func (it *refsFixIter) Next() (*graph.Ref, error) {
+	ref, err := it.RefIterator.Next()
+	if err == nil {
+		it.fix(ref)
+	}
+	return ref, err
+}
+
+// pagedDefsIter answers a defs query with First or Offset filters by
+// calling defsIter with the query's other filters and returning an
+// iterator over the page of its results. If the query isn't paged, it
+// returns paged == false without calling defsIter.
+func pagedDefsIter(defsIter func(...DefFilter) (DefIterator, error), fs []DefFilter) (_ DefIterator, paged bool, err error) {
+	offset, limit, paged := queryPage(fs)
+	if !paged {
+		return nil, false, nil
+	}
+	it, err := defsIter(withoutScanLimit(fs).([]DefFilter)...)
+	if err != nil {
+		return nil, true, err
+	}
+	return &defsPageIter{DefIterator: it, skip: offset, left: limit}, true, nil
+}
+
+// pagedRefsIter is like pagedDefsIter, but for refs.
+func pagedRefsIter(refsIter func(...RefFilter) (RefIterator, error), fs []RefFilter) (_ RefIterator, paged bool, err error) {
+	offset, limit, paged := queryPage(fs)
+	if !paged {
+		return nil, false, nil
+	}
+	it, err := refsIter(withoutScanLimit(fs).([]RefFilter)...)
+	if err != nil {
+		return nil, true, err
+	}
+	return &refsPageIter{RefIterator: it, skip: offset, left: limit}, true, nil
+}
+
+// defsPageIter skips the first defs of the underlying iterator and
+// returns at most a limited number of the rest.
+type defsPageIter struct {
+	DefIterator
+	skip int // number of defs left to skip
+	left int // number of defs left to return, or -1 if unlimited
+}
+
+func (it *defsPageIter) Next() (*graph.Def, error) {
+	for ; it.skip > 0; it.skip-- {
+		if _, err := it.DefIterator.Next(); err != nil {
+			return nil, err
+		}
+	}
+	if it.left == 0 {
+		return nil, io.EOF
+	}
+	def, err := it.DefIterator.Next()
+	if err == nil && it.left > 0 {
+		it.left--
+	}
+	return def, err
+}
+
+// refsPageIter is like defsPageIter, but for refs.
+type refsPageIter struct {
+	RefIterator
+	skip int // number of refs left to skip
+	left int // number of refs left to return, or -1 if unlimited
+}
+
+func (it *refsPageIter) Next() (*graph.Ref, error) {
+	for ; it.skip > 0; it.skip-- {
+		if _, err := it.RefIterator.Next(); err != nil {
+			return nil, err
+		}
+	}
+	if it.left == 0 {
+		return nil, io.EOF
+	}
+	ref, err := it.RefIterator.Next()
+	if err == nil && it.left > 0 {
+		it.left--
+	}
+	return ref, err
+}
+
+// defsConcatIter returns the defs of n iterators, in order. Each
+// iterator is opened (by open) when the previous one is exhausted, so
+// only one is open at a time. Iterators whose stores don't exist are
+// skipped.
+type defsConcatIter struct {
+	n    int
+	open func(i int) (DefIterator, error)
+
+	i   int // index of the next iterator to open
+	cur DefIterator
+}
+
+func (it *defsConcatIter) Next() (*graph.Def, error) {
+	for {
+		if it.cur == nil {
+			if it.i >= it.n {
+				return nil, io.EOF
+			}
+			cur, err := it.open(it.i)
+			it.i++
+			if isStoreNotExist(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			it.cur = cur
+		}
+		def, err := it.cur.Next()
+		if err == io.EOF {
+			if err := it.closeCur(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return def, err
+	}
+}
+
+func (it *defsConcatIter) Close() error {
+	it.i = it.n // don't open any more iterators
+	return it.closeCur()
+}
+
+func (it *defsConcatIter) closeCur() error {
+	if it.cur == nil {
+		return nil
+	}
+	err := it.cur.Close()
+	it.cur = nil
+	return err
+}
+
+// refsConcatIter is like defsConcatIter, but for refs.
+type refsConcatIter struct {
+	n    int
+	open func(i int) (RefIterator, error)
+
+	i   int // index of the next iterator to open
+	cur RefIterator
+}
+
+func (it *refsConcatIter) Next() (*graph.Ref, error) {
+	for {
+		if it.cur == nil {
+			if it.i >= it.n {
+				return nil, io.EOF
+			}
+			cur, err := it.open(it.i)
+			it.i++
+			if isStoreNotExist(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			it.cur = cur
+		}
+		ref, err := it.cur.Next()
+		if err == io.EOF {
+			if err := it.closeCur(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return ref, err
+	}
+}
+
+func (it *refsConcatIter) Close() error {
+	it.i = it.n // don't open any more iterators
+	return it.closeCur()
+}
+
+func (it *refsConcatIter) closeCur() error {
+	if it.cur == nil {
+		return nil
+	}
+	err := it.cur.Close()
+	it.cur = nil
+	return err
+}
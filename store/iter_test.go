@@ -0,0 +1,135 @@
+package store
+
+import (
+	"io"
+	"reflect"
+	"sort"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestDefsIter_RefsIter(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+
+	data := func(u string) graph.Output {
+		return graph.Output{
+			Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "x"}, Name: u}, {DefKey: graph.DefKey{Path: "y"}, Name: u}},
+			Refs: []*graph.Ref{
+				{DefPath: "x", File: "f", Start: 1, End: 2},
+				{DefPath: "y", File: "f", Start: 3, End: 4},
+				{DefRepo: "o", DefUnitType: "t", DefUnit: "o", DefPath: "z", File: "g", Start: 5, End: 6},
+			},
+		}
+	}
+
+	defQueries := [][]DefFilter{
+		nil,
+		{ByRepos("b")},
+		{ByDefPath("y")},
+		{ByUnits(unit.ID2{Type: "t", Name: "u2"}), ByDefPath("x")},
+	}
+	refQueries := [][]RefFilter{
+		nil,
+		{ByRepos("a"), ByFiles(false, "g")},
+		{ByRefDef(graph.RefDefKey{DefRepo: "a", DefUnitType: "t", DefUnit: "u1", DefPath: "y"})},
+	}
+
+	stores := map[string]func() MultiRepoStoreImporter{
+		"fs":     func() MultiRepoStoreImporter { return NewFSMultiRepoStore(newTestFS(), nil) },
+		"memory": func() MultiRepoStoreImporter { return newMemoryMultiRepoStore() },
+	}
+	for _, indexed := range []bool{false, true} {
+		useIndexedStore = indexed
+		for label, newStore := range stores {
+			mrs := newStore()
+			for _, repo := range []string{"a", "b"} {
+				for _, u := range []string{"u1", "u2"} {
+					if err := mrs.Import(repo, "c", &unit.SourceUnit{Key: unit.Key{Type: "t", Name: u}, Info: unit.Info{Files: []string{"f", "g"}}}, data(u)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := mrs.CreateVersion(repo, "c"); err != nil {
+					t.Fatal(err)
+				}
+				if mrs, ok := mrs.(MultiRepoIndexer); ok {
+					if err := mrs.Index(repo, "c"); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			for _, q := range defQueries {
+				want, err := mrs.Defs(q...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				it, err := DefsIter(mrs, q...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []*graph.Def
+				for {
+					def, err := it.Next()
+					if err == io.EOF {
+						break
+					} else if err != nil {
+						t.Fatal(err)
+					}
+					got = append(got, def)
+				}
+				if err := it.Close(); err != nil {
+					t.Fatal(err)
+				}
+				sort.Sort(defsInCanonicalOrder(got))
+				if len(want) == 0 || !reflect.DeepEqual(got, want) {
+					t.Errorf("%s indexed=%v: DefsIter(%v): got %v, want %v", label, indexed, q, got, want)
+				}
+			}
+
+			for _, q := range refQueries {
+				want, err := mrs.Refs(q...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				it, err := RefsIter(mrs, q...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []*graph.Ref
+				for {
+					ref, err := it.Next()
+					if err == io.EOF {
+						break
+					} else if err != nil {
+						t.Fatal(err)
+					}
+					got = append(got, ref)
+				}
+				if err := it.Close(); err != nil {
+					t.Fatal(err)
+				}
+				sortRefs(got, nil)
+				if len(want) == 0 || !reflect.DeepEqual(got, want) {
+					t.Errorf("%s indexed=%v: RefsIter(%v): got %v, want %v", label, indexed, q, got, want)
+				}
+			}
+
+			// An iterator can be closed before it's exhausted.
+			it, err := DefsIter(mrs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := it.Next(); err != nil {
+				t.Fatal(err)
+			}
+			if err := it.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if def, err := it.Next(); err != io.EOF {
+				t.Errorf("%s indexed=%v: Next after Close: got %v, %v, want io.EOF", label, indexed, def, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+// A JSONDecoderFunc decodes the JSON-encoded record in data into v.
+type JSONDecoderFunc func(data []byte, v interface{}) error
+
+// jsonDecoders maps the types of records to the functions that
+// JSONCodec decodes them with. Records of other types are decoded with
+// encoding/json.
+var jsonDecoders = map[reflect.Type]JSONDecoderFunc{
+	reflect.TypeOf((*graph.Def)(nil)): generatedJSONDecoder,
+	reflect.TypeOf((*graph.Ref)(nil)): generatedJSONDecoder,
+}
+
+// RegisterJSONDecoder makes JSONCodec decode records of the same type
+// as v (e.g., (*graph.Def)(nil)) with dec, so that faster decoders
+// (such as ones generated by ffjson or easyjson) can be plugged in. If
+// dec is nil, records of v's type are decoded with encoding/json.
+//
+// By default, defs and refs are decoded with the decoders generated by
+// the graph package (see graph/gen_json_decoders.go). Like Codec, it
+// should only be called at init time or when you can guarantee that no
+// stores will be reading data.
+func RegisterJSONDecoder(v interface{}, dec JSONDecoderFunc) {
+	t := reflect.TypeOf(v)
+	if dec == nil {
+		delete(jsonDecoders, t)
+		return
+	}
+	jsonDecoders[t] = dec
+}
+
+// A fastJSONUnmarshaler is a type with a generated JSON decoder (such
+// as graph.Def and graph.Ref).
+type fastJSONUnmarshaler interface {
+	// UnmarshalJSONFast decodes data with the generated decoder. It
+	// returns false if data must be decoded with encoding/json.
+	UnmarshalJSONFast(data []byte) bool
+}
+
+// generatedJSONDecoder decodes records with their generated JSON
+// decoders. The (rare) records that the generated decoders don't
+// handle, such as those with unknown fields, are decoded with
+// encoding/json.
+func generatedJSONDecoder(data []byte, v interface{}) error {
+	if v.(fastJSONUnmarshaler).UnmarshalJSONFast(data) {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// unmarshalJSON decodes the JSON-encoded record in data into v with
+// the JSON decoder registered for v's type.
+func unmarshalJSON(data []byte, v interface{}) error {
+	if dec, ok := jsonDecoders[reflect.TypeOf(v)]; ok {
+		return dec(data, v)
+	}
+	return json.Unmarshal(data, v)
+}
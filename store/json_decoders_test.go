@@ -0,0 +1,58 @@
+package store
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+func TestRegisterJSONDecoder(t *testing.T) {
+	defer func(c codec) { Codec = c }(Codec)
+	defer func(n int) { ScanWorkers = n }(ScanWorkers)
+	defer RegisterJSONDecoder((*graph.Def)(nil), generatedJSONDecoder)
+	Codec = JSONCodec{}
+
+	us := &fsUnitStore{fs: newTestFS(), label: "test"}
+	want := []*graph.Def{
+		{DefKey: graph.DefKey{Path: "p1"}, Name: "n1", Data: []byte(`{"a":1}`)},
+		{DefKey: graph.DefKey{Path: "p2"}, Name: "n2", UnknownFields: []byte(`{"Future":true}`)},
+	}
+	if err := us.Import(graph.Output{Defs: want}); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int
+	RegisterJSONDecoder((*graph.Def)(nil), func(data []byte, v interface{}) error {
+		calls++
+		return json.Unmarshal(data, v)
+	})
+	for _, workers := range []int{1, 4} {
+		ScanWorkers = workers
+		calls = 0
+		defs, err := us.Defs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(defs, want) {
+			t.Errorf("ScanWorkers=%d: got defs %v, want %v", workers, defs, want)
+		}
+		if calls != len(want) {
+			t.Errorf("ScanWorkers=%d: registered decoder called %d times, want %d", workers, calls, len(want))
+		}
+	}
+
+	// The generated decoder (and encoding/json, for the def with
+	// unknown fields) decode the same defs.
+	for _, dec := range []JSONDecoderFunc{generatedJSONDecoder, nil} {
+		RegisterJSONDecoder((*graph.Def)(nil), dec)
+		defs, err := us.Defs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(defs, want) {
+			t.Errorf("got defs %v, want %v", defs, want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// LanguageStats summarizes the data of a tree's source units of a
+// single unit type (which usually corresponds to a language).
+type LanguageStats struct {
+	// UnitType is the type of the source units (e.g., "GoPackage").
+	UnitType string
+
+	// Units is the number of source units of the type.
+	Units int
+
+	// Defs and Refs are the total numbers of defs and refs in the
+	// source units.
+	Defs, Refs int
+
+	// Files is the number of distinct files in the source units (in
+	// their Files lists or with defs or refs).
+	Files int
+}
+
+// A TreeLanguageStats summarizes a tree's data by unit type.
+type TreeLanguageStats interface {
+	// LanguageStats returns the stats of each unit type in the tree,
+	// sorted by unit type.
+	LanguageStats() ([]*LanguageStats, error)
+}
+
+// A RepoLanguageStats summarizes a repo's trees' data by unit type.
+type RepoLanguageStats interface {
+	LanguageStats(commitID string) ([]*LanguageStats, error)
+}
+
+// A MultiRepoLanguageStats summarizes the data of trees in multiple
+// repos by unit type.
+type MultiRepoLanguageStats interface {
+	LanguageStats(repo, commitID string) ([]*LanguageStats, error)
+}
+
+// unitStatsFilename is the name of the file (in a unit's dir) that
+// holds the unit's stats, which are computed when the unit is
+// imported. If it doesn't exist, the unit was imported before stats
+// were recorded, and its stats are computed from its data when
+// needed.
+const unitStatsFilename = "unit_stats.json"
+
+type unitStats struct {
+	Defs, Refs int
+
+	// Files are the distinct files in the unit, sorted.
+	Files []string
+}
+
+// computeUnitStats computes the stats of a unit's data.
+func computeUnitStats(u *unit.SourceUnit, defs []*graph.Def, refs []*graph.Ref) *unitStats {
+	files := make(map[string]struct{}, len(u.Files))
+	for _, f := range u.Files {
+		files[f] = struct{}{}
+	}
+	for _, def := range defs {
+		files[def.File] = struct{}{}
+	}
+	for _, ref := range refs {
+		files[ref.File] = struct{}{}
+	}
+	delete(files, "")
+
+	st := &unitStats{Defs: len(defs), Refs: len(refs), Files: make([]string, 0, len(files))}
+	for f := range files {
+		st.Files = append(st.Files, f)
+	}
+	sort.Strings(st.Files)
+	return st
+}
+
+func (s *fsTreeStore) unitStatsFilename(u unit.ID2) string {
+	return path.Join(s.unitDir(u), unitStatsFilename)
+}
+
+func (s *fsTreeStore) writeUnitStats(u *unit.SourceUnit, data *graph.Output) (err error) {
+	f, err := s.fs.Create(s.unitStatsFilename(u.ID2()))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := f.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+	return json.NewEncoder(f).Encode(computeUnitStats(u, data.Defs, data.Refs))
+}
+
+// readUnitStats reads the unit's recorded stats, or computes them from
+// the unit's data if they weren't recorded.
+func (s *fsTreeStore) readUnitStats(u *unit.SourceUnit) (*unitStats, error) {
+	f, err := s.fs.Open(s.unitStatsFilename(u.ID2()))
+	if os.IsNotExist(err) {
+		us := s.openUnitStore(u.ID2())
+		defs, err := us.Defs()
+		if err != nil {
+			return nil, err
+		}
+		refs, err := us.Refs()
+		if err != nil {
+			return nil, err
+		}
+		return computeUnitStats(u, defs, refs), nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var st unitStats
+	if err := json.NewDecoder(f).Decode(&st); err != nil {
+		return nil, fmt.Errorf("%s: invalid %s: %s", u.ID2(), unitStatsFilename, err)
+	}
+	return &st, nil
+}
+
+func (s *fsTreeStore) LanguageStats() ([]*LanguageStats, error) {
+	units, err := s.Units()
+	if err != nil {
+		return nil, err
+	}
+
+	byType := map[string]*LanguageStats{}
+	files := map[string]map[string]struct{}{}
+	for _, u := range units {
+		st, err := s.readUnitStats(u)
+		if err != nil {
+			return nil, err
+		}
+		ls, present := byType[u.Type]
+		if !present {
+			ls = &LanguageStats{UnitType: u.Type}
+			byType[u.Type] = ls
+			files[u.Type] = map[string]struct{}{}
+		}
+		ls.Units++
+		ls.Defs += st.Defs
+		ls.Refs += st.Refs
+		for _, f := range st.Files {
+			files[u.Type][f] = struct{}{}
+		}
+	}
+
+	stats := make([]*LanguageStats, 0, len(byType))
+	for unitType, ls := range byType {
+		ls.Files = len(files[unitType])
+		stats = append(stats, ls)
+	}
+	sort.Sort(languageStatsByUnitType(stats))
+	return stats, nil
+}
+
+type languageStatsByUnitType []*LanguageStats
+
+func (v languageStatsByUnitType) Len() int           { return len(v) }
+func (v languageStatsByUnitType) Less(i, j int) bool { return v[i].UnitType < v[j].UnitType }
+func (v languageStatsByUnitType) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+
+func (s *fsRepoStore) LanguageStats(commitID string) ([]*LanguageStats, error) {
+	return s.newTreeStore(commitID).(TreeLanguageStats).LanguageStats()
+}
+
+func (s *fsMultiRepoStore) LanguageStats(repo, commitID string) ([]*LanguageStats, error) {
+	return s.openRepoStore(repo).(RepoLanguageStats).LanguageStats(commitID)
+}
+
+var (
+	_ TreeLanguageStats      = (*fsTreeStore)(nil)
+	_ TreeLanguageStats      = (*indexedTreeStore)(nil)
+	_ RepoLanguageStats      = (*fsRepoStore)(nil)
+	_ MultiRepoLanguageStats = (*fsMultiRepoStore)(nil)
+)
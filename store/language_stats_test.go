@@ -0,0 +1,87 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestFSMultiRepoStore_LanguageStats(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+
+	imports := []struct {
+		unit *unit.SourceUnit
+		data graph.Output
+	}{
+		{
+			unit: &unit.SourceUnit{Key: unit.Key{Type: "GoPackage", Name: "a"}, Info: unit.Info{Files: []string{"a/a.go", "a/doc.go"}}},
+			data: graph.Output{
+				Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "x"}, File: "a/a.go"}, {DefKey: graph.DefKey{Path: "y"}, File: "a/a.go"}},
+				Refs: []*graph.Ref{{DefPath: "x", File: "a/a.go"}, {DefPath: "z", File: "a/gen.go"}},
+			},
+		},
+		{
+			unit: &unit.SourceUnit{Key: unit.Key{Type: "GoPackage", Name: "b"}, Info: unit.Info{Files: []string{"b/b.go", "a/doc.go"}}},
+			data: graph.Output{
+				Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "x"}, File: "b/b.go"}},
+			},
+		},
+		{
+			unit: &unit.SourceUnit{Key: unit.Key{Type: "JavaArtifact", Name: "c"}},
+			data: graph.Output{
+				Refs: []*graph.Ref{{DefPath: "x", File: "C.java"}},
+			},
+		},
+	}
+	want := []*LanguageStats{
+		{UnitType: "GoPackage", Units: 2, Defs: 3, Refs: 2, Files: 4},
+		{UnitType: "JavaArtifact", Units: 1, Refs: 1, Files: 1},
+	}
+
+	for _, indexed := range []bool{false, true} {
+		useIndexedStore = indexed
+		fs := newTestFS()
+		mrs := NewFSMultiRepoStore(fs, nil)
+		for _, imp := range imports {
+			if err := mrs.Import("r", "c", imp.unit, imp.data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := mrs.CreateVersion("r", "c"); err != nil {
+			t.Fatal(err)
+		}
+
+		stats, err := mrs.(MultiRepoLanguageStats).LanguageStats("r", "c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(stats, want) {
+			t.Errorf("indexed=%v: got stats %v, want %v", indexed, stats, want)
+		}
+
+		// Stats of units imported before they were recorded are
+		// computed from the units' data.
+		ts := mrs.(*fsMultiRepoStore).openRepoStore("r").(*fsRepoStore).newTreeStore("c")
+		var fts *fsTreeStore
+		switch ts := ts.(type) {
+		case *fsTreeStore:
+			fts = ts
+		case *indexedTreeStore:
+			fts = ts.fsTreeStore
+		}
+		for _, imp := range imports {
+			if err := fts.fs.Remove(fts.unitStatsFilename(imp.unit.ID2())); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stats, err = mrs.(MultiRepoLanguageStats).LanguageStats("r", "c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(stats, want) {
+			t.Errorf("indexed=%v: got stats %v computed from unit data, want %v", indexed, stats, want)
+		}
+	}
+}
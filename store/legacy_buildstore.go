@@ -0,0 +1,267 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kr/fs"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// NewLegacyBuildStore returns a read-only RepoStore that serves
+// queries from build data in the legacy build store layout (the
+// layout of .srclib-cache dirs, which predates the .srclib-store
+// format), so that historical build data can be queried without
+// rerunning the toolchains on old commits.
+//
+// The fs must be rooted at the build store's root dir (e.g., a repo's
+// .srclib-cache dir), which is laid out as follows:
+//
+//	<COMMITID>/<UNIT>/<UNITTYPE>.unit.json   source unit definition
+//	<COMMITID>/<UNIT>/<UNITTYPE>.graph.json  graph data (graph.Output)
+//
+// Each commit dir is a version. The data isn't indexed, so queries
+// scan (and decode) the graph data of all matching units.
+func NewLegacyBuildStore(fs rwvfs.WalkableFileSystem) RepoStore {
+	s := &legacyRepoStore{fs: fs}
+	s.treeStores = treeStores{s}
+	return s
+}
+
+const (
+	legacyUnitFileSuffix  = ".unit.json"
+	legacyGraphFileSuffix = ".graph.json"
+)
+
+type legacyRepoStore struct {
+	fs rwvfs.WalkableFileSystem
+	treeStores
+}
+
+var _ RepoStore = (*legacyRepoStore)(nil)
+
+func (s *legacyRepoStore) String() string { return fmt.Sprintf("legacyRepoStore(%v)", s.fs) }
+
+func (s *legacyRepoStore) commitIDs() ([]string, error) {
+	entries, err := s.fs.ReadDir(".")
+	if err != nil {
+		return nil, err
+	}
+	var commitIDs []string
+	for _, e := range entries {
+		if e.IsDir() {
+			commitIDs = append(commitIDs, e.Name())
+		}
+	}
+	sort.Strings(commitIDs)
+	return commitIDs, nil
+}
+
+func (s *legacyRepoStore) Versions(f ...VersionFilter) ([]*Version, error) {
+	commitIDs, err := s.commitIDs()
+	if err != nil {
+		return nil, err
+	}
+	var versions []*Version
+	for _, commitID := range commitIDs {
+		version := &Version{CommitID: commitID}
+		if versionFilters(f).SelectVersion(version) {
+			versions = append(versions, version)
+		}
+	}
+	return versions, nil
+}
+
+func (s *legacyRepoStore) openTreeStore(commitID string) TreeStore {
+	return newLegacyTreeStore(rwvfs.Walkable(rwvfs.Sub(s.fs, commitID)))
+}
+
+func (s *legacyRepoStore) openAllTreeStores() (map[string]TreeStore, error) {
+	commitIDs, err := s.commitIDs()
+	if err != nil {
+		return nil, err
+	}
+	tss := make(map[string]TreeStore, len(commitIDs))
+	for _, commitID := range commitIDs {
+		tss[commitID] = s.openTreeStore(commitID)
+	}
+	return tss, nil
+}
+
+var _ treeStoreOpener = (*legacyRepoStore)(nil)
+
+// A legacyTreeStore is a TreeStore for a commit dir in the legacy
+// build store layout.
+type legacyTreeStore struct {
+	fs rwvfs.WalkableFileSystem
+
+	unitsOnce  sync.Once
+	units      []*unit.SourceUnit
+	graphFiles map[unit.ID2]string // graph data file of each unit
+	unitsErr   error
+
+	unitStores
+}
+
+func newLegacyTreeStore(fs rwvfs.WalkableFileSystem) *legacyTreeStore {
+	ts := &legacyTreeStore{fs: fs}
+	ts.unitStores = unitStores{ts}
+	return ts
+}
+
+func (s *legacyTreeStore) String() string { return fmt.Sprintf("legacyTreeStore(%v)", s.fs) }
+
+// readUnits reads the tree's source unit definitions (once).
+func (s *legacyTreeStore) readUnits() ([]*unit.SourceUnit, map[unit.ID2]string, error) {
+	s.unitsOnce.Do(func() {
+		if _, err := s.fs.Stat("."); err != nil {
+			if os.IsNotExist(err) {
+				err = errTreeNoInit
+			}
+			s.unitsErr = err
+			return
+		}
+
+		var unitFiles []string
+		w := fs.WalkFS(".", s.fs)
+		for w.Step() {
+			if err := w.Err(); err != nil {
+				s.unitsErr = err
+				return
+			}
+			if fi := w.Stat(); fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), legacyUnitFileSuffix) {
+				unitFiles = append(unitFiles, filepath.ToSlash(w.Path()))
+			}
+		}
+		sort.Strings(unitFiles)
+
+		s.graphFiles = make(map[unit.ID2]string, len(unitFiles))
+		for _, unitFile := range unitFiles {
+			var u *unit.SourceUnit
+			if err := s.readJSON(unitFile, &u); err != nil {
+				s.unitsErr = err
+				return
+			}
+			if u == nil {
+				continue
+			}
+			s.units = append(s.units, u)
+			s.graphFiles[u.ID2()] = strings.TrimSuffix(unitFile, legacyUnitFileSuffix) + legacyGraphFileSuffix
+		}
+	})
+	return s.units, s.graphFiles, s.unitsErr
+}
+
+func (s *legacyTreeStore) readJSON(file string, v interface{}) error {
+	f, err := s.fs.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(v); err != nil {
+		return fmt.Errorf("%s: %s", path.Clean(file), err)
+	}
+	return nil
+}
+
+func (s *legacyTreeStore) Units(f ...UnitFilter) ([]*unit.SourceUnit, error) {
+	if units, paged, err := PagedUnits(s.Units, f); paged {
+		return units, err
+	}
+
+	units, _, err := s.readUnits()
+	if err != nil {
+		return nil, err
+	}
+	var selected []*unit.SourceUnit
+	for _, u := range units {
+		if unitFilters(f).SelectUnit(u) {
+			selected = append(selected, u)
+		}
+	}
+	return selected, nil
+}
+
+func (s *legacyTreeStore) openUnitStore(u unit.ID2) UnitStore {
+	_, graphFiles, err := s.readUnits()
+	if err != nil {
+		return nil
+	}
+	if file, present := graphFiles[u]; present {
+		return &legacyUnitStore{tree: s, unit: u, file: file}
+	}
+	return nil
+}
+
+func (s *legacyTreeStore) openAllUnitStores() (map[unit.ID2]UnitStore, error) {
+	_, graphFiles, err := s.readUnits()
+	if err != nil {
+		return nil, err
+	}
+	uss := make(map[unit.ID2]UnitStore, len(graphFiles))
+	for u := range graphFiles {
+		uss[u] = s.openUnitStore(u)
+	}
+	return uss, nil
+}
+
+var _ unitStoreOpener = (*legacyTreeStore)(nil)
+
+// A legacyUnitStore is a UnitStore for a source unit's graph data file
+// in the legacy build store layout.
+type legacyUnitStore struct {
+	tree *legacyTreeStore
+	unit unit.ID2
+	file string
+}
+
+func (s *legacyUnitStore) String() string { return fmt.Sprintf("legacyUnitStore(%s)", s.file) }
+
+// data reads and decodes the unit's graph data, converting it to the
+// form that the current store formats return.
+func (s *legacyUnitStore) data() (*memoryUnitStore, error) {
+	var data graph.Output
+	if err := s.tree.readJSON(s.file, &data); err != nil {
+		return nil, err
+	}
+
+	// Older toolchains emitted docs separately from defs; the importer
+	// attaches them to their defs.
+	docsByPath := make(map[string]*graph.Doc, len(data.Docs))
+	for _, doc := range data.Docs {
+		docsByPath[doc.Path] = doc
+	}
+	for _, def := range data.Defs {
+		if doc, present := docsByPath[def.Path]; present && len(def.Docs) == 0 {
+			def.Docs = append(def.Docs, &graph.DefDoc{Format: doc.Format, Data: doc.Data})
+		}
+	}
+
+	cleanForImport(&data, "", s.unit.Type, s.unit.Name)
+	return &memoryUnitStore{data: &data}, nil
+}
+
+func (s *legacyUnitStore) Defs(f ...DefFilter) ([]*graph.Def, error) {
+	us, err := s.data()
+	if err != nil {
+		return nil, err
+	}
+	return us.Defs(f...)
+}
+
+func (s *legacyUnitStore) Refs(f ...RefFilter) ([]*graph.Ref, error) {
+	us, err := s.data()
+	if err != nil {
+		return nil, err
+	}
+	return us.Refs(f...)
+}
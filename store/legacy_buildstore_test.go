@@ -0,0 +1,83 @@
+package store
+
+import (
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestLegacyBuildStore(t *testing.T) {
+	files := map[string]string{
+		"c1/a/u/t.unit.json":     `{"Name": "a/u", "Type": "t", "Files": ["a/u/f.go"]}`,
+		"c1/a/u/t.graph.json":    `{"Defs": [{"Path": "p", "Name": "p", "File": "a/u/f.go", "UnitType": "t", "Unit": "a/u"}], "Refs": [{"DefUnitType": "t", "DefUnit": "a/u", "DefPath": "p", "File": "a/u/f.go", "Start": 1, "End": 2}], "Docs": [{"Path": "p", "Format": "text/plain", "Data": "doc"}]}`,
+		"c1/v/t.unit.json":       `{"Name": "v", "Type": "t", "Files": ["v.go"]}`,
+		"c1/v/t.graph.json":      `{"Defs": [{"Path": "q", "Name": "q", "File": "v.go"}]}`,
+		"c1/v/t.depresolve.json": `[]`,
+		"c2/v/t.unit.json":       `{"Name": "v", "Type": "t"}`,
+	}
+	fs := newTestFS()
+	for name, data := range files {
+		if err := rwvfs.MkdirAll(fs, path.Dir(name)); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFileFrom(fs, name, strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := NewLegacyBuildStore(fs)
+
+	versions, err := s.Versions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []*Version{{CommitID: "c1"}, {CommitID: "c2"}}; !reflect.DeepEqual(versions, want) {
+		t.Errorf("got versions %v, want %v", versions, want)
+	}
+
+	units, err := s.Units(ByCommitIDs("c1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unitNames []string
+	for _, u := range units {
+		unitNames = append(unitNames, u.Name)
+	}
+	sort.Strings(unitNames)
+	if want := []string{"a/u", "v"}; !reflect.DeepEqual(unitNames, want) {
+		t.Errorf("got units %v, want %v", unitNames, want)
+	}
+
+	defs, err := s.Defs(ByCommitIDs("c1"), ByUnits(unit.ID2{Type: "t", Name: "a/u"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 1 {
+		t.Fatalf("got %d defs, want 1", len(defs))
+	}
+	if d := defs[0]; d.Path != "p" || d.UnitType != "t" || d.Unit != "a/u" || d.CommitID != "c1" || len(d.Docs) != 1 || d.Docs[0].Data != "doc" {
+		t.Errorf("got def %+v, want p in unit t a/u at c1 with its doc", d)
+	}
+
+	refs, err := s.Refs(ByCommitIDs("c1"), ByRefDef(graph.RefDefKey{DefUnitType: "t", DefUnit: "a/u", DefPath: "p"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 || refs[0].Unit != "a/u" || refs[0].DefUnit != "a/u" {
+		t.Errorf("got refs %+v, want 1 ref in and to unit a/u", refs)
+	}
+
+	// Units without graph data have no defs.
+	defs, err = s.Defs(ByCommitIDs("c2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 0 {
+		t.Errorf("got defs %+v in c2, want none", defs)
+	}
+}
@@ -0,0 +1,442 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"unicode/utf8"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+// A Position is a line and column in a file. Lines and columns are
+// 1-indexed, and columns are measured in bytes (like
+// go/token.Position).
+type Position struct {
+	Line, Column int
+}
+
+func (p Position) String() string { return fmt.Sprintf("%d:%d", p.Line, p.Column) }
+
+// A LineTable records the byte offset at which each line of a file
+// begins, and the location of each multibyte UTF-8 character. It
+// translates between the byte offsets used by defs and refs and the
+// line/column positions used by editors.
+type LineTable struct {
+	// lines is the byte offset of the start of each line.
+	lines []uint32
+
+	// chars is the byte offset and UTF-8 length of each multibyte
+	// character, sorted by offset.
+	chars []multibyteChar
+}
+
+type multibyteChar struct {
+	offset uint32
+	size   uint8
+}
+
+// utf16Len returns the number of UTF-16 code units needed to encode
+// the character. Characters encoded in 4 UTF-8 bytes are outside the
+// Basic Multilingual Plane and need a surrogate pair.
+func (c multibyteChar) utf16Len() uint32 {
+	if c.size == 4 {
+		return 2
+	}
+	return 1
+}
+
+// NewLineTable returns the line table for a file whose contents are
+// src.
+func NewLineTable(src []byte) LineTable {
+	t := LineTable{lines: []uint32{0}}
+	for i := 0; i < len(src); {
+		c := src[i]
+		if c < utf8.RuneSelf {
+			if c == '\n' {
+				t.lines = append(t.lines, uint32(i+1))
+			}
+			i++
+			continue
+		}
+		_, size := utf8.DecodeRune(src[i:])
+		if size > 1 {
+			t.chars = append(t.chars, multibyteChar{offset: uint32(i), size: uint8(size)})
+		}
+		i += size
+	}
+	return t
+}
+
+// Lines returns the number of lines in the file.
+func (t LineTable) Lines() int { return len(t.lines) }
+
+// line returns the 0-indexed line that contains offset.
+func (t LineTable) line(offset uint32) (int, error) {
+	if len(t.lines) == 0 {
+		return 0, errors.New("empty line table")
+	}
+	return sort.Search(len(t.lines), func(i int) bool { return t.lines[i] > offset }) - 1, nil
+}
+
+// Position returns the line and column of the byte at offset.
+func (t LineTable) Position(offset uint32) (Position, error) {
+	line, err := t.line(offset)
+	if err != nil {
+		return Position{}, err
+	}
+	return Position{Line: line + 1, Column: int(offset-t.lines[line]) + 1}, nil
+}
+
+// Offset returns the byte offset of the line and column in pos. It is
+// the inverse of Position. The column is not checked against the
+// length of the line.
+func (t LineTable) Offset(pos Position) (uint32, error) {
+	if pos.Line < 1 || pos.Line > len(t.lines) {
+		return 0, fmt.Errorf("line %d out of range (file has %d lines)", pos.Line, len(t.lines))
+	}
+	if pos.Column < 1 {
+		return 0, fmt.Errorf("column %d out of range", pos.Column)
+	}
+	return t.lines[pos.Line-1] + uint32(pos.Column-1), nil
+}
+
+// LineRange returns the byte offsets of the start of the given
+// (1-indexed) line and of the start of the next line (or
+// math.MaxUint32 for the last line).
+func (t LineTable) LineRange(line int) (start, end uint32, err error) {
+	start, err = t.Offset(Position{Line: line, Column: 1})
+	if err != nil {
+		return 0, 0, err
+	}
+	if line < len(t.lines) {
+		return start, t.lines[line], nil
+	}
+	return start, ^uint32(0), nil
+}
+
+// A UTF16Position is a position as used by the Language Server
+// Protocol: Line and Character are 0-indexed, and Character is
+// measured in UTF-16 code units.
+type UTF16Position struct {
+	Line, Character int
+}
+
+func (p UTF16Position) String() string { return fmt.Sprintf("%d:%d", p.Line, p.Character) }
+
+// charsIn returns the multibyte characters that begin in the byte
+// range [start, end).
+func (t LineTable) charsIn(start, end uint32) []multibyteChar {
+	i := sort.Search(len(t.chars), func(i int) bool { return t.chars[i].offset >= start })
+	j := sort.Search(len(t.chars), func(i int) bool { return t.chars[i].offset >= end })
+	return t.chars[i:j]
+}
+
+// UTF16Position returns the LSP position of the byte at offset.
+func (t LineTable) UTF16Position(offset uint32) (UTF16Position, error) {
+	line, err := t.line(offset)
+	if err != nil {
+		return UTF16Position{}, err
+	}
+	start := t.lines[line]
+	col := offset - start
+	for _, c := range t.charsIn(start, offset) {
+		col -= uint32(c.size) - c.utf16Len()
+	}
+	return UTF16Position{Line: line, Character: int(col)}, nil
+}
+
+// UTF16Offset returns the byte offset of the LSP position pos. It is
+// the inverse of UTF16Position. A position in the middle of a
+// surrogate pair is mapped to the offset of the character.
+func (t LineTable) UTF16Offset(pos UTF16Position) (uint32, error) {
+	if pos.Line < 0 || pos.Line >= len(t.lines) {
+		return 0, fmt.Errorf("line %d out of range (file has %d lines)", pos.Line, len(t.lines))
+	}
+	if pos.Character < 0 {
+		return 0, fmt.Errorf("character %d out of range", pos.Character)
+	}
+	ofs := t.lines[pos.Line]
+	end := ^uint32(0)
+	if pos.Line+1 < len(t.lines) {
+		end = t.lines[pos.Line+1]
+	}
+	units := uint32(pos.Character)
+	for _, c := range t.charsIn(ofs, end) {
+		gap := c.offset - ofs
+		if units <= gap {
+			return ofs + units, nil
+		}
+		units -= gap
+		if units < c.utf16Len() {
+			return c.offset, nil
+		}
+		units -= c.utf16Len()
+		ofs = c.offset + uint32(c.size)
+	}
+	return ofs + units, nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. Offsets are
+// delta-encoded as uvarints, so the encoding is usually ~1 byte per
+// line (plus ~2 bytes per multibyte character).
+func (t LineTable) MarshalBinary() ([]byte, error) {
+	b := make([]byte, (2+len(t.lines)+2*len(t.chars))*binary.MaxVarintLen32)
+	n := binary.PutUvarint(b, uint64(len(t.lines)))
+	var prev uint32
+	for _, ofs := range t.lines {
+		n += binary.PutUvarint(b[n:], uint64(ofs-prev))
+		prev = ofs
+	}
+	n += binary.PutUvarint(b[n:], uint64(len(t.chars)))
+	prev = 0
+	for _, c := range t.chars {
+		n += binary.PutUvarint(b[n:], uint64(c.offset-prev))
+		b[n] = c.size
+		n++
+		prev = c.offset
+	}
+	return b[:n], nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (t *LineTable) UnmarshalBinary(b []byte) error {
+	errBad := errors.New("bad line table encoding")
+	next := func() (uint32, error) {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, errBad
+		}
+		b = b[n:]
+		return uint32(v), nil
+	}
+
+	// Each line is encoded in at least 1 byte, and each multibyte
+	// char in at least 2, so counts that b can't hold are rejected
+	// before they are allocated.
+	numLines, err := next()
+	if err != nil {
+		return err
+	}
+	if uint64(numLines) > uint64(len(b)) {
+		return errBad
+	}
+	t.lines = make([]uint32, numLines)
+	var prev uint32
+	for i := range t.lines {
+		delta, err := next()
+		if err != nil {
+			return err
+		}
+		prev += delta
+		t.lines[i] = prev
+	}
+
+	numChars, err := next()
+	if err != nil {
+		return err
+	}
+	if uint64(numChars) > uint64(len(b)/2) {
+		return errBad
+	}
+	t.chars = nil
+	if numChars > 0 {
+		t.chars = make([]multibyteChar, numChars)
+	}
+	prev = 0
+	for i := range t.chars {
+		delta, err := next()
+		if err != nil {
+			return err
+		}
+		if len(b) == 0 {
+			return errBad
+		}
+		prev += delta
+		t.chars[i] = multibyteChar{offset: prev, size: b[0]}
+		b = b[1:]
+	}
+	return nil
+}
+
+// A TreeLineTables stores the line tables of a tree's files.
+type TreeLineTables interface {
+	// ImportLineTables stores the line tables of files (keyed on
+	// file path). Line tables for other files that were previously
+	// imported are kept.
+	ImportLineTables(tables map[string]LineTable) error
+
+	// LineTable returns the line table for file. If there is none,
+	// an error satisfying os.IsNotExist is returned.
+	LineTable(file string) (LineTable, error)
+}
+
+// A RepoLineTables stores the line tables of files in a repo's trees.
+type RepoLineTables interface {
+	ImportLineTables(commitID string, tables map[string]LineTable) error
+	LineTable(commitID, file string) (LineTable, error)
+}
+
+// A MultiRepoLineTables stores the line tables of files in trees in
+// multiple repos.
+type MultiRepoLineTables interface {
+	ImportLineTables(repo, commitID string, tables map[string]LineTable) error
+	LineTable(repo, commitID, file string) (LineTable, error)
+}
+
+// lineTablesFilename is the name of the file (in a tree's dir) that
+// holds the line tables of all of the tree's files.
+const lineTablesFilename = "lines.dat"
+
+func (s *fsTreeStore) ImportLineTables(tables map[string]LineTable) error {
+	if err := rwvfs.MkdirAll(s.fs, "."); err != nil {
+		return err
+	}
+	if err := s.invalidateContentDigest(); err != nil {
+		return err
+	}
+	all, err := s.readLineTables()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if all == nil {
+		all = make(map[string]LineTable, len(tables))
+	}
+	for file, t := range tables {
+		all[file] = t
+	}
+	return s.writeLineTables(all)
+}
+
+func (s *fsTreeStore) LineTable(file string) (LineTable, error) {
+	all, err := s.readLineTables()
+	if err != nil {
+		return LineTable{}, err
+	}
+	t, present := all[file]
+	if !present {
+		return LineTable{}, &os.PathError{Op: "LineTable", Path: file, Err: os.ErrNotExist}
+	}
+	return t, nil
+}
+
+// writeLineTables writes the line tables file. Each entry consists of
+// the uvarint-prefixed file path followed by the uvarint-prefixed
+// binary encoding of its line table.
+func (s *fsTreeStore) writeLineTables(tables map[string]LineTable) (err error) {
+	files := make([]string, 0, len(tables))
+	for file := range tables {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	f, err := s.fs.Create(lineTablesFilename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := f.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	var lenBuf [binary.MaxVarintLen64]byte
+	writeBytes := func(b []byte) error {
+		n := binary.PutUvarint(lenBuf[:], uint64(len(b)))
+		if _, err := w.Write(lenBuf[:n]); err != nil {
+			return err
+		}
+		_, err := w.Write(b)
+		return err
+	}
+	for _, file := range files {
+		b, err := tables[file].MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if err := writeBytes([]byte(file)); err != nil {
+			return err
+		}
+		if err := writeBytes(b); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func (s *fsTreeStore) readLineTables() (tables map[string]LineTable, err error) {
+	f, err := s.fs.Open(lineTablesFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err2 := f.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+
+	r := bufio.NewReader(f)
+	readBytes := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(r, b)
+		return b, err
+	}
+	tables = map[string]LineTable{}
+	for {
+		file, err := readBytes()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		b, err := readBytes()
+		if err != nil {
+			return nil, err
+		}
+		var t LineTable
+		if err := t.UnmarshalBinary(b); err != nil {
+			return nil, err
+		}
+		tables[string(file)] = t
+	}
+	return tables, nil
+}
+
+func (s *fsRepoStore) ImportLineTables(commitID string, tables map[string]LineTable) error {
+	ts := s.newTreeStore(commitID).(TreeLineTables)
+	return ts.ImportLineTables(tables)
+}
+
+func (s *fsRepoStore) LineTable(commitID, file string) (LineTable, error) {
+	return s.newTreeStore(commitID).(TreeLineTables).LineTable(file)
+}
+
+func (s *fsMultiRepoStore) ImportLineTables(repo, commitID string, tables map[string]LineTable) error {
+	if err := s.CheckImportAllowed(repo, commitID); err != nil {
+		return err
+	}
+	if err := rwvfs.MkdirAll(s.fs, s.repoPath(repo)); err != nil {
+		return err
+	}
+	return s.openRepoStore(repo).(RepoLineTables).ImportLineTables(commitID, tables)
+}
+
+func (s *fsMultiRepoStore) LineTable(repo, commitID, file string) (LineTable, error) {
+	return s.openRepoStore(repo).(RepoLineTables).LineTable(commitID, file)
+}
+
+var (
+	_ TreeLineTables      = (*fsTreeStore)(nil)
+	_ RepoLineTables      = (*fsRepoStore)(nil)
+	_ MultiRepoLineTables = (*fsMultiRepoStore)(nil)
+)
@@ -0,0 +1,173 @@
+package store
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestLineTable(t *testing.T) {
+	src := []byte("ab\n\ncde\nf")
+	lt := NewLineTable(src)
+	if want := []uint32{0, 3, 4, 8}; !reflect.DeepEqual(lt.lines, want) {
+		t.Fatalf("got line table %v, want %v", lt, want)
+	}
+
+	tests := []struct {
+		offset uint32
+		pos    Position
+	}{
+		{0, Position{1, 1}},
+		{1, Position{1, 2}},
+		{2, Position{1, 3}},
+		{3, Position{2, 1}},
+		{4, Position{3, 1}},
+		{6, Position{3, 3}},
+		{8, Position{4, 1}},
+	}
+	for _, test := range tests {
+		pos, err := lt.Position(test.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pos != test.pos {
+			t.Errorf("Position(%d): got %v, want %v", test.offset, pos, test.pos)
+		}
+		ofs, err := lt.Offset(test.pos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ofs != test.offset {
+			t.Errorf("Offset(%v): got %d, want %d", test.pos, ofs, test.offset)
+		}
+	}
+
+	if _, err := lt.Offset(Position{5, 1}); err == nil {
+		t.Error("Offset: got nil error for out-of-range line")
+	}
+
+	b, err := lt.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lt2 LineTable
+	if err := lt2.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(lt2, lt) {
+		t.Errorf("after round-trip: got %v, want %v", lt2, lt)
+	}
+}
+
+func TestLineTable_UTF16(t *testing.T) {
+	// "é" is 2 bytes in UTF-8 and 1 UTF-16 code unit; "世" is 3
+	// bytes and 1 code unit; "😀" is 4 bytes and 2 code units (a
+	// surrogate pair).
+	src := []byte("aé世b\n😀x\ny")
+	lt := NewLineTable(src)
+
+	tests := []struct {
+		offset uint32
+		pos    UTF16Position
+	}{
+		{0, UTF16Position{0, 0}},  // a
+		{1, UTF16Position{0, 1}},  // é
+		{3, UTF16Position{0, 2}},  // 世
+		{6, UTF16Position{0, 3}},  // b
+		{7, UTF16Position{0, 4}},  // \n
+		{8, UTF16Position{1, 0}},  // 😀
+		{12, UTF16Position{1, 2}}, // x
+		{14, UTF16Position{2, 0}}, // y
+	}
+	for _, test := range tests {
+		pos, err := lt.UTF16Position(test.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pos != test.pos {
+			t.Errorf("UTF16Position(%d): got %v, want %v", test.offset, pos, test.pos)
+		}
+		ofs, err := lt.UTF16Offset(test.pos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ofs != test.offset {
+			t.Errorf("UTF16Offset(%v): got %d, want %d", test.pos, ofs, test.offset)
+		}
+	}
+
+	// A position in the middle of a surrogate pair maps to the start
+	// of the character.
+	if ofs, err := lt.UTF16Offset(UTF16Position{1, 1}); err != nil || ofs != 8 {
+		t.Errorf("UTF16Offset(1:1): got %d (err %v), want 8", ofs, err)
+	}
+
+	// Byte columns are unaffected by multibyte characters.
+	if pos, err := lt.Position(6); err != nil || pos != (Position{1, 7}) {
+		t.Errorf("Position(6): got %v (err %v), want 1:7", pos, err)
+	}
+
+	b, err := lt.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lt2 LineTable
+	if err := lt2.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(lt2, lt) {
+		t.Errorf("after round-trip: got %+v, want %+v", lt2, lt)
+	}
+}
+
+func TestLineTable_UnmarshalBinary_badCounts(t *testing.T) {
+	uvarints := func(vs ...uint64) []byte {
+		var b []byte
+		for _, v := range vs {
+			buf := make([]byte, binary.MaxVarintLen64)
+			b = append(b, buf[:binary.PutUvarint(buf, v)]...)
+		}
+		return b
+	}
+	tests := map[string][]byte{
+		"lines": uvarints(math.MaxUint32),
+		"chars": uvarints(1, 0, math.MaxUint32, 1),
+	}
+	for label, b := range tests {
+		var lt LineTable
+		if err := lt.UnmarshalBinary(b); err == nil {
+			t.Errorf("%s: got nil error, want error", label)
+		}
+	}
+}
+
+func TestFSMultiRepoStore_LineTables(t *testing.T) {
+	mrs := NewFSMultiRepoStore(newTestFS(), nil).(MultiRepoLineTables)
+
+	if _, err := mrs.LineTable("r", "c", "f"); !os.IsNotExist(err) {
+		t.Errorf("LineTable before import: got error %v, want not-exist", err)
+	}
+
+	if err := mrs.ImportLineTables("r", "c", map[string]LineTable{"f1": NewLineTable([]byte("a\nb"))}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mrs.ImportLineTables("r", "c", map[string]LineTable{"f2": NewLineTable([]byte("a\nb\nc"))}); err != nil {
+		t.Fatal(err)
+	}
+
+	for file, want := range map[string][]uint32{"f1": {0, 2}, "f2": {0, 2, 4}} {
+		lt, err := mrs.LineTable("r", "c", file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(lt.lines, want) {
+			t.Errorf("%s: got line offsets %v, want %v", file, lt.lines, want)
+		}
+	}
+
+	if _, err := mrs.LineTable("r", "c", "f3"); !os.IsNotExist(err) {
+		t.Errorf("LineTable for missing file: got error %v, want not-exist", err)
+	}
+}
@@ -0,0 +1,329 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kr/fs"
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+// A TreeManifest lists the files that make up a tree (its data files
+// and index files). It is written when the tree's version is created
+// (and rewritten when the tree is reindexed), so that store
+// management operations (sync, shared data GC, verification, and
+// bundle extraction) can find a tree's files without walking its
+// directory, which is slow on remote VFSs.
+type TreeManifest struct {
+	// Files are the tree's files, sorted by path.
+	Files []TreeManifestFile
+}
+
+// A TreeManifestFile describes a file in a tree.
+type TreeManifestFile struct {
+	Path   string // path relative to the tree's dir
+	Size   int64  // size in bytes
+	SHA256 string // hex-encoded SHA-256 digest of the contents
+	Index  bool   // whether the file is an index (derived data)
+}
+
+// File returns the entry for the file at path, or nil if the manifest
+// doesn't list it.
+func (m *TreeManifest) File(path string) *TreeManifestFile {
+	i := sort.Search(len(m.Files), func(i int) bool { return m.Files[i].Path >= path })
+	if i < len(m.Files) && m.Files[i].Path == path {
+		return &m.Files[i]
+	}
+	return nil
+}
+
+// DataFiles returns the entries for the tree's data (non-index) files.
+func (m *TreeManifest) DataFiles() []TreeManifestFile {
+	var files []TreeManifestFile
+	for _, f := range m.Files {
+		if !f.Index {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// sameData reports whether m and m2 list the same data files with the
+// same contents.
+func (m *TreeManifest) sameData(m2 *TreeManifest) bool {
+	a, b := m.DataFiles(), m2.DataFiles()
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ErrNoTreeManifest is returned by TreeManifest when the tree has no
+// manifest (e.g., because its version hasn't been created yet, or
+// because data was imported into it after its version was created).
+var ErrNoTreeManifest = errors.New("tree has no manifest")
+
+// A TreeManifestMismatch describes a difference between a tree's
+// manifest and its files, as found by VerifyTreeManifest.
+type TreeManifestMismatch struct {
+	Path string
+
+	// Problem is "missing" (the file is listed but doesn't exist),
+	// "unlisted" (the file exists but isn't listed), "size", or
+	// "checksum".
+	Problem string
+}
+
+func (m TreeManifestMismatch) String() string { return m.Path + ": " + m.Problem }
+
+// A TreeManifests writes and reads a tree's manifest.
+type TreeManifests interface {
+	// WriteTreeManifest lists the tree's files and writes its
+	// manifest.
+	WriteTreeManifest() (*TreeManifest, error)
+
+	// TreeManifest returns the tree's manifest. If it has none,
+	// ErrNoTreeManifest is returned.
+	TreeManifest() (*TreeManifest, error)
+
+	// VerifyTreeManifest compares the tree's manifest to its files
+	// and returns the differences.
+	VerifyTreeManifest() ([]TreeManifestMismatch, error)
+}
+
+// A RepoTreeManifests writes and reads the manifests of a repo's
+// trees.
+type RepoTreeManifests interface {
+	WriteTreeManifest(commitID string) (*TreeManifest, error)
+	TreeManifest(commitID string) (*TreeManifest, error)
+	VerifyTreeManifest(commitID string) ([]TreeManifestMismatch, error)
+}
+
+// A MultiRepoTreeManifests writes and reads the manifests of trees in
+// multiple repos.
+type MultiRepoTreeManifests interface {
+	WriteTreeManifest(repo, commitID string) (*TreeManifest, error)
+	TreeManifest(repo, commitID string) (*TreeManifest, error)
+	VerifyTreeManifest(repo, commitID string) ([]TreeManifestMismatch, error)
+}
+
+// treeManifestFilename is the name of the file (in a tree's dir) that
+// holds the tree's manifest. It is removed whenever data is imported
+// into the tree (see invalidateContentDigest).
+const treeManifestFilename = "manifest.json"
+
+// isTreeManifestFile reports whether the file at the given path (in a
+// tree's dir) is listed in the tree's manifest. Files that are
+// written after the manifest (or that describe it) and transient
+// files are excluded.
+func isTreeManifestFile(path string) bool {
+	switch path {
+	case treeManifestFilename, contentDigestFilename, treeSignatureFilename, indexCheckpointName:
+		return false
+	}
+	return true
+}
+
+// listTreeFiles walks the tree's dir and returns its files (without
+// their checksums), sorted by path.
+func (s *fsTreeStore) listTreeFiles() ([]TreeManifestFile, error) {
+	var files []TreeManifestFile
+	w := fs.WalkFS(".", rwvfs.Walkable(s.fs))
+	for w.Step() {
+		if err := w.Err(); err != nil {
+			return nil, err
+		}
+		path := filepath.ToSlash(w.Path())
+		if fi := w.Stat(); fi.Mode().IsRegular() && isTreeManifestFile(path) {
+			files = append(files, TreeManifestFile{Path: path, Size: fi.Size(), Index: strings.HasSuffix(path, ".idx")})
+		}
+	}
+	sort.Sort(treeManifestFiles(files))
+	return files, nil
+}
+
+type treeManifestFiles []TreeManifestFile
+
+func (v treeManifestFiles) Len() int           { return len(v) }
+func (v treeManifestFiles) Less(i, j int) bool { return v[i].Path < v[j].Path }
+func (v treeManifestFiles) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+
+// fileSHA256 returns the hex-encoded SHA-256 digest of the file's
+// contents.
+func (s *fsTreeStore) fileSHA256(name string) (string, error) {
+	f, err := s.fs.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (s *fsTreeStore) WriteTreeManifest() (m *TreeManifest, err error) {
+	if _, err := s.fs.Stat("."); err != nil {
+		if os.IsNotExist(err) {
+			return nil, errTreeNoInit
+		}
+		return nil, err
+	}
+	files, err := s.listTreeFiles()
+	if err != nil {
+		return nil, err
+	}
+	for i := range files {
+		if files[i].SHA256, err = s.fileSHA256(files[i].Path); err != nil {
+			return nil, err
+		}
+	}
+	m = &TreeManifest{Files: files}
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	f, err := s.fs.Create(treeManifestFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err2 := f.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+	if _, err := f.Write(b); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (s *fsTreeStore) TreeManifest() (*TreeManifest, error) {
+	f, err := s.fs.Open(treeManifestFilename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoTreeManifest
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var m TreeManifest
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", treeManifestFilename, err)
+	}
+	return &m, nil
+}
+
+func (s *fsTreeStore) VerifyTreeManifest() ([]TreeManifestMismatch, error) {
+	m, err := s.TreeManifest()
+	if err != nil {
+		return nil, err
+	}
+	files, err := s.listTreeFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	var mismatches []TreeManifestMismatch
+	exists := make(map[string]struct{}, len(files))
+	for _, f := range files {
+		exists[f.Path] = struct{}{}
+		want := m.File(f.Path)
+		if want == nil {
+			mismatches = append(mismatches, TreeManifestMismatch{Path: f.Path, Problem: "unlisted"})
+			continue
+		}
+		if f.Size != want.Size {
+			mismatches = append(mismatches, TreeManifestMismatch{Path: f.Path, Problem: "size"})
+			continue
+		}
+		sum, err := s.fileSHA256(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		if sum != want.SHA256 {
+			mismatches = append(mismatches, TreeManifestMismatch{Path: f.Path, Problem: "checksum"})
+		}
+	}
+	for _, f := range m.Files {
+		if _, present := exists[f.Path]; !present {
+			mismatches = append(mismatches, TreeManifestMismatch{Path: f.Path, Problem: "missing"})
+		}
+	}
+	sort.Sort(treeManifestMismatches(mismatches))
+	return mismatches, nil
+}
+
+type treeManifestMismatches []TreeManifestMismatch
+
+func (v treeManifestMismatches) Len() int           { return len(v) }
+func (v treeManifestMismatches) Less(i, j int) bool { return v[i].Path < v[j].Path }
+func (v treeManifestMismatches) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+
+// refreshTreeManifest rewrites the tree's manifest if it has one (e.g.,
+// because the tree's indexes were rebuilt after its version was
+// created).
+func (s *fsTreeStore) refreshTreeManifest() error {
+	if _, err := s.fs.Stat(treeManifestFilename); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	_, err := s.WriteTreeManifest()
+	return err
+}
+
+// removeTreeManifest removes the tree's manifest. It must be called
+// before the tree's imported data is modified.
+func (s *fsTreeStore) removeTreeManifest() error {
+	if err := s.fs.Remove(treeManifestFilename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *fsRepoStore) WriteTreeManifest(commitID string) (*TreeManifest, error) {
+	return s.newTreeStore(commitID).(TreeManifests).WriteTreeManifest()
+}
+
+func (s *fsRepoStore) TreeManifest(commitID string) (*TreeManifest, error) {
+	return s.newTreeStore(commitID).(TreeManifests).TreeManifest()
+}
+
+func (s *fsRepoStore) VerifyTreeManifest(commitID string) ([]TreeManifestMismatch, error) {
+	return s.newTreeStore(commitID).(TreeManifests).VerifyTreeManifest()
+}
+
+func (s *fsMultiRepoStore) WriteTreeManifest(repo, commitID string) (*TreeManifest, error) {
+	return s.openRepoStore(repo).(RepoTreeManifests).WriteTreeManifest(commitID)
+}
+
+func (s *fsMultiRepoStore) TreeManifest(repo, commitID string) (*TreeManifest, error) {
+	return s.openRepoStore(repo).(RepoTreeManifests).TreeManifest(commitID)
+}
+
+func (s *fsMultiRepoStore) VerifyTreeManifest(repo, commitID string) ([]TreeManifestMismatch, error) {
+	return s.openRepoStore(repo).(RepoTreeManifests).VerifyTreeManifest(commitID)
+}
+
+var (
+	_ TreeManifests          = (*fsTreeStore)(nil)
+	_ RepoTreeManifests      = (*fsRepoStore)(nil)
+	_ MultiRepoTreeManifests = (*fsMultiRepoStore)(nil)
+)
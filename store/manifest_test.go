@@ -0,0 +1,92 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFSMultiRepoStore_TreeManifest(t *testing.T) {
+	mrs := NewFSMultiRepoStore(newTestFS(), nil)
+	ms := mrs.(MultiRepoTreeManifests)
+	treeFS := mrs.(*fsMultiRepoStore).openRepoStore("r").(*fsRepoStore).treeStoreFS("c")
+
+	testSyncImport(t, mrs, "r", "c", "u1")
+	m, err := ms.TreeManifest("r", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dataFiles []string
+	for _, f := range m.DataFiles() {
+		if f.SHA256 == "" {
+			t.Errorf("%s: no checksum", f.Path)
+		}
+		dataFiles = append(dataFiles, f.Path)
+	}
+	for _, want := range []string{"u1/t.unit.json", "u1/t/def.dat", "u1/t/ref.dat"} {
+		if m.File(want) == nil {
+			t.Errorf("manifest does not list %s (data files: %v)", want, dataFiles)
+		}
+	}
+	if mm, err := ms.VerifyTreeManifest("r", "c"); err != nil || len(mm) != 0 {
+		t.Errorf("VerifyTreeManifest: got %v, %v, want no mismatches", mm, err)
+	}
+
+	// Listing units uses the manifest.
+	units, err := mrs.Units()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(units) != 1 {
+		t.Errorf("got %d units, want 1", len(units))
+	}
+
+	// Reindexing refreshes the manifest.
+	if err := mrs.Index("r", "c"); err != nil {
+		t.Fatal(err)
+	}
+	m2, err := ms.TreeManifest("r", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m2.sameData(m) {
+		t.Error("data files changed after reindexing")
+	}
+	if mm, err := ms.VerifyTreeManifest("r", "c"); err != nil || len(mm) != 0 {
+		t.Errorf("VerifyTreeManifest after reindexing: got %v, %v, want no mismatches", mm, err)
+	}
+
+	// Changed, added, and removed files are reported.
+	writeFile := func(name, data string) {
+		f, err := treeFS.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("u1/t/def.dat", "x")
+	writeFile("extra", "x")
+	if err := treeFS.Remove("u1/t/ref.dat"); err != nil {
+		t.Fatal(err)
+	}
+	mm, err := ms.VerifyTreeManifest("r", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TreeManifestMismatch{{"extra", "unlisted"}, {"u1/t/def.dat", "size"}, {"u1/t/ref.dat", "missing"}}
+	if !reflect.DeepEqual(mm, want) {
+		t.Errorf("got mismatches %v, want %v", mm, want)
+	}
+
+	// Importing data removes the (now stale) manifest.
+	if err := mrs.(MultiRepoLineTables).ImportLineTables("r", "c", map[string]LineTable{"f": NewLineTable([]byte("a"))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms.TreeManifest("r", "c"); err != ErrNoTreeManifest {
+		t.Errorf("TreeManifest after import: got error %v, want ErrNoTreeManifest", err)
+	}
+}
@@ -24,6 +24,9 @@ func newMemoryMultiRepoStore() *memoryMultiRepoStore {
 var errMultiRepoStoreNoInit = errors.New("multi-repo store not yet initialized")
 
 func (s *memoryMultiRepoStore) Repos(f ...RepoFilter) ([]string, error) {
+	if repos, paged, err := PagedRepos(s.Repos, f); paged {
+		return repos, err
+	}
 	if s.repos == nil {
 		return nil, errMultiRepoStoreNoInit
 	}
@@ -164,6 +167,9 @@ func newMemoryTreeStore() *memoryTreeStore {
 var errTreeNoInit = errors.New("tree not yet initialized")
 
 func (s *memoryTreeStore) Units(f ...UnitFilter) ([]*unit.SourceUnit, error) {
+	if units, paged, err := PagedUnits(s.Units, f); paged {
+		return units, err
+	}
 	if s.units == nil {
 		return nil, errTreeNoInit
 	}
@@ -228,6 +234,9 @@ type memoryUnitStore struct {
 var errUnitNoInit = errors.New("unit not yet initialized")
 
 func (s *memoryUnitStore) Defs(f ...DefFilter) ([]*graph.Def, error) {
+	if defs, paged, err := PagedDefs(s.Defs, f); paged {
+		return defs, err
+	}
 	if s.data == nil {
 		return nil, errUnitNoInit
 	}
@@ -248,6 +257,9 @@ func (s *memoryUnitStore) Defs(f ...DefFilter) ([]*graph.Def, error) {
 }
 
 func (s *memoryUnitStore) Refs(f ...RefFilter) ([]*graph.Ref, error) {
+	if refs, paged, err := PagedRefs(s.Refs, f); paged {
+		return refs, err
+	}
 	if s.data == nil {
 		return nil, errUnitNoInit
 	}
@@ -0,0 +1,447 @@
+package store
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// A Middleware wraps a MultiRepoStore to add cross-cutting behavior
+// (such as logging, metrics, caching, or authorization) to its
+// queries. Middlewares are composed with Chain.
+//
+// The store returned by a Middleware only needs to implement
+// MultiRepoStore; other interfaces that the wrapped store implements
+// (such as MultiRepoImporter) may be hidden, so import into the
+// underlying store directly.
+type Middleware func(MultiRepoStore) MultiRepoStore
+
+// Chain returns a MultiRepoStore that performs queries on s through
+// the middlewares. The first middleware is the outermost: it sees
+// each query first, and it sees the results last. For example,
+//
+//	Chain(s, LoggingMiddleware(sink, nil), AuthzMiddleware(authz), CacheMiddleware(1000))
+//
+// logs each query (including the time spent authorizing it), then
+// restricts it to the authorized repos, and then looks up its results
+// in the cache (keyed by the authorized query), performing it on s on
+// a cache miss.
+//
+// Middlewares that keep state across queries (such as the cache of
+// CacheMiddleware) keep it in the store they return, so a chain that
+// includes them should be created once and shared, not created for
+// each request. Per-request middlewares (such as AuthzMiddleware with
+// an authorizer for the current user) can be chained in front of a
+// shared chain.
+func Chain(s MultiRepoStore, mws ...Middleware) MultiRepoStore {
+	for i := len(mws) - 1; i >= 0; i-- {
+		s = mws[i](s)
+	}
+	return s
+}
+
+// LoggingMiddleware returns a Middleware that logs each query to sink
+// (see NewQueryLoggingStore).
+func LoggingMiddleware(sink QueryLogSink, bytesRead func() int64) Middleware {
+	return func(s MultiRepoStore) MultiRepoStore {
+		return NewQueryLoggingStore(s, sink, bytesRead)
+	}
+}
+
+// SlowQueryLoggingMiddleware returns a Middleware that logs slow
+// queries (see NewSlowQueryLoggingStore).
+func SlowQueryLoggingMiddleware(opt SlowQueryLogOptions) Middleware {
+	return func(s MultiRepoStore) MultiRepoStore {
+		return NewSlowQueryLoggingStore(s, opt)
+	}
+}
+
+// AuthzMiddleware returns a Middleware that restricts queries to the
+// repos that authz authorizes (see NewAuthorizedMultiRepoStore).
+func AuthzMiddleware(authz RepoAuthorizer) Middleware {
+	return func(s MultiRepoStore) MultiRepoStore {
+		return NewAuthorizedMultiRepoStore(s, authz)
+	}
+}
+
+// SingleflightMiddleware returns a Middleware that shares the
+// execution of concurrent identical queries (see
+// NewSingleflightStore).
+func SingleflightMiddleware() Middleware {
+	return NewSingleflightStore
+}
+
+// ShadowReadMiddleware returns a Middleware that verifies a sample of
+// the queries' indexed results against full scans (see
+// NewShadowReadStore).
+func ShadowReadMiddleware(opt ShadowReadOptions) Middleware {
+	return func(s MultiRepoStore) MultiRepoStore {
+		return NewShadowReadStore(s, opt)
+	}
+}
+
+// A QueryInterceptor is called for each query that passes through an
+// InterceptQueries middleware. Op is the name of the MultiRepoStore
+// method being called (e.g., "Defs"), and filters are the query's
+// filters.
+//
+// The interceptor performs the query by calling query, which returns
+// the number of results and the query's error. It may do work before
+// and after the call, and it may abort the query by returning an error
+// without calling query. Otherwise it should return the error that
+// query returned. It must not call query more than once.
+type QueryInterceptor func(op string, filters []interface{}, query func() (results int, err error)) error
+
+// InterceptQueries returns a Middleware that calls fn for each query.
+// It is the simplest way to write custom middleware that observes or
+// gates queries without implementing all of MultiRepoStore's methods.
+func InterceptQueries(fn QueryInterceptor) Middleware {
+	return func(s MultiRepoStore) MultiRepoStore {
+		return &interceptingStore{s: s, fn: fn}
+	}
+}
+
+type interceptingStore struct {
+	s  MultiRepoStore
+	fn QueryInterceptor
+}
+
+var _ MultiRepoStore = (*interceptingStore)(nil)
+
+func (s *interceptingStore) Repos(f ...RepoFilter) (repos []string, err error) {
+	err = s.fn("Repos", storeFilters(f), func() (int, error) {
+		repos, err = s.s.Repos(f...)
+		return len(repos), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return repos, nil
+}
+
+func (s *interceptingStore) Versions(f ...VersionFilter) (versions []*Version, err error) {
+	err = s.fn("Versions", storeFilters(f), func() (int, error) {
+		versions, err = s.s.Versions(f...)
+		return len(versions), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+func (s *interceptingStore) Units(f ...UnitFilter) (units []*unit.SourceUnit, err error) {
+	err = s.fn("Units", storeFilters(f), func() (int, error) {
+		units, err = s.s.Units(f...)
+		return len(units), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return units, nil
+}
+
+func (s *interceptingStore) Defs(f ...DefFilter) (defs []*graph.Def, err error) {
+	err = s.fn("Defs", storeFilters(f), func() (int, error) {
+		defs, err = s.s.Defs(f...)
+		return len(defs), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return defs, nil
+}
+
+func (s *interceptingStore) Refs(f ...RefFilter) (refs []*graph.Ref, err error) {
+	err = s.fn("Refs", storeFilters(f), func() (int, error) {
+		refs, err = s.s.Refs(f...)
+		return len(refs), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+func (s *interceptingStore) generation() uint64 { return generationOf(s.s) }
+
+func (s *interceptingStore) clock() Clock { return clockOf(s.s) }
+
+func (s *interceptingStore) String() string { return fmt.Sprintf("intercepting(%v)", s.s) }
+
+// QueryMetrics collects per-operation query metrics (see
+// MetricsMiddleware). It is safe for concurrent use. The zero value is
+// ready to use.
+type QueryMetrics struct {
+	mu  sync.Mutex
+	ops map[string]*QueryOpMetrics
+}
+
+// QueryOpMetrics are the metrics of the queries of one kind (e.g.,
+// "Defs").
+type QueryOpMetrics struct {
+	Count    int           // number of queries
+	Errors   int           // number of queries that failed
+	Results  int           // total number of results returned
+	Duration time.Duration // total duration of the queries
+}
+
+func (m *QueryMetrics) record(op string, results int, err error, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ops == nil {
+		m.ops = map[string]*QueryOpMetrics{}
+	}
+	om := m.ops[op]
+	if om == nil {
+		om = &QueryOpMetrics{}
+		m.ops[op] = om
+	}
+	om.Count++
+	if err != nil {
+		om.Errors++
+	}
+	om.Results += results
+	om.Duration += d
+}
+
+// Snapshot returns the current metrics, keyed by operation name.
+func (m *QueryMetrics) Snapshot() map[string]QueryOpMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snap := make(map[string]QueryOpMetrics, len(m.ops))
+	for op, om := range m.ops {
+		snap[op] = *om
+	}
+	return snap
+}
+
+// String returns a one-line summary of the metrics.
+func (m *QueryMetrics) String() string {
+	snap := m.Snapshot()
+	ops := make([]string, 0, len(snap))
+	for op := range snap {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	var s string
+	for i, op := range ops {
+		if i > 0 {
+			s += ", "
+		}
+		om := snap[op]
+		s += fmt.Sprintf("%s: %d queries (%d errors, %d results, %s)", op, om.Count, om.Errors, om.Results, om.Duration)
+	}
+	return s
+}
+
+// MetricsMiddleware returns a Middleware that records the count,
+// errors, results, and duration of each query in m. Durations are
+// measured with the clock of the wrapped store.
+func MetricsMiddleware(m *QueryMetrics) Middleware {
+	return func(s MultiRepoStore) MultiRepoStore {
+		clock := clockOf(s)
+		return InterceptQueries(func(op string, _ []interface{}, query func() (int, error)) error {
+			start := clock.Now()
+			n, err := query()
+			m.record(op, n, err, clock.Now().Sub(start))
+			return err
+		})(s)
+	}
+}
+
+// CacheMiddleware returns a Middleware that caches the results of up
+// to maxEntries queries (evicting the least recently used). Each store
+// it returns has its own cache.
+//
+// Queries are cached by their kind and filters (see
+// NewSingleflightStore for which queries can be compared), and cached
+// results are discarded when data is written to the wrapped store.
+// (Only writes made through the store returned by NewFSMultiRepoStore,
+// in this process, are observed; results of stores that don't track
+// writes are cached until they are evicted.) Failed queries are not
+// cached.
+//
+// Each caller receives its own slice and its own shallow copies of the
+// results' structs, as with NewSingleflightStore.
+func CacheMiddleware(maxEntries int) Middleware {
+	return func(s MultiRepoStore) MultiRepoStore {
+		return &cachingStore{s: s, max: maxEntries, lru: list.New(), m: map[string]*list.Element{}}
+	}
+}
+
+type cachingStore struct {
+	s   MultiRepoStore
+	max int
+
+	mu  sync.Mutex
+	gen uint64                   // the write generation of s when the cached results were added
+	lru *list.List               // of *cachedQuery, most recently used first
+	m   map[string]*list.Element // query key -> element in lru
+}
+
+type cachedQuery struct {
+	key     string
+	results interface{}
+}
+
+var _ MultiRepoStore = (*cachingStore)(nil)
+
+// get returns the cached results of the query with the given key.
+func (s *cachingStore) get(key string) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.discardStale()
+	e, present := s.m[key]
+	if !present {
+		return nil, false
+	}
+	s.lru.MoveToFront(e)
+	return e.Value.(*cachedQuery).results, true
+}
+
+// add caches the results of the query with the given key.
+func (s *cachingStore) add(key string, results interface{}) {
+	if s.max <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.discardStale()
+	if e, present := s.m[key]; present {
+		e.Value.(*cachedQuery).results = results
+		s.lru.MoveToFront(e)
+		return
+	}
+	s.m[key] = s.lru.PushFront(&cachedQuery{key: key, results: results})
+	for s.lru.Len() > s.max {
+		e := s.lru.Back()
+		s.lru.Remove(e)
+		delete(s.m, e.Value.(*cachedQuery).key)
+	}
+}
+
+// discardStale empties the cache if data was written to s since the
+// cached results were added. (Keys include the write generation, so
+// stale results would never be returned, but they would take up
+// space.) The caller must hold s.mu.
+func (s *cachingStore) discardStale() {
+	if gen := generationOf(s.s); gen != s.gen {
+		s.gen = gen
+		s.lru.Init()
+		s.m = map[string]*list.Element{}
+	}
+}
+
+// query returns the (copied) cached results of the query of kind op
+// with the given filters, or performs the query by calling fn and
+// caches its results.
+func (s *cachingStore) query(op string, filters interface{}, fn func() (interface{}, error)) (interface{}, error) {
+	key, ok := queryKey(s.s, op, filters)
+	if !ok {
+		return fn()
+	}
+	if results, present := s.get(key); present {
+		return copyQueryResults(results), nil
+	}
+	results, err := fn()
+	if err != nil {
+		return nil, err
+	}
+	s.add(key, results)
+	return copyQueryResults(results), nil
+}
+
+func (s *cachingStore) Repos(f ...RepoFilter) ([]string, error) {
+	v, err := s.query("Repos", f, func() (interface{}, error) { return s.s.Repos(f...) })
+	repos, _ := v.([]string)
+	return repos, err
+}
+
+func (s *cachingStore) Versions(f ...VersionFilter) ([]*Version, error) {
+	v, err := s.query("Versions", f, func() (interface{}, error) { return s.s.Versions(f...) })
+	versions, _ := v.([]*Version)
+	return versions, err
+}
+
+func (s *cachingStore) Units(f ...UnitFilter) ([]*unit.SourceUnit, error) {
+	v, err := s.query("Units", f, func() (interface{}, error) { return s.s.Units(f...) })
+	units, _ := v.([]*unit.SourceUnit)
+	return units, err
+}
+
+func (s *cachingStore) Defs(f ...DefFilter) ([]*graph.Def, error) {
+	v, err := s.query("Defs", f, func() (interface{}, error) { return s.s.Defs(f...) })
+	defs, _ := v.([]*graph.Def)
+	return defs, err
+}
+
+func (s *cachingStore) Refs(f ...RefFilter) ([]*graph.Ref, error) {
+	v, err := s.query("Refs", f, func() (interface{}, error) { return s.s.Refs(f...) })
+	refs, _ := v.([]*graph.Ref)
+	return refs, err
+}
+
+func (s *cachingStore) generation() uint64 { return generationOf(s.s) }
+
+func (s *cachingStore) clock() Clock { return clockOf(s.s) }
+
+func (s *cachingStore) String() string { return fmt.Sprintf("caching(%v)", s.s) }
+
+// copyQueryResults returns a copy of the results of a query: a new
+// slice holding shallow copies of the results' structs.
+func copyQueryResults(results interface{}) interface{} {
+	switch rs := results.(type) {
+	case []string:
+		if rs == nil {
+			return rs
+		}
+		return append([]string{}, rs...)
+	case []*Version:
+		if rs == nil {
+			return rs
+		}
+		cp := make([]*Version, len(rs))
+		for i, v := range rs {
+			v2 := *v
+			cp[i] = &v2
+		}
+		return cp
+	case []*unit.SourceUnit:
+		if rs == nil {
+			return rs
+		}
+		cp := make([]*unit.SourceUnit, len(rs))
+		for i, u := range rs {
+			u2 := *u
+			cp[i] = &u2
+		}
+		return cp
+	case []*graph.Def:
+		if rs == nil {
+			return rs
+		}
+		cp := make([]*graph.Def, len(rs))
+		for i, def := range rs {
+			def2 := *def
+			cp[i] = &def2
+		}
+		return cp
+	case []*graph.Ref:
+		if rs == nil {
+			return rs
+		}
+		cp := make([]*graph.Ref, len(rs))
+		for i, ref := range rs {
+			ref2 := *ref
+			cp[i] = &ref2
+		}
+		return cp
+	}
+	return results
+}
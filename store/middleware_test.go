@@ -0,0 +1,147 @@
+package store
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestChain(t *testing.T) {
+	var calls []string
+	record := func(name string) Middleware {
+		return InterceptQueries(func(op string, _ []interface{}, query func() (int, error)) error {
+			calls = append(calls, name+" "+op)
+			_, err := query()
+			calls = append(calls, name+" done")
+			return err
+		})
+	}
+	mock := MockMultiRepoStore{Repos_: func(...RepoFilter) ([]string, error) {
+		calls = append(calls, "store")
+		return []string{"r"}, nil
+	}}
+	s := Chain(mock, record("a"), record("b"))
+	if _, err := s.Repos(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a Repos", "b Repos", "store", "b done", "a done"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("got calls %v, want %v", calls, want)
+	}
+
+	// An interceptor can abort a query.
+	errDenied := errors.New("denied")
+	calls = nil
+	s = Chain(mock, InterceptQueries(func(string, []interface{}, func() (int, error)) error { return errDenied }))
+	if repos, err := s.Repos(); err != errDenied || repos != nil {
+		t.Errorf("got repos %v and error %v, want nil and %v", repos, err, errDenied)
+	}
+	if len(calls) != 0 {
+		t.Errorf("aborted query called the store: %v", calls)
+	}
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	errQuery := errors.New("x")
+	mock := MockMultiRepoStore{
+		Defs_: func(...DefFilter) ([]*graph.Def, error) { return []*graph.Def{{}, {}}, nil },
+		Refs_: func(...RefFilter) ([]*graph.Ref, error) { return nil, errQuery },
+	}
+	var m QueryMetrics
+	s := Chain(mock, MetricsMiddleware(&m))
+	s.Defs()
+	s.Defs()
+	s.Refs()
+	snap := m.Snapshot()
+	if got, want := snap["Defs"], (QueryOpMetrics{Count: 2, Results: 4, Duration: snap["Defs"].Duration}); got != want {
+		t.Errorf("got Defs metrics %+v, want %+v", got, want)
+	}
+	if got := snap["Refs"]; got.Count != 1 || got.Errors != 1 {
+		t.Errorf("got Refs metrics %+v, want 1 failed query", got)
+	}
+}
+
+func TestCacheMiddleware(t *testing.T) {
+	fss := NewFSMultiRepoStore(newTestFS(), nil)
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
+	importDefs := func(paths ...string) {
+		var data graph.Output
+		for _, p := range paths {
+			data.Defs = append(data.Defs, &graph.Def{DefKey: graph.DefKey{Path: p}})
+		}
+		if err := fss.Import("r", "c", u, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := fss.CreateVersion("r", "c"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	importDefs("p")
+
+	var m QueryMetrics
+	s := Chain(fss, CacheMiddleware(1), MetricsMiddleware(&m))
+	queries := func() int { return m.Snapshot()["Defs"].Count }
+
+	defs1, err := s.Defs(ByRepos("r"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defs2, err := s.Defs(ByRepos("r"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := queries(); n != 1 {
+		t.Errorf("got %d queries, want 1 (cache hit)", n)
+	}
+	if !reflect.DeepEqual(defs1, defs2) {
+		t.Errorf("cached defs %v differ from %v", defs2, defs1)
+	}
+	if defs1[0] == defs2[0] {
+		t.Error("cached defs are shared between callers")
+	}
+
+	// Queries with incomparable filters aren't cached.
+	f := DefFilterFunc(func(*graph.Def) bool { return true })
+	s.Defs(f)
+	s.Defs(f)
+	if n := queries(); n != 3 {
+		t.Errorf("got %d queries, want 3", n)
+	}
+
+	// The least recently used results are evicted.
+	s.Defs(ByRepos("r"), ByDefPath("p"))
+	s.Defs(ByRepos("r"))
+	if n := queries(); n != 5 {
+		t.Errorf("got %d queries, want 5 (evicted)", n)
+	}
+
+	// Writes invalidate cached results.
+	importDefs("p", "q")
+	if defs, err := s.Defs(ByRepos("r")); err != nil {
+		t.Fatal(err)
+	} else if len(defs) != 2 {
+		t.Errorf("after write, got %d defs, want 2", len(defs))
+	}
+
+	// Queries with in/out filters aren't cached, even if they are
+	// logged like other filters.
+	if err := fss.Import("r", "c", u, graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "q"}, Name: "q"}}}); err != nil {
+		t.Fatal(err)
+	}
+	n := queries()
+	for i := 0; i < 2; i++ {
+		var dm DefMatches
+		defs, err := s.Defs(ByRepos("r"), ByDefQueryMatches("q", &dm))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(defs) != 1 || dm.Get(defs[0]) == nil {
+			t.Errorf("ByDefQueryMatches query %d: got defs %v, want 1 def with matches", i, defs)
+		}
+	}
+	if got, want := queries(), n+2; got != want {
+		t.Errorf("got %d queries, want %d (not cached)", got, want)
+	}
+}
@@ -17,7 +17,8 @@ type MultiRepoStore interface {
 
 	// RepoStore's methods call the corresponding methods on the
 	// RepoStore of each repository contained within this multi-repo
-	// store. The combined results are returned (in undefined order).
+	// store. The combined results are returned in the canonical
+	// order (see "CONVENTION - RESULT ORDERING" in the package docs).
 	RepoStore
 }
 
@@ -38,17 +39,20 @@ type MultiRepoIndexer interface {
 	Index(repo, commitID string) error
 }
 
-// A MultiRepoStoreImporter implements both MultiRepoStore and
-// MultiRepoImporter.
+// A MultiRepoStoreImporter implements MultiRepoStore,
+// MultiRepoImporter, and MultiRepoDeleter.
 type MultiRepoStoreImporter interface {
 	MultiRepoStore
 	MultiRepoImporter
+	MultiRepoDeleter
 }
 
-// A MultiRepoStoreImporterIndexer implements all 3 interfaces.
+// A MultiRepoStoreImporterIndexer implements MultiRepoStoreImporter
+// and MultiRepoIndexer.
 type MultiRepoStoreImporterIndexer interface {
 	MultiRepoStore
 	MultiRepoImporter
+	MultiRepoDeleter
 	MultiRepoIndexer
 }
 
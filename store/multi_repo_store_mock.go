@@ -15,6 +15,10 @@ type MockMultiRepoStore struct {
 	Import_        func(repo, commitID string, unit *unit.SourceUnit, data graph.Output) error
 	Index_         func(repo, commitID string) error
 	CreateVersion_ func(repo, commit string) error
+
+	Delete_     func(repo, commitID string) error
+	DeleteUnit_ func(repo, commitID string, u unit.ID2) error
+	DeleteRepo_ func(repo string) error
 }
 
 func (m MockMultiRepoStore) Repos(f ...RepoFilter) ([]string, error) {
@@ -49,4 +53,16 @@ func (m MockMultiRepoStore) CreateVersion(repo, commitID string) error {
 	return m.CreateVersion_(repo, commitID)
 }
 
+func (m MockMultiRepoStore) Delete(repo, commitID string) error {
+	return m.Delete_(repo, commitID)
+}
+
+func (m MockMultiRepoStore) DeleteUnit(repo, commitID string, u unit.ID2) error {
+	return m.DeleteUnit_(repo, commitID, u)
+}
+
+func (m MockMultiRepoStore) DeleteRepo(repo string) error {
+	return m.DeleteRepo_(repo)
+}
+
 var _ MultiRepoStoreImporterIndexer = MockMultiRepoStore{}
@@ -5,6 +5,7 @@ import (
 
 	"sort"
 
+	"sourcegraph.com/sourcegraph/rwvfs"
 	"sourcegraph.com/sourcegraph/srclib/graph"
 	"sourcegraph.com/sourcegraph/srclib/unit"
 )
@@ -27,6 +28,8 @@ func testMultiRepoStore(t *testing.T, newFn func() MultiRepoStoreImporter) {
 	testMultiRepoStore_Refs(t, newFn())
 	testMultiRepoStore_Refs_filterByRepoCommitAndFile(t, newFn())
 	testMultiRepoStore_Refs_filterByDef(t, newFn())
+	testMultiRepoStore_resultOrder(t, newFn())
+	testMultiRepoStore_Delete(t, newFn())
 }
 
 func testMultiRepoStore_uninitialized(t *testing.T, mrs MultiRepoStore) {
@@ -193,6 +196,125 @@ func TestFSMultiRepoStore_Repos_customPathFuncs(t *testing.T) {
 	}
 }
 
+func TestFSMultiRepoStore_normalizesRepoURIs(t *testing.T) {
+	mrs := NewFSMultiRepoStore(newTestFS(), nil)
+
+	unit := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}, Info: unit.Info{Files: []string{"f"}}}
+	data := graph.Output{
+		Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}}},
+		Refs: []*graph.Ref{
+			{DefRepo: "https://www.github.com/Foo/Bar.git", DefUnitType: "t", DefUnit: "u", DefPath: "p", File: "f", Start: 1, End: 2},
+			{DefRepo: "https://github.com/X/Y.git", DefUnitType: "t", DefUnit: "u", DefPath: "q", File: "f", Start: 3, End: 4},
+		},
+	}
+	if err := mrs.Import("GitHub.com/Foo/Bar", "c", unit, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := mrs.CreateVersion("github.com/foo/bar.git", "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	repos, err := mrs.Repos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"github.com/foo/bar"}; !deepEqual(repos, want) {
+		t.Errorf("Repos(): got %v, want %v", repos, want)
+	}
+
+	defs, err := mrs.Defs(ByRepos("https://github.com/foo/bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 1 || defs[0].Repo != "github.com/foo/bar" {
+		t.Errorf("Defs(ByRepos with clone URL): got %v, want 1 def with the normalized Repo", defs)
+	}
+
+	// Each repo is queried once, no matter how many of its spellings
+	// are given.
+	defs, err = mrs.Defs(ByRepos("https://GitHub.com/foo/bar.git", "github.com/foo/bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 1 || defs[0].Repo != "github.com/foo/bar" {
+		t.Errorf("Defs(ByRepos with two spellings): got %v, want 1 def with the normalized Repo", defs)
+	}
+	units, err := mrs.Units(ByRepoCommitIDs(Version{Repo: "https://GitHub.com/foo/bar.git", CommitID: "c"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(units) != 1 || units[0].Repo != "github.com/foo/bar" {
+		t.Errorf("Units(ByRepoCommitIDs with clone URL): got %v, want 1 unit with the normalized Repo", units)
+	}
+	if repos, err := mrs.Repos(ByRepos("GitHub.com/Foo/Bar")); err != nil {
+		t.Fatal(err)
+	} else if want := []string{"github.com/foo/bar"}; !deepEqual(repos, want) {
+		t.Errorf("Repos(ByRepos): got %v, want %v", repos, want)
+	}
+
+	refs, err := mrs.Refs(ByRepos("github.com/Foo/Bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Sort(refsByFileStartEnd(refs))
+	if want := []string{"github.com/foo/bar", "github.com/x/y"}; len(refs) != 2 || refs[0].DefRepo != want[0] || refs[1].DefRepo != want[1] || refs[0].Repo != want[0] {
+		t.Errorf("Refs: got %v, want DefRepos %v", refs, want)
+	}
+}
+
+func TestRenormalizeRepoPaths(t *testing.T) {
+	fs := newTestFS()
+
+	// Import data at the un-normalized path, as older versions of
+	// the store did.
+	oldPath := fs.Join(DefaultRepoPaths.RepoToPath("GitHub.com/Foo/Bar")...)
+	if err := rwvfs.MkdirAll(fs, oldPath); err != nil {
+		t.Fatal(err)
+	}
+	rs := NewFSRepoStore(rwvfs.Walkable(rwvfs.Sub(fs, oldPath)))
+	unit := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
+	data := graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}}}}
+	if err := rs.Import("c", unit, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.CreateVersion("c"); err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := RenormalizeRepoPaths(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"GitHub.com/Foo/Bar"}; !deepEqual(moved, want) {
+		t.Errorf("got moved %v, want %v", moved, want)
+	}
+
+	mrs := NewFSMultiRepoStore(fs, nil)
+	repos, err := mrs.Repos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"github.com/foo/bar"}; !deepEqual(repos, want) {
+		t.Errorf("Repos(): got %v, want %v", repos, want)
+	}
+	defs, err := mrs.Defs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 1 || defs[0].Repo != "github.com/foo/bar" {
+		t.Errorf("Defs(): got %v, want 1 def in github.com/foo/bar", defs)
+	}
+
+	// Running it again is a no-op.
+	moved, err = RenormalizeRepoPaths(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) != 0 {
+		t.Errorf("got moved %v on second run, want none", moved)
+	}
+}
+
 func testMultiRepoStore_Versions(t *testing.T, mrs MultiRepoStoreImporter) {
 	for _, version := range []string{"c1", "c2"} {
 		unit := &unit.SourceUnit{Key: unit.Key{Type: "t1", Name: "u1"}}
@@ -760,3 +882,124 @@ func testMultiRepoStore_Refs_filterByDef(t *testing.T, mrs MultiRepoStoreImporte
 		t.Errorf("%s: Refs(): got refs %v, want %v", mrs, refs, want)
 	}
 }
+
+func testMultiRepoStore_resultOrder(t *testing.T, mrs MultiRepoStoreImporter) {
+	// Import data in non-canonical order.
+	for _, repo := range []string{"r2", "r1"} {
+		for _, commitID := range []string{"c2", "c1"} {
+			for _, u := range []string{"u2", "u1"} {
+				unit := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: u}, Info: unit.Info{Files: []string{"f1", "f2"}}}
+				data := graph.Output{
+					Defs: []*graph.Def{
+						{DefKey: graph.DefKey{Path: "q"}, Name: "q", File: "f2"},
+						{DefKey: graph.DefKey{Path: "p"}, Name: "p", File: "f1"},
+					},
+					Refs: []*graph.Ref{
+						{DefPath: "q", File: "f2", Start: 1, End: 2},
+						{DefPath: "p", File: "f1", Start: 3, End: 4},
+						{DefPath: "q", File: "f1", Start: 1, End: 2},
+					},
+				}
+				if err := mrs.Import(repo, commitID, unit, data); err != nil {
+					t.Fatalf("%s: Import(%s, %s, %v, data): %s", mrs, repo, commitID, unit, err)
+				}
+			}
+			if err := mrs.CreateVersion(repo, commitID); err != nil {
+				t.Fatalf("%s: CreateVersion(%s, %s): %s", mrs, repo, commitID, err)
+			}
+		}
+	}
+
+	for _, f := range [][]DefFilter{nil, {ByCommitIDs("c1", "c2")}, {ByDefPath("p")}} {
+		defs, err := mrs.Defs(f...)
+		if err != nil {
+			t.Fatalf("%s: Defs(%v): %s", mrs, f, err)
+		}
+		if len(defs) == 0 || !sort.IsSorted(defsInCanonicalOrder(defs)) {
+			t.Errorf("%s: Defs(%v): got defs %v, want them in canonical order", mrs, f, defs)
+		}
+	}
+	for _, f := range [][]RefFilter{nil, {ByFiles(false, "f1")}, {ByRefDef(graph.RefDefKey{DefRepo: "r1", DefUnitType: "t", DefUnit: "u1", DefPath: "q"})}} {
+		refs, err := mrs.Refs(f...)
+		if err != nil {
+			t.Fatalf("%s: Refs(%v): %s", mrs, f, err)
+		}
+		if len(refs) == 0 || !sort.IsSorted(refsInCanonicalOrder(refs)) {
+			t.Errorf("%s: Refs(%v): got refs %v, want them in canonical order", mrs, f, refs)
+		}
+	}
+
+	// A DefsSorter overrides the canonical order.
+	defs, err := mrs.Defs(DefsSortByKey{})
+	if err != nil {
+		t.Fatalf("%s: Defs(DefsSortByKey): %s", mrs, err)
+	}
+	if !sort.IsSorted(graph.Defs(defs)) {
+		t.Errorf("%s: Defs(DefsSortByKey): got defs %v, want them sorted by key", mrs, defs)
+	}
+
+	// Unordered results are the same, in any order.
+	defs, err = mrs.Defs(Unordered())
+	if err != nil {
+		t.Fatalf("%s: Defs(Unordered): %s", mrs, err)
+	}
+	if want := 16; len(defs) != want {
+		t.Errorf("%s: Defs(Unordered): got %d defs, want %d", mrs, len(defs), want)
+	}
+}
+
+func testMultiRepoStore_Delete(t *testing.T, mrs MultiRepoStoreImporter) {
+	for _, repo := range []string{"r1", "r2"} {
+		for _, name := range []string{"u1", "u2"} {
+			u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: name}, Info: unit.Info{Files: []string{"f"}}}
+			data := graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}, Name: "n", File: "f"}}}
+			if err := mrs.Import(repo, "c", u, data); err != nil {
+				t.Fatalf("%s: Import(%s, c, %v, data): %s", mrs, repo, u, err)
+			}
+		}
+		if err := mrs.CreateVersion(repo, "c"); err != nil {
+			t.Fatalf("%s: CreateVersion(%s, c): %s", mrs, repo, err)
+		}
+	}
+
+	u1 := unit.ID2{Type: "t", Name: "u1"}
+	if err := mrs.DeleteUnit("r1", "c", u1); err != nil {
+		t.Fatalf("%s: DeleteUnit(r1, c, %v): %s", mrs, u1, err)
+	}
+	units, err := mrs.Units(ByRepos("r1"))
+	if err != nil {
+		t.Fatalf("%s: Units(r1): %s", mrs, err)
+	}
+	if len(units) != 1 || units[0].Name != "u2" {
+		t.Errorf("%s: Units(r1) after DeleteUnit: got %v, want only u2", mrs, units)
+	}
+
+	if err := mrs.DeleteRepo("r1"); err != nil {
+		t.Fatalf("%s: DeleteRepo(r1): %s", mrs, err)
+	}
+	repos, err := mrs.Repos()
+	if err != nil {
+		t.Fatalf("%s: Repos(): %s", mrs, err)
+	}
+	if want := []string{"r2"}; !deepEqual(repos, want) {
+		t.Errorf("%s: Repos() after DeleteRepo(r1): got %v, want %v", mrs, repos, want)
+	}
+
+	if err := mrs.Delete("r2", "c"); err != nil {
+		t.Fatalf("%s: Delete(r2, c): %s", mrs, err)
+	}
+	versions, err := mrs.Versions(ByRepos("r2"))
+	if err != nil && !isStoreNotExist(err) {
+		t.Fatalf("%s: Versions(r2): %s", mrs, err)
+	}
+	if len(versions) != 0 {
+		t.Errorf("%s: Versions(r2) after Delete(r2, c): got %v, want none", mrs, versions)
+	}
+	defs, err := mrs.Defs(ByRepos("r2"))
+	if err != nil && !isStoreNotExist(err) {
+		t.Fatalf("%s: Defs(r2): %s", mrs, err)
+	}
+	if len(defs) != 0 {
+		t.Errorf("%s: Defs(r2) after Delete(r2, c): got %v, want none", mrs, defs)
+	}
+}
@@ -0,0 +1,172 @@
+package store
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// An ImportEvent describes a tree import that completed: the version
+// was created, so the tree's data is now visible to queries.
+type ImportEvent struct {
+	Repo     string
+	CommitID string
+
+	// Units are the source units in the tree.
+	Units []unit.ID2
+
+	// Bytes is the number of bytes that the tree's data (including
+	// indexes) uses in the store, or 0 if the store does not account
+	// for usage.
+	Bytes int64
+
+	// Time is when the version was created.
+	Time time.Time
+}
+
+// An ImportNotifier is notified after each tree import completes (see
+// FSMultiRepoStoreConf.Notifiers), so that downstream systems (such as
+// search indexers or doc generators) can react to new data.
+type ImportNotifier interface {
+	// NotifyImport is called after the event's version is created.
+	// Errors are logged; they do not fail the import (whose data has
+	// already been committed).
+	NotifyImport(e *ImportEvent) error
+}
+
+// ImportNotifierFunc is an ImportNotifier that calls the func.
+type ImportNotifierFunc func(*ImportEvent) error
+
+func (f ImportNotifierFunc) NotifyImport(e *ImportEvent) error { return f(e) }
+
+// notifyImport notifies s's notifiers of the completed import of
+// repo's tree at commitID.
+func (s *fsMultiRepoStore) notifyImport(repo, commitID string) {
+	if len(s.Notifiers) == 0 {
+		return
+	}
+
+	e := &ImportEvent{Repo: repo, CommitID: commitID, Time: s.clock().Now()}
+	units, err := s.Units(ByRepoCommitIDs(Version{Repo: repo, CommitID: commitID}))
+	if err != nil {
+		log.Printf("Warning: listing source units for import notification of %s@%s failed: %s", repo, commitID, err)
+	}
+	for _, u := range units {
+		e.Units = append(e.Units, u.ID2())
+	}
+	if rs, ok := s.openRepoStore(repo).(RepoStoreUsage); ok {
+		if u, err := rs.Usage(); err == nil {
+			e.Bytes = u.Trees[commitID]
+		}
+	}
+
+	for _, n := range s.Notifiers {
+		if err := n.NotifyImport(e); err != nil {
+			log.Printf("Warning: import notification of %s@%s failed: %s", repo, commitID, err)
+		}
+	}
+}
+
+// WebhookNotifier is an ImportNotifier that POSTs each ImportEvent as
+// JSON to a URL.
+type WebhookNotifier struct {
+	// URL is the webhook URL.
+	URL string
+
+	// Secret, if set, is used to sign each request's body. The
+	// signature is sent in the X-Srclib-Signature header as
+	// "sha256=" followed by the hex-encoded HMAC-SHA256 of the body.
+	Secret string `json:",omitempty"`
+
+	// Timeout is the maximum duration of each request. If 0, a
+	// default of 10 seconds is used.
+	Timeout time.Duration `json:",omitempty"`
+}
+
+func (n *WebhookNotifier) NotifyImport(e *ImportEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(n.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Srclib-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return doNotifyRequest(req, n.Timeout)
+}
+
+// KafkaNotifier is an ImportNotifier that produces each ImportEvent
+// (as a JSON value, keyed on the repo) to a Kafka topic, through a
+// Kafka REST Proxy (using its v2 API).
+type KafkaNotifier struct {
+	// RESTProxyURL is the base URL of the Kafka REST Proxy (e.g.,
+	// "http://kafka-rest:8082").
+	RESTProxyURL string
+
+	// Topic is the topic that events are produced to.
+	Topic string
+
+	// Timeout is the maximum duration of each request. If 0, a
+	// default of 10 seconds is used.
+	Timeout time.Duration `json:",omitempty"`
+}
+
+func (n *KafkaNotifier) NotifyImport(e *ImportEvent) error {
+	type record struct {
+		Key   string       `json:"key"`
+		Value *ImportEvent `json:"value"`
+	}
+	body, err := json.Marshal(struct {
+		Records []record `json:"records"`
+	}{[]record{{Key: e.Repo, Value: e}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", n.RESTProxyURL+"/topics/"+url.PathEscape(n.Topic), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	return doNotifyRequest(req, n.Timeout)
+}
+
+// doNotifyRequest performs an import notification request and returns
+// an error if it fails or has a non-2xx response status.
+func doNotifyRequest(req *http.Request, timeout time.Duration) error {
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	resp, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: HTTP %s: %s", req.Method, req.URL, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+var (
+	_ ImportNotifier = (*WebhookNotifier)(nil)
+	_ ImportNotifier = (*KafkaNotifier)(nil)
+)
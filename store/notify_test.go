@@ -0,0 +1,91 @@
+package store
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestFSMultiRepoStore_Notifiers(t *testing.T) {
+	type request struct {
+		path, contentType, signature string
+		body                         []byte
+	}
+	reqs := make(chan request, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		reqs <- request{r.URL.Path, r.Header.Get("Content-Type"), r.Header.Get("X-Srclib-Signature"), body}
+	}))
+	defer srv.Close()
+
+	var events []*ImportEvent
+	clock := NewManualClock(time.Unix(1000, 0).UTC())
+	mrs := NewFSMultiRepoStore(newTestFS(), &FSMultiRepoStoreConf{
+		FSStoreConf: FSStoreConf{Clock: clock},
+		Notifiers: []ImportNotifier{
+			ImportNotifierFunc(func(e *ImportEvent) error {
+				events = append(events, e)
+				return nil
+			}),
+			ImportNotifierFunc(func(e *ImportEvent) error {
+				return errors.New("failures are logged but don't fail the import")
+			}),
+			&WebhookNotifier{URL: srv.URL + "/hook", Secret: "s"},
+			&KafkaNotifier{RESTProxyURL: srv.URL, Topic: "imports"},
+		},
+	})
+	testSyncImport(t, mrs, "r", "c", "u1", "u2")
+
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+	e := events[0]
+	if want := []unit.ID2{{Type: "t", Name: "u1"}, {Type: "t", Name: "u2"}}; e.Repo != "r" || e.CommitID != "c" || !reflect.DeepEqual(e.Units, want) || !e.Time.Equal(clock.Now()) {
+		t.Errorf("got event %+v, want repo r, commit c, units %v", e, want)
+	}
+	if e.Bytes == 0 {
+		t.Error("got event Bytes 0, want the tree's usage")
+	}
+
+	wantEvent, _ := json.Marshal(e)
+	webhook, kafka := <-reqs, <-reqs
+	if webhook.path != "/hook" {
+		webhook, kafka = kafka, webhook
+	}
+	mac := hmac.New(sha256.New, []byte("s"))
+	mac.Write(webhook.body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); webhook.signature != want {
+		t.Errorf("got webhook signature %q, want %q", webhook.signature, want)
+	}
+	if string(webhook.body) != string(wantEvent) {
+		t.Errorf("got webhook body %s, want %s", webhook.body, wantEvent)
+	}
+
+	if kafka.path != "/topics/imports" || kafka.contentType != "application/vnd.kafka.json.v2+json" {
+		t.Errorf("got Kafka request to %s with content type %q", kafka.path, kafka.contentType)
+	}
+	if want := `{"records":[{"key":"r","value":` + string(wantEvent) + `}]}`; string(kafka.body) != want {
+		t.Errorf("got Kafka body %s, want %s", kafka.body, want)
+	}
+}
+
+func TestWebhookNotifier_error(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	if err := (&WebhookNotifier{URL: srv.URL}).NotifyImport(&ImportEvent{Repo: "r"}); err == nil {
+		t.Error("got nil error for HTTP 403 response")
+	}
+}
@@ -0,0 +1,102 @@
+package store
+
+import "sourcegraph.com/sourcegraph/srclib/unit"
+
+// A RepoStoreOpener opens the RepoStores of the repositories in a
+// multi-repo store. It is the exported counterpart of the opener that
+// this package's multi-repo stores use, so that stores implemented
+// outside of this package (such as the PostgreSQL store in
+// store/pgsql) can combine their RepoStores with CombineRepoStores.
+type RepoStoreOpener interface {
+	// OpenRepoStore returns the RepoStore of repo, or nil if the
+	// store contains no data for repo.
+	OpenRepoStore(repo string) RepoStore
+
+	// OpenAllRepoStores returns the RepoStores of all repositories
+	// in the store.
+	OpenAllRepoStores() (map[string]RepoStore, error)
+}
+
+// A TreeStoreOpener opens the TreeStores of the commits in a
+// repository (see RepoStoreOpener).
+type TreeStoreOpener interface {
+	// OpenTreeStore returns the TreeStore of the tree at commitID,
+	// or nil if the store contains no data for the tree.
+	OpenTreeStore(commitID string) TreeStore
+
+	// OpenAllTreeStores returns the TreeStores of all trees in the
+	// store.
+	OpenAllTreeStores() (map[string]TreeStore, error)
+}
+
+// A UnitStoreOpener opens the UnitStores of the source units in a
+// tree (see RepoStoreOpener).
+type UnitStoreOpener interface {
+	// OpenUnitStore returns the UnitStore of the source unit u, or
+	// nil if the store contains no data for u.
+	OpenUnitStore(u unit.ID2) UnitStore
+
+	// OpenAllUnitStores returns the UnitStores of all source units
+	// in the store.
+	OpenAllUnitStores() (map[unit.ID2]UnitStore, error)
+}
+
+// CombineRepoStores returns a RepoStore whose methods call the
+// corresponding methods on the RepoStores that o opens, in the same
+// way as this package's multi-repo stores do: only the repositories
+// that the query's filters are scoped to are opened, the Repo fields
+// of the results are set, and the combined results are returned in
+// the canonical order. A MultiRepoStore can be implemented by adding
+// a Repos method to it.
+func CombineRepoStores(o RepoStoreOpener) RepoStore {
+	return repoStores{opener: repoStoreOpenerAdapter{o}}
+}
+
+// CombineTreeStores returns a TreeStore whose methods call the
+// corresponding methods on the TreeStores that o opens (see
+// CombineRepoStores). A RepoStore can be implemented by adding a
+// Versions method to it.
+func CombineTreeStores(o TreeStoreOpener) TreeStore {
+	return treeStores{opener: treeStoreOpenerAdapter{o}}
+}
+
+// CombineUnitStores returns a UnitStore whose methods call the
+// corresponding methods on the UnitStores that o opens (see
+// CombineRepoStores). A TreeStore can be implemented by adding a
+// Units method to it.
+func CombineUnitStores(o UnitStoreOpener) UnitStore {
+	return unitStores{opener: unitStoreOpenerAdapter{o}}
+}
+
+type repoStoreOpenerAdapter struct{ o RepoStoreOpener }
+
+func (a repoStoreOpenerAdapter) openRepoStore(repo string) RepoStore {
+	return a.o.OpenRepoStore(repo)
+}
+func (a repoStoreOpenerAdapter) openAllRepoStores() (map[string]RepoStore, error) {
+	return a.o.OpenAllRepoStores()
+}
+
+type treeStoreOpenerAdapter struct{ o TreeStoreOpener }
+
+func (a treeStoreOpenerAdapter) openTreeStore(commitID string) TreeStore {
+	return a.o.OpenTreeStore(commitID)
+}
+func (a treeStoreOpenerAdapter) openAllTreeStores() (map[string]TreeStore, error) {
+	return a.o.OpenAllTreeStores()
+}
+
+type unitStoreOpenerAdapter struct{ o UnitStoreOpener }
+
+func (a unitStoreOpenerAdapter) openUnitStore(u unit.ID2) UnitStore {
+	return a.o.OpenUnitStore(u)
+}
+func (a unitStoreOpenerAdapter) openAllUnitStores() (map[unit.ID2]UnitStore, error) {
+	return a.o.OpenAllUnitStores()
+}
+
+var (
+	_ repoStoreOpener = repoStoreOpenerAdapter{}
+	_ treeStoreOpener = treeStoreOpenerAdapter{}
+	_ unitStoreOpener = unitStoreOpenerAdapter{}
+)
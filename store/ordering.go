@@ -0,0 +1,116 @@
+package store
+
+import (
+	"sort"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+// Unordered returns a filter that lets stores return results in
+// arbitrary order instead of the canonical order (see "CONVENTION -
+// RESULT ORDERING" in the package docs). It selects all defs and refs.
+func Unordered() interface {
+	DefFilter
+	RefFilter
+} {
+	return unorderedFilter{}
+}
+
+type unorderedFilter struct{}
+
+func (unorderedFilter) SelectDef(*graph.Def) bool { return true }
+func (unorderedFilter) SelectRef(*graph.Ref) bool { return true }
+func (unorderedFilter) String() string            { return "Unordered" }
+
+// isUnordered reports whether filters contains an Unordered filter.
+func isUnordered(filters interface{}) bool {
+	for _, f := range storeFilters(filters) {
+		if _, ok := f.(unorderedFilter); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sortDefs sorts defs in the order that the filters specify: by the
+// DefsSorter in fs, if any, or else in canonical order (unless fs
+// contains Unordered).
+func sortDefs(defs []*graph.Def, fs []DefFilter) {
+	for _, f := range fs {
+		if dSort, ok := f.(DefsSorter); ok {
+			dSort.DefsSort(defs)
+			return
+		}
+	}
+	if !isUnordered(fs) {
+		sort.Sort(defsInCanonicalOrder(defs))
+	}
+}
+
+// sortRefs sorts refs in canonical order (unless fs contains
+// Unordered).
+func sortRefs(refs []*graph.Ref, fs []RefFilter) {
+	if !isUnordered(fs) {
+		sort.Sort(refsInCanonicalOrder(refs))
+	}
+}
+
+type defsInCanonicalOrder []*graph.Def
+
+func (v defsInCanonicalOrder) Len() int      { return len(v) }
+func (v defsInCanonicalOrder) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+func (v defsInCanonicalOrder) Less(i, j int) bool {
+	a, b := v[i], v[j]
+	if a.Repo != b.Repo {
+		return a.Repo < b.Repo
+	}
+	if a.CommitID != b.CommitID {
+		return a.CommitID < b.CommitID
+	}
+	if a.UnitType != b.UnitType {
+		return a.UnitType < b.UnitType
+	}
+	if a.Unit != b.Unit {
+		return a.Unit < b.Unit
+	}
+	return a.Path < b.Path
+}
+
+type refsInCanonicalOrder []*graph.Ref
+
+func (v refsInCanonicalOrder) Len() int      { return len(v) }
+func (v refsInCanonicalOrder) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+func (v refsInCanonicalOrder) Less(i, j int) bool {
+	a, b := v[i], v[j]
+	if a.Repo != b.Repo {
+		return a.Repo < b.Repo
+	}
+	if a.CommitID != b.CommitID {
+		return a.CommitID < b.CommitID
+	}
+	if a.UnitType != b.UnitType {
+		return a.UnitType < b.UnitType
+	}
+	if a.Unit != b.Unit {
+		return a.Unit < b.Unit
+	}
+	if a.File != b.File {
+		return a.File < b.File
+	}
+	if a.Start != b.Start {
+		return a.Start < b.Start
+	}
+	if a.End != b.End {
+		return a.End < b.End
+	}
+	if a.DefRepo != b.DefRepo {
+		return a.DefRepo < b.DefRepo
+	}
+	if a.DefUnitType != b.DefUnitType {
+		return a.DefUnitType < b.DefUnitType
+	}
+	if a.DefUnit != b.DefUnit {
+		return a.DefUnit < b.DefUnit
+	}
+	return a.DefPath < b.DefPath
+}
@@ -0,0 +1,324 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// An OverlayTreeStore is a TreeStore that layers graph data imported
+// into it over the data of a base tree. It lets editors query the
+// graph of a working tree with uncommitted changes: the modified files
+// are graphed (typically by a quick, partial graphing pass) and
+// imported into the overlay, and the rest of the data is read from the
+// base tree (typically the imported commit that the working tree is
+// based on).
+//
+// Importing a source unit into the overlay shadows the base tree's
+// data in the unit's files (its Files list and the files of its
+// imported defs and refs): queries return the overlay's data for those
+// files and the base tree's data for the rest of the unit's files.
+type OverlayTreeStore interface {
+	TreeStoreImporter
+
+	// VirtualFileImporter's data for a file shadows both the base
+	// tree's and the overlay's data in the file.
+	VirtualFileImporter
+
+	// Shadow hides the base tree's data in the given files (in all
+	// source units), such as files that were deleted in the working
+	// tree.
+	Shadow(files ...string)
+
+	// Reset discards the overlay's data, so that queries return the
+	// base tree's data.
+	Reset()
+}
+
+// NewOverlayTreeStore returns an OverlayTreeStore that layers data
+// imported into it over base.
+func NewOverlayTreeStore(base TreeStore) OverlayTreeStore {
+	s := &overlayTreeStore{base: base}
+	s.Reset()
+	return s
+}
+
+type overlayTreeStore struct {
+	base TreeStore
+
+	mu       sync.RWMutex
+	overlay  *memoryTreeStore
+	units    map[unit.ID2]*unit.SourceUnit
+	data     map[unit.ID2]graph.Output
+	shadowed map[unit.ID2]map[string]struct{} // files shadowed by imported units
+	deleted  map[string]struct{}              // files shadowed by Shadow
+	virtual  *virtualUnits                    // files imported with ImportFile
+}
+
+var _ OverlayTreeStore = (*overlayTreeStore)(nil)
+
+func (s *overlayTreeStore) String() string { return fmt.Sprintf("overlay(%v)", s.base) }
+
+func (s *overlayTreeStore) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overlay = newMemoryTreeStore()
+	s.overlay.Import(nil, graph.Output{})
+	s.units = map[unit.ID2]*unit.SourceUnit{}
+	s.data = map[unit.ID2]graph.Output{}
+	s.shadowed = map[unit.ID2]map[string]struct{}{}
+	s.deleted = map[string]struct{}{}
+	s.virtual = newVirtualUnits()
+}
+
+func (s *overlayTreeStore) Shadow(files ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, file := range files {
+		s.deleted[file] = struct{}{}
+	}
+}
+
+func (s *overlayTreeStore) Import(u *unit.SourceUnit, data graph.Output) error {
+	if u == nil {
+		return errors.New("overlay import: source unit must be set")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := u.ID2()
+	files := map[string]struct{}{}
+	for _, file := range u.Files {
+		files[file] = struct{}{}
+	}
+	for _, def := range data.Defs {
+		files[def.File] = struct{}{}
+	}
+	for _, ref := range data.Refs {
+		files[ref.File] = struct{}{}
+	}
+	if prev, present := s.shadowed[id]; present {
+		for file := range prev {
+			files[file] = struct{}{}
+		}
+	}
+	s.shadowed[id] = files
+	s.units[id] = u
+	s.data[id] = data
+
+	// Rebuild the overlay so that a unit that is imported again
+	// replaces its previously imported data.
+	overlay := newMemoryTreeStore()
+	overlay.Import(nil, graph.Output{})
+	for id, u := range s.units {
+		if err := overlay.Import(u, s.data[id]); err != nil {
+			return err
+		}
+	}
+	s.overlay = overlay
+	return nil
+}
+
+// Units returns the base tree's units, with the units imported into
+// the overlay in place of the base tree's units with the same IDs. The
+// Files list of an overlay unit that replaces a base unit includes the
+// base unit's files (which a partial graphing pass may have omitted).
+func (s *overlayTreeStore) Units(fs ...UnitFilter) ([]*unit.SourceUnit, error) {
+	if units, paged, err := PagedUnits(s.Units, fs); paged {
+		return units, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	baseUnits, err := s.base.Units()
+	if err != nil && !isStoreNotExist(err) {
+		return nil, err
+	}
+	units := make([]*unit.SourceUnit, 0, len(baseUnits)+len(s.units))
+	for _, bu := range baseUnits {
+		if _, present := s.units[bu.ID2()]; !present {
+			units = append(units, bu)
+		}
+	}
+	for _, u := range s.units {
+		for _, bu := range baseUnits {
+			if bu.ID2() == u.ID2() {
+				uCopy := *u
+				uCopy.Files = mergeFiles(bu.Files, u.Files)
+				u = &uCopy
+				break
+			}
+		}
+		units = append(units, u)
+	}
+
+	var selected []*unit.SourceUnit
+	for _, u := range units {
+		if unitFilters(fs).SelectUnit(u) {
+			selected = append(selected, u)
+		}
+	}
+	return selected, nil
+}
+
+// mergeFiles returns the sorted union of the file lists.
+func mergeFiles(a, b []string) []string {
+	seen := make(map[string]struct{}, len(a)+len(b))
+	var files []string
+	for _, fl := range [][]string{a, b} {
+		for _, file := range fl {
+			if _, present := seen[file]; !present {
+				seen[file] = struct{}{}
+				files = append(files, file)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+func (s *overlayTreeStore) Defs(fs ...DefFilter) ([]*graph.Def, error) {
+	if defs, paged, err := PagedDefs(s.Defs, fs); paged {
+		return defs, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// The shadow filters must precede the others so that stateful
+	// filters don't count shadowed defs.
+	defs, err := s.base.Defs(append([]DefFilter{s.baseShadowFilter()}, fs...)...)
+	if err != nil && !isStoreNotExist(err) {
+		return nil, err
+	}
+	overlayDefs, err := s.overlay.Defs(append([]DefFilter{s.virtualShadowFilter()}, fs...)...)
+	if err != nil {
+		return nil, err
+	}
+	virtualDefs, err := s.virtual.Defs(fs...)
+	if err != nil {
+		return nil, err
+	}
+	defs = append(append(defs, overlayDefs...), virtualDefs...)
+	sortDefs(defs, fs)
+	return defs, nil
+}
+
+func (s *overlayTreeStore) Refs(fs ...RefFilter) ([]*graph.Ref, error) {
+	if refs, paged, err := PagedRefs(s.Refs, fs); paged {
+		return refs, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	refs, err := s.base.Refs(append([]RefFilter{s.baseShadowFilter()}, fs...)...)
+	if err != nil && !isStoreNotExist(err) {
+		return nil, err
+	}
+	overlayRefs, err := s.overlay.Refs(append([]RefFilter{s.virtualShadowFilter()}, fs...)...)
+	if err != nil {
+		return nil, err
+	}
+	virtualRefs, err := s.virtual.Refs(fs...)
+	if err != nil {
+		return nil, err
+	}
+	refs = append(append(refs, overlayRefs...), virtualRefs...)
+	sortRefs(refs, fs)
+	return refs, nil
+}
+
+// baseShadowFilter hides the base tree's data in files that are
+// shadowed by the overlay's or virtual data.
+func (s *overlayTreeStore) baseShadowFilter() *overlayShadowFilter {
+	return &overlayShadowFilter{shadowed: []map[unit.ID2]map[string]struct{}{s.shadowed, s.virtual.files}, deleted: s.deleted}
+}
+
+// virtualShadowFilter hides the overlay's data in files that are
+// shadowed by virtual data.
+func (s *overlayTreeStore) virtualShadowFilter() *overlayShadowFilter {
+	return &overlayShadowFilter{shadowed: []map[unit.ID2]map[string]struct{}{s.virtual.files}}
+}
+
+// overlayShadowFilter hides base tree data in files that are shadowed
+// by an overlay.
+type overlayShadowFilter struct {
+	shadowed []map[unit.ID2]map[string]struct{}
+	deleted  map[string]struct{}
+
+	// unit is the unit that the filter is applied to (whose defs and
+	// refs have empty unit fields), if any (see filtersForUnit).
+	unit *unit.ID2
+}
+
+func (f *overlayShadowFilter) String() string {
+	units := 0
+	for _, shadowed := range f.shadowed {
+		units += len(shadowed)
+	}
+	return fmt.Sprintf("overlayShadow(%d units, %d files)", units, len(f.deleted))
+}
+
+func (f *overlayShadowFilter) SelectDef(def *graph.Def) bool {
+	return f.selectFile(unit.ID2{Type: def.UnitType, Name: def.Unit}, def.File)
+}
+
+func (f *overlayShadowFilter) SelectRef(ref *graph.Ref) bool {
+	return f.selectFile(unit.ID2{Type: ref.UnitType, Name: ref.Unit}, ref.File)
+}
+
+func (f *overlayShadowFilter) selectFile(u unit.ID2, file string) bool {
+	if _, present := f.deleted[file]; present {
+		return false
+	}
+	if f.unit != nil {
+		u = *f.unit
+	}
+	for _, shadowed := range f.shadowed {
+		if _, present := shadowed[u][file]; present {
+			return false
+		}
+	}
+	return true
+}
+
+// forUnit returns a copy of the filter to apply to data in unit u.
+func (f *overlayShadowFilter) forUnit(u unit.ID2) *overlayShadowFilter {
+	return &overlayShadowFilter{shadowed: f.shadowed, deleted: f.deleted, unit: &u}
+}
+
+// NewVersionTreeStore returns a TreeStore that queries the tree of
+// repo at commitID in mrs (e.g., to use as an OverlayTreeStore's
+// base).
+func NewVersionTreeStore(mrs MultiRepoStore, repo, commitID string) TreeStore {
+	return &versionTreeStore{mrs: mrs, version: Version{Repo: repo, CommitID: commitID}}
+}
+
+type versionTreeStore struct {
+	mrs     MultiRepoStore
+	version Version
+}
+
+var _ TreeStore = (*versionTreeStore)(nil)
+
+func (s *versionTreeStore) String() string {
+	return fmt.Sprintf("%v@%s", s.mrs, s.version.CommitID)
+}
+
+func (s *versionTreeStore) Units(fs ...UnitFilter) ([]*unit.SourceUnit, error) {
+	return s.mrs.Units(append(append([]UnitFilter(nil), fs...), ByRepoCommitIDs(s.version))...)
+}
+
+func (s *versionTreeStore) Defs(fs ...DefFilter) ([]*graph.Def, error) {
+	return s.mrs.Defs(append(append([]DefFilter(nil), fs...), ByRepoCommitIDs(s.version))...)
+}
+
+func (s *versionTreeStore) Refs(fs ...RefFilter) ([]*graph.Ref, error) {
+	return s.mrs.Refs(append(append([]RefFilter(nil), fs...), ByRepoCommitIDs(s.version))...)
+}
@@ -0,0 +1,169 @@
+package store
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestOverlayTreeStore(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+
+	u1 := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u1"}, Info: unit.Info{Files: []string{"a", "b"}}}
+	u2 := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u2"}, Info: unit.Info{Files: []string{"c"}}}
+	def := func(path, file string) *graph.Def {
+		return &graph.Def{DefKey: graph.DefKey{Path: path}, Name: path, File: file}
+	}
+	ref := func(defPath, file string, start uint32) *graph.Ref {
+		return &graph.Ref{DefUnitType: "t", DefUnit: "u1", DefPath: defPath, File: file, Start: start, End: start + 1}
+	}
+	defPaths := func(defs []*graph.Def) []string {
+		paths := make([]string, len(defs))
+		for i, d := range defs {
+			paths[i] = d.Unit + "/" + d.Path
+		}
+		sort.Strings(paths)
+		return paths
+	}
+
+	for _, indexed := range []bool{false, true} {
+		useIndexedStore = indexed
+		mrs := NewFSMultiRepoStore(newTestFS(), nil)
+		if err := mrs.Import("r", "c", u1, graph.Output{
+			Defs: []*graph.Def{def("p", "a"), def("q", "b")},
+			Refs: []*graph.Ref{ref("p", "a", 1), ref("q", "b", 2)},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.Import("r", "c", u2, graph.Output{Defs: []*graph.Def{def("s", "c")}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.CreateVersion("r", "c"); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.Index("r", "c"); err != nil {
+			t.Fatal(err)
+		}
+
+		ots := NewOverlayTreeStore(NewVersionTreeStore(mrs, "r", "c"))
+		checkDefs := func(label string, want []string, fs ...DefFilter) {
+			defs, err := ots.Defs(fs...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := defPaths(defs); !reflect.DeepEqual(got, want) {
+				t.Errorf("indexed=%v %s: got defs %v, want %v", indexed, label, got, want)
+			}
+		}
+		checkDefs("base", []string{"u1/p", "u1/q", "u2/s"})
+
+		// File "a" was modified: p was renamed to p2 and its ref now
+		// refers to it.
+		if err := ots.Import(&unit.SourceUnit{Key: u1.Key, Info: unit.Info{Files: []string{"a"}}}, graph.Output{
+			Defs: []*graph.Def{def("p2", "a")},
+			Refs: []*graph.Ref{ref("p2", "a", 1)},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		checkDefs("overlay", []string{"u1/p2", "u1/q", "u2/s"})
+		checkDefs("overlay ByUnits", []string{"u1/p2", "u1/q"}, ByUnits(u1.ID2()))
+		checkDefs("overlay Limit", []string{"u1/p2"}, ByUnits(u1.ID2()), ByFiles(true, "a"), Limit(1, 0))
+
+		refs, err := ots.Refs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var refDefs []string
+		for _, r := range refs {
+			refDefs = append(refDefs, r.File+":"+r.DefPath)
+		}
+		sort.Strings(refDefs)
+		if want := []string{"a:p2", "b:q"}; !reflect.DeepEqual(refDefs, want) {
+			t.Errorf("indexed=%v: got refs %v, want %v", indexed, refDefs, want)
+		}
+
+		units, err := ots.Units(ByUnits(u1.ID2()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(units) != 1 || !reflect.DeepEqual(units[0].Files, []string{"a", "b"}) {
+			t.Errorf("indexed=%v: got units %+v, want u1 with files [a b]", indexed, units)
+		}
+
+		// Importing the unit again replaces its overlay data.
+		if err := ots.Import(&unit.SourceUnit{Key: u1.Key, Info: unit.Info{Files: []string{"a"}}}, graph.Output{Defs: []*graph.Def{def("p3", "a")}}); err != nil {
+			t.Fatal(err)
+		}
+		checkDefs("reimport", []string{"u1/p3", "u1/q", "u2/s"})
+
+		ots.Shadow("c")
+		checkDefs("deleted file", []string{"u1/p3", "u1/q"})
+
+		ots.Reset()
+		checkDefs("reset", []string{"u1/p", "u1/q", "u2/s"})
+	}
+}
+
+func TestOverlayTreeStore_ImportFile(t *testing.T) {
+	u1 := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u1"}, Info: unit.Info{Files: []string{"a", "b"}}}
+	def := func(path, file string) *graph.Def {
+		return &graph.Def{DefKey: graph.DefKey{Path: path}, Name: path, File: file}
+	}
+
+	mrs := NewFSMultiRepoStore(newTestFS(), nil)
+	if err := mrs.Import("r", "c", u1, graph.Output{Defs: []*graph.Def{def("p", "a"), def("q", "b")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mrs.CreateVersion("r", "c"); err != nil {
+		t.Fatal(err)
+	}
+	ots := NewOverlayTreeStore(NewVersionTreeStore(mrs, "r", "c"))
+	if err := ots.Import(&unit.SourceUnit{Key: u1.Key, Info: unit.Info{Files: []string{"b"}}}, graph.Output{Defs: []*graph.Def{def("q2", "b")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	checkDefs := func(label string, want []string, fs ...DefFilter) {
+		defs, err := ots.Defs(fs...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, d := range defs {
+			got = append(got, d.Unit+"/"+d.Path)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got defs %v, want %v", label, got, want)
+		}
+	}
+
+	// Virtual data shadows both the base tree and the overlay.
+	if err := ots.ImportFile(u1.ID2(), "a", graph.Output{Defs: []*graph.Def{def("p1", "a")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ots.ImportFile(u1.ID2(), "b", graph.Output{Defs: []*graph.Def{def("q3", "b")}}); err != nil {
+		t.Fatal(err)
+	}
+	checkDefs("virtual", []string{"u1/p1", "u1/q3"})
+	checkDefs("virtual ByUnits", []string{"u1/p1", "u1/q3"}, ByUnits(u1.ID2()))
+	checkDefs("virtual other unit", nil, ByUnits(unit.ID2{Type: "t", Name: "u2"}))
+
+	// Unsaved edits to a file that isn't in any imported unit.
+	u2 := unit.ID2{Type: "t", Name: "u2"}
+	if err := ots.ImportFile(u2, "c", graph.Output{Defs: []*graph.Def{def("s", "c")}}); err != nil {
+		t.Fatal(err)
+	}
+	checkDefs("virtual new unit", []string{"u1/p1", "u1/q3", "u2/s"})
+
+	ots.DiscardFile(u1.ID2(), "a")
+	ots.DiscardFile(u1.ID2(), "b")
+	ots.DiscardFile(u2, "c")
+	checkDefs("discarded", []string{"u1/p", "u1/q2"})
+
+	if err := ots.ImportFile(u1.ID2(), "a", graph.Output{Defs: []*graph.Def{def("x", "b")}}); err == nil {
+		t.Error("got no error for data in other file")
+	}
+}
@@ -0,0 +1,317 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// LimitFilter is implemented by filters that limit the number of
+// results of a query.
+type LimitFilter interface {
+	Limit() int
+}
+
+// OffsetFilter is implemented by filters that skip the first results
+// of a query.
+type OffsetFilter interface {
+	Offset() int
+}
+
+// First returns a filter that limits a query's results to the first n
+// (after the results that an Offset filter skips). Together with
+// Offset, it lets clients page through large result sets.
+//
+// Pages are taken from the results in the order that the store
+// returns them: the canonical order for defs and refs (see
+// "CONVENTION - RESULT ORDERING" in the package docs), or the order
+// that a DefsSorter specifies; units sorted by Repo, CommitID, Type,
+// and Name; and repos in sorted order. Stores stop reading data once
+// they have found the results that a page needs, if the way that the
+// data is stored allows them to.
+//
+// It panics if n is negative.
+func First(n int) interface {
+	DefFilter
+	RefFilter
+	UnitFilter
+	RepoFilter
+	LimitFilter
+} {
+	if n < 0 {
+		panic("First: negative n")
+	}
+	return limitFilter(n)
+}
+
+// Offset returns a filter that skips the first n results of a query
+// (see First). It panics if n is negative.
+func Offset(n int) interface {
+	DefFilter
+	RefFilter
+	UnitFilter
+	RepoFilter
+	OffsetFilter
+} {
+	if n < 0 {
+		panic("Offset: negative n")
+	}
+	return offsetFilter(n)
+}
+
+type limitFilter int
+
+func (f limitFilter) Limit() int                       { return int(f) }
+func (f limitFilter) SelectDef(*graph.Def) bool        { return true }
+func (f limitFilter) SelectRef(*graph.Ref) bool        { return true }
+func (f limitFilter) SelectUnit(*unit.SourceUnit) bool { return true }
+func (f limitFilter) SelectRepo(string) bool           { return true }
+func (f limitFilter) String() string                   { return fmt.Sprintf("First(%d)", int(f)) }
+
+// Limit returns a filter that limits a def or ref query's results to
+// limit results, after skipping the first offset results. Negative
+// limits and offsets are treated as 0.
+//
+// Deprecated: Use First and Offset. Queries with a Limit filter are
+// paged like queries with First and Offset filters, but they are
+// always executed (and never share their results; see
+// NewSingleflightStore).
+func Limit(limit, offset int) interface {
+	DefFilter
+	RefFilter
+} {
+	if limit < 0 {
+		limit = 0
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return &pageFilter{limit: limit, offset: offset}
+}
+
+// LimitRemaining returns how many results of a query with the given
+// filters are needed (see ScanLimit), and whether more results are
+// needed (either because the limit is positive, or there is no limit).
+//
+// Deprecated: Use ScanLimit. Because filters no longer count the
+// results they select, remaining doesn't decrease as results are
+// found.
+func LimitRemaining(filters interface{}) (remaining int, moreOK bool) {
+	n, limited := ScanLimit(filters)
+	if !limited {
+		return 0, true
+	}
+	return n, n > 0
+}
+
+type offsetFilter int
+
+func (f offsetFilter) Offset() int                      { return int(f) }
+func (f offsetFilter) SelectDef(*graph.Def) bool        { return true }
+func (f offsetFilter) SelectRef(*graph.Ref) bool        { return true }
+func (f offsetFilter) SelectUnit(*unit.SourceUnit) bool { return true }
+func (f offsetFilter) SelectRepo(string) bool           { return true }
+func (f offsetFilter) String() string                   { return fmt.Sprintf("Offset(%d)", int(f)) }
+
+// A pageFilter is a Limit filter, which is both a LimitFilter and an
+// OffsetFilter.
+type pageFilter struct{ limit, offset int }
+
+func (f *pageFilter) Limit() int                { return f.limit }
+func (f *pageFilter) Offset() int               { return f.offset }
+func (f *pageFilter) SelectDef(*graph.Def) bool { return true }
+func (f *pageFilter) SelectRef(*graph.Ref) bool { return true }
+func (f *pageFilter) String() string {
+	return fmt.Sprintf("Limit(%d offset %d)", f.limit, f.offset)
+}
+
+// A limitHint filter tells the lower-level stores that a store queries
+// to answer a paged query that only the first n of their results (in
+// the query's order) are needed. It is added (in place of the First
+// and Offset filters) by the store that pages the results.
+type limitHint int
+
+func (f limitHint) SelectDef(*graph.Def) bool        { return true }
+func (f limitHint) SelectRef(*graph.Ref) bool        { return true }
+func (f limitHint) SelectUnit(*unit.SourceUnit) bool { return true }
+func (f limitHint) SelectRepo(string) bool           { return true }
+func (f limitHint) String() string                   { return fmt.Sprintf("limitHint(%d)", int(f)) }
+
+// queryPage returns the offset and limit (or -1 if there is no limit)
+// of the first Offset and First (or Limit) filters in filters, and
+// whether there are any.
+func queryPage(filters interface{}) (offset, limit int, paged bool) {
+	offset, limit = 0, -1
+	var hasOffset, hasLimit bool
+	for _, f := range storeFilters(filters) {
+		// A filter may be both (see Limit).
+		if f, ok := f.(OffsetFilter); ok && !hasOffset {
+			offset, hasOffset = f.Offset(), true
+		}
+		if f, ok := f.(LimitFilter); ok && !hasLimit {
+			limit, hasLimit = f.Limit(), true
+		}
+	}
+	return offset, limit, hasOffset || hasLimit
+}
+
+// ScanLimit returns n if only the first n results of a query (in the
+// query's order) are needed, because the query has a First filter or
+// is made (by a store that pages the results) to answer such a query.
+// Stores whose data is stored in the query's order can stop reading it
+// after they have found n results.
+func ScanLimit(filters interface{}) (n int, ok bool) {
+	for _, f := range storeFilters(filters) {
+		if f, ok := f.(limitHint); ok {
+			return int(f), true
+		}
+	}
+	offset, limit, _ := queryPage(filters)
+	if limit < 0 || hasDefsSorter(filters) {
+		return 0, false
+	}
+	return offset + limit, true
+}
+
+// hasDefsSorter reports whether filters contains a DefsSorter.
+func hasDefsSorter(filters interface{}) bool {
+	for _, f := range storeFilters(filters) {
+		if _, ok := f.(DefsSorter); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutPage returns filters (a slice of filters) without its First,
+// Offset, and Limit filters, and with a limitHint filter if only the first
+// results are needed (see ScanLimit). Stores that page the results of
+// a query use it to query their lower-level stores.
+func withoutPage(filters interface{}) interface{} {
+	n, limited := ScanLimit(filters)
+	pf := storeFilters(withoutScanLimit(filters))
+	if limited {
+		pf = append(pf, limitHint(n))
+	}
+	return toTypedFilterSlice(reflect.TypeOf(filters), pf)
+}
+
+// withoutScanLimit returns filters (a slice of filters) without its
+// First, Offset, Limit, and limitHint filters. Stores that exclude some of
+// their lower-level stores' results use it to query them for all of
+// their results.
+func withoutScanLimit(filters interface{}) interface{} {
+	sf := storeFilters(filters)
+	pf := make([]interface{}, 0, len(sf)+1)
+	for _, f := range sf {
+		switch f.(type) {
+		case LimitFilter, OffsetFilter, limitHint:
+			continue
+		}
+		pf = append(pf, f)
+	}
+	return toTypedFilterSlice(reflect.TypeOf(filters), pf)
+}
+
+// pageBounds returns the bounds of the page of n results.
+func pageBounds(n, offset, limit int) (start, end int) {
+	start, end = offset, n
+	if start > n {
+		start = n
+	}
+	if limit >= 0 && start+limit < end {
+		end = start + limit
+	}
+	return start, end
+}
+
+// PagedDefs answers a defs query with First or Offset filters by
+// calling defs with the query's other filters (and, if only the first
+// results are needed, a filter that tells the stores that defs queries
+// so; see ScanLimit), sorting the results in the query's order, and
+// returning the page. If the query isn't paged, it returns paged == false
+// without calling defs.
+//
+// Stores call it (with their own Defs method) at the start of their
+// Defs methods, unless they pass the query on to a single lower-level
+// store that pages the results itself.
+func PagedDefs(defs func(...DefFilter) ([]*graph.Def, error), fs []DefFilter) (_ []*graph.Def, paged bool, err error) {
+	offset, limit, paged := queryPage(fs)
+	if !paged {
+		return nil, false, nil
+	}
+	all, err := defs(withoutPage(fs).([]DefFilter)...)
+	if err != nil {
+		return nil, true, err
+	}
+	sortDefs(all, fs)
+	start, end := pageBounds(len(all), offset, limit)
+	return all[start:end], true, nil
+}
+
+// PagedRefs is like PagedDefs, but for refs.
+func PagedRefs(refs func(...RefFilter) ([]*graph.Ref, error), fs []RefFilter) (_ []*graph.Ref, paged bool, err error) {
+	offset, limit, paged := queryPage(fs)
+	if !paged {
+		return nil, false, nil
+	}
+	all, err := refs(withoutPage(fs).([]RefFilter)...)
+	if err != nil {
+		return nil, true, err
+	}
+	sortRefs(all, fs)
+	start, end := pageBounds(len(all), offset, limit)
+	return all[start:end], true, nil
+}
+
+// PagedUnits is like PagedDefs, but for units, which are sorted by
+// Repo, CommitID, Type, and Name.
+func PagedUnits(units func(...UnitFilter) ([]*unit.SourceUnit, error), fs []UnitFilter) (_ []*unit.SourceUnit, paged bool, err error) {
+	offset, limit, paged := queryPage(fs)
+	if !paged {
+		return nil, false, nil
+	}
+	all, err := units(withoutPage(fs).([]UnitFilter)...)
+	if err != nil {
+		return nil, true, err
+	}
+	sort.Sort(unitsInPageOrder(all))
+	start, end := pageBounds(len(all), offset, limit)
+	return all[start:end], true, nil
+}
+
+// PagedRepos is like PagedDefs, but for repos, which are sorted.
+func PagedRepos(repos func(...RepoFilter) ([]string, error), fs []RepoFilter) (_ []string, paged bool, err error) {
+	offset, limit, paged := queryPage(fs)
+	if !paged {
+		return nil, false, nil
+	}
+	all, err := repos(withoutPage(fs).([]RepoFilter)...)
+	if err != nil {
+		return nil, true, err
+	}
+	sort.Strings(all)
+	start, end := pageBounds(len(all), offset, limit)
+	return all[start:end], true, nil
+}
+
+type unitsInPageOrder []*unit.SourceUnit
+
+func (v unitsInPageOrder) Len() int      { return len(v) }
+func (v unitsInPageOrder) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+func (v unitsInPageOrder) Less(i, j int) bool {
+	a, b := v[i], v[j]
+	if a.Repo != b.Repo {
+		return a.Repo < b.Repo
+	}
+	if a.CommitID != b.CommitID {
+		return a.CommitID < b.CommitID
+	}
+	if a.Type != b.Type {
+		return a.Type < b.Type
+	}
+	return a.Name < b.Name
+}
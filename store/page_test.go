@@ -0,0 +1,256 @@
+package store
+
+import (
+	"io"
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestLimitOffset(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+
+	data := func(u string) graph.Output {
+		return graph.Output{
+			Defs: []*graph.Def{
+				{DefKey: graph.DefKey{Path: "y"}, Name: u},
+				{DefKey: graph.DefKey{Path: "x"}, Name: u},
+				{DefKey: graph.DefKey{Path: "z"}, Name: u},
+			},
+			Refs: []*graph.Ref{
+				{DefPath: "x", File: "f", Start: 1, End: 2},
+				{DefPath: "y", File: "f", Start: 3, End: 4},
+				{DefPath: "z", File: "f", Start: 3, End: 4},
+				{DefPath: "x", File: "g", Start: 5, End: 6},
+			},
+		}
+	}
+
+	type page struct{ offset, limit int }
+	pages := []page{{0, 0}, {0, 1}, {0, 2}, {1, 2}, {2, 3}, {5, 100}, {100, 1}, {3, -1}}
+	pageFilters := func(p page) []interface{} {
+		fs := []interface{}{Offset(p.offset)}
+		if p.limit >= 0 {
+			fs = append(fs, First(p.limit))
+		}
+		return fs
+	}
+	pageOf := func(n int, p page) (start, end int) { return pageBounds(n, p.offset, p.limit) }
+
+	defQueries := [][]DefFilter{
+		nil,
+		{ByRepos("b")},
+		{ByDefPath("y")},
+		{ByUnits(unit.ID2{Type: "t", Name: "u2"})},
+	}
+	refQueries := [][]RefFilter{
+		nil,
+		{ByRepos("a"), ByFiles(false, "f")},
+		{ByRefDef(graph.RefDefKey{DefRepo: "a", DefUnitType: "t", DefUnit: "u1", DefPath: "x"})},
+	}
+
+	stores := map[string]func() MultiRepoStoreImporter{
+		"fs":     func() MultiRepoStoreImporter { return NewFSMultiRepoStore(newTestFS(), nil) },
+		"memory": func() MultiRepoStoreImporter { return newMemoryMultiRepoStore() },
+	}
+	for _, indexed := range []bool{false, true} {
+		useIndexedStore = indexed
+		for label, newStore := range stores {
+			mrs := newStore()
+			for _, repo := range []string{"b", "a", "c"} {
+				for _, u := range []string{"u2", "u1"} {
+					if err := mrs.Import(repo, "c", &unit.SourceUnit{Key: unit.Key{Type: "t", Name: u}, Info: unit.Info{Files: []string{"f", "g"}}}, data(u)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := mrs.CreateVersion(repo, "c"); err != nil {
+					t.Fatal(err)
+				}
+				if mrs, ok := mrs.(MultiRepoIndexer); ok {
+					if err := mrs.Index(repo, "c"); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			for _, q := range defQueries {
+				all, err := mrs.Defs(q...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, p := range pages {
+					fs := append(append([]DefFilter{}, q...), toTypedFilterSlice(reflect.TypeOf(q), pageFilters(p)).([]DefFilter)...)
+					got, err := mrs.Defs(fs...)
+					if err != nil {
+						t.Fatal(err)
+					}
+					start, end := pageOf(len(all), p)
+					if want := all[start:end]; !reflect.DeepEqual(defKeys(got), defKeys(want)) {
+						t.Errorf("%s (indexed=%v): Defs(%v): got %v, want %v", label, indexed, fs, defKeys(got), defKeys(want))
+					}
+				}
+			}
+
+			for _, q := range refQueries {
+				all, err := mrs.Refs(q...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, p := range pages {
+					fs := append(append([]RefFilter{}, q...), toTypedFilterSlice(reflect.TypeOf(q), pageFilters(p)).([]RefFilter)...)
+					got, err := mrs.Refs(fs...)
+					if err != nil {
+						t.Fatal(err)
+					}
+					start, end := pageOf(len(all), p)
+					if want := all[start:end]; (len(got) != 0 || len(want) != 0) && !reflect.DeepEqual(got, want) {
+						t.Errorf("%s (indexed=%v): Refs(%v): got %d refs, want %d", label, indexed, fs, len(got), len(want))
+					}
+				}
+			}
+
+			allUnits, err := mrs.Units()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(allUnits) != 6 {
+				t.Fatalf("%s (indexed=%v): got %d units, want 6", label, indexed, len(allUnits))
+			}
+			for _, p := range pages {
+				fs := toTypedFilterSlice(reflect.TypeOf([]UnitFilter{}), pageFilters(p)).([]UnitFilter)
+				got, err := mrs.Units(fs...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var gotIDs []string
+				for _, u := range got {
+					gotIDs = append(gotIDs, u.Repo+"/"+u.Name)
+				}
+				wantIDs := []string{"a/u1", "a/u2", "b/u1", "b/u2", "c/u1", "c/u2"}
+				start, end := pageOf(len(wantIDs), p)
+				if wantIDs = wantIDs[start:end]; len(wantIDs) == 0 {
+					wantIDs = nil
+				}
+				if !reflect.DeepEqual(gotIDs, wantIDs) {
+					t.Errorf("%s (indexed=%v): Units(%v): got %v, want %v", label, indexed, fs, gotIDs, wantIDs)
+				}
+			}
+
+			for _, p := range pages {
+				fs := toTypedFilterSlice(reflect.TypeOf([]RepoFilter{}), pageFilters(p)).([]RepoFilter)
+				got, err := mrs.Repos(fs...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := []string{"a", "b", "c"}
+				start, end := pageOf(len(want), p)
+				if want = want[start:end]; (len(got) != 0 || len(want) != 0) && !reflect.DeepEqual(got, want) {
+					t.Errorf("%s (indexed=%v): Repos(%v): got %v, want %v", label, indexed, fs, got, want)
+				}
+			}
+
+			// Iterators page through their results in the order that
+			// they return them.
+			all, err := iterDefs(DefsIter(mrs))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range pages {
+				fs := toTypedFilterSlice(reflect.TypeOf([]DefFilter{}), pageFilters(p)).([]DefFilter)
+				got, err := iterDefs(DefsIter(mrs, fs...))
+				if err != nil {
+					t.Fatal(err)
+				}
+				start, end := pageOf(len(all), p)
+				if want := all[start:end]; !reflect.DeepEqual(defKeys(got), defKeys(want)) {
+					t.Errorf("%s (indexed=%v): DefsIter(%v): got %v, want %v", label, indexed, fs, defKeys(got), defKeys(want))
+				}
+			}
+		}
+	}
+}
+
+func TestLimitOffset_negative(t *testing.T) {
+	for name, f := range map[string]func(){
+		"First":  func() { First(-1) },
+		"Offset": func() { Offset(-1) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s(-1): did not panic", name)
+				}
+			}()
+			f()
+		}()
+	}
+}
+
+func TestScanLimit(t *testing.T) {
+	tests := []struct {
+		filters []DefFilter
+		n       int
+		ok      bool
+	}{
+		{nil, 0, false},
+		{[]DefFilter{Offset(3)}, 0, false},
+		{[]DefFilter{First(2)}, 2, true},
+		{[]DefFilter{Offset(3), First(2)}, 5, true},
+		{[]DefFilter{First(2), DefsSortByName{}}, 0, false},
+		{withoutPage([]DefFilter{Offset(1), First(2), ByDefPath("p")}).([]DefFilter), 3, true},
+		{[]DefFilter{Limit(2, 3)}, 5, true},
+		{withoutPage([]DefFilter{Limit(2, 1)}).([]DefFilter), 3, true},
+	}
+	for _, test := range tests {
+		n, ok := ScanLimit(test.filters)
+		if n != test.n || ok != test.ok {
+			t.Errorf("%v: got ScanLimit %d, %v, want %d, %v", test.filters, n, ok, test.n, test.ok)
+		}
+	}
+}
+
+func TestLimitRemaining(t *testing.T) {
+	tests := []struct {
+		filters   []DefFilter
+		remaining int
+		moreOK    bool
+	}{
+		{nil, 0, true},
+		{[]DefFilter{Limit(2, 3)}, 5, true},
+		{[]DefFilter{Limit(0, 0)}, 0, false},
+		{[]DefFilter{First(1)}, 1, true},
+	}
+	for _, test := range tests {
+		remaining, moreOK := LimitRemaining(test.filters)
+		if remaining != test.remaining || moreOK != test.moreOK {
+			t.Errorf("%v: got LimitRemaining %d, %v, want %d, %v", test.filters, remaining, moreOK, test.remaining, test.moreOK)
+		}
+	}
+}
+
+func defKeys(defs []*graph.Def) []graph.DefKey {
+	keys := make([]graph.DefKey, len(defs))
+	for i, def := range defs {
+		keys[i] = def.DefKey
+	}
+	return keys
+}
+
+func iterDefs(it DefIterator, err error) ([]*graph.Def, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	var defs []*graph.Def
+	for {
+		def, err := it.Next()
+		if err == io.EOF {
+			return defs, nil
+		} else if err != nil {
+			return nil, err
+		}
+		defs = append(defs, def)
+	}
+}
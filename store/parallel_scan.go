@@ -0,0 +1,293 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/gogo/protobuf/proto"
+	"golang.org/x/net/context"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+// ScanWorkers is the number of goroutines that decode and filter the
+// records of each full scan of a source unit's def or ref data file.
+// If it is greater than 1, a scan reads the file's records in batches
+// (splitting them using their length headers, without decoding them)
+// and decodes and filters the batches concurrently, which speeds up
+// large scans on multicore machines. The records are returned in file
+// order unless the query has an Unordered filter. Like Codec, it
+// should only be set at init time or when you can guarantee that no
+// stores will be reading data.
+var ScanWorkers = 1
+
+// scanBatchSize is the number of records in each batch that a
+// parallel scan decodes.
+const scanBatchSize = 256
+
+// A framedCodec is a codec whose records can be split from a data
+// file without decoding them, so that they can be decoded
+// concurrently.
+type framedCodec interface {
+	// readFrame reads the next record's encoded bytes (without its
+	// length header) from r. It returns the number of bytes read,
+	// including the length header.
+	readFrame(r *bufio.Reader) ([]byte, uint64, error)
+
+	// unmarshal decodes a record's encoded bytes (as returned by
+	// readFrame) into v.
+	unmarshal(b []byte, v interface{}) error
+}
+
+func (JSONCodec) readFrame(r *bufio.Reader) ([]byte, uint64, error) {
+	var n uint64
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, 0, err
+	}
+	if n > uint64(MaxRecordSize) {
+		return nil, 0, &RecordTooLargeError{Size: n, Max: MaxRecordSize}
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	return b, uint64(binary.Size(n)) + n, nil
+}
+
+func (JSONCodec) unmarshal(b []byte, v interface{}) error { return unmarshalJSON(b, v) }
+
+func (ProtobufCodec) readFrame(r *bufio.Reader) ([]byte, uint64, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	if n > uint64(MaxRecordSize) {
+		return nil, 0, &RecordTooLargeError{Size: n, Max: MaxRecordSize}
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	var hdr [binary.MaxVarintLen64]byte
+	return b, uint64(binary.PutUvarint(hdr[:], n)) + n, nil
+}
+
+func (ProtobufCodec) unmarshal(b []byte, v interface{}) error {
+	return proto.Unmarshal(b, v.(proto.Message))
+}
+
+var (
+	_ framedCodec = JSONCodec{}
+	_ framedCodec = ProtobufCodec{}
+)
+
+// frameDecoder is the decoder of a record that was decoded by a
+// parallel scan. It only returns the record's encoded bytes (for
+// record observers; see storedRecord).
+type frameDecoder []byte
+
+func (d frameDecoder) Decode(v interface{}) (uint64, error) { panic("frameDecoder.Decode") }
+
+func (d frameDecoder) lastRaw() []byte { return d }
+
+// A scanBatch is a batch of consecutive records read by a parallel
+// scan.
+type scanBatch struct {
+	seq    int      // the batch's position in the file
+	frames [][]byte // the records' encoded bytes
+	ofs    []int64  // the records' byte offsets
+	sizes  []int64  // the records' sizes, including length headers
+
+	selected []interface{} // the decoded records that were selected
+}
+
+// useParallelScan reports whether a full scan with the given filters
+// should be performed by parallelScan. Scans of queries that need only
+// their first results (see ScanLimit) are sequential, so that they can
+// stop early.
+func useParallelScan(c codec, filters interface{}) bool {
+	if ScanWorkers <= 1 {
+		return false
+	}
+	if _, ok := c.(framedCodec); !ok {
+		return false
+	}
+	if _, ok := ScanLimit(filters); ok {
+		return false
+	}
+	return true
+}
+
+// parallelScan reads the records of the named data file in batches and
+// decodes (into values returned by newRecord) and filters (with
+// selectRecord, which returns the value to add to the results, or nil
+// if the record isn't selected) them on ScanWorkers goroutines. It
+// returns the selected records, in file order if ordered is true.
+//
+// Records that fail to decode are skipped (see CorruptRecordError). If
+// a record's length header is corrupt, the records after it can't be
+// found, so a *CorruptRecordError is returned; callers should fall back
+// to a sequential scan, which can resync using the unit's indexes.
+func (s *fsUnitStore) parallelScan(ctx context.Context, name string, ordered bool, newRecord func() interface{}, selectRecord func(v interface{}, rec *storedRecord) interface{}) (records []interface{}, err error) {
+	f, err := openForScan(ctx, s.fs, name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err2 := f.Close()
+		if err == nil {
+			err = err2
+		}
+	}()
+	fc := s.codec().(framedCodec)
+
+	batches := make(chan *scanBatch, ScanWorkers)
+	results := make(chan *scanBatch, ScanWorkers)
+
+	var readErr error
+	go func() {
+		defer close(batches)
+		readErr = s.readScanBatches(name, f, fc, batches)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < ScanWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				s.decodeScanBatch(name, fc, b, newRecord, selectRecord)
+				results <- b
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Collect the batches' selected records. If ordered, hold
+	// finished batches until the batches before them are done.
+	pending := map[int]*scanBatch{}
+	next := 0
+	for b := range results {
+		if !ordered {
+			records = append(records, b.selected...)
+			continue
+		}
+		pending[b.seq] = b
+		for b, ok := pending[next]; ok; b, ok = pending[next] {
+			records = append(records, b.selected...)
+			delete(pending, next)
+			next++
+		}
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	return records, nil
+}
+
+// readScanBatches splits the records of the named data file (read from
+// f) into batches and sends them to batches.
+func (s *fsUnitStore) readScanBatches(name string, f io.Reader, fc framedCodec, batches chan<- *scanBatch) error {
+	rr := &recordReader{r: f}
+	br := bufio.NewReaderSize(rr, decodeBufSize)
+	var (
+		b   = &scanBatch{}
+		ofs int64
+	)
+	for {
+		frame, n, err := fc.readFrame(br)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return s.corruptRecord(rr, name, ofs, err)
+		}
+		b.frames = append(b.frames, frame)
+		b.ofs = append(b.ofs, ofs)
+		b.sizes = append(b.sizes, int64(n))
+		ofs += int64(n)
+		if len(b.frames) == scanBatchSize {
+			batches <- b
+			b = &scanBatch{seq: b.seq + 1}
+		}
+	}
+	if len(b.frames) > 0 {
+		batches <- b
+	}
+	return nil
+}
+
+// decodeScanBatch decodes and filters the records in b.
+func (s *fsUnitStore) decodeScanBatch(name string, fc framedCodec, b *scanBatch, newRecord func() interface{}, selectRecord func(v interface{}, rec *storedRecord) interface{}) {
+	for i, frame := range b.frames {
+		v := newRecord()
+		if err := fc.unmarshal(frame, v); err != nil {
+			skipCorruptRecord(&CorruptRecordError{Store: s.String(), File: name, Offset: b.ofs[i], Err: err})
+			continue
+		}
+		if kept := selectRecord(v, &storedRecord{store: s, file: name, offset: b.ofs[i], size: b.sizes[i], dec: frameDecoder(frame)}); kept != nil {
+			b.selected = append(b.selected, kept)
+		}
+	}
+	b.frames = nil
+}
+
+// parallelDefs performs a full scan of the def data file with
+// parallelScan.
+func (s *fsUnitStore) parallelDefs(fs []DefFilter) ([]*graph.Def, error) {
+	obs := getRecordObservers(fs)
+	arena := getArena(fs)
+	records, err := s.parallelScan(queryContext(fs), unitDefsFilename, !isUnordered(fs), func() interface{} { return &graph.Def{} }, func(v interface{}, rec *storedRecord) interface{} {
+		def := arena.selectDef(v.(*graph.Def), fs)
+		if def == nil {
+			return nil
+		}
+		if obs != nil {
+			obs.observeDef(def, rec)
+		}
+		return def
+	})
+	if err != nil {
+		return nil, err
+	}
+	defs := make([]*graph.Def, len(records))
+	for i, v := range records {
+		defs[i] = v.(*graph.Def)
+	}
+	return defs, nil
+}
+
+// parallelRefs performs a full scan of the ref data file with
+// parallelScan.
+func (s *fsUnitStore) parallelRefs(fs []RefFilter) ([]*graph.Ref, error) {
+	obs := getRecordObservers(fs)
+	arena := getArena(fs)
+	records, err := s.parallelScan(queryContext(fs), unitRefsFilename, !isUnordered(fs), func() interface{} { return &graph.Ref{} }, func(v interface{}, rec *storedRecord) interface{} {
+		ref := v.(*graph.Ref)
+		if !refFilters(fs).SelectRef(ref) {
+			return nil
+		}
+		ref = arena.keepRef(ref)
+		if obs != nil {
+			obs.observeRef(ref, rec)
+		}
+		return ref
+	})
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]*graph.Ref, len(records))
+	for i, v := range records {
+		refs[i] = v.(*graph.Ref)
+	}
+	return refs, nil
+}
@@ -0,0 +1,102 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+func TestFSUnitStore_parallelScan(t *testing.T) {
+	defer func(n int) { ScanWorkers = n }(ScanWorkers)
+	defer func(c codec) { Codec = c }(Codec)
+
+	for _, c := range []codec{JSONCodec{}, ProtobufCodec{}} {
+		Codec = c
+		us := &fsUnitStore{fs: newTestFS(), label: "test"}
+		var data graph.Output
+		for i := 0; i < 3*scanBatchSize+5; i++ {
+			data.Defs = append(data.Defs, &graph.Def{DefKey: graph.DefKey{Path: fmt.Sprintf("p%04d", i)}, Name: fmt.Sprint(i % 3), File: "f"})
+			data.Refs = append(data.Refs, &graph.Ref{DefPath: fmt.Sprintf("p%04d", i), File: fmt.Sprint(i % 3), Start: uint32(i), End: uint32(i + 1)})
+		}
+		if err := us.Import(data); err != nil {
+			t.Fatal(err)
+		}
+
+		filters := map[string]struct {
+			defs []DefFilter
+			refs []RefFilter
+		}{
+			"all":      {},
+			"filtered": {defs: []DefFilter{ByDefQuery("1")}, refs: []RefFilter{ByFiles(false, "2")}},
+		}
+		for name, f := range filters {
+			ScanWorkers = 1
+			wantDefs, err := us.Defs(f.defs...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantRefs, err := us.Refs(f.refs...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(wantDefs) == 0 || len(wantRefs) == 0 {
+				t.Fatalf("%T %s: no results", c, name)
+			}
+
+			ScanWorkers = 4
+			defs, err := us.Defs(f.defs...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(defs, wantDefs) {
+				t.Errorf("%T %s: parallel scan got %d defs, want %d (in file order)", c, name, len(defs), len(wantDefs))
+			}
+			refs, err := us.Refs(f.refs...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(refs, wantRefs) {
+				t.Errorf("%T %s: parallel scan got %d refs, want %d (in file order)", c, name, len(refs), len(wantRefs))
+			}
+
+			// Unordered scans return the same records in any order.
+			defs, err = us.Defs(append(f.defs, Unordered())...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sortDefs(defs, nil)
+			sortDefs(wantDefs, nil)
+			if !reflect.DeepEqual(defs, wantDefs) {
+				t.Errorf("%T %s: unordered parallel scan got %d defs, want %d", c, name, len(defs), len(wantDefs))
+			}
+		}
+	}
+}
+
+func TestFSUnitStore_parallelScan_rawRecords(t *testing.T) {
+	defer func(n int) { ScanWorkers = n }(ScanWorkers)
+	ScanWorkers = 4
+
+	us := &fsUnitStore{fs: newTestFS(), label: "test"}
+	data := graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}, Name: "n"}}}
+	if err := us.Import(data); err != nil {
+		t.Fatal(err)
+	}
+	raw := newRawRecordsFilter(Codec)
+	defs, err := us.Defs(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 1 {
+		t.Fatalf("got %d defs, want 1", len(defs))
+	}
+	want, err := Codec.(rawCodec).marshal(defs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := raw.defs[defs[0]]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got raw record %q, want %q", got, want)
+	}
+}
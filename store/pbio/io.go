@@ -28,7 +28,11 @@
 
 package pbio
 
-import "github.com/gogo/protobuf/proto"
+import (
+	"fmt"
+
+	"github.com/gogo/protobuf/proto"
+)
 
 type Writer interface {
 	WriteMsg(proto.Message) (uint64, error)
@@ -38,6 +42,30 @@ type Reader interface {
 	ReadMsg(msg proto.Message) (uint64, error)
 }
 
+// A RawReader is a Reader that can return the encoded bytes of the
+// last message it read.
+type RawReader interface {
+	Reader
+
+	// LastMsg returns the encoded bytes (without the length header)
+	// of the last message read. They are only valid until the next
+	// call to ReadMsg.
+	LastMsg() []byte
+}
+
+// A MsgTooLargeError is returned by a Reader created with
+// NewSizeCheckedDelimitedReader when a message's length header exceeds
+// the reader's maximum message size (e.g., because the header is
+// corrupt).
+type MsgTooLargeError struct {
+	Size uint64 // the length in the message's header
+	Max  int    // the reader's maximum message size
+}
+
+func (e *MsgTooLargeError) Error() string {
+	return fmt.Sprintf("message size %d exceeds the maximum of %d bytes", e.Size, e.Max)
+}
+
 type marshaler interface {
 	MarshalTo(data []byte) (n int, err error)
 	Sizer
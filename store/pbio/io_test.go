@@ -97,6 +97,17 @@ func TestVarintMaxSize(t *testing.T) {
 	}
 }
 
+func TestVarintMaxSize_sizeChecked(t *testing.T) {
+	var buf bytes.Buffer
+	writer := NewDelimitedWriter(&buf)
+	reader := NewSizeCheckedDelimitedReader(&buf, 100, 20)
+	if err, ok := iotest(writer, reader).(*MsgTooLargeError); !ok || err.Max != 20 {
+		t.Error(err)
+	} else {
+		t.Logf("%s", err)
+	}
+}
+
 func TestVarintError(t *testing.T) {
 	var buf bytes.Buffer
 	buf.Write([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f})
@@ -79,13 +79,22 @@ func (w *varintWriter) WriteMsg(msg proto.Message) (uint64, error) {
 }
 
 func NewDelimitedReader(r io.Reader, bufSize, maxSize int) Reader {
-	return &varintReader{bufio.NewReaderSize(r, bufSize), nil, maxSize}
+	return &varintReader{r: bufio.NewReaderSize(r, bufSize), maxSize: maxSize}
+}
+
+// NewSizeCheckedDelimitedReader is like NewDelimitedReader, except that
+// the returned Reader returns a *MsgTooLargeError (instead of
+// io.ErrShortBuffer) when a message's length header exceeds maxSize.
+func NewSizeCheckedDelimitedReader(r io.Reader, bufSize, maxSize int) Reader {
+	return &varintReader{r: bufio.NewReaderSize(r, bufSize), maxSize: maxSize, sizeErr: true}
 }
 
 type varintReader struct {
 	r       *bufio.Reader
 	buf     []byte
+	last    []byte
 	maxSize int
+	sizeErr bool // return *MsgTooLargeError for oversized messages
 }
 
 func (r *varintReader) ReadMsg(msg proto.Message) (uint64, error) {
@@ -93,20 +102,27 @@ func (r *varintReader) ReadMsg(msg proto.Message) (uint64, error) {
 	if err != nil {
 		return 0, err
 	}
-	length := int(length64)
-	if length < 0 || length > r.maxSize {
+	if length64 > uint64(r.maxSize) {
+		if r.sizeErr {
+			return 0, &MsgTooLargeError{Size: length64, Max: r.maxSize}
+		}
 		return 0, io.ErrShortBuffer
 	}
+	length := int(length64)
 	if len(r.buf) < length {
 		r.buf = make([]byte, length)
 	}
 	buf := r.buf[:length]
+	r.last = nil
 	if _, err := io.ReadFull(r.r, buf); err != nil {
 		return 0, err
 	}
+	r.last = buf
 	return uint64(n) + length64, proto.Unmarshal(buf, msg)
 }
 
+func (r *varintReader) LastMsg() []byte { return r.last }
+
 // readUvarint reads an encoded unsigned integer from r and returns it
 // as a uint64. It returns the int number of bytes read.
 //
@@ -0,0 +1,27 @@
+// Package pgsql implements a multi-repo store backed by a PostgreSQL
+// database, so that deployments with many repositories can import
+// data in transactions and query it with the database's indexes
+// instead of sharing a VFS.
+//
+// The store keeps its data in the trees, versions, units, defs, and
+// refs tables (see Schema). Defs, refs, and units are stored as
+// protobufs, with the columns that queries are narrowed by (such as
+// each def's path) stored alongside them. Like the other stores, each
+// row contains zero values in the fields that are implied by its
+// repository, commit, and source unit (see "CONVENTION - ZERO VALUES
+// FOR FIELDS OUTSIDE OF A STORE'S SCOPE" in package store).
+//
+// This package uses only database/sql; programs must register a
+// PostgreSQL driver (such as github.com/lib/pq) themselves:
+//
+//	db, err := sql.Open("postgres", dsn)
+//	...
+//	if err := pgsql.CreateSchema(db); err != nil {
+//		...
+//	}
+//	mrs := pgsql.New(db)
+//
+// The store's tests (in package store, which run the same test suites
+// as the other stores) need a PostgreSQL 9.5+ database; run them with
+// "make test-pgsql" (see the Makefile).
+package pgsql
@@ -0,0 +1,71 @@
+package pgsql
+
+import (
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/store"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func selectRepo(fs []store.RepoFilter, repo string) bool {
+	for _, f := range fs {
+		if !f.SelectRepo(repo) {
+			return false
+		}
+	}
+	return true
+}
+
+func selectVersion(fs []store.VersionFilter, version *store.Version) bool {
+	for _, f := range fs {
+		if !f.SelectVersion(version) {
+			return false
+		}
+	}
+	return true
+}
+
+func selectUnit(fs []store.UnitFilter, u *unit.SourceUnit) bool {
+	for _, f := range fs {
+		if !f.SelectUnit(u) {
+			return false
+		}
+	}
+	return true
+}
+
+func selectRef(fs []store.RefFilter, ref *graph.Ref) bool {
+	for _, f := range fs {
+		if !f.SelectRef(ref) {
+			return false
+		}
+	}
+	return true
+}
+
+// cleanForImport clears the fields of data's defs and refs that are
+// implied by the repository and source unit that they are imported
+// into (see "CONVENTION - ZERO VALUES FOR FIELDS OUTSIDE OF A STORE'S
+// SCOPE" in package store).
+func cleanForImport(data *graph.Output, repo, unitType, unit string) {
+	for _, def := range data.Defs {
+		def.Unit = ""
+		def.UnitType = ""
+		def.Repo = ""
+		def.CommitID = ""
+	}
+	for _, ref := range data.Refs {
+		ref.Unit = ""
+		ref.UnitType = ""
+		ref.Repo = ""
+		ref.CommitID = ""
+		if repo != "" && ref.DefRepo == repo {
+			ref.DefRepo = ""
+		}
+		if unitType != "" && ref.DefUnitType == unitType {
+			ref.DefUnitType = ""
+		}
+		if unit != "" && ref.DefUnit == unit {
+			ref.DefUnit = ""
+		}
+	}
+}
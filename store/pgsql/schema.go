@@ -0,0 +1,98 @@
+package pgsql
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// Schema is the schema of the tables that the store uses. CreateSchema
+// creates them.
+//
+// A tree is listed in the trees table once any data (or an empty
+// import) has been imported for it, and in the versions table once
+// CreateVersion has been called for it. The seq columns record the
+// import order of each tree's units and each unit's defs and refs.
+// Empty def_repo, def_unit_type, and def_unit values in the refs
+// table refer to the ref's own repository and source unit.
+const Schema = `CREATE TABLE IF NOT EXISTS trees (
+  repo TEXT NOT NULL,
+  commit_id TEXT NOT NULL,
+  PRIMARY KEY (repo, commit_id)
+);
+CREATE TABLE IF NOT EXISTS versions (
+  repo TEXT NOT NULL,
+  commit_id TEXT NOT NULL,
+  PRIMARY KEY (repo, commit_id)
+);
+CREATE TABLE IF NOT EXISTS units (
+  repo TEXT NOT NULL,
+  commit_id TEXT NOT NULL,
+  unit_type TEXT NOT NULL,
+  unit TEXT NOT NULL,
+  seq INTEGER NOT NULL,
+  data BYTEA NOT NULL,
+  PRIMARY KEY (repo, commit_id, unit_type, unit)
+);
+CREATE TABLE IF NOT EXISTS defs (
+  repo TEXT NOT NULL,
+  commit_id TEXT NOT NULL,
+  unit_type TEXT NOT NULL,
+  unit TEXT NOT NULL,
+  seq INTEGER NOT NULL,
+  path TEXT NOT NULL,
+  name TEXT NOT NULL,
+  file TEXT NOT NULL,
+  data BYTEA NOT NULL,
+  PRIMARY KEY (repo, commit_id, unit_type, unit, seq)
+);
+CREATE INDEX IF NOT EXISTS defs_path ON defs (repo, commit_id, unit_type, unit, path);
+CREATE TABLE IF NOT EXISTS refs (
+  repo TEXT NOT NULL,
+  commit_id TEXT NOT NULL,
+  unit_type TEXT NOT NULL,
+  unit TEXT NOT NULL,
+  seq INTEGER NOT NULL,
+  def_repo TEXT NOT NULL,
+  def_unit_type TEXT NOT NULL,
+  def_unit TEXT NOT NULL,
+  def_path TEXT NOT NULL,
+  file TEXT NOT NULL,
+  data BYTEA NOT NULL,
+  PRIMARY KEY (repo, commit_id, unit_type, unit, seq)
+);
+CREATE INDEX IF NOT EXISTS refs_def_path ON refs (repo, commit_id, unit_type, unit, def_path);
+`
+
+// tables are the tables in Schema.
+var tables = []string{"trees", "versions", "units", "defs", "refs"}
+
+// CreateSchema creates the store's tables and indexes in db (see
+// Schema). It does nothing to the tables and indexes that already
+// exist.
+func CreateSchema(db *sql.DB) error {
+	return execStmts(db, Schema)
+}
+
+// DropSchema drops the store's tables (and all of their data) from
+// db.
+func DropSchema(db *sql.DB) error {
+	var stmts []string
+	for _, t := range tables {
+		stmts = append(stmts, "DROP TABLE IF EXISTS "+t)
+	}
+	return execStmts(db, strings.Join(stmts, ";\n"))
+}
+
+// execStmts executes each of the ";"-separated statements in script
+// (which must not contain ";" in string literals).
+func execStmts(db *sql.DB, script string) error {
+	for _, stmt := range strings.Split(script, ";") {
+		if stmt = strings.TrimSpace(stmt); stmt == "" {
+			continue
+		}
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
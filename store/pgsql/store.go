@@ -0,0 +1,736 @@
+package pgsql
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/store"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+var (
+	errMultiRepoStoreNoInit = errors.New("multi-repo store not yet initialized")
+	errRepoNoInit           = errors.New("repo not yet initialized")
+	errTreeNoInit           = errors.New("tree not yet initialized")
+	errUnitNoInit           = errors.New("unit not yet initialized")
+)
+
+func errUnitNotInTree(commitID string, u unit.ID2) error {
+	return fmt.Errorf("source unit %s %s is not in the tree at commit %s (use Import to add source units)", u.Type, u.Name, commitID)
+}
+
+// A MultiRepoStore is a multi-repo store whose data is stored in a
+// PostgreSQL database (see the package docs). Like the FS-backed store,
+// it normalizes repo URIs (with graph.NormalizeRepoURI), so
+// "https://github.com/User/Repo.git" and "github.com/user/repo" refer
+// to the same repo.
+type MultiRepoStore struct {
+	db *sql.DB
+
+	// RepoStore combines the results of the store's repositories.
+	store.RepoStore
+}
+
+// New returns a MultiRepoStore whose data is stored in db, which must
+// contain the store's tables (see CreateSchema).
+func New(db *sql.DB) *MultiRepoStore {
+	return &MultiRepoStore{db: db, RepoStore: store.CombineRepoStores(repoOpener{db})}
+}
+
+var (
+	_ store.MultiRepoStoreImporter = (*MultiRepoStore)(nil)
+	_ store.MultiRepoUnitImporter  = (*MultiRepoStore)(nil)
+)
+
+// Repo returns a RepoStore that accesses the data of repo in s.
+func (s *MultiRepoStore) Repo(repo string) store.RepoStoreImporter {
+	return newRepoStore(s.db, graph.NormalizeRepoURI(repo))
+}
+
+// Tree returns a TreeStore that accesses the data of the tree at
+// commitID in repo in s.
+func (s *MultiRepoStore) Tree(repo, commitID string) store.TreeStoreImporter {
+	return newTreeStore(s.db, graph.NormalizeRepoURI(repo), commitID)
+}
+
+// Unit returns a UnitStore that accesses the data of the source unit
+// u in the tree at commitID in repo in s.
+func (s *MultiRepoStore) Unit(repo, commitID string, u unit.ID2) store.UnitStoreImporter {
+	return &unitStore{db: s.db, key: unitKey{repo: graph.NormalizeRepoURI(repo), commitID: commitID, unit: u}}
+}
+
+func (s *MultiRepoStore) Repos(f ...store.RepoFilter) ([]string, error) {
+	if repos, paged, err := store.PagedRepos(s.Repos, f); paged {
+		return repos, err
+	}
+
+	all, err := listRepos(s.db)
+	if err != nil {
+		return nil, err
+	}
+	repos := []string{}
+	for _, repo := range all {
+		if selectRepo(f, repo) {
+			repos = append(repos, repo)
+		}
+	}
+	return repos, nil
+}
+
+func (s *MultiRepoStore) Import(repo, commitID string, u *unit.SourceUnit, data graph.Output) error {
+	repo = graph.NormalizeRepoURI(repo)
+	normalizeRefDefRepos(data.Refs)
+	if u != nil {
+		cleanForImport(&data, repo, u.Type, u.Name)
+	}
+	return importTree(s.db, repo, commitID, u, data)
+}
+
+func (s *MultiRepoStore) ImportUnit(repo, commitID string, u *unit.SourceUnit, data graph.Output) error {
+	repo = graph.NormalizeRepoURI(repo)
+	normalizeRefDefRepos(data.Refs)
+	if u != nil {
+		cleanForImport(&data, repo, u.Type, u.Name)
+	}
+	return newRepoStore(s.db, repo).ImportUnit(commitID, u, data)
+}
+
+func (s *MultiRepoStore) CreateVersion(repo, commitID string) error {
+	return newRepoStore(s.db, graph.NormalizeRepoURI(repo)).CreateVersion(commitID)
+}
+
+func (s *MultiRepoStore) Delete(repo, commitID string) error {
+	return newRepoStore(s.db, graph.NormalizeRepoURI(repo)).Delete(commitID)
+}
+
+func (s *MultiRepoStore) DeleteUnit(repo, commitID string, u unit.ID2) error {
+	return newRepoStore(s.db, graph.NormalizeRepoURI(repo)).DeleteUnit(commitID, u)
+}
+
+func (s *MultiRepoStore) DeleteRepo(repo string) error {
+	repo = graph.NormalizeRepoURI(repo)
+	return withTx(s.db, func(tx *sql.Tx) error {
+		for _, t := range tables {
+			if _, err := tx.Exec(`DELETE FROM `+t+` WHERE repo = $1`, repo); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *MultiRepoStore) String() string { return "pgsql.MultiRepoStore" }
+
+// normalizeRefDefRepos normalizes the DefRepo of each ref (with
+// graph.NormalizeRepoURI), as the FS-backed store does on import, so
+// that refs to a repo match its (normalized) defs.
+func normalizeRefDefRepos(refs []*graph.Ref) {
+	for _, ref := range refs {
+		ref.DefRepo = graph.NormalizeRepoURI(ref.DefRepo)
+	}
+}
+
+// listRepos lists the repositories that have trees, in sorted order.
+func listRepos(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`SELECT DISTINCT repo FROM trees ORDER BY repo`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var repos []string
+	for rows.Next() {
+		var repo string
+		if err := rows.Scan(&repo); err != nil {
+			return nil, err
+		}
+		repos = append(repos, repo)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(repos) == 0 {
+		return nil, errMultiRepoStoreNoInit
+	}
+	return repos, nil
+}
+
+// A repoOpener opens the RepoStores of the repositories in db.
+type repoOpener struct{ db *sql.DB }
+
+func (o repoOpener) OpenRepoStore(repo string) store.RepoStore {
+	repo = graph.NormalizeRepoURI(repo)
+	if ok, err := exists(o.db, `SELECT 1 FROM trees WHERE repo = $1`, repo); err == nil && !ok {
+		return nil
+	}
+	return newRepoStore(o.db, repo)
+}
+
+func (o repoOpener) OpenAllRepoStores() (map[string]store.RepoStore, error) {
+	repos, err := listRepos(o.db)
+	if err != nil {
+		return nil, err
+	}
+	rss := make(map[string]store.RepoStore, len(repos))
+	for _, repo := range repos {
+		rss[repo] = newRepoStore(o.db, repo)
+	}
+	return rss, nil
+}
+
+// A repoStore is a RepoStore that accesses the data of a repository
+// in a database.
+type repoStore struct {
+	db   *sql.DB
+	repo string
+
+	store.TreeStore
+}
+
+func newRepoStore(db *sql.DB, repo string) *repoStore {
+	return &repoStore{db: db, repo: repo, TreeStore: store.CombineTreeStores(treeOpener{db, repo})}
+}
+
+var _ store.RepoStoreImporter = (*repoStore)(nil)
+
+func (s *repoStore) Versions(f ...store.VersionFilter) ([]*store.Version, error) {
+	rows, err := s.db.Query(`SELECT commit_id FROM versions WHERE repo = $1 ORDER BY commit_id`, s.repo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var versions []*store.Version
+	for rows.Next() {
+		version := &store.Version{}
+		if err := rows.Scan(&version.CommitID); err != nil {
+			return nil, err
+		}
+		if selectVersion(f, version) {
+			versions = append(versions, version)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if versions == nil {
+		if ok, err := exists(s.db, `SELECT 1 FROM versions WHERE repo = $1`, s.repo); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, errRepoNoInit
+		}
+	}
+	return versions, nil
+}
+
+func (s *repoStore) Import(commitID string, u *unit.SourceUnit, data graph.Output) error {
+	if u != nil {
+		cleanForImport(&data, "", u.Type, u.Name)
+	}
+	return importTree(s.db, s.repo, commitID, u, data)
+}
+
+func (s *repoStore) ImportUnit(commitID string, u *unit.SourceUnit, data graph.Output) error {
+	if u == nil {
+		return fmt.Errorf("import unit: source unit must be set")
+	}
+	key := unitKey{repo: s.repo, commitID: commitID, unit: u.ID2()}
+	if ok, err := key.exists(s.db); err != nil {
+		return err
+	} else if !ok {
+		return errUnitNotInTree(commitID, u.ID2())
+	}
+	return s.Import(commitID, u, data)
+}
+
+func (s *repoStore) CreateVersion(commitID string) error {
+	_, err := s.db.Exec(`INSERT INTO versions (repo, commit_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`, s.repo, commitID)
+	return err
+}
+
+func (s *repoStore) Delete(commitID string) error {
+	return withTx(s.db, func(tx *sql.Tx) error {
+		for _, t := range tables {
+			if _, err := tx.Exec(`DELETE FROM `+t+` WHERE repo = $1 AND commit_id = $2`, s.repo, commitID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *repoStore) DeleteUnit(commitID string, u unit.ID2) error {
+	key := unitKey{repo: s.repo, commitID: commitID, unit: u}
+	return withTx(s.db, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`DELETE FROM units WHERE `+unitKeyCond, key.args()...)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return errUnitNotInTree(commitID, u)
+		}
+		return deleteUnitData(tx, key)
+	})
+}
+
+func (s *repoStore) String() string { return fmt.Sprintf("pgsql.repoStore(%s)", s.repo) }
+
+// A treeOpener opens the TreeStores of the trees in a repository.
+type treeOpener struct {
+	db   *sql.DB
+	repo string
+}
+
+func (o treeOpener) OpenTreeStore(commitID string) store.TreeStore {
+	if ok, err := exists(o.db, `SELECT 1 FROM trees WHERE repo = $1 AND commit_id = $2`, o.repo, commitID); err == nil && !ok {
+		return nil
+	}
+	return newTreeStore(o.db, o.repo, commitID)
+}
+
+func (o treeOpener) OpenAllTreeStores() (map[string]store.TreeStore, error) {
+	rows, err := o.db.Query(`SELECT commit_id FROM trees WHERE repo = $1`, o.repo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tss := map[string]store.TreeStore{}
+	for rows.Next() {
+		var commitID string
+		if err := rows.Scan(&commitID); err != nil {
+			return nil, err
+		}
+		tss[commitID] = newTreeStore(o.db, o.repo, commitID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(tss) == 0 {
+		return nil, errRepoNoInit
+	}
+	return tss, nil
+}
+
+// A treeStore is a TreeStore that accesses the data of a tree in a
+// database.
+type treeStore struct {
+	db             *sql.DB
+	repo, commitID string
+
+	store.UnitStore
+}
+
+func newTreeStore(db *sql.DB, repo, commitID string) *treeStore {
+	return &treeStore{db: db, repo: repo, commitID: commitID, UnitStore: store.CombineUnitStores(unitOpener{db, repo, commitID})}
+}
+
+var _ store.TreeStoreImporter = (*treeStore)(nil)
+
+func (s *treeStore) Units(f ...store.UnitFilter) ([]*unit.SourceUnit, error) {
+	if units, paged, err := store.PagedUnits(s.Units, f); paged {
+		return units, err
+	}
+
+	if err := checkTreeExists(s.db, s.repo, s.commitID); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT data FROM units WHERE repo = $1 AND commit_id = $2 ORDER BY seq`, s.repo, s.commitID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var units []*unit.SourceUnit
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		u := &unit.SourceUnit{}
+		if err := u.Unmarshal(data); err != nil {
+			return nil, err
+		}
+		if selectUnit(f, u) {
+			units = append(units, u)
+		}
+	}
+	return units, rows.Err()
+}
+
+func (s *treeStore) Import(u *unit.SourceUnit, data graph.Output) error {
+	if u != nil {
+		cleanForImport(&data, "", u.Type, u.Name)
+	}
+	return importTree(s.db, s.repo, s.commitID, u, data)
+}
+
+func (s *treeStore) String() string {
+	return fmt.Sprintf("pgsql.treeStore(%s@%s)", s.repo, s.commitID)
+}
+
+// checkTreeExists returns errTreeNoInit if nothing has been imported
+// into the tree at commitID in repo.
+func checkTreeExists(db *sql.DB, repo, commitID string) error {
+	ok, err := exists(db, `SELECT 1 FROM trees WHERE repo = $1 AND commit_id = $2`, repo, commitID)
+	if err == nil && !ok {
+		err = errTreeNoInit
+	}
+	return err
+}
+
+// A unitOpener opens the UnitStores of the source units in a tree.
+type unitOpener struct {
+	db             *sql.DB
+	repo, commitID string
+}
+
+func (o unitOpener) OpenUnitStore(u unit.ID2) store.UnitStore {
+	key := unitKey{repo: o.repo, commitID: o.commitID, unit: u}
+	if ok, err := key.exists(o.db); err == nil && !ok {
+		return nil
+	}
+	return &unitStore{db: o.db, key: key}
+}
+
+func (o unitOpener) OpenAllUnitStores() (map[unit.ID2]store.UnitStore, error) {
+	if err := checkTreeExists(o.db, o.repo, o.commitID); err != nil {
+		return nil, err
+	}
+	rows, err := o.db.Query(`SELECT unit_type, unit FROM units WHERE repo = $1 AND commit_id = $2`, o.repo, o.commitID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	uss := map[unit.ID2]store.UnitStore{}
+	for rows.Next() {
+		var u unit.ID2
+		if err := rows.Scan(&u.Type, &u.Name); err != nil {
+			return nil, err
+		}
+		uss[u] = &unitStore{db: o.db, key: unitKey{repo: o.repo, commitID: o.commitID, unit: u}}
+	}
+	return uss, rows.Err()
+}
+
+// A unitStore is a UnitStore that accesses the data of a source unit
+// in a database.
+type unitStore struct {
+	db  *sql.DB
+	key unitKey
+}
+
+var _ store.UnitStoreImporter = (*unitStore)(nil)
+
+func (s *unitStore) Defs(fs ...store.DefFilter) ([]*graph.Def, error) {
+	if defs, paged, err := store.PagedDefs(s.Defs, fs); paged {
+		return defs, err
+	}
+
+	q := `SELECT data FROM defs WHERE ` + unitKeyCond
+	args := s.key.args()
+	for _, f := range fs {
+		if f, ok := f.(store.ByDefPathFilter); ok {
+			args = append(args, f.ByDefPath())
+			q += fmt.Sprintf(" AND path = $%d", len(args))
+			break
+		}
+	}
+
+	// If only the first defs (in path order) are needed, read the
+	// defs in that order (comparing bytes, as Go does) and stop after
+	// them.
+	order := " ORDER BY seq"
+	limit, limited := store.ScanLimit(fs)
+	if limited {
+		order = ` ORDER BY path COLLATE "C"`
+	}
+	rows, err := s.db.Query(q+order, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var defs []*graph.Def
+	for rows.Next() {
+		if limited && len(defs) >= limit {
+			break
+		}
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		def := &graph.Def{}
+		if err := def.Unmarshal(data); err != nil {
+			return nil, err
+		}
+		if store.DefFilters(fs).SelectDef(def) {
+			defs = append(defs, def)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if defs == nil {
+		if err := s.checkExists(); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range fs {
+		if dSort, ok := f.(store.DefsSorter); ok {
+			dSort.DefsSort(defs)
+			break
+		}
+	}
+	return defs, nil
+}
+
+func (s *unitStore) Refs(fs ...store.RefFilter) ([]*graph.Ref, error) {
+	if refs, paged, err := store.PagedRefs(s.Refs, fs); paged {
+		return refs, err
+	}
+
+	q := `SELECT data FROM refs WHERE ` + unitKeyCond
+	args := s.key.args()
+	for _, f := range fs {
+		if f, ok := f.(store.ByRefDefFilter); ok {
+			args = append(args, f.ByDefPath())
+			q += fmt.Sprintf(" AND def_path = $%d", len(args))
+			break
+		}
+	}
+
+	// Refs are ordered by file first, so if only the first refs are
+	// needed, read the refs by file and stop at the first file after
+	// them.
+	order := " ORDER BY seq"
+	limit, limited := store.ScanLimit(fs)
+	if limited {
+		order = ` ORDER BY file COLLATE "C", seq`
+	}
+	rows, err := s.db.Query(q+order, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var refs []*graph.Ref
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		ref := &graph.Ref{}
+		if err := ref.Unmarshal(data); err != nil {
+			return nil, err
+		}
+		if selectRef(fs, ref) {
+			if limited && len(refs) >= limit && (len(refs) == 0 || ref.File != refs[len(refs)-1].File) {
+				break
+			}
+			refs = append(refs, ref)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if refs == nil {
+		if err := s.checkExists(); err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
+}
+
+// Import imports data into the unit's store. If the unit is not yet
+// in its tree, a source unit with only its type and name set is
+// added (and the tree is created if it doesn't yet exist).
+func (s *unitStore) Import(data graph.Output) error {
+	cleanForImport(&data, "", "", "")
+	u := &unit.SourceUnit{Key: unit.Key{Type: s.key.unit.Type, Name: s.key.unit.Name}}
+	return withTx(s.db, func(tx *sql.Tx) error {
+		if err := insertTree(tx, s.key.repo, s.key.commitID); err != nil {
+			return err
+		}
+		return importUnit(tx, s.key, u, data, false)
+	})
+}
+
+// checkExists returns errUnitNoInit if nothing has been imported
+// into the unit's store.
+func (s *unitStore) checkExists() error {
+	ok, err := s.key.exists(s.db)
+	if err == nil && !ok {
+		err = errUnitNoInit
+	}
+	return err
+}
+
+func (s *unitStore) String() string {
+	return fmt.Sprintf("pgsql.unitStore(%s@%s %s %s)", s.key.repo, s.key.commitID, s.key.unit.Type, s.key.unit.Name)
+}
+
+// A unitKey identifies a source unit in a tree in a repository.
+type unitKey struct {
+	repo, commitID string
+	unit           unit.ID2
+}
+
+// unitKeyCond is the SQL condition that selects the rows of the
+// source unit whose unitKey args are the query's first args.
+const unitKeyCond = `repo = $1 AND commit_id = $2 AND unit_type = $3 AND unit = $4`
+
+func (k unitKey) args() []interface{} {
+	return []interface{}{k.repo, k.commitID, k.unit.Type, k.unit.Name}
+}
+
+func (k unitKey) exists(db *sql.DB) (bool, error) {
+	return exists(db, `SELECT 1 FROM units WHERE `+unitKeyCond, k.args()...)
+}
+
+// importTree imports the data of u (if any) into the tree at commitID
+// in repo, replacing u's existing data. The tree is created if it
+// doesn't yet exist.
+func importTree(db *sql.DB, repo, commitID string, u *unit.SourceUnit, data graph.Output) error {
+	return withTx(db, func(tx *sql.Tx) error {
+		if err := insertTree(tx, repo, commitID); err != nil {
+			return err
+		}
+		if u == nil {
+			return nil
+		}
+		return importUnit(tx, unitKey{repo: repo, commitID: commitID, unit: u.ID2()}, u, data, true)
+	})
+}
+
+// insertTree adds the tree at commitID in repo to the trees table,
+// if it isn't already there.
+func insertTree(tx *sql.Tx, repo, commitID string) error {
+	_, err := tx.Exec(`INSERT INTO trees (repo, commit_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`, repo, commitID)
+	return err
+}
+
+// importUnit adds u to (or, if replace is true, replaces u in) its
+// tree and replaces its defs and refs with those in data.
+func importUnit(tx *sql.Tx, key unitKey, u *unit.SourceUnit, data graph.Output, replace bool) error {
+	unitData, err := u.Marshal()
+	if err != nil {
+		return err
+	}
+	onConflict := `DO NOTHING`
+	if replace {
+		onConflict = `DO UPDATE SET data = excluded.data`
+	}
+	if _, err := tx.Exec(`INSERT INTO units (repo, commit_id, unit_type, unit, seq, data)
+VALUES ($1, $2, $3, $4, (SELECT COALESCE(MAX(seq), 0) + 1 FROM units WHERE repo = $1 AND commit_id = $2), $5)
+ON CONFLICT (repo, commit_id, unit_type, unit) `+onConflict, append(key.args(), unitData)...); err != nil {
+		return err
+	}
+
+	if err := deleteUnitData(tx, key); err != nil {
+		return err
+	}
+	err = insertRows(tx, "defs", []string{"repo", "commit_id", "unit_type", "unit", "seq", "path", "name", "file", "data"}, len(data.Defs), func(i int) ([]interface{}, error) {
+		def := data.Defs[i]
+		b, err := def.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		return append(key.args(), i, def.Path, def.Name, def.File, b), nil
+	})
+	if err != nil {
+		return err
+	}
+	return insertRows(tx, "refs", []string{"repo", "commit_id", "unit_type", "unit", "seq", "def_repo", "def_unit_type", "def_unit", "def_path", "file", "data"}, len(data.Refs), func(i int) ([]interface{}, error) {
+		ref := data.Refs[i]
+		b, err := ref.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		return append(key.args(), i, ref.DefRepo, ref.DefUnitType, ref.DefUnit, ref.DefPath, ref.File, b), nil
+	})
+}
+
+// maxInsertParams is the maximum number of parameters in each INSERT
+// statement that insertRows executes. (PostgreSQL allows at most 65535
+// parameters per statement.)
+var maxInsertParams = 10000
+
+// insertRows inserts n rows into table, whose values of columns are
+// returned by row(i) for the i'th row. It inserts many rows per
+// statement, so that importing a source unit with many defs and refs
+// doesn't take a database round trip per def and ref.
+func insertRows(tx *sql.Tx, table string, columns []string, n int, row func(i int) ([]interface{}, error)) error {
+	batch := maxInsertParams / len(columns)
+	if batch < 1 {
+		batch = 1
+	}
+	prefix := `INSERT INTO ` + table + ` (` + strings.Join(columns, ", ") + `) VALUES `
+	for start := 0; start < n; start += batch {
+		end := start + batch
+		if end > n {
+			end = n
+		}
+		var (
+			q    bytes.Buffer
+			args = make([]interface{}, 0, (end-start)*len(columns))
+		)
+		q.WriteString(prefix)
+		for i := start; i < end; i++ {
+			vals, err := row(i)
+			if err != nil {
+				return err
+			}
+			if i > start {
+				q.WriteString(", ")
+			}
+			q.WriteByte('(')
+			for j := range vals {
+				if j > 0 {
+					q.WriteString(", ")
+				}
+				fmt.Fprintf(&q, "$%d", len(args)+j+1)
+			}
+			q.WriteByte(')')
+			args = append(args, vals...)
+		}
+		if _, err := tx.Exec(q.String(), args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteUnitData deletes the defs and refs of a source unit.
+func deleteUnitData(tx *sql.Tx, key unitKey) error {
+	for _, t := range []string{"defs", "refs"} {
+		if _, err := tx.Exec(`DELETE FROM `+t+` WHERE `+unitKeyCond, key.args()...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withTx calls f in a transaction, which is committed if f returns
+// nil and rolled back otherwise.
+func withTx(db *sql.DB, f func(*sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// exists returns whether query returns any rows.
+func exists(db *sql.DB, query string, args ...interface{}) (bool, error) {
+	var one int
+	err := db.QueryRow(query+` LIMIT 1`, args...).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,6 @@
+//go:build pgsql
+// +build pgsql
+
+package store_test
+
+import _ "github.com/lib/pq" // registers the "postgres" driver for pgsql_test.go
@@ -0,0 +1,179 @@
+package store_test
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/store"
+	"sourcegraph.com/sourcegraph/srclib/store/pgsql"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// openPGSQLTestDB opens the PostgreSQL database whose DSN is in the
+// SRCLIB_PGSQL_TEST_DSN env var, using the database/sql driver named
+// by SRCLIB_PGSQL_TEST_DRIVER (default "postgres"). It skips the test
+// if no DSN is set, and fails it if the driver isn't registered; build
+// with "-tags pgsql" to register the github.com/lib/pq driver (or run
+// "make test-pgsql"). THE TESTS DROP THE STORE'S TABLES.
+func openPGSQLTestDB(t *testing.T) *sql.DB {
+	dsn := os.Getenv("SRCLIB_PGSQL_TEST_DSN")
+	if dsn == "" {
+		t.Skip("SRCLIB_PGSQL_TEST_DSN not set; skipping PostgreSQL store tests")
+	}
+	driver := os.Getenv("SRCLIB_PGSQL_TEST_DRIVER")
+	if driver == "" {
+		driver = "postgres"
+	}
+	registered := false
+	for _, d := range sql.Drivers() {
+		registered = registered || d == driver
+	}
+	if !registered {
+		t.Fatalf("SRCLIB_PGSQL_TEST_DSN is set, but no %q database/sql driver is registered (build with -tags pgsql)", driver)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// newPGSQLStore returns a pgsql.MultiRepoStore with empty tables.
+func newPGSQLStore(t *testing.T, db *sql.DB) *pgsql.MultiRepoStore {
+	if err := pgsql.DropSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := pgsql.CreateSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	return pgsql.New(db)
+}
+
+func TestPGSQLUnitStore(t *testing.T) {
+	db := openPGSQLTestDB(t)
+	defer db.Close()
+	store.UnitStoreSuite(t, func() store.UnitStoreImporter {
+		return newPGSQLStore(t, db).Unit("r", "c", unit.ID2{Type: "t", Name: "u"})
+	})
+}
+
+func TestPGSQLTreeStore(t *testing.T) {
+	db := openPGSQLTestDB(t)
+	defer db.Close()
+	store.TreeStoreSuite(t, func() store.TreeStoreImporter {
+		return newPGSQLStore(t, db).Tree("r", "c")
+	})
+}
+
+func TestPGSQLRepoStore(t *testing.T) {
+	db := openPGSQLTestDB(t)
+	defer db.Close()
+	store.RepoStoreSuite(t, func() store.RepoStoreImporter {
+		return newPGSQLStore(t, db).Repo("r")
+	})
+}
+
+func TestPGSQLMultiRepoStore(t *testing.T) {
+	db := openPGSQLTestDB(t)
+	defer db.Close()
+	store.MultiRepoStoreSuite(t, func() store.MultiRepoStoreImporter {
+		return newPGSQLStore(t, db)
+	})
+}
+
+func TestPGSQLUnitStore_importCreatesTree(t *testing.T) {
+	db := openPGSQLTestDB(t)
+	defer db.Close()
+	mrs := newPGSQLStore(t, db)
+	data := graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}}}}
+	if err := mrs.Unit("r", "c", unit.ID2{Type: "t", Name: "u"}).Import(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// The unit's data is visible through its tree.
+	defs, err := mrs.Tree("r", "c").Defs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 1 {
+		t.Errorf("got %d defs in tree, want 1", len(defs))
+	}
+	defs, err = mrs.Defs(store.ByRepoCommitIDs(store.Version{Repo: "r", CommitID: "c"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 1 {
+		t.Errorf("got %d defs in multi-repo store, want 1", len(defs))
+	}
+}
+
+func TestPGSQLUnitStore_importMany(t *testing.T) {
+	db := openPGSQLTestDB(t)
+	defer db.Close()
+
+	// Enough defs and refs that they are inserted in several batches.
+	const n = 1200
+	var data graph.Output
+	for i := 0; i < n; i++ {
+		data.Defs = append(data.Defs, &graph.Def{DefKey: graph.DefKey{Path: fmt.Sprintf("p%d", i)}})
+		data.Refs = append(data.Refs, &graph.Ref{DefPath: fmt.Sprintf("p%d", i), File: "f", Start: uint32(i), End: uint32(i + 1)})
+	}
+	us := newPGSQLStore(t, db).Unit("r", "c", unit.ID2{Type: "t", Name: "u"})
+	if err := us.Import(data); err != nil {
+		t.Fatal(err)
+	}
+
+	defs, err := us.Defs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != n || defs[n-1].Path != fmt.Sprintf("p%d", n-1) {
+		t.Errorf("got %d defs, want %d in import order", len(defs), n)
+	}
+	refs, err := us.Refs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != n || refs[n-1].Start != n-1 {
+		t.Errorf("got %d refs, want %d in import order", len(refs), n)
+	}
+}
+
+func TestPGSQLMultiRepoStore_normalizesRepos(t *testing.T) {
+	db := openPGSQLTestDB(t)
+	defer db.Close()
+	mrs := newPGSQLStore(t, db)
+	data := graph.Output{
+		Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}}},
+		Refs: []*graph.Ref{{DefRepo: "https://github.com/Other/Repo.git", DefPath: "q", File: "f", Start: 1, End: 2}},
+	}
+	if err := mrs.Import("https://github.com/User/Repo.git", "c", &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}, data); err != nil {
+		t.Fatal(err)
+	}
+
+	repos, err := mrs.Repos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"github.com/user/repo"}; !reflect.DeepEqual(repos, want) {
+		t.Errorf("got repos %v, want %v", repos, want)
+	}
+	defs, err := mrs.Tree("github.com/USER/repo", "c").Defs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 1 {
+		t.Errorf("got %d defs through a differently spelled repo URI, want 1", len(defs))
+	}
+	refs, err := mrs.Refs(store.ByRepos("github.com/user/repo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 || refs[0].DefRepo != "github.com/other/repo" {
+		t.Errorf("got refs %v, want 1 ref with a normalized DefRepo", refs)
+	}
+}
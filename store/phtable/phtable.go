@@ -147,6 +147,14 @@ func (c *CHD) Len() int {
 	return len(c.keys)
 }
 
+// Values returns the values in the hash table, in table order
+// (including the empty values of unused slots). Unlike Iterate, it can
+// be used if the keys aren't stored. It returns nil if the values are
+// varints.
+func (c *CHD) Values() [][]byte {
+	return c.values
+}
+
 // Iterate over entries in the hash table.
 func (c *CHD) Iterate() *Iterator {
 	if len(c.keys) == 0 {
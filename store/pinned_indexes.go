@@ -0,0 +1,248 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/neelance/parallel"
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+// PinnedIndexStats describes the indexes that a store opened with
+// FSMultiRepoStoreConf.PinIndexes keeps loaded in memory.
+type PinnedIndexStats struct {
+	Trees   []Version // trees whose indexes are pinned
+	Indexes int       // number of pinned indexes
+	Bytes   int64     // approximate memory used by the pinned indexes
+}
+
+// MultiRepoPinnedIndexes is implemented by stores that can pin
+// indexes in memory (see FSMultiRepoStoreConf.PinIndexes).
+type MultiRepoPinnedIndexes interface {
+	// PinnedIndexes returns the stats of the indexes that were pinned
+	// when the store was opened. If pinning failed (e.g., because a
+	// tree doesn't exist or an index file couldn't be read), the
+	// error is also returned; the indexes of the trees listed in the
+	// stats remain pinned.
+	PinnedIndexes() (*PinnedIndexStats, error)
+}
+
+var _ MultiRepoPinnedIndexes = (*fsMultiRepoStore)(nil)
+
+func (s *fsMultiRepoStore) PinnedIndexes() (*PinnedIndexStats, error) {
+	if s.pinned == nil {
+		return &PinnedIndexStats{}, s.pinErr
+	}
+	return s.pinned, s.pinErr
+}
+
+// pinIndexes loads and pins the indexes of the trees selected by
+// versions (see FSMultiRepoStoreConf.PinIndexes).
+func (s *fsMultiRepoStore) pinIndexes(versions []Version) (*PinnedIndexStats, error) {
+	if !useIndexedStore {
+		return nil, errors.New("can't pin indexes because indexed stores are disabled")
+	}
+
+	stats := &PinnedIndexStats{}
+	for _, v := range versions {
+		commitIDs := []string{v.CommitID}
+		if v.CommitID == "" {
+			vs, err := s.Versions(ByRepos(v.Repo))
+			if err != nil {
+				return stats, err
+			}
+			if len(vs) == 0 {
+				return stats, fmt.Errorf("pinning indexes of repo %s: repo has no versions", v.Repo)
+			}
+			commitIDs = make([]string, len(vs))
+			for i, v := range vs {
+				commitIDs[i] = v.CommitID
+			}
+			sort.Strings(commitIDs)
+		}
+
+		for _, commitID := range commitIDs {
+			rs := s.openRepoStore(v.Repo).(*fsRepoStore)
+			n, size, err := pinTreeIndexes(rs, commitID)
+			if err != nil {
+				return stats, fmt.Errorf("pinning indexes of %s@%s: %s", v.Repo, commitID, err)
+			}
+			stats.Trees = append(stats.Trees, Version{Repo: graph.NormalizeRepoURI(v.Repo), CommitID: commitID})
+			stats.Indexes += n
+			stats.Bytes += size
+		}
+	}
+	return stats, nil
+}
+
+// pinnedIndexes holds the pinned indexes of the tree and unit stores
+// of the trees pinned by pinTreeIndexes, keyed by the String of the
+// store's VFS (which identifies the store like the index cache's
+// store keys). Indexed stores that are opened on one of these VFSs
+// use the pinned indexes (which are Ready) instead of reading them.
+var pinnedIndexes = struct {
+	m map[string]pinnedStoreIndexes
+	sync.RWMutex
+}{m: map[string]pinnedStoreIndexes{}}
+
+type pinnedStoreIndexes struct {
+	tree    interface{} // store key of the tree store that the indexes belong to
+	indexes map[string]Index
+}
+
+// usePinnedIndexes replaces the indexes of the store whose data is in
+// fs with the store's pinned indexes (if any).
+func usePinnedIndexes(fs rwvfs.FileSystem, indexes map[string]Index) {
+	if fs == nil {
+		return
+	}
+	pinnedIndexes.RLock()
+	defer pinnedIndexes.RUnlock()
+	if len(pinnedIndexes.m) == 0 {
+		return
+	}
+	if p, present := pinnedIndexes.m[fs.String()]; present {
+		for name, x := range p.indexes {
+			indexes[name] = x
+		}
+	}
+}
+
+// unpinIndexes unpins the indexes of the tree store with the given
+// store key (and of its unit stores).
+func unpinIndexes(treeKey interface{}) {
+	pinnedIndexes.Lock()
+	defer pinnedIndexes.Unlock()
+	for key, p := range pinnedIndexes.m {
+		if p.tree == treeKey {
+			delete(pinnedIndexes.m, key)
+		}
+	}
+}
+
+// pinTreeIndexes reads all of the built indexes of the tree and of its
+// source units (and their ref shards) into memory and pins them. It
+// returns the number of pinned indexes and their approximate memory
+// usage.
+func pinTreeIndexes(rs *fsRepoStore, commitID string) (n int, size int64, err error) {
+	ts, ok := rs.newTreeStore(commitID).(*indexedTreeStore)
+	if !ok {
+		return 0, 0, errors.New("tree store is not indexed")
+	}
+	if !dirExists(ts.fs) {
+		return 0, 0, errors.New("no such tree")
+	}
+
+	pins := map[string]map[string]Index{}
+	var pinsMu sync.Mutex
+	pin := func(s indexedStore, fs rwvfs.FileSystem, indexes map[string]Index) error {
+		xs, xsize, err := readPinnedIndexes(s, fs, indexes)
+		if err != nil {
+			return err
+		}
+		pinsMu.Lock()
+		defer pinsMu.Unlock()
+		pins[fs.String()] = xs
+		n += len(xs)
+		size += xsize
+		return nil
+	}
+
+	if err := pin(ts, ts.fs, ts.indexes); err != nil {
+		return 0, 0, err
+	}
+	uss, err := ts.fsTreeStore.openAllUnitStores()
+	if err != nil {
+		return 0, 0, err
+	}
+	par := parallel.NewRun(runtime.GOMAXPROCS(0))
+	for _, us_ := range uss {
+		us, ok := us_.(*indexedUnitStore)
+		if !ok {
+			continue
+		}
+		par.Acquire()
+		go func() {
+			defer par.Release()
+			uss := []*indexedUnitStore{us}
+			shards, err := us.refShards()
+			if err != nil {
+				par.Error(err)
+				return
+			}
+			for i := 0; i < shards; i++ {
+				uss = append(uss, us.openRefShard(i, openIndexedRefShard).(*indexedUnitStore))
+			}
+			for _, us := range uss {
+				if err := pin(us, us.fs, us.indexes); err != nil {
+					par.Error(fmt.Errorf("%s: %s", us.label, err))
+					return
+				}
+			}
+		}()
+	}
+	if err := par.Wait(); err != nil {
+		return 0, 0, err
+	}
+
+	pinnedIndexes.Lock()
+	defer pinnedIndexes.Unlock()
+	for key, xs := range pins {
+		pinnedIndexes.m[key] = pinnedStoreIndexes{tree: ts.StoreKey(), indexes: xs}
+	}
+	return n, size, nil
+}
+
+// readPinnedIndexes reads the built indexes of a tree or unit store
+// in full (including range-read indexes, which are otherwise read
+// from their files as needed). Indexes that have not been built are
+// omitted. The memory used by an index that doesn't report it (see
+// memSizer) is approximated by the size of its file.
+func readPinnedIndexes(s indexedStore, fs rwvfs.FileSystem, indexes map[string]Index) (map[string]Index, int64, error) {
+	xs := make(map[string]Index, len(indexes))
+	var size int64
+	for name, x := range indexes {
+		px, ok := x.(persistedIndex)
+		if !ok {
+			continue
+		}
+		if err := readIndex(fs, name, px); isIndexUnavailable(err) {
+			continue
+		} else if err != nil {
+			return nil, 0, fmt.Errorf("index %s: %s", name, err)
+		}
+		xs[name] = x
+		if xsize := indexMemSize(x); xsize > 0 {
+			size += xsize
+		} else if fi, err := s.statIndex(name); err == nil {
+			size += fi.Size()
+		}
+	}
+	return xs, size, nil
+}
+
+// ParsePinnedVersions parses specs of the form "REPO" or
+// "REPO@COMMIT" (as used by FSMultiRepoStoreConf.PinIndexes, where
+// "REPO" selects all of the repo's versions).
+func ParsePinnedVersions(specs []string) ([]Version, error) {
+	versions := make([]Version, len(specs))
+	for i, spec := range specs {
+		repo, commitID := spec, ""
+		if i := strings.LastIndex(spec, "@"); i != -1 {
+			repo, commitID = spec[:i], spec[i+1:]
+			if commitID == "" {
+				return nil, fmt.Errorf("invalid version %q (commit ID is empty)", spec)
+			}
+		}
+		if repo == "" {
+			return nil, fmt.Errorf("invalid version %q (repo is empty)", spec)
+		}
+		versions[i] = Version{Repo: repo, CommitID: commitID}
+	}
+	return versions, nil
+}
@@ -0,0 +1,103 @@
+package store
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/kr/fs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestPinIndexes(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+	useIndexedStore = true
+
+	vfs := newTestFS()
+	mrs := NewFSMultiRepoStore(vfs, nil)
+	for _, u := range []string{"u1", "u2"} {
+		data := graph.Output{
+			Defs: []*graph.Def{
+				{DefKey: graph.DefKey{Path: u + "/p1"}, Name: "Reader", Exported: true, File: "f"},
+				{DefKey: graph.DefKey{Path: u + "/p2"}, Name: "Writer", Exported: true, File: "f"},
+			},
+			Refs: []*graph.Ref{{DefPath: u + "/p1", File: "f", Start: 1, End: 2}},
+		}
+		if err := mrs.Import("r", "c", &unit.SourceUnit{Key: unit.Key{Type: "t", Name: u}, Info: unit.Info{Files: []string{"f"}}}, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mrs.Index("r", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mrs.CreateVersion("r", "c"); err != nil {
+		t.Fatal(err)
+	}
+	treeKey := mrs.(*fsMultiRepoStore).openRepoStore("r").(*fsRepoStore).treeStoreFS("c").String()
+	defer cacheRemove(treeKey)
+
+	query := func(s MultiRepoStore) (defs []*graph.Def, refs []*graph.Ref) {
+		var err error
+		if defs, err = s.Defs(ByDefQuery("writ")); err != nil {
+			t.Fatal(err)
+		}
+		if refs, err = s.Refs(ByFiles(false, "f"), ByRefDef(graph.RefDefKey{DefUnitType: "t", DefUnit: "u1", DefPath: "u1/p1"})); err != nil {
+			t.Fatal(err)
+		}
+		sort.Sort(graph.Defs(defs))
+		return defs, refs
+	}
+	wantDefs, wantRefs := query(mrs)
+	cacheRemove(treeKey)
+
+	pinned := NewFSMultiRepoStore(vfs, &FSMultiRepoStoreConf{PinIndexes: []Version{{Repo: "r"}}})
+	stats, err := pinned.(MultiRepoPinnedIndexes).PinnedIndexes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Version{{Repo: "r", CommitID: "c"}}; !reflect.DeepEqual(stats.Trees, want) {
+		t.Errorf("got pinned trees %v, want %v", stats.Trees, want)
+	}
+	if stats.Indexes == 0 || stats.Bytes == 0 {
+		t.Errorf("got stats %+v, want pinned indexes and bytes", stats)
+	}
+
+	// Queries use the pinned indexes, even if the index files are
+	// gone.
+	var idxFiles []string
+	w := fs.WalkFS(".", vfs)
+	for w.Step() {
+		if err := w.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(w.Path(), ".idx") {
+			idxFiles = append(idxFiles, w.Path())
+		}
+	}
+	for _, f := range idxFiles {
+		if err := vfs.Remove(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c_indexFallbacks.set(0)
+	defs, refs := query(pinned)
+	if !reflect.DeepEqual(defs, wantDefs) || !reflect.DeepEqual(refs, wantRefs) {
+		t.Errorf("with pinned indexes, got defs %v and refs %v, want %v and %v", defs, refs, wantDefs, wantRefs)
+	}
+	if n := c_indexFallbacks.get(); n != 0 {
+		t.Errorf("with pinned indexes, got %d index fallbacks, want 0", n)
+	}
+
+	// Unpinned, the missing index files cause fallbacks to scans.
+	cacheRemove(treeKey)
+	query(pinned)
+	if c_indexFallbacks.get() == 0 {
+		t.Error("after unpinning, got no index fallbacks")
+	}
+
+	if _, err := NewFSMultiRepoStore(vfs, &FSMultiRepoStoreConf{PinIndexes: []Version{{Repo: "r", CommitID: "nope"}}}).(MultiRepoPinnedIndexes).PinnedIndexes(); err == nil {
+		t.Error("pinning nonexistent tree: got nil error, want error")
+	}
+}
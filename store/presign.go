@@ -0,0 +1,287 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+// A PresignFS is a filesystem that can issue pre-signed URLs for byte
+// ranges of its files (e.g., an S3-backed filesystem). A pre-signed
+// URL grants read access to the byte range [start, end) of a single
+// file until it expires, so it can be handed to clients that have no
+// credentials for the underlying storage.
+//
+// The range must be part of the signature (e.g., for S3, by signing
+// the Range header), so that the URL can't be used to read any other
+// bytes of the file. Clients fetch it with the HTTP request header
+// "Range: bytes=<start>-<end-1>".
+type PresignFS interface {
+	PresignURL(name string, start, end int64, expires time.Duration) (string, error)
+}
+
+var (
+	errPresignNotSupported = errors.New("store filesystem does not support pre-signed URLs (it must implement PresignFS)")
+	errPresignEncrypted    = errors.New("can't issue pre-signed URLs for an encrypted store (clients can't decrypt the data)")
+)
+
+// presignURL returns a pre-signed URL for the byte range [start, end)
+// of name on fs (see PresignFS).
+func presignURL(fs rwvfs.FileSystem, name string, start, end int64, expires time.Duration) (string, error) {
+	if fs, ok := fs.(PresignFS); ok {
+		return fs.PresignURL(name, start, end, expires)
+	}
+	return "", errPresignNotSupported
+}
+
+func (fs *throttledFS) PresignURL(name string, start, end int64, expires time.Duration) (string, error) {
+	return presignURL(fs.fs, name, start, end, expires)
+}
+
+// PresignURL implements PresignFS. It always fails, because the files
+// at the URLs would be encrypted.
+func (fs *encryptedFS) PresignURL(name string, start, end int64, expires time.Duration) (string, error) {
+	return "", errPresignEncrypted
+}
+
+func (fs *readCountingFS) PresignURL(name string, start, end int64, expires time.Duration) (string, error) {
+	return presignURL(fs.FileSystem, name, start, end, expires)
+}
+
+func (fs *writeCountingFS) PresignURL(name string, start, end int64, expires time.Duration) (string, error) {
+	return presignURL(fs.FileSystem, name, start, end, expires)
+}
+
+func (fs *writePolicyFS) PresignURL(name string, start, end int64, expires time.Duration) (string, error) {
+	return presignURL(fs.FileSystem, name, start, end, expires)
+}
+
+// PresignURL implements PresignFS. If name is a pointer file, the URL
+// is for the object it refers to (which has the same content).
+func (fs *casFS) PresignURL(name string, start, end int64, expires time.Duration) (string, error) {
+	digest, ok, err := fs.readPointer(name)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		name = casObjectPath(digest)
+	}
+	return presignURL(fs.WalkableFileSystem, name, start, end, expires)
+}
+
+var (
+	_ PresignFS = (*throttledFS)(nil)
+	_ PresignFS = (*encryptedFS)(nil)
+	_ PresignFS = (*readCountingFS)(nil)
+	_ PresignFS = (*writeCountingFS)(nil)
+	_ PresignFS = (*writePolicyFS)(nil)
+	_ PresignFS = (*casFS)(nil)
+)
+
+// A DataSegment is a byte range of a source unit's data file that
+// holds a consecutive run of a query's records.
+type DataSegment struct {
+	Repo     string
+	CommitID string
+	UnitType string
+	Unit     string
+
+	// URL is the pre-signed URL of the segment's byte range of the
+	// data file. It grants access to only that range.
+	URL string
+
+	// Start and End are the byte offsets (in the data file) of the
+	// segment's first byte and of the byte after its last byte. The
+	// segment must be fetched with the HTTP request header
+	// "Range: bytes=<Start>-<End-1>".
+	Start, End int64
+
+	// Records is the number of records in the segment.
+	Records int
+}
+
+// PresignedRecords is the result of a PresignDefs or PresignRefs
+// query.
+type PresignedRecords struct {
+	// ContentType is the media type of each record (e.g.,
+	// "application/json").
+	ContentType string
+
+	// Segments hold the matching records, in the same order that the
+	// corresponding Defs or Refs query returns them.
+	//
+	// Each record in a segment is preceded by its length header, as
+	// in the store's data files (an 8-byte little-endian length for
+	// the JSON codec, and a varint length for the protobuf codec).
+	// Like RawRecord's Data, the records omit the fields that are
+	// implied by their context, which clients must fill in from the
+	// segment's fields.
+	Segments []*DataSegment
+}
+
+// A MultiRepoPresigner can return pre-signed URLs for the data that
+// holds a query's results, so that clients (e.g., untrusted
+// frontends) can fetch large results directly from the underlying
+// storage instead of through the store.
+// Each URL only grants access to the bytes of its segment, so clients
+// can't read the records of defs or refs that didn't match.
+type MultiRepoPresigner interface {
+	// PresignDefs returns the segments of the store's data files
+	// that hold the defs that match the filters. The URLs expire
+	// after the given duration.
+	PresignDefs(expires time.Duration, f ...DefFilter) (*PresignedRecords, error)
+
+	// PresignRefs is like PresignDefs, but for refs.
+	PresignRefs(expires time.Duration, f ...RefFilter) (*PresignedRecords, error)
+}
+
+// PresignDefs implements MultiRepoPresigner. The store's filesystem
+// must implement PresignFS and must not be encrypted. It is an error
+// if a matching def isn't read from a data file (e.g., if it is
+// returned by an index that stores defs).
+func (s *fsMultiRepoStore) PresignDefs(expires time.Duration, fs ...DefFilter) (*PresignedRecords, error) {
+	rc, ok := s.codec().(rawCodec)
+	if !ok {
+		return nil, fmt.Errorf("codec %T does not support raw records", s.codec())
+	}
+	locs := newRecordLocationsFilter()
+	defs, err := s.Defs(append(fs, locs)...)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &presignedSegments{s: s, unitDirs: map[string]string{}}
+	for _, def := range defs {
+		rec, present := locs.defs[def]
+		if !present {
+			return nil, fmt.Errorf("can't presign def %+v: it wasn't read from a data file", def.DefKey)
+		}
+		p.add(def.Repo, def.CommitID, def.UnitType, def.Unit, rec)
+	}
+	if err := p.presign(expires); err != nil {
+		return nil, err
+	}
+	return &PresignedRecords{ContentType: rc.contentType(&graph.Def{}), Segments: p.segs}, nil
+}
+
+// PresignRefs implements MultiRepoPresigner. See PresignDefs.
+func (s *fsMultiRepoStore) PresignRefs(expires time.Duration, fs ...RefFilter) (*PresignedRecords, error) {
+	rc, ok := s.codec().(rawCodec)
+	if !ok {
+		return nil, fmt.Errorf("codec %T does not support raw records", s.codec())
+	}
+	locs := newRecordLocationsFilter()
+	refs, err := s.Refs(append(fs, locs)...)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &presignedSegments{s: s, unitDirs: map[string]string{}}
+	for _, ref := range refs {
+		rec, present := locs.refs[ref]
+		if !present {
+			return nil, fmt.Errorf("can't presign ref at %s:%d-%d: it wasn't read from a data file", ref.File, ref.Start, ref.End)
+		}
+		p.add(ref.Repo, ref.CommitID, ref.UnitType, ref.Unit, rec)
+	}
+	if err := p.presign(expires); err != nil {
+		return nil, err
+	}
+	return &PresignedRecords{ContentType: rc.contentType(&graph.Ref{}), Segments: p.segs}, nil
+}
+
+var _ MultiRepoPresigner = (*fsMultiRepoStore)(nil)
+
+// presignedSegments builds the segments of a PresignDefs or
+// PresignRefs query's results.
+type presignedSegments struct {
+	s *fsMultiRepoStore
+
+	segs     []*DataSegment
+	files    []string          // the path of each segment's data file
+	unitDirs map[string]string // "repo commitID unitType unit" -> unit's dir
+}
+
+// add adds the stored record rec (of a def or ref in the given source
+// unit) to the segments. It extends the last segment if rec directly
+// follows it in the same data file.
+func (p *presignedSegments) add(repo, commitID, unitType, unitName string, rec *storedRecord) {
+	key := repo + " " + commitID + " " + unitType + " " + unitName
+	dir, present := p.unitDirs[key]
+	if !present {
+		treeDir := p.s.fs.Join(p.s.repoPath(repo), commitID)
+		dir = p.s.fs.Join(treeDir, strings.TrimSuffix(existingUnitFilename(rwvfs.Sub(p.s.fs, treeDir), unitType, unitName), unitFileSuffix))
+		p.unitDirs[key] = dir
+	}
+	name := p.s.fs.Join(dir, rec.store.refShardDir, rec.file)
+	if n := len(p.segs); n > 0 && name == p.files[n-1] && p.segs[n-1].End == rec.offset {
+		p.segs[n-1].End += rec.size
+		p.segs[n-1].Records++
+		return
+	}
+	p.segs = append(p.segs, &DataSegment{
+		Repo:     repo,
+		CommitID: commitID,
+		UnitType: unitType,
+		Unit:     unitName,
+		Start:    rec.offset,
+		End:      rec.offset + rec.size,
+		Records:  1,
+	})
+	p.files = append(p.files, name)
+}
+
+// presign sets the URL of each segment to a pre-signed URL for its
+// byte range that expires after the given duration.
+func (p *presignedSegments) presign(expires time.Duration) error {
+	for i, seg := range p.segs {
+		url, err := presignURL(p.s.fs, p.files[i], seg.Start, seg.End, expires)
+		if err != nil {
+			return err
+		}
+		seg.URL = url
+	}
+	return nil
+}
+
+// recordLocationsFilter selects all defs and refs. It is passed down
+// to the fsUnitStores that read a PresignDefs or PresignRefs query's
+// records, which record where each def and ref they return is
+// stored.
+type recordLocationsFilter struct {
+	mu   sync.Mutex
+	defs map[*graph.Def]*storedRecord
+	refs map[*graph.Ref]*storedRecord
+}
+
+func newRecordLocationsFilter() *recordLocationsFilter {
+	return &recordLocationsFilter{defs: map[*graph.Def]*storedRecord{}, refs: map[*graph.Ref]*storedRecord{}}
+}
+
+func (f *recordLocationsFilter) String() string { return fmt.Sprintf("recordLocations(%p)", f) }
+
+func (f *recordLocationsFilter) SelectDef(*graph.Def) bool { return true }
+func (f *recordLocationsFilter) SelectRef(*graph.Ref) bool { return true }
+
+// observeDef implements recordObserver.
+func (f *recordLocationsFilter) observeDef(def *graph.Def, rec *storedRecord) {
+	loc := *rec
+	loc.dec = nil // don't retain the decoder's buffers
+	f.mu.Lock()
+	f.defs[def] = &loc
+	f.mu.Unlock()
+}
+
+// observeRef implements recordObserver.
+func (f *recordLocationsFilter) observeRef(ref *graph.Ref, rec *storedRecord) {
+	loc := *rec
+	loc.dec = nil
+	f.mu.Lock()
+	f.refs[ref] = &loc
+	f.mu.Unlock()
+}
@@ -0,0 +1,168 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// presigningFS issues fake pre-signed URLs
+// ("presigned:<name>#<start>-<end>").
+type presigningFS struct {
+	rwvfs.WalkableFileSystem
+}
+
+func (fs presigningFS) PresignURL(name string, start, end int64, expires time.Duration) (string, error) {
+	return fmt.Sprintf("presigned:%s#%d-%d", name, start, end), nil
+}
+
+func TestFSMultiRepoStore_Presign(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
+	data := graph.Output{
+		Defs: []*graph.Def{
+			{DefKey: graph.DefKey{Path: "p1"}, Name: "a", File: "f"},
+			{DefKey: graph.DefKey{Path: "p2"}, Name: "b", File: "f"},
+			{DefKey: graph.DefKey{Path: "p3"}, Name: "c", File: "f"},
+		},
+		Refs: []*graph.Ref{
+			{DefPath: "p1", File: "f", Start: 1, End: 2},
+			{DefPath: "p2", File: "f", Start: 3, End: 4},
+		},
+	}
+
+	for _, indexed := range []bool{false, true} {
+		for _, contentAddressed := range []bool{false, true} {
+			useIndexedStore = indexed
+			vfs := presigningFS{newTestFS()}
+			mrs := NewFSMultiRepoStore(vfs, &FSMultiRepoStoreConf{ContentAddressed: contentAddressed}).(*fsMultiRepoStore)
+			if err := mrs.Import("r", "c", u, data); err != nil {
+				t.Fatal(err)
+			}
+			if err := mrs.Index("r", "c"); err != nil {
+				t.Fatal(err)
+			}
+			if err := mrs.CreateVersion("r", "c"); err != nil {
+				t.Fatal(err)
+			}
+
+			// fetch returns the records in a segment, as a client
+			// would fetch them.
+			fetch := func(seg *DataSegment) []byte {
+				if seg.Repo != "r" || seg.CommitID != "c" || seg.UnitType != "t" || seg.Unit != "u" {
+					t.Errorf("indexed=%v cas=%v: got segment %+v, want one in r@c unit t/u", indexed, contentAddressed, seg)
+				}
+				var name string
+				var start, end int64
+				if _, err := fmt.Sscanf(strings.Replace(strings.TrimPrefix(seg.URL, "presigned:"), "#", " ", 1), "%s %d-%d", &name, &start, &end); err != nil {
+					t.Fatalf("bad URL %q: %s", seg.URL, err)
+				}
+				if start != seg.Start || end != seg.End {
+					t.Errorf("indexed=%v cas=%v: got URL %q for segment %d-%d, want it to be signed for only the segment's range", indexed, contentAddressed, seg.URL, seg.Start, seg.End)
+				}
+				if contentAddressed && !strings.HasPrefix(name, casDir) {
+					t.Errorf("cas: got URL %q, want one for a content store object", seg.URL)
+				}
+				f, err := vfs.Open(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				b, err := ioutil.ReadAll(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return b[start:end]
+			}
+
+			for _, f := range [][]DefFilter{nil, {ByDefPath("p2")}} {
+				defs, err := mrs.Defs(f...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				recs, err := mrs.PresignDefs(time.Hour, f...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if f == nil && !indexed && len(recs.Segments) != 1 {
+					// A scan reads the defs in file order, so their
+					// records are merged into one segment.
+					t.Errorf("cas=%v: got %d segments for scan, want 1", contentAddressed, len(recs.Segments))
+				}
+				var got []string
+				for _, seg := range recs.Segments {
+					dec := Codec.NewDecoder(bytes.NewReader(fetch(seg)))
+					for i := 0; i < seg.Records; i++ {
+						var def graph.Def
+						if _, err := dec.Decode(&def); err != nil {
+							t.Fatal(err)
+						}
+						got = append(got, def.Path)
+					}
+					if _, err := dec.Decode(&graph.Def{}); err != io.EOF {
+						t.Errorf("indexed=%v cas=%v: got %v after segment's records, want EOF", indexed, contentAddressed, err)
+					}
+				}
+				var want []string
+				for _, def := range defs {
+					want = append(want, def.Path)
+				}
+				if strings.Join(got, " ") != strings.Join(want, " ") {
+					t.Errorf("indexed=%v cas=%v: %v: got presigned defs %v, want %v", indexed, contentAddressed, f, got, want)
+				}
+			}
+
+			refs, err := mrs.Refs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			recs, err := mrs.PresignRefs(time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n := 0
+			for _, seg := range recs.Segments {
+				dec := Codec.NewDecoder(bytes.NewReader(fetch(seg)))
+				for i := 0; i < seg.Records; i++ {
+					var ref graph.Ref
+					if _, err := dec.Decode(&ref); err != nil {
+						t.Fatal(err)
+					}
+					if ref.DefPath != refs[n].DefPath || ref.Start != refs[n].Start {
+						t.Errorf("indexed=%v cas=%v: presigned ref %d: got %+v, want %+v", indexed, contentAddressed, n, ref, refs[n])
+					}
+					n++
+				}
+			}
+			if n != len(refs) {
+				t.Errorf("indexed=%v cas=%v: got %d presigned refs, want %d", indexed, contentAddressed, n, len(refs))
+			}
+		}
+	}
+
+	// Encrypted stores and filesystems that can't presign are
+	// rejected.
+	for _, mrs := range []*fsMultiRepoStore{
+		NewFSMultiRepoStore(presigningFS{newTestFS()}, &FSMultiRepoStoreConf{EncryptionKey: staticKey(bytes.Repeat([]byte{1}, 16))}).(*fsMultiRepoStore),
+		NewFSMultiRepoStore(newTestFS(), nil).(*fsMultiRepoStore),
+	} {
+		if err := mrs.Import("r", "c", u, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.CreateVersion("r", "c"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mrs.PresignDefs(time.Hour); err != errPresignEncrypted && err != errPresignNotSupported {
+			t.Errorf("%s: got error %v, want presigning to be unsupported", mrs.fs, err)
+		}
+	}
+}
@@ -1,32 +1,211 @@
 package store
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"sort"
 
-	"strings"
-
+	"golang.org/x/net/context"
+	"sourcegraph.com/sourcegraph/rwvfs"
 	"sourcegraph.com/sourcegraph/srclib/graph"
-	"sourcegraph.com/sourcegraph/srclib/store/phtable"
 )
 
+// defPathIndex maps def paths to the byte offsets of the defs in the
+// unit's def data file.
+//
+// It is persisted (uncompressed) as a sorted flat table of fixed-size
+// entries, so that a lookup can binary search the index file using a
+// few small range reads instead of fetching and decoding the whole
+// file. This makes point lookups cheap on remote VFSs (such as S3).
+//
+// The layout is a header (defPathIndexMagic, then the key width and
+// entry count as big-endian uint32 and uint64) followed by the
+// entries, sorted by key. Each entry is a def path (truncated to the
+// key width and padded with NUL bytes) followed by the def's byte
+// offset as a big-endian uint64. Because keys may be truncated, a
+// lookup may return the offsets of other defs whose paths share a
+// long prefix with the query; these are removed by the query's
+// ByDefPath filter when the defs are read.
 type defPathIndex struct {
-	phtable *phtable.CHD
-	ready   bool
+	keyWidth int
+	n        int64
+
+	// table is the entries (if the whole index has been read into
+	// memory).
+	table []byte
+
+	// fs and filename are the index file to perform range reads on
+	// (if the index was opened instead of read).
+	fs       rwvfs.FileSystem
+	filename string
+
+	ready bool
 }
 
 var _ interface {
 	Index
 	persistedIndex
+	rangeReadIndex
 	defIndexBuilder
 	defIndex
 } = (*defPathIndex)(nil)
 
-func (x *defPathIndex) getByPath(defPath string) (int64, bool) {
-	if x.phtable == nil {
-		panic("phtable not built/read")
+const (
+	defPathIndexName = "path_to_def_sorted"
+
+	// defPathIndexMagic begins every def path index file.
+	defPathIndexMagic = "SDP1"
+
+	// defPathIndexHeaderLen is the length of the index file header.
+	defPathIndexHeaderLen = len(defPathIndexMagic) + 4 + 8
+
+	// maxDefPathIndexKeyWidth is the maximum width of a def path key
+	// in the index. Longer def paths are truncated.
+	maxDefPathIndexKeyWidth = 128
+)
+
+var errBadDefPathIndex = errors.New("bad def path index file")
+
+func (x *defPathIndex) entryLen() int64 { return int64(x.keyWidth) + 8 }
+
+// key returns defPath as an index key (truncated or padded to the
+// key width).
+func (x *defPathIndex) key(defPath string) []byte {
+	k := make([]byte, x.keyWidth)
+	copy(k, defPath)
+	return k
+}
+
+// entries returns the entries in the range [i, j) of the index.
+func (x *defPathIndex) entries(ctx context.Context, f io.ReadSeeker, i, j int64) ([]byte, error) {
+	if x.table != nil {
+		return x.table[i*x.entryLen() : j*x.entryLen()], nil
+	}
+	start, n := int64(defPathIndexHeaderLen)+i*x.entryLen(), (j-i)*x.entryLen()
+	r, err := rangeReader(ctx, x.fs, x.filename, f, start, n)
+	if err != nil {
+		return nil, err
 	}
-	v, found := x.phtable.GetUint64([]byte(defPath))
-	return int64(v), found
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// getByPath returns the byte offsets of the defs whose (possibly
+// truncated) path key is equal to defPath's.
+func (x *defPathIndex) getByPath(ctx context.Context, defPath string) (byteOffsets, error) {
+	if !x.ready {
+		panic("def path index not built/read")
+	}
+	if x.n == 0 {
+		return nil, nil
+	}
+
+	var f io.ReadSeeker
+	if x.table == nil {
+		rf, err := openFetcherOrOpen(ctx, x.fs, x.filename)
+		if err != nil {
+			return nil, err
+		}
+		defer rf.Close()
+		f = rf
+	}
+
+	// Binary search for the first entry whose key is >= the query key.
+	key := x.key(defPath)
+	var searchErr error
+	i := int64(sort.Search(int(x.n), func(i int) bool {
+		if searchErr != nil {
+			return true
+		}
+		e, err := x.entries(ctx, f, int64(i), int64(i)+1)
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return bytes.Compare(e[:x.keyWidth], key) >= 0
+	}))
+	if searchErr != nil {
+		return nil, searchErr
+	}
+
+	// Collect the offsets of all entries with an equal key.
+	var ofs byteOffsets
+	for ; i < x.n; i++ {
+		e, err := x.entries(ctx, f, i, i+1)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(e[:x.keyWidth], key) {
+			break
+		}
+		ofs = append(ofs, int64(binary.BigEndian.Uint64(e[x.keyWidth:])))
+	}
+	return ofs, nil
+}
+
+// offsets returns the byte offsets of all defs in the index (which
+// must have been read into memory), in index order.
+func (x *defPathIndex) offsets() byteOffsets {
+	ofs := make(byteOffsets, x.n)
+	for i := range ofs {
+		e := x.table[int64(i)*x.entryLen():][:x.entryLen()]
+		ofs[i] = int64(binary.BigEndian.Uint64(e[x.keyWidth:]))
+	}
+	return ofs
+}
+
+// offsetsAt returns the byte offsets of the defs at the given entry
+// indexes (in [0, x.n)). Unlike offsets, it doesn't require the index
+// to have been read into memory.
+func (x *defPathIndex) offsetsAt(ctx context.Context, is []int64) (byteOffsets, error) {
+	if !x.ready {
+		panic("def path index not built/read")
+	}
+	var f io.ReadSeeker
+	if x.table == nil {
+		rf, err := openFetcherOrOpen(ctx, x.fs, x.filename)
+		if err != nil {
+			return nil, err
+		}
+		defer rf.Close()
+		f = rf
+	}
+	ofs := make(byteOffsets, len(is))
+	for k, i := range is {
+		e, err := x.entries(ctx, f, i, i+1)
+		if err != nil {
+			return nil, err
+		}
+		ofs[k] = int64(binary.BigEndian.Uint64(e[x.keyWidth:]))
+	}
+	return ofs, nil
+}
+
+// dump returns the index's entries (for DumpIndex).
+func (x *defPathIndex) dump() interface{} {
+	type entry struct {
+		Path   string
+		Offset int64
+	}
+	entries := make([]entry, x.n)
+	for i := range entries {
+		e := x.table[int64(i)*x.entryLen():][:x.entryLen()]
+		entries[i] = entry{
+			Path:   string(bytes.TrimRight(e[:x.keyWidth], "\x00")),
+			Offset: int64(binary.BigEndian.Uint64(e[x.keyWidth:])),
+		}
+	}
+	return struct {
+		KeyWidth int
+		Entries  []entry
+	}{x.keyWidth, entries}
 }
 
 // Covers implements defIndex.
@@ -44,36 +223,53 @@ func (x *defPathIndex) Covers(filters interface{}) int {
 func (x *defPathIndex) Defs(f ...DefFilter) (byteOffsets, error) {
 	for _, ff := range f {
 		if pf, ok := ff.(ByDefPathFilter); ok {
-			ofs, found := x.getByPath(pf.ByDefPath())
-			if !found {
-				return nil, nil
-			}
-			return byteOffsets{ofs}, nil
+			return x.getByPath(queryContext(f), pf.ByDefPath())
 		}
 	}
 	return nil, nil
 }
 
+type defPathIndexEntries struct {
+	keys [][]byte
+	ofs  byteOffsets
+}
+
+func (v defPathIndexEntries) Len() int           { return len(v.keys) }
+func (v defPathIndexEntries) Less(i, j int) bool { return bytes.Compare(v.keys[i], v.keys[j]) < 0 }
+func (v defPathIndexEntries) Swap(i, j int) {
+	v.keys[i], v.keys[j] = v.keys[j], v.keys[i]
+	v.ofs[i], v.ofs[j] = v.ofs[j], v.ofs[i]
+}
+
 // Build implements defIndexBuilder.
 func (x *defPathIndex) Build(defs []*graph.Def, ofs byteOffsets) error {
-	tries := 0
-retry:
 	vlog.Printf("defPathIndex: building index... (%d defs)", len(defs))
-	b := phtable.Uvarint64Builder(len(defs))
+	x.keyWidth = 1
+	for _, def := range defs {
+		if len(def.Path) > x.keyWidth {
+			x.keyWidth = len(def.Path)
+		}
+	}
+	if x.keyWidth > maxDefPathIndexKeyWidth {
+		x.keyWidth = maxDefPathIndexKeyWidth
+	}
+
+	e := defPathIndexEntries{keys: make([][]byte, len(defs)), ofs: make(byteOffsets, len(defs))}
 	for i, def := range defs {
-		b.AddUvarint64([]byte(def.Path), uint64(ofs[i]))
+		e.keys[i] = x.key(def.Path)
+		e.ofs[i] = ofs[i]
 	}
-	vlog.Printf("defPathIndex: done adding index (%d defs).", len(defs))
-	h, err := b.Build()
-	if err != nil {
-		if tries < 10 && strings.Contains(err.Error(), "failed to find a collision-free hash function") {
-			tries++
-			goto retry
-		}
-		return err
+	sort.Stable(e)
+
+	x.n = int64(len(defs))
+	x.table = make([]byte, 0, x.n*x.entryLen())
+	var ofsBuf [8]byte
+	for i, key := range e.keys {
+		x.table = append(x.table, key...)
+		binary.BigEndian.PutUint64(ofsBuf[:], uint64(e.ofs[i]))
+		x.table = append(x.table, ofsBuf[:]...)
 	}
-	h.ValuesAreVarints = true
-	x.phtable = h
+	x.fs, x.filename = nil, ""
 	x.ready = true
 	vlog.Printf("defPathIndex: done building index (%d defs).", len(defs))
 	return nil
@@ -81,18 +277,80 @@ retry:
 
 // Write implements persistedIndex.
 func (x *defPathIndex) Write(w io.Writer) error {
-	if x.phtable == nil {
-		panic("no phtable to write")
+	if x.table == nil {
+		panic("no def path index table to write")
+	}
+	hdr := make([]byte, defPathIndexHeaderLen)
+	copy(hdr, defPathIndexMagic)
+	binary.BigEndian.PutUint32(hdr[len(defPathIndexMagic):], uint32(x.keyWidth))
+	binary.BigEndian.PutUint64(hdr[len(defPathIndexMagic)+4:], uint64(x.n))
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(x.table)
+	return err
+}
+
+// readHeader reads the index file header from r.
+func (x *defPathIndex) readHeader(r io.Reader) error {
+	hdr := make([]byte, defPathIndexHeaderLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errBadDefPathIndex
+		}
+		return err
+	}
+	if string(hdr[:len(defPathIndexMagic)]) != defPathIndexMagic {
+		return errBadDefPathIndex
 	}
-	return x.phtable.Write(w)
+	x.keyWidth = int(binary.BigEndian.Uint32(hdr[len(defPathIndexMagic):]))
+	x.n = int64(binary.BigEndian.Uint64(hdr[len(defPathIndexMagic)+4:]))
+	if x.keyWidth <= 0 || x.keyWidth > maxDefPathIndexKeyWidth || x.n < 0 {
+		return errBadDefPathIndex
+	}
+	return nil
 }
 
-// Read implements persistedIndex.
+// Read implements persistedIndex. It reads the whole index into
+// memory.
 func (x *defPathIndex) Read(r io.Reader) error {
-	var err error
-	x.phtable, err = phtable.ReadVarints(r)
-	x.ready = (err == nil)
-	return err
+	x.ready = false
+	if err := x.readHeader(r); err != nil {
+		return err
+	}
+	table, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(table)) != x.n*x.entryLen() {
+		return errBadDefPathIndex
+	}
+	x.table = table
+	x.fs, x.filename = nil, ""
+	x.ready = true
+	return nil
+}
+
+// open implements rangeReadIndex. Only the index file header is read;
+// lookups read entries from the file as needed.
+func (x *defPathIndex) open(fs rwvfs.FileSystem, filename string) error {
+	x.ready = false
+	f, err := openFetcherOrOpen(context.Background(), fs, filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := rangeReader(context.Background(), fs, filename, f, 0, int64(defPathIndexHeaderLen))
+	if err != nil {
+		return err
+	}
+	if err := x.readHeader(r); err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+	x.table = nil
+	x.fs, x.filename = fs, filename
+	x.ready = true
+	return nil
 }
 
 // Ready implements persistedIndex.
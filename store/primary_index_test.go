@@ -1,6 +1,13 @@
 package store
 
-import "testing"
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
 
 func TestDefPathIndex_Covers(t *testing.T) {
 	x := &defPathIndex{}
@@ -19,3 +26,55 @@ func TestDefPathIndex_Covers(t *testing.T) {
 		t.Errorf("got coverage %d, want %d", c, want)
 	}
 }
+
+func TestDefPathIndex_sortedLookup(t *testing.T) {
+	longPrefix := strings.Repeat("x", maxDefPathIndexKeyWidth)
+	defs := []*graph.Def{
+		{DefKey: graph.DefKey{Path: "c"}},
+		{DefKey: graph.DefKey{Path: "a"}},
+		{DefKey: graph.DefKey{Path: "b/c"}},
+		{DefKey: graph.DefKey{Path: longPrefix + "1"}},
+		{DefKey: graph.DefKey{Path: longPrefix + "2"}},
+	}
+	ofs := byteOffsets{10, 20, 30, 40, 50}
+
+	x := &defPathIndex{}
+	if err := x.Build(defs, ofs); err != nil {
+		t.Fatal(err)
+	}
+	fs := rwvfs.Map(map[string]string{})
+	if err := writeIndex(fs, "x", x); err != nil {
+		t.Fatal(err)
+	}
+
+	// Test both the in-memory index and range reads on the persisted
+	// index.
+	opened := &defPathIndex{}
+	if err := prepareIndex(fs, "x", opened); err != nil {
+		t.Fatal(err)
+	}
+	if opened.table != nil {
+		t.Error("opened index was read into memory, want range reads")
+	}
+	for _, x := range []*defPathIndex{x, opened} {
+		tests := map[string]byteOffsets{
+			"a":   {20},
+			"b/c": {30},
+			"c":   {10},
+			"b":   nil,
+			"d":   nil,
+			// Keys longer than the max key width are truncated, so
+			// lookups also return defs with the same key prefix.
+			longPrefix + "1": {40, 50},
+		}
+		for path, want := range tests {
+			got, err := x.Defs(ByDefPath(path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%q: got offsets %v, want %v", path, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,585 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/tools/godoc/vfs"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// A QueryLogEntry records a query performed on a store, so that the
+// query workload can later be replayed (with ReplayQueryLog) against
+// another build of the store to compare performance.
+type QueryLogEntry struct {
+	Time time.Time
+
+	// Op is the name of the store method that was called ("Repos",
+	// "Versions", "Units", "Defs", or "Refs").
+	Op string
+
+	// Filters are the query's filters.
+	Filters []QueryLogFilter
+
+	Duration time.Duration
+
+	// BytesRead is the number of bytes read from the store's VFS
+	// during the query (or -1 if unknown). If other queries were
+	// running concurrently, it includes the bytes that they read.
+	BytesRead int64
+
+	// Results is the number of results that the query returned.
+	Results int
+
+	Error string `json:",omitempty"`
+
+	// Trace is the query's trace (for slow-query log entries; see
+	// NewSlowQueryLoggingStore).
+	Trace *QueryTrace `json:",omitempty"`
+}
+
+// A QueryLogFilter is the logged form of a query filter. Name is the
+// name of the function that created the filter (e.g., "ByRepos"), and
+// the other fields hold its arguments. Filters that can't be logged
+// (such as filter funcs) have an empty Name and are described by
+// String; they are omitted when the query is replayed.
+type QueryLogFilter struct {
+	Name string `json:",omitempty"`
+
+	Repos      []string         `json:",omitempty"`
+	CommitIDs  []string         `json:",omitempty"`
+	Versions   []Version        `json:",omitempty"`
+	Units      []unit.ID2       `json:",omitempty"`
+	UnitKey    *unit.Key        `json:",omitempty"`
+	DefKey     *graph.DefKey    `json:",omitempty"`
+	RefDef     *graph.RefDefKey `json:",omitempty"`
+	Query      string           `json:",omitempty"` // ByDefPath's path, ByDefName's name, ByDefNameRegexp's regexp, or ByDefQuery's or BySignatureQuery's query
+	Values     []string         `json:",omitempty"` // ByDefKinds, ByDefQueries' expansions, ByUnitTypes, ByAuthor, ByOwner, ByUnitMetadata's key and value, and unit names
+	Files      []string         `json:",omitempty"` // ByFiles' files or ByDirs' dirs
+	Exact      bool             `json:",omitempty"`
+	IgnoreCase bool             `json:",omitempty"`
+	N          int              `json:",omitempty"` // First's or Offset's n
+
+	String string `json:",omitempty"`
+}
+
+// queryLogFilters returns the logged form of filters. In/out filters
+// (such as *QueryStats, *ConditionalQuery, and *QueryTrace) and
+// *Arena filters are omitted.
+func queryLogFilters(filters []interface{}) []QueryLogFilter {
+	var lfs []QueryLogFilter
+	for _, f := range filters {
+		var lf QueryLogFilter
+		switch f := f.(type) {
+		case *QueryStats, *ConditionalQuery, *QueryTrace, *Arena:
+			continue
+		case byReposFilter:
+			lf = QueryLogFilter{Name: "ByRepos", Repos: f}
+		case byCommitIDsFilter:
+			lf = QueryLogFilter{Name: "ByCommitIDs", CommitIDs: f}
+		case byRepoCommitIDsFilter:
+			lf = QueryLogFilter{Name: "ByRepoCommitIDs", Versions: f}
+		case byUnitsFilter:
+			lf = QueryLogFilter{Name: "ByUnits", Units: f}
+		case byUnitTypesFilter:
+			lf = QueryLogFilter{Name: "ByUnitTypes", Values: f}
+		case byUnitKeyFilter:
+			key := f.key
+			lf = QueryLogFilter{Name: "ByUnitKey", UnitKey: &key}
+		case byDefKeyFilter:
+			key := f.key
+			lf = QueryLogFilter{Name: "ByDefKey", DefKey: &key}
+		case *byRefDefFilter:
+			def := f.def
+			lf = QueryLogFilter{Name: "ByRefDef", RefDef: &def}
+		case byDefPathFilter:
+			lf = QueryLogFilter{Name: "ByDefPath", Query: string(f)}
+		case byDefNameFilter:
+			lf = QueryLogFilter{Name: "ByDefName", Query: string(f)}
+		case byDirsFilter:
+			lf = QueryLogFilter{Name: "ByDirs", Files: f}
+		case ByDefNameRegexpFilter:
+			lf = QueryLogFilter{Name: "ByDefNameRegexp", Query: f.ByDefNameRegexp().String()}
+		case byDefQueriesFilter:
+			lf = QueryLogFilter{Name: "ByDefQueries", Values: f}
+		case ByDefQueryFilter:
+			// This also logs ByDefQueryMatches filters as ByDefQuery
+			// filters, which select the same defs.
+			lf = QueryLogFilter{Name: "ByDefQuery", Query: f.ByDefQuery()}
+		case byDefKindsFilter:
+			lf = QueryLogFilter{Name: "ByDefKinds", Values: f}
+		case BySignatureQueryFilter:
+			lf = QueryLogFilter{Name: "BySignatureQuery", Query: f.BySignatureQuery().String()}
+		case byExportedFilter:
+			lf = QueryLogFilter{Name: "ByExported"}
+		case ByDeprecatedFilter:
+			lf = QueryLogFilter{Name: "ByDeprecated"}
+		case forceScanFilter:
+			lf = QueryLogFilter{Name: "ForceScan"}
+		case requireIndexFilter:
+			lf = QueryLogFilter{Name: "RequireIndex"}
+		case unorderedFilter:
+			lf = QueryLogFilter{Name: "Unordered"}
+		case byFilesFilter:
+			lf = QueryLogFilter{Name: "ByFiles", Files: f.files, Exact: f.exact, IgnoreCase: f.ignoreCase}
+		case byAuthorFilter:
+			lf = QueryLogFilter{Name: "ByAuthor", Values: f}
+		case byOwnerFilter:
+			lf = QueryLogFilter{Name: "ByOwner", Values: f}
+		case byUnitMetadataFilter:
+			lf = QueryLogFilter{Name: "ByUnitMetadata", Values: []string{f.key, f.value}}
+		case byUnitNamesFilter:
+			lf = QueryLogFilter{Name: "byUnitNames", Values: f}
+		case limitFilter:
+			lf = QueryLogFilter{Name: "First", N: int(f)}
+		case offsetFilter:
+			lf = QueryLogFilter{Name: "Offset", N: int(f)}
+		default:
+			lf = QueryLogFilter{String: fmt.Sprint(f)}
+		}
+		lfs = append(lfs, lf)
+	}
+	return lfs
+}
+
+// filter returns the filter that f is the logged form of, or nil if f
+// can't be replayed.
+func (f QueryLogFilter) filter() interface{} {
+	switch f.Name {
+	case "ByRepos":
+		return ByRepos(f.Repos...)
+	case "ByCommitIDs":
+		return ByCommitIDs(f.CommitIDs...)
+	case "ByRepoCommitIDs":
+		return ByRepoCommitIDs(f.Versions...)
+	case "ByUnits":
+		return ByUnits(f.Units...)
+	case "ByUnitTypes":
+		return ByUnitTypes(f.Values...)
+	case "ByUnitKey":
+		if f.UnitKey != nil {
+			return ByUnitKey(*f.UnitKey)
+		}
+	case "ByDefKey":
+		if f.DefKey != nil {
+			return ByDefKey(*f.DefKey)
+		}
+	case "ByRefDef":
+		if f.RefDef != nil {
+			return ByRefDef(*f.RefDef)
+		}
+	case "ByDefPath":
+		return ByDefPath(f.Query)
+	case "ByDefName":
+		return ByDefName(f.Query)
+	case "ByDefQuery":
+		return ByDefQuery(f.Query)
+	case "ByDirs":
+		return ByDirs(f.Files...)
+	case "ByDefQueries":
+		if len(f.Values) > 0 {
+			return byDefQueriesFilter(f.Values)
+		}
+	case "ByDefNameRegexp":
+		if re, err := regexp.Compile(f.Query); err == nil {
+			return ByDefNameRegexp(re)
+		}
+	case "ByDefKinds":
+		return ByDefKinds(f.Values...)
+	case "BySignatureQuery":
+		if q, err := ParseSignatureQuery(f.Query); err == nil {
+			return BySignatureQuery(*q)
+		}
+	case "ByExported":
+		return ByExported()
+	case "ByDeprecated":
+		return ByDeprecated()
+	case "ForceScan":
+		return ForceScan()
+	case "RequireIndex":
+		return RequireIndex()
+	case "Unordered":
+		return Unordered()
+	case "ByFiles":
+		if f.IgnoreCase {
+			return ByFilesIgnoreCase(f.Exact, f.Files...)
+		}
+		return ByFiles(f.Exact, f.Files...)
+	case "ByAuthor":
+		return ByAuthor(f.Values...)
+	case "ByOwner":
+		return ByOwner(f.Values...)
+	case "ByUnitMetadata":
+		if len(f.Values) == 2 && f.Values[0] != "" {
+			return ByUnitMetadata(f.Values[0], f.Values[1])
+		}
+	case "byUnitNames":
+		return byUnitNamesFilter(f.Values)
+	case "First":
+		if f.N >= 0 {
+			return First(f.N)
+		}
+	case "Offset":
+		if f.N >= 0 {
+			return Offset(f.N)
+		}
+	}
+	return nil
+}
+
+// A QueryLogSink receives the entries of a query log.
+type QueryLogSink interface {
+	LogQuery(*QueryLogEntry) error
+}
+
+// A QueryLogWriter is a QueryLogSink that writes entries (as JSON,
+// one per line) to a writer. It is safe for concurrent use.
+type QueryLogWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+}
+
+// NewQueryLogWriter returns a QueryLogWriter that writes to w.
+func NewQueryLogWriter(w io.Writer) *QueryLogWriter {
+	return &QueryLogWriter{w: w, enc: json.NewEncoder(w)}
+}
+
+// LogQuery implements QueryLogSink.
+func (w *QueryLogWriter) LogQuery(e *QueryLogEntry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.enc.Encode(e)
+}
+
+// Close closes the underlying writer (if it is an io.Closer).
+func (w *QueryLogWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if c, ok := w.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// ReadQueryLog reads the entries written by a QueryLogWriter.
+func ReadQueryLog(r io.Reader) ([]*QueryLogEntry, error) {
+	var entries []*QueryLogEntry
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var e QueryLogEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &e)
+	}
+	return entries, nil
+}
+
+// queryLogDir is the dir (in a store's VFS) that holds query logs
+// created by CreateQueryLog.
+const queryLogDir = "query-logs"
+
+// CreateQueryLog creates a new query log file in the store whose data
+// is in fs. The caller must close the returned writer when done.
+func CreateQueryLog(fs rwvfs.FileSystem) (*QueryLogWriter, error) {
+	if err := rwvfs.MkdirAll(fs, queryLogDir); err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("%s-%d.jsonl", time.Now().UTC().Format("20060102T150405.000000000Z"), os.Getpid())
+	f, err := fs.Create(path.Join(queryLogDir, name))
+	if err != nil {
+		return nil, err
+	}
+	return NewQueryLogWriter(f), nil
+}
+
+// ReadQueryLogs reads the entries in all of the query logs created
+// (with CreateQueryLog) in the store whose data is in fs, in the
+// order in which the logs were created. If there are no query logs, it
+// returns no entries and no error.
+func ReadQueryLogs(fs rwvfs.FileSystem) ([]*QueryLogEntry, error) {
+	fis, err := fs.ReadDir(queryLogDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(fis))
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var entries []*QueryLogEntry
+	for _, name := range names {
+		f, err := fs.Open(path.Join(queryLogDir, name))
+		if err != nil {
+			return nil, err
+		}
+		es, err := ReadQueryLog(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("query log %s: %s", name, err)
+		}
+		entries = append(entries, es...)
+	}
+	return entries, nil
+}
+
+// NewReadCountingFS returns a filesystem that counts the bytes read
+// from files opened on fs, and a func that returns the count so far.
+// Pass the filesystem to a store constructor and the func to
+// NewQueryLoggingStore or ReplayQueryLog to record the bytes read by
+// queries.
+func NewReadCountingFS(fs rwvfs.FileSystem) (rwvfs.WalkableFileSystem, func() int64) {
+	c := &readCountingFS{FileSystem: fs}
+	return rwvfs.Walkable(c), func() int64 { return atomic.LoadInt64(&c.n) }
+}
+
+type readCountingFS struct {
+	rwvfs.FileSystem
+	n int64
+}
+
+func (fs *readCountingFS) Open(name string) (vfs.ReadSeekCloser, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &readCountingFile{ReadSeekCloser: f, n: &fs.n}, nil
+}
+
+func (fs *readCountingFS) String() string { return "ReadCounting(" + fs.FileSystem.String() + ")" }
+
+func (fs *readCountingFS) CreateParentDirs(b bool) {
+	type createParents interface {
+		CreateParentDirs(bool)
+	}
+	if cfs, ok := fs.FileSystem.(createParents); ok {
+		cfs.CreateParentDirs(b)
+	}
+}
+
+// Join implements rwvfs.WalkableFileSystem using the underlying FS's
+// Join (if any).
+func (fs *readCountingFS) Join(elem ...string) string {
+	if wfs, ok := fs.FileSystem.(rwvfs.WalkableFileSystem); ok {
+		return wfs.Join(elem...)
+	}
+	return path.Join(elem...)
+}
+
+type readCountingFile struct {
+	vfs.ReadSeekCloser
+	n *int64
+}
+
+func (f *readCountingFile) Read(p []byte) (int, error) {
+	n, err := f.ReadSeekCloser.Read(p)
+	atomic.AddInt64(f.n, int64(n))
+	return n, err
+}
+
+// NewQueryLoggingStore returns a MultiRepoStore that performs queries
+// on s and logs each query to sink. If bytesRead is non-nil, it is
+// called before and after each query to determine the number of bytes
+// that the query read (see NewReadCountingFS).
+//
+// The returned store only implements MultiRepoStore; other interfaces
+// that s implements (such as MultiRepoImporter) are hidden.
+func NewQueryLoggingStore(s MultiRepoStore, sink QueryLogSink, bytesRead func() int64) MultiRepoStore {
+	return &queryLoggingStore{s: s, sink: sink, bytesRead: bytesRead, clock: clockOf(s)}
+}
+
+type queryLoggingStore struct {
+	s         MultiRepoStore
+	sink      QueryLogSink
+	bytesRead func() int64
+	clock     Clock // the clock of s (which times its queries)
+}
+
+var _ MultiRepoStore = (*queryLoggingStore)(nil)
+
+// queryStart records the state at the start of a query.
+type queryStart struct {
+	clock     Clock
+	time      time.Time
+	bytesRead int64
+}
+
+func beginQuery(clock Clock, bytesRead func() int64) queryStart {
+	q := queryStart{clock: clock, time: clock.Now(), bytesRead: -1}
+	if bytesRead != nil {
+		q.bytesRead = bytesRead()
+	}
+	return q
+}
+
+// end returns the log entry for a query that started at q.
+func (q queryStart) end(bytesRead func() int64, op string, filters []QueryLogFilter, results int, err error) *QueryLogEntry {
+	e := &QueryLogEntry{
+		Time:      q.time,
+		Op:        op,
+		Filters:   filters,
+		Duration:  q.clock.Now().Sub(q.time),
+		BytesRead: -1,
+		Results:   results,
+	}
+	if bytesRead != nil {
+		e.BytesRead = bytesRead() - q.bytesRead
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return e
+}
+
+func (s *queryLoggingStore) log(q queryStart, op string, filters interface{}, results int, err error) {
+	e := q.end(s.bytesRead, op, queryLogFilters(storeFilters(filters)), results, err)
+	if err := s.sink.LogQuery(e); err != nil {
+		log.Printf("Warning: failed to log %s query: %s", op, err)
+	}
+}
+
+func (s *queryLoggingStore) Repos(f ...RepoFilter) ([]string, error) {
+	q := beginQuery(s.clock, s.bytesRead)
+	repos, err := s.s.Repos(f...)
+	s.log(q, "Repos", f, len(repos), err)
+	return repos, err
+}
+
+func (s *queryLoggingStore) Versions(f ...VersionFilter) ([]*Version, error) {
+	q := beginQuery(s.clock, s.bytesRead)
+	versions, err := s.s.Versions(f...)
+	s.log(q, "Versions", f, len(versions), err)
+	return versions, err
+}
+
+func (s *queryLoggingStore) Units(f ...UnitFilter) ([]*unit.SourceUnit, error) {
+	q := beginQuery(s.clock, s.bytesRead)
+	units, err := s.s.Units(f...)
+	s.log(q, "Units", f, len(units), err)
+	return units, err
+}
+
+func (s *queryLoggingStore) Defs(f ...DefFilter) ([]*graph.Def, error) {
+	q := beginQuery(s.clock, s.bytesRead)
+	defs, err := s.s.Defs(f...)
+	s.log(q, "Defs", f, len(defs), err)
+	return defs, err
+}
+
+func (s *queryLoggingStore) Refs(f ...RefFilter) ([]*graph.Ref, error) {
+	q := beginQuery(s.clock, s.bytesRead)
+	refs, err := s.s.Refs(f...)
+	s.log(q, "Refs", f, len(refs), err)
+	return refs, err
+}
+
+func (s *queryLoggingStore) generation() uint64 { return generationOf(s.s) }
+
+func (s *queryLoggingStore) String() string { return fmt.Sprintf("queryLogging(%v)", s.s) }
+
+// A QueryReplay is the result of replaying a logged query.
+type QueryReplay struct {
+	// Logged is the logged query.
+	Logged *QueryLogEntry
+
+	// Partial is true if some of the logged query's filters could not
+	// be replayed (see QueryLogFilter), so the replayed query differs
+	// from the original.
+	Partial bool
+
+	// Replayed holds the duration, bytes read, results, and error of
+	// the replayed query.
+	Replayed *QueryLogEntry
+}
+
+// ReplayQueryLog performs the logged queries on s, one at a time and
+// in order, and returns the results of each. If bytesRead is non-nil,
+// it is used to record the number of bytes that each query read (see
+// NewReadCountingFS).
+//
+// Errors from replayed queries are recorded in the results; an error
+// is only returned if a logged query's Op is unrecognized.
+func ReplayQueryLog(s MultiRepoStore, entries []*QueryLogEntry, bytesRead func() int64) ([]*QueryReplay, error) {
+	clock := clockOf(s)
+	replays := make([]*QueryReplay, len(entries))
+	for i, e := range entries {
+		var filterType reflect.Type
+		switch e.Op {
+		case "Repos":
+			filterType = reflect.TypeOf([]RepoFilter(nil))
+		case "Versions":
+			filterType = reflect.TypeOf([]VersionFilter(nil))
+		case "Units":
+			filterType = reflect.TypeOf([]UnitFilter(nil))
+		case "Defs":
+			filterType = reflect.TypeOf([]DefFilter(nil))
+		case "Refs":
+			filterType = reflect.TypeOf([]RefFilter(nil))
+		default:
+			return nil, fmt.Errorf("query log entry %d: unrecognized op %q", i, e.Op)
+		}
+
+		r := &QueryReplay{Logged: e}
+		var filters []interface{}
+		for _, lf := range e.Filters {
+			f := lf.filter()
+			if f == nil || !reflect.TypeOf(f).AssignableTo(filterType.Elem()) {
+				r.Partial = true
+				continue
+			}
+			filters = append(filters, f)
+		}
+		fs := toTypedFilterSlice(filterType, filters)
+
+		q := beginQuery(clock, bytesRead)
+		var n int
+		var err error
+		switch e.Op {
+		case "Repos":
+			var repos []string
+			repos, err = s.Repos(fs.([]RepoFilter)...)
+			n = len(repos)
+		case "Versions":
+			var versions []*Version
+			versions, err = s.Versions(fs.([]VersionFilter)...)
+			n = len(versions)
+		case "Units":
+			var units []*unit.SourceUnit
+			units, err = s.Units(fs.([]UnitFilter)...)
+			n = len(units)
+		case "Defs":
+			var defs []*graph.Def
+			defs, err = s.Defs(fs.([]DefFilter)...)
+			n = len(defs)
+		case "Refs":
+			var refs []*graph.Ref
+			refs, err = s.Refs(fs.([]RefFilter)...)
+			n = len(refs)
+		}
+		r.Replayed = q.end(bytesRead, e.Op, e.Filters, n, err)
+		replays[i] = r
+	}
+	return replays, nil
+}
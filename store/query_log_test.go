@@ -0,0 +1,108 @@
+package store
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestQueryLog_replay(t *testing.T) {
+	fs, bytesRead := NewReadCountingFS(newTestFS())
+	mrs := NewFSMultiRepoStore(fs, nil)
+	testSyncImport(t, mrs, "r1", "c1", "u1", "u2")
+	testSyncImport(t, mrs, "r2", "c2", "u")
+
+	var buf bytes.Buffer
+	s := NewQueryLoggingStore(mrs, NewQueryLogWriter(&buf), bytesRead)
+	if _, err := s.Defs(ByRepos("r1"), ByUnits(unit.ID2{Type: "t", Name: "u1"}), ByDefQuery("n"), &QueryStats{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Refs(ByRefDef(graph.RefDefKey{DefPath: "p"}), RefFilterFunc(func(*graph.Ref) bool { return true })); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Units(ByFiles(false, "f")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Versions(ByRepoCommitIDs(Version{Repo: "r2", CommitID: "c2"})); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ReadQueryLog(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("got %d entries, want 4", len(entries))
+	}
+	wantResults := []int{1, 6, 3, 1}
+	for i, e := range entries {
+		if e.Results != wantResults[i] {
+			t.Errorf("entry %d (%s): got %d results, want %d", i, e.Op, e.Results, wantResults[i])
+		}
+		if e.Op != "Versions" && e.BytesRead <= 0 {
+			t.Errorf("entry %d (%s): got %d bytes read, want > 0", i, e.Op, e.BytesRead)
+		}
+	}
+	wantFilters := []QueryLogFilter{
+		{Name: "ByRepos", Repos: []string{"r1"}},
+		{Name: "ByUnits", Units: []unit.ID2{{Type: "t", Name: "u1"}}},
+		{Name: "ByDefQuery", Query: "n"},
+	}
+	if !reflect.DeepEqual(entries[0].Filters, wantFilters) {
+		t.Errorf("got Defs filters %+v, want %+v", entries[0].Filters, wantFilters)
+	}
+	if f := entries[1].Filters[1]; f.Name != "" || f.String != "RefFilterFunc" {
+		t.Errorf("got unloggable filter %+v", f)
+	}
+
+	replays, err := ReplayQueryLog(mrs, entries, bytesRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range replays {
+		if r.Replayed.Error != "" {
+			t.Errorf("replay %d (%s): %s", i, r.Logged.Op, r.Replayed.Error)
+		}
+		if r.Replayed.Results != r.Logged.Results {
+			t.Errorf("replay %d (%s): got %d results, want %d", i, r.Logged.Op, r.Replayed.Results, r.Logged.Results)
+		}
+		if want := i == 1; r.Partial != want {
+			t.Errorf("replay %d (%s): got Partial %v, want %v", i, r.Logged.Op, r.Partial, want)
+		}
+	}
+
+	if _, err := ReplayQueryLog(mrs, []*QueryLogEntry{{Op: "Foo"}}, nil); err == nil {
+		t.Error("got no error for unrecognized op")
+	}
+}
+
+func TestCreateQueryLog(t *testing.T) {
+	fs := newTestFS()
+	if entries, err := ReadQueryLogs(fs); err != nil || len(entries) != 0 {
+		t.Fatalf("got entries %v and error %v with no query logs, want none", entries, err)
+	}
+
+	for _, op := range []string{"Defs", "Refs"} {
+		w, err := CreateQueryLog(fs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.LogQuery(&QueryLogEntry{Op: op}); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := ReadQueryLogs(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Op != "Defs" || entries[1].Op != "Refs" {
+		t.Errorf("got entries %+v, want Defs and Refs entries", entries)
+	}
+}
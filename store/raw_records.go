@@ -0,0 +1,203 @@
+package store
+
+import (
+	"fmt"
+	"sync"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+// A RawRecord is a def or ref in the form in which the store encodes
+// it (with its codec), so that it can be passed through to clients (e.g.,
+// by an HTTP frontend) without being re-encoded.
+//
+// Like the stored form, Data omits the fields that are implied by the
+// record's context: a def's or ref's Repo, CommitID, UnitType, and
+// Unit are empty, and so are a ref's DefRepo, DefUnitType, and
+// DefUnit if they are equal to the ref's Repo, UnitType, and Unit.
+// Clients must fill them in from the RawRecord's fields.
+type RawRecord struct {
+	Repo     string
+	CommitID string
+	UnitType string
+	Unit     string
+
+	Data []byte
+}
+
+// RawRecords is the result of a RawDefs or RawRefs query.
+type RawRecords struct {
+	// ContentType is the media type of each record's Data (e.g.,
+	// "application/json").
+	ContentType string
+
+	// Records are the matching records, in the same order that the
+	// corresponding Defs or Refs query returns them.
+	Records []*RawRecord
+}
+
+// RawDefs returns the encoded records of the defs in s that match the
+// filters.
+//
+// The FS-backed stores decode each record that they read (to evaluate
+// the filters) but keep its encoded bytes, so the records aren't
+// re-encoded. Defs that aren't read from encoded records (e.g., from
+// a memory store or an overlay's virtual data) are encoded.
+func RawDefs(s UnitStore, fs ...DefFilter) (*RawRecords, error) {
+	c := codecOf(s)
+	rc, ok := c.(rawCodec)
+	if !ok {
+		return nil, fmt.Errorf("codec %T does not support raw records", c)
+	}
+	raw := newRawRecordsFilter(c)
+	defs, err := s.Defs(append(fs, raw)...)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := &RawRecords{ContentType: rc.contentType(&graph.Def{}), Records: make([]*RawRecord, len(defs))}
+	for i, def := range defs {
+		data, present := raw.defs[def]
+		if !present {
+			stored := *def
+			stored.Repo, stored.CommitID, stored.UnitType, stored.Unit = "", "", "", ""
+			if data, err = rc.marshal(&stored); err != nil {
+				return nil, err
+			}
+		}
+		rs.Records[i] = &RawRecord{Repo: def.Repo, CommitID: def.CommitID, UnitType: def.UnitType, Unit: def.Unit, Data: data}
+	}
+	return rs, nil
+}
+
+// RawRefs returns the encoded records of the refs in s that match the
+// filters. See RawDefs.
+func RawRefs(s UnitStore, fs ...RefFilter) (*RawRecords, error) {
+	c := codecOf(s)
+	rc, ok := c.(rawCodec)
+	if !ok {
+		return nil, fmt.Errorf("codec %T does not support raw records", c)
+	}
+	raw := newRawRecordsFilter(c)
+	refs, err := s.Refs(append(fs, raw)...)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := &RawRecords{ContentType: rc.contentType(&graph.Ref{}), Records: make([]*RawRecord, len(refs))}
+	for i, ref := range refs {
+		data, present := raw.refs[ref]
+		if !present {
+			stored := *ref
+			cleanForImport(&graph.Output{Refs: []*graph.Ref{&stored}}, ref.Repo, ref.UnitType, ref.Unit)
+			if data, err = rc.marshal(&stored); err != nil {
+				return nil, err
+			}
+		}
+		rs.Records[i] = &RawRecord{Repo: ref.Repo, CommitID: ref.CommitID, UnitType: ref.UnitType, Unit: ref.Unit, Data: data}
+	}
+	return rs, nil
+}
+
+// rawRecordsFilter selects all defs and refs. It is passed down to
+// the fsUnitStores that read a RawDefs or RawRefs query's records,
+// which record the encoded bytes of each def and ref they return.
+type rawRecordsFilter struct {
+	codec codec // the codec of the raw records (records in other codecs are re-encoded)
+
+	mu   sync.Mutex
+	defs map[*graph.Def][]byte
+	refs map[*graph.Ref][]byte
+}
+
+func newRawRecordsFilter(c codec) *rawRecordsFilter {
+	return &rawRecordsFilter{codec: c, defs: map[*graph.Def][]byte{}, refs: map[*graph.Ref][]byte{}}
+}
+
+func (f *rawRecordsFilter) String() string { return fmt.Sprintf("rawRecords(%p)", f) }
+
+func (f *rawRecordsFilter) SelectDef(*graph.Def) bool { return true }
+func (f *rawRecordsFilter) SelectRef(*graph.Ref) bool { return true }
+
+// observeDef implements recordObserver.
+func (f *rawRecordsFilter) observeDef(def *graph.Def, rec *storedRecord) {
+	if rec.store.codec() != f.codec {
+		return
+	}
+	if b := lastRaw(rec.dec); b != nil {
+		f.mu.Lock()
+		f.defs[def] = b
+		f.mu.Unlock()
+	}
+}
+
+// observeRef implements recordObserver.
+func (f *rawRecordsFilter) observeRef(ref *graph.Ref, rec *storedRecord) {
+	if rec.store.codec() != f.codec {
+		return
+	}
+	if b := lastRaw(rec.dec); b != nil {
+		f.mu.Lock()
+		f.refs[ref] = b
+		f.mu.Unlock()
+	}
+}
+
+// lastRaw returns a copy of the encoded bytes of the value that dec
+// last decoded, or nil if dec can't return them.
+func lastRaw(dec decoder) []byte {
+	if dec, ok := dec.(rawDecoder); ok {
+		if b := dec.lastRaw(); b != nil {
+			return append([]byte(nil), b...)
+		}
+	}
+	return nil
+}
+
+// A recordObserver is a filter that is passed down to the
+// fsUnitStores that read a query's records, which call it with the
+// stored record of each def and ref that they return (after setting
+// none of the def's or ref's context fields; the layers above set
+// them on the same *graph.Def or *graph.Ref later).
+type recordObserver interface {
+	observeDef(*graph.Def, *storedRecord)
+	observeRef(*graph.Ref, *storedRecord)
+}
+
+// A storedRecord is an encoded def or ref that was read from a unit's
+// data file.
+type storedRecord struct {
+	store  *fsUnitStore
+	file   string  // the data file (e.g., "def.dat")
+	offset int64   // the byte offset of the record in the data file
+	size   int64   // the size of the record, including its length header
+	dec    decoder // the decoder that decoded the record
+}
+
+// recordObservers is a list of record observers that is itself a
+// recordObserver.
+type recordObservers []recordObserver
+
+func (o recordObservers) observeDef(def *graph.Def, rec *storedRecord) {
+	for _, o := range o {
+		o.observeDef(def, rec)
+	}
+}
+
+func (o recordObservers) observeRef(ref *graph.Ref, rec *storedRecord) {
+	for _, o := range o {
+		o.observeRef(ref, rec)
+	}
+}
+
+// getRecordObservers returns the record observers in filters (a
+// []DefFilter or []RefFilter), or nil if there are none.
+func getRecordObservers(filters interface{}) recordObservers {
+	var o recordObservers
+	for _, f := range storeFilters(filters) {
+		if f, ok := f.(recordObserver); ok {
+			o = append(o, f)
+		}
+	}
+	return o
+}
@@ -0,0 +1,140 @@
+package store
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestRawDefsAndRefs(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+	defer func(c codec) { Codec = c }(Codec)
+
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
+	data := graph.Output{
+		Defs: []*graph.Def{
+			{DefKey: graph.DefKey{Path: "p1"}, Name: "a", File: "f"},
+			{DefKey: graph.DefKey{Path: "p2"}, Name: "b", File: "f"},
+		},
+		Refs: []*graph.Ref{
+			{DefPath: "p1", File: "f", Start: 1, End: 2},
+			{DefRepo: "r2", DefUnitType: "t", DefUnit: "u2", DefPath: "q", File: "f", Start: 3, End: 4},
+		},
+	}
+
+	for _, c := range []codec{JSONCodec{}, ProtobufCodec{}} {
+		for _, indexed := range []bool{false, true} {
+			Codec = c
+			useIndexedStore = indexed
+			label := func(store string) string {
+				return strings.Join([]string{reflect.TypeOf(c).Name(), store, map[bool]string{false: "unindexed", true: "indexed"}[indexed]}, " ")
+			}
+
+			fsStore := NewFSMultiRepoStore(newTestFS(), nil)
+			memStore := newMemoryMultiRepoStore()
+			for _, mrs := range []MultiRepoImporter{fsStore, memStore} {
+				if err := mrs.Import("r", "c", u, data); err != nil {
+					t.Fatal(err)
+				}
+				if mrs, ok := mrs.(MultiRepoIndexer); ok {
+					if err := mrs.Index("r", "c"); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := mrs.CreateVersion("r", "c"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for name, mrs := range map[string]MultiRepoStore{"fs": fsStore, "memory": memStore} {
+				unmarshal := func(data []byte, v interface{}) {
+					var err error
+					if _, ok := c.(JSONCodec); ok {
+						err = json.Unmarshal(data, v)
+					} else {
+						err = proto.Unmarshal(data, v.(proto.Message))
+					}
+					if err != nil {
+						t.Fatalf("%s: %s", label(name), err)
+					}
+				}
+
+				for _, f := range [][]DefFilter{nil, {ByDefPath("p2")}} {
+					defs, err := mrs.Defs(f...)
+					if err != nil {
+						t.Fatal(err)
+					}
+					raw, err := RawDefs(mrs, f...)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if want := c.(rawCodec).contentType(&graph.Def{}); raw.ContentType != want {
+						t.Errorf("%s: got content type %q, want %q", label(name), raw.ContentType, want)
+					}
+					if len(raw.Records) != len(defs) {
+						t.Fatalf("%s: %v: got %d raw defs, want %d", label(name), f, len(raw.Records), len(defs))
+					}
+					for i, rec := range raw.Records {
+						var def graph.Def
+						unmarshal(rec.Data, &def)
+						if def.Repo != "" || def.UnitType != "" {
+							t.Errorf("%s: raw def %d has context fields: %+v", label(name), i, def)
+						}
+						def.Repo, def.CommitID, def.UnitType, def.Unit = rec.Repo, rec.CommitID, rec.UnitType, rec.Unit
+						if !reflect.DeepEqual(&def, defs[i]) {
+							t.Errorf("%s: %v: raw def %d: got %+v, want %+v", label(name), f, i, &def, defs[i])
+						}
+					}
+				}
+
+				// The FS store's records are passed through, not
+				// re-encoded.
+				if name == "fs" {
+					raw := newRawRecordsFilter(Codec)
+					defs, err := mrs.Defs(raw)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(raw.defs) != len(defs) {
+						t.Errorf("%s: got %d passed-through raw defs, want %d", label(name), len(raw.defs), len(defs))
+					}
+				}
+
+				refs, err := mrs.Refs()
+				if err != nil {
+					t.Fatal(err)
+				}
+				raw, err := RawRefs(mrs)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(raw.Records) != len(refs) {
+					t.Fatalf("%s: got %d raw refs, want %d", label(name), len(raw.Records), len(refs))
+				}
+				for i, rec := range raw.Records {
+					var ref graph.Ref
+					unmarshal(rec.Data, &ref)
+					ref.Repo, ref.CommitID, ref.UnitType, ref.Unit = rec.Repo, rec.CommitID, rec.UnitType, rec.Unit
+					if ref.DefRepo == "" {
+						ref.DefRepo = rec.Repo
+					}
+					if ref.DefUnitType == "" {
+						ref.DefUnitType = rec.UnitType
+					}
+					if ref.DefUnit == "" {
+						ref.DefUnit = rec.Unit
+					}
+					if !reflect.DeepEqual(&ref, refs[i]) {
+						t.Errorf("%s: raw ref %d: got %+v, want %+v", label(name), i, &ref, refs[i])
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"golang.org/x/net/context"
+	"golang.org/x/tools/godoc/vfs"
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+// A ReadPattern is the way that a query reads a data file.
+type ReadPattern int
+
+const (
+	// ScanReads is a sequential read of an entire data file (e.g., to
+	// find the defs matching a query that no index can satisfy).
+	ScanReads ReadPattern = iota
+
+	// OffsetReads are reads of the records at (index-provided) byte
+	// offsets or ranges in a data file.
+	OffsetReads
+)
+
+func (p ReadPattern) String() string {
+	switch p {
+	case ScanReads:
+		return "scan"
+	case OffsetReads:
+		return "offsets"
+	}
+	return fmt.Sprintf("ReadPattern(%d)", int(p))
+}
+
+// A ReadStrategy tells the VFS layer how to read a data file.
+type ReadStrategy struct {
+	// ReadAhead is the number of bytes to read (or fetch, on network
+	// VFSs) at a time. Scans buffer this many bytes ahead of the
+	// decoder, and offset reads fetch at least this many bytes at each
+	// offset. If 0, only the bytes that the decoder is expected to
+	// need are read.
+	ReadAhead int64
+
+	// Parallelism is the maximum number of concurrent fetches that
+	// offset reads may issue. If 0 or 1, offset reads are serial.
+	Parallelism int
+}
+
+// A ReadPolicyFunc chooses the strategy for reading the named data file
+// on fs with the given pattern.
+type ReadPolicyFunc func(fs rwvfs.FileSystem, name string, pattern ReadPattern) ReadStrategy
+
+// ReadPolicy is the read policy used by all file-backed stores. Like
+// Codec, it should only be set at init time or when you can guarantee
+// that no stores will be reading data.
+var ReadPolicy ReadPolicyFunc = DefaultReadPolicy
+
+// scanReadAhead is the read-ahead that DefaultReadPolicy uses for
+// scans on network VFSs.
+const scanReadAhead = 1024 * 1024
+
+// DefaultReadPolicy is the default ReadPolicy. On network VFSs (those
+// that implement rwvfs.FetcherOpener or ContextFetcherOpener, even
+// behind the store's throttling, write policy, etc.), it uses a large
+// read-ahead for scans (to amortize the latency of each request) and
+// parallel fetches with no read-ahead for offset reads. Local files
+// are read serially with no read-ahead beyond the decoder's buffer.
+func DefaultReadPolicy(fs rwvfs.FileSystem, name string, pattern ReadPattern) ReadStrategy {
+	if !isFetcherFS(fs) {
+		return ReadStrategy{}
+	}
+	if pattern == ScanReads {
+		return ReadStrategy{ReadAhead: scanReadAhead}
+	}
+	return ReadStrategy{Parallelism: maxNetPar}
+}
+
+// A ReadStrategyOpener is a VFS that implements read strategies itself
+// (e.g., by issuing ranged requests of the read-ahead size). Stores
+// open data files on such VFSs with OpenWithStrategy instead of Open.
+type ReadStrategyOpener interface {
+	OpenWithStrategy(name string, st ReadStrategy) (vfs.ReadSeekCloser, error)
+}
+
+// fetchSize returns the number of bytes to fetch to read a record that
+// is estimated to be n bytes long.
+func (st ReadStrategy) fetchSize(n int64) int64 {
+	if st.ReadAhead > n {
+		return st.ReadAhead
+	}
+	return n
+}
+
+// openForScan opens the named data file for a sequential scan. Reads
+// from the returned file fail once ctx is done.
+func openForScan(ctx context.Context, fs rwvfs.FileSystem, name string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f, err := openForScanStrategy(fs, name)
+	if err != nil || ctx.Done() == nil {
+		return f, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{withContext(ctx, f), f}, nil
+}
+
+func openForScanStrategy(fs rwvfs.FileSystem, name string) (io.ReadCloser, error) {
+	st := ReadPolicy(fs, name, ScanReads)
+	if so, ok := fs.(ReadStrategyOpener); ok {
+		return so.OpenWithStrategy(name, st)
+	}
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if st.ReadAhead > decodeBufSize {
+		return &readAheadFile{Reader: bufio.NewReaderSize(f, int(st.ReadAhead)), Closer: f}, nil
+	}
+	return f, nil
+}
+
+// openForOffsets opens the named data file for offset reads and
+// returns the strategy to read it with.
+func openForOffsets(ctx context.Context, fs rwvfs.FileSystem, name string) (vfs.ReadSeekCloser, ReadStrategy, error) {
+	st := ReadPolicy(fs, name, OffsetReads)
+	if so, ok := fs.(ReadStrategyOpener); ok {
+		if err := ctx.Err(); err != nil {
+			return nil, st, err
+		}
+		f, err := so.OpenWithStrategy(name, st)
+		return f, st, err
+	}
+	f, err := openFetcherOrOpen(ctx, fs, name)
+	return f, st, err
+}
+
+// readAheadFile is a file that is read through a read-ahead buffer.
+type readAheadFile struct {
+	io.Reader
+	io.Closer
+}
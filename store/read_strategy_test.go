@@ -0,0 +1,105 @@
+package store
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/tools/godoc/vfs"
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+// strategyRecordingFS is a VFS that records the read strategies that
+// files are opened with.
+type strategyRecordingFS struct {
+	rwvfs.FileSystem
+
+	mu         sync.Mutex
+	strategies map[string][]ReadStrategy
+}
+
+func (fs *strategyRecordingFS) OpenWithStrategy(name string, st ReadStrategy) (vfs.ReadSeekCloser, error) {
+	fs.mu.Lock()
+	fs.strategies[name] = append(fs.strategies[name], st)
+	fs.mu.Unlock()
+	return fs.Open(name)
+}
+
+func TestReadPolicy(t *testing.T) {
+	defer func(orig ReadPolicyFunc) { ReadPolicy = orig }(ReadPolicy)
+	ReadPolicy = func(fs rwvfs.FileSystem, name string, pattern ReadPattern) ReadStrategy {
+		if pattern == ScanReads {
+			return ReadStrategy{ReadAhead: 64 * 1024}
+		}
+		return ReadStrategy{Parallelism: 2}
+	}
+
+	fs := &strategyRecordingFS{FileSystem: newTestFS(), strategies: map[string][]ReadStrategy{}}
+	us := &fsUnitStore{fs: fs}
+	if err := us.Import(graph.Output{
+		Defs: []*graph.Def{
+			{DefKey: graph.DefKey{Path: "p"}, Name: "p"},
+			{DefKey: graph.DefKey{Path: "q"}, Name: "q"},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	defs, ofs, err := us.readDefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 2 {
+		t.Fatalf("got %d defs, want 2", len(defs))
+	}
+	if want := []ReadStrategy{{ReadAhead: 64 * 1024}}; !reflect.DeepEqual(fs.strategies[unitDefsFilename], want) {
+		t.Errorf("got scan strategies %v, want %v", fs.strategies[unitDefsFilename], want)
+	}
+
+	fs.strategies = map[string][]ReadStrategy{}
+	defs, err = us.Defs(defOffsetsFilter(ofs[1:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 1 || defs[0].Path != "q" {
+		t.Errorf("got defs %v, want [q]", defs)
+	}
+	if want := []ReadStrategy{{Parallelism: 2}}; !reflect.DeepEqual(fs.strategies[unitDefsFilename], want) {
+		t.Errorf("got offset read strategies %v, want %v", fs.strategies[unitDefsFilename], want)
+	}
+}
+
+func TestOpenForScan_readAhead(t *testing.T) {
+	defer func(orig ReadPolicyFunc) { ReadPolicy = orig }(ReadPolicy)
+	ReadPolicy = func(rwvfs.FileSystem, string, ReadPattern) ReadStrategy {
+		return ReadStrategy{ReadAhead: 2 * decodeBufSize}
+	}
+
+	us := &fsUnitStore{fs: newTestFS()}
+	want := []*graph.Def{
+		{DefKey: graph.DefKey{Path: "p"}, Name: "p"},
+		{DefKey: graph.DefKey{Path: "q"}, Name: "q"},
+	}
+	if err := us.Import(graph.Output{Defs: want}); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := openForScan(context.Background(), us.fs, unitDefsFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, ok := f.(*readAheadFile); !ok {
+		t.Errorf("got %T, want a read-ahead file", f)
+	}
+
+	defs, err := us.Defs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != len(want) {
+		t.Errorf("got %d defs, want %d", len(defs), len(want))
+	}
+}
@@ -45,6 +45,28 @@ func (x *refFileIndex) getByFile(file string) (byteRanges, bool, error) {
 	return br, true, nil
 }
 
+// byteRanges returns the byteRanges of all files in the index. It
+// returns nil if the index doesn't store its keys (which is needed to
+// tell the files' entries apart from the case-folding entries).
+func (x *refFileIndex) byteRanges() ([]byteRanges, error) {
+	if x.phtable == nil {
+		panic("phtable not built/read")
+	}
+	var brs []byteRanges
+	for it := x.phtable.Iterate(); it != nil; it = it.Next() {
+		k, v := it.Get()
+		if len(k) == 0 || k[0] == 0 {
+			continue // unused slot, or case-folded key or marker (see foldedFileKeys)
+		}
+		var br byteRanges
+		if err := binary.Unmarshal(v, &br); err != nil {
+			return nil, err
+		}
+		brs = append(brs, br)
+	}
+	return brs, nil
+}
+
 // Covers implements defIndex.
 func (x *refFileIndex) Covers(filters interface{}) int {
 	// TODO(sqs): this index also covers RefStart/End range filters
@@ -62,7 +84,10 @@ func (x *refFileIndex) Covers(filters interface{}) int {
 func (x *refFileIndex) Refs(fs ...RefFilter) ([]byteRanges, error) {
 	for _, f := range fs {
 		if ff, ok := f.(ByFilesFilter); ok {
-			files := ff.ByFiles()
+			files, err := indexFilesForLookup(x.phtable, ff)
+			if err != nil {
+				return nil, err
+			}
 			brs := make([]byteRanges, 0, len(files))
 			for _, file := range files {
 				br, found, err := x.getByFile(file)
@@ -82,7 +107,15 @@ func (x *refFileIndex) Refs(fs ...RefFilter) ([]byteRanges, error) {
 // Build creates the refFileIndex.
 func (x *refFileIndex) Build(_ []*graph.Ref, fbr fileByteRanges, _ byteOffsets) error {
 	vlog.Printf("refFilesIndex: building index...")
-	b := phtable.Builder(len(fbr))
+	files := make([]string, 0, len(fbr))
+	for file := range fbr {
+		files = append(files, file)
+	}
+	folded, err := foldedFileKeys(files)
+	if err != nil {
+		return err
+	}
+	b := phtable.Builder(len(fbr) + len(folded))
 	for file, br := range fbr {
 		v, err := binary.Marshal(br)
 		if err != nil {
@@ -90,10 +123,16 @@ func (x *refFileIndex) Build(_ []*graph.Ref, fbr fileByteRanges, _ byteOffsets)
 		}
 		b.Add([]byte(file), v)
 	}
+	for k, v := range folded {
+		b.Add([]byte(k), v)
+	}
 	h, err := b.Build()
 	if err != nil {
 		return err
 	}
+	// Store the keys so that lookups of files that aren't in the
+	// index (and case-folded keys) can't return another key's value.
+	h.StoreKeys = true
 	x.phtable = h
 	x.ready = true
 	vlog.Printf("refFilesIndex: done building index.")
@@ -0,0 +1,430 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/alecthomas/binary"
+	"github.com/gogo/protobuf/proto"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/store/phtable"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// A RefSortOrder is an order in which a source unit's refs are stored.
+type RefSortOrder string
+
+const (
+	// RefsByFile orders refs by (file, start, end). It makes reading
+	// all of the refs in a file fast. A unit's refs are always stored
+	// in this order.
+	RefsByFile RefSortOrder = "file"
+
+	// RefsByDef orders refs by their target def (and then by file,
+	// start, and end). It makes reading all of the refs to a def a
+	// single contiguous read.
+	RefsByDef RefSortOrder = "def"
+)
+
+// RefOrders are the additional orders (other than RefsByFile) in which
+// the refs of newly imported source units are stored. Each order adds
+// a copy of the unit's refs in that order (and an index of it), which
+// trades storage for faster queries scoped to a def. The orders that
+// a unit's refs are stored in are recorded in the unit's metadata, so
+// changing RefOrders doesn't affect how existing units are read.
+var RefOrders []RefSortOrder
+
+// ParseRefSortOrders parses a comma-separated list of ref sort orders
+// (e.g., "file,def").
+func ParseRefSortOrders(s string) ([]RefSortOrder, error) {
+	var orders []RefSortOrder
+	for _, name := range strings.Split(s, ",") {
+		switch o := RefSortOrder(strings.TrimSpace(name)); o {
+		case "":
+		case RefsByFile, RefsByDef:
+			orders = append(orders, o)
+		default:
+			return nil, fmt.Errorf("unrecognized ref sort order %q (valid values are %s, %s)", o, RefsByFile, RefsByDef)
+		}
+	}
+	return orders, nil
+}
+
+// A UnitRefOrders reports the orders in which a source unit's refs are
+// stored.
+type UnitRefOrders interface {
+	// RefOrders returns the orders in which the unit's refs are
+	// stored. The first is always RefsByFile.
+	RefOrders() ([]RefSortOrder, error)
+}
+
+// A TreeRefOrders reports the orders in which the refs of a tree's
+// source units are stored.
+type TreeRefOrders interface {
+	RefOrders(u unit.ID2) ([]RefSortOrder, error)
+}
+
+// A RepoRefOrders reports the orders in which the refs of source units
+// in a repo's trees are stored.
+type RepoRefOrders interface {
+	RefOrders(commitID string, u unit.ID2) ([]RefSortOrder, error)
+}
+
+// A MultiRepoRefOrders reports the orders in which the refs of source
+// units in trees in multiple repos are stored.
+type MultiRepoRefOrders interface {
+	RefOrders(repo, commitID string, u unit.ID2) ([]RefSortOrder, error)
+}
+
+const (
+	// unitMetaFilename is the name of the file (in a unit's dir) that
+	// describes the layout of the unit's data. If it doesn't exist,
+	// the unit was imported before it was written, and its refs are
+	// only stored in RefsByFile order.
+	unitMetaFilename = "unit_meta.json"
+
+	// unitRefsByDefFilename is the name of the ref data file that
+	// holds a copy of the unit's refs in RefsByDef order.
+	unitRefsByDefFilename = "ref_by_def.dat"
+
+	defToRefRangesIndexName = "def_to_ref_ranges"
+)
+
+type unitMeta struct {
+	// RefOrders are the orders in which the unit's refs are stored.
+	RefOrders []RefSortOrder
+}
+
+func (s *fsUnitStore) readUnitMeta() (*unitMeta, error) {
+	f, err := s.fs.Open(unitMetaFilename)
+	if os.IsNotExist(err) {
+		return &unitMeta{RefOrders: []RefSortOrder{RefsByFile}}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var m unitMeta
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		return nil, fmt.Errorf("%s: invalid %s: %s", s, unitMetaFilename, err)
+	}
+	return &m, nil
+}
+
+func (s *fsUnitStore) writeUnitMeta(m *unitMeta) (err error) {
+	f, err := s.fs.Create(unitMetaFilename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := f.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+	return json.NewEncoder(f).Encode(m)
+}
+
+func (s *fsUnitStore) RefOrders() ([]RefSortOrder, error) {
+	m, err := s.readUnitMeta()
+	if err != nil {
+		return nil, err
+	}
+	return m.RefOrders, nil
+}
+
+// hasRefOrder reports whether the unit's refs are stored in order o.
+func (s *fsUnitStore) hasRefOrder(o RefSortOrder) (bool, error) {
+	orders, err := s.RefOrders()
+	if err != nil {
+		return false, err
+	}
+	for _, o2 := range orders {
+		if o2 == o {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// writeRefOrders writes the copies of refs in each of RefOrders (and
+// removes copies in other orders) and records the orders in the unit's
+// metadata. It must be called after the refs are written in RefsByFile
+// order (with writeRefs). It returns the byte ranges (in the
+// RefsByDef copy) of each def's refs, or nil if there is no such copy.
+func (s *fsUnitStore) writeRefOrders(refs []*graph.Ref) (defRanges map[graph.RefDefKey]byteRanges, err error) {
+	m := &unitMeta{RefOrders: []RefSortOrder{RefsByFile}}
+	for _, o := range RefOrders {
+		if o == RefsByDef {
+			m.RefOrders = append(m.RefOrders, RefsByDef)
+			break
+		}
+	}
+
+	if len(m.RefOrders) > 1 {
+		defRanges, err = s.writeRefsByDef(refs)
+		if err != nil {
+			return nil, err
+		}
+	} else if err := s.fs.Remove(unitRefsByDefFilename); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return defRanges, s.writeUnitMeta(m)
+}
+
+// writeRefsByDef writes a copy of refs in RefsByDef order and returns
+// the byte ranges of each def's refs in it.
+func (s *fsUnitStore) writeRefsByDef(refs []*graph.Ref) (defRanges map[graph.RefDefKey]byteRanges, err error) {
+	vlog.Printf("%s: writing %d refs in def order...", s, len(refs))
+	f, err := s.fs.Create(unitRefsByDefFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err2 := f.Close()
+		if err == nil {
+			err = err2
+		}
+	}()
+
+	refs = append([]*graph.Ref(nil), refs...)
+	sort.Sort(refsByDefFileStartEnd(refs))
+
+	bw := bufio.NewWriter(f)
+	enc := s.codec().NewEncoder(bw)
+	var o uint64
+	defRanges = map[graph.RefDefKey]byteRanges{}
+	var last graph.RefDefKey
+	var lastRanges byteRanges
+	for _, ref := range refs {
+		def := ref.RefDefKey()
+		if lastRanges == nil || def != last {
+			if lastRanges != nil {
+				defRanges[last] = lastRanges
+			}
+			last = def
+			lastRanges = byteRanges{int64(o)}
+		}
+		n, err := enc.Encode(ref)
+		if err != nil {
+			return nil, err
+		}
+		o += n
+		lastRanges = append(lastRanges, int64(n))
+	}
+	if lastRanges != nil {
+		defRanges[last] = lastRanges
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+	vlog.Printf("%s: done writing %d refs in def order.", s, len(refs))
+	return defRanges, nil
+}
+
+// refsByDefFileStartEnd sorts refs by (def, file, start, end).
+type refsByDefFileStartEnd []*graph.Ref
+
+func (v refsByDefFileStartEnd) Len() int { return len(v) }
+func (v refsByDefFileStartEnd) Less(i, j int) bool {
+	a, b := v[i], v[j]
+	if a.DefRepo != b.DefRepo {
+		return a.DefRepo < b.DefRepo
+	}
+	if a.DefUnitType != b.DefUnitType {
+		return a.DefUnitType < b.DefUnitType
+	}
+	if a.DefUnit != b.DefUnit {
+		return a.DefUnit < b.DefUnit
+	}
+	if a.DefPath != b.DefPath {
+		return a.DefPath < b.DefPath
+	}
+	return refsByFileStartEnd(v).Less(i, j)
+}
+func (v refsByDefFileStartEnd) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+
+// defRefRangesIndex makes it fast to read the refs (within a source
+// unit) to a def from the unit's RefsByDef ref data file. Unlike
+// defRefsIndex, it maps each def to a single byte range.
+type defRefRangesIndex struct {
+	phtable *phtable.CHD
+	ready   bool
+	sync.RWMutex
+}
+
+var _ interface {
+	Index
+	persistedIndex
+} = (*defRefRangesIndex)(nil)
+
+var c_defRefRangesIndex_getByDef = &counter{count: new(int64)}
+
+func (x *defRefRangesIndex) String() string { return "defRefRangesIndex" }
+
+// Covers implements Index.
+func (x *defRefRangesIndex) Covers(filters interface{}) int {
+	cov := 0
+	for _, f := range storeFilters(filters) {
+		if _, ok := f.(ByRefDefFilter); ok {
+			cov++
+		}
+	}
+	return cov
+}
+
+// getByDef returns the byte range of the refs to def.
+func (x *defRefRangesIndex) getByDef(def graph.RefDefKey) (byteRanges, bool, error) {
+	c_defRefRangesIndex_getByDef.increment()
+	x.RLock()
+	defer x.RUnlock()
+	k, err := proto.Marshal(&def)
+	if err != nil {
+		return nil, false, err
+	}
+	v := x.phtable.Get(k)
+	if v == nil {
+		return nil, false, nil
+	}
+	var br byteRanges
+	if err := binary.Unmarshal(v, &br); err != nil {
+		return nil, true, err
+	}
+	return br, true, nil
+}
+
+// Build creates the defRefRangesIndex.
+func (x *defRefRangesIndex) Build(defRanges map[graph.RefDefKey]byteRanges) error {
+	x.Lock()
+	defer x.Unlock()
+	vlog.Printf("defRefRangesIndex: building index (%d defs)...", len(defRanges))
+	b := phtable.Builder(len(defRanges))
+	for def, br := range defRanges {
+		v, err := binary.Marshal(br)
+		if err != nil {
+			return err
+		}
+		k, err := proto.Marshal(&def)
+		if err != nil {
+			return err
+		}
+		b.Add(k, v)
+	}
+	h, err := b.Build()
+	if err != nil {
+		return err
+	}
+	// Store the keys so that lookups of defs that aren't in the index
+	// can't return another def's ranges.
+	h.StoreKeys = true
+	x.phtable = h
+	x.ready = true
+	vlog.Printf("defRefRangesIndex: done building index.")
+	return nil
+}
+
+// Write implements persistedIndex.
+func (x *defRefRangesIndex) Write(w io.Writer) error {
+	x.RLock()
+	defer x.RUnlock()
+	if x.phtable == nil {
+		panic("no phtable to write")
+	}
+	return x.phtable.Write(w)
+}
+
+// Read implements persistedIndex.
+func (x *defRefRangesIndex) Read(r io.Reader) error {
+	phtable, err := phtable.Read(r)
+	x.Lock()
+	defer x.Unlock()
+	x.phtable = phtable
+	x.ready = (err == nil)
+	return err
+}
+
+// Ready implements persistedIndex.
+func (x *defRefRangesIndex) Ready() bool {
+	x.RLock()
+	defer x.RUnlock()
+	return x.ready
+}
+
+// importRefOrders writes the copies of refs in each of RefOrders and
+// their indexes.
+func (s *indexedUnitStore) importRefOrders(refs []*graph.Ref) error {
+	defRanges, err := s.fsUnitStore.writeRefOrders(refs)
+	if err != nil {
+		return err
+	}
+	if defRanges == nil {
+		return nil
+	}
+	x := &defRefRangesIndex{}
+	if err := x.Build(defRanges); err != nil {
+		return err
+	}
+	return writeIndex(s.fs, defToRefRangesIndexName, x)
+}
+
+// refsByDef returns the refs that match fs, read from the unit's
+// RefsByDef copy of its refs. If fs has no ByRefDef filter or the
+// copy (or its index) doesn't exist, ok is false.
+func (s *indexedUnitStore) refsByDef(fs []RefFilter) (refs []*graph.Ref, ok bool, err error) {
+	var f ByRefDefFilter
+	for _, f2 := range fs {
+		if f2, isRefDef := f2.(ByRefDefFilter); isRefDef {
+			f = f2
+			break
+		}
+	}
+	if f == nil {
+		return nil, false, nil
+	}
+	if ok, err := s.hasRefOrder(RefsByDef); err != nil || !ok {
+		return nil, false, err
+	}
+
+	x := &defRefRangesIndex{}
+	if err := prepareIndex(s.fs, defToRefRangesIndexName, x); isIndexUnavailable(err) {
+		logIndexFallback(s.fs, defToRefRangesIndexName, err)
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	br, found, err := x.getByDef(f.withEmptyImpliedValues())
+	if err != nil || !found {
+		return nil, err == nil, err
+	}
+	refs, err = s.refsAtByteRangesIn(unitRefsByDefFilename, []byteRanges{br}, fs)
+	return refs, err == nil, err
+}
+
+func (s *fsTreeStore) RefOrders(u unit.ID2) ([]RefSortOrder, error) {
+	if _, err := s.openUnitFile(existingUnitFilename(s.fs, u.Type, u.Name)); err != nil {
+		return nil, err
+	}
+	return s.openUnitStore(u).(UnitRefOrders).RefOrders()
+}
+
+func (s *fsRepoStore) RefOrders(commitID string, u unit.ID2) ([]RefSortOrder, error) {
+	return s.newTreeStore(commitID).(TreeRefOrders).RefOrders(u)
+}
+
+func (s *fsMultiRepoStore) RefOrders(repo, commitID string, u unit.ID2) ([]RefSortOrder, error) {
+	return s.openRepoStore(repo).(RepoRefOrders).RefOrders(commitID, u)
+}
+
+var (
+	_ UnitRefOrders      = (*fsUnitStore)(nil)
+	_ UnitRefOrders      = (*indexedUnitStore)(nil)
+	_ TreeRefOrders      = (*fsTreeStore)(nil)
+	_ TreeRefOrders      = (*indexedTreeStore)(nil)
+	_ RepoRefOrders      = (*fsRepoStore)(nil)
+	_ MultiRepoRefOrders = (*fsMultiRepoStore)(nil)
+)
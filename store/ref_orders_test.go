@@ -0,0 +1,89 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestFSMultiRepoStore_RefOrders(t *testing.T) {
+	defer func(orders []RefSortOrder) { RefOrders = orders }(RefOrders)
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
+	data := graph.Output{
+		Refs: []*graph.Ref{
+			{DefPath: "p2", File: "a", Start: 1, End: 2},
+			{DefPath: "p1", File: "b", Start: 1, End: 2},
+			{DefPath: "p2", File: "b", Start: 3, End: 4},
+			{DefPath: "p1", File: "a", Start: 3, End: 4},
+			{DefRepo: "r2", DefPath: "p1", File: "a", Start: 5, End: 6},
+		},
+	}
+	want := []*graph.Ref{
+		{Repo: "r", UnitType: "t", Unit: "u", DefRepo: "r", DefUnitType: "t", DefUnit: "u", DefPath: "p1", File: "a", Start: 3, End: 4},
+		{Repo: "r", UnitType: "t", Unit: "u", DefRepo: "r", DefUnitType: "t", DefUnit: "u", DefPath: "p1", File: "b", Start: 1, End: 2},
+	}
+
+	for _, indexed := range []bool{false, true} {
+		useIndexedStore = indexed
+		mrs := NewFSMultiRepoStore(newTestFS(), nil)
+		for commitID, orders := range map[string][]RefSortOrder{"c1": nil, "c2": {RefsByFile, RefsByDef}} {
+			RefOrders = orders
+			if err := mrs.Import("r", commitID, u, data); err != nil {
+				t.Fatal(err)
+			}
+			if err := mrs.CreateVersion("r", commitID); err != nil {
+				t.Fatal(err)
+			}
+			if err := mrs.Index("r", commitID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		RefOrders = nil
+
+		for commitID, wantOrders := range map[string][]RefSortOrder{"c1": {RefsByFile}, "c2": {RefsByFile, RefsByDef}} {
+			orders, err := mrs.(MultiRepoRefOrders).RefOrders("r", commitID, u.ID2())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(orders, wantOrders) {
+				t.Errorf("indexed=%v %s: got ref orders %v, want %v", indexed, commitID, orders, wantOrders)
+			}
+
+			c_defRefRangesIndex_getByDef.set(0)
+			refs, err := mrs.Refs(ByRepoCommitIDs(Version{Repo: "r", CommitID: commitID}), ByRefDef(graph.RefDefKey{DefRepo: "r", DefUnitType: "t", DefUnit: "u", DefPath: "p1"}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, ref := range want {
+				ref.CommitID = commitID
+			}
+			if !reflect.DeepEqual(refs, want) {
+				t.Errorf("indexed=%v %s: got refs %v, want %v", indexed, commitID, refs, want)
+			}
+			if want := indexed && commitID == "c2"; (c_defRefRangesIndex_getByDef.get() == 1) != want {
+				t.Errorf("indexed=%v %s: got %d def ref range lookups", indexed, commitID, c_defRefRangesIndex_getByDef.get())
+			}
+		}
+
+		if _, err := mrs.(MultiRepoRefOrders).RefOrders("r", "c1", unit.ID2{Type: "t", Name: "x"}); err == nil {
+			t.Errorf("indexed=%v: got no error for nonexistent unit", indexed)
+		}
+	}
+}
+
+func TestParseRefSortOrders(t *testing.T) {
+	orders, err := ParseRefSortOrders("file, def")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []RefSortOrder{RefsByFile, RefsByDef}; !reflect.DeepEqual(orders, want) {
+		t.Errorf("got %v, want %v", orders, want)
+	}
+	if _, err := ParseRefSortOrders("def,x"); err == nil {
+		t.Error("got no error for invalid order")
+	}
+}
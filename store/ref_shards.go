@@ -0,0 +1,216 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/neelance/parallel"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+// RefShards is the number of buckets that the refs of a huge source
+// unit are sharded into when the unit is imported. Each ref is placed
+// in a bucket by a hash of its file, and each bucket has its own ref
+// data file and indexes. Queries for the refs in specific files only
+// read the buckets that those files hash to, and the buckets are
+// written in parallel during import.
+//
+// Only units with at least RefShardMinRefs refs are sharded. If
+// RefShards is less than 2, refs are not sharded. It defaults to the
+// value of the REFSHARDS environment variable.
+var RefShards, _ = strconv.Atoi(os.Getenv("REFSHARDS"))
+
+// RefShardMinRefs is the minimum number of refs that a source unit
+// must have for its refs to be sharded (see RefShards).
+var RefShardMinRefs = 1000000
+
+// refShardsFilename is the name of the file (in a unit's dir) that
+// records how the unit's refs are sharded. If it doesn't exist, the
+// unit's refs are not sharded.
+const refShardsFilename = "ref_shards.json"
+
+type refShardsManifest struct {
+	// Shards is the number of buckets that the refs are sharded into.
+	Shards int
+}
+
+// numRefShards returns the number of buckets that the unit's refs
+// should be sharded into when importing nrefs refs, or 0 if they should
+// not be sharded.
+func (s *fsUnitStore) numRefShards(nrefs int) int {
+	if s.refShardDir != "" || RefShards < 2 || nrefs < RefShardMinRefs {
+		return 0
+	}
+	return RefShards
+}
+
+// refShard returns the bucket (in [0, n)) for refs in file.
+func refShard(file string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(file))
+	return int(h.Sum32() % uint32(n))
+}
+
+func refShardDir(i int) string { return fmt.Sprintf("ref_shard%d", i) }
+
+// A refShardOpener returns the store for a bucket of a unit's refs,
+// backed by fs (which is the bucket's dir, dir, in the unit's dir),
+// using the given settings.
+type refShardOpener func(fs rwvfs.FileSystem, dir, label string, st fsStoreSettings) UnitStoreImporter
+
+func openFSRefShard(fs rwvfs.FileSystem, dir, label string, st fsStoreSettings) UnitStoreImporter {
+	return &fsUnitStore{fs: fs, label: label, refShardDir: dir, fsStoreSettings: st}
+}
+
+func openIndexedRefShard(fs rwvfs.FileSystem, dir, label string, st fsStoreSettings) UnitStoreImporter {
+	us := newIndexedUnitStore(fs, label, st).(*indexedUnitStore)
+	us.refShardDir = dir
+	return us
+}
+
+func (s *fsUnitStore) openRefShard(i int, open refShardOpener) UnitStoreImporter {
+	dir := refShardDir(i)
+	return open(rwvfs.Sub(s.fs, dir), dir, fmt.Sprintf("%s#ref_shard%d", s.label, i), s.fsStoreSettings)
+}
+
+// refShards returns the number of buckets that the unit's refs are
+// sharded into, or 0 if they are not sharded.
+func (s *fsUnitStore) refShards() (int, error) {
+	if s.refShardDir != "" {
+		return 0, nil
+	}
+	f, err := s.fs.Open(refShardsFilename)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var m refShardsManifest
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		return 0, fmt.Errorf("%s: invalid %s: %s", s, refShardsFilename, err)
+	}
+	return m.Shards, nil
+}
+
+// importRefShards writes refs to n buckets (each with its own store
+// created by open) in parallel. The unit's own ref data file is left
+// empty.
+func (s *fsUnitStore) importRefShards(refs []*graph.Ref, n int, open refShardOpener) error {
+	vlog.Printf("%s: sharding %d refs into %d buckets...", s, len(refs), n)
+	buckets := make([][]*graph.Ref, n)
+	for _, ref := range refs {
+		i := refShard(ref.File, n)
+		buckets[i] = append(buckets[i], ref)
+	}
+
+	par := parallel.NewRun(runtime.GOMAXPROCS(0))
+	for i_, bucket_ := range buckets {
+		i, bucket := i_, bucket_
+		par.Acquire()
+		go func() {
+			defer par.Release()
+			if err := rwvfs.MkdirAll(s.fs, refShardDir(i)); err != nil {
+				par.Error(err)
+				return
+			}
+			if err := s.openRefShard(i, open).Import(graph.Output{Refs: bucket}); err != nil {
+				par.Error(err)
+			}
+		}()
+	}
+	if err := par.Wait(); err != nil {
+		return err
+	}
+
+	if _, _, err := s.writeRefs(nil); err != nil {
+		return err
+	}
+
+	// Write the manifest last, so that the unit's refs are only
+	// treated as sharded once all of the buckets are written.
+	f, err := s.fs.Create(refShardsFilename)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(refShardsManifest{Shards: n}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// removeRefShards marks the unit's refs as not sharded (if they were
+// sharded by a previous import).
+func (s *fsUnitStore) removeRefShards() error {
+	if err := s.fs.Remove(refShardsFilename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// refShardsForFilters returns the buckets (out of n) that may contain
+// refs matching the filters.
+func refShardsForFilters(n int, fs []RefFilter) []int {
+	for _, f := range fs {
+		if ff, ok := f.(byFilesFilter); ok && ff.exact && !ff.ignoreCase {
+			seen := make(map[int]struct{}, len(ff.files))
+			var shards []int
+			for _, file := range ff.files {
+				i := refShard(file, n)
+				if _, present := seen[i]; !present {
+					seen[i] = struct{}{}
+					shards = append(shards, i)
+				}
+			}
+			sort.Ints(shards)
+			return shards
+		}
+	}
+	shards := make([]int, n)
+	for i := range shards {
+		shards[i] = i
+	}
+	return shards
+}
+
+// shardedRefs queries the buckets (out of n) that may contain refs
+// matching the filters, using stores created by open.
+func (s *fsUnitStore) shardedRefs(n int, fs []RefFilter, open refShardOpener) ([]*graph.Ref, error) {
+	shards := refShardsForFilters(n, fs)
+	vlog.Printf("%s: reading refs from %d of %d ref shards with filters %v...", s, len(shards), n, fs)
+
+	var (
+		refs   []*graph.Ref
+		refsMu sync.Mutex
+	)
+	par := parallel.NewRun(maxNetPar)
+	for _, i_ := range shards {
+		i := i_
+		par.Acquire()
+		go func() {
+			defer par.Release()
+			shardRefs, err := s.openRefShard(i, open).Refs(fs...)
+			if err != nil {
+				par.Error(err)
+				return
+			}
+			refsMu.Lock()
+			refs = append(refs, shardRefs...)
+			refsMu.Unlock()
+		}()
+	}
+	if err := par.Wait(); err != nil {
+		return nil, err
+	}
+	sort.Sort(refsByFileStartEnd(refs))
+	return refs, nil
+}
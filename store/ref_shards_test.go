@@ -0,0 +1,104 @@
+package store
+
+import (
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// withRefShards runs f with ref sharding enabled for all units.
+func withRefShards(n int, f func()) {
+	origShards, origMinRefs := RefShards, RefShardMinRefs
+	RefShards, RefShardMinRefs = n, 1
+	defer func() { RefShards, RefShardMinRefs = origShards, origMinRefs }()
+	f()
+}
+
+func TestFSUnitStore_refShards(t *testing.T) {
+	withRefShards(3, func() {
+		testUnitStore(t, func() UnitStoreImporter {
+			return &fsUnitStore{fs: newTestFS()}
+		})
+	})
+}
+
+// shardedUnitStore hides an indexed unit store from isIndexedStore,
+// because queries on sharded refs hit an index in each shard that
+// they read (not just one index).
+type shardedUnitStore struct{ UnitStoreImporter }
+
+func TestIndexedUnitStore_refShards(t *testing.T) {
+	useIndexedStore = true
+	withRefShards(3, func() {
+		testUnitStore(t, func() UnitStoreImporter {
+			return shardedUnitStore{newIndexedUnitStore(newTestFS(), "", fsStoreSettings{})}
+		})
+	})
+}
+
+func TestIndexedFSRepoStore_refShards(t *testing.T) {
+	useIndexedStore = true
+	withRefShards(4, func() {
+		rs := NewFSRepoStore(newTestFS())
+		files := []string{"f1", "f2", "f3", "f4", "f5"}
+		u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}, Info: unit.Info{Files: files}}
+		var data graph.Output
+		for _, file := range files {
+			data.Refs = append(data.Refs, &graph.Ref{DefPath: "p", File: file, Start: 1, End: 2})
+		}
+		if err := rs.Import("c", u, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := rs.(RepoIndexer).Index("c"); err != nil {
+			t.Fatal(err)
+		}
+		if err := rs.CreateVersion("c"); err != nil {
+			t.Fatal(err)
+		}
+
+		us := rs.(*fsRepoStore).newTreeStore("c").(*indexedTreeStore).openUnitStore(u.ID2()).(*indexedUnitStore)
+		if n, err := us.refShards(); err != nil {
+			t.Fatal(err)
+		} else if n != 4 {
+			t.Errorf("got %d ref shards, want 4", n)
+		}
+
+		refs, err := rs.Refs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(refs) != len(files) {
+			t.Errorf("Refs: got %d refs, want %d", len(refs), len(files))
+		}
+
+		refs, err = rs.Refs(ByFiles(true, "f2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(refs) != 1 || refs[0].File != "f2" {
+			t.Errorf("Refs(ByFiles): got %v, want 1 ref in f2", refs)
+		}
+
+		refs, err = rs.Refs(ByRefDef(graph.RefDefKey{DefUnitType: "t", DefUnit: "u", DefPath: "p"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(refs) != len(files) {
+			t.Errorf("Refs(ByRefDef): got %d refs, want %d", len(refs), len(files))
+		}
+	})
+}
+
+func TestRefShardsForFilters(t *testing.T) {
+	if got := refShardsForFilters(3, nil); len(got) != 3 {
+		t.Errorf("no filters: got shards %v, want all 3", got)
+	}
+	if got := refShardsForFilters(3, []RefFilter{ByFiles(false, "d")}); len(got) != 3 {
+		t.Errorf("non-exact ByFiles: got shards %v, want all 3", got)
+	}
+	got := refShardsForFilters(3, []RefFilter{ByFiles(true, "f", "f")})
+	if want := refShard("f", 3); len(got) != 1 || got[0] != want {
+		t.Errorf("exact ByFiles: got shards %v, want [%d]", got, want)
+	}
+}
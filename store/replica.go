@@ -0,0 +1,217 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// Names of the stores that can serve a query on a replicated store
+// (see QueryStats.Source).
+const (
+	ReplicaSource = "replica"
+	PrimarySource = "primary"
+)
+
+// QueryStats records how a query was served. To obtain the stats for
+// a query, pass a *QueryStats as one of the query's filters; stores
+// that record stats (such as the store returned by
+// NewReplicatedMultiRepoStore) fill it in. A *QueryStats implements
+// all filter interfaces and selects everything, so it may be passed to
+// any store.
+type QueryStats struct {
+	// Source is the name of the store that served the query
+	// (ReplicaSource or PrimarySource).
+	Source string
+
+	// MissingVersions are the versions that the query needed but
+	// that the replica lacked (which caused the query to be served
+	// by the primary store).
+	MissingVersions []Version
+}
+
+func (*QueryStats) SelectDef(*graph.Def) bool        { return true }
+func (*QueryStats) SelectRef(*graph.Ref) bool        { return true }
+func (*QueryStats) SelectUnit(*unit.SourceUnit) bool { return true }
+func (*QueryStats) SelectVersion(*Version) bool      { return true }
+func (*QueryStats) SelectRepo(string) bool           { return true }
+func (s *QueryStats) String() string                 { return fmt.Sprintf("QueryStats(%+v)", *s) }
+
+// queryStatsFilters returns the *QueryStats filters in filters, and
+// filters without them (so that they aren't passed on to underlying
+// stores).
+func queryStatsFilters(filters []interface{}) (stats []*QueryStats, others []interface{}) {
+	for _, f := range filters {
+		if s, ok := f.(*QueryStats); ok {
+			stats = append(stats, s)
+		} else {
+			others = append(others, f)
+		}
+	}
+	return stats, others
+}
+
+// NewReplicatedMultiRepoStore returns a MultiRepoStore that serves
+// queries from replica (typically a fast local copy of primary, kept
+// up to date with Sync) when replica has all of the versions that
+// the query needs, and from primary (the authoritative store)
+// otherwise.
+//
+// A query whose filters specify both repos and commit IDs (e.g.,
+// ByRepoCommitIDs) needs only those versions, and they are looked up
+// in the replica's versions. Other queries potentially need all
+// versions of the repos they touch, so the replica's versions are
+// compared against the primary's. Repos and Versions queries are
+// always served by primary, because it holds the authoritative list
+// of repos and versions.
+//
+// The store that served each query is recorded in the query's
+// *QueryStats filters (if any).
+//
+// The returned store is read-only.
+func NewReplicatedMultiRepoStore(replica, primary MultiRepoStore) MultiRepoStore {
+	return &replicatedMultiRepoStore{replica: replica, primary: primary}
+}
+
+type replicatedMultiRepoStore struct {
+	replica, primary MultiRepoStore
+}
+
+var _ MultiRepoStore = (*replicatedMultiRepoStore)(nil)
+
+// route returns the store that should serve a query with the given
+// filters, and the filters to pass to it.
+func (s *replicatedMultiRepoStore) route(filters interface{}) (MultiRepoStore, []interface{}, error) {
+	stats, filtersList := queryStatsFilters(storeFilters(filters))
+	missing, err := s.missingVersions(filtersList)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	store, source := s.replica, ReplicaSource
+	if len(missing) > 0 {
+		store, source = s.primary, PrimarySource
+	}
+	for _, st := range stats {
+		st.Source = source
+		st.MissingVersions = missing
+	}
+	return store, filtersList, nil
+}
+
+// missingVersions returns the versions needed by a query with the
+// given filters that the replica lacks.
+func (s *replicatedMultiRepoStore) missingVersions(filters []interface{}) ([]Version, error) {
+	repos, err := scopeRepos(filters)
+	if err != nil {
+		return nil, err
+	}
+	commitIDs, err := scopeTrees(filters)
+	if err != nil {
+		return nil, err
+	}
+	if repos != nil && len(repos) == 0 || commitIDs != nil && len(commitIDs) == 0 {
+		return nil, nil // the query can't match anything
+	}
+
+	var needed []Version
+	for _, f := range filters {
+		if f, ok := f.(ByRepoCommitIDsFilter); ok {
+			needed = append(needed, f.ByRepoCommitIDs()...)
+		}
+	}
+	if needed == nil {
+		for _, repo := range repos {
+			for _, commitID := range commitIDs {
+				needed = append(needed, Version{Repo: repo, CommitID: commitID})
+			}
+		}
+	}
+
+	var vf []VersionFilter
+	if needed != nil {
+		vf = append(vf, ByRepoCommitIDs(needed...))
+	} else {
+		// The query isn't scoped to specific versions, so consult
+		// the primary's version manifest.
+		if repos != nil {
+			vf = append(vf, ByRepos(repos...))
+		}
+		if commitIDs != nil {
+			vf = append(vf, ByCommitIDs(commitIDs...))
+		}
+		primaryVersions, err := s.primary.Versions(vf...)
+		if err != nil {
+			return nil, err
+		}
+		needed = make([]Version, len(primaryVersions))
+		for i, v := range primaryVersions {
+			needed[i] = *v
+		}
+	}
+	if len(needed) == 0 {
+		return nil, nil
+	}
+
+	replicaVersions, err := s.replica.Versions(vf...)
+	if err != nil {
+		return nil, err
+	}
+	have := make(map[Version]struct{}, len(replicaVersions))
+	for _, v := range replicaVersions {
+		have[Version{Repo: v.Repo, CommitID: v.CommitID}] = struct{}{}
+	}
+	var missing []Version
+	for _, v := range needed {
+		if _, present := have[v]; !present {
+			missing = append(missing, v)
+		}
+	}
+	return missing, nil
+}
+
+func (s *replicatedMultiRepoStore) Repos(f ...RepoFilter) ([]string, error) {
+	stats, fs := queryStatsFilters(storeFilters(f))
+	for _, st := range stats {
+		st.Source = PrimarySource
+	}
+	return s.primary.Repos(toTypedFilterSlice(reflect.TypeOf(f), fs).([]RepoFilter)...)
+}
+
+func (s *replicatedMultiRepoStore) Versions(f ...VersionFilter) ([]*Version, error) {
+	stats, fs := queryStatsFilters(storeFilters(f))
+	for _, st := range stats {
+		st.Source = PrimarySource
+	}
+	return s.primary.Versions(toTypedFilterSlice(reflect.TypeOf(f), fs).([]VersionFilter)...)
+}
+
+func (s *replicatedMultiRepoStore) Units(f ...UnitFilter) ([]*unit.SourceUnit, error) {
+	store, fs, err := s.route(f)
+	if err != nil {
+		return nil, err
+	}
+	return store.Units(toTypedFilterSlice(reflect.TypeOf(f), fs).([]UnitFilter)...)
+}
+
+func (s *replicatedMultiRepoStore) Defs(f ...DefFilter) ([]*graph.Def, error) {
+	store, fs, err := s.route(f)
+	if err != nil {
+		return nil, err
+	}
+	return store.Defs(toTypedFilterSlice(reflect.TypeOf(f), fs).([]DefFilter)...)
+}
+
+func (s *replicatedMultiRepoStore) Refs(f ...RefFilter) ([]*graph.Ref, error) {
+	store, fs, err := s.route(f)
+	if err != nil {
+		return nil, err
+	}
+	return store.Refs(toTypedFilterSlice(reflect.TypeOf(f), fs).([]RefFilter)...)
+}
+
+func (s *replicatedMultiRepoStore) String() string {
+	return fmt.Sprintf("replicated(replica=%s, primary=%s)", s.replica, s.primary)
+}
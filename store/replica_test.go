@@ -0,0 +1,97 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestReplicatedMultiRepoStore(t *testing.T) {
+	useIndexedStore = false
+	importVersion := func(s MultiRepoStoreImporter, commitID, name string) {
+		u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
+		data := graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}, Name: name}}}
+		if err := s.Import("r", commitID, u, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CreateVersion("r", commitID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	primary := NewFSMultiRepoStore(newTestFS(), nil)
+	replica := NewFSMultiRepoStore(newTestFS(), nil)
+	importVersion(primary, "c1", PrimarySource)
+	importVersion(primary, "c2", PrimarySource)
+	importVersion(replica, "c1", ReplicaSource)
+	s := NewReplicatedMultiRepoStore(replica, primary)
+
+	c1, c2 := Version{Repo: "r", CommitID: "c1"}, Version{Repo: "r", CommitID: "c2"}
+	tests := []struct {
+		filters     []DefFilter
+		wantSource  string
+		wantMissing []Version
+	}{
+		{[]DefFilter{ByRepoCommitIDs(c1)}, ReplicaSource, nil},
+		{[]DefFilter{ByRepos("r"), ByCommitIDs("c1")}, ReplicaSource, nil},
+		{[]DefFilter{ByRepoCommitIDs(c1, c2)}, PrimarySource, []Version{c2}},
+		{[]DefFilter{ByRepos("r")}, PrimarySource, []Version{c2}},
+		{[]DefFilter{ByCommitIDs("c2")}, PrimarySource, []Version{c2}},
+		{nil, PrimarySource, []Version{c2}},
+		{[]DefFilter{ByRepos("r2")}, ReplicaSource, nil},
+	}
+	for _, test := range tests {
+		var stats QueryStats
+		defs, err := s.Defs(append(test.filters, &stats)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Source != test.wantSource {
+			t.Errorf("%v: got source %q, want %q", test.filters, stats.Source, test.wantSource)
+		}
+		if !reflect.DeepEqual(stats.MissingVersions, test.wantMissing) {
+			t.Errorf("%v: got missing versions %v, want %v", test.filters, stats.MissingVersions, test.wantMissing)
+		}
+		for _, def := range defs {
+			if def.Name != test.wantSource {
+				t.Errorf("%v: got def from %s, want from %s", test.filters, def.Name, test.wantSource)
+			}
+		}
+	}
+
+	// Once the replica has all versions, it serves unscoped queries.
+	importVersion(replica, "c2", ReplicaSource)
+	var stats QueryStats
+	if _, err := s.Refs(ByRepos("r"), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Source != ReplicaSource {
+		t.Errorf("after replica caught up: got source %q, want %q", stats.Source, ReplicaSource)
+	}
+
+	if versions, err := s.Versions(&stats); err != nil {
+		t.Fatal(err)
+	} else if len(versions) != 2 || stats.Source != PrimarySource {
+		t.Errorf("Versions: got %d versions from %q, want 2 from %q", len(versions), stats.Source, PrimarySource)
+	}
+}
+
+func TestQueryStats_ignoredByOtherStores(t *testing.T) {
+	s := NewFSMultiRepoStore(newTestFS(), nil)
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
+	data := graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}}}}
+	if err := s.Import("r", "c", u, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateVersion("r", "c"); err != nil {
+		t.Fatal(err)
+	}
+	defs, err := s.Defs(ByRepos("r"), &QueryStats{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 1 {
+		t.Errorf("got %d defs, want 1", len(defs))
+	}
+}
@@ -1,11 +1,15 @@
 package store
 
 import (
+	"fmt"
+	"io"
+	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/kr/fs"
 	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
 )
 
 // RepoPaths specifies how to generate and list repos in a multi-repo
@@ -77,3 +81,127 @@ func (defaultRepoPaths) ListRepoPaths(vfs rwvfs.WalkableFileSystem, after string
 	}
 	return paths, nil
 }
+
+// RenormalizeRepoPaths migrates an FS-backed multi-repo store whose
+// repos were imported before repo URIs were normalized (see
+// graph.NormalizeRepoURI). It moves each repo's data from the path
+// for its original URI to the path for its normalized URI, and it
+// returns the (original) repo URIs that were moved.
+//
+// If data already exists at a repo's normalized path, that repo is
+// left in place and an error is returned after all other repos have
+// been processed.
+//
+// Only the on-disk layout is migrated. The DefRepo fields of refs in
+// already-imported data are normalized when the data is re-imported.
+func RenormalizeRepoPaths(vfs rwvfs.WalkableFileSystem, conf *FSMultiRepoStoreConf) ([]string, error) {
+	repoPaths := RepoPaths(DefaultRepoPaths)
+	if conf != nil && conf.RepoPaths != nil {
+		repoPaths = conf.RepoPaths
+	}
+
+	paths, err := repoPaths.ListRepoPaths(vfs, "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		moved     []string
+		conflicts []string
+	)
+	for _, p := range paths {
+		repo := repoPaths.PathToRepo(p)
+		normRepo := graph.NormalizeRepoURI(repo)
+		if repo == normRepo {
+			continue
+		}
+		src, dst := vfs.Join(p...), vfs.Join(repoPaths.RepoToPath(normRepo)...)
+		if _, err := vfs.Stat(dst); err == nil {
+			conflicts = append(conflicts, repo)
+			continue
+		} else if !os.IsNotExist(err) {
+			return moved, err
+		}
+		if err := moveTree(vfs, src, dst); err != nil {
+			return moved, fmt.Errorf("moving repo %q to %q: %s", repo, normRepo, err)
+		}
+		moved = append(moved, repo)
+	}
+	if len(conflicts) > 0 {
+		return moved, fmt.Errorf("data for normalized repo URI already exists (not moved): %v", conflicts)
+	}
+	return moved, nil
+}
+
+// moveTree copies all files under src to dst and then removes src.
+func moveTree(vfs rwvfs.WalkableFileSystem, src, dst string) error {
+	if err := copyTree(vfs, src, dst); err != nil {
+		return err
+	}
+	return removeTree(vfs, src)
+}
+
+// copyTree copies all files under src to dst.
+func copyTree(vfs rwvfs.WalkableFileSystem, src, dst string) error {
+	w := fs.WalkFS(src, vfs)
+	for w.Step() {
+		if err := w.Err(); err != nil {
+			return err
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(filepath.ToSlash(w.Path()), filepath.ToSlash(src)), "/")
+		if w.Stat().Mode().IsDir() {
+			if err := rwvfs.MkdirAll(vfs, vfs.Join(dst, rel)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := copyFile(vfs, w.Path(), vfs.Join(dst, rel)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeTree removes src and all files under it.
+func removeTree(vfs rwvfs.WalkableFileSystem, src string) error {
+	var files, dirs []string
+	w := fs.WalkFS(src, vfs)
+	for w.Step() {
+		if err := w.Err(); err != nil {
+			return err
+		}
+		if w.Stat().Mode().IsDir() {
+			dirs = append(dirs, w.Path())
+		} else {
+			files = append(files, w.Path())
+		}
+	}
+	for _, f := range files {
+		if err := vfs.Remove(f); err != nil {
+			return err
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := vfs.Remove(dirs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(vfs rwvfs.FileSystem, src, dst string) error {
+	r, err := vfs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := vfs.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
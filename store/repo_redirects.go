@@ -0,0 +1,212 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+// A MultiRepoRenamer is a multi-repo store whose repos can be renamed
+// (e.g., when a repository moves to a different host or org).
+type MultiRepoRenamer interface {
+	// RenameRepo moves oldRepo's data to newRepo and records a
+	// redirect from oldRepo to newRepo. Afterwards, newRepo is listed
+	// by Repos (and oldRepo isn't), but queries and imports that name
+	// oldRepo (e.g., ByRepos(oldRepo) filters, or lookups of the defs
+	// of refs whose DefRepo is oldRepo) still resolve, using
+	// newRepo's data. The DefRepo fields of refs to oldRepo that are
+	// imported afterwards are rewritten to newRepo; refs that were
+	// already imported keep their DefRepo.
+	//
+	// It fails if oldRepo has no data or if newRepo already has data.
+	// It must not be called while other processes import into
+	// oldRepo or newRepo.
+	RenameRepo(oldRepo, newRepo string) error
+
+	// RepoRedirects returns the recorded redirects (from old to new
+	// repo URIs). Redirects are followed transitively: if a repo is
+	// renamed again, the redirects of its previous names are updated
+	// to point to its latest name.
+	RepoRedirects() (map[string]string, error)
+}
+
+var _ MultiRepoRenamer = (*fsMultiRepoStore)(nil)
+
+// redirectsFilename is the name of the file (in a multi-repo store's
+// VFS) that holds the redirects of renamed repos. It begins with a "."
+// so that it isn't listed as a repo.
+const redirectsFilename = ".srclib-redirects.json"
+
+// repoRedirects caches the contents of a store's redirects file. It is
+// reread when the file's size or modification time changes.
+type repoRedirects struct {
+	redirects map[string]string
+	size      int64
+	modTime   time.Time
+}
+
+// readRedirects returns the store's redirects. The caller must hold
+// s.redirectsMu.
+func (s *fsMultiRepoStore) readRedirects() (map[string]string, error) {
+	fi, err := s.fs.Stat(redirectsFilename)
+	if os.IsNotExist(err) {
+		s.redirectsCache = repoRedirects{}
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if c := s.redirectsCache; c.redirects != nil && c.size == fi.Size() && c.modTime.Equal(fi.ModTime()) {
+		return c.redirects, nil
+	}
+
+	f, err := s.fs.Open(redirectsFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var redirects map[string]string
+	if err := json.NewDecoder(f).Decode(&redirects); err != nil {
+		return nil, fmt.Errorf("reading %s: %s", redirectsFilename, err)
+	}
+	if redirects == nil {
+		redirects = map[string]string{}
+	}
+	s.redirectsCache = repoRedirects{redirects: redirects, size: fi.Size(), modTime: fi.ModTime()}
+	return redirects, nil
+}
+
+func (s *fsMultiRepoStore) writeRedirects(redirects map[string]string) (err error) {
+	s.redirectsCache = repoRedirects{}
+	if len(redirects) == 0 {
+		if err := s.fs.Remove(redirectsFilename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	f, err := s.fs.Create(redirectsFilename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := f.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+	return json.NewEncoder(f).Encode(redirects)
+}
+
+// redirectRepo returns the repo that (normalized) repo was renamed to,
+// or repo if it wasn't renamed. If the redirects can't be read, a
+// warning is logged and repo is returned.
+func (s *fsMultiRepoStore) redirectRepo(repo string) string {
+	s.redirectsMu.Lock()
+	defer s.redirectsMu.Unlock()
+	redirects, err := s.readRedirects()
+	if err != nil {
+		log.Printf("Warning: reading repo redirects failed: %s.", err)
+		return repo
+	}
+	if newRepo, present := redirects[repo]; present {
+		return newRepo
+	}
+	return repo
+}
+
+// canonicalRepo implements repoCanonicalizer.
+func (s *fsMultiRepoStore) canonicalRepo(repo string) string { return s.redirectRepo(repo) }
+
+func (s *fsMultiRepoStore) RenameRepo(oldRepo, newRepo string) error {
+	defer s.wrote()
+	oldRepo, newRepo = graph.NormalizeRepoURI(oldRepo), graph.NormalizeRepoURI(newRepo)
+	if oldRepo == newRepo {
+		return fmt.Errorf("can't rename repo %s to itself", oldRepo)
+	}
+	if err := s.moveRepo(oldRepo, newRepo); err != nil {
+		return err
+	}
+	return s.updateTombstones(func(tombstones map[string]*RepoTombstone) {
+		if t, present := tombstones[oldRepo]; present {
+			t.Repo = newRepo
+			tombstones[newRepo] = t
+			delete(tombstones, oldRepo)
+		}
+	})
+}
+
+// moveRepo moves oldRepo's data to newRepo and records the redirect.
+func (s *fsMultiRepoStore) moveRepo(oldRepo, newRepo string) error {
+	s.redirectsMu.Lock()
+	defer s.redirectsMu.Unlock()
+	redirects, err := s.readRedirects()
+	if err != nil {
+		return err
+	}
+	if to, present := redirects[oldRepo]; present {
+		return fmt.Errorf("repo %s was already renamed to %s", oldRepo, to)
+	}
+
+	src, dst := s.fs.Join(s.RepoToPath(oldRepo)...), s.fs.Join(s.RepoToPath(newRepo)...)
+	if fi, err := s.fs.Stat(src); os.IsNotExist(err) || (err == nil && !fi.Mode().IsDir()) {
+		return fmt.Errorf("repo %s not found", oldRepo)
+	} else if err != nil {
+		return err
+	}
+	if _, err := s.fs.Stat(dst); err == nil {
+		return fmt.Errorf("repo %s already exists", newRepo)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := moveTree(s.fs, src, dst); err != nil {
+		return fmt.Errorf("moving repo %s to %s: %s", oldRepo, newRepo, err)
+	}
+
+	// Point the redirects of oldRepo's previous names to newRepo. If
+	// newRepo is a previous name of oldRepo (i.e., a rename is being
+	// undone), its redirect is removed.
+	updated := make(map[string]string, len(redirects)+1)
+	for from, to := range redirects {
+		if to == oldRepo {
+			to = newRepo
+		}
+		if from != newRepo {
+			updated[from] = to
+		}
+	}
+	updated[oldRepo] = newRepo
+	return s.writeRedirects(updated)
+}
+
+func (s *fsMultiRepoStore) RepoRedirects() (map[string]string, error) {
+	s.redirectsMu.Lock()
+	defer s.redirectsMu.Unlock()
+	redirects, err := s.readRedirects()
+	if err != nil {
+		return nil, err
+	}
+	redirects2 := make(map[string]string, len(redirects))
+	for from, to := range redirects {
+		redirects2[from] = to
+	}
+	return redirects2, nil
+}
+
+// redirectRefDefRepos rewrites the (normalized) DefRepo fields of refs
+// to renamed repos to the repos' new names.
+func (s *fsMultiRepoStore) redirectRefDefRepos(refs []*graph.Ref) error {
+	s.redirectsMu.Lock()
+	defer s.redirectsMu.Unlock()
+	redirects, err := s.readRedirects()
+	if err != nil || len(redirects) == 0 {
+		return err
+	}
+	for _, ref := range refs {
+		if newRepo, present := redirects[ref.DefRepo]; present {
+			ref.DefRepo = newRepo
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestFSMultiRepoStore_RenameRepo(t *testing.T) {
+	mrs := NewFSMultiRepoStore(newTestFS(), nil)
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
+	imports := []struct {
+		repo string
+		data graph.Output
+	}{
+		{"github.com/a/r", graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}, Name: "p"}}}},
+		{"github.com/b/x", graph.Output{Refs: []*graph.Ref{{DefRepo: "github.com/a/r", DefUnitType: "t", DefUnit: "u", DefPath: "p", File: "f"}}}},
+	}
+	for _, imp := range imports {
+		if err := mrs.Import(imp.repo, "c", u, imp.data); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.CreateVersion(imp.repo, "c"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mrs.(MultiRepoTombstones).HideRepo("github.com/a/r", "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := mrs.(MultiRepoRenamer)
+	if err := rr.RenameRepo("github.com/a/r", "github.com/c/r"); err != nil {
+		t.Fatal(err)
+	}
+	checkRedirects := func(want map[string]string) {
+		redirects, err := rr.RepoRedirects()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(redirects, want) {
+			t.Errorf("got redirects %v, want %v", redirects, want)
+		}
+	}
+	checkRedirects(map[string]string{"github.com/a/r": "github.com/c/r"})
+
+	// The repo's tombstone follows it.
+	if hidden, err := mrs.(MultiRepoTombstones).HiddenRepos(); err != nil {
+		t.Fatal(err)
+	} else if len(hidden) != 1 || hidden[0].Repo != "github.com/c/r" {
+		t.Errorf("got hidden repos %v, want github.com/c/r", hidden)
+	}
+	if err := mrs.(MultiRepoTombstones).UnhideRepo("github.com/c/r"); err != nil {
+		t.Fatal(err)
+	}
+
+	repos, err := mrs.Repos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"github.com/b/x", "github.com/c/r"}; !reflect.DeepEqual(repos, want) {
+		t.Errorf("got repos %v, want %v", repos, want)
+	}
+
+	// Refs to the old repo URI still resolve.
+	refs, err := mrs.Refs(ByRepos("github.com/b/x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 {
+		t.Fatalf("got %d refs, want 1", len(refs))
+	}
+	for _, repo := range []string{refs[0].DefRepo, "github.com/c/r"} {
+		defs, err := mrs.Defs(ByRepos(repo), ByDefPath(refs[0].DefPath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(defs) != 1 {
+			t.Errorf("%s: got %d defs, want 1", repo, len(defs))
+		}
+	}
+
+	// Refs to the old repo URI that are imported afterwards are
+	// redirected.
+	if err := mrs.Import("github.com/b/x", "c2", u, imports[1].data); err != nil {
+		t.Fatal(err)
+	}
+	if refs, err := mrs.Refs(ByRepos("github.com/b/x"), ByCommitIDs("c2")); err != nil {
+		t.Fatal(err)
+	} else if len(refs) != 1 || refs[0].DefRepo != "github.com/c/r" {
+		t.Errorf("got refs %v, want 1 ref with DefRepo github.com/c/r", refs)
+	}
+
+	// Redirects are followed transitively, and renames can be undone.
+	if err := rr.RenameRepo("github.com/c/r", "github.com/d/r"); err != nil {
+		t.Fatal(err)
+	}
+	checkRedirects(map[string]string{"github.com/a/r": "github.com/d/r", "github.com/c/r": "github.com/d/r"})
+	if err := rr.RenameRepo("github.com/d/r", "github.com/a/r"); err != nil {
+		t.Fatal(err)
+	}
+	checkRedirects(map[string]string{"github.com/c/r": "github.com/a/r", "github.com/d/r": "github.com/a/r"})
+	if defs, err := mrs.Defs(ByRepos("github.com/c/r")); err != nil {
+		t.Fatal(err)
+	} else if len(defs) != 1 {
+		t.Errorf("after undoing rename, got %d defs, want 1", len(defs))
+	}
+
+	for _, bad := range [][2]string{{"github.com/nope/r", "github.com/e/r"}, {"github.com/a/r", "github.com/b/x"}, {"github.com/c/r", "github.com/e/r"}, {"github.com/a/r", "github.com/a/r"}} {
+		if err := rr.RenameRepo(bad[0], bad[1]); err == nil {
+			t.Errorf("RenameRepo(%q, %q): got nil error, want error", bad[0], bad[1])
+		}
+	}
+}
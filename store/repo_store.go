@@ -1,6 +1,7 @@
 package store
 
 import (
+	"sort"
 	"sync"
 
 	"github.com/neelance/parallel"
@@ -17,7 +18,8 @@ type RepoStore interface {
 
 	// TreeStore's methods call the corresponding methods on the
 	// TreeStore of each version contained within this repository. The
-	// combined results are returned (in undefined order).
+	// combined results are returned in the canonical order (see
+	// "CONVENTION - RESULT ORDERING" in the package docs).
 	TreeStore
 }
 
@@ -28,6 +30,14 @@ type RepoImporter interface {
 	// specific version into the store.
 	Import(commitID string, unit *unit.SourceUnit, data graph.Output) error
 
+	// ImportUnit replaces the data of exactly one source unit (which
+	// must already have been imported) in the tree at commitID, and
+	// rebuilds only the indexes that depend on it: the unit's own
+	// indexes and the tree's indexes (if they were built). The data
+	// of the tree's other source units is not rewritten, so callers
+	// can fix a single bad unit without re-importing the whole tree.
+	ImportUnit(commitID string, unit *unit.SourceUnit, data graph.Output) error
+
 	// CreateVersion creates the version entry for the given commit. This signals that the commit data is
 	// ready to be queried. All other data (including indexes) needs to exist before this gets called.
 	CreateVersion(commitID string) error
@@ -38,10 +48,12 @@ type RepoIndexer interface {
 	Index(commitID string) error
 }
 
-// A RepoStoreImporter implements both RepoStore and RepoImporter.
+// A RepoStoreImporter implements RepoStore, RepoImporter, and
+// RepoDeleter.
 type RepoStoreImporter interface {
 	RepoStore
 	RepoImporter
+	RepoDeleter
 }
 
 // A VersionKey is a unique identifier for a version across all
@@ -84,6 +96,7 @@ type repoStores struct {
 var _ RepoStore = (*repoStores)(nil)
 
 func (s repoStores) Versions(f ...VersionFilter) ([]*Version, error) {
+	f = normalizeRepoFilters(s.opener, f).([]VersionFilter)
 	rss, err := openRepoStores(s.opener, f)
 	if err != nil {
 		return nil, err
@@ -108,6 +121,11 @@ func (s repoStores) Versions(f ...VersionFilter) ([]*Version, error) {
 }
 
 func (s repoStores) Units(f ...UnitFilter) ([]*unit.SourceUnit, error) {
+	if units, paged, err := PagedUnits(s.Units, f); paged {
+		return units, err
+	}
+
+	f = normalizeRepoFilters(s.opener, f).([]UnitFilter)
 	rss, err := openRepoStores(s.opener, f)
 	if err != nil {
 		return nil, err
@@ -117,14 +135,27 @@ func (s repoStores) Units(f ...UnitFilter) ([]*unit.SourceUnit, error) {
 		allUnits   []*unit.SourceUnit
 		allUnitsMu sync.Mutex
 	)
+	limit, limited := ScanLimit(f)
 	par := parallel.NewRun(storeFetchPar)
-	for repo_, rs_ := range rss {
-		repo, rs := repo_, rs_
+	if limited {
+		// Query the repositories one at a time, in sorted order,
+		// until enough units have been found.
+		par = parallel.NewRun(1)
+	}
+	for _, repo_ := range sortedRepos(rss) {
+		repo, rs := repo_, rss[repo_]
 		if rs == nil {
 			continue
 		}
 
 		par.Acquire()
+		allUnitsMu.Lock()
+		enough := limited && len(allUnits) >= limit
+		allUnitsMu.Unlock()
+		if enough {
+			par.Release()
+			break
+		}
 		go func() {
 			defer par.Release()
 			units, err := rs.Units(filtersForRepo(repo, f).([]UnitFilter)...)
@@ -145,6 +176,11 @@ func (s repoStores) Units(f ...UnitFilter) ([]*unit.SourceUnit, error) {
 }
 
 func (s repoStores) Defs(f ...DefFilter) ([]*graph.Def, error) {
+	if defs, paged, err := PagedDefs(s.Defs, f); paged {
+		return defs, err
+	}
+
+	f = normalizeRepoFilters(s.opener, f).([]DefFilter)
 	rss, err := openRepoStores(s.opener, f)
 	if err != nil {
 		return nil, err
@@ -154,14 +190,27 @@ func (s repoStores) Defs(f ...DefFilter) ([]*graph.Def, error) {
 		allDefs   []*graph.Def
 		allDefsMu sync.Mutex
 	)
+	limit, limited := ScanLimit(f)
 	par := parallel.NewRun(storeFetchPar)
-	for repo_, rs_ := range rss {
-		repo, rs := repo_, rs_
+	if limited {
+		// Query the repositories one at a time, in sorted order,
+		// until enough defs have been found.
+		par = parallel.NewRun(1)
+	}
+	for _, repo_ := range sortedRepos(rss) {
+		repo, rs := repo_, rss[repo_]
 		if rs == nil {
 			continue
 		}
 
 		par.Acquire()
+		allDefsMu.Lock()
+		enough := limited && len(allDefs) >= limit
+		allDefsMu.Unlock()
+		if enough {
+			par.Release()
+			break
+		}
 		go func() {
 			defer par.Release()
 			defs, err := rs.Defs(filtersForRepo(repo, f).([]DefFilter)...)
@@ -178,20 +227,31 @@ func (s repoStores) Defs(f ...DefFilter) ([]*graph.Def, error) {
 		}()
 	}
 	err = par.Wait()
+	sortDefs(allDefs, f)
 	return allDefs, err
 }
 
 func (s repoStores) Refs(f ...RefFilter) ([]*graph.Ref, error) {
+	if refs, paged, err := PagedRefs(s.Refs, f); paged {
+		return refs, err
+	}
+
+	f = normalizeRepoFilters(s.opener, f).([]RefFilter)
 	rss, err := openRepoStores(s.opener, f)
 	if err != nil {
 		return nil, err
 	}
 
 	var allRefs []*graph.Ref
-	for repo, rs := range rss {
+	limit, limited := ScanLimit(f)
+	for _, repo := range sortedRepos(rss) {
+		rs := rss[repo]
 		if rs == nil {
 			continue
 		}
+		if limited && len(allRefs) >= limit {
+			break
+		}
 
 		setImpliedRepo(f, repo)
 		refs, err := rs.Refs(filtersForRepo(repo, f).([]RefFilter)...)
@@ -206,5 +266,16 @@ func (s repoStores) Refs(f ...RefFilter) ([]*graph.Ref, error) {
 		}
 		allRefs = append(allRefs, refs...)
 	}
+	sortRefs(allRefs, f)
 	return allRefs, nil
 }
+
+// sortedRepos returns the repositories of rss in sorted order.
+func sortedRepos(rss map[string]RepoStore) []string {
+	repos := make([]string, 0, len(rss))
+	for repo := range rss {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	return repos
+}
@@ -20,6 +20,7 @@ func testRepoStore(t *testing.T, newFn func() RepoStoreImporter) {
 	testRepoStore_Defs_ByCommitIDs(t, newFn())
 	testRepoStore_Defs_ByCommitIDs_ByFile(t, newFn())
 	testRepoStore_Refs(t, newFn())
+	testRepoStore_Delete(t, newFn())
 }
 
 func testRepoStore_uninitialized(t *testing.T, rs RepoStore) {
@@ -360,3 +361,82 @@ func testRepoStore_Refs(t *testing.T, rs RepoStoreImporter) {
 		t.Errorf("%s: Refs(): got refs %v, want %v", rs, refs, want)
 	}
 }
+
+func testRepoStore_Delete(t *testing.T, rs RepoStoreImporter) {
+	for _, commitID := range []string{"c1", "c2"} {
+		for _, name := range []string{"u1", "u2"} {
+			u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: name}, Info: unit.Info{Files: []string{"f"}}}
+			data := graph.Output{
+				Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}, Name: "n", File: "f"}},
+				Refs: []*graph.Ref{{DefPath: "p", File: "f", Start: 1, End: 2}},
+			}
+			if err := rs.Import(commitID, u, data); err != nil {
+				t.Fatalf("%s: Import(%s, %v, data): %s", rs, commitID, u, err)
+			}
+		}
+		if rs, ok := rs.(RepoIndexer); ok {
+			if err := rs.Index(commitID); err != nil {
+				t.Fatalf("%s: Index(%s): %s", rs, commitID, err)
+			}
+		}
+		if err := rs.CreateVersion(commitID); err != nil {
+			t.Fatalf("%s: CreateVersion(%s): %s", rs, commitID, err)
+		}
+	}
+
+	u1 := unit.ID2{Type: "t", Name: "u1"}
+	if err := rs.DeleteUnit("c1", u1); err != nil {
+		t.Fatalf("%s: DeleteUnit(c1, %v): %s", rs, u1, err)
+	}
+	if err := rs.DeleteUnit("c1", u1); err == nil {
+		t.Errorf("%s: DeleteUnit(c1, %v) of deleted unit: no error", rs, u1)
+	}
+	units, err := rs.Units(ByCommitIDs("c1"))
+	if err != nil {
+		t.Fatalf("%s: Units(c1): %s", rs, err)
+	}
+	if len(units) != 1 || units[0].Name != "u2" {
+		t.Errorf("%s: Units(c1) after DeleteUnit: got %v, want only u2", rs, units)
+	}
+	for _, f := range [][]DefFilter{{ByCommitIDs("c1")}, {ByCommitIDs("c1"), ByUnits(u1)}, {ByCommitIDs("c1"), ByFiles(false, "f")}, {ByCommitIDs("c1"), ByDefQuery("n")}} {
+		defs, err := rs.Defs(f...)
+		if err != nil {
+			t.Fatalf("%s: Defs(%v): %s", rs, f, err)
+		}
+		for _, def := range defs {
+			if def.Unit == "u1" {
+				t.Errorf("%s: Defs(%v) after DeleteUnit: got def %v of deleted unit", rs, f, def)
+			}
+		}
+	}
+	refs, err := rs.Refs(ByCommitIDs("c1"), ByFiles(false, "f"))
+	if err != nil {
+		t.Fatalf("%s: Refs(c1, f): %s", rs, err)
+	}
+	if len(refs) != 1 || refs[0].Unit != "u2" {
+		t.Errorf("%s: Refs(c1, f) after DeleteUnit: got %v, want only u2's ref", rs, refs)
+	}
+
+	if err := rs.Delete("c1"); err != nil {
+		t.Fatalf("%s: Delete(c1): %s", rs, err)
+	}
+	versions, err := rs.Versions()
+	if err != nil {
+		t.Fatalf("%s: Versions(): %s", rs, err)
+	}
+	if len(versions) != 1 || versions[0].CommitID != "c2" {
+		t.Errorf("%s: Versions() after Delete(c1): got %v, want only c2", rs, versions)
+	}
+	units, err = rs.Units()
+	if err != nil {
+		t.Fatalf("%s: Units(): %s", rs, err)
+	}
+	if len(units) != 2 {
+		t.Errorf("%s: Units() after Delete(c1): got %v, want the 2 units of c2", rs, units)
+	}
+	for _, u := range units {
+		if u.CommitID != "c2" {
+			t.Errorf("%s: Units() after Delete(c1): got unit %v of deleted commit", rs, u)
+		}
+	}
+}
@@ -3,6 +3,9 @@ package store
 import (
 	"fmt"
 	"reflect"
+	"time"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
 )
 
 // scopeRepos returns a list of repos that are matched by the
@@ -59,22 +62,143 @@ type repoStoreOpener interface {
 // openRepoStores is a helper func that calls o.openRepoStore for each
 // repo returned by scopeRepoStores(filters...).
 func openRepoStores(o repoStoreOpener, filters interface{}) (map[string]RepoStore, error) {
-	repos, err := scopeRepos(storeFilters(filters))
+	t := queryTraceOf(filters)
+	defer t.stage("open repos", time.Now())
+	sf := storeFilters(filters)
+	repos, err := scopeRepos(sf)
 	if err != nil {
 		return nil, err
 	}
 
+	var rss map[string]RepoStore
 	if repos == nil {
-		return o.openAllRepoStores()
+		t.strategy("all repos")
+		rss, err = o.openAllRepoStores()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if h, ok := o.(repoHider); ok {
+			repos, err = h.withoutHiddenRepos(repos)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		rss = make(map[string]RepoStore, len(repos))
+		for _, repo := range repos {
+			rss[repo] = o.openRepoStore(repo)
+		}
 	}
 
-	rss := make(map[string]RepoStore, len(repos))
-	for _, repo := range repos {
-		rss[repo] = o.openRepoStore(repo)
+	if r, ok := o.(unitTypeRouter); ok {
+		if unitTypes := scopeUnitTypes(sf); unitTypes != nil {
+			if err := routeByUnitTypes(r, rss, unitTypes, sf); err != nil {
+				return nil, err
+			}
+		}
 	}
 	return rss, nil
 }
 
+// routeByUnitTypes removes the repos from rss that r knows contain no
+// source units of the unit types.
+func routeByUnitTypes(r unitTypeRouter, rss map[string]RepoStore, unitTypes map[string]struct{}, filters []interface{}) error {
+	repos := make([]string, 0, len(rss))
+	for repo := range rss {
+		repos = append(repos, repo)
+	}
+	kept, err := r.reposWithUnitTypes(repos, unitTypes, filters)
+	if err != nil {
+		return err
+	}
+	keep := make(map[string]struct{}, len(kept))
+	for _, repo := range kept {
+		keep[repo] = struct{}{}
+	}
+	for repo := range rss {
+		if _, present := keep[repo]; !present {
+			delete(rss, repo)
+		}
+	}
+	return nil
+}
+
+// A repoHider is a repoStoreOpener that excludes hidden repos (see
+// MultiRepoTombstones) from queries. Its openAllRepoStores must not
+// open hidden repos.
+type repoHider interface {
+	withoutHiddenRepos(repos []string) ([]string, error)
+}
+
+// A repoCanonicalizer is a repoStoreOpener that knows the canonical
+// name of a repo (e.g., the name that a renamed repo was renamed to).
+type repoCanonicalizer interface {
+	// canonicalRepo returns the canonical name of the (normalized)
+	// repo.
+	canonicalRepo(repo string) string
+}
+
+// normalizeRepoFilters returns filters with the repos of its ByRepos
+// and ByRepoCommitIDs filters normalized (see graph.NormalizeRepoURI),
+// and canonicalized if o is a repoCanonicalizer. This ensures that
+// each repo is queried once, no matter how many spellings of its URI
+// the filters contain, and that results' Repo fields hold the repo's
+// canonical name, not the caller's spelling.
+func normalizeRepoFilters(o repoStoreOpener, filters interface{}) interface{} {
+	canonical := graph.NormalizeRepoURI
+	if c, ok := o.(repoCanonicalizer); ok {
+		canonical = func(repo string) string { return c.canonicalRepo(graph.NormalizeRepoURI(repo)) }
+	}
+	return canonicalizeRepoFilters(canonical, filters)
+}
+
+// canonicalizeRepoFilters returns filters with the repos of its
+// ByRepos and ByRepoCommitIDs filters replaced by canonical(repo) (and
+// deduplicated).
+func canonicalizeRepoFilters(canonical func(repo string) string, filters interface{}) interface{} {
+	sf := storeFilters(filters)
+	var normFilters []interface{}
+	for i, f := range sf {
+		var nf interface{}
+		switch f := f.(type) {
+		case byReposFilter:
+			repos := make(byReposFilter, 0, len(f))
+			seen := make(map[string]struct{}, len(f))
+			for _, repo := range f {
+				repo = canonical(repo)
+				if _, dup := seen[repo]; !dup {
+					seen[repo] = struct{}{}
+					repos = append(repos, repo)
+				}
+			}
+			nf = repos
+		case byRepoCommitIDsFilter:
+			versions := make(byRepoCommitIDsFilter, 0, len(f))
+			seen := make(map[Version]struct{}, len(f))
+			for _, v := range f {
+				v.Repo = canonical(v.Repo)
+				if _, dup := seen[v]; !dup {
+					seen[v] = struct{}{}
+					versions = append(versions, v)
+				}
+			}
+			nf = versions
+		default:
+			continue
+		}
+		if normFilters == nil {
+			normFilters = make([]interface{}, len(sf))
+			copy(normFilters, sf)
+		}
+		normFilters[i] = nf
+	}
+	if normFilters == nil {
+		return filters // no repo filters
+	}
+	return toTypedFilterSlice(reflect.TypeOf(filters), normFilters)
+}
+
 // filtersForRepo modifies the filters list to remove filters or
 // conditions inside filters that are guaranteed to be true or
 // unnecessary when using the filters on a call to a specific repo
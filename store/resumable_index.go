@@ -0,0 +1,286 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/neelance/parallel"
+
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// ResumableIndexOptions configures a resumable index build.
+type ResumableIndexOptions struct {
+	// Parallelism is the number of source units whose indexes are
+	// built concurrently. If 0, GOMAXPROCS is used.
+	Parallelism int
+
+	// CheckpointEvery is the number of source units whose indexes are
+	// built between checkpoints. If 0, a checkpoint is written after
+	// each unit.
+	CheckpointEvery int
+
+	// Progress, if set, is called (serially) after each source unit's
+	// indexes are built, with the number of units done (including
+	// units done in earlier, interrupted builds) and the total number
+	// of units.
+	Progress func(done, total int)
+}
+
+// ResumableIndexStats describes a completed resumable index build.
+type ResumableIndexStats struct {
+	// Units is the number of source units in the tree.
+	Units int
+
+	// Built is the number of source units whose indexes were built by
+	// this build.
+	Built int
+
+	// Resumed is the number of source units whose indexes were built
+	// by earlier, interrupted builds (and were skipped by this build).
+	Resumed int
+}
+
+// A TreeResumableIndexer builds a tree's indexes in a way that can be
+// resumed if the build is interrupted, which avoids starting over when
+// a long build (e.g., of a large monorepo) fails.
+type TreeResumableIndexer interface {
+	// IndexResumable rebuilds the indexes of each of the tree's
+	// source units (in parallel) and then builds the tree's indexes.
+	// The source units that are done are checkpointed in the tree's
+	// dir, and a build that is started after an earlier build of the
+	// tree was interrupted only rebuilds the remaining units' indexes.
+	// The checkpoint is removed when the build completes and when data
+	// is imported into the tree (which makes it stale).
+	IndexResumable(opt *ResumableIndexOptions) (*ResumableIndexStats, error)
+}
+
+// A RepoResumableIndexer builds the indexes of a repo's trees
+// resumably (see TreeResumableIndexer).
+type RepoResumableIndexer interface {
+	IndexResumable(commitID string, opt *ResumableIndexOptions) (*ResumableIndexStats, error)
+}
+
+// A MultiRepoResumableIndexer builds the indexes of trees in multiple
+// repos resumably (see TreeResumableIndexer).
+type MultiRepoResumableIndexer interface {
+	IndexResumable(repo, commitID string, opt *ResumableIndexOptions) (*ResumableIndexStats, error)
+}
+
+// indexCheckpointName is the name of the file (in a tree's dir) that
+// records the progress of an interrupted resumable index build. It is
+// named like an index so that it isn't covered by the tree's content
+// digest.
+var indexCheckpointName = fmt.Sprintf(indexFilename, "index_checkpoint")
+
+// indexCheckpoint is the progress of a resumable index build.
+type indexCheckpoint struct {
+	// Units are the source units whose indexes were built.
+	Units []unit.ID2
+}
+
+func (s *fsTreeStore) readIndexCheckpoint() (*indexCheckpoint, error) {
+	f, err := s.fs.Open(indexCheckpointName)
+	if os.IsNotExist(err) {
+		return &indexCheckpoint{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var c indexCheckpoint
+	if err := json.NewDecoder(f).Decode(&c); err != nil {
+		// A checkpoint that was partially written when the build was
+		// interrupted is discarded.
+		vlog.Printf("%s: ignoring invalid %s: %s", s, indexCheckpointName, err)
+		return &indexCheckpoint{}, nil
+	}
+	return &c, nil
+}
+
+func (s *fsTreeStore) writeIndexCheckpoint(c *indexCheckpoint) (err error) {
+	f, err := s.fs.Create(indexCheckpointName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := f.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+	return json.NewEncoder(f).Encode(c)
+}
+
+// invalidateIndexCheckpoint removes the tree's resumable index build
+// checkpoint. It must be called before the tree's imported data is
+// modified.
+func (s *fsTreeStore) invalidateIndexCheckpoint() error {
+	if err := s.fs.Remove(indexCheckpointName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// IndexResumable implements TreeResumableIndexer. An unindexed tree
+// store has no indexes to build.
+func (s *fsTreeStore) IndexResumable(opt *ResumableIndexOptions) (*ResumableIndexStats, error) {
+	units, err := s.Units()
+	if err != nil {
+		return nil, err
+	}
+	return &ResumableIndexStats{Units: len(units)}, nil
+}
+
+func (s *indexedTreeStore) IndexResumable(opt *ResumableIndexOptions) (*ResumableIndexStats, error) {
+	if opt == nil {
+		opt = &ResumableIndexOptions{}
+	}
+	units, err := s.fsTreeStore.Units()
+	if err != nil {
+		return nil, err
+	}
+	checkpoint, err := s.readIndexCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(map[unit.ID2]struct{}, len(checkpoint.Units))
+	for _, u := range checkpoint.Units {
+		done[u] = struct{}{}
+	}
+	var todo []*unit.SourceUnit
+	for _, u := range units {
+		if _, present := done[u.ID2()]; !present {
+			todo = append(todo, u)
+		}
+	}
+	stats := &ResumableIndexStats{Units: len(units), Resumed: len(units) - len(todo)}
+
+	parN := opt.Parallelism
+	if parN <= 0 {
+		parN = runtime.GOMAXPROCS(0)
+	}
+	every := opt.CheckpointEvery
+	if every <= 0 {
+		every = 1
+	}
+
+	var (
+		mu         sync.Mutex // guards checkpoint, stats, and sinceWrite
+		sinceWrite int
+	)
+	par := parallel.NewRun(parN)
+	for _, u_ := range todo {
+		u := u_.ID2()
+		par.Acquire()
+		go func() {
+			defer par.Release()
+			us, ok := s.fsTreeStore.openUnitStore(u).(*indexedUnitStore)
+			if ok {
+				if err := us.rebuildIndexes(); err != nil {
+					par.Error(fmt.Errorf("building indexes of source unit %v: %s", u, err))
+					return
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			checkpoint.Units = append(checkpoint.Units, u)
+			stats.Built++
+			if sinceWrite++; sinceWrite >= every {
+				if err := s.writeIndexCheckpoint(checkpoint); err != nil {
+					par.Error(err)
+					return
+				}
+				sinceWrite = 0
+			}
+			if opt.Progress != nil {
+				opt.Progress(stats.Resumed+stats.Built, stats.Units)
+			}
+		}()
+	}
+	if err := par.Wait(); err != nil {
+		// Save the progress of the units that were built, so that the
+		// next build can resume after them.
+		if sinceWrite > 0 {
+			if err2 := s.writeIndexCheckpoint(checkpoint); err2 != nil {
+				vlog.Printf("%s: failed to write %s: %s", s, indexCheckpointName, err2)
+			}
+		}
+		return nil, err
+	}
+
+	if err := s.Index(); err != nil {
+		return nil, err
+	}
+	if err := s.invalidateIndexCheckpoint(); err != nil {
+		return nil, err
+	}
+	if err := s.refreshTreeManifest(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// rebuildIndexes rebuilds all of the unit's indexes (and those of its
+// ref shards, if any).
+func (s *indexedUnitStore) rebuildIndexes() error {
+	n, err := s.refShards()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return s.buildIndexes(s.Indexes(), nil, nil, nil, nil)
+	}
+
+	// The refs are stored (and indexed) in the shards; see Import.
+	defIndexes := map[string]Index{}
+	for name, x := range s.Indexes() {
+		if _, ok := x.(defIndexBuilder); ok {
+			defIndexes[name] = x
+		}
+	}
+	if err := s.buildIndexes(defIndexes, nil, nil, nil, nil); err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		shard := s.openRefShard(i, openIndexedRefShard).(*indexedUnitStore)
+		refIndexes := map[string]Index{}
+		for name, x := range shard.Indexes() {
+			if _, ok := x.(refIndexBuilder); ok {
+				refIndexes[name] = x
+			}
+		}
+		if err := shard.buildIndexes(refIndexes, nil, nil, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fsRepoStore) IndexResumable(commitID string, opt *ResumableIndexOptions) (*ResumableIndexStats, error) {
+	return s.newTreeStore(commitID).(TreeResumableIndexer).IndexResumable(opt)
+}
+
+func (s *fsMultiRepoStore) IndexResumable(repo, commitID string, opt *ResumableIndexOptions) (*ResumableIndexStats, error) {
+	if err := s.CheckImportAllowed(repo, commitID); err != nil {
+		return nil, err
+	}
+	stats, err := s.openRepoStore(repo).(RepoResumableIndexer).IndexResumable(commitID, opt)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.UpdateUsage(repo, commitID); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+var (
+	_ TreeResumableIndexer      = (*fsTreeStore)(nil)
+	_ TreeResumableIndexer      = (*indexedTreeStore)(nil)
+	_ RepoResumableIndexer      = (*fsRepoStore)(nil)
+	_ MultiRepoResumableIndexer = (*fsMultiRepoStore)(nil)
+)
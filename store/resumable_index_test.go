@@ -0,0 +1,85 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestIndexResumable(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+
+	for _, indexed := range []bool{false, true} {
+		useIndexedStore = indexed
+		mrs := NewFSMultiRepoStore(newTestFS(), nil)
+		testSyncImport(t, mrs, "r", "c", "u1", "u2", "u3")
+
+		ts := mrs.(*fsMultiRepoStore).openRepoStore("r").(*fsRepoStore).newTreeStore("c")
+		var fts *fsTreeStore
+		switch ts := ts.(type) {
+		case *fsTreeStore:
+			fts = ts
+		case *indexedTreeStore:
+			fts = ts.fsTreeStore
+		}
+
+		// Simulate an interrupted build that built u1's indexes.
+		if err := fts.writeIndexCheckpoint(&indexCheckpoint{Units: []unit.ID2{{Type: "t", Name: "u1"}}}); err != nil {
+			t.Fatal(err)
+		}
+
+		var progress []int
+		stats, err := mrs.(MultiRepoResumableIndexer).IndexResumable("r", "c", &ResumableIndexOptions{
+			Parallelism: 1,
+			Progress:    func(done, total int) { progress = append(progress, done) },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := ResumableIndexStats{Units: 3}
+		if indexed {
+			want.Built, want.Resumed = 2, 1
+		}
+		if *stats != want {
+			t.Errorf("indexed=%v: got stats %+v, want %+v", indexed, *stats, want)
+		}
+		if indexed {
+			if want := []int{2, 3}; !reflect.DeepEqual(progress, want) {
+				t.Errorf("indexed=%v: got progress %v, want %v", indexed, progress, want)
+			}
+			if _, err := fts.fs.Stat(indexCheckpointName); err == nil {
+				t.Errorf("indexed=%v: checkpoint exists after completed build", indexed)
+			}
+		}
+
+		refs, err := mrs.Refs(ByRepoCommitIDs(Version{Repo: "r", CommitID: "c"}), ByUnits(unit.ID2{Type: "t", Name: "u2"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(refs) != 2 {
+			t.Errorf("indexed=%v: got %d refs, want 2", indexed, len(refs))
+		}
+
+		// Importing data makes a checkpoint stale.
+		if err := fts.writeIndexCheckpoint(&indexCheckpoint{Units: []unit.ID2{{Type: "t", Name: "u1"}}}); err != nil {
+			t.Fatal(err)
+		}
+		testSyncImport(t, mrs, "r", "c", "u4")
+		if _, err := fts.fs.Stat(indexCheckpointName); err == nil {
+			t.Errorf("indexed=%v: checkpoint exists after import", indexed)
+		}
+	}
+}
+
+func TestIndexResumable_invalidCheckpoint(t *testing.T) {
+	fts := newFSTreeStore(rwvfs.Map(map[string]string{indexCheckpointName: `{"Units": [`}), fsStoreSettings{})
+	c, err := fts.readIndexCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Units) != 0 {
+		t.Errorf("got checkpoint units %v, want none", c.Units)
+	}
+}
@@ -0,0 +1,622 @@
+package store
+
+import (
+	"math/rand"
+	"sync"
+
+	"github.com/neelance/parallel"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+// A DefRefSampler returns random samples of a store's defs and refs,
+// for previews, debugging, and statistical quality checks of huge
+// source units.
+//
+// Samples are drawn using the offsets recorded in the units' indexes
+// (the def path index for defs, and the file-to-refs index for refs):
+// random entries of the index are picked and only the records at their
+// offsets are read, so a sample doesn't require scanning the units'
+// full data files. Units whose indexes are unavailable are scanned.
+//
+// Each unit's sample is uniformly random. Samples from multiple units
+// (and trees and repos) are combined in proportion to the number of
+// matching defs or refs in each, which is estimated from the
+// fraction of each unit's sampled records that the filters select, so
+// the combined sample is only roughly uniform if the filters select
+// defs or refs unevenly.
+type DefRefSampler interface {
+	// SampleDefs returns a random sample of up to n of the defs that
+	// match the filters, in random order. If fewer than n defs match,
+	// all of them are returned.
+	SampleDefs(n int, f ...DefFilter) ([]*graph.Def, error)
+
+	// SampleRefs returns a random sample of up to n of the refs that
+	// match the filters, in random order. If fewer than n refs match,
+	// all of them are returned.
+	SampleRefs(n int, f ...RefFilter) ([]*graph.Ref, error)
+}
+
+var (
+	_ DefRefSampler = (*fsMultiRepoStore)(nil)
+	_ DefRefSampler = (*fsRepoStore)(nil)
+	_ DefRefSampler = (*fsTreeStore)(nil)
+)
+
+// A defSample is a uniformly random sample (in random order) of the
+// defs that match a query in part of a store, and the (estimated)
+// number of matching defs that it was drawn from.
+type defSample struct {
+	defs       []*graph.Def
+	population float64
+}
+
+// A refSample is like a defSample, but for refs.
+type refSample struct {
+	refs       []*graph.Ref
+	population float64
+}
+
+// defSampler and refSampler are implemented by stores that can sample
+// their defs and refs more efficiently than by querying all of them.
+type defSampler interface {
+	sampleDefs(n int, fs []DefFilter) (*defSample, error)
+}
+type refSampler interface {
+	sampleRefs(n int, fs []RefFilter) (*refSample, error)
+}
+
+// sampleDefsOf samples the defs of s, using s's sampleDefs method if
+// it has one and otherwise querying all of its defs.
+func sampleDefsOf(s interface {
+	Defs(...DefFilter) ([]*graph.Def, error)
+}, n int, fs []DefFilter) (*defSample, error) {
+	if s, ok := s.(defSampler); ok {
+		return s.sampleDefs(n, fs)
+	}
+	defs, err := s.Defs(fs...)
+	if err != nil {
+		return nil, err
+	}
+	shuffleSample(len(defs), func(i, j int) { defs[i], defs[j] = defs[j], defs[i] })
+	sample := &defSample{population: float64(len(defs))}
+	if len(defs) > n {
+		defs = defs[:n]
+	}
+	sample.defs = defs
+	return sample, nil
+}
+
+// sampleRefsOf is like sampleDefsOf, but for refs.
+func sampleRefsOf(s interface {
+	Refs(...RefFilter) ([]*graph.Ref, error)
+}, n int, fs []RefFilter) (*refSample, error) {
+	if s, ok := s.(refSampler); ok {
+		return s.sampleRefs(n, fs)
+	}
+	refs, err := s.Refs(fs...)
+	if err != nil {
+		return nil, err
+	}
+	shuffleSample(len(refs), func(i, j int) { refs[i], refs[j] = refs[j], refs[i] })
+	sample := &refSample{population: float64(len(refs))}
+	if len(refs) > n {
+		refs = refs[:n]
+	}
+	sample.refs = refs
+	return sample, nil
+}
+
+// shuffleSample shuffles n elements using swap.
+func shuffleSample(n int, swap func(i, j int)) {
+	for i := n - 1; i > 0; i-- {
+		swap(i, rand.Intn(i+1))
+	}
+}
+
+// mergeSamples draws up to n elements (without replacement) from
+// samples of sizes[i] elements of populations of pops[i] elements. It
+// returns the chosen elements as (sample index, element index) pairs.
+// If each sample is a uniformly random sample in random order, the
+// chosen elements are a uniformly random sample of the union of the
+// populations.
+func mergeSamples(sizes []int, pops []float64, n int) [][2]int {
+	taken := make([]int, len(sizes))
+	remaining := append([]float64{}, pops...)
+	var picks [][2]int
+	for len(picks) < n {
+		// Weigh each sample by the size of the remainder of its
+		// population (which is at least the number of elements left in
+		// the sample, even if the population was underestimated).
+		var total float64
+		weights := make([]float64, len(sizes))
+		for i := range sizes {
+			if left := sizes[i] - taken[i]; left > 0 {
+				weights[i] = remaining[i]
+				if weights[i] < float64(left) {
+					weights[i] = float64(left)
+				}
+				total += weights[i]
+			}
+		}
+		if total == 0 {
+			break
+		}
+		r := rand.Float64() * total
+		i := 0
+		for ; i < len(weights)-1; i++ {
+			if weights[i] > 0 && r < weights[i] {
+				break
+			}
+			r -= weights[i]
+		}
+		for weights[i] == 0 {
+			i-- // guard against rounding past the last nonzero weight
+		}
+		picks = append(picks, [2]int{i, taken[i]})
+		taken[i]++
+		remaining[i]--
+	}
+	return picks
+}
+
+// mergeDefSamples merges samples (see mergeSamples).
+func mergeDefSamples(samples []*defSample, n int) *defSample {
+	sizes, pops := make([]int, len(samples)), make([]float64, len(samples))
+	merged := &defSample{}
+	for i, s := range samples {
+		sizes[i], pops[i] = len(s.defs), s.population
+		merged.population += s.population
+	}
+	for _, p := range mergeSamples(sizes, pops, n) {
+		merged.defs = append(merged.defs, samples[p[0]].defs[p[1]])
+	}
+	return merged
+}
+
+// mergeRefSamples merges samples (see mergeSamples).
+func mergeRefSamples(samples []*refSample, n int) *refSample {
+	sizes, pops := make([]int, len(samples)), make([]float64, len(samples))
+	merged := &refSample{}
+	for i, s := range samples {
+		sizes[i], pops[i] = len(s.refs), s.population
+		merged.population += s.population
+	}
+	for _, p := range mergeSamples(sizes, pops, n) {
+		merged.refs = append(merged.refs, samples[p[0]].refs[p[1]])
+	}
+	return merged
+}
+
+// A lazyPerm generates a random permutation of [0, n) lazily, using a
+// Fisher-Yates shuffle that records only the positions it has swapped,
+// so that drawing k elements takes O(k) time and space regardless of
+// n.
+type lazyPerm struct {
+	n, i  int64
+	swaps map[int64]int64
+}
+
+func newLazyPerm(n int64) *lazyPerm { return &lazyPerm{n: n, swaps: map[int64]int64{}} }
+
+func (p *lazyPerm) at(i int64) int64 {
+	if v, present := p.swaps[i]; present {
+		return v
+	}
+	return i
+}
+
+// next returns up to k more elements of the permutation.
+func (p *lazyPerm) next(k int) []int64 {
+	var is []int64
+	for ; len(is) < k && p.i < p.n; p.i++ {
+		j := p.i + rand.Int63n(p.n-p.i)
+		vi, vj := p.at(p.i), p.at(j)
+		p.swaps[j] = vi
+		delete(p.swaps, p.i)
+		is = append(is, vj)
+	}
+	return is
+}
+
+// sampleAtRandomOffsets draws a sample of up to n of the records that
+// the read func selects from a population of total records, by reading
+// records at random positions of the population in batches until
+// enough are selected. It returns the number of records that it
+// selected and the estimated number of selected records in the
+// population.
+func sampleAtRandomOffsets(total int64, n int, read func(is []int64) (selected int, err error)) (int, float64, error) {
+	perm := newLazyPerm(total)
+	var selected, examined int
+	for selected < n {
+		// Read n records per batch (even if fewer are still needed),
+		// so that filters that select few records don't require many
+		// small batches.
+		is := perm.next(n)
+		if len(is) == 0 {
+			break
+		}
+		m, err := read(is)
+		if err != nil {
+			return 0, 0, err
+		}
+		selected += m
+		examined += len(is)
+	}
+	if examined == 0 {
+		return 0, 0, nil
+	}
+	return selected, float64(total) * float64(selected) / float64(examined), nil
+}
+
+func (s *indexedUnitStore) sampleDefs(n int, fs []DefFilter) (*defSample, error) {
+	x := s.indexes[defPathIndexName].(*defPathIndex)
+	if err := prepareQueryIndex(s, s.fs, defPathIndexName, x); isIndexUnavailable(err) {
+		return sampleDefsOf(s.fsUnitStore, n, fs)
+	} else if err != nil {
+		return nil, err
+	}
+
+	sample := &defSample{}
+	var err error
+	_, sample.population, err = sampleAtRandomOffsets(x.n, n, func(is []int64) (int, error) {
+		ofs, err := x.offsetsAt(queryContext(fs), is)
+		if err != nil {
+			return 0, err
+		}
+		defs, err := s.defsAtOffsets(ofs, fs)
+		if err != nil {
+			return 0, err
+		}
+		sample.defs = append(sample.defs, defs...)
+		return len(defs), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	shuffleSample(len(sample.defs), func(i, j int) { sample.defs[i], sample.defs[j] = sample.defs[j], sample.defs[i] })
+	if len(sample.defs) > n {
+		sample.defs = sample.defs[:n]
+	}
+	return sample, nil
+}
+
+func (s *indexedUnitStore) sampleRefs(n int, fs []RefFilter) (*refSample, error) {
+	// Sharded refs are indexed per shard.
+	if nshards, err := s.refShards(); err != nil {
+		return nil, err
+	} else if nshards > 0 {
+		samples := make([]*refSample, nshards)
+		for i := range samples {
+			var err error
+			samples[i], err = sampleRefsOf(s.openRefShard(i, openIndexedRefShard), n, fs)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return mergeRefSamples(samples, n), nil
+	}
+
+	const xname = "file_to_refs"
+	x := s.indexes[xname].(*refFileIndex)
+	if err := prepareQueryIndex(s, s.fs, xname, x); isIndexUnavailable(err) {
+		return sampleRefsOf(s.fsUnitStore, n, fs)
+	} else if err != nil {
+		return nil, err
+	}
+	brs, err := x.byteRanges()
+	if err != nil {
+		return nil, err
+	}
+	if brs == nil {
+		// The index doesn't list its files.
+		return sampleRefsOf(s.fsUnitStore, n, fs)
+	}
+
+	// The i'th ref in the index is the (i-cum[k])'th ref of brs[k],
+	// where k is the last byteRanges with cum[k] <= i.
+	cum := make([]int64, len(brs)+1)
+	for k, br := range brs {
+		cum[k+1] = cum[k] + int64(len(br)-1)
+	}
+	refOffset := func(i int64) int64 {
+		lo, hi := 0, len(brs)
+		for hi-lo > 1 {
+			if mid := (lo + hi) / 2; cum[mid] <= i {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		br := brs[lo]
+		ofs := br.start()
+		for _, l := range br[1 : 1+i-cum[lo]] {
+			ofs += l
+		}
+		return ofs
+	}
+
+	sample := &refSample{}
+	_, sample.population, err = sampleAtRandomOffsets(cum[len(brs)], n, func(is []int64) (int, error) {
+		ofs := make(byteOffsets, len(is))
+		for k, i := range is {
+			ofs[k] = refOffset(i)
+		}
+		refs, err := s.refsAtOffsets(ofs, fs)
+		if err != nil {
+			return 0, err
+		}
+		sample.refs = append(sample.refs, refs...)
+		return len(refs), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	shuffleSample(len(sample.refs), func(i, j int) { sample.refs[i], sample.refs[j] = sample.refs[j], sample.refs[i] })
+	if len(sample.refs) > n {
+		sample.refs = sample.refs[:n]
+	}
+	return sample, nil
+}
+
+func (s unitStores) sampleDefs(n int, fs []DefFilter) (*defSample, error) {
+	uss, err := openUnitStores(s.opener, fs)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		samples   []*defSample
+		samplesMu sync.Mutex
+	)
+	par := parallel.NewRun(storeFetchPar)
+	for u_, us_ := range uss {
+		u, us := u_, us_
+		if us == nil {
+			continue
+		}
+
+		par.Acquire()
+		go func() {
+			defer par.Release()
+			sample, err := sampleDefsOf(us, n, filtersForUnit(u, fs).([]DefFilter))
+			if err != nil {
+				if !isStoreNotExist(err) {
+					par.Error(err)
+				}
+				return
+			}
+			for _, def := range sample.defs {
+				def.UnitType = u.Type
+				def.Unit = u.Name
+			}
+			samplesMu.Lock()
+			samples = append(samples, sample)
+			samplesMu.Unlock()
+		}()
+	}
+	if err := par.Wait(); err != nil {
+		return nil, err
+	}
+	return mergeDefSamples(samples, n), nil
+}
+
+func (s unitStores) sampleRefs(n int, f []RefFilter) (*refSample, error) {
+	uss, err := openUnitStores(s.opener, f)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		samples   []*refSample
+		samplesMu sync.Mutex
+	)
+	par := parallel.NewRun(storeFetchPar)
+	for u_, us_ := range uss {
+		u, us := u_, us_
+		if us == nil {
+			continue
+		}
+
+		par.Acquire()
+		go func() {
+			defer par.Release()
+			fCopy := withImpliedUnit(filtersForUnit(u, f).([]RefFilter), u)
+			sample, err := sampleRefsOf(us, n, fCopy)
+			if err != nil {
+				if !isStoreNotExist(err) {
+					par.Error(err)
+				}
+				return
+			}
+			for _, ref := range sample.refs {
+				ref.UnitType = u.Type
+				ref.Unit = u.Name
+				if ref.DefUnitType == "" {
+					ref.DefUnitType = u.Type
+				}
+				if ref.DefUnit == "" {
+					ref.DefUnit = u.Name
+				}
+			}
+			samplesMu.Lock()
+			samples = append(samples, sample)
+			samplesMu.Unlock()
+		}()
+	}
+	if err := par.Wait(); err != nil {
+		return nil, err
+	}
+	return mergeRefSamples(samples, n), nil
+}
+
+func (s *fsTreeStore) sampleDefs(n int, fs []DefFilter) (*defSample, error) {
+	fs, err := s.withDeprecations(fs)
+	if err != nil {
+		return nil, err
+	}
+	return s.unitStores.sampleDefs(n, fs)
+}
+
+func (s treeStores) sampleDefs(n int, f []DefFilter) (*defSample, error) {
+	tss, err := openTreeStores(s.opener, f)
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []*defSample
+	for commitID, ts := range tss {
+		if ts == nil {
+			continue
+		}
+
+		sample, err := sampleDefsOf(ts, n, f)
+		if err != nil {
+			if isStoreNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, def := range sample.defs {
+			def.CommitID = commitID
+		}
+		samples = append(samples, sample)
+	}
+	return mergeDefSamples(samples, n), nil
+}
+
+func (s treeStores) sampleRefs(n int, f []RefFilter) (*refSample, error) {
+	tss, err := openTreeStores(s.opener, f)
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []*refSample
+	for commitID, ts := range tss {
+		if ts == nil {
+			continue
+		}
+
+		setImpliedCommitID(f, commitID)
+		sample, err := sampleRefsOf(ts, n, f)
+		if err != nil {
+			if isStoreNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, ref := range sample.refs {
+			ref.CommitID = commitID
+		}
+		samples = append(samples, sample)
+	}
+	return mergeRefSamples(samples, n), nil
+}
+
+func (s repoStores) sampleDefs(n int, f []DefFilter) (*defSample, error) {
+	f = normalizeRepoFilters(s.opener, f).([]DefFilter)
+	rss, err := openRepoStores(s.opener, f)
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []*defSample
+	for repo, rs := range rss {
+		if rs == nil {
+			continue
+		}
+
+		sample, err := sampleDefsOf(rs, n, filtersForRepo(repo, f).([]DefFilter))
+		if err != nil {
+			if isStoreNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, def := range sample.defs {
+			def.Repo = repo
+		}
+		samples = append(samples, sample)
+	}
+	return mergeDefSamples(samples, n), nil
+}
+
+func (s repoStores) sampleRefs(n int, f []RefFilter) (*refSample, error) {
+	f = normalizeRepoFilters(s.opener, f).([]RefFilter)
+	rss, err := openRepoStores(s.opener, f)
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []*refSample
+	for repo, rs := range rss {
+		if rs == nil {
+			continue
+		}
+
+		setImpliedRepo(f, repo)
+		sample, err := sampleRefsOf(rs, n, filtersForRepo(repo, f).([]RefFilter))
+		if err != nil {
+			if isStoreNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, ref := range sample.refs {
+			ref.Repo = repo
+			if ref.DefRepo == "" {
+				ref.DefRepo = repo
+			}
+		}
+		samples = append(samples, sample)
+	}
+	return mergeRefSamples(samples, n), nil
+}
+
+func (s *fsTreeStore) SampleDefs(n int, f ...DefFilter) ([]*graph.Def, error) {
+	sample, err := s.sampleDefs(n, f)
+	if err != nil {
+		return nil, err
+	}
+	return sample.defs, nil
+}
+
+func (s *fsTreeStore) SampleRefs(n int, f ...RefFilter) ([]*graph.Ref, error) {
+	sample, err := s.sampleRefs(n, f)
+	if err != nil {
+		return nil, err
+	}
+	return sample.refs, nil
+}
+
+func (s *fsRepoStore) SampleDefs(n int, f ...DefFilter) ([]*graph.Def, error) {
+	sample, err := s.sampleDefs(n, f)
+	if err != nil {
+		return nil, err
+	}
+	return sample.defs, nil
+}
+
+func (s *fsRepoStore) SampleRefs(n int, f ...RefFilter) ([]*graph.Ref, error) {
+	sample, err := s.sampleRefs(n, f)
+	if err != nil {
+		return nil, err
+	}
+	return sample.refs, nil
+}
+
+func (s *fsMultiRepoStore) SampleDefs(n int, f ...DefFilter) ([]*graph.Def, error) {
+	sample, err := s.sampleDefs(n, f)
+	if err != nil {
+		return nil, err
+	}
+	return sample.defs, nil
+}
+
+func (s *fsMultiRepoStore) SampleRefs(n int, f ...RefFilter) ([]*graph.Ref, error) {
+	sample, err := s.sampleRefs(n, f)
+	if err != nil {
+		return nil, err
+	}
+	return sample.refs, nil
+}
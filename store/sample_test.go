@@ -0,0 +1,152 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestSampleDefsRefs(t *testing.T) {
+	for _, indexed := range []bool{false, true} {
+		func() {
+			defer func(v bool) { useIndexedStore = v }(useIndexedStore)
+			useIndexedStore = indexed
+			testSampleDefsRefs(t, indexed)
+		}()
+	}
+}
+
+func testSampleDefsRefs(t *testing.T, indexed bool) {
+	label := fmt.Sprintf("indexed=%v", indexed)
+	mrs := NewFSMultiRepoStore(newTestFS(), nil)
+	for _, u := range []string{"u1", "u2"} {
+		var data graph.Output
+		for i := 0; i < 50; i++ {
+			data.Defs = append(data.Defs, &graph.Def{DefKey: graph.DefKey{Path: fmt.Sprintf("%s/p%d", u, i)}, Name: "x", File: "f"})
+			data.Refs = append(data.Refs, &graph.Ref{DefPath: fmt.Sprintf("%s/p%d", u, i), File: fmt.Sprintf("f%d", i%3), Start: uint32(i), End: uint32(i + 1)})
+		}
+		if err := mrs.Import("r", "c", &unit.SourceUnit{Key: unit.Key{Type: "t", Name: u}}, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mrs.Index("r", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mrs.CreateVersion("r", "c"); err != nil {
+		t.Fatal(err)
+	}
+	ss := mrs.(DefRefSampler)
+	c_indexFallbacks.set(0)
+
+	checkDefs := func(defs []*graph.Def, want int, unitName string) {
+		if len(defs) != want {
+			t.Errorf("%s: got %d sampled defs, want %d", label, len(defs), want)
+		}
+		seen := map[string]bool{}
+		for _, def := range defs {
+			if def.Repo != "r" || def.CommitID != "c" || def.UnitType != "t" || (unitName != "" && def.Unit != unitName) {
+				t.Errorf("%s: got sampled def with key %+v", label, def.DefKey)
+			}
+			if seen[def.Path] {
+				t.Errorf("%s: def %s sampled twice", label, def.Path)
+			}
+			seen[def.Path] = true
+		}
+	}
+	defs, err := ss.SampleDefs(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDefs(defs, 10, "")
+	if defs, err = ss.SampleDefs(1000); err != nil {
+		t.Fatal(err)
+	}
+	checkDefs(defs, 100, "")
+	if defs, err = ss.SampleDefs(10, ByUnits(unit.ID2{Type: "t", Name: "u2"})); err != nil {
+		t.Fatal(err)
+	}
+	checkDefs(defs, 10, "u2")
+	if defs, err = ss.SampleDefs(1000, ByDefPath("u1/p7")); err != nil {
+		t.Fatal(err)
+	}
+	checkDefs(defs, 1, "u1")
+
+	refs, err := ss.SampleRefs(10, ByFiles(false, "f1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 10 {
+		t.Errorf("%s: got %d sampled refs, want 10", label, len(refs))
+	}
+	for _, ref := range refs {
+		if ref.File != "f1" || ref.Repo != "r" || ref.DefRepo != "r" || ref.Unit == "" || ref.DefUnit != ref.Unit {
+			t.Errorf("%s: got sampled ref %+v", label, ref)
+		}
+	}
+	if refs, err = ss.SampleRefs(1000); err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 100 {
+		t.Errorf("%s: got %d sampled refs, want all 100", label, len(refs))
+	}
+
+	// The indexes' offsets are used instead of scanning the units.
+	if n := c_indexFallbacks.get(); indexed && n != 0 {
+		t.Errorf("%s: got %d index fallbacks, want 0", label, n)
+	}
+}
+
+func TestMergeSamples(t *testing.T) {
+	// Elements are drawn in proportion to their samples' populations.
+	var fromFirst int
+	const trials = 2000
+	for i := 0; i < trials; i++ {
+		picks := mergeSamples([]int{5, 5}, []float64{900, 100}, 1)
+		if picks[0][0] == 0 {
+			fromFirst++
+		}
+	}
+	if frac := float64(fromFirst) / trials; frac < 0.85 || frac > 0.95 {
+		t.Errorf("got %.2f of picks from the first sample, want about 0.9", frac)
+	}
+
+	// Samples are exhausted in order, even if populations were
+	// underestimated.
+	picks := mergeSamples([]int{2, 3}, []float64{0, 1}, 10)
+	if len(picks) != 5 {
+		t.Fatalf("got %d picks, want 5", len(picks))
+	}
+	next := []int{0, 0}
+	for _, p := range picks {
+		if p[1] != next[p[0]] {
+			t.Errorf("got pick %v, want element %d of sample %d", p, next[p[0]], p[0])
+		}
+		next[p[0]]++
+	}
+}
+
+func TestLazyPerm(t *testing.T) {
+	p := newLazyPerm(100)
+	var is []int
+	for {
+		batch := p.next(7)
+		if len(batch) == 0 {
+			break
+		}
+		for _, i := range batch {
+			is = append(is, int(i))
+		}
+	}
+	sort.Ints(is)
+	for i, v := range is {
+		if v != i {
+			t.Fatalf("not a permutation of [0, 100): %v", is)
+		}
+	}
+	if len(is) != 100 {
+		t.Errorf("got %d elements, want 100", len(is))
+	}
+}
@@ -0,0 +1,142 @@
+package store
+
+import (
+	"io"
+	"sort"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// A TreeScanResults stores the output of the scanners (unit
+// discovery) for a tree: all of the source units that were discovered,
+// with their file lists and config. Unlike the units returned by
+// Units, which are only those whose graph data was imported, the scan
+// results include every discovered unit, so tools can answer "what
+// units exist and what files belong to each" without re-running the
+// scanners on a checkout of the tree.
+type TreeScanResults interface {
+	// ImportScan stores the tree's scan results, replacing any
+	// previously stored results.
+	ImportScan(units []*unit.SourceUnit) error
+
+	// ScannedUnits returns the units in the tree's scan results that
+	// match the filters (e.g., ByFiles to find the units that contain
+	// a file). If no scan results were stored, an error satisfying
+	// os.IsNotExist is returned.
+	ScannedUnits(f ...UnitFilter) ([]*unit.SourceUnit, error)
+}
+
+// A RepoScanResults stores the scan results of a repo's trees.
+type RepoScanResults interface {
+	ImportScan(commitID string, units []*unit.SourceUnit) error
+	ScannedUnits(commitID string, f ...UnitFilter) ([]*unit.SourceUnit, error)
+}
+
+// A MultiRepoScanResults stores the scan results of trees in multiple
+// repos.
+type MultiRepoScanResults interface {
+	ImportScan(repo, commitID string, units []*unit.SourceUnit) error
+	ScannedUnits(repo, commitID string, f ...UnitFilter) ([]*unit.SourceUnit, error)
+}
+
+// scanFilename is the name of the file (in a tree's dir) that holds
+// the tree's scan results.
+const scanFilename = "scan.dat"
+
+func (s *fsTreeStore) ImportScan(units []*unit.SourceUnit) (err error) {
+	if err := rwvfs.MkdirAll(s.fs, "."); err != nil {
+		return err
+	}
+	if err := s.invalidateContentDigest(); err != nil {
+		return err
+	}
+
+	// Write the units in a deterministic order, so that importing the
+	// same scan results yields the same tree content digest.
+	sorted := make([]*unit.SourceUnit, len(units))
+	copy(sorted, units)
+	sort.Sort(unitsByID2(sorted))
+
+	f, err := s.fs.Create(scanFilename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := f.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+	enc := s.codec().NewEncoder(f)
+	for _, u := range sorted {
+		if _, err := enc.Encode(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fsTreeStore) ScannedUnits(fs ...UnitFilter) (units []*unit.SourceUnit, err error) {
+	f, err := s.fs.Open(scanFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err2 := f.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+
+	dec := s.codec().NewDecoder(f)
+	for {
+		u := &unit.SourceUnit{}
+		if _, err := dec.Decode(u); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if unitFilters(fs).SelectUnit(u) {
+			units = append(units, u)
+		}
+	}
+	return units, nil
+}
+
+func (s *fsRepoStore) ImportScan(commitID string, units []*unit.SourceUnit) error {
+	return s.newTreeStore(commitID).(TreeScanResults).ImportScan(units)
+}
+
+func (s *fsRepoStore) ScannedUnits(commitID string, f ...UnitFilter) ([]*unit.SourceUnit, error) {
+	units, err := s.newTreeStore(commitID).(TreeScanResults).ScannedUnits(f...)
+	for _, u := range units {
+		u.CommitID = commitID
+	}
+	return units, err
+}
+
+func (s *fsMultiRepoStore) ImportScan(repo, commitID string, units []*unit.SourceUnit) error {
+	if err := s.CheckImportAllowed(repo, commitID); err != nil {
+		return err
+	}
+	if err := s.ensureStoreManifest(); err != nil {
+		return err
+	}
+	if err := rwvfs.MkdirAll(s.fs, s.repoPath(repo)); err != nil {
+		return err
+	}
+	return s.openRepoStore(repo).(RepoScanResults).ImportScan(commitID, units)
+}
+
+func (s *fsMultiRepoStore) ScannedUnits(repo, commitID string, f ...UnitFilter) ([]*unit.SourceUnit, error) {
+	units, err := s.openRepoStore(repo).(RepoScanResults).ScannedUnits(commitID, f...)
+	for _, u := range units {
+		u.Repo = repo
+	}
+	return units, err
+}
+
+var (
+	_ TreeScanResults      = (*fsTreeStore)(nil)
+	_ RepoScanResults      = (*fsRepoStore)(nil)
+	_ MultiRepoScanResults = (*fsMultiRepoStore)(nil)
+)
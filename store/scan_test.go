@@ -0,0 +1,70 @@
+package store
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestFSMultiRepoStore_ScanResults(t *testing.T) {
+	mrs := NewFSMultiRepoStore(newTestFS(), nil)
+	scan := mrs.(MultiRepoScanResults)
+
+	if _, err := scan.ScannedUnits("r", "c"); !os.IsNotExist(err) {
+		t.Errorf("ScannedUnits before import: got error %v, want IsNotExist", err)
+	}
+
+	units := []*unit.SourceUnit{
+		{Key: unit.Key{Type: "t", Name: "u2"}, Info: unit.Info{Files: []string{"b/b.go"}, Config: map[string]string{"k": "v"}}},
+		{Key: unit.Key{Type: "t", Name: "u1"}, Info: unit.Info{Files: []string{"a/a.go", "a/a2.go"}}},
+	}
+	if err := scan.ImportScan("r", "c", units); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := scan.ScannedUnits("r", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Name != "u1" || got[1].Name != "u2" {
+		t.Fatalf("got units %v, want u1 and u2 (sorted)", got)
+	}
+	if got[0].Repo != "r" || !reflect.DeepEqual(got[0].Files, units[1].Files) || !reflect.DeepEqual(got[1].Config, units[0].Config) {
+		t.Errorf("got unit %+v and %+v, want files and config preserved", got[0], got[1])
+	}
+
+	got, err = scan.ScannedUnits("r", "c", ByFiles(false, "a/a2.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Name != "u1" {
+		t.Errorf("ScannedUnits(ByFiles): got %v, want u1", got)
+	}
+
+	// Scan results are separate from imported units.
+	if units, err := mrs.Units(ByRepos("r")); err != nil || len(units) != 0 {
+		t.Errorf("Units: got %v (error %v), want none", units, err)
+	}
+}
+
+func TestSync_scanResults(t *testing.T) {
+	src := NewFSMultiRepoStore(newTestFS(), nil)
+	dst := NewFSMultiRepoStore(newTestFS(), nil)
+	testSyncImport(t, src, "r", "c", "u")
+	units := []*unit.SourceUnit{{Key: unit.Key{Type: "t", Name: "u"}}, {Key: unit.Key{Type: "t", Name: "unbuilt"}}}
+	if err := src.(MultiRepoScanResults).ImportScan("r", "c", units); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Sync(src, dst, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := dst.(MultiRepoScanResults).ScannedUnits("r", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Errorf("got %d scanned units, want 2", len(got))
+	}
+}
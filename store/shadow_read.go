@@ -0,0 +1,306 @@
+package store
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// ShadowReadOptions configures shadow-read verification (see
+// NewShadowReadStore).
+type ShadowReadOptions struct {
+	// SampleRate is the fraction (between 0 and 1) of defs and refs
+	// queries that are verified. If 0, none of them are verified (so
+	// set it to 1 to verify all of them).
+	SampleRate float64
+
+	// MaxConcurrent is the maximum number of verifications that run at
+	// once. Queries that are sampled while that many verifications
+	// are running aren't verified (and are counted as skipped), so
+	// verification can't pile up full scans under load. If 0, there is
+	// no maximum.
+	MaxConcurrent int
+
+	// Metrics, if non-nil, records the numbers of verified queries and
+	// mismatches.
+	Metrics *ShadowReadMetrics
+}
+
+// NewShadowReadStore returns a MultiRepoStore that performs queries on
+// s and verifies a sample of the defs and refs queries by performing
+// them again with the ForceScan filter, in the background, and
+// comparing the results. Each mismatch (a query whose indexed and
+// scanned results differ) is logged, with the strategies that the
+// stores chose for the indexed query, and counted in opt.Metrics. Run
+// it in production to gain confidence in new index types before
+// relying on them.
+//
+// Callers always receive the results of the queries they made, not of
+// the scans. Verifications ignore the queries' in/out filters (such as
+// *QueryStats and *QueryTrace), WithContext filters (so they aren't
+// cancelled when the query's caller is done), and RequireIndex
+// filters. Paged queries whose order isn't fully determined (because
+// of an Unordered filter or a DefsSorter) aren't verified, because
+// their indexed and scanned pages may legitimately differ.
+//
+// The returned store only implements MultiRepoStore; other interfaces
+// that s implements (such as MultiRepoImporter) are hidden.
+func NewShadowReadStore(s MultiRepoStore, opt ShadowReadOptions) MultiRepoStore {
+	return &shadowReadStore{s: s, opt: opt, sample: rand.Float64}
+}
+
+type shadowReadStore struct {
+	s      MultiRepoStore
+	opt    ShadowReadOptions
+	sample func() float64 // returns a random number in [0, 1)
+
+	mu      sync.Mutex
+	running int            // number of verifications running
+	wg      sync.WaitGroup // verifications running (for tests)
+}
+
+var _ MultiRepoStore = (*shadowReadStore)(nil)
+
+// shouldVerify reports whether the query with the given filters should
+// be verified. If so, the caller must call done when the verification
+// is finished.
+func (s *shadowReadStore) shouldVerify(op string, filters interface{}) bool {
+	if s.opt.SampleRate <= 0 || (s.opt.SampleRate < 1 && s.sample() >= s.opt.SampleRate) {
+		return false
+	}
+	if _, _, paged := queryPage(filters); paged && (isUnordered(filters) || hasDefsSorter(filters)) {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.opt.MaxConcurrent > 0 && s.running >= s.opt.MaxConcurrent {
+		s.opt.Metrics.record(op, shadowReadSkipped)
+		return false
+	}
+	s.running++
+	s.wg.Add(1)
+	return true
+}
+
+func (s *shadowReadStore) done() {
+	s.mu.Lock()
+	s.running--
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+// report records the outcome of the verification of a query, and logs
+// mismatches and errors.
+func (s *shadowReadStore) report(op string, filters interface{}, trace *QueryTrace, diff string, err error) {
+	switch {
+	case err != nil:
+		s.opt.Metrics.record(op, shadowReadError)
+		log.Printf("Warning: shadow read of %s query %v failed: %s", op, filters, err)
+	case diff != "":
+		s.opt.Metrics.record(op, shadowReadMismatch)
+		log.Printf("Warning: shadow read mismatch in %s query %v (strategies %v): %s", op, filters, trace.Strategies, diff)
+	default:
+		s.opt.Metrics.record(op, shadowReadMatch)
+	}
+}
+
+// scanFilters returns the filters of the scan that verifies a query
+// with the given filters (a slice of filters).
+func scanFilters(filters interface{}) interface{} {
+	sf := storeFilters(filters)
+	fs := make([]interface{}, 0, len(sf)+1)
+	for _, f := range sf {
+		switch f.(type) {
+		case *QueryStats, *ConditionalQuery, *QueryTrace, *Arena, contextFilter, requireIndexFilter:
+			continue
+		}
+		fs = append(fs, f)
+	}
+	fs = append(fs, ForceScan())
+	return toTypedFilterSlice(reflect.TypeOf(filters), fs)
+}
+
+func (s *shadowReadStore) Repos(f ...RepoFilter) ([]string, error) {
+	return s.s.Repos(f...)
+}
+
+func (s *shadowReadStore) Versions(f ...VersionFilter) ([]*Version, error) {
+	return s.s.Versions(f...)
+}
+
+func (s *shadowReadStore) Units(f ...UnitFilter) ([]*unit.SourceUnit, error) {
+	return s.s.Units(f...)
+}
+
+func (s *shadowReadStore) Defs(f ...DefFilter) ([]*graph.Def, error) {
+	if !s.shouldVerify("Defs", f) {
+		return s.s.Defs(f...)
+	}
+	t := &QueryTrace{}
+	defs, err := s.s.Defs(append(f[:len(f):len(f)], t)...)
+	if err != nil {
+		s.done()
+		return nil, err
+	}
+	indexed := copyQueryResults(defs).([]*graph.Def)
+	go func() {
+		defer s.done()
+		scanned, err := s.s.Defs(scanFilters(f).([]DefFilter)...)
+		var diff string
+		if err == nil {
+			diff = diffDefs(indexed, scanned)
+		}
+		s.report("Defs", f, t, diff, err)
+	}()
+	return defs, nil
+}
+
+func (s *shadowReadStore) Refs(f ...RefFilter) ([]*graph.Ref, error) {
+	if !s.shouldVerify("Refs", f) {
+		return s.s.Refs(f...)
+	}
+	t := &QueryTrace{}
+	refs, err := s.s.Refs(append(f[:len(f):len(f)], t)...)
+	if err != nil {
+		s.done()
+		return nil, err
+	}
+	indexed := copyQueryResults(refs).([]*graph.Ref)
+	go func() {
+		defer s.done()
+		scanned, err := s.s.Refs(scanFilters(f).([]RefFilter)...)
+		var diff string
+		if err == nil {
+			diff = diffRefs(indexed, scanned)
+		}
+		s.report("Refs", f, t, diff, err)
+	}()
+	return refs, nil
+}
+
+func (s *shadowReadStore) generation() uint64 { return generationOf(s.s) }
+
+func (s *shadowReadStore) clock() Clock { return clockOf(s.s) }
+
+func (s *shadowReadStore) String() string { return fmt.Sprintf("shadowRead(%v)", s.s) }
+
+// diffDefs returns a description of the first difference between the
+// indexed and scanned defs (compared in canonical order), or "" if
+// they are the same.
+func diffDefs(indexed, scanned []*graph.Def) string {
+	sort.Sort(defsInCanonicalOrder(indexed))
+	sort.Sort(defsInCanonicalOrder(scanned))
+	for i := 0; i < len(indexed) && i < len(scanned); i++ {
+		if !reflect.DeepEqual(indexed[i], scanned[i]) {
+			return fmt.Sprintf("def %d is %v (indexed), %v (scanned)", i, indexed[i].DefKey, scanned[i].DefKey)
+		}
+	}
+	if len(indexed) != len(scanned) {
+		return fmt.Sprintf("got %d defs (indexed), %d defs (scanned)", len(indexed), len(scanned))
+	}
+	return ""
+}
+
+// diffRefs is like diffDefs, but for refs.
+func diffRefs(indexed, scanned []*graph.Ref) string {
+	sort.Sort(refsInCanonicalOrder(indexed))
+	sort.Sort(refsInCanonicalOrder(scanned))
+	for i := 0; i < len(indexed) && i < len(scanned); i++ {
+		if !reflect.DeepEqual(indexed[i], scanned[i]) {
+			a, b := indexed[i], scanned[i]
+			return fmt.Sprintf("ref %d is %s:%d-%d to %v (indexed), %s:%d-%d to %v (scanned)", i, a.File, a.Start, a.End, a.DefKey(), b.File, b.Start, b.End, b.DefKey())
+		}
+	}
+	if len(indexed) != len(scanned) {
+		return fmt.Sprintf("got %d refs (indexed), %d refs (scanned)", len(indexed), len(scanned))
+	}
+	return ""
+}
+
+// ShadowReadMetrics collects per-operation shadow-read verification
+// metrics (see ShadowReadOptions). It is safe for concurrent use. The
+// zero value is ready to use.
+type ShadowReadMetrics struct {
+	mu  sync.Mutex
+	ops map[string]*ShadowReadOpMetrics
+}
+
+// ShadowReadOpMetrics are the shadow-read verification metrics of the
+// queries of one kind (e.g., "Defs").
+type ShadowReadOpMetrics struct {
+	Verified   int // number of queries whose indexed and scanned results matched
+	Mismatches int // number of queries whose indexed and scanned results differed
+	Errors     int // number of verifications that failed
+	Skipped    int // number of sampled queries that weren't verified (see MaxConcurrent)
+}
+
+type shadowReadOutcome int
+
+const (
+	shadowReadMatch shadowReadOutcome = iota
+	shadowReadMismatch
+	shadowReadError
+	shadowReadSkipped
+)
+
+func (m *ShadowReadMetrics) record(op string, outcome shadowReadOutcome) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ops == nil {
+		m.ops = map[string]*ShadowReadOpMetrics{}
+	}
+	om := m.ops[op]
+	if om == nil {
+		om = &ShadowReadOpMetrics{}
+		m.ops[op] = om
+	}
+	switch outcome {
+	case shadowReadMatch:
+		om.Verified++
+	case shadowReadMismatch:
+		om.Mismatches++
+	case shadowReadError:
+		om.Errors++
+	case shadowReadSkipped:
+		om.Skipped++
+	}
+}
+
+// Snapshot returns the current metrics, keyed by operation name.
+func (m *ShadowReadMetrics) Snapshot() map[string]ShadowReadOpMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snap := make(map[string]ShadowReadOpMetrics, len(m.ops))
+	for op, om := range m.ops {
+		snap[op] = *om
+	}
+	return snap
+}
+
+// String returns a one-line summary of the metrics.
+func (m *ShadowReadMetrics) String() string {
+	snap := m.Snapshot()
+	ops := make([]string, 0, len(snap))
+	for op := range snap {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	var s string
+	for i, op := range ops {
+		if i > 0 {
+			s += ", "
+		}
+		om := snap[op]
+		s += fmt.Sprintf("%s: %d verified, %d mismatches (%d errors, %d skipped)", op, om.Verified, om.Mismatches, om.Errors, om.Skipped)
+	}
+	return s
+}
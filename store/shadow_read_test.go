@@ -0,0 +1,115 @@
+package store
+
+import (
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestShadowReadStore(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+	useIndexedStore = true
+
+	mrs := NewFSMultiRepoStore(newTestFS(), nil)
+	testSyncImport(t, mrs, "r", "c", "u1", "u2")
+	if err := mrs.(MultiRepoIndexer).Index("r", "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	var m ShadowReadMetrics
+	s := NewShadowReadStore(mrs, ShadowReadOptions{SampleRate: 1, Metrics: &m}).(*shadowReadStore)
+	stats := &QueryStats{}
+	defs, err := s.Defs(ByRepos("r"), ByUnits(unit.ID2{Type: "t", Name: "u1"}), ByDefPath("p"), stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 1 {
+		t.Errorf("got %d defs, want 1", len(defs))
+	}
+	if _, err := s.Refs(ByRepos("r"), ByFiles(true, "f"), RequireIndex()); err != nil {
+		t.Fatal(err)
+	}
+	s.wg.Wait()
+	if got := m.Snapshot(); got["Defs"].Verified != 1 || got["Refs"].Verified != 1 || got["Defs"].Mismatches+got["Refs"].Mismatches != 0 {
+		t.Errorf("got metrics %v, want 1 verified Defs and Refs query each", &m)
+	}
+
+	// Paged queries whose order isn't fully determined aren't
+	// verified.
+	if _, err := s.Refs(ByRepos("r"), Unordered(), First(1)); err != nil {
+		t.Fatal(err)
+	}
+	s.wg.Wait()
+	if got := m.Snapshot()["Refs"]; got.Verified != 1 {
+		t.Errorf("got Refs metrics %+v, want unordered paged query not verified", got)
+	}
+
+	// Mismatches are counted, and callers receive the indexed
+	// results.
+	m = ShadowReadMetrics{}
+	s = NewShadowReadStore(scanDroppingStore{mrs}, ShadowReadOptions{SampleRate: 1, Metrics: &m}).(*shadowReadStore)
+	defs, err = s.Defs(ByRepos("r"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 2 {
+		t.Errorf("got %d defs, want 2", len(defs))
+	}
+	if _, err := s.Refs(ByRepos("r")); err != nil {
+		t.Fatal(err)
+	}
+	s.wg.Wait()
+	if got := m.Snapshot(); got["Defs"].Mismatches != 1 || got["Refs"].Mismatches != 1 {
+		t.Errorf("got metrics %v, want 1 mismatched Defs and Refs query each", &m)
+	}
+
+	// Queries aren't verified if they aren't sampled or too many
+	// verifications are running.
+	m = ShadowReadMetrics{}
+	s = NewShadowReadStore(mrs, ShadowReadOptions{SampleRate: 0.5, MaxConcurrent: 1, Metrics: &m}).(*shadowReadStore)
+	s.sample = func() float64 { return 0.7 }
+	if _, err := s.Defs(ByRepos("r")); err != nil {
+		t.Fatal(err)
+	}
+	s.sample = func() float64 { return 0.2 }
+	s.running = 1
+	if _, err := s.Defs(ByRepos("r")); err != nil {
+		t.Fatal(err)
+	}
+	s.running = 0
+	s.wg.Wait()
+	if got := m.Snapshot()["Defs"]; got != (ShadowReadOpMetrics{Skipped: 1}) {
+		t.Errorf("got Defs metrics %+v, want 1 skipped query", got)
+	}
+
+	// A zero SampleRate verifies no queries.
+	m = ShadowReadMetrics{}
+	s = NewShadowReadStore(mrs, ShadowReadOptions{Metrics: &m}).(*shadowReadStore)
+	if _, err := s.Defs(ByRepos("r")); err != nil {
+		t.Fatal(err)
+	}
+	s.wg.Wait()
+	if got := m.Snapshot()["Defs"]; got != (ShadowReadOpMetrics{}) {
+		t.Errorf("got Defs metrics %+v with zero SampleRate, want none", got)
+	}
+}
+
+// scanDroppingStore omits the last result of each ForceScan query.
+type scanDroppingStore struct{ MultiRepoStore }
+
+func (s scanDroppingStore) Defs(f ...DefFilter) ([]*graph.Def, error) {
+	defs, err := s.MultiRepoStore.Defs(f...)
+	if isForceScan(f) && len(defs) > 0 {
+		defs = defs[:len(defs)-1]
+	}
+	return defs, err
+}
+
+func (s scanDroppingStore) Refs(f ...RefFilter) ([]*graph.Ref, error) {
+	refs, err := s.MultiRepoStore.Refs(f...)
+	if isForceScan(f) && len(refs) > 0 {
+		refs = refs[:len(refs)-1]
+	}
+	return refs, err
+}
@@ -0,0 +1,412 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kr/fs"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// A MultiRepoSharedDataGC removes the shared unit data files (see
+// FSMultiRepoStoreConf.ShareUnitData) that no tree refers to.
+type MultiRepoSharedDataGC interface {
+	// GCSharedData removes the shared data files of the repos that
+	// match the filters that are no longer linked into any of the
+	// repos' trees.
+	GCSharedData(f ...RepoFilter) (*SharedDataGCStats, error)
+}
+
+// SharedDataGCStats describes the result of a GCSharedData call.
+type SharedDataGCStats struct {
+	Files   int   // number of shared data files that are still referred to
+	Removed int   // number of unreferenced shared data files that were removed
+	Bytes   int64 // total size of the removed files
+}
+
+// errLinkNotSupported is returned when linking files on a filesystem
+// that can't link files.
+var errLinkNotSupported = errors.New("store filesystem does not support hard links (use NewHardLinkOSFS)")
+
+// A linkFS is a filesystem that can make a file available under a
+// second name that shares the original file's data, either as a hard
+// link or as a copy-on-write clone (reflink).
+//
+// The data of a linked file must never be modified in place (because
+// that would modify the other names' data, too), so its Create must
+// replace existing files instead of truncating them.
+type linkFS interface {
+	Link(oldname, newname string) error
+}
+
+// link links oldname to newname on fs (see linkFS).
+func link(fs rwvfs.FileSystem, oldname, newname string) error {
+	if fs, ok := fs.(linkFS); ok {
+		return fs.Link(oldname, newname)
+	}
+	return errLinkNotSupported
+}
+
+func (fs *throttledFS) Link(oldname, newname string) error {
+	if err := fs.begin("Link", newname, nil, ""); err != nil {
+		return err
+	}
+	defer fs.end()
+	return link(fs.fs, oldname, newname)
+}
+
+// Link implements linkFS. Each file's ciphertext is bound to its path
+// (see NewEncryptedFS), so the names can't share the encrypted data:
+// Link re-encrypts oldname's content for newname instead (so sharing
+// unit data saves no space in an encrypted store).
+func (fs *encryptedFS) Link(oldname, newname string) error { return copyFile(fs, oldname, newname) }
+
+func (fs *readCountingFS) Link(oldname, newname string) error {
+	return link(fs.FileSystem, oldname, newname)
+}
+
+func (fs *writeCountingFS) Link(oldname, newname string) error {
+	return link(fs.FileSystem, oldname, newname)
+}
+
+func (fs *writePolicyFS) Link(oldname, newname string) error {
+	if err := link(fs.FileSystem, oldname, newname); err != nil {
+		return err
+	}
+	if fs.sync == SyncImport {
+		fs.mu.Lock()
+		fs.unsynced[newname] = struct{}{}
+		fs.mu.Unlock()
+	}
+	return nil
+}
+
+// NewHardLinkOSFS returns a filesystem rooted at dir on the OS
+// filesystem that supports hard links, so that a store on it can
+// share identical unit data files between trees (see
+// FSMultiRepoStoreConf.ShareUnitData).
+//
+// Its Create replaces existing files (instead of truncating them), so
+// that rewriting a file never modifies the data of other links to it.
+func NewHardLinkOSFS(dir string) rwvfs.WalkableFileSystem {
+	return &hardLinkOSFS{FileSystem: rwvfs.OS(dir), dir: dir}
+}
+
+type hardLinkOSFS struct {
+	rwvfs.FileSystem
+	dir string
+}
+
+func (fs *hardLinkOSFS) resolve(name string) string {
+	return filepath.Join(fs.dir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (fs *hardLinkOSFS) Create(name string) (io.WriteCloser, error) {
+	if err := os.Remove(fs.resolve(name)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return fs.FileSystem.Create(name)
+}
+
+// Mkdir creates the dir's missing parent dirs, too, because the store
+// assumes that they are created implicitly (see setCreateParentDirs).
+func (fs *hardLinkOSFS) Mkdir(name string) error {
+	if err := os.MkdirAll(filepath.Dir(fs.resolve(name)), 0777); err != nil {
+		return err
+	}
+	return fs.FileSystem.Mkdir(name)
+}
+
+func (fs *hardLinkOSFS) Link(oldname, newname string) error {
+	return os.Link(fs.resolve(oldname), fs.resolve(newname))
+}
+
+func (fs *hardLinkOSFS) String() string { return "HardLinkOS(" + fs.dir + ")" }
+
+func (fs *hardLinkOSFS) CreateParentDirs(b bool) {
+	type createParents interface {
+		CreateParentDirs(bool)
+	}
+	if cfs, ok := fs.FileSystem.(createParents); ok {
+		cfs.CreateParentDirs(b)
+	}
+}
+
+// Join implements rwvfs.WalkableFileSystem.
+func (fs *hardLinkOSFS) Join(elem ...string) string { return path.Join(elem...) }
+
+var (
+	_ linkFS = (*hardLinkOSFS)(nil)
+	_ linkFS = (*throttledFS)(nil)
+	_ linkFS = (*encryptedFS)(nil)
+	_ linkFS = (*readCountingFS)(nil)
+	_ linkFS = (*writeCountingFS)(nil)
+	_ linkFS = (*writePolicyFS)(nil)
+)
+
+// sharedDataDir is the name of the dir (in a repo's dir) that holds
+// one link to each shared unit data file, named by the SHA-256 digest
+// of its content, and the sharedDataRefsFilename file.
+const sharedDataDir = "__shared"
+
+// sharedDataRefsFilename is the name of the file (in a repo's
+// sharedDataDir) that records which shared data file each linked tree
+// file refers to (as a JSON object mapping the tree file's path,
+// relative to the repo's dir, to the shared file's digest). A shared
+// file's reference count is the number of tree files that refer to
+// it.
+const sharedDataRefsFilename = "refs.json"
+
+// unitDataDir returns the path (relative to a tree's dir) of the dir
+// that holds a source unit's data files.
+func unitDataDir(u unit.ID2) string {
+	return strings.TrimSuffix((*fsTreeStore)(nil).unitFilename(u.Type, u.Name), unitFileSuffix)
+}
+
+func (s *fsMultiRepoStore) sharedDataPath(repo string, elem ...string) string {
+	return s.fs.Join(append([]string{s.repoPath(repo), sharedDataDir}, elem...)...)
+}
+
+func (s *fsMultiRepoStore) readSharedDataRefs(repo string) (map[string]string, error) {
+	f, err := s.fs.Open(s.sharedDataPath(repo, sharedDataRefsFilename))
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	refs := map[string]string{}
+	if err := json.NewDecoder(f).Decode(&refs); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+func (s *fsMultiRepoStore) writeSharedDataRefs(repo string, refs map[string]string) (err error) {
+	f, err := s.fs.Create(s.sharedDataPath(repo, sharedDataRefsFilename))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := f.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+	return json.NewEncoder(f).Encode(refs)
+}
+
+// shareUnitData replaces each of a source unit's data files in a tree
+// with a link to the identical shared data file (if one exists), or
+// else makes it the shared data file for its content, so that trees
+// (of the same repo) with identical unit data files store them only
+// once.
+func (s *fsMultiRepoStore) shareUnitData(repo, commitID string, u unit.ID2) error {
+	s.sharedDataMu.Lock()
+	defer s.sharedDataMu.Unlock()
+
+	refs, err := s.readSharedDataRefs(repo)
+	if err != nil {
+		return err
+	}
+	dir := path.Join(commitID, unitDataDir(u))
+	for file := range refs {
+		if strings.HasPrefix(file, dir+"/") {
+			delete(refs, file) // the unit's previous data
+		}
+	}
+	if err := rwvfs.MkdirAll(s.fs, s.sharedDataPath(repo)); err != nil {
+		return err
+	}
+
+	repoDir := s.repoPath(repo)
+	w := fs.WalkFS(s.fs.Join(repoDir, dir), s.fs)
+	for w.Step() {
+		if err := w.Err(); err != nil {
+			return err
+		}
+		if !w.Stat().Mode().IsRegular() {
+			continue
+		}
+		digest, err := s.fileDigest(w.Path())
+		if err != nil {
+			return err
+		}
+		shared := s.sharedDataPath(repo, digest)
+		if _, err := s.fs.Stat(shared); err == nil {
+			// The import is not visible until its version is created,
+			// so if linking fails after the file is removed, the
+			// import can be retried.
+			if err := s.fs.Remove(w.Path()); err != nil {
+				return err
+			}
+			if err := link(s.fs, shared, w.Path()); err != nil {
+				return err
+			}
+		} else if os.IsNotExist(err) {
+			if err := link(s.fs, w.Path(), shared); err != nil {
+				return err
+			}
+		} else {
+			return err
+		}
+		refs[strings.TrimPrefix(w.Path(), repoDir+"/")] = digest
+	}
+	return s.writeSharedDataRefs(repo, refs)
+}
+
+// fileDigest returns the hex-encoded SHA-256 digest of a file's
+// content.
+func (s *fsMultiRepoStore) fileDigest(name string) (string, error) {
+	f, err := s.fs.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// splitTreeFile splits the path of a file (relative to its repo's dir)
+// into the commit ID of its tree and its path in the tree.
+func splitTreeFile(file string) (commitID, treeFile string) {
+	if i := strings.Index(file, "/"); i != -1 {
+		return file[:i], file[i+1:]
+	}
+	return "", file
+}
+
+// unshareTree removes a tree's references to shared data files (e.g.,
+// because the tree is being removed). The shared files are removed by
+// the next GCSharedData call.
+func (s *fsMultiRepoStore) unshareTree(repo, commitID string) error {
+	return s.unshareDir(repo, commitID)
+}
+
+// unshareDir removes the references to shared data files of the
+// files under dir (relative to repo's dir). The shared files are
+// removed by the next GCSharedData call.
+func (s *fsMultiRepoStore) unshareDir(repo, dir string) error {
+	s.sharedDataMu.Lock()
+	defer s.sharedDataMu.Unlock()
+
+	refs, err := s.readSharedDataRefs(repo)
+	if err != nil {
+		return err
+	}
+	n := len(refs)
+	for file := range refs {
+		if strings.HasPrefix(file, dir+"/") {
+			delete(refs, file)
+		}
+	}
+	if len(refs) == n {
+		return nil
+	}
+	return s.writeSharedDataRefs(repo, refs)
+}
+
+func (s *fsMultiRepoStore) GCSharedData(f ...RepoFilter) (*SharedDataGCStats, error) {
+	repos, err := s.Repos(f...)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(repos)
+
+	s.sharedDataMu.Lock()
+	defer s.sharedDataMu.Unlock()
+	stats := &SharedDataGCStats{}
+	for _, repo := range repos {
+		if err := s.gcSharedData(repo, stats); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+func (s *fsMultiRepoStore) gcSharedData(repo string, stats *SharedDataGCStats) error {
+	entries, err := s.fs.ReadDir(s.sharedDataPath(repo))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	refs, err := s.readSharedDataRefs(repo)
+	if err != nil {
+		return err
+	}
+
+	// Drop the references of tree files that no longer exist (e.g.,
+	// because their unit's data was reimported without sharing). The
+	// trees' manifests are consulted (instead of stat'ing each file)
+	// when the trees have them.
+	manifests := map[string]*TreeManifest{} // commit ID -> manifest (nil if none)
+	treeManifest := func(commitID string) (*TreeManifest, error) {
+		if m, present := manifests[commitID]; present {
+			return m, nil
+		}
+		m, err := s.openRepoStore(repo).(RepoTreeManifests).TreeManifest(commitID)
+		if err != nil && err != ErrNoTreeManifest {
+			return nil, err
+		}
+		manifests[commitID] = m
+		return m, nil
+	}
+	referenced := map[string]struct{}{}
+	n := len(refs)
+	for file, digest := range refs {
+		var exists bool
+		commitID, treeFile := splitTreeFile(file)
+		m, err := treeManifest(commitID)
+		if err != nil {
+			return err
+		}
+		if m != nil {
+			exists = m.File(treeFile) != nil
+		} else if _, err := s.fs.Stat(s.fs.Join(s.repoPath(repo), file)); err == nil {
+			exists = true
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if !exists {
+			delete(refs, file)
+			continue
+		}
+		referenced[digest] = struct{}{}
+	}
+	if len(refs) != n {
+		if err := s.writeSharedDataRefs(repo, refs); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range entries {
+		if e.Name() == sharedDataRefsFilename {
+			continue
+		}
+		if _, present := referenced[e.Name()]; present {
+			stats.Files++
+			continue
+		}
+		if err := s.fs.Remove(s.sharedDataPath(repo, e.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		stats.Removed++
+		stats.Bytes += e.Size()
+	}
+	return nil
+}
+
+var _ MultiRepoSharedDataGC = (*fsMultiRepoStore)(nil)
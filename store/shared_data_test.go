@@ -0,0 +1,91 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestFSMultiRepoStore_ShareUnitData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srclib-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mrs := NewFSMultiRepoStore(NewHardLinkOSFS(dir), &FSMultiRepoStoreConf{ShareUnitData: true}).(*fsMultiRepoStore)
+
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
+	importTree := func(commitID, defName string) {
+		data := graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}, Name: defName}}}
+		if err := mrs.Import("r", commitID, u, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.CreateVersion("r", commitID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defsFile := func(commitID string) os.FileInfo {
+		fi, err := os.Stat(filepath.Join(dir, mrs.repoPath("r"), commitID, unitDataDir(u.ID2()), unitDefsFilename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi
+	}
+	checkDefName := func(commitID, want string) {
+		defs, err := mrs.Defs(ByRepoCommitIDs(Version{Repo: "r", CommitID: commitID}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(defs) != 1 || defs[0].Name != want {
+			t.Errorf("%s: got defs %v, want 1 def named %q", commitID, defs, want)
+		}
+	}
+
+	importTree("c1", "a")
+	importTree("c2", "a")
+	if !os.SameFile(defsFile("c1"), defsFile("c2")) {
+		t.Error("identical defs files are not shared")
+	}
+
+	// Reimporting a tree's unit doesn't modify the data of the trees
+	// that shared its files.
+	importTree("c2", "b")
+	if os.SameFile(defsFile("c1"), defsFile("c2")) {
+		t.Error("different defs files are shared")
+	}
+	checkDefName("c1", "a")
+	checkDefName("c2", "b")
+
+	// The shared files of c2's previous data that c1 doesn't share
+	// (e.g., indexes that aren't byte-identical) are removed, and the
+	// others are kept.
+	if _, err := mrs.GCSharedData(); err != nil {
+		t.Fatal(err)
+	}
+	checkDefName("c1", "a")
+	checkDefName("c2", "b")
+
+	if err := mrs.removeVersion("r", "c1"); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := mrs.GCSharedData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Removed == 0 || stats.Files == 0 {
+		t.Errorf("after removing tree: got %+v, want some shared files removed and some kept", stats)
+	}
+	checkDefName("c2", "b")
+}
+
+func TestFSMultiRepoStore_ShareUnitData_noLinks(t *testing.T) {
+	mrs := NewFSMultiRepoStore(newTestFS(), &FSMultiRepoStoreConf{ShareUnitData: true})
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
+	if err := mrs.Import("r", "c", u, graph.Output{}); err != errLinkNotSupported {
+		t.Errorf("got error %v, want %v", err, errLinkNotSupported)
+	}
+}
@@ -0,0 +1,286 @@
+package store
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kr/fs"
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+// A TreeSignature is a detached signature over a tree's content
+// digest. It allows consumers of a shared store to check that the
+// tree's data was produced by trusted build infrastructure and has not
+// been modified since.
+type TreeSignature struct {
+	// KeyID identifies the key that produced the signature. Verifiers
+	// use it to look up the corresponding public key.
+	KeyID string
+
+	// Digest is the tree content digest (see TreeSigning.TreeDigest)
+	// at the time the tree was signed.
+	Digest []byte
+
+	// Signature is the signature over Digest. For RSA keys, it is a
+	// PKCS #1 v1.5 signature; for ECDSA keys, it is an ASN.1-encoded
+	// (r, s) pair.
+	Signature []byte
+}
+
+// TrustedKeys maps key IDs to the public keys (*rsa.PublicKey or
+// *ecdsa.PublicKey) that are trusted to sign tree data.
+type TrustedKeys map[string]crypto.PublicKey
+
+var (
+	// ErrTreeNotSigned is returned by VerifyTree when the tree has no
+	// signature.
+	ErrTreeNotSigned = errors.New("tree is not signed")
+
+	// ErrUntrustedKey is returned by VerifyTree when the tree was
+	// signed with a key that is not trusted.
+	ErrUntrustedKey = errors.New("tree signed with untrusted key")
+
+	// ErrTreeModified is returned by VerifyTree when the tree's
+	// content no longer matches the digest that was signed.
+	ErrTreeModified = errors.New("tree content does not match signed digest")
+
+	// ErrBadSignature is returned by VerifyTree when the signature is
+	// not valid for the signed digest.
+	ErrBadSignature = errors.New("bad tree signature")
+)
+
+// A TreeSigning signs a tree's data and verifies signatures made by
+// SignTree.
+type TreeSigning interface {
+	// TreeDigest returns the SHA-256 digest of the tree's imported
+	// data (source units, defs, refs, and line tables). Indexes are
+	// not included, since they are derived from the imported data and
+	// may be rebuilt at any time.
+	TreeDigest() ([]byte, error)
+
+	// SignTree signs the tree's content digest with key and stores the
+	// signature alongside the tree's data. The key's Sign method is
+	// called with crypto.SHA256 as the signer options.
+	SignTree(keyID string, key crypto.Signer) error
+
+	// TreeSignature returns the tree's signature. If the tree is not
+	// signed, ErrTreeNotSigned is returned.
+	TreeSignature() (*TreeSignature, error)
+
+	// VerifyTree checks that the tree was signed by one of the
+	// trusted keys and that its content has not changed since.
+	//
+	// The tree's index files are not covered (see TreeDigest), so
+	// they may have been modified even if VerifyTree succeeds, and
+	// queries that use them could return records that aren't in the
+	// signed data (or omit ones that are). Callers that query the
+	// tree through its indexes must rebuild them (e.g., with
+	// BuildIndexes) after verifying it, before trusting the results
+	// (as "srclib store verify" does).
+	VerifyTree(keys TrustedKeys) error
+}
+
+// A RepoTreeSigning signs and verifies the data of a repo's trees.
+type RepoTreeSigning interface {
+	TreeDigest(commitID string) ([]byte, error)
+	SignTree(commitID, keyID string, key crypto.Signer) error
+	TreeSignature(commitID string) (*TreeSignature, error)
+	VerifyTree(commitID string, keys TrustedKeys) error
+}
+
+// A MultiRepoTreeSigning signs and verifies the data of trees in
+// multiple repos.
+type MultiRepoTreeSigning interface {
+	TreeDigest(repo, commitID string) ([]byte, error)
+	SignTree(repo, commitID, keyID string, key crypto.Signer) error
+	TreeSignature(repo, commitID string) (*TreeSignature, error)
+	VerifyTree(repo, commitID string, keys TrustedKeys) error
+}
+
+// treeSignatureFilename is the name of the file (in a tree's dir)
+// that holds the tree's signature.
+const treeSignatureFilename = "signature.json"
+
+// isTreeDigestFile reports whether the file at the given path (in a
+// tree's dir) is covered by the tree's content digest.
+func isTreeDigestFile(path string) bool {
+	return path != treeSignatureFilename && path != contentDigestFilename && path != treeManifestFilename && !strings.HasSuffix(path, ".idx")
+}
+
+func (s *fsTreeStore) TreeDigest() ([]byte, error) {
+	if _, err := s.fs.Stat("."); err != nil {
+		if os.IsNotExist(err) {
+			return nil, errTreeNoInit
+		}
+		return nil, err
+	}
+
+	var files []string
+	sizes := map[string]int64{}
+	w := fs.WalkFS(".", rwvfs.Walkable(s.fs))
+	for w.Step() {
+		if err := w.Err(); err != nil {
+			return nil, err
+		}
+		path := filepath.ToSlash(w.Path())
+		if fi := w.Stat(); fi.Mode().IsRegular() && isTreeDigestFile(path) {
+			files = append(files, path)
+			sizes[path] = fi.Size()
+		}
+	}
+	sort.Strings(files)
+
+	// Each file contributes its path and size (to make the encoding
+	// unambiguous) followed by its contents.
+	h := sha256.New()
+	for _, file := range files {
+		f, err := s.fs.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", file, sizes[file])
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+func (s *fsTreeStore) SignTree(keyID string, key crypto.Signer) error {
+	digest, err := s.TreeDigest()
+	if err != nil {
+		return err
+	}
+	sig, err := key.Sign(rand.Reader, digest, crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(&TreeSignature{KeyID: keyID, Digest: digest, Signature: sig})
+	if err != nil {
+		return err
+	}
+	f, err := s.fs.Create(treeSignatureFilename)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *fsTreeStore) TreeSignature() (*TreeSignature, error) {
+	f, err := s.fs.Open(treeSignatureFilename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrTreeNotSigned
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var sig TreeSignature
+	if err := json.NewDecoder(f).Decode(&sig); err != nil {
+		return nil, err
+	}
+	return &sig, nil
+}
+
+func (s *fsTreeStore) VerifyTree(keys TrustedKeys) error {
+	sig, err := s.TreeSignature()
+	if err != nil {
+		return err
+	}
+	pub, present := keys[sig.KeyID]
+	if !present {
+		return ErrUntrustedKey
+	}
+	if err := verifyDigestSignature(pub, sig.Digest, sig.Signature); err != nil {
+		return err
+	}
+	digest, err := s.TreeDigest()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(digest, sig.Digest) {
+		return ErrTreeModified
+	}
+	return nil
+}
+
+// verifyDigestSignature verifies a signature made by a crypto.Signer
+// (with crypto.SHA256 as the signer options) over digest.
+func verifyDigestSignature(pub crypto.PublicKey, digest, sig []byte) error {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig); err != nil {
+			return ErrBadSignature
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		var rs struct{ R, S *big.Int }
+		if rest, err := asn1.Unmarshal(sig, &rs); err != nil || len(rest) != 0 {
+			return ErrBadSignature
+		}
+		if !ecdsa.Verify(pub, digest, rs.R, rs.S) {
+			return ErrBadSignature
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+func (s *fsRepoStore) TreeDigest(commitID string) ([]byte, error) {
+	return s.newTreeStore(commitID).(TreeSigning).TreeDigest()
+}
+
+func (s *fsRepoStore) SignTree(commitID, keyID string, key crypto.Signer) error {
+	return s.newTreeStore(commitID).(TreeSigning).SignTree(keyID, key)
+}
+
+func (s *fsRepoStore) TreeSignature(commitID string) (*TreeSignature, error) {
+	return s.newTreeStore(commitID).(TreeSigning).TreeSignature()
+}
+
+func (s *fsRepoStore) VerifyTree(commitID string, keys TrustedKeys) error {
+	return s.newTreeStore(commitID).(TreeSigning).VerifyTree(keys)
+}
+
+func (s *fsMultiRepoStore) TreeDigest(repo, commitID string) ([]byte, error) {
+	return s.openRepoStore(repo).(RepoTreeSigning).TreeDigest(commitID)
+}
+
+func (s *fsMultiRepoStore) SignTree(repo, commitID, keyID string, key crypto.Signer) error {
+	return s.openRepoStore(repo).(RepoTreeSigning).SignTree(commitID, keyID, key)
+}
+
+func (s *fsMultiRepoStore) TreeSignature(repo, commitID string) (*TreeSignature, error) {
+	return s.openRepoStore(repo).(RepoTreeSigning).TreeSignature(commitID)
+}
+
+func (s *fsMultiRepoStore) VerifyTree(repo, commitID string, keys TrustedKeys) error {
+	return s.openRepoStore(repo).(RepoTreeSigning).VerifyTree(commitID, keys)
+}
+
+var (
+	_ TreeSigning          = (*fsTreeStore)(nil)
+	_ RepoTreeSigning      = (*fsRepoStore)(nil)
+	_ MultiRepoTreeSigning = (*fsMultiRepoStore)(nil)
+)
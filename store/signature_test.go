@@ -0,0 +1,69 @@
+package store
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestFSMultiRepoStore_SignTree(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for keyID, key := range map[string]crypto.Signer{"ec": ecKey, "rsa": rsaKey} {
+		mrs := NewFSMultiRepoStore(newTestFS(), nil)
+		signing := mrs.(MultiRepoTreeSigning)
+
+		if err := signing.SignTree("r", "c", keyID, key); err != errTreeNoInit {
+			t.Errorf("%s: SignTree before import: got error %v, want %v", keyID, err, errTreeNoInit)
+		}
+
+		u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
+		data := graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}, Name: "n"}}}
+		if err := mrs.Import("r", "c", u, data); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := signing.VerifyTree("r", "c", TrustedKeys{keyID: key.Public()}); err != ErrTreeNotSigned {
+			t.Errorf("%s: VerifyTree before signing: got error %v, want %v", keyID, err, ErrTreeNotSigned)
+		}
+		if err := signing.SignTree("r", "c", keyID, key); err != nil {
+			t.Fatal(err)
+		}
+
+		// Building indexes must not invalidate the signature.
+		if err := mrs.Index("r", "c"); err != nil {
+			t.Fatal(err)
+		}
+		if err := signing.VerifyTree("r", "c", TrustedKeys{keyID: key.Public()}); err != nil {
+			t.Errorf("%s: VerifyTree: %s", keyID, err)
+		}
+		if err := signing.VerifyTree("r", "c", TrustedKeys{"other": key.Public()}); err != ErrUntrustedKey {
+			t.Errorf("%s: VerifyTree with untrusted key: got error %v, want %v", keyID, err, ErrUntrustedKey)
+		}
+		otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err := signing.VerifyTree("r", "c", TrustedKeys{keyID: otherKey.Public()}); err == nil {
+			t.Errorf("%s: VerifyTree with wrong public key: got nil error", keyID)
+		}
+
+		data.Defs[0].Name = "n2"
+		if err := mrs.Import("r", "c", u, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := signing.VerifyTree("r", "c", TrustedKeys{keyID: key.Public()}); err != ErrTreeModified {
+			t.Errorf("%s: VerifyTree after modification: got error %v, want %v", keyID, err, ErrTreeModified)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// NewSingleflightStore returns a MultiRepoStore that performs queries
+// on s, except that concurrent identical queries share a single
+// execution: a query that arrives while an identical query is in
+// flight waits for that query and receives (copies of) its results.
+// This bounds the load of bursts of identical queries (e.g., many
+// clients requesting the same def's hover info).
+//
+// Queries are identical if they are of the same kind and their
+// filters are equal (ignoring order) and if no data was written to s
+// between their arrivals, so a query never receives the results of a
+// query that started before a write it follows. (Only writes made
+// through the store returned by NewFSMultiRepoStore, in this process,
+// are observed.) Queries with filters that can't be compared (such as
+// funcs and Limit filters), in/out filters (such as *QueryStats,
+// *ConditionalQuery, *QueryTrace, WithContext, and ByDefQueryMatches),
+// or *Arena filters are always executed.
+//
+// Each caller receives its own slice and its own shallow copies of the
+// results' structs. Fields that refer to other memory (such as
+// graph.Def's Data) are shared and must not be modified.
+//
+// The returned store only implements MultiRepoStore; other interfaces
+// that s implements (such as MultiRepoImporter) are hidden.
+func NewSingleflightStore(s MultiRepoStore) MultiRepoStore {
+	return &singleflightStore{s: s}
+}
+
+type singleflightStore struct {
+	s MultiRepoStore
+	g flightGroup
+}
+
+var _ MultiRepoStore = (*singleflightStore)(nil)
+
+// key returns the key that identifies the query, or false if the query
+// must not share its execution.
+func (s *singleflightStore) key(op string, filters interface{}) (string, bool) {
+	return queryKey(s.s, op, filters)
+}
+
+func (s *singleflightStore) Repos(f ...RepoFilter) ([]string, error) {
+	key, ok := s.key("Repos", f)
+	if !ok {
+		return s.s.Repos(f...)
+	}
+	v, shared, err := s.g.do(key, func() (interface{}, error) { return s.s.Repos(f...) })
+	repos, _ := v.([]string)
+	if shared && repos != nil {
+		repos = append([]string{}, repos...)
+	}
+	return repos, err
+}
+
+func (s *singleflightStore) Versions(f ...VersionFilter) ([]*Version, error) {
+	key, ok := s.key("Versions", f)
+	if !ok {
+		return s.s.Versions(f...)
+	}
+	v, shared, err := s.g.do(key, func() (interface{}, error) { return s.s.Versions(f...) })
+	versions, _ := v.([]*Version)
+	if shared && versions != nil {
+		cp := make([]*Version, len(versions))
+		for i, v := range versions {
+			v2 := *v
+			cp[i] = &v2
+		}
+		versions = cp
+	}
+	return versions, err
+}
+
+func (s *singleflightStore) Units(f ...UnitFilter) ([]*unit.SourceUnit, error) {
+	key, ok := s.key("Units", f)
+	if !ok {
+		return s.s.Units(f...)
+	}
+	v, shared, err := s.g.do(key, func() (interface{}, error) { return s.s.Units(f...) })
+	units, _ := v.([]*unit.SourceUnit)
+	if shared && units != nil {
+		cp := make([]*unit.SourceUnit, len(units))
+		for i, u := range units {
+			u2 := *u
+			cp[i] = &u2
+		}
+		units = cp
+	}
+	return units, err
+}
+
+func (s *singleflightStore) Defs(f ...DefFilter) ([]*graph.Def, error) {
+	key, ok := s.key("Defs", f)
+	if !ok {
+		return s.s.Defs(f...)
+	}
+	v, shared, err := s.g.do(key, func() (interface{}, error) { return s.s.Defs(f...) })
+	defs, _ := v.([]*graph.Def)
+	if shared && defs != nil {
+		cp := make([]*graph.Def, len(defs))
+		for i, def := range defs {
+			def2 := *def
+			cp[i] = &def2
+		}
+		defs = cp
+	}
+	return defs, err
+}
+
+func (s *singleflightStore) Refs(f ...RefFilter) ([]*graph.Ref, error) {
+	key, ok := s.key("Refs", f)
+	if !ok {
+		return s.s.Refs(f...)
+	}
+	v, shared, err := s.g.do(key, func() (interface{}, error) { return s.s.Refs(f...) })
+	refs, _ := v.([]*graph.Ref)
+	if shared && refs != nil {
+		cp := make([]*graph.Ref, len(refs))
+		for i, ref := range refs {
+			ref2 := *ref
+			cp[i] = &ref2
+		}
+		refs = cp
+	}
+	return refs, err
+}
+
+func (s *singleflightStore) generation() uint64 { return generationOf(s.s) }
+
+func (s *singleflightStore) String() string { return fmt.Sprintf("singleflight(%v)", s.s) }
+
+// A flightGroup executes calls, sharing the execution of concurrent
+// calls with the same key.
+type flightGroup struct {
+	mu sync.Mutex
+	m  map[string]*flight
+}
+
+// A flight is an in-flight (or completed) call.
+type flight struct {
+	wg      sync.WaitGroup
+	waiters int // number of calls waiting for this call (guarded by flightGroup.mu)
+	val     interface{}
+	err     error
+}
+
+// do calls fn and returns its results, unless a call with the same key
+// is in flight, in which case it waits for that call and returns its
+// results (and shared is true).
+func (g *flightGroup) do(key string, fn func() (interface{}, error)) (v interface{}, shared bool, err error) {
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = map[string]*flight{}
+	}
+	if c, present := g.m[key]; present {
+		c.waiters++
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, true, c.err
+	}
+	c := &flight{}
+	c.wg.Add(1)
+	g.m[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.m, key)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+	c.val, c.err = fn()
+	return c.val, false, c.err
+}
+
+// queryKey returns a key that identifies a query of kind op with the
+// given filters on s, or false if the query's filters can't be
+// compared (in which case it must not share its execution or results
+// with other queries). Keys include the write generation of s, so the
+// keys of identical queries differ if data was written to s between
+// them.
+func queryKey(s MultiRepoStore, op string, filters interface{}) (string, bool) {
+	fs := storeFilters(filters)
+	for _, f := range fs {
+		switch f.(type) {
+		case contextFilter, defStateFilter, recordObserver:
+			// In/out filters that are logged as (or like) other
+			// filters.
+			return "", false
+		}
+	}
+	lfs := queryLogFilters(fs)
+	if len(lfs) != len(fs) {
+		return "", false // in/out filters
+	}
+	parts := make([]string, len(lfs))
+	for i, lf := range lfs {
+		if lf.Name == "" || lf.filter() == nil {
+			return "", false // can't be compared
+		}
+		b, err := json.Marshal(lf)
+		if err != nil {
+			return "", false
+		}
+		parts[i] = string(b)
+	}
+	sort.Strings(parts)
+	return fmt.Sprintf("%s@%d:%s", op, generationOf(s), strings.Join(parts, ",")), true
+}
+
+// generationOf returns the write generation of s, which changes
+// whenever data is written to s, or 0 if s doesn't track writes.
+func generationOf(s interface{}) uint64 {
+	if s, ok := s.(interface {
+		generation() uint64
+	}); ok {
+		return s.generation()
+	}
+	return 0
+}
+
+func (s *fsMultiRepoStore) generation() uint64 { return atomic.LoadUint64(&s.gen) }
+
+// wrote records that data was written to the store. Writers defer it,
+// so that queries that arrive after a write completes don't share the
+// executions of queries that arrived before the write.
+func (s *fsMultiRepoStore) wrote() { atomic.AddUint64(&s.gen, 1) }
@@ -0,0 +1,117 @@
+package store
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+func TestSingleflightStore(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	mock := MockMultiRepoStore{
+		Defs_: func(...DefFilter) ([]*graph.Def, error) {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			return []*graph.Def{{DefKey: graph.DefKey{Path: "p"}}}, nil
+		},
+	}
+	s := NewSingleflightStore(mock).(*singleflightStore)
+
+	const n = 5
+	defs := make([][]*graph.Def, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			// The filters are equal, ignoring order.
+			if i%2 == 0 {
+				defs[i], err = s.Defs(ByRepos("r"), ByDefPath("p"))
+			} else {
+				defs[i], err = s.Defs(ByDefPath("p"), ByRepos("r"))
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	// Wait for all queries to be in flight.
+	for {
+		s.g.mu.Lock()
+		var waiters int
+		for _, c := range s.g.m {
+			waiters += c.waiters
+		}
+		s.g.mu.Unlock()
+		if waiters == n-1 {
+			break
+		}
+		runtime.Gosched()
+	}
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("got %d executions, want 1", calls)
+	}
+	for i, defs := range defs {
+		if len(defs) != 1 || defs[0].Path != "p" {
+			t.Errorf("query %d: got defs %+v, want [p]", i, defs)
+		}
+	}
+	// Each caller receives its own copies.
+	seen := map[*graph.Def]bool{}
+	for _, defs := range defs {
+		if len(defs) == 1 {
+			seen[defs[0]] = true
+		}
+	}
+	if len(seen) != n {
+		t.Errorf("got %d distinct result defs, want %d", len(seen), n)
+	}
+}
+
+func TestSingleflightStore_key(t *testing.T) {
+	fss := NewFSMultiRepoStore(newTestFS(), nil)
+	s := NewSingleflightStore(fss).(*singleflightStore)
+
+	k1, ok := s.key("Defs", []DefFilter{ByRepos("r"), ByDefPath("p")})
+	if !ok {
+		t.Fatal("ByRepos, ByDefPath: not deduplicated")
+	}
+	if k2, _ := s.key("Defs", []DefFilter{ByDefPath("p"), ByRepos("r")}); k2 != k1 {
+		t.Errorf("got different keys %q and %q for reordered filters", k1, k2)
+	}
+	kd, _ := s.key("Defs", []DefFilter{ByRepos("r")})
+	if kv, _ := s.key("Versions", []VersionFilter{ByRepos("r")}); kv == kd {
+		t.Errorf("got same key %q for Defs and Versions queries", kd)
+	}
+
+	// Queries that arrive after a write don't share the executions of
+	// queries that arrived before it.
+	testSyncImport(t, fss, "r", "c", "u")
+	if k2, _ := s.key("Defs", []DefFilter{ByRepos("r"), ByDefPath("p")}); k2 == k1 {
+		t.Errorf("got same key %q after import", k1)
+	}
+
+	for _, f := range []DefFilter{
+		&QueryStats{},
+		&QueryTrace{},
+		DefFilterFunc(func(*graph.Def) bool { return true }),
+		Limit(1, 0),
+		ByDefQueryMatches("q", &DefMatches{}),
+		WithContext(context.Background()),
+		newRawRecordsFilter(Codec),
+	} {
+		if _, ok := s.key("Defs", []DefFilter{ByRepos("r"), f}); ok {
+			t.Errorf("%v: got deduplicated, want always executed", f)
+		}
+	}
+}
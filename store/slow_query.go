@@ -0,0 +1,193 @@
+package store
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// QueryTrace records how a query was performed: the strategies that
+// the stores chose (e.g., which index was used, or whether the data
+// was scanned) and the time spent in each stage. To obtain the trace
+// of a query, pass a *QueryTrace as one of the query's filters; stores
+// fill it in as they perform the query. Like a *QueryStats, a
+// *QueryTrace implements all filter interfaces and selects everything.
+//
+// A QueryTrace is safe for concurrent use (stores query trees and
+// units concurrently).
+type QueryTrace struct {
+	mu sync.Mutex
+
+	// Strategies are the distinct strategies that the stores chose, in
+	// the order they were first chosen.
+	Strategies []string
+
+	// Stages are the query's stages, in the order they first
+	// occurred. A stage that occurred more than once (e.g., once per
+	// tree) is recorded once, with its total duration.
+	Stages []QueryStage
+}
+
+// A QueryStage is a stage of a query.
+type QueryStage struct {
+	Name     string
+	Duration time.Duration // total duration of all occurrences
+	Count    int           // number of occurrences
+}
+
+func (*QueryTrace) SelectDef(*graph.Def) bool        { return true }
+func (*QueryTrace) SelectRef(*graph.Ref) bool        { return true }
+func (*QueryTrace) SelectUnit(*unit.SourceUnit) bool { return true }
+func (*QueryTrace) SelectVersion(*Version) bool      { return true }
+func (*QueryTrace) SelectRepo(string) bool           { return true }
+func (t *QueryTrace) String() string                 { return "QueryTrace" }
+
+// queryTraceOf returns the *QueryTrace in filters, or nil if there is
+// none. The QueryTrace methods that stores call are no-ops on a nil
+// *QueryTrace.
+func queryTraceOf(filters interface{}) *QueryTrace {
+	for _, f := range storeFilters(filters) {
+		if t, ok := f.(*QueryTrace); ok {
+			return t
+		}
+	}
+	return nil
+}
+
+// strategy records that the named strategy was chosen.
+func (t *QueryTrace) strategy(name string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range t.Strategies {
+		if s == name {
+			return
+		}
+	}
+	t.Strategies = append(t.Strategies, name)
+}
+
+// stage records an occurrence of the named stage that started at
+// start and ended now. It is typically deferred:
+//
+//	defer queryTraceOf(fs).stage("open trees", time.Now())
+func (t *QueryTrace) stage(name string, start time.Time) {
+	if t == nil {
+		return
+	}
+	d := time.Since(start)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.Stages {
+		if t.Stages[i].Name == name {
+			t.Stages[i].Duration += d
+			t.Stages[i].Count++
+			return
+		}
+	}
+	t.Stages = append(t.Stages, QueryStage{Name: name, Duration: d, Count: 1})
+}
+
+// SlowQueryLogOptions configures slow-query logging (see
+// NewSlowQueryLoggingStore).
+type SlowQueryLogOptions struct {
+	// Threshold is the minimum duration of the queries that are
+	// logged.
+	Threshold time.Duration
+
+	// SampleRate is the fraction (between 0 and 1) of slow queries
+	// that are logged, to bound the logging overhead under load. If 0,
+	// all slow queries are logged.
+	SampleRate float64
+
+	// Sink receives the log entries of slow queries. Their Trace
+	// fields hold the strategies and per-stage timings of the queries.
+	Sink QueryLogSink
+}
+
+// NewSlowQueryLoggingStore returns a MultiRepoStore that performs
+// queries on s and logs the queries that exceed opt.Threshold (with
+// their filters, the strategies that the stores chose, and per-stage
+// timings) to opt.Sink. Unlike verbose (vlog) output, which logs every
+// step of every query, slow-query logging only records the queries
+// worth investigating, so it is suitable for production.
+//
+// The returned store only implements MultiRepoStore; other interfaces
+// that s implements (such as MultiRepoImporter) are hidden.
+func NewSlowQueryLoggingStore(s MultiRepoStore, opt SlowQueryLogOptions) MultiRepoStore {
+	return &slowQueryLoggingStore{s: s, opt: opt, clock: clockOf(s), sample: rand.Float64}
+}
+
+type slowQueryLoggingStore struct {
+	s      MultiRepoStore
+	opt    SlowQueryLogOptions
+	clock  Clock          // the clock of s (which times its queries)
+	sample func() float64 // returns a random number in [0, 1)
+}
+
+var _ MultiRepoStore = (*slowQueryLoggingStore)(nil)
+
+func (s *slowQueryLoggingStore) log(q queryStart, op string, filters interface{}, trace *QueryTrace, results int, err error) {
+	if s.clock.Now().Sub(q.time) < s.opt.Threshold {
+		return
+	}
+	if s.opt.SampleRate > 0 && s.opt.SampleRate < 1 && s.sample() >= s.opt.SampleRate {
+		return
+	}
+	e := q.end(nil, op, queryLogFilters(storeFilters(filters)), results, err)
+	e.Trace = trace
+	if err := s.opt.Sink.LogQuery(e); err != nil {
+		log.Printf("Warning: failed to log slow %s query: %s", op, err)
+	}
+}
+
+func (s *slowQueryLoggingStore) Repos(f ...RepoFilter) ([]string, error) {
+	t := &QueryTrace{}
+	q := beginQuery(s.clock, nil)
+	repos, err := s.s.Repos(append(f[:len(f):len(f)], t)...)
+	s.log(q, "Repos", f, t, len(repos), err)
+	return repos, err
+}
+
+func (s *slowQueryLoggingStore) Versions(f ...VersionFilter) ([]*Version, error) {
+	t := &QueryTrace{}
+	q := beginQuery(s.clock, nil)
+	versions, err := s.s.Versions(append(f[:len(f):len(f)], t)...)
+	s.log(q, "Versions", f, t, len(versions), err)
+	return versions, err
+}
+
+func (s *slowQueryLoggingStore) Units(f ...UnitFilter) ([]*unit.SourceUnit, error) {
+	t := &QueryTrace{}
+	q := beginQuery(s.clock, nil)
+	units, err := s.s.Units(append(f[:len(f):len(f)], t)...)
+	s.log(q, "Units", f, t, len(units), err)
+	return units, err
+}
+
+func (s *slowQueryLoggingStore) Defs(f ...DefFilter) ([]*graph.Def, error) {
+	t := &QueryTrace{}
+	q := beginQuery(s.clock, nil)
+	defs, err := s.s.Defs(append(f[:len(f):len(f)], t)...)
+	s.log(q, "Defs", f, t, len(defs), err)
+	return defs, err
+}
+
+func (s *slowQueryLoggingStore) Refs(f ...RefFilter) ([]*graph.Ref, error) {
+	t := &QueryTrace{}
+	q := beginQuery(s.clock, nil)
+	refs, err := s.s.Refs(append(f[:len(f):len(f)], t)...)
+	s.log(q, "Refs", f, t, len(refs), err)
+	return refs, err
+}
+
+func (s *slowQueryLoggingStore) generation() uint64 { return generationOf(s.s) }
+
+func (s *slowQueryLoggingStore) String() string { return fmt.Sprintf("slowQueryLogging(%v)", s.s) }
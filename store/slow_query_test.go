@@ -0,0 +1,98 @@
+package store
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+type querySinkFunc func(*QueryLogEntry) error
+
+func (f querySinkFunc) LogQuery(e *QueryLogEntry) error { return f(e) }
+
+func TestSlowQueryLoggingStore(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+	useIndexedStore = true
+
+	mrs := NewFSMultiRepoStore(newTestFS(), nil)
+	testSyncImport(t, mrs, "r", "c", "u1", "u2")
+	if err := mrs.(MultiRepoIndexer).Index("r", "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []*QueryLogEntry
+	sink := querySinkFunc(func(e *QueryLogEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+
+	s := NewSlowQueryLoggingStore(mrs, SlowQueryLogOptions{Sink: sink})
+	refs, err := s.Refs(ByRepoCommitIDs(Version{Repo: "r", CommitID: "c"}), ByUnits(unit.ID2{Type: "t", Name: "u1"}), ByFiles(true, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 2 {
+		t.Errorf("got %d refs, want 2", len(refs))
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d slow query log entries, want 1", len(entries))
+	}
+	e := entries[0]
+	if e.Op != "Refs" || e.Results != 2 || len(e.Filters) != 3 {
+		t.Errorf("got entry %+v, want Refs with 2 results and 3 filters", e)
+	}
+	if e.Trace == nil || len(e.Trace.Strategies) == 0 || len(e.Trace.Stages) == 0 {
+		t.Fatalf("got trace %+v, want strategies and stages", e.Trace)
+	}
+	var stages []string
+	for _, st := range e.Trace.Stages {
+		stages = append(stages, st.Name)
+	}
+	if !strings.Contains(strings.Join(stages, ","), "open units") {
+		t.Errorf("got stages %v, want to include open units", stages)
+	}
+
+	// Queries faster than the threshold aren't logged.
+	entries = nil
+	s = NewSlowQueryLoggingStore(mrs, SlowQueryLogOptions{Threshold: time.Hour, Sink: sink})
+	if _, err := s.Defs(); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("got %d entries for fast query, want 0", len(entries))
+	}
+}
+
+func TestSlowQueryLoggingStore_sampling(t *testing.T) {
+	mrs := NewFSMultiRepoStore(newTestFS(), nil)
+	testSyncImport(t, mrs, "r", "c", "u")
+
+	var buf bytes.Buffer
+	s := NewSlowQueryLoggingStore(mrs, SlowQueryLogOptions{SampleRate: 0.5, Sink: NewQueryLogWriter(&buf)}).(*slowQueryLoggingStore)
+	samples := []float64{0.1, 0.9, 0.4, 0.5}
+	s.sample = func() float64 {
+		v := samples[0]
+		samples = samples[1:]
+		return v
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := s.Units(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := ReadQueryLog(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("got %d sampled entries, want 2", len(entries))
+	}
+	for _, e := range entries {
+		if e.Trace == nil {
+			t.Error("entry has no trace")
+		}
+	}
+}
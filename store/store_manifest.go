@@ -0,0 +1,225 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/kr/fs"
+)
+
+// A StoreManifest records the settings of an FS-backed multi-repo
+// store that every process that opens the store must agree on. It is
+// written when data is first imported into the store.
+type StoreManifest struct {
+	// Codec is the name of the codec (see ParseCodec) that the
+	// store's data files are encoded with.
+	Codec string
+}
+
+// storeManifestFilename is the name of the file (in a multi-repo
+// store's VFS) that holds the store's manifest. It begins with a "."
+// so that it isn't listed as a repo.
+const storeManifestFilename = ".srclib-store.json"
+
+// A MultiRepoStoreManifester is a multi-repo store that records its
+// settings in a manifest.
+type MultiRepoStoreManifester interface {
+	// StoreManifest returns the store's manifest. It returns
+	// ErrNoStoreManifest if the store has none (because nothing was
+	// imported into it yet, or because it was created before stores
+	// had manifests).
+	StoreManifest() (*StoreManifest, error)
+}
+
+// ErrNoStoreManifest is returned by StoreManifest when the store has
+// no manifest.
+var ErrNoStoreManifest = errors.New("store has no manifest")
+
+var _ MultiRepoStoreManifester = (*fsMultiRepoStore)(nil)
+
+func (s *fsMultiRepoStore) StoreManifest() (*StoreManifest, error) {
+	m, err := s.readStoreManifest()
+	if err == nil && m == nil {
+		err = ErrNoStoreManifest
+	}
+	return m, err
+}
+
+// readStoreManifest returns the store's manifest, or nil if it has
+// none.
+func (s *fsMultiRepoStore) readStoreManifest() (*StoreManifest, error) {
+	f, err := s.fs.Open(storeManifestFilename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var m StoreManifest
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		return nil, fmt.Errorf("reading %s: %s", storeManifestFilename, err)
+	}
+	return &m, nil
+}
+
+func (s *fsMultiRepoStore) writeStoreManifest(m *StoreManifest) (err error) {
+	f, err := s.fs.Create(storeManifestFilename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := f.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+	return json.NewEncoder(f).Encode(m)
+}
+
+// settings returns the settings that the store passes down to its
+// repo stores. The store's codec is determined (see
+// FSMultiRepoStoreConf.Codec) when settings is first called, instead
+// of when the store is opened, so that opening a store does no I/O. If
+// the codec can't be determined, settings returns the error (and
+// settings whose codec fails with it), and tries again on the next
+// call.
+func (s *fsMultiRepoStore) settings() (fsStoreSettings, error) {
+	s.manifestMu.Lock()
+	defer s.manifestMu.Unlock()
+	if !s.codecKnown {
+		c, pending, err := s.storeCodec()
+		if err != nil {
+			return s.fsStoreSettings.withCodec(unknownCodec{err}), err
+		}
+		s.dataCodec, s.manifestPending, s.codecKnown = c, pending, true
+	}
+	return s.fsStoreSettings, nil
+}
+
+// codec implements codecStore.
+func (s *fsMultiRepoStore) codec() codec {
+	st, _ := s.settings()
+	return st.codec()
+}
+
+// storeCodec determines the codec of the store's data files. It
+// returns a nil codec if the store uses the package's Codec, and
+// whether the store's manifest must be written before data is
+// imported. The codec of a store that has data but no manifest is
+// detected from its data (see detectStoreCodec).
+func (s *fsMultiRepoStore) storeCodec() (c codec, pending bool, err error) {
+	c = s.confCodec
+	m, err := s.readStoreManifest()
+	if err != nil {
+		return nil, false, err
+	}
+	if m != nil {
+		mc, err := ParseCodec(m.Codec)
+		if err != nil {
+			return nil, false, fmt.Errorf("%s: %s", storeManifestFilename, err)
+		}
+		if c != nil && c != mc {
+			return nil, false, fmt.Errorf("store is encoded with codec %s, not %s (use MigrateCodec to change it)", m.Codec, codecName(c))
+		}
+		return mc, false, nil
+	}
+
+	if empty, err := s.isEmpty(); err != nil {
+		return nil, false, err
+	} else if empty {
+		// A new store records its codec (or Codec).
+		if c == nil {
+			c = Codec
+		}
+		return c, true, nil
+	}
+
+	// A store that already has data but no manifest was created
+	// before stores had manifests. Its codec is detected from its
+	// data and recorded when data is next imported.
+	dc, err := s.detectStoreCodec()
+	if err != nil {
+		return nil, false, err
+	}
+	if dc == nil {
+		// The store has no defs to detect the codec from, so it keeps
+		// using Codec (or records the codec it is opened with).
+		return c, c != nil, nil
+	}
+	if c != nil && c != dc {
+		return nil, false, fmt.Errorf("store is encoded with codec %s, not %s (use MigrateCodec to change it)", codecName(dc), codecName(c))
+	}
+	return dc, true, nil
+}
+
+// detectStoreCodec returns the codec of the first def data file in the
+// store, or nil if the store has none.
+//
+// A JSON record begins with its length as an 8-byte little-endian
+// integer, followed by the "{" that begins the JSON object. A protobuf
+// record begins with its length as a varint, so its first 8 bytes read
+// as a length that exceeds the file size.
+func (s *fsMultiRepoStore) detectStoreCodec() (codec, error) {
+	w := fs.WalkFS(".", s.fs)
+	for w.Step() {
+		if err := w.Err(); err != nil {
+			return nil, err
+		}
+		fi := w.Stat()
+		if fi.IsDir() && w.Path() != "." && path.Dir(w.Path()) == "." && strings.HasPrefix(fi.Name(), ".") {
+			w.SkipDir() // the store's own files (not a repo)
+			continue
+		}
+		if !fi.Mode().IsRegular() || fi.Name() != unitDefsFilename || fi.Size() == 0 {
+			continue
+		}
+
+		f, err := s.fs.Open(w.Path())
+		if err != nil {
+			return nil, err
+		}
+		var b [9]byte
+		n, err := io.ReadFull(f, b[:])
+		f.Close()
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		if n == len(b) && b[8] == '{' && binary.LittleEndian.Uint64(b[:8]) <= uint64(fi.Size()-8) {
+			return codecsByName["json"], nil
+		}
+		return codecsByName["protobuf"], nil
+	}
+	return nil, nil
+}
+
+// isEmpty reports whether the store's VFS has no files.
+func (s *fsMultiRepoStore) isEmpty() (bool, error) {
+	fis, err := s.fs.ReadDir(".")
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	return len(fis) == 0, err
+}
+
+// ensureStoreManifest writes the store's manifest if it wasn't
+// written yet. It is called before data is imported.
+func (s *fsMultiRepoStore) ensureStoreManifest() error {
+	if _, err := s.settings(); err != nil {
+		return err
+	}
+	s.manifestMu.Lock()
+	defer s.manifestMu.Unlock()
+	if !s.manifestPending {
+		return nil
+	}
+	if err := s.writeStoreManifest(&StoreManifest{Codec: codecName(s.dataCodec)}); err != nil {
+		return err
+	}
+	s.manifestPending = false
+	return nil
+}
@@ -0,0 +1,190 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+
+	"golang.org/x/tools/godoc/vfs"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestStoreManifest_codec(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+	defer func(c codec) { Codec = c }(Codec)
+	Codec = ProtobufCodec{}
+
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}, Info: unit.Info{Files: []string{"f"}}}
+	data := graph.Output{
+		Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}, Name: "n", File: "f"}},
+		Refs: []*graph.Ref{{DefPath: "p", File: "f", Start: 1, End: 2}},
+	}
+	open := func(fs rwvfs.WalkableFileSystem, codec string) MultiRepoStoreImporterIndexer {
+		return NewFSMultiRepoStore(fs, &FSMultiRepoStoreConf{Codec: codec})
+	}
+	checkDefs := func(label string, mrs MultiRepoStore, n int) {
+		defs, err := mrs.Defs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(defs) != n {
+			t.Errorf("%s: got %d defs, want %d", label, len(defs), n)
+		}
+		for _, def := range defs {
+			if def.Name != "n" {
+				t.Errorf("%s: got def %+v, want the imported def", label, def)
+			}
+		}
+	}
+	importTree := func(mrs MultiRepoStoreImporterIndexer, commitID string) {
+		if err := mrs.Import("r", commitID, u, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.Index("r", commitID); err != nil {
+			t.Fatal(err)
+		}
+		if err := mrs.CreateVersion("r", commitID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest := func(mrs MultiRepoStore) *StoreManifest {
+		m, err := mrs.(MultiRepoStoreManifester).StoreManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	for _, indexed := range []bool{false, true} {
+		useIndexedStore = indexed
+
+		// A new store records its codec, and is read with it even if
+		// it is opened without Codec.
+		fs := newTestFS()
+		mrs := open(fs, "json")
+		if _, err := mrs.(MultiRepoStoreManifester).StoreManifest(); err != ErrNoStoreManifest {
+			t.Errorf("indexed=%v: before import, got StoreManifest error %v, want ErrNoStoreManifest", indexed, err)
+		}
+		importTree(mrs, "c")
+		if want := (&StoreManifest{Codec: "json"}); !reflect.DeepEqual(manifest(mrs), want) {
+			t.Errorf("indexed=%v: got manifest %+v, want %+v", indexed, manifest(mrs), want)
+		}
+		if repos, err := mrs.Repos(); err != nil {
+			t.Fatal(err)
+		} else if want := []string{"r"}; !reflect.DeepEqual(repos, want) {
+			t.Errorf("indexed=%v: got repos %v, want %v (the manifest isn't a repo)", indexed, repos, want)
+		}
+		checkDefs("json store", open(fs, ""), 1)
+		checkWrongCodec := func(label string, mrs MultiRepoStoreImporterIndexer) {
+			if _, err := mrs.Defs(); err == nil {
+				t.Errorf("indexed=%v: %s: Defs with protobuf codec: got nil error", indexed, label)
+			}
+			if err := mrs.Import("r", "c3", u, data); err == nil {
+				t.Errorf("indexed=%v: %s: Import with protobuf codec: got nil error", indexed, label)
+			}
+		}
+		checkWrongCodec("json store", open(fs, "protobuf"))
+
+		// The codec of a store without a manifest (created before
+		// stores had manifests) is detected from its data, and
+		// recorded when data is next imported.
+		if err := fs.Remove(storeManifestFilename); err != nil {
+			t.Fatal(err)
+		}
+		checkWrongCodec("legacy json store", open(fs, "protobuf"))
+		mrs = open(fs, "")
+		checkDefs("legacy json store", mrs, 1)
+		if _, err := mrs.(MultiRepoStoreManifester).StoreManifest(); err != ErrNoStoreManifest {
+			t.Errorf("indexed=%v: legacy store: before import, got StoreManifest error %v, want ErrNoStoreManifest (the store must not be written when it's opened or queried)", indexed, err)
+		}
+		importTree(mrs, "c2")
+		if want := (&StoreManifest{Codec: "json"}); !reflect.DeepEqual(manifest(mrs), want) {
+			t.Errorf("indexed=%v: legacy store: got manifest %+v, want %+v", indexed, manifest(mrs), want)
+		}
+		checkDefs("legacy json store after import", open(fs, ""), 2)
+
+		// The same for a legacy protobuf store, even if Codec is json.
+		pfs := newTestFS()
+		importTree(open(pfs, "protobuf"), "c")
+		if err := pfs.Remove(storeManifestFilename); err != nil {
+			t.Fatal(err)
+		}
+		Codec = JSONCodec{}
+		mrs = open(pfs, "")
+		checkDefs("legacy protobuf store", mrs, 1)
+		importTree(mrs, "c2")
+		Codec = ProtobufCodec{}
+		if want := (&StoreManifest{Codec: "protobuf"}); !reflect.DeepEqual(manifest(mrs), want) {
+			t.Errorf("indexed=%v: legacy protobuf store: got manifest %+v, want %+v", indexed, manifest(mrs), want)
+		}
+
+		// A new store opened without Codec records Codec.
+		mrs = open(newTestFS(), "")
+		importTree(mrs, "c")
+		if want := (&StoreManifest{Codec: "protobuf"}); !reflect.DeepEqual(manifest(mrs), want) {
+			t.Errorf("indexed=%v: got manifest %+v, want %+v", indexed, manifest(mrs), want)
+		}
+	}
+}
+
+// opCountingFS counts the operations on a filesystem, and fails opens
+// if err is set.
+type opCountingFS struct {
+	rwvfs.WalkableFileSystem
+	ops int
+	err error
+}
+
+func (fs *opCountingFS) Open(name string) (vfs.ReadSeekCloser, error) {
+	fs.ops++
+	if fs.err != nil {
+		return nil, fs.err
+	}
+	return fs.WalkableFileSystem.Open(name)
+}
+
+func (fs *opCountingFS) ReadDir(name string) ([]os.FileInfo, error) {
+	fs.ops++
+	return fs.WalkableFileSystem.ReadDir(name)
+}
+
+func (fs *opCountingFS) Create(name string) (io.WriteCloser, error) {
+	fs.ops++
+	return fs.WalkableFileSystem.Create(name)
+}
+
+func TestStoreManifest_lazy(t *testing.T) {
+	fs := &opCountingFS{WalkableFileSystem: newTestFS()}
+	testSyncImport(t, NewFSMultiRepoStore(fs, nil), "r", "c", "u")
+	if err := fs.Remove(storeManifestFilename); err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening a store reads and writes nothing.
+	fs.ops = 0
+	mrs, err := OpenFSMultiRepoStore(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs.ops != 0 {
+		t.Errorf("got %d filesystem operations when opening the store, want 0", fs.ops)
+	}
+
+	// The codec is determined when it is first needed, and I/O
+	// errors are returned (and the next query tries again).
+	fs.err = errors.New("test I/O error")
+	if _, err := mrs.Defs(); err != fs.err {
+		t.Errorf("got Defs error %v, want %v", err, fs.err)
+	}
+	fs.err = nil
+	if defs, err := mrs.Defs(); err != nil {
+		t.Fatal(err)
+	} else if len(defs) != 1 {
+		t.Errorf("got %d defs, want 1", len(defs))
+	}
+}
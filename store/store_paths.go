@@ -0,0 +1,244 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+// Source unit names and types are used as paths in the FS store
+// layout (see fsTreeStore.unitFilename), but they are arbitrary
+// strings that may be platform paths. On Windows, unit names such as
+// `C:\src\foo` contain drive letters and backslashes, which either
+// are not valid in a file name or are interpreted as path separators
+// by the underlying VFS. And any unit name with "", ".", or ".."
+// components (e.g., "/abs" or "../x") is silently altered by
+// path.Join.
+//
+// encodeStorePath maps such a string to a slash-separated store path
+// whose components are safe on all platforms, and decodeStorePath
+// recovers the original string. Store paths of ordinary unit names
+// (e.g., Go import paths) are the same as the names themselves. Units
+// whose names or types were stored verbatim by older versions are
+// still read from there (see legacyUnitFilename) until they are
+// reimported.
+//
+// Components that are too long for common filesystems (after
+// escaping) are replaced by a hash of their contents. Hashing is not
+// reversible, so the original component is written to a sidecar name
+// file next to the hashed component (see writeStorePathNames), and
+// decodeStorePath reads it from there.
+
+// storePathEscapeChars are the bytes that are always escaped (as
+// "%XX") in store path components. '%' is the escape character
+// itself, '\\' is the Windows path separator, ':' is used in Windows
+// drive letters (and alternate data streams), and the rest are not
+// allowed in Windows file names (and are glob metacharacters on other
+// systems).
+const storePathEscapeChars = `%\:*?"<>|`
+
+// maxStorePathComponentLen is the max length of an encoded store path
+// component. Longer components are hashed. It leaves room for file
+// suffixes (such as unitFileSuffix) within the 255-byte file name
+// limit of most filesystems.
+const maxStorePathComponentLen = 200
+
+// hashedStorePathPrefix is the prefix of hashed store path components.
+// It can't be produced by escaping any other component (see
+// emptyStorePathComponent).
+const hashedStorePathPrefix = "%h"
+
+// storePathNameFileSuffix is appended to a hashed store path component
+// to form the name of its sidecar name file, which contains the
+// original (unencoded) component.
+const storePathNameFileSuffix = ".name"
+
+// emptyStorePathComponent is the encoded form of an empty path
+// component (e.g., the first component of "/abs"). It can't be
+// produced by escaping any other component, because a literal '%' is
+// always escaped.
+const emptyStorePathComponent = "%"
+
+// encodeStorePath encodes p, a unit name, as a slash-separated store
+// path. Each "/"-separated component of p is encoded with
+// encodeStorePathComponent. As a special case, "." (the name of many
+// root source units) is not escaped, because it has always referred to
+// the tree's root dir.
+func encodeStorePath(p string) string {
+	if p == "." {
+		return p
+	}
+	comps := strings.Split(p, "/")
+	for i, c := range comps {
+		comps[i] = encodeStorePathComponent(c)
+	}
+	return strings.Join(comps, "/")
+}
+
+// encodeStorePathComponent escapes the bytes in
+// storePathEscapeChars, '/', control characters, and trailing dots
+// and spaces (which Windows strips from file names, and which include
+// the special components "." and ".."). An empty component is encoded
+// as emptyStorePathComponent. It is used directly for strings that
+// must be stored as a single path component (such as unit types).
+// Components that are longer than maxStorePathComponentLen when
+// encoded are hashed.
+func encodeStorePathComponent(c string) string {
+	if c == "" {
+		return emptyStorePathComponent
+	}
+	if enc := escapeStorePathComponent(c); len(enc) <= maxStorePathComponentLen {
+		return enc
+	}
+	sum := sha256.Sum256([]byte(c))
+	return hashedStorePathPrefix + hex.EncodeToString(sum[:20])
+}
+
+func escapeStorePathComponent(c string) string {
+	// Trailing dots and spaces are escaped, so find where they start.
+	trailing := len(c)
+	for trailing > 0 && (c[trailing-1] == '.' || c[trailing-1] == ' ') {
+		trailing--
+	}
+
+	var buf bytes.Buffer
+	for i := 0; i < len(c); i++ {
+		b := c[i]
+		if i >= trailing || b == '/' || b < 0x20 || b == 0x7F || strings.IndexByte(storePathEscapeChars, b) != -1 {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		} else {
+			buf.WriteByte(b)
+		}
+	}
+	return buf.String()
+}
+
+// isHashedStorePathComponent reports whether c is a hashed store path
+// component.
+func isHashedStorePathComponent(c string) bool {
+	return strings.HasPrefix(c, hashedStorePathPrefix)
+}
+
+// writeStorePathNames writes the sidecar name files for the hashed
+// components of encodeStorePath(p) in fs. The dirs that contain the
+// hashed components must already exist.
+func writeStorePathNames(fs rwvfs.FileSystem, p string) error {
+	if p == "." {
+		return nil
+	}
+	dir := "."
+	for _, c := range strings.Split(p, "/") {
+		enc := encodeStorePathComponent(c)
+		if err := writeStorePathName(fs, dir, c, enc); err != nil {
+			return err
+		}
+		dir = path.Join(dir, enc)
+	}
+	return nil
+}
+
+// writeStorePathName writes the sidecar name file for the store path
+// component enc (the encoded form of c) in dir, if enc is hashed.
+func writeStorePathName(fs rwvfs.FileSystem, dir, c, enc string) (err error) {
+	if !isHashedStorePathComponent(enc) {
+		return nil
+	}
+	f, err := fs.Create(path.Join(dir, enc+storePathNameFileSuffix))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err2 := f.Close()
+		if err == nil {
+			err = err2
+		}
+	}()
+	_, err = f.Write([]byte(c))
+	return err
+}
+
+// decodeStorePath is the inverse of encodeStorePath. The sidecar name
+// files of hashed components are read from fs. It returns an error if
+// p contains an invalid escape sequence.
+func decodeStorePath(fs rwvfs.FileSystem, p string) (string, error) {
+	if p == "." {
+		return p, nil
+	}
+	comps := strings.Split(p, "/")
+	dir := "."
+	for i, enc := range comps {
+		var err error
+		comps[i], err = readStorePathComponent(fs, dir, enc)
+		if err != nil {
+			return "", fmt.Errorf("invalid store path %q: %s", p, err)
+		}
+		dir = path.Join(dir, enc)
+	}
+	return strings.Join(comps, "/"), nil
+}
+
+// readStorePathComponent decodes the store path component enc in dir,
+// reading its sidecar name file from fs if it is hashed.
+func readStorePathComponent(fs rwvfs.FileSystem, dir, enc string) (string, error) {
+	if !isHashedStorePathComponent(enc) {
+		return decodeStorePathComponent(enc)
+	}
+	f, err := fs.Open(path.Join(dir, enc+storePathNameFileSuffix))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	c, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	if encodeStorePathComponent(string(c)) != enc {
+		return "", fmt.Errorf("name file for hashed component %q has mismatched contents", enc)
+	}
+	return string(c), nil
+}
+
+func decodeStorePathComponent(c string) (string, error) {
+	if c == emptyStorePathComponent {
+		return "", nil
+	}
+	if strings.IndexByte(c, '%') == -1 {
+		return c, nil
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(c); i++ {
+		if c[i] != '%' {
+			buf.WriteByte(c[i])
+			continue
+		}
+		if i+2 >= len(c) {
+			return "", fmt.Errorf("truncated escape sequence %q", c[i:])
+		}
+		hi, ok1 := unhex(c[i+1])
+		lo, ok2 := unhex(c[i+2])
+		if !ok1 || !ok2 {
+			return "", fmt.Errorf("invalid escape sequence %q", c[i:i+3])
+		}
+		buf.WriteByte(hi<<4 | lo)
+		i += 2
+	}
+	return buf.String(), nil
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
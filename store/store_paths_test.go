@@ -0,0 +1,230 @@
+package store
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestEncodeStorePath(t *testing.T) {
+	tests := map[string]string{
+		".":                  ".",
+		"a/b":                "a/b",
+		"github.com/x/y":     "github.com/x/y",
+		`C:\src\foo`:         "C%3A%5Csrc%5Cfoo",
+		`\\server\share\pkg`: "%5C%5Cserver%5Cshare%5Cpkg",
+		"C:/src/foo":         "C%3A/src/foo",
+		"/abs/path":          "%/abs/path",
+		"a//b/":              "a/%/b/%",
+		"../x":               "%2E%2E/x",
+		"a/./b":              "a/%2E/b",
+		`..\x`:               "..%5Cx",
+		"a%2Fb":              "a%252Fb",
+		"trailing. /dot.":    "trailing%2E%20/dot%2E",
+		"ctl\x00\n":          "ctl%00%0A",
+		"unicode/é/世界":       "unicode/é/世界",
+		"":                   "%",
+		`a*b?/"c"/<d>|e`:     "a%2Ab%3F/%22c%22/%3Cd%3E%7Ce",
+	}
+	for p, want := range tests {
+		enc := encodeStorePath(p)
+		if enc != want {
+			t.Errorf("%q: got encoded %q, want %q", p, enc, want)
+		}
+		dec, err := decodeStorePath(nil, enc)
+		if err != nil {
+			t.Errorf("%q: decode %q: %s", p, enc, err)
+			continue
+		}
+		if dec != p {
+			t.Errorf("%q: got decoded %q", p, dec)
+		}
+	}
+
+	for _, bad := range []string{"a/%2", "%zz", "a%G0", "%%"} {
+		if _, err := decodeStorePath(nil, bad); err == nil {
+			t.Errorf("%q: got no decode error", bad)
+		}
+	}
+}
+
+func TestFSTreeStore_windowsUnitNames(t *testing.T) {
+	names := []string{
+		`C:\src\foo`, `C:\src\foo\bar`, "C:/src/foo", `..\x`, "../y", "/abs", ".",
+		"a*b", `x/y<z>|"?"`,
+		strings.Repeat("long/", 3) + strings.Repeat("n", 300),
+		strings.Repeat("m", 300) + "/" + strings.Repeat("n", 300),
+	}
+	ts := newFSTreeStore(newTestFS(), fsStoreSettings{})
+	for _, name := range names {
+		u := &unit.SourceUnit{Key: unit.Key{Type: `t:\`, Name: name}}
+		data := graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}, Name: name}}}
+		if err := ts.Import(u, data); err != nil {
+			t.Fatalf("%q: Import: %s", name, err)
+		}
+		if strings.Contains(ts.unitFilename(u.Type, u.Name), `\`) {
+			t.Errorf("%q: unit filename %q contains a backslash", name, ts.unitFilename(u.Type, u.Name))
+		}
+	}
+
+	units, err := ts.Units()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(units) != len(names) {
+		t.Errorf("Units: got %d units, want %d", len(units), len(names))
+	}
+
+	defs, err := ts.Defs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotUnits []string
+	for _, def := range defs {
+		if def.UnitType != `t:\` || def.Unit != def.Name {
+			t.Errorf("got def in unit %q %q, want unit %q %q", def.UnitType, def.Unit, `t:\`, def.Name)
+		}
+		gotUnits = append(gotUnits, def.Unit)
+	}
+	sort.Strings(gotUnits)
+	sort.Strings(names)
+	if strings.Join(gotUnits, "\n") != strings.Join(names, "\n") {
+		t.Errorf("Defs: got units %q, want %q", gotUnits, names)
+	}
+
+	for _, name := range names {
+		defs, err := ts.Defs(ByUnits(unit.ID2{Type: `t:\`, Name: name}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(defs) != 1 || defs[0].Unit != name {
+			t.Errorf("Defs(ByUnits(%q)): got %v, want 1 def", name, defs)
+		}
+	}
+}
+
+func TestEncodeStorePath_long(t *testing.T) {
+	long := strings.Repeat("x", maxStorePathComponentLen+1)
+	enc := encodeStorePath("a/" + long)
+	if !strings.HasPrefix(enc, "a/"+hashedStorePathPrefix) || len(enc) > maxStorePathComponentLen {
+		t.Fatalf("got encoded %q, want hashed component", enc)
+	}
+	if enc2 := encodeStorePath("a/" + long + "y"); enc2 == enc {
+		t.Errorf("different long components have the same encoding %q", enc)
+	}
+
+	fs := newTestFS()
+	if _, err := decodeStorePath(fs, enc); err == nil {
+		t.Error("got no error decoding hashed component without a name file")
+	}
+	if err := rwvfs.MkdirAll(fs, enc); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeStorePathNames(fs, "a/"+long); err != nil {
+		t.Fatal(err)
+	}
+	if dec, err := decodeStorePath(fs, enc); err != nil {
+		t.Fatal(err)
+	} else if dec != "a/"+long {
+		t.Errorf("got decoded %q, want %q", dec, "a/"+long)
+	}
+}
+
+func TestFSTreeStore_longUnitType(t *testing.T) {
+	ts := newFSTreeStore(newTestFS(), fsStoreSettings{})
+	u := unit.ID2{Type: strings.Repeat("t", 300), Name: "u"}
+	data := graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}}}}
+	if err := ts.Import(&unit.SourceUnit{Key: unit.Key{Type: u.Type, Name: u.Name}}, data); err != nil {
+		t.Fatal(err)
+	}
+	defs, err := ts.Defs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 1 || defs[0].UnitType != u.Type || defs[0].Unit != u.Name {
+		t.Errorf("got defs %v, want 1 def in unit %v", defs, u)
+	}
+}
+
+func TestFSTreeStore_legacyUnitFilenames(t *testing.T) {
+	fs := newTestFS()
+	ts := newFSTreeStore(fs, fsStoreSettings{})
+	names := []string{"C:/src/foo", "a%41", "trailing. ", strings.Repeat("n", maxStorePathComponentLen+1)}
+	for _, name := range names {
+		// Write the unit at the filename it had before unit names and
+		// types were encoded.
+		u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: name}}
+		filename := legacyUnitFilename(u.Type, u.Name)
+		if filename == "" {
+			t.Fatalf("%q: got no legacy filename", name)
+		}
+		dir := strings.TrimSuffix(filename, unitFileSuffix)
+		if err := rwvfs.MkdirAll(fs, dir); err != nil {
+			t.Fatal(err)
+		}
+		f, err := fs.Create(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ts.codec().NewEncoder(f).Encode(u); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		us := &fsUnitStore{fs: rwvfs.Sub(fs, dir), fsStoreSettings: ts.fsStoreSettings}
+		if err := us.Import(graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}, Name: name}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkUnits := func(label string) {
+		units, err := ts.Units()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(units) != len(names) {
+			t.Errorf("%s: Units: got %d units, want %d", label, len(units), len(names))
+		}
+		defs, err := ts.Defs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(defs) != len(names) {
+			t.Errorf("%s: Defs: got %d defs, want %d", label, len(defs), len(names))
+		}
+		for _, name := range names {
+			u := unit.ID2{Type: "t", Name: name}
+			units, err := ts.Units(ByUnits(u))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(units) != 1 || units[0].Name != name {
+				t.Errorf("%s: Units(ByUnits(%q)): got %v, want 1 unit", label, name, units)
+			}
+			defs, err := ts.Defs(ByUnits(u))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(defs) != 1 || defs[0].Unit != name {
+				t.Errorf("%s: Defs(ByUnits(%q)): got %v, want 1 def", label, name, defs)
+			}
+		}
+	}
+	checkUnits("legacy")
+
+	// Reimporting a unit moves it to its encoded filename.
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: names[0]}}
+	if err := ts.Import(u, graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}, Name: names[0]}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(legacyUnitFilename(u.Type, u.Name)); !os.IsNotExist(err) {
+		t.Errorf("after reimport: got legacy unit file stat error %v, want it to be removed", err)
+	}
+	checkUnits("after reimport")
+}
@@ -0,0 +1,58 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// StrictDefKeys is whether malformed def keys (see
+// graph.ValidateDefKey and graph.ValidateRefDefKey) are rejected. When
+// it is set, imports into multi-repo stores fail before any data is
+// written if any def's key or any ref's target def key is malformed,
+// and NewByDefKeyFilter, NewByRefDefFilter, and NewByDefPathFilter
+// return an error for malformed keys and def paths. It defaults to
+// the value of the STRICTDEFKEYS environment variable.
+var StrictDefKeys, _ = strconv.ParseBool(os.Getenv("STRICTDEFKEYS"))
+
+// A MalformedDefKeyError is returned by imports (when StrictDefKeys is
+// set) if a def or ref in the imported data has a malformed def key.
+type MalformedDefKeyError struct {
+	Unit  unit.ID2 // the source unit being imported
+	Kind  string   // "def" or "ref"
+	Index int      // the index of the def or ref in the imported data
+	Key   string   // the (formatted) malformed key
+	Err   *graph.InvalidDefKeyError
+}
+
+func (e *MalformedDefKeyError) Error() string {
+	return fmt.Sprintf("source unit %s %s: %s %d (%s) has a malformed def key: %s", e.Unit.Type, e.Unit.Name, e.Kind, e.Index, e.Key, e.Err)
+}
+
+// checkImportDefKeys returns a *MalformedDefKeyError for the first def
+// or ref in data with a malformed def key, if StrictDefKeys is set. It
+// must be called before cleanForImport, which clears some of the
+// fields it checks.
+func checkImportDefKeys(u *unit.SourceUnit, data *graph.Output) error {
+	if !StrictDefKeys {
+		return nil
+	}
+	var uid unit.ID2
+	if u != nil {
+		uid = u.ID2()
+	}
+	for i, def := range data.Defs {
+		if err := graph.ValidateDefKey(def.DefKey); err != nil {
+			return &MalformedDefKeyError{Unit: uid, Kind: "def", Index: i, Key: fmt.Sprintf("%+v", def.DefKey), Err: err.(*graph.InvalidDefKeyError)}
+		}
+	}
+	for i, ref := range data.Refs {
+		if err := graph.ValidateRefDefKey(ref.RefDefKey()); err != nil {
+			return &MalformedDefKeyError{Unit: uid, Kind: "ref", Index: i, Key: fmt.Sprintf("%+v", ref.RefDefKey()), Err: err.(*graph.InvalidDefKeyError)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package store
+
+import (
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestStrictDefKeys_Import(t *testing.T) {
+	defer func(strict bool) { StrictDefKeys = strict }(StrictDefKeys)
+	StrictDefKeys = true
+
+	fs := newTestFS()
+	mrs := NewFSMultiRepoStore(fs, nil)
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
+
+	data := graph.Output{
+		Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}}},
+		Refs: []*graph.Ref{
+			{DefUnitType: "t", DefUnit: "u", DefPath: "p", File: "f"},
+			{DefUnit: "u2", DefPath: "q", File: "f"},
+		},
+	}
+	err := mrs.Import("r", "c", u, data)
+	e, ok := err.(*MalformedDefKeyError)
+	if !ok {
+		t.Fatalf("got error %v, want *MalformedDefKeyError", err)
+	}
+	if e.Kind != "ref" || e.Index != 1 || e.Err.Field != "DefUnitType" {
+		t.Errorf("got error %+v, want ref 1 with malformed DefUnitType", e)
+	}
+	if _, err := fs.Stat("r"); err == nil {
+		t.Error("rejected import created repo dir")
+	}
+
+	data.Refs = data.Refs[:1]
+	data.Defs = append(data.Defs, &graph.Def{DefKey: graph.DefKey{Path: "/q"}})
+	if err := mrs.Import("r", "c", u, data); err == nil {
+		t.Fatal("got nil error for def with unclean path, want error")
+	}
+
+	data.Defs = data.Defs[:1]
+	if err := mrs.Import("r", "c", u, data); err != nil {
+		t.Fatal(err)
+	}
+}
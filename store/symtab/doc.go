@@ -0,0 +1,16 @@
+// Package symtab exposes the defs in a store as symbol tables, in the
+// style of go/types: each source unit has a scope tree that mirrors
+// its def paths, and each def is a Symbol with a name, kind, position,
+// and (if the toolchain records one) typed signature.
+//
+// It lets code-analysis tools look up defs by path and walk their
+// scopes without constructing store filters:
+//
+//	tab, err := symtab.Load(treeStore)
+//	...
+//	sym := tab.Lookup(unit.ID2{Type: "GoPackage", Name: "net/http"}, "Client/Do")
+//	fmt.Println(sym.Kind(), sym.Signature())
+//
+// A Table is a snapshot of the defs that were in the store when it
+// was loaded; it is safe for concurrent use.
+package symtab
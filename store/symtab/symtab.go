@@ -0,0 +1,221 @@
+package symtab
+
+import (
+	"sort"
+	"strings"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/store"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// A Symbol is a def in a symbol table.
+type Symbol struct {
+	def   *graph.Def
+	scope *Scope // the symbol's own scope (holding its members)
+}
+
+// Def returns the underlying def. It must not be modified.
+func (s *Symbol) Def() *graph.Def { return s.def }
+
+// Name returns the def's name.
+func (s *Symbol) Name() string { return s.def.Name }
+
+// Path returns the def's path (which is unique within its source
+// unit).
+func (s *Symbol) Path() string { return s.def.Path }
+
+// Kind returns the def's kind (e.g., "func" or "type"), as reported by
+// the toolchain.
+func (s *Symbol) Kind() string { return s.def.Kind }
+
+// Unit returns the source unit that defines the def.
+func (s *Symbol) Unit() unit.ID2 { return unit.ID2{Type: s.def.UnitType, Name: s.def.Unit} }
+
+// Exported reports whether the def is exported (i.e., accessible from
+// other source units).
+func (s *Symbol) Exported() bool { return s.def.Exported }
+
+// Pos returns the file and the byte offsets of the start and end of
+// the def's definition in it.
+func (s *Symbol) Pos() (file string, start, end uint32) {
+	return s.def.File, s.def.DefStart, s.def.DefEnd
+}
+
+// Signature returns the def's typed signature, or nil if the
+// toolchain didn't record one (see graph.DefSignature).
+func (s *Symbol) Signature() *graph.DefSignature { return s.def.Signature() }
+
+// Scope returns the scope holding the symbol's members (e.g., the
+// methods and fields of a type), whose defs' paths begin with the
+// symbol's path.
+func (s *Symbol) Scope() *Scope { return s.scope }
+
+func (s *Symbol) String() string { return s.Unit().String() + ":" + s.def.Path }
+
+// A Scope is a node in a source unit's scope tree. Each def path
+// component is a scope; for example, the def with path "a/b" is in the
+// scope named "a", which is in the unit's root scope. A scope for a
+// path prefix that isn't itself a def (e.g., a Go package's dir) has
+// no Symbol.
+type Scope struct {
+	parent   *Scope
+	name     string // the last component of the scope's path
+	path     string
+	sym      *Symbol
+	children map[string]*Scope
+}
+
+// Parent returns the enclosing scope, or nil for a unit's root scope.
+func (s *Scope) Parent() *Scope { return s.parent }
+
+// Path returns the def path that the scope corresponds to ("" for a
+// unit's root scope).
+func (s *Scope) Path() string { return s.path }
+
+// Symbol returns the symbol whose members the scope holds, or nil if
+// the scope's path isn't a def.
+func (s *Scope) Symbol() *Symbol { return s.sym }
+
+// Lookup returns the symbol named name that is directly in the scope,
+// or nil if there is none.
+func (s *Scope) Lookup(name string) *Symbol {
+	if c, present := s.children[name]; present {
+		return c.sym
+	}
+	return nil
+}
+
+// Child returns the scope named name that is directly in the scope,
+// or nil if there is none.
+func (s *Scope) Child(name string) *Scope { return s.children[name] }
+
+// Names returns the sorted names of the scopes directly in the scope
+// (whether or not they are defs).
+func (s *Scope) Names() []string {
+	names := make([]string, 0, len(s.children))
+	for name := range s.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Symbols returns the symbols directly in the scope, sorted by name.
+func (s *Scope) Symbols() []*Symbol {
+	var syms []*Symbol
+	for _, name := range s.Names() {
+		if sym := s.children[name].sym; sym != nil {
+			syms = append(syms, sym)
+		}
+	}
+	return syms
+}
+
+// child returns the scope named name in s, creating it if needed.
+func (s *Scope) child(name string) *Scope {
+	if c, present := s.children[name]; present {
+		return c
+	}
+	path := name
+	if s.path != "" {
+		path = s.path + "/" + name
+	}
+	c := &Scope{parent: s, name: name, path: path, children: map[string]*Scope{}}
+	s.children[name] = c
+	return c
+}
+
+// A Table is a symbol table of the defs in a store, with a scope tree
+// for each source unit.
+type Table struct {
+	units map[unit.ID2]*Scope
+	byKey map[symbolKey]*Symbol
+}
+
+type symbolKey struct {
+	unit unit.ID2
+	path string
+}
+
+// Load queries the defs in s that match the filters (all defs, if
+// there are none) and returns a symbol table of them. Typically s is
+// a tree store, or a multi-repo or repo store with filters that select
+// a single version. If s holds multiple versions, the defs of the same
+// source unit in each version are merged.
+func Load(s store.UnitStore, f ...store.DefFilter) (*Table, error) {
+	defs, err := s.Defs(f...)
+	if err != nil {
+		return nil, err
+	}
+	return New(defs), nil
+}
+
+// New returns a symbol table of defs.
+func New(defs []*graph.Def) *Table {
+	t := &Table{
+		units: map[unit.ID2]*Scope{},
+		byKey: make(map[symbolKey]*Symbol, len(defs)),
+	}
+	for _, def := range defs {
+		u := unit.ID2{Type: def.UnitType, Name: def.Unit}
+		root, present := t.units[u]
+		if !present {
+			root = &Scope{children: map[string]*Scope{}}
+			t.units[u] = root
+		}
+
+		scope := root
+		for _, name := range strings.Split(def.Path, "/") {
+			scope = scope.child(name)
+		}
+		sym := &Symbol{def: def, scope: scope}
+		scope.sym = sym
+		t.byKey[symbolKey{unit: u, path: def.Path}] = sym
+	}
+	return t
+}
+
+// Units returns the source units that have defs in the table, sorted
+// by type and name.
+func (t *Table) Units() []unit.ID2 {
+	units := make([]unit.ID2, 0, len(t.units))
+	for u := range t.units {
+		units = append(units, u)
+	}
+	sort.Sort(unitID2s(units))
+	return units
+}
+
+// Scope returns the root scope of source unit u, or nil if u has no
+// defs in the table.
+func (t *Table) Scope(u unit.ID2) *Scope { return t.units[u] }
+
+// Lookup returns the symbol for the def with the given path in source
+// unit u, or nil if there is none.
+func (t *Table) Lookup(u unit.ID2, path string) *Symbol {
+	return t.byKey[symbolKey{unit: u, path: path}]
+}
+
+// LookupPath returns the symbols for the defs with the given path in
+// all source units, sorted by unit.
+func (t *Table) LookupPath(path string) []*Symbol {
+	var syms []*Symbol
+	for _, u := range t.Units() {
+		if sym := t.Lookup(u, path); sym != nil {
+			syms = append(syms, sym)
+		}
+	}
+	return syms
+}
+
+type unitID2s []unit.ID2
+
+func (v unitID2s) Len() int      { return len(v) }
+func (v unitID2s) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+func (v unitID2s) Less(i, j int) bool {
+	if v[i].Type != v[j].Type {
+		return v[i].Type < v[j].Type
+	}
+	return v[i].Name < v[j].Name
+}
@@ -0,0 +1,88 @@
+package symtab
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/store"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+	"sourcegraph.com/sqs/pbtypes"
+)
+
+func TestLoad(t *testing.T) {
+	mrs := store.NewFSMultiRepoStore(rwvfs.Walkable(rwvfs.Map(map[string]string{})), nil)
+	u := unit.ID2{Type: "t", Name: "u"}
+	def := func(path, name, kind string, data string) *graph.Def {
+		return &graph.Def{
+			DefKey: graph.DefKey{UnitType: u.Type, Unit: u.Name, Path: path},
+			Name:   name,
+			Kind:   kind,
+			File:   "f",
+			Data:   pbtypes.RawMessage(data),
+		}
+	}
+	sig := graph.DefSignature{Params: []string{"int"}, Results: []string{"error"}}
+	sigData, err := json.Marshal(struct{ Signature graph.DefSignature }{sig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mrs.Import("r", "c", &unit.SourceUnit{Key: unit.Key{Type: u.Type, Name: u.Name}}, graph.Output{
+		Defs: []*graph.Def{
+			def("T", "T", "type", ""),
+			def("T/M", "M", "method", string(sigData)),
+			def("d/f", "f", "func", ""),
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tab, err := Load(mrs, store.ByRepoCommitIDs(store.Version{Repo: "r", CommitID: "c"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if units := tab.Units(); !reflect.DeepEqual(units, []unit.ID2{u}) {
+		t.Errorf("got units %v, want %v", units, []unit.ID2{u})
+	}
+
+	m := tab.Lookup(u, "T/M")
+	if m == nil {
+		t.Fatal("got nil symbol for T/M")
+	}
+	if m.Name() != "M" || m.Kind() != "method" || m.Unit() != u {
+		t.Errorf("got symbol %s name %q kind %q, want M method", m, m.Name(), m.Kind())
+	}
+	if got := m.Signature(); !reflect.DeepEqual(got, &sig) {
+		t.Errorf("got signature %+v, want %+v", got, sig)
+	}
+	if tab.Lookup(u, "T").Signature() != nil {
+		t.Error("got non-nil signature for T")
+	}
+	if tab.Lookup(u, "x") != nil {
+		t.Error("got symbol for nonexistent path")
+	}
+
+	root := tab.Scope(u)
+	if names := root.Names(); !reflect.DeepEqual(names, []string{"T", "d"}) {
+		t.Errorf("got root scope names %v, want [T d]", names)
+	}
+	if root.Lookup("d") != nil {
+		t.Error("got symbol for non-def scope d")
+	}
+	if f := root.Child("d").Lookup("f"); f == nil || f.Path() != "d/f" {
+		t.Errorf("got symbol %v for d/f", f)
+	}
+	if ms := root.Lookup("T").Scope().Symbols(); len(ms) != 1 || ms[0] != m {
+		t.Errorf("got T's members %v, want [%s]", ms, m)
+	}
+	if p := m.Scope().Parent(); p.Symbol().Path() != "T" || p.Parent() != root {
+		t.Errorf("got bad parent scope %q of T/M", p.Path())
+	}
+
+	if syms := tab.LookupPath("T/M"); len(syms) != 1 || syms[0] != m {
+		t.Errorf("got LookupPath symbols %v, want [%s]", syms, m)
+	}
+}
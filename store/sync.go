@@ -0,0 +1,295 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// SyncOptions configures Sync.
+type SyncOptions struct {
+	// Repos, if set, restricts syncing to these repos. By default,
+	// all repos in the source store are synced.
+	Repos []string
+
+	// Versions, if set, restricts syncing to these versions.
+	Versions []Version
+
+	// Index is whether to build indexes for each copied version in
+	// the destination store (if it implements MultiRepoIndexer)
+	// before the version is created.
+	Index bool
+
+	// DryRun is whether to only determine which versions would be
+	// copied, without writing anything to the destination store.
+	DryRun bool
+
+	// Log, if set, receives a line for each version that is copied
+	// or skipped.
+	Log *log.Logger
+}
+
+// SyncStats describes the result of a Sync.
+type SyncStats struct {
+	Copied  []Version // versions that were copied (or would be, if DryRun)
+	Skipped []Version // versions that were already present and identical
+	Units   int       // number of source units copied
+}
+
+// Sync copies the versions (repo commits) in src that are missing in
+// dst to dst. It can be used to mirror a primary store to regional
+// replicas or to local disk for offline use.
+//
+// If a version exists in both stores, the data files listed in the
+// versions' tree manifests (if both stores implement
+// MultiRepoTreeManifests and both trees have manifests) or else the
+// versions' tree content digests (if both stores implement
+// MultiRepoTreeSigning) are compared, and the version is copied again
+// if they differ (e.g., because it was reimported in src). Source units that were removed
+// from a version in src are not removed from dst. If either store
+// does not support content digests, versions that exist in dst are
+// assumed to be identical and are skipped.
+//
+// Each version's source units, defs, and refs are copied, as well as
+// the line tables of the units' files (if both stores implement
+// MultiRepoLineTables). The version is created in dst only after all
+// of its data has been copied, so an interrupted Sync never leaves a
+// partial version visible in dst; rerunning it resumes where it left
+// off.
+func Sync(src, dst MultiRepoStoreImporter, opt *SyncOptions) (*SyncStats, error) {
+	if opt == nil {
+		opt = &SyncOptions{}
+	}
+
+	var vf []VersionFilter
+	if len(opt.Repos) > 0 {
+		vf = append(vf, ByRepos(opt.Repos...))
+	}
+	if len(opt.Versions) > 0 {
+		vf = append(vf, ByRepoCommitIDs(opt.Versions...))
+	}
+	versions, err := src.Versions(vf...)
+	if err != nil {
+		return nil, err
+	}
+	sortVersions(versions)
+
+	stats := &SyncStats{}
+	for _, v := range versions {
+		needed, err := syncNeedsCopy(src, dst, *v)
+		if err != nil {
+			return stats, err
+		}
+		if !needed {
+			stats.Skipped = append(stats.Skipped, *v)
+			if opt.Log != nil {
+				opt.Log.Printf("Skipping %s@%s (identical in destination)", v.Repo, v.CommitID)
+			}
+			continue
+		}
+
+		if opt.Log != nil {
+			opt.Log.Printf("Copying %s@%s", v.Repo, v.CommitID)
+		}
+		if !opt.DryRun {
+			n, err := syncVersion(src, dst, *v, opt.Index)
+			if err != nil {
+				return stats, fmt.Errorf("sync %s@%s: %s", v.Repo, v.CommitID, err)
+			}
+			stats.Units += n
+		}
+		stats.Copied = append(stats.Copied, *v)
+	}
+	return stats, nil
+}
+
+// syncNeedsCopy reports whether version v must be copied from src to
+// dst.
+func syncNeedsCopy(src, dst MultiRepoStore, v Version) (bool, error) {
+	dstVersions, err := dst.Versions(ByRepoCommitIDs(v))
+	if err != nil {
+		return false, err
+	}
+	if len(dstVersions) == 0 {
+		return true, nil
+	}
+
+	// Compare the trees' manifests (if both have one), which is much
+	// cheaper than computing their content digests.
+	if srcManifests, ok := src.(MultiRepoTreeManifests); ok {
+		if dstManifests, ok := dst.(MultiRepoTreeManifests); ok {
+			srcM, err := srcManifests.TreeManifest(v.Repo, v.CommitID)
+			if err != nil && err != ErrNoTreeManifest {
+				return false, err
+			}
+			dstM, err := dstManifests.TreeManifest(v.Repo, v.CommitID)
+			if err != nil && err != ErrNoTreeManifest {
+				return false, err
+			}
+			if srcM != nil && dstM != nil {
+				return !srcM.sameData(dstM), nil
+			}
+		}
+	}
+
+	srcDigests, ok1 := src.(MultiRepoTreeSigning)
+	dstDigests, ok2 := dst.(MultiRepoTreeSigning)
+	if !ok1 || !ok2 {
+		return false, nil
+	}
+	srcDigest, err := srcDigests.TreeDigest(v.Repo, v.CommitID)
+	if err != nil {
+		return false, err
+	}
+	dstDigest, err := dstDigests.TreeDigest(v.Repo, v.CommitID)
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(srcDigest, dstDigest), nil
+}
+
+// syncVersion copies the data of version v from src to dst and then
+// creates the version in dst. It returns the number of source units
+// copied.
+func syncVersion(src MultiRepoStore, dst MultiRepoImporter, v Version, index bool) (int, error) {
+	vfilter := ByRepoCommitIDs(v)
+	units, err := src.Units(vfilter)
+	if err != nil {
+		return 0, err
+	}
+	sortUnits(units)
+
+	// Initialize the tree (even if it has no units).
+	if err := dst.Import(v.Repo, v.CommitID, nil, graph.Output{}); err != nil {
+		return 0, err
+	}
+
+	for _, u := range units {
+		ufilter := ByUnits(unit.ID2{Type: u.Type, Name: u.Name})
+		defs, err := src.Defs(vfilter, ufilter)
+		if err != nil {
+			return 0, err
+		}
+		refs, err := src.Refs(vfilter, ufilter)
+		if err != nil {
+			return 0, err
+		}
+
+		// Units are stored without their repo and commit ID (which
+		// the store fills in when they are read), so clear them to
+		// make the copied data identical to the source.
+		u2 := *u
+		u2.Repo, u2.CommitID = "", ""
+		if err := dst.Import(v.Repo, v.CommitID, &u2, graph.Output{Defs: defs, Refs: refs}); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := syncLineTables(src, dst, v, units); err != nil {
+		return 0, err
+	}
+	if err := syncScanResults(src, dst, v); err != nil {
+		return 0, err
+	}
+
+	if index {
+		if dst, ok := dst.(MultiRepoIndexer); ok {
+			if err := dst.Index(v.Repo, v.CommitID); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := dst.CreateVersion(v.Repo, v.CommitID); err != nil {
+		return 0, err
+	}
+	return len(units), nil
+}
+
+// syncLineTables copies the line tables of the units' files from src
+// to dst, if both support line tables.
+func syncLineTables(src, dst interface{}, v Version, units []*unit.SourceUnit) error {
+	srcTables, ok1 := src.(MultiRepoLineTables)
+	dstTables, ok2 := dst.(MultiRepoLineTables)
+	if !ok1 || !ok2 {
+		return nil
+	}
+
+	tables := map[string]LineTable{}
+	for _, u := range units {
+		for _, file := range u.Files {
+			if _, present := tables[file]; present {
+				continue
+			}
+			t, err := srcTables.LineTable(v.Repo, v.CommitID, file)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			tables[file] = t
+		}
+	}
+	if len(tables) == 0 {
+		return nil
+	}
+	return dstTables.ImportLineTables(v.Repo, v.CommitID, tables)
+}
+
+// syncScanResults copies the scan results of the version from src to
+// dst, if both support scan results and src has them.
+func syncScanResults(src, dst interface{}, v Version) error {
+	srcScan, ok1 := src.(MultiRepoScanResults)
+	dstScan, ok2 := dst.(MultiRepoScanResults)
+	if !ok1 || !ok2 {
+		return nil
+	}
+	units, err := srcScan.ScannedUnits(v.Repo, v.CommitID)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, u := range units {
+		u.Repo = ""
+		u.CommitID = ""
+	}
+	return dstScan.ImportScan(v.Repo, v.CommitID, units)
+}
+
+// sortVersions sorts versions by repo and then commit ID, so that
+// Sync copies them in a deterministic order.
+func sortVersions(versions []*Version) {
+	sort.Sort(versionsByRepoCommitID(versions))
+}
+
+type versionsByRepoCommitID []*Version
+
+func (vs versionsByRepoCommitID) Len() int      { return len(vs) }
+func (vs versionsByRepoCommitID) Swap(i, j int) { vs[i], vs[j] = vs[j], vs[i] }
+func (vs versionsByRepoCommitID) Less(i, j int) bool {
+	if vs[i].Repo != vs[j].Repo {
+		return vs[i].Repo < vs[j].Repo
+	}
+	return vs[i].CommitID < vs[j].CommitID
+}
+
+// sortUnits sorts units by type and then name.
+func sortUnits(units []*unit.SourceUnit) {
+	sort.Sort(unitsByID2(units))
+}
+
+type unitsByID2 []*unit.SourceUnit
+
+func (us unitsByID2) Len() int      { return len(us) }
+func (us unitsByID2) Swap(i, j int) { us[i], us[j] = us[j], us[i] }
+func (us unitsByID2) Less(i, j int) bool {
+	if us[i].Type != us[j].Type {
+		return us[i].Type < us[j].Type
+	}
+	return us[i].Name < us[j].Name
+}
@@ -0,0 +1,144 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func testSyncImport(t *testing.T, s MultiRepoStoreImporter, repo, commitID string, unitNames ...string) {
+	for _, name := range unitNames {
+		u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: name}, Info: unit.Info{Files: []string{"f"}}}
+		data := graph.Output{
+			Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}, Name: "n", File: "f"}},
+			Refs: []*graph.Ref{
+				{DefPath: "p", File: "f", Start: 3, End: 4},
+				{DefPath: "p", File: "f", Start: 1, End: 2},
+			},
+		}
+		if err := s.Import(repo, commitID, u, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.CreateVersion(repo, commitID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSync(t *testing.T) {
+	src := NewFSMultiRepoStore(newTestFS(), nil)
+	dst := NewFSMultiRepoStore(newTestFS(), nil)
+	testSyncImport(t, src, "r1", "c1", "u1", "u2")
+	testSyncImport(t, src, "r2", "c2", "u")
+	lt := NewLineTable([]byte("a\nb\nc"))
+	if err := src.(MultiRepoLineTables).ImportLineTables("r1", "c1", map[string]LineTable{"f": lt}); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := Sync(src, dst, &SyncOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Copied) != 2 {
+		t.Errorf("dry run: got %d copied versions, want 2", len(stats.Copied))
+	}
+	if versions, _ := dst.Versions(); len(versions) != 0 {
+		t.Errorf("dry run: got %d versions in dst, want 0", len(versions))
+	}
+
+	stats, err = Sync(src, dst, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Copied) != 2 || len(stats.Skipped) != 0 || stats.Units != 3 {
+		t.Errorf("got stats %+v, want 2 versions (3 units) copied", stats)
+	}
+
+	for _, repo := range []string{"r1", "r2"} {
+		for _, q := range []string{"Units", "Versions"} {
+			var want, got interface{}
+			switch q {
+			case "Units":
+				want, _ = src.Units(ByRepos(repo))
+				got, _ = dst.Units(ByRepos(repo))
+			case "Versions":
+				want, _ = src.Versions(ByRepos(repo))
+				got, _ = dst.Versions(ByRepos(repo))
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s %s: got %v, want %v", repo, q, got, want)
+			}
+		}
+	}
+	units, err := src.Units()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range units {
+		repoF, unitF := ByRepos(u.Repo), ByUnits(u.ID2())
+		wantDefs, _ := src.Defs(repoF, unitF)
+		gotDefs, _ := dst.Defs(repoF, unitF)
+		if !reflect.DeepEqual(gotDefs, wantDefs) {
+			t.Errorf("%v Defs: got %v, want %v", u.ID2(), gotDefs, wantDefs)
+		}
+		wantRefs, _ := src.Refs(repoF, unitF)
+		gotRefs, _ := dst.Refs(repoF, unitF)
+		if !reflect.DeepEqual(gotRefs, wantRefs) {
+			t.Errorf("%v Refs: got %v, want %v", u.ID2(), gotRefs, wantRefs)
+		}
+	}
+	if got, err := dst.(MultiRepoLineTables).LineTable("r1", "c1", "f"); err != nil {
+		t.Fatal(err)
+	} else if got.Lines() != lt.Lines() {
+		t.Errorf("got line table with %d lines, want %d", got.Lines(), lt.Lines())
+	}
+
+	// Identical versions are skipped.
+	stats, err = Sync(src, dst, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Copied) != 0 || len(stats.Skipped) != 2 {
+		t.Errorf("second sync: got stats %+v, want all versions skipped", stats)
+	}
+
+	// Versions whose data changed in src are copied again.
+	testSyncImport(t, src, "r2", "c2", "u3")
+	stats, err = Sync(src, dst, &SyncOptions{Repos: []string{"r2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Version{{Repo: "r2", CommitID: "c2"}}; !reflect.DeepEqual(stats.Copied, want) || len(stats.Skipped) != 0 {
+		t.Errorf("after reimport: got stats %+v, want %v copied", stats, want)
+	}
+	if units, err := dst.Units(ByRepos("r2")); err != nil {
+		t.Fatal(err)
+	} else if len(units) != 2 {
+		t.Errorf("after reimport: got %d units in dst, want 2", len(units))
+	}
+}
+
+func TestSync_memoryStore(t *testing.T) {
+	// The memory store doesn't support content digests, so versions
+	// that exist in dst are skipped.
+	src := newMemoryMultiRepoStore()
+	dst := NewFSMultiRepoStore(newTestFS(), nil)
+	testSyncImport(t, src, "r", "c", "u")
+
+	for i, wantCopied := range []int{1, 0} {
+		stats, err := Sync(src, dst, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stats.Copied) != wantCopied {
+			t.Errorf("sync %d: got %d copied versions, want %d", i, len(stats.Copied), wantCopied)
+		}
+	}
+	if defs, err := dst.Defs(); err != nil {
+		t.Fatal(err)
+	} else if len(defs) != 1 {
+		t.Errorf("got %d defs in dst, want 1", len(defs))
+	}
+}
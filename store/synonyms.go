@@ -0,0 +1,202 @@
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// A SynonymTable holds groups of interchangeable search terms (e.g.,
+// "init" and "initialize", or "cfg" and "config"), so that def
+// queries for one term also find defs named with the others. It lets
+// operators adapt def search to their organization's naming
+// conventions. Terms are matched case-insensitively and literally
+// (they are not stemmed).
+type SynonymTable struct {
+	syns   map[string][]string // lowercased term -> its synonyms
+	maxLen int                 // the length of the longest term
+}
+
+// NewSynonymTable returns a SynonymTable with the groups of
+// synonyms. A term may appear in more than one group; its synonyms
+// are the other terms of all of its groups. An error is returned if a
+// term is empty or contains whitespace, or if a group has fewer than
+// 2 distinct terms.
+func NewSynonymTable(groups ...[]string) (*SynonymTable, error) {
+	t := &SynonymTable{syns: map[string][]string{}}
+	for _, g := range groups {
+		terms := make([]string, 0, len(g))
+		seen := make(map[string]struct{}, len(g))
+		for _, term := range g {
+			if term == "" || strings.IndexFunc(term, unicode.IsSpace) != -1 {
+				return nil, fmt.Errorf("invalid synonym %q in group %q", term, g)
+			}
+			term = strings.ToLower(term)
+			if _, present := seen[term]; !present {
+				seen[term] = struct{}{}
+				terms = append(terms, term)
+			}
+		}
+		if len(terms) < 2 {
+			return nil, fmt.Errorf("synonym group %q has fewer than 2 distinct terms", g)
+		}
+		for _, term := range terms {
+			for _, syn := range terms {
+				if syn != term && !containsString(t.syns[term], syn) {
+					t.syns[term] = append(t.syns[term], syn)
+				}
+			}
+			if len(term) > t.maxLen {
+				t.maxLen = len(term)
+			}
+		}
+	}
+	return t, nil
+}
+
+// ReadSynonymTable reads a SynonymTable from r, which contains one
+// group of synonyms per line. The terms on a line are separated by
+// commas and/or whitespace. Blank lines and lines beginning with "#"
+// are ignored.
+func ReadSynonymTable(r io.Reader) (*SynonymTable, error) {
+	var groups [][]string
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		g := strings.FieldsFunc(text, func(c rune) bool { return c == ',' || unicode.IsSpace(c) })
+		if len(g) < 2 {
+			return nil, fmt.Errorf("synonyms line %d: a group must have at least 2 terms", line)
+		}
+		groups = append(groups, g)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return NewSynonymTable(groups...)
+}
+
+// Expand returns the def queries that q expands to: q (lowercased),
+// followed by q with its longest prefix that is a term in the table
+// replaced by each of the term's synonyms. Because def queries match
+// def name prefixes, only q's prefix is expanded; for example, if
+// "init" and "initialize" are synonyms, "initcfg" expands to
+// "initcfg" and "initializecfg".
+func (t *SynonymTable) Expand(q string) []string {
+	q = strings.ToLower(q)
+	qs := []string{q}
+	n := len(q)
+	if n > t.maxLen {
+		n = t.maxLen
+	}
+	for ; n > 0; n-- {
+		if syns, present := t.syns[q[:n]]; present {
+			for _, syn := range syns {
+				if q2 := syn + q[n:]; !containsString(qs, q2) {
+					qs = append(qs, q2)
+				}
+			}
+			break
+		}
+	}
+	return qs
+}
+
+func containsString(ss []string, s string) bool {
+	for _, s2 := range ss {
+		if s2 == s {
+			return true
+		}
+	}
+	return false
+}
+
+// NewSynonymStore returns a MultiRepoStore that performs queries on
+// s, except that the queries of ByDefQuery filters are expanded with
+// the synonyms in t (see SynonymTable.Expand): a def is selected if
+// its name matches any of the expansions. Def query indexes are
+// consulted for each expansion.
+//
+// ByDefQueryMatches and ByDefQuerySuggest filters are not expanded
+// (because their matches and suggestions refer to the original
+// query).
+//
+// The returned store is read-only.
+func NewSynonymStore(s MultiRepoStore, t *SynonymTable) MultiRepoStore {
+	return &synonymStore{s: s, t: t}
+}
+
+type synonymStore struct {
+	s MultiRepoStore
+	t *SynonymTable
+}
+
+var _ MultiRepoStore = (*synonymStore)(nil)
+
+func (s *synonymStore) Repos(f ...RepoFilter) ([]string, error) { return s.s.Repos(f...) }
+
+func (s *synonymStore) Versions(f ...VersionFilter) ([]*Version, error) {
+	return s.s.Versions(f...)
+}
+
+func (s *synonymStore) Units(f ...UnitFilter) ([]*unit.SourceUnit, error) {
+	return s.s.Units(f...)
+}
+
+func (s *synonymStore) Defs(f ...DefFilter) ([]*graph.Def, error) {
+	var f2 []DefFilter
+	for i, ff := range f {
+		q, ok := ff.(byDefQueryFilter)
+		if !ok {
+			continue
+		}
+		qs := s.t.Expand(string(q))
+		if len(qs) == 1 {
+			continue
+		}
+		if f2 == nil {
+			f2 = append([]DefFilter{}, f...)
+		}
+		f2[i] = byDefQueriesFilter(qs)
+	}
+	if f2 == nil {
+		return s.s.Defs(f...)
+	}
+	return s.s.Defs(f2...)
+}
+
+func (s *synonymStore) Refs(f ...RefFilter) ([]*graph.Ref, error) { return s.s.Refs(f...) }
+
+func (s *synonymStore) String() string { return fmt.Sprintf("synonyms(%s)", s.s) }
+
+// defQueryAlternatives is implemented by def query filters that match
+// defs whose names begin with any of several queries. Def query
+// indexes return the union of their matches for each query.
+type defQueryAlternatives interface {
+	defQueryAlternatives() []string
+}
+
+// byDefQueriesFilter selects defs whose names begin with any of its
+// (lowercased) queries. Its first query is the original query and the
+// others are its synonym expansions.
+type byDefQueriesFilter []string
+
+func (f byDefQueriesFilter) String() string                 { return fmt.Sprintf("ByDefQueries(%q)", []string(f)) }
+func (f byDefQueriesFilter) ByDefQuery() string             { return f[0] }
+func (f byDefQueriesFilter) defQueryAlternatives() []string { return f }
+func (f byDefQueriesFilter) SelectDef(def *graph.Def) bool {
+	name := strings.ToLower(def.Name)
+	for _, q := range f {
+		if strings.HasPrefix(name, q) {
+			return true
+		}
+	}
+	return false
+}
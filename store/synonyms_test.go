@@ -0,0 +1,103 @@
+package store
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestSynonymTable_Expand(t *testing.T) {
+	st, err := ReadSynonymTable(strings.NewReader(`
+# Abbreviations
+init, initialize
+cfg config configuration
+Config settings
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string][]string{
+		"Initialize":    {"initialize", "init"},
+		"initcfg":       {"initcfg", "initializecfg"},
+		"initializeFoo": {"initializefoo", "initfoo"},
+		"configuration": {"configuration", "cfg", "config"}, // longest prefix
+		"configx":       {"configx", "cfgx", "configurationx", "settingsx"},
+		"in":            {"in"},
+		"reader":        {"reader"},
+	}
+	for q, want := range tests {
+		if got := st.Expand(q); !reflect.DeepEqual(got, want) {
+			t.Errorf("Expand(%q): got %q, want %q", q, got, want)
+		}
+	}
+
+	for _, bad := range []string{"init", "a, A", "a b\nc"} {
+		if _, err := ReadSynonymTable(strings.NewReader(bad)); err == nil {
+			t.Errorf("ReadSynonymTable(%q): got nil error, want error", bad)
+		}
+	}
+}
+
+func TestSynonymStore(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+
+	st, err := NewSynonymTable([]string{"init", "initialize"}, []string{"cfg", "config"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, indexed := range []bool{false, true} {
+		useIndexedStore = indexed
+		mrs := NewFSMultiRepoStore(newTestFS(), nil)
+		for _, u := range []string{"u1", "u2"} {
+			data := graph.Output{Defs: []*graph.Def{
+				{DefKey: graph.DefKey{Path: u + "/a"}, Name: "InitConfig", Exported: true},
+				{DefKey: graph.DefKey{Path: u + "/b"}, Name: "InitializeServer", Exported: true},
+				{DefKey: graph.DefKey{Path: u + "/c"}, Name: "CfgLoader", Exported: true},
+				{DefKey: graph.DefKey{Path: u + "/d"}, Name: "Reader", Exported: true},
+			}}
+			if err := mrs.Import("r", "c", &unit.SourceUnit{Key: unit.Key{Type: "t", Name: u}}, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if indexed {
+			if err := mrs.Index("r", "c"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := mrs.CreateVersion("r", "c"); err != nil {
+			t.Fatal(err)
+		}
+		s := NewSynonymStore(mrs, st)
+
+		tests := []struct {
+			scope []DefFilter
+			q     string
+			want  []string
+		}{
+			{q: "initialize", want: []string{"u1/a", "u1/b", "u2/a", "u2/b"}},
+			{q: "init", want: []string{"u1/a", "u1/b", "u2/a", "u2/b"}},
+			{q: "configL", want: []string{"u1/c", "u2/c"}},
+			{q: "initializes", want: []string{"u1/b", "u2/b"}},
+			{q: "read", want: []string{"u1/d", "u2/d"}},
+			{q: "initialize", scope: []DefFilter{ByUnits(unit.ID2{Type: "t", Name: "u1"})}, want: []string{"u1/a", "u1/b"}},
+		}
+		for _, test := range tests {
+			defs, err := s.Defs(append(test.scope, ByDefQuery(test.q))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var paths []string
+			for _, def := range defs {
+				paths = append(paths, def.Path)
+			}
+			sort.Strings(paths)
+			if !reflect.DeepEqual(paths, test.want) {
+				t.Errorf("indexed=%v: %q (scope %v): got defs %v, want %v", indexed, test.q, test.scope, paths, test.want)
+			}
+		}
+	}
+}
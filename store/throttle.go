@@ -0,0 +1,306 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"golang.org/x/tools/godoc/vfs"
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+// FSStoreConf configures how an FS-backed store accesses its VFS. The
+// zero value imposes no limits and uses the default write policy.
+//
+// The limits protect shared backends (such as S3 or NFS servers) from
+// bursty fan-out queries. An operation that would exceed a limit
+// waits (in FIFO order) until it can proceed; if it would have to wait
+// longer than MaxQueueWait, it fails with an *ErrThrottled error
+// instead.
+type FSStoreConf struct {
+	// MaxConcurrentOps is the maximum number of VFS operations
+	// (opens, reads, stats, directory listings, and writes) that may
+	// be in progress at once. If 0, there is no limit.
+	MaxConcurrentOps int `json:",omitempty"`
+
+	// OpensPerSecond is the maximum rate at which files may be opened
+	// (for reading or writing). If 0, there is no limit.
+	OpensPerSecond float64 `json:",omitempty"`
+
+	// ReadsPerSecond is the maximum rate at which reads may be issued
+	// on open files. If 0, there is no limit.
+	ReadsPerSecond float64 `json:",omitempty"`
+
+	// MaxQueueWait is the maximum amount of time that an operation
+	// waits for a limit to allow it to proceed. If 0, operations wait
+	// indefinitely.
+	MaxQueueWait time.Duration `json:",omitempty"`
+
+	// WriteBufferSize is the size (in bytes) of the buffer used for
+	// each file that the store writes (see NewWritePolicyFS). Larger
+	// buffers reduce the number of writes issued to the VFS, which
+	// speeds up imports on filesystems with a high per-write cost
+	// (such as NFS). If 0, the store's default buffering is used.
+	WriteBufferSize int `json:",omitempty"`
+
+	// Sync is when the files that the store writes are synced to
+	// stable storage (see SyncPolicy). By default, they are never
+	// synced.
+	Sync SyncPolicy `json:",omitempty"`
+
+	// Clock is the clock that the store uses for the timestamps and
+	// durations that it records and for its time-based limits. If
+	// nil, SystemClock is used. Tests may set it to a ManualClock.
+	Clock Clock `json:"-"`
+}
+
+// Validate returns an error if c has an invalid setting (such as a
+// negative limit or an unknown Sync policy).
+func (c FSStoreConf) Validate() error {
+	switch {
+	case c.MaxConcurrentOps < 0:
+		return fmt.Errorf("invalid MaxConcurrentOps %d (must be >= 0)", c.MaxConcurrentOps)
+	case c.OpensPerSecond < 0:
+		return fmt.Errorf("invalid OpensPerSecond %g (must be >= 0)", c.OpensPerSecond)
+	case c.ReadsPerSecond < 0:
+		return fmt.Errorf("invalid ReadsPerSecond %g (must be >= 0)", c.ReadsPerSecond)
+	case c.MaxQueueWait < 0:
+		return fmt.Errorf("invalid MaxQueueWait %s (must be >= 0)", c.MaxQueueWait)
+	case c.WriteBufferSize < 0:
+		return fmt.Errorf("invalid WriteBufferSize %d (must be >= 0)", c.WriteBufferSize)
+	}
+	return c.Sync.validate()
+}
+
+// throttled reports whether conf imposes any limits.
+func (c FSStoreConf) throttled() bool {
+	return c.MaxConcurrentOps > 0 || c.OpensPerSecond > 0 || c.ReadsPerSecond > 0
+}
+
+// ErrThrottled is the error returned by a VFS operation that could not
+// proceed within the MaxQueueWait of a store's FSStoreConf.
+type ErrThrottled struct {
+	Op    string // the VFS operation (e.g., "Open" or "Read")
+	Path  string // the path of the file that the operation was on
+	Limit string // the name of the limit that was exceeded (e.g., "OpensPerSecond")
+}
+
+func (e *ErrThrottled) Error() string {
+	return fmt.Sprintf("%s %s: throttled (%s exceeded)", e.Op, e.Path, e.Limit)
+}
+
+// IsThrottled reports whether err is an *ErrThrottled error.
+func IsThrottled(err error) bool {
+	_, ok := err.(*ErrThrottled)
+	return ok
+}
+
+// NewThrottledFS returns a filesystem that limits the operations on fs
+// according to conf. If conf imposes no limits, fs is returned
+// (as a WalkableFileSystem).
+func NewThrottledFS(fs rwvfs.FileSystem, conf FSStoreConf) rwvfs.WalkableFileSystem {
+	if !conf.throttled() {
+		return rwvfs.Walkable(fs)
+	}
+	t := &throttledFS{fs: fs, conf: conf}
+	if conf.MaxConcurrentOps > 0 {
+		t.sem = make(chan struct{}, conf.MaxConcurrentOps)
+	}
+	if conf.OpensPerSecond > 0 {
+		t.opens = newRateLimiter(conf.OpensPerSecond, conf.clock())
+	}
+	if conf.ReadsPerSecond > 0 {
+		t.reads = newRateLimiter(conf.ReadsPerSecond, conf.clock())
+	}
+	return rwvfs.Walkable(t)
+}
+
+type throttledFS struct {
+	fs   rwvfs.FileSystem
+	conf FSStoreConf
+
+	sem          chan struct{} // concurrency slots (nil if unlimited)
+	opens, reads *rateLimiter  // nil if unlimited
+}
+
+// begin waits until the operation may proceed. If it returns a nil
+// error, the caller must call end when the operation is done.
+func (fs *throttledFS) begin(op, name string, rl *rateLimiter, rateLimit string) error {
+	var deadline time.Time
+	if fs.conf.MaxQueueWait > 0 {
+		deadline = fs.conf.clock().Now().Add(fs.conf.MaxQueueWait)
+	}
+	if rl != nil && !rl.wait(deadline) {
+		return &ErrThrottled{Op: op, Path: name, Limit: rateLimit}
+	}
+	if fs.sem != nil {
+		if deadline.IsZero() {
+			fs.sem <- struct{}{}
+		} else {
+			timer := time.NewTimer(deadline.Sub(fs.conf.clock().Now()))
+			defer timer.Stop()
+			select {
+			case fs.sem <- struct{}{}:
+			case <-timer.C:
+				return &ErrThrottled{Op: op, Path: name, Limit: "MaxConcurrentOps"}
+			}
+		}
+	}
+	return nil
+}
+
+func (fs *throttledFS) end() {
+	if fs.sem != nil {
+		<-fs.sem
+	}
+}
+
+func (fs *throttledFS) Open(name string) (vfs.ReadSeekCloser, error) {
+	if err := fs.begin("Open", name, fs.opens, "OpensPerSecond"); err != nil {
+		return nil, err
+	}
+	defer fs.end()
+	f, err := fs.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &throttledFile{ReadSeekCloser: f, fs: fs, name: name}, nil
+}
+
+func (fs *throttledFS) Create(name string) (io.WriteCloser, error) {
+	if err := fs.begin("Create", name, fs.opens, "OpensPerSecond"); err != nil {
+		return nil, err
+	}
+	defer fs.end()
+	return fs.fs.Create(name)
+}
+
+func (fs *throttledFS) Lstat(name string) (os.FileInfo, error) {
+	if err := fs.begin("Lstat", name, nil, ""); err != nil {
+		return nil, err
+	}
+	defer fs.end()
+	return fs.fs.Lstat(name)
+}
+
+func (fs *throttledFS) Stat(name string) (os.FileInfo, error) {
+	if err := fs.begin("Stat", name, nil, ""); err != nil {
+		return nil, err
+	}
+	defer fs.end()
+	return fs.fs.Stat(name)
+}
+
+func (fs *throttledFS) ReadDir(name string) ([]os.FileInfo, error) {
+	if err := fs.begin("ReadDir", name, nil, ""); err != nil {
+		return nil, err
+	}
+	defer fs.end()
+	return fs.fs.ReadDir(name)
+}
+
+func (fs *throttledFS) Mkdir(name string) error {
+	if err := fs.begin("Mkdir", name, nil, ""); err != nil {
+		return err
+	}
+	defer fs.end()
+	return fs.fs.Mkdir(name)
+}
+
+func (fs *throttledFS) Remove(name string) error {
+	if err := fs.begin("Remove", name, nil, ""); err != nil {
+		return err
+	}
+	defer fs.end()
+	return fs.fs.Remove(name)
+}
+
+func (fs *throttledFS) String() string { return "Throttled(" + fs.fs.String() + ")" }
+
+func (fs *throttledFS) CreateParentDirs(b bool) {
+	type createParents interface {
+		CreateParentDirs(bool)
+	}
+	if cfs, ok := fs.fs.(createParents); ok {
+		cfs.CreateParentDirs(b)
+	}
+}
+
+// Join implements rwvfs.WalkableFileSystem using the underlying FS's
+// Join (if any).
+func (fs *throttledFS) Join(elem ...string) string {
+	if wfs, ok := fs.fs.(rwvfs.WalkableFileSystem); ok {
+		return wfs.Join(elem...)
+	}
+	return path.Join(elem...)
+}
+
+// throttledFile limits the reads on a file opened by a throttledFS.
+type throttledFile struct {
+	vfs.ReadSeekCloser
+	fs   *throttledFS
+	name string
+}
+
+func (f *throttledFile) Read(p []byte) (int, error) {
+	if err := f.fs.begin("Read", f.name, f.fs.reads, "ReadsPerSecond"); err != nil {
+		return 0, err
+	}
+	defer f.fs.end()
+	return f.ReadSeekCloser.Read(p)
+}
+
+// rateLimiter is a token bucket that allows events to occur at a
+// given rate, with bursts of up to 1 second's worth of events.
+type rateLimiter struct {
+	rate  float64 // events per second
+	burst float64
+	clock Clock
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, clock Clock) *rateLimiter {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: burst, clock: clock, tokens: burst, last: clock.Now()}
+}
+
+// wait waits until an event may occur and reports true. If the event
+// could not occur before deadline (unless deadline is zero), it
+// returns false immediately without waiting.
+func (rl *rateLimiter) wait(deadline time.Time) bool {
+	rl.mu.Lock()
+	now := rl.clock.Now()
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.last = now
+
+	var delay time.Duration
+	if rl.tokens < 1 {
+		delay = time.Duration((1 - rl.tokens) / rl.rate * float64(time.Second))
+	}
+	if !deadline.IsZero() && now.Add(delay).After(deadline) {
+		rl.mu.Unlock()
+		return false
+	}
+
+	// Reserve the token now (going into debt if necessary) so that
+	// waiters are served in order.
+	rl.tokens--
+	rl.mu.Unlock()
+
+	if delay > 0 {
+		rl.clock.Sleep(delay)
+	}
+	return true
+}
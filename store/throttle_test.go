@@ -0,0 +1,163 @@
+package store
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/tools/godoc/vfs"
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+// blockingFS is a FS whose Stat method blocks until unblocked.
+type blockingFS struct {
+	rwvfs.FileSystem
+	started chan struct{}
+	unblock chan struct{}
+}
+
+func (fs *blockingFS) Stat(name string) (os.FileInfo, error) {
+	fs.started <- struct{}{}
+	<-fs.unblock
+	return fs.FileSystem.Stat(name)
+}
+
+func TestThrottledFS_maxConcurrentOps(t *testing.T) {
+	bfs := &blockingFS{FileSystem: rwvfs.Map(map[string]string{}), started: make(chan struct{}, 10), unblock: make(chan struct{})}
+	fs := NewThrottledFS(bfs, FSStoreConf{MaxConcurrentOps: 2, MaxQueueWait: 20 * time.Millisecond})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fs.Stat(".")
+		}()
+	}
+	<-bfs.started
+	<-bfs.started
+
+	if _, err := fs.Stat("."); !IsThrottled(err) {
+		t.Errorf("got error %v, want throttled", err)
+	} else if limit := err.(*ErrThrottled).Limit; limit != "MaxConcurrentOps" {
+		t.Errorf("got limit %q, want MaxConcurrentOps", limit)
+	}
+
+	close(bfs.unblock)
+	wg.Wait()
+	if _, err := fs.Stat("."); err != nil {
+		t.Errorf("after ops finished: %s", err)
+	}
+}
+
+func TestThrottledFS_opensPerSecond(t *testing.T) {
+	mfs := rwvfs.Map(map[string]string{})
+	if err := rwvfs.MkdirAll(mfs, "."); err != nil {
+		t.Fatal(err)
+	}
+	w, err := mfs.Create("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("data"))
+	w.Close()
+
+	fs := NewThrottledFS(mfs, FSStoreConf{OpensPerSecond: 2, MaxQueueWait: 100 * time.Millisecond})
+
+	// The first 2 opens use the initial burst; the third would have
+	// to wait ~500ms.
+	for i := 0; i < 2; i++ {
+		data, err := vfs.ReadFile(fs, "f")
+		if err != nil {
+			t.Fatalf("open %d: %s", i, err)
+		}
+		if string(data) != "data" {
+			t.Errorf("open %d: got %q, want %q", i, data, "data")
+		}
+	}
+	if _, err := fs.Open("f"); !IsThrottled(err) {
+		t.Errorf("got error %v, want throttled", err)
+	}
+}
+
+func TestThrottledFS_readsPerSecond(t *testing.T) {
+	mfs := rwvfs.Map(map[string]string{})
+	w, err := mfs.Create("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("data"))
+	w.Close()
+
+	fs := NewThrottledFS(mfs, FSStoreConf{ReadsPerSecond: 50})
+	f, err := fs.Open("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Without MaxQueueWait, reads are delayed instead of failing.
+	start := time.Now()
+	var buf [1]byte
+	for i := 0; i < 52; i++ {
+		f.Seek(0, 0)
+		if _, err := f.Read(buf[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("52 reads took %s, want >= 20ms (at 50 reads/sec after burst)", d)
+	}
+}
+
+func TestNewThrottledFS_unlimited(t *testing.T) {
+	fs := rwvfs.Walkable(rwvfs.Map(map[string]string{}))
+	if got := NewThrottledFS(fs, FSStoreConf{}); got != fs {
+		t.Errorf("got %v, want unwrapped FS", got)
+	}
+}
+
+func TestThrottledFS_clock(t *testing.T) {
+	mfs := rwvfs.Map(map[string]string{})
+	w, err := mfs.Create("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("data"))
+	w.Close()
+
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewManualClock(start)
+	fs := NewThrottledFS(mfs, FSStoreConf{ReadsPerSecond: 50, Clock: clock})
+	f, err := fs.Open("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// The reads after the burst of 50 wait on the store's clock.
+	var buf [1]byte
+	for i := 0; i < 52; i++ {
+		f.Seek(0, 0)
+		if _, err := f.Read(buf[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d, want := clock.Now().Sub(start), 40*time.Millisecond; d != want {
+		t.Errorf("52 reads took %s on the clock, want %s", d, want)
+	}
+
+	// MaxQueueWait deadlines are also measured on the store's clock.
+	fs = NewThrottledFS(mfs, FSStoreConf{OpensPerSecond: 1, MaxQueueWait: 500 * time.Millisecond, Clock: clock})
+	if _, err := fs.Open("f"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Open("f"); !IsThrottled(err) {
+		t.Errorf("got error %v, want throttled", err)
+	}
+	clock.Advance(2 * time.Second)
+	if _, err := fs.Open("f"); err != nil {
+		t.Errorf("after advancing clock: %s", err)
+	}
+}
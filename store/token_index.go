@@ -0,0 +1,302 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+	"unicode"
+	"unicode/utf8"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+// A TokenSpan is the location of an occurrence of an identifier in a
+// source file.
+type TokenSpan struct {
+	File       string
+	Start, End uint32 // byte offsets of the identifier in File
+}
+
+// A TokenIndex maps identifier text to the locations where it
+// appears. Unlike def search (which matches defs' names), it finds
+// every literal occurrence of an identifier that lies within a ref's
+// span, including the qualifiers of qualified refs (e.g., both "fmt"
+// and "Println" in "fmt.Println").
+type TokenIndex map[string][]TokenSpan
+
+// AddRefs adds the identifiers that appear in the spans of refs (in
+// file) to x. src is the contents of file; refs in other files, and
+// refs whose spans lie outside of src, are ignored.
+func (x TokenIndex) AddRefs(file string, src []byte, refs []*graph.Ref) {
+	seen := map[TokenSpan]struct{}{}
+	for _, ref := range refs {
+		if ref.File != file || ref.Start >= ref.End || int(ref.End) > len(src) {
+			continue
+		}
+		for _, sp := range identifierSpans(src[ref.Start:ref.End]) {
+			span := TokenSpan{File: file, Start: ref.Start + sp[0], End: ref.Start + sp[1]}
+			if _, dup := seen[span]; dup {
+				continue
+			}
+			seen[span] = struct{}{}
+			tok := string(src[span.Start:span.End])
+			x[tok] = append(x[tok], span)
+		}
+	}
+}
+
+// identifierSpans returns the [start, end) byte ranges of the
+// identifiers in b. An identifier is a run of letters, digits, '_',
+// and '$' that doesn't begin with a digit.
+func identifierSpans(b []byte) [][2]uint32 {
+	var spans [][2]uint32
+	start := -1
+	for i := 0; i <= len(b); {
+		r, size := utf8.RuneError, 1
+		if i < len(b) {
+			r, size = utf8.DecodeRune(b[i:])
+		}
+		ident := i < len(b) && (r == '_' || r == '$' || unicode.IsLetter(r) || (start != -1 && unicode.IsDigit(r)))
+		if ident && start == -1 {
+			start = i
+		} else if !ident && start != -1 {
+			spans = append(spans, [2]uint32{uint32(start), uint32(i)})
+			start = -1
+		}
+		i += size
+	}
+	return spans
+}
+
+// A TreeTokenIndex stores the token index of a tree.
+type TreeTokenIndex interface {
+	// ImportTokens adds the tokens in x to the tree's token index.
+	// Previously imported token locations in the files that appear
+	// in x are replaced; those in other files are kept.
+	ImportTokens(x TokenIndex) error
+
+	// Tokens returns the locations of the identifier token (which
+	// must match exactly), sorted by file and offset. If the tree
+	// has no token index, an error satisfying os.IsNotExist is
+	// returned.
+	Tokens(token string) ([]TokenSpan, error)
+}
+
+// A RepoTokenIndex stores the token indexes of a repo's trees.
+type RepoTokenIndex interface {
+	ImportTokens(commitID string, x TokenIndex) error
+	Tokens(commitID, token string) ([]TokenSpan, error)
+}
+
+// A MultiRepoTokenIndex stores the token indexes of trees in multiple
+// repos.
+type MultiRepoTokenIndex interface {
+	ImportTokens(repo, commitID string, x TokenIndex) error
+	Tokens(repo, commitID, token string) ([]TokenSpan, error)
+}
+
+// tokensFilename is the name of the file (in a tree's dir) that holds
+// the tree's token index.
+const tokensFilename = "tokens.dat"
+
+func (s *fsTreeStore) ImportTokens(x TokenIndex) error {
+	if err := rwvfs.MkdirAll(s.fs, "."); err != nil {
+		return err
+	}
+	if err := s.invalidateContentDigest(); err != nil {
+		return err
+	}
+	all, err := s.readTokens()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if all == nil {
+		all = make(TokenIndex, len(x))
+	}
+
+	replaced := map[string]struct{}{}
+	for _, spans := range x {
+		for _, span := range spans {
+			replaced[span.File] = struct{}{}
+		}
+	}
+	for tok, spans := range all {
+		kept := spans[:0]
+		for _, span := range spans {
+			if _, r := replaced[span.File]; !r {
+				kept = append(kept, span)
+			}
+		}
+		if len(kept) == 0 {
+			delete(all, tok)
+		} else {
+			all[tok] = kept
+		}
+	}
+	for tok, spans := range x {
+		all[tok] = append(all[tok], spans...)
+	}
+	return s.writeTokens(all)
+}
+
+func (s *fsTreeStore) Tokens(token string) ([]TokenSpan, error) {
+	all, err := s.readTokens()
+	if err != nil {
+		return nil, err
+	}
+	return all[token], nil
+}
+
+type tokenSpans []TokenSpan
+
+func (v tokenSpans) Len() int      { return len(v) }
+func (v tokenSpans) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+func (v tokenSpans) Less(i, j int) bool {
+	if v[i].File != v[j].File {
+		return v[i].File < v[j].File
+	}
+	return v[i].Start < v[j].Start
+}
+
+// writeTokens writes the token index file. Entries are sorted by
+// token, and each consists of the uvarint-prefixed token and the
+// uvarint number of locations, followed by each location's
+// uvarint-prefixed file path and its uvarint start and end offsets.
+func (s *fsTreeStore) writeTokens(x TokenIndex) (err error) {
+	toks := make([]string, 0, len(x))
+	for tok := range x {
+		toks = append(toks, tok)
+	}
+	sort.Strings(toks)
+
+	f, err := s.fs.Create(tokensFilename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := f.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	var buf [binary.MaxVarintLen64]byte
+	writeUvarint := func(v uint64) error {
+		_, err := w.Write(buf[:binary.PutUvarint(buf[:], v)])
+		return err
+	}
+	writeString := func(s string) error {
+		if err := writeUvarint(uint64(len(s))); err != nil {
+			return err
+		}
+		_, err := w.WriteString(s)
+		return err
+	}
+	for _, tok := range toks {
+		spans := x[tok]
+		sort.Sort(tokenSpans(spans))
+		if err := writeString(tok); err != nil {
+			return err
+		}
+		if err := writeUvarint(uint64(len(spans))); err != nil {
+			return err
+		}
+		for _, span := range spans {
+			if err := writeString(span.File); err != nil {
+				return err
+			}
+			if err := writeUvarint(uint64(span.Start)); err != nil {
+				return err
+			}
+			if err := writeUvarint(uint64(span.End)); err != nil {
+				return err
+			}
+		}
+	}
+	return w.Flush()
+}
+
+func (s *fsTreeStore) readTokens() (x TokenIndex, err error) {
+	f, err := s.fs.Open(tokensFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err2 := f.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+
+	r := bufio.NewReader(f)
+	readString := func() (string, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(r, b)
+		return string(b), err
+	}
+	x = TokenIndex{}
+	for {
+		tok, err := readString()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		spans := make([]TokenSpan, n)
+		for i := range spans {
+			if spans[i].File, err = readString(); err != nil {
+				return nil, err
+			}
+			start, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, err
+			}
+			end, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, err
+			}
+			spans[i].Start, spans[i].End = uint32(start), uint32(end)
+		}
+		x[tok] = spans
+	}
+	return x, nil
+}
+
+func (s *fsRepoStore) ImportTokens(commitID string, x TokenIndex) error {
+	return s.newTreeStore(commitID).(TreeTokenIndex).ImportTokens(x)
+}
+
+func (s *fsRepoStore) Tokens(commitID, token string) ([]TokenSpan, error) {
+	return s.newTreeStore(commitID).(TreeTokenIndex).Tokens(token)
+}
+
+func (s *fsMultiRepoStore) ImportTokens(repo, commitID string, x TokenIndex) error {
+	if err := s.CheckImportAllowed(repo, commitID); err != nil {
+		return err
+	}
+	if err := rwvfs.MkdirAll(s.fs, s.repoPath(repo)); err != nil {
+		return err
+	}
+	return s.openRepoStore(repo).(RepoTokenIndex).ImportTokens(commitID, x)
+}
+
+func (s *fsMultiRepoStore) Tokens(repo, commitID, token string) ([]TokenSpan, error) {
+	return s.openRepoStore(repo).(RepoTokenIndex).Tokens(commitID, token)
+}
+
+var (
+	_ TreeTokenIndex      = (*fsTreeStore)(nil)
+	_ RepoTokenIndex      = (*fsRepoStore)(nil)
+	_ MultiRepoTokenIndex = (*fsMultiRepoStore)(nil)
+)
@@ -0,0 +1,67 @@
+package store
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+func TestTokenIndex_AddRefs(t *testing.T) {
+	src := []byte("x := fmt.Println(a2, 9b)\n_ = $v + héllo")
+	x := TokenIndex{}
+	x.AddRefs("f", src, []*graph.Ref{
+		{File: "f", Start: 5, End: 16},  // fmt.Println
+		{File: "f", Start: 5, End: 8},   // fmt (duplicate span)
+		{File: "f", Start: 17, End: 24}, // a2, 9b
+		{File: "f", Start: 29, End: 40}, // $v + héllo
+		{File: "f", Start: 0, End: 100}, // out of range
+		{File: "g", Start: 0, End: 1},   // other file
+	})
+	want := TokenIndex{
+		"fmt":     {{"f", 5, 8}},
+		"Println": {{"f", 9, 16}},
+		"a2":      {{"f", 17, 19}},
+		"b":       {{"f", 22, 23}},
+		"$v":      {{"f", 29, 31}},
+		"héllo":   {{"f", 34, 40}},
+	}
+	if !reflect.DeepEqual(x, want) {
+		t.Errorf("got %+v, want %+v", x, want)
+	}
+}
+
+func TestFSMultiRepoStore_Tokens(t *testing.T) {
+	mrs := NewFSMultiRepoStore(newTestFS(), nil).(MultiRepoTokenIndex)
+
+	if _, err := mrs.Tokens("r", "c", "a"); !os.IsNotExist(err) {
+		t.Errorf("Tokens before import: got error %v, want not-exist", err)
+	}
+
+	if err := mrs.ImportTokens("r", "c", TokenIndex{"a": {{"f1", 3, 4}, {"f1", 0, 1}}, "b": {{"f1", 5, 6}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mrs.ImportTokens("r", "c", TokenIndex{"a": {{"f0", 7, 8}}}); err != nil {
+		t.Fatal(err)
+	}
+	// Reimporting f1 replaces its previous tokens.
+	if err := mrs.ImportTokens("r", "c", TokenIndex{"a": {{"f1", 2, 3}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string][]TokenSpan{
+		"a": {{"f0", 7, 8}, {"f1", 2, 3}},
+		"b": nil,
+		"c": nil,
+	}
+	for tok, want := range tests {
+		spans, err := mrs.Tokens("r", "c", tok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(spans, want) {
+			t.Errorf("%s: got %+v, want %+v", tok, spans, want)
+		}
+	}
+}
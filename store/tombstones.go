@@ -0,0 +1,160 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+// A RepoTombstone marks a repo in a multi-repo store as hidden.
+type RepoTombstone struct {
+	Repo string
+
+	// Reason describes why the repo is hidden (e.g., "deprecated" or
+	// "bad data; pending reimport").
+	Reason string `json:",omitempty"`
+
+	// Time is when the repo was hidden.
+	Time time.Time
+}
+
+// A MultiRepoTombstones is a multi-repo store whose repos can be
+// hidden without deleting their data. Hidden repos are excluded from
+// Repos and from queries (of versions, units, defs, and refs, and of
+// dependents), even if the query's filters name them explicitly. Their
+// data can still be imported (e.g., to fix it before unhiding them).
+type MultiRepoTombstones interface {
+	// HideRepo hides repo. Hiding a repo that is already hidden
+	// replaces its tombstone.
+	HideRepo(repo, reason string) error
+
+	// UnhideRepo removes repo's tombstone (if any), so that it is
+	// included in queries again.
+	UnhideRepo(repo string) error
+
+	// HiddenRepos returns the tombstones of all hidden repos, sorted
+	// by repo.
+	HiddenRepos() ([]*RepoTombstone, error)
+}
+
+// tombstonesFilename is the name of the file (in a multi-repo store's
+// VFS) that holds the tombstones of hidden repos. It begins with a "."
+// so that it isn't listed as a repo.
+const tombstonesFilename = ".srclib-tombstones.json"
+
+func (s *fsMultiRepoStore) readTombstones() (map[string]*RepoTombstone, error) {
+	f, err := s.fs.Open(tombstonesFilename)
+	if os.IsNotExist(err) {
+		return map[string]*RepoTombstone{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var tombstones map[string]*RepoTombstone
+	if err := json.NewDecoder(f).Decode(&tombstones); err != nil {
+		return nil, fmt.Errorf("reading %s: %s", tombstonesFilename, err)
+	}
+	if tombstones == nil {
+		tombstones = map[string]*RepoTombstone{}
+	}
+	return tombstones, nil
+}
+
+func (s *fsMultiRepoStore) writeTombstones(tombstones map[string]*RepoTombstone) (err error) {
+	if len(tombstones) == 0 {
+		if err := s.fs.Remove(tombstonesFilename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	f, err := s.fs.Create(tombstonesFilename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := f.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+	return json.NewEncoder(f).Encode(tombstones)
+}
+
+// updateTombstones calls fn with the store's tombstones and writes the
+// result.
+func (s *fsMultiRepoStore) updateTombstones(fn func(map[string]*RepoTombstone)) error {
+	defer s.wrote()
+	s.tombstonesMu.Lock()
+	defer s.tombstonesMu.Unlock()
+	tombstones, err := s.readTombstones()
+	if err != nil {
+		return err
+	}
+	fn(tombstones)
+	if err := s.writeTombstones(tombstones); err != nil {
+		return err
+	}
+	// The multi-repo file names index covers all visible repos.
+	return s.invalidateFileNamesIndex()
+}
+
+func (s *fsMultiRepoStore) HideRepo(repo, reason string) error {
+	repo = graph.NormalizeRepoURI(repo)
+	now := s.clock().Now()
+	return s.updateTombstones(func(tombstones map[string]*RepoTombstone) {
+		tombstones[repo] = &RepoTombstone{Repo: repo, Reason: reason, Time: now}
+	})
+}
+
+func (s *fsMultiRepoStore) UnhideRepo(repo string) error {
+	repo = graph.NormalizeRepoURI(repo)
+	return s.updateTombstones(func(tombstones map[string]*RepoTombstone) {
+		delete(tombstones, repo)
+	})
+}
+
+func (s *fsMultiRepoStore) HiddenRepos() ([]*RepoTombstone, error) {
+	s.tombstonesMu.Lock()
+	tombstones, err := s.readTombstones()
+	s.tombstonesMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	hidden := make([]*RepoTombstone, 0, len(tombstones))
+	for _, t := range tombstones {
+		hidden = append(hidden, t)
+	}
+	sort.Sort(repoTombstonesByRepo(hidden))
+	return hidden, nil
+}
+
+type repoTombstonesByRepo []*RepoTombstone
+
+func (v repoTombstonesByRepo) Len() int           { return len(v) }
+func (v repoTombstonesByRepo) Less(i, j int) bool { return v[i].Repo < v[j].Repo }
+func (v repoTombstonesByRepo) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+
+// withoutHiddenRepos returns the repos that aren't hidden.
+func (s *fsMultiRepoStore) withoutHiddenRepos(repos []string) ([]string, error) {
+	s.tombstonesMu.Lock()
+	tombstones, err := s.readTombstones()
+	s.tombstonesMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if len(tombstones) == 0 {
+		return repos, nil
+	}
+	visible := make([]string, 0, len(repos))
+	for _, repo := range repos {
+		if _, hidden := tombstones[s.redirectRepo(graph.NormalizeRepoURI(repo))]; !hidden {
+			visible = append(visible, repo)
+		}
+	}
+	return visible, nil
+}
+
+var _ MultiRepoTombstones = (*fsMultiRepoStore)(nil)
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFSMultiRepoStore_HideRepo(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0).UTC())
+	mrs := NewFSMultiRepoStore(newTestFS(), &FSMultiRepoStoreConf{FSStoreConf: FSStoreConf{Clock: clock}})
+	testSyncImport(t, mrs, "r1", "c1", "u")
+	testSyncImport(t, mrs, "r2", "c2", "u")
+
+	checkRepos := func(label string, want []string) {
+		repos, err := mrs.Repos()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(repos, want) {
+			t.Errorf("%s: got repos %v, want %v", label, repos, want)
+		}
+	}
+	checkDefRepos := func(label string, want []string, f ...DefFilter) {
+		defs, err := mrs.Defs(f...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var repos []string
+		for _, d := range defs {
+			repos = append(repos, d.Repo)
+		}
+		if !reflect.DeepEqual(repos, want) {
+			t.Errorf("%s: got defs in repos %v, want %v", label, repos, want)
+		}
+	}
+
+	checkRepos("initial", []string{"r1", "r2"})
+
+	ts := mrs.(MultiRepoTombstones)
+	if err := ts.HideRepo("r1", "bad data"); err != nil {
+		t.Fatal(err)
+	}
+	checkRepos("hidden", []string{"r2"})
+	checkDefRepos("hidden", []string{"r2"})
+	checkDefRepos("hidden ByRepos", nil, ByRepos("r1"))
+
+	hidden, err := ts.HiddenRepos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []*RepoTombstone{{Repo: "r1", Reason: "bad data", Time: clock.Now()}}; !reflect.DeepEqual(hidden, want) {
+		t.Errorf("got hidden repos %+v, want %+v", hidden, want)
+	}
+
+	// Hidden repos' data can still be imported.
+	testSyncImport(t, mrs, "r1", "c3", "u")
+	checkRepos("reimported", []string{"r2"})
+
+	if err := ts.UnhideRepo("r1"); err != nil {
+		t.Fatal(err)
+	}
+	checkRepos("unhidden", []string{"r1", "r2"})
+	checkDefRepos("unhidden ByRepos", []string{"r1", "r1"}, ByRepos("r1"))
+
+	hidden, err = ts.HiddenRepos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hidden) != 0 {
+		t.Errorf("got hidden repos %+v, want none", hidden)
+	}
+}
@@ -1,6 +1,8 @@
 package store
 
 import (
+	"sort"
+
 	"sourcegraph.com/sourcegraph/srclib/graph"
 	"sourcegraph.com/sourcegraph/srclib/unit"
 )
@@ -13,7 +15,8 @@ type TreeStore interface {
 
 	// UnitStore's methods call the corresponding methods on the
 	// UnitStore of each source unit contained within this tree. The
-	// combined results are returned (in undefined order).
+	// combined results are returned in the canonical order (see
+	// "CONVENTION - RESULT ORDERING" in the package docs).
 	UnitStore
 }
 
@@ -51,16 +54,25 @@ type treeStores struct {
 var _ TreeStore = (*treeStores)(nil)
 
 func (s treeStores) Units(f ...UnitFilter) ([]*unit.SourceUnit, error) {
+	if units, paged, err := PagedUnits(s.Units, f); paged {
+		return units, err
+	}
+
 	tss, err := openTreeStores(s.opener, f)
 	if err != nil {
 		return nil, err
 	}
 
 	var allUnits []*unit.SourceUnit
-	for commitID, ts := range tss {
+	limit, limited := ScanLimit(f)
+	for _, commitID := range sortedCommitIDs(tss) {
+		ts := tss[commitID]
 		if ts == nil {
 			continue
 		}
+		if limited && len(allUnits) >= limit {
+			break
+		}
 
 		units, err := ts.Units(f...)
 		if err != nil && !isStoreNotExist(err) {
@@ -75,16 +87,25 @@ func (s treeStores) Units(f ...UnitFilter) ([]*unit.SourceUnit, error) {
 }
 
 func (s treeStores) Defs(f ...DefFilter) ([]*graph.Def, error) {
+	if defs, paged, err := PagedDefs(s.Defs, f); paged {
+		return defs, err
+	}
+
 	tss, err := openTreeStores(s.opener, f)
 	if err != nil {
 		return nil, err
 	}
 
 	var allDefs []*graph.Def
-	for commitID, ts := range tss {
+	limit, limited := ScanLimit(f)
+	for _, commitID := range sortedCommitIDs(tss) {
+		ts := tss[commitID]
 		if ts == nil {
 			continue
 		}
+		if limited && len(allDefs) >= limit {
+			break
+		}
 
 		defs, err := ts.Defs(f...)
 		if err != nil && !isStoreNotExist(err) {
@@ -93,22 +114,35 @@ func (s treeStores) Defs(f ...DefFilter) ([]*graph.Def, error) {
 		for _, def := range defs {
 			def.CommitID = commitID
 		}
+		if err := recordDefScoreStats(ts, defs, f); err != nil {
+			return nil, err
+		}
 		allDefs = append(allDefs, defs...)
 	}
+	sortDefs(allDefs, f)
 	return allDefs, nil
 }
 
 func (s treeStores) Refs(f ...RefFilter) ([]*graph.Ref, error) {
+	if refs, paged, err := PagedRefs(s.Refs, f); paged {
+		return refs, err
+	}
+
 	tss, err := openTreeStores(s.opener, f)
 	if err != nil {
 		return nil, err
 	}
 
 	var allRefs []*graph.Ref
-	for commitID, ts := range tss {
+	limit, limited := ScanLimit(f)
+	for _, commitID := range sortedCommitIDs(tss) {
+		ts := tss[commitID]
 		if ts == nil {
 			continue
 		}
+		if limited && len(allRefs) >= limit {
+			break
+		}
 
 		setImpliedCommitID(f, commitID)
 		refs, err := ts.Refs(f...)
@@ -120,5 +154,16 @@ func (s treeStores) Refs(f ...RefFilter) ([]*graph.Ref, error) {
 		}
 		allRefs = append(allRefs, refs...)
 	}
+	sortRefs(allRefs, f)
 	return allRefs, nil
 }
+
+// sortedCommitIDs returns the commit IDs of tss in sorted order.
+func sortedCommitIDs(tss map[string]TreeStore) []string {
+	commitIDs := make([]string, 0, len(tss))
+	for commitID := range tss {
+		commitIDs = append(commitIDs, commitID)
+	}
+	sort.Strings(commitIDs)
+	return commitIDs
+}
@@ -32,6 +32,9 @@ func testTreeStore(t *testing.T, newFn func() TreeStoreImporter) {
 	testTreeStore_Unit(t, newFn())
 	testTreeStore_Units(t, newFn())
 	testTreeStore_Units_ByFile(t, newFn())
+	testTreeStore_Units_ByFilesIgnoreCase(t, newFn())
+	testTreeStore_Units_ByOwner(t, newFn())
+	testTreeStore_Units_ByUnitMetadata(t, newFn())
 	testTreeStore_Def(t, newFn())
 	testTreeStore_Defs(t, newFn())
 	testTreeStore_Defs_Query(t, newFn())
@@ -41,6 +44,7 @@ func testTreeStore(t *testing.T, newFn func() TreeStoreImporter) {
 	testTreeStore_Refs(t, newFn())
 	testTreeStore_Refs_ByFiles(t, newFn())
 	testTreeStore_Refs_ByDef(t, newFn())
+	testTreeStore_resultOrder(t, newFn())
 }
 
 func testTreeStore_uninitialized(t *testing.T, ts TreeStore) {
@@ -198,6 +202,42 @@ func testTreeStore_Units(t *testing.T, ts TreeStoreImporter) {
 	}
 }
 
+func testTreeStore_Units_ByFilesIgnoreCase(t *testing.T, ts TreeStoreImporter) {
+	units := []*unit.SourceUnit{
+		{Key: unit.Key{Type: "t1", Name: "u1"}, Info: unit.Info{Files: []string{"d/F1"}}},
+		{Key: unit.Key{Type: "t2", Name: "u2"}, Info: unit.Info{Files: []string{"d/f2"}}},
+	}
+	for _, unit := range units {
+		if err := ts.Import(unit, graph.Output{}); err != nil {
+			t.Errorf("%s: Import(%v, empty data): %s", ts, unit, err)
+		}
+	}
+	if ts, ok := ts.(TreeIndexer); ok {
+		if err := ts.Index(); err != nil {
+			t.Fatalf("%s: Index: %s", ts, err)
+		}
+	}
+
+	tests := []struct {
+		filter    UnitFilter
+		wantUnits int
+	}{
+		{ByFiles(false, "./d/F1"), 1},
+		{ByFiles(false, "d/f1"), 0},
+		{ByFilesIgnoreCase(false, "d/f1"), 1},
+		{ByFilesIgnoreCase(false, "D"), 2},
+	}
+	for _, test := range tests {
+		got, err := ts.Units(test.filter)
+		if err != nil {
+			t.Fatalf("%s: Units(%v): %s", ts, test.filter, err)
+		}
+		if len(got) != test.wantUnits {
+			t.Errorf("%s: Units(%v): got %d units, want %d", ts, test.filter, len(got), test.wantUnits)
+		}
+	}
+}
+
 func testTreeStore_Units_ByFile(t *testing.T, ts TreeStoreImporter) {
 	want := []*unit.SourceUnit{
 		{Key: unit.Key{Type: "t1", Name: "u1"}, Info: unit.Info{Files: []string{"f1"}}},
@@ -249,6 +289,58 @@ func testTreeStore_Units_ByFile(t *testing.T, ts TreeStoreImporter) {
 	}
 }
 
+func testTreeStore_Units_ByOwner(t *testing.T, ts TreeStoreImporter) {
+	units := []*unit.SourceUnit{
+		{Key: unit.Key{Type: "t1", Name: "u1"}, Info: unit.Info{Owners: []string{"@org/a"}}},
+		{Key: unit.Key{Type: "t2", Name: "u2"}, Info: unit.Info{Owners: []string{"@org/a", "@org/b"}}},
+		{Key: unit.Key{Type: "t3", Name: "u3"}},
+	}
+	for _, unit := range units {
+		if err := ts.Import(unit, graph.Output{}); err != nil {
+			t.Errorf("%s: Import(%v, empty data): %s", ts, unit, err)
+		}
+	}
+	if ts, ok := ts.(TreeIndexer); ok {
+		if err := ts.Index(); err != nil {
+			t.Fatalf("%s: Index: %s", ts, err)
+		}
+	}
+
+	got, err := ts.Units(ByOwner("@ORG/b"))
+	if err != nil {
+		t.Fatalf("%s: Units(ByOwner): %s", ts, err)
+	}
+	if want := units[1:2]; !deepEqual(got, want) {
+		t.Errorf("%s: Units(ByOwner): got %v, want %v", ts, got, want)
+	}
+}
+
+func testTreeStore_Units_ByUnitMetadata(t *testing.T, ts TreeStoreImporter) {
+	units := []*unit.SourceUnit{
+		{Key: unit.Key{Type: "t1", Name: "u1"}, Info: unit.Info{Metadata: map[string]string{"version": "1.0", "tags": "linux"}}},
+		{Key: unit.Key{Type: "t2", Name: "u2"}, Info: unit.Info{Metadata: map[string]string{"version": "2.0"}}},
+		{Key: unit.Key{Type: "t3", Name: "u3"}},
+	}
+	for _, unit := range units {
+		if err := ts.Import(unit, graph.Output{}); err != nil {
+			t.Errorf("%s: Import(%v, empty data): %s", ts, unit, err)
+		}
+	}
+	if ts, ok := ts.(TreeIndexer); ok {
+		if err := ts.Index(); err != nil {
+			t.Fatalf("%s: Index: %s", ts, err)
+		}
+	}
+
+	got, err := ts.Units(ByUnitMetadata("version", "2.0"))
+	if err != nil {
+		t.Fatalf("%s: Units(ByUnitMetadata): %s", ts, err)
+	}
+	if want := units[1:2]; !deepEqual(got, want) {
+		t.Errorf("%s: Units(ByUnitMetadata): got %v, want %v", ts, got, want)
+	}
+}
+
 func testTreeStore_Def(t *testing.T, ts TreeStoreImporter) {
 	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
 	data := graph.Output{
@@ -809,3 +901,48 @@ func testTreeStore_Refs_ByDef(t *testing.T, ts TreeStoreImporter) {
 		}
 	}
 }
+
+func testTreeStore_resultOrder(t *testing.T, ts TreeStoreImporter) {
+	// Import data in non-canonical order.
+	for _, u := range []string{"u2", "u1"} {
+		unit := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: u}, Info: unit.Info{Files: []string{"f1", "f2"}}}
+		data := graph.Output{
+			Defs: []*graph.Def{
+				{DefKey: graph.DefKey{Path: "q"}, Name: "q", File: "f2"},
+				{DefKey: graph.DefKey{Path: "p"}, Name: "p", File: "f1"},
+			},
+			Refs: []*graph.Ref{
+				{DefPath: "q", File: "f2", Start: 1, End: 2},
+				{DefPath: "p", File: "f1", Start: 3, End: 4},
+				{DefPath: "q", File: "f1", Start: 1, End: 2},
+			},
+		}
+		if err := ts.Import(unit, data); err != nil {
+			t.Fatalf("%s: Import(%v, data): %s", ts, unit, err)
+		}
+	}
+	if ts, ok := ts.(TreeIndexer); ok {
+		if err := ts.Index(); err != nil {
+			t.Fatalf("%s: Index: %s", ts, err)
+		}
+	}
+
+	for _, f := range [][]DefFilter{nil, {ByUnits(unit.ID2{Type: "t", Name: "u2"}, unit.ID2{Type: "t", Name: "u1"})}, {ByDefPath("p")}, {ByFiles(false, "f1", "f2")}} {
+		defs, err := ts.Defs(f...)
+		if err != nil {
+			t.Fatalf("%s: Defs(%v): %s", ts, f, err)
+		}
+		if len(defs) == 0 || !sort.IsSorted(defsInCanonicalOrder(defs)) {
+			t.Errorf("%s: Defs(%v): got defs %v, want them in canonical order", ts, f, defs)
+		}
+	}
+	for _, f := range [][]RefFilter{nil, {ByFiles(false, "f1")}, {ByRefDef(graph.RefDefKey{DefUnitType: "t", DefUnit: "u1", DefPath: "q"})}} {
+		refs, err := ts.Refs(f...)
+		if err != nil {
+			t.Fatalf("%s: Refs(%v): %s", ts, f, err)
+		}
+		if len(refs) == 0 || !sort.IsSorted(refsInCanonicalOrder(refs)) {
+			t.Errorf("%s: Refs(%v): got refs %v, want them in canonical order", ts, f, refs)
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package store
 
+import "time"
+
 // scopeTrees returns a list of commit IDs that are matched by the
 // filters. If potentially all commits could match, or if enough
 // commits could potentially match that it would probably be cheaper
@@ -56,12 +58,15 @@ type treeStoreOpener interface {
 // openCommitstores is a helper func that calls o.openTreeStore for
 // each tree returned by scopeTrees(filters...).
 func openTreeStores(o treeStoreOpener, filters interface{}) (map[string]TreeStore, error) {
+	t := queryTraceOf(filters)
+	defer t.stage("open trees", time.Now())
 	commitIDs, err := scopeTrees(storeFilters(filters))
 	if err != nil {
 		return nil, err
 	}
 
 	if commitIDs == nil {
+		t.strategy("all trees")
 		return o.openAllTreeStores()
 	}
 
@@ -0,0 +1,162 @@
+package store
+
+import (
+	"fmt"
+	"sync"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// TwoPhaseImporter imports trees into multiple stores (e.g., a local
+// FS store and its mirror on S3) so that the stores can't diverge
+// after a partial failure: each version is created in all of the
+// stores or in none of them.
+//
+// Importing and indexing (Import and Index) are the prepare phase:
+// the data is written to each store, but it isn't visible to queries
+// until its version is created. CreateVersion is the commit phase: it
+// creates the version in each store. If any store fails in either
+// phase, the version's data is removed from all of the stores (and
+// the version is removed from the stores in which it was already
+// created). Callers that abandon an import midway (e.g., because a
+// build failed) should call Rollback to discard the prepared data.
+//
+// Only new versions may be imported, because the previous data of a
+// version that already exists in a store couldn't be restored if the
+// import were rolled back.
+type TwoPhaseImporter struct {
+	stores []MultiRepoStoreImporter
+
+	mu       sync.Mutex
+	prepared map[Version]struct{} // versions imported but not yet committed or rolled back
+}
+
+var (
+	_ MultiRepoImporter = (*TwoPhaseImporter)(nil)
+	_ MultiRepoIndexer  = (*TwoPhaseImporter)(nil)
+)
+
+// NewTwoPhaseImporter returns an importer that imports into all of
+// the given stores. Imports are rolled back by deleting the version
+// from each store (with MultiRepoDeleter.Delete).
+func NewTwoPhaseImporter(stores ...MultiRepoStoreImporter) *TwoPhaseImporter {
+	return &TwoPhaseImporter{stores: stores, prepared: map[Version]struct{}{}}
+}
+
+// prepare records that version v is being imported, checking that it
+// doesn't already exist in any of the stores.
+func (c *TwoPhaseImporter) prepare(v Version) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, present := c.prepared[v]; present {
+		return nil
+	}
+	for _, s := range c.stores {
+		versions, err := s.Versions(ByRepoCommitIDs(v))
+		if err != nil && !isStoreNotExist(err) {
+			return err
+		}
+		if len(versions) > 0 {
+			return fmt.Errorf("two-phase import of %s@%s: version already exists in store %s (only new versions may be imported)", v.Repo, v.CommitID, s)
+		}
+	}
+	c.prepared[v] = struct{}{}
+	return nil
+}
+
+// isPrepared reports whether version v is being imported.
+func (c *TwoPhaseImporter) isPrepared(v Version) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, present := c.prepared[v]
+	return present
+}
+
+// Import implements MultiRepoImporter. It imports the source unit's
+// data into each store. If any store fails, the version is rolled
+// back.
+func (c *TwoPhaseImporter) Import(repo, commitID string, u *unit.SourceUnit, data graph.Output) error {
+	v := Version{Repo: repo, CommitID: commitID}
+	if err := c.prepare(v); err != nil {
+		return err
+	}
+	for _, s := range c.stores {
+		if err := s.Import(repo, commitID, u, data); err != nil {
+			return c.abort(v, fmt.Errorf("import into store %s: %s", s, err))
+		}
+	}
+	return nil
+}
+
+// Index implements MultiRepoIndexer. It builds the version's indexes
+// in each store that can be indexed. If any store fails, the version
+// is rolled back.
+func (c *TwoPhaseImporter) Index(repo, commitID string) error {
+	v := Version{Repo: repo, CommitID: commitID}
+	if !c.isPrepared(v) {
+		return fmt.Errorf("two-phase index of %s@%s: version was not imported", repo, commitID)
+	}
+	for _, s := range c.stores {
+		if s, ok := s.(MultiRepoIndexer); ok {
+			if err := s.Index(repo, commitID); err != nil {
+				return c.abort(v, fmt.Errorf("index in store %s: %s", s, err))
+			}
+		}
+	}
+	return nil
+}
+
+// CreateVersion implements MultiRepoImporter. It creates the version
+// in each store. If any store fails, the version is rolled back
+// (including in the stores in which it was already created).
+func (c *TwoPhaseImporter) CreateVersion(repo, commitID string) error {
+	v := Version{Repo: repo, CommitID: commitID}
+	if !c.isPrepared(v) {
+		return fmt.Errorf("two-phase commit of %s@%s: version was not imported", repo, commitID)
+	}
+	for _, s := range c.stores {
+		if err := s.CreateVersion(repo, commitID); err != nil {
+			return c.abort(v, fmt.Errorf("create version in store %s: %s", s, err))
+		}
+	}
+	c.mu.Lock()
+	delete(c.prepared, v)
+	c.mu.Unlock()
+	return nil
+}
+
+// Rollback discards the data of a version that was imported (but
+// whose version was not yet created) from all of the stores.
+func (c *TwoPhaseImporter) Rollback(repo, commitID string) error {
+	v := Version{Repo: repo, CommitID: commitID}
+	if !c.isPrepared(v) {
+		return fmt.Errorf("two-phase rollback of %s@%s: version was not imported", repo, commitID)
+	}
+	return c.rollback(v)
+}
+
+// abort rolls back version v after err occurred.
+func (c *TwoPhaseImporter) abort(v Version, err error) error {
+	if err2 := c.rollback(v); err2 != nil {
+		return fmt.Errorf("two-phase import of %s@%s: %s (and rollback failed, so the stores may have diverged: %s)", v.Repo, v.CommitID, err, err2)
+	}
+	return fmt.Errorf("two-phase import of %s@%s: %s (rolled back)", v.Repo, v.CommitID, err)
+}
+
+// rollback deletes version v from all of the stores. It attempts to
+// remove it from every store even if some of them fail, and returns
+// the first error.
+func (c *TwoPhaseImporter) rollback(v Version) error {
+	c.mu.Lock()
+	delete(c.prepared, v)
+	c.mu.Unlock()
+
+	var firstErr error
+	for _, s := range c.stores {
+		if err := s.Delete(v.Repo, v.CommitID); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("store %s: %s", s, err)
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,151 @@
+package store
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// failingImporter is a store whose imports or version creations fail
+// (if the corresponding field is set).
+type failingImporter struct {
+	*fsMultiRepoStore
+	failImport, failCreateVersion bool
+}
+
+func (s *failingImporter) Import(repo, commitID string, u *unit.SourceUnit, data graph.Output) error {
+	if s.failImport {
+		return errors.New("import failed")
+	}
+	return s.fsMultiRepoStore.Import(repo, commitID, u, data)
+}
+
+func (s *failingImporter) CreateVersion(repo, commitID string) error {
+	if s.failCreateVersion {
+		return errors.New("create version failed")
+	}
+	return s.fsMultiRepoStore.CreateVersion(repo, commitID)
+}
+
+func TestTwoPhaseImporter(t *testing.T) {
+	u1 := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u1"}}
+	u2 := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u2"}}
+	data := graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}, Name: "n"}}}
+
+	importTree := func(c *TwoPhaseImporter) error {
+		for _, u := range []*unit.SourceUnit{u1, u2} {
+			if err := c.Import("r", "c", u, data); err != nil {
+				return err
+			}
+		}
+		if err := c.Index("r", "c"); err != nil {
+			return err
+		}
+		return c.CreateVersion("r", "c")
+	}
+	checkUnits := func(label string, s MultiRepoStore, want int) {
+		units, err := s.Units(ByRepoCommitIDs(Version{Repo: "r", CommitID: "c"}))
+		if err != nil && !isStoreNotExist(err) {
+			t.Fatal(err)
+		}
+		if len(units) != want {
+			t.Errorf("%s: got %d units, want %d", label, len(units), want)
+		}
+	}
+
+	tests := map[string]struct {
+		failImport, failCreateVersion bool
+	}{
+		"ok":                   {},
+		"import fails":         {failImport: true},
+		"create version fails": {failCreateVersion: true},
+	}
+	for label, test := range tests {
+		s1 := NewFSMultiRepoStore(newTestFS(), nil).(*fsMultiRepoStore)
+		s2 := &failingImporter{
+			fsMultiRepoStore:  NewFSMultiRepoStore(newTestFS(), nil).(*fsMultiRepoStore),
+			failImport:        test.failImport,
+			failCreateVersion: test.failCreateVersion,
+		}
+		c := NewTwoPhaseImporter(s1, s2)
+
+		err := importTree(c)
+		if ok := !test.failImport && !test.failCreateVersion; ok {
+			if err != nil {
+				t.Fatalf("%s: %s", label, err)
+			}
+			checkUnits(label+": store 1", s1, 2)
+			checkUnits(label+": store 2", s2, 2)
+			if err := importTree(c); err == nil {
+				t.Errorf("%s: reimport: got nil error, want an error (version exists)", label)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: got nil error", label)
+			continue
+		}
+		for i, s := range []MultiRepoStore{s1, s2} {
+			if versions, err := s.Versions(); err != nil && !isStoreNotExist(err) {
+				t.Fatal(err)
+			} else if len(versions) != 0 {
+				t.Errorf("%s: store %d: got versions %v after rollback, want none", label, i+1, versions)
+			}
+		}
+
+		// The rolled-back data must be gone, not merely hidden.
+		if err := s1.CreateVersion("r", "c"); err != nil {
+			t.Fatal(err)
+		}
+		checkUnits(label+": store 1 after rollback", s1, 0)
+	}
+}
+
+func TestTwoPhaseImporter_Rollback(t *testing.T) {
+	s1 := NewFSMultiRepoStore(newTestFS(), nil)
+	s2 := NewFSMultiRepoStore(newTestFS(), nil)
+	c := NewTwoPhaseImporter(s1, s2)
+	if err := c.Import("r", "c", &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}, graph.Output{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rollback("r", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateVersion("r", "c"); err == nil {
+		t.Error("CreateVersion after Rollback: got nil error")
+	}
+	for i, s := range []MultiRepoStoreImporter{s1, s2} {
+		if err := s.CreateVersion("r", "c"); err != nil {
+			t.Fatal(err)
+		}
+		if units, err := s.Units(); err != nil {
+			t.Fatal(err)
+		} else if len(units) != 0 {
+			t.Errorf("store %d: got %d units after rollback, want 0", i+1, len(units))
+		}
+	}
+}
+
+func TestTwoPhaseImporter_rollbackDeletes(t *testing.T) {
+	var deleted []Version
+	s := MockMultiRepoStore{
+		Versions_: func(...VersionFilter) ([]*Version, error) { return nil, nil },
+		Import_: func(repo, commitID string, u *unit.SourceUnit, data graph.Output) error {
+			return errors.New("import failed")
+		},
+		Delete_: func(repo, commitID string) error {
+			deleted = append(deleted, Version{Repo: repo, CommitID: commitID})
+			return nil
+		},
+	}
+	c := NewTwoPhaseImporter(s)
+	if err := c.Import("r", "c", &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}, graph.Output{}); err == nil {
+		t.Fatal("got nil error from failing import")
+	}
+	if want := []Version{{Repo: "r", CommitID: "c"}}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("got deleted versions %v, want %v", deleted, want)
+	}
+}
@@ -68,7 +68,10 @@ func (x *unitFilesIndex) Covers(filters interface{}) int {
 func (x *unitFilesIndex) Units(fs ...UnitFilter) ([]unit.ID2, error) {
 	for _, f := range fs {
 		if ff, ok := f.(ByFilesFilter); ok {
-			files := ff.ByFiles()
+			files, err := indexFilesForLookup(x.phtable, ff)
+			if err != nil {
+				return nil, err
+			}
 			umap := map[unit.ID2]struct{}{}
 			for _, file := range files {
 				u, _, err := x.getByPath(file)
@@ -100,7 +103,15 @@ func (x *unitFilesIndex) Build(units []*unit.SourceUnit) error {
 			f2u.add(f, u.ID2())
 		}
 	}
-	b := phtable.Builder(len(f2u))
+	files := make([]string, 0, len(f2u))
+	for file := range f2u {
+		files = append(files, file)
+	}
+	folded, err := foldedFileKeys(files)
+	if err != nil {
+		return err
+	}
+	b := phtable.Builder(len(f2u) + len(folded))
 	for file, fileUnits := range f2u {
 		ub, err := binary.Marshal(fileUnits)
 		if err != nil {
@@ -108,10 +119,16 @@ func (x *unitFilesIndex) Build(units []*unit.SourceUnit) error {
 		}
 		b.Add([]byte(file), ub)
 	}
+	for k, v := range folded {
+		b.Add([]byte(k), v)
+	}
 	h, err := b.Build()
 	if err != nil {
 		return err
 	}
+	// Store the keys so that lookups of files that aren't in the
+	// index (and case-folded keys) can't return another key's value.
+	h.StoreKeys = true
 	x.phtable = h
 	x.ready = true
 	vlog.Printf("unitFilesIndex: done building index.")
@@ -1,19 +1,24 @@
 package store
 
 import (
+	"sort"
 	"sync"
 
 	"github.com/neelance/parallel"
 	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
 )
 
 // A UnitStore stores and accesses srclib build data for a single
 // source unit.
 type UnitStore interface {
-	// Defs returns all defs that match the filter.
+	// Defs returns all defs that match the filter. A store for a
+	// single source unit returns them in no particular order (see
+	// "CONVENTION - RESULT ORDERING" in the package docs).
 	Defs(...DefFilter) ([]*graph.Def, error)
 
-	// Refs returns all refs that match the filter.
+	// Refs returns all refs that match the filter (in no particular
+	// order, like Defs).
 	Refs(...RefFilter) ([]*graph.Ref, error)
 
 	// TODO(sqs): how to deal with depresolve and other non-graph
@@ -45,6 +50,10 @@ type unitStores struct {
 var _ UnitStore = (*unitStores)(nil)
 
 func (s unitStores) Defs(fs ...DefFilter) ([]*graph.Def, error) {
+	if defs, paged, err := PagedDefs(s.Defs, fs); paged {
+		return defs, err
+	}
+
 	uss, err := openUnitStores(s.opener, fs)
 	if err != nil {
 		return nil, err
@@ -54,14 +63,27 @@ func (s unitStores) Defs(fs ...DefFilter) ([]*graph.Def, error) {
 		allDefs   []*graph.Def
 		allDefsMu sync.Mutex
 	)
+	limit, limited := ScanLimit(fs)
 	par := parallel.NewRun(storeFetchPar)
-	for u_, us_ := range uss {
-		u, us := u_, us_
+	if limited {
+		// Query the units one at a time, in the canonical order,
+		// until enough defs have been found.
+		par = parallel.NewRun(1)
+	}
+	for _, u_ := range sortedUnitIDs(uss) {
+		u, us := u_, uss[u_]
 		if us == nil {
 			continue
 		}
 
 		par.Acquire()
+		allDefsMu.Lock()
+		enough := limited && len(allDefs) >= limit
+		allDefsMu.Unlock()
+		if enough {
+			par.Release()
+			break
+		}
 		go func() {
 			defer par.Release()
 			defs, err := us.Defs(filtersForUnit(u, fs).([]DefFilter)...)
@@ -79,12 +101,17 @@ func (s unitStores) Defs(fs ...DefFilter) ([]*graph.Def, error) {
 		}()
 	}
 	err = par.Wait()
+	sortDefs(allDefs, fs)
 	return allDefs, err
 }
 
 var c_unitStores_Refs_last_numUnitsQueried = &counter{count: new(int64)}
 
 func (s unitStores) Refs(f ...RefFilter) ([]*graph.Ref, error) {
+	if refs, paged, err := PagedRefs(s.Refs, f); paged {
+		return refs, err
+	}
+
 	uss, err := openUnitStores(s.opener, f)
 	if err != nil {
 		return nil, err
@@ -95,21 +122,33 @@ func (s unitStores) Refs(f ...RefFilter) ([]*graph.Ref, error) {
 		allRefsMu sync.Mutex
 		allRefs   []*graph.Ref
 	)
+	limit, limited := ScanLimit(f)
 	par := parallel.NewRun(storeFetchPar)
-	for u, us := range uss {
+	if limited {
+		// Query the units one at a time, in the canonical order,
+		// until enough refs have been found.
+		par = parallel.NewRun(1)
+	}
+	for _, u := range sortedUnitIDs(uss) {
+		us := uss[u]
 		if us == nil {
 			continue
 		}
-		u, us := u, us
+		u := u
+
+		par.Acquire()
+		allRefsMu.Lock()
+		enough := limited && len(allRefs) >= limit
+		allRefsMu.Unlock()
+		if enough {
+			par.Release()
+			break
+		}
 
 		c_unitStores_Refs_last_numUnitsQueried.increment()
 
-		par.Acquire()
 		go func() {
 			defer par.Release()
-			if _, moreOK := LimitRemaining(f); !moreOK {
-				return
-			}
 			fCopy := filtersForUnit(u, f).([]RefFilter)
 			fCopy = withImpliedUnit(fCopy, u)
 
@@ -135,9 +174,20 @@ func (s unitStores) Refs(f ...RefFilter) ([]*graph.Ref, error) {
 		}()
 	}
 	err = par.Wait()
+	sortRefs(allRefs, f)
 	return allRefs, err
 }
 
+// sortedUnitIDs returns the source units of uss in sorted order.
+func sortedUnitIDs(uss map[unit.ID2]UnitStore) []unit.ID2 {
+	units := make([]unit.ID2, 0, len(uss))
+	for u := range uss {
+		units = append(units, u)
+	}
+	sort.Sort(unitID2s(units))
+	return units
+}
+
 func cleanForImport(data *graph.Output, repo, unitType, unit string) {
 	for _, def := range data.Defs {
 		def.Unit = ""
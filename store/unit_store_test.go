@@ -16,9 +16,14 @@ func testUnitStore(t *testing.T, newFn func() UnitStoreImporter) {
 	testUnitStore_Defs(t, newFn())
 	testUnitStore_Defs_SortByName(t, newFn())
 	testUnitStore_Defs_Query(t, newFn())
+	testUnitStore_Defs_ByAuthor(t, newFn())
+	testUnitStore_Defs_ByOwner(t, newFn())
+	testUnitStore_Defs_LimitOffset(t, newFn())
 	testUnitStore_Refs(t, newFn())
 	testUnitStore_Refs_ByFiles(t, newFn())
+	testUnitStore_Refs_ByFilesIgnoreCase(t, newFn())
 	testUnitStore_Refs_ByDef(t, newFn())
+	testUnitStore_Refs_LimitOffset(t, newFn())
 }
 
 func testUnitStore_uninitialized(t *testing.T, us UnitStore) {
@@ -274,6 +279,89 @@ func testUnitStore_Defs_Query(t *testing.T, us UnitStoreImporter) {
 	}
 }
 
+func testUnitStore_Defs_ByAuthor(t *testing.T, us UnitStoreImporter) {
+	data := graph.Output{
+		Defs: []*graph.Def{
+			{DefKey: graph.DefKey{Path: "p1"}, Author: "a@example.com", AuthorCommitID: "c1"},
+			{DefKey: graph.DefKey{Path: "p2"}, Author: "b@example.com", AuthorCommitID: "c2"},
+			{DefKey: graph.DefKey{Path: "p3"}},
+		},
+	}
+	if err := us.Import(data); err != nil {
+		t.Errorf("%s: Import(data): %s", us, err)
+	}
+
+	defs, err := us.Defs(ByAuthor("A@example.com"))
+	if err != nil {
+		t.Fatalf("%s: Defs(ByAuthor): %s", us, err)
+	}
+	if got, want := defPaths(defs), []string{"p1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: Defs(ByAuthor): got defs %v, want %v", us, got, want)
+	}
+	if len(defs) == 1 && defs[0].AuthorCommitID != "c1" {
+		t.Errorf("%s: Defs(ByAuthor): got AuthorCommitID %q, want %q", us, defs[0].AuthorCommitID, "c1")
+	}
+}
+
+func testUnitStore_Defs_ByOwner(t *testing.T, us UnitStoreImporter) {
+	data := graph.Output{
+		Defs: []*graph.Def{
+			{DefKey: graph.DefKey{Path: "p1"}, Owners: []string{"@org/a"}},
+			{DefKey: graph.DefKey{Path: "p2"}, Owners: []string{"@org/b", "@org/c"}},
+			{DefKey: graph.DefKey{Path: "p3"}},
+		},
+	}
+	if err := us.Import(data); err != nil {
+		t.Errorf("%s: Import(data): %s", us, err)
+	}
+
+	defs, err := us.Defs(ByOwner("@org/C", "@org/d"))
+	if err != nil {
+		t.Fatalf("%s: Defs(ByOwner): %s", us, err)
+	}
+	if got, want := defPaths(defs), []string{"p2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: Defs(ByOwner): got defs %v, want %v", us, got, want)
+	}
+}
+
+func testUnitStore_Defs_LimitOffset(t *testing.T, us UnitStoreImporter) {
+	data := graph.Output{
+		Defs: []*graph.Def{
+			{DefKey: graph.DefKey{Path: "p3"}, Name: "a"},
+			{DefKey: graph.DefKey{Path: "p1"}, Name: "c"},
+			{DefKey: graph.DefKey{Path: "p4"}, Name: "b"},
+			{DefKey: graph.DefKey{Path: "p2"}, Name: "d"},
+		},
+	}
+	if err := us.Import(data); err != nil {
+		t.Errorf("%s: Import(data): %s", us, err)
+	}
+
+	tests := []struct {
+		filters []DefFilter
+		want    []string
+	}{
+		{[]DefFilter{First(2)}, []string{"p1", "p2"}},
+		{[]DefFilter{Offset(1), First(2)}, []string{"p2", "p3"}},
+		{[]DefFilter{Offset(3)}, []string{"p4"}},
+		{[]DefFilter{Offset(4), First(1)}, nil},
+		{[]DefFilter{DefsSortByName{}, Offset(1), First(2)}, []string{"p4", "p1"}},
+	}
+	for _, test := range tests {
+		defs, err := us.Defs(test.filters...)
+		if err != nil {
+			t.Errorf("%s: Defs(%v): %s", us, test.filters, err)
+		}
+		var paths []string
+		for _, def := range defs {
+			paths = append(paths, def.Path)
+		}
+		if !reflect.DeepEqual(paths, test.want) {
+			t.Errorf("%s: Defs(%v): got defs %v, want %v", us, test.filters, paths, test.want)
+		}
+	}
+}
+
 func testUnitStore_Refs(t *testing.T, us UnitStoreImporter) {
 	data := graph.Output{
 		Refs: []*graph.Ref{
@@ -350,6 +438,39 @@ func testUnitStore_Refs_ByFiles(t *testing.T, us UnitStoreImporter) {
 	}
 }
 
+func testUnitStore_Refs_ByFilesIgnoreCase(t *testing.T, us UnitStoreImporter) {
+	data := graph.Output{
+		Refs: []*graph.Ref{
+			{DefPath: "p1", File: "d/F1", Start: 0, End: 5},
+			{DefPath: "p2", File: "d/f1", Start: 5, End: 10},
+			{DefPath: "p3", File: "d/f2", Start: 10, End: 15},
+		},
+	}
+	if err := us.Import(data); err != nil {
+		t.Errorf("%s: Import(data): %s", us, err)
+	}
+
+	tests := []struct {
+		filter   RefFilter
+		wantRefs int
+	}{
+		{ByFiles(true, "./d/f1"), 1},
+		{ByFiles(true, "d/x"), 0},
+		{ByFilesIgnoreCase(true, "D/F1"), 2},
+		{ByFilesIgnoreCase(true, "d/x"), 0},
+		{ByFilesIgnoreCase(true, "d/f1", "D/F2"), 3},
+	}
+	for _, test := range tests {
+		refs, err := us.Refs(test.filter)
+		if err != nil {
+			t.Fatalf("%s: Refs(%v): %s", us, test.filter, err)
+		}
+		if len(refs) != test.wantRefs {
+			t.Errorf("%s: Refs(%v): got %d refs, want %d", us, test.filter, len(refs), test.wantRefs)
+		}
+	}
+}
+
 func testUnitStore_Refs_ByDef(t *testing.T, us UnitStoreImporter) {
 	refsByDef := map[string][]*graph.Ref{
 		"p1": {
@@ -404,3 +525,40 @@ func defPaths(defs []*graph.Def) []string {
 	sort.Strings(dps)
 	return dps
 }
+
+func testUnitStore_Refs_LimitOffset(t *testing.T, us UnitStoreImporter) {
+	data := graph.Output{
+		Refs: []*graph.Ref{
+			{DefPath: "p3", File: "f2", Start: 1, End: 2},
+			{DefPath: "p2", File: "f1", Start: 3, End: 4},
+			{DefPath: "p1", File: "f1", Start: 3, End: 4},
+			{DefPath: "p4", File: "f1", Start: 1, End: 2},
+		},
+	}
+	if err := us.Import(data); err != nil {
+		t.Errorf("%s: Import(data): %s", us, err)
+	}
+
+	tests := []struct {
+		filters []RefFilter
+		want    []string
+	}{
+		{[]RefFilter{First(2)}, []string{"p4", "p1"}},
+		{[]RefFilter{Offset(1), First(2)}, []string{"p1", "p2"}},
+		{[]RefFilter{Offset(3)}, []string{"p3"}},
+		{[]RefFilter{Offset(4), First(1)}, nil},
+	}
+	for _, test := range tests {
+		refs, err := us.Refs(test.filters...)
+		if err != nil {
+			t.Errorf("%s: Refs(%v): %s", us, test.filters, err)
+		}
+		var defPaths []string
+		for _, ref := range refs {
+			defPaths = append(defPaths, ref.DefPath)
+		}
+		if !reflect.DeepEqual(defPaths, test.want) {
+			t.Errorf("%s: Refs(%v): got refs to %v, want %v", us, test.filters, defPaths, test.want)
+		}
+	}
+}
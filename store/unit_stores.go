@@ -3,6 +3,7 @@ package store
 import (
 	"fmt"
 	"reflect"
+	"time"
 
 	"sourcegraph.com/sourcegraph/srclib/unit"
 )
@@ -52,6 +53,25 @@ func scopeUnits(filters []interface{}) ([]unit.ID2, error) {
 	return ids, nil
 }
 
+// scopeUnitTypes returns the set of unit types that are matched by
+// the filters, or nil if potentially all unit types could match. If
+// none match, an empty (non-nil) set is returned.
+func scopeUnitTypes(filters []interface{}) map[string]struct{} {
+	var unitTypes map[string]struct{}
+	for _, f := range filters {
+		if f, ok := f.(ByUnitTypesFilter); ok {
+			newUnitTypes := make(map[string]struct{}, len(f.ByUnitTypes()))
+			for _, t := range f.ByUnitTypes() {
+				if _, present := unitTypes[t]; unitTypes == nil || present {
+					newUnitTypes[t] = struct{}{}
+				}
+			}
+			unitTypes = newUnitTypes // intersect
+		}
+	}
+	return unitTypes
+}
+
 // A unitStoreOpener opens the UnitStore for the specified source
 // unit.
 type unitStoreOpener interface {
@@ -62,18 +82,34 @@ type unitStoreOpener interface {
 // openUnitStores is a helper func that calls o.openUnitStore for each
 // unit returned by scopeUnits(filters...).
 func openUnitStores(o unitStoreOpener, filters interface{}) (map[unit.ID2]UnitStore, error) {
+	t := queryTraceOf(filters)
+	defer t.stage("open units", time.Now())
 	unitIDs, err := scopeUnits(storeFilters(filters))
 	if err != nil {
 		return nil, err
 	}
 
+	unitTypes := scopeUnitTypes(storeFilters(filters))
+
 	if unitIDs == nil {
-		return o.openAllUnitStores()
+		t.strategy("all units")
+		uss, err := o.openAllUnitStores()
+		if err != nil || unitTypes == nil {
+			return uss, err
+		}
+		for u := range uss {
+			if _, present := unitTypes[u.Type]; !present {
+				delete(uss, u)
+			}
+		}
+		return uss, nil
 	}
 
 	uss := make(map[unit.ID2]UnitStore, len(unitIDs))
 	for _, u := range unitIDs {
-		uss[u] = o.openUnitStore(u)
+		if _, present := unitTypes[u.Type]; unitTypes == nil || present {
+			uss[u] = o.openUnitStore(u)
+		}
 	}
 	return uss, nil
 }
@@ -118,6 +154,14 @@ func filtersForUnit(unit unit.ID2, filters interface{}) interface{} {
 			if !found {
 				panic(fmt.Sprintf("in ByUnitsFilter, no unit == %v", unit))
 			}
+
+		case *byDeprecatedFilter:
+			if f.overlay != nil {
+				unitFilters[i+d] = f.forUnit(unit)
+			}
+
+		case *overlayShadowFilter:
+			unitFilters[i+d] = f.forUnit(unit)
 		}
 	}
 
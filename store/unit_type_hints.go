@@ -0,0 +1,235 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+)
+
+// unitTypeHintsFilename is the name of the file (in a repo's dir) that
+// holds the repo's unit type hints: a JSON object mapping each commit
+// ID to the sorted unit types of the source units in its tree.
+//
+// Multi-repo queries with ByUnitTypes filters consult the hints to skip
+// repos that have no source units of the types, without opening their
+// trees. The hints may list unit types that a tree no longer contains
+// (e.g., if a unit was reimported without data), which only makes the
+// routing less selective. Trees that have no hints (because they were
+// imported before hints were recorded) are never skipped.
+const unitTypeHintsFilename = "__unit_types"
+
+func (s *fsRepoStore) readUnitTypeHints() (map[string][]string, error) {
+	f, err := s.fs.Open(unitTypeHintsFilename)
+	if os.IsNotExist(err) {
+		return map[string][]string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var hints map[string][]string
+	if err := json.NewDecoder(f).Decode(&hints); err != nil {
+		return nil, fmt.Errorf("reading %s: %s", unitTypeHintsFilename, err)
+	}
+	if hints == nil {
+		hints = map[string][]string{}
+	}
+	return hints, nil
+}
+
+func (s *fsRepoStore) writeUnitTypeHints(hints map[string][]string) (err error) {
+	if len(hints) == 0 {
+		if err := s.fs.Remove(unitTypeHintsFilename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	f, err := s.fs.Create(unitTypeHintsFilename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := f.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+	return json.NewEncoder(f).Encode(hints)
+}
+
+// updateUnitTypeHints calls fn with repo's unit type hints and writes
+// the result.
+func (s *fsMultiRepoStore) updateUnitTypeHints(repo string, fn func(map[string][]string)) error {
+	s.unitTypeHintsMu.Lock()
+	defer s.unitTypeHintsMu.Unlock()
+	rs := s.openRepoStore(repo).(*fsRepoStore)
+	hints, err := rs.readUnitTypeHints()
+	if err != nil {
+		return err
+	}
+	fn(hints)
+	return rs.writeUnitTypeHints(hints)
+}
+
+// addUnitTypeHint records that the tree at commitID in repo contains
+// a source unit of unitType.
+func (s *fsMultiRepoStore) addUnitTypeHint(repo, commitID, unitType string) error {
+	return s.updateUnitTypeHints(repo, func(hints map[string][]string) {
+		types := hints[commitID]
+		i := sort.SearchStrings(types, unitType)
+		if i < len(types) && types[i] == unitType {
+			return
+		}
+		types = append(types, "")
+		copy(types[i+1:], types[i:])
+		types[i] = unitType
+		hints[commitID] = types
+	})
+}
+
+// setUnitTypeHints records the unit types of the source units in the
+// tree at commitID in repo, replacing the tree's existing hints (which
+// may be incomplete if the tree was imported before hints were
+// recorded).
+func (s *fsMultiRepoStore) setUnitTypeHints(repo, commitID string) error {
+	units, err := s.openRepoStore(repo).(*fsRepoStore).newTreeStore(commitID).Units()
+	if err != nil && !isStoreNotExist(err) {
+		return err
+	}
+	seen := map[string]struct{}{}
+	types := []string{}
+	for _, u := range units {
+		if _, present := seen[u.Type]; !present {
+			seen[u.Type] = struct{}{}
+			types = append(types, u.Type)
+		}
+	}
+	sort.Strings(types)
+	return s.updateUnitTypeHints(repo, func(hints map[string][]string) {
+		hints[commitID] = types
+	})
+}
+
+// removeUnitTypeHints removes the hints of the tree at commitID in
+// repo.
+func (s *fsMultiRepoStore) removeUnitTypeHints(repo, commitID string) error {
+	return s.updateUnitTypeHints(repo, func(hints map[string][]string) {
+		delete(hints, commitID)
+	})
+}
+
+// A unitTypeRouter is a repoStoreOpener that can tell which repos
+// might contain source units of a set of unit types (see
+// ByUnitTypes), so that queries can skip the other repos.
+type unitTypeRouter interface {
+	// reposWithUnitTypes returns the repos (of repos) that might
+	// contain source units of any of the unit types in the trees
+	// that the filters select.
+	reposWithUnitTypes(repos []string, unitTypes map[string]struct{}, filters []interface{}) ([]string, error)
+}
+
+func (s *fsMultiRepoStore) reposWithUnitTypes(repos []string, unitTypes map[string]struct{}, filters []interface{}) ([]string, error) {
+	var kept []string
+	for _, repo := range repos {
+		ok, err := s.mayHaveUnitTypes(repo, unitTypes, filters)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			kept = append(kept, repo)
+		}
+	}
+	return kept, nil
+}
+
+// mayHaveUnitTypes returns whether repo might contain source units of
+// any of the unit types in the trees that the filters select.
+func (s *fsMultiRepoStore) mayHaveUnitTypes(repo string, unitTypes map[string]struct{}, filters []interface{}) (bool, error) {
+	rs := s.openRepoStore(repo).(*fsRepoStore)
+	s.unitTypeHintsMu.Lock()
+	hints, err := rs.readUnitTypeHints()
+	s.unitTypeHintsMu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	if len(hints) == 0 {
+		return true, nil // no hints recorded
+	}
+
+	commitIDs := scopeCommitIDs(repo, filters)
+	if commitIDs == nil {
+		versions, err := rs.Versions()
+		if err != nil {
+			if isStoreNotExist(err) || os.IsNotExist(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		commitIDs = make([]string, len(versions))
+		for i, v := range versions {
+			commitIDs[i] = v.CommitID
+		}
+	}
+	for _, commitID := range commitIDs {
+		types, present := hints[commitID]
+		if !present {
+			if _, err := rs.fs.Stat(commitID); os.IsNotExist(err) {
+				continue // no such tree
+			} else if err != nil {
+				return false, err
+			}
+			return true, nil // no hints recorded for the tree
+		}
+		for _, t := range types {
+			if _, present := unitTypes[t]; present {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// scopeCommitIDs returns the commit IDs in repo that are selected by
+// the filters' ByCommitIDs and ByRepoCommitIDs filters, or nil if
+// potentially all commits could match.
+func scopeCommitIDs(repo string, filters []interface{}) []string {
+	var commitIDs []string
+	scoped := false
+	add := func(ids []string) {
+		if !scoped {
+			commitIDs, scoped = ids, true
+			return
+		}
+		var both []string // intersect
+		for _, id := range ids {
+			for _, id2 := range commitIDs {
+				if id == id2 {
+					both = append(both, id)
+					break
+				}
+			}
+		}
+		commitIDs = both
+	}
+	for _, f := range filters {
+		switch f := f.(type) {
+		case ByRepoCommitIDsFilter:
+			var ids []string
+			for _, v := range f.ByRepoCommitIDs() {
+				if graph.NormalizeRepoURI(v.Repo) == graph.NormalizeRepoURI(repo) {
+					ids = append(ids, v.CommitID)
+				}
+			}
+			add(ids)
+		case ByCommitIDsFilter:
+			add(f.ByCommitIDs())
+		}
+	}
+	if scoped && commitIDs == nil {
+		return []string{}
+	}
+	return commitIDs
+}
+
+var _ unitTypeRouter = (*fsMultiRepoStore)(nil)
@@ -0,0 +1,150 @@
+package store
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestFSMultiRepoStore_unitTypeRouting(t *testing.T) {
+	defer func(indexed bool) { useIndexedStore = indexed }(useIndexedStore)
+
+	for _, indexed := range []bool{false, true} {
+		useIndexedStore = indexed
+		mrs := NewFSMultiRepoStore(newTestFS(), nil).(*fsMultiRepoStore)
+		importUnit := func(repo, commitID, unitType string) {
+			u := &unit.SourceUnit{Key: unit.Key{Type: unitType, Name: "u"}}
+			data := graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}, Name: unitType}}}
+			if err := mrs.Import(repo, commitID, u, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		importUnit("r1", "c", "Go")
+		importUnit("r2", "c", "Python")
+		importUnit("r3", "c", "Go")
+		importUnit("r3", "c", "Python")
+		for _, repo := range []string{"r1", "r2", "r3"} {
+			if err := mrs.CreateVersion(repo, "c"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		route := func(unitTypes []string, filters ...interface{}) []string {
+			types := scopeUnitTypes([]interface{}{ByUnitTypes(unitTypes...)})
+			repos, err := mrs.reposWithUnitTypes([]string{"r1", "r2", "r3"}, types, append(filters, ByUnitTypes(unitTypes...)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(repos)
+			return repos
+		}
+		checkRoute := func(label string, got []string, want ...string) {
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("indexed=%v: %s: got repos %v, want %v", indexed, label, got, want)
+			}
+		}
+		checkRoute("Go", route([]string{"Go"}), "r1", "r3")
+		checkRoute("Python", route([]string{"Python"}), "r2", "r3")
+		checkRoute("other commit", route([]string{"Go"}, ByCommitIDs("c2")))
+
+		// Queries don't open the skipped repos' stores.
+		for _, f := range [][]DefFilter{{ByUnitTypes("Go")}, {ByUnitTypes("Go"), ByRepos("r1", "r2")}} {
+			rss, err := openRepoStores(mrs, f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var opened []string
+			for repo := range rss {
+				opened = append(opened, repo)
+			}
+			sort.Strings(opened)
+			want := []string{"r1", "r3"}
+			if len(f) == 2 {
+				want = []string{"r1"}
+			}
+			checkRoute("openRepoStores", opened, want...)
+		}
+
+		// Only defs in units of the types are returned.
+		defs, err := mrs.Defs(ByUnitTypes("Go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var repos []string
+		for _, def := range defs {
+			if def.UnitType != "Go" {
+				t.Errorf("indexed=%v: got def in unit type %q, want Go", indexed, def.UnitType)
+			}
+			repos = append(repos, def.Repo)
+		}
+		sort.Strings(repos)
+		checkRoute("Defs", repos, "r1", "r3")
+
+		// A unit imported into an existing version is added to the
+		// hints.
+		importUnit("r2", "c", "Go")
+		checkRoute("after Import", route([]string{"Go"}), "r1", "r2", "r3")
+
+		// Trees without hints (e.g., imported before hints were
+		// recorded) are never skipped.
+		rs := mrs.openRepoStore("r1").(*fsRepoStore)
+		if err := rs.fs.Remove(unitTypeHintsFilename); err != nil {
+			t.Fatal(err)
+		}
+		checkRoute("without hints", route([]string{"Python"}), "r1", "r2", "r3")
+
+		// Removing a version removes its hints.
+		if err := mrs.removeVersion("r2", "c"); err != nil {
+			t.Fatal(err)
+		}
+		hints, err := mrs.openRepoStore("r2").(*fsRepoStore).readUnitTypeHints()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hints) != 0 {
+			t.Errorf("indexed=%v: after removing version: got hints %v, want none", indexed, hints)
+		}
+	}
+}
+
+func TestByUnitTypes(t *testing.T) {
+	mrs := newMemoryMultiRepoStore()
+	for _, unitType := range []string{"Go", "Python"} {
+		u := &unit.SourceUnit{Key: unit.Key{Type: unitType, Name: "u"}}
+		data := graph.Output{
+			Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}}},
+			Refs: []*graph.Ref{{DefPath: "p", File: "f"}},
+		}
+		if err := mrs.Import("r", "c", u, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mrs.CreateVersion("r", "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	defs, err := mrs.Defs(ByUnitTypes("Python"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 1 || defs[0].UnitType != "Python" {
+		t.Errorf("got defs %v, want 1 def in a Python unit", defs)
+	}
+	refs, err := mrs.Refs(ByUnitTypes("Go", "Python"), ByUnitTypes("Go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 || refs[0].UnitType != "Go" {
+		t.Errorf("got refs %v, want 1 ref in a Go unit", refs)
+	}
+	units, err := mrs.Units(ByUnitTypes("Ruby"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(units) != 0 {
+		t.Errorf("got units %v, want none", units)
+	}
+}
@@ -0,0 +1,250 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/kr/fs"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+// RepoUsage is the amount of storage that a repo's data (including
+// indexes) uses in a store.
+type RepoUsage struct {
+	// Repo is the repo URI. It is only set by multi-repo stores.
+	Repo string `json:",omitempty"`
+
+	// Bytes is the total number of bytes used by the repo's trees.
+	Bytes int64
+
+	// Trees is the number of bytes used by each of the repo's trees
+	// (keyed on commit ID).
+	Trees map[string]int64
+}
+
+// A RepoStoreUsage accounts for the storage used by a repo's data.
+//
+// The usage is kept in an accounting file that is updated as data is
+// imported: each import adds the estimated size of the imported data
+// (see EstimateOutputSize), and the actual sizes of a tree's files are
+// recounted when the tree's version is created or its indexes are
+// built. Other writes (such as of line tables or scan results) are
+// accounted for at the next recount.
+type RepoStoreUsage interface {
+	// Usage returns the repo's storage usage. If the repo has no
+	// accounting file (e.g., because its data was imported before
+	// usage was tracked), it is created by counting the sizes of all
+	// of the repo's files.
+	Usage() (*RepoUsage, error)
+
+	// UpdateUsage recounts the actual sizes of the files in the
+	// trees of the given commits (or all trees, if none are given).
+	UpdateUsage(commitIDs ...string) error
+}
+
+// A MultiRepoStoreUsage accounts for the storage used by each repo's
+// data in a multi-repo store.
+type MultiRepoStoreUsage interface {
+	// Usage returns the storage usage of each repo that matches the
+	// filters.
+	Usage(f ...RepoFilter) ([]*RepoUsage, error)
+
+	// UpdateUsage recounts the actual sizes of the files in the
+	// repo's trees of the given commits (or all of the repo's
+	// trees, if none are given).
+	UpdateUsage(repo string, commitIDs ...string) error
+}
+
+// RepoQuotas limits the number of bytes that each repo's data may use
+// in a multi-repo store. Imports that would exceed a repo's quota
+// (based on its recorded usage and the estimated size of the imported
+// data) fail with an *ErrQuotaExceeded error before any data is
+// written. Zero-valued quotas are not enforced.
+type RepoQuotas struct {
+	// Default is the quota for repos that are not in Repos.
+	Default int64 `json:",omitempty"`
+
+	// Repos maps repo URIs to their quotas.
+	Repos map[string]int64 `json:",omitempty"`
+}
+
+// Quota returns repo's quota (or 0 if it has none).
+func (q RepoQuotas) Quota(repo string) int64 {
+	if n, present := q.Repos[repo]; present {
+		return n
+	}
+	return q.Default
+}
+
+// ErrQuotaExceeded is returned when an import would exceed a repo's
+// quota (see RepoQuotas).
+type ErrQuotaExceeded struct {
+	Repo  string
+	Usage int64 // the repo's recorded usage before the import
+	Size  int64 // the estimated size of the imported data
+	Quota int64
+}
+
+func (e *ErrQuotaExceeded) Error() string {
+	return fmt.Sprintf("import into repo %s would exceed its storage quota: %d bytes used + %d bytes imported > %d byte quota", e.Repo, e.Usage, e.Size, e.Quota)
+}
+
+// IsQuotaExceeded reports whether err is an *ErrQuotaExceeded error.
+func IsQuotaExceeded(err error) bool {
+	_, ok := err.(*ErrQuotaExceeded)
+	return ok
+}
+
+// usageFilename is the name of the file (in a repo's dir) that holds
+// the repo's usage accounting.
+const usageFilename = "__usage"
+
+func (s *fsRepoStore) Usage() (*RepoUsage, error) {
+	f, err := s.fs.Open(usageFilename)
+	if os.IsNotExist(err) {
+		if err := s.UpdateUsage(); err != nil {
+			return nil, err
+		}
+		return s.Usage()
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var u RepoUsage
+	if err := json.NewDecoder(f).Decode(&u); err != nil {
+		return nil, fmt.Errorf("reading %s: %s", usageFilename, err)
+	}
+	if u.Trees == nil {
+		u.Trees = map[string]int64{}
+	}
+	return &u, nil
+}
+
+func (s *fsRepoStore) UpdateUsage(commitIDs ...string) error {
+	var u *RepoUsage
+	if len(commitIDs) == 0 {
+		// Recount all trees, including those whose versions haven't
+		// been created yet.
+		var err error
+		commitIDs, err = s.listAllVersions_old()
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		u = &RepoUsage{Trees: map[string]int64{}}
+	} else {
+		var err error
+		u, err = s.Usage()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, commitID := range commitIDs {
+		n, err := s.treeUsage(commitID)
+		if os.IsNotExist(err) {
+			delete(u.Trees, commitID)
+			continue
+		} else if err != nil {
+			return err
+		}
+		u.Trees[commitID] = n
+	}
+	return s.writeUsage(u)
+}
+
+// treeUsage returns the total size of the files in a tree's dir.
+func (s *fsRepoStore) treeUsage(commitID string) (int64, error) {
+	if _, err := s.fs.Stat(commitID); err != nil {
+		return 0, err
+	}
+	var n int64
+	w := fs.WalkFS(commitID, rwvfs.Walkable(s.fs))
+	for w.Step() {
+		if err := w.Err(); err != nil {
+			return 0, err
+		}
+		if fi := w.Stat(); fi.Mode().IsRegular() {
+			n += fi.Size()
+		}
+	}
+	return n, nil
+}
+
+// addUsage adds n bytes to a tree's recorded usage.
+func (s *fsRepoStore) addUsage(commitID string, n int64) error {
+	u, err := s.Usage()
+	if err != nil {
+		return err
+	}
+	u.Trees[commitID] += n
+	return s.writeUsage(u)
+}
+
+func (s *fsRepoStore) writeUsage(u *RepoUsage) (err error) {
+	u.Bytes = 0
+	for _, n := range u.Trees {
+		u.Bytes += n
+	}
+	f, err := s.fs.Create(usageFilename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := f.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+	return json.NewEncoder(f).Encode(u)
+}
+
+func (s *fsMultiRepoStore) Usage(f ...RepoFilter) ([]*RepoUsage, error) {
+	repos, err := s.Repos(f...)
+	if err != nil {
+		return nil, err
+	}
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+	usages := make([]*RepoUsage, len(repos))
+	for i, repo := range repos {
+		u, err := s.openRepoStore(repo).(RepoStoreUsage).Usage()
+		if err != nil {
+			return nil, err
+		}
+		u.Repo = repo
+		usages[i] = u
+	}
+	return usages, nil
+}
+
+func (s *fsMultiRepoStore) UpdateUsage(repo string, commitIDs ...string) error {
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+	return s.openRepoStore(repo).(RepoStoreUsage).UpdateUsage(commitIDs...)
+}
+
+// reserveUsage checks that importing data (of the given estimated
+// size) into a repo would not exceed the repo's quota, and adds the
+// size to the repo's recorded usage. If the import fails, the caller
+// should call reserveUsage again with -size.
+func (s *fsMultiRepoStore) reserveUsage(repo, commitID string, size int64) error {
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+	rs := s.openRepoStore(repo).(*fsRepoStore)
+	if quota := s.Quotas.Quota(repo); quota > 0 && size > 0 {
+		u, err := rs.Usage()
+		if err != nil {
+			return err
+		}
+		if u.Bytes+size > quota {
+			return &ErrQuotaExceeded{Repo: repo, Usage: u.Bytes, Size: size, Quota: quota}
+		}
+	}
+	return rs.addUsage(commitID, size)
+}
+
+var (
+	_ RepoStoreUsage      = (*fsRepoStore)(nil)
+	_ MultiRepoStoreUsage = (*fsMultiRepoStore)(nil)
+)
@@ -0,0 +1,74 @@
+package store
+
+import (
+	"testing"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+func TestFSMultiRepoStore_Usage(t *testing.T) {
+	fs := newTestFS()
+	mrs := NewFSMultiRepoStore(fs, nil)
+	testSyncImport(t, mrs, "r1", "c1", "u1", "u2")
+	testSyncImport(t, mrs, "r2", "c2", "u")
+
+	usages, err := mrs.(MultiRepoStoreUsage).Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usages) != 2 {
+		t.Fatalf("got %d usages, want 2", len(usages))
+	}
+	for _, u := range usages {
+		if u.Bytes <= 0 || len(u.Trees) != 1 {
+			t.Errorf("%s: got usage %+v, want > 0 bytes in 1 tree", u.Repo, u)
+		}
+	}
+	r1 := usages[0]
+	if r1.Repo != "r1" || r1.Trees["c1"] != r1.Bytes {
+		t.Errorf("got r1 usage %+v, want all bytes in tree c1", r1)
+	}
+
+	// A recount matches the usage recorded at import (because the
+	// version was created and indexed, which recounts the tree).
+	if err := mrs.(MultiRepoStoreUsage).UpdateUsage("r1"); err != nil {
+		t.Fatal(err)
+	}
+	usages, err = mrs.(MultiRepoStoreUsage).Usage(ByRepos("r1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usages) != 1 || usages[0].Bytes != r1.Bytes {
+		t.Errorf("got recounted usage %+v, want %d bytes", usages, r1.Bytes)
+	}
+
+	// The accounting file isn't listed as a version.
+	versions, err := mrs.Versions(ByRepos("r1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0].CommitID != "c1" {
+		t.Errorf("got versions %v, want only c1", versions)
+	}
+
+	// Imports that would exceed a repo's quota fail.
+	mrs = NewFSMultiRepoStore(fs, &FSMultiRepoStoreConf{Quotas: RepoQuotas{Default: r1.Bytes + 1, Repos: map[string]int64{"r2": 0}}})
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u3"}}
+	data := graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}, Name: "n"}}}
+	if err := mrs.Import("r1", "c3", u, data); !IsQuotaExceeded(err) {
+		t.Errorf("got error %v, want quota exceeded", err)
+	}
+	usages, err = mrs.(MultiRepoStoreUsage).Usage(ByRepos("r1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usages[0].Bytes != r1.Bytes {
+		t.Errorf("got %d bytes after failed import, want %d", usages[0].Bytes, r1.Bytes)
+	}
+
+	// Repos with a zero quota are unlimited.
+	if err := mrs.Import("r2", "c3", u, data); err != nil {
+		t.Fatal(err)
+	}
+}
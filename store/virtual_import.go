@@ -0,0 +1,146 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// A VirtualFileImporter injects the graph data of single files into
+// the query paths of a store session (such as an OverlayTreeStore).
+// The data is held in memory only and is never written to the
+// underlying store, which makes it suitable for the output of graphing
+// a file with unsaved edits (e.g., to update hovers and jump-to-def
+// results as the user types).
+type VirtualFileImporter interface {
+	// ImportFile replaces the data of file in source unit u with
+	// data, which must contain only defs and refs in file. The unit
+	// need not have been imported (its Units entry is unaffected).
+	ImportFile(u unit.ID2, file string, data graph.Output) error
+
+	// DiscardFile removes the data that was imported into the session
+	// for file in source unit u with ImportFile.
+	DiscardFile(u unit.ID2, file string)
+}
+
+// virtualUnits holds the data imported with ImportFile.
+type virtualUnits struct {
+	units map[unit.ID2]*virtualUnit
+
+	// files is the set of files (in each unit) that have virtual
+	// data. It shadows the data in those files in other layers.
+	files map[unit.ID2]map[string]struct{}
+
+	unitStores
+}
+
+type virtualUnit struct {
+	files map[string]graph.Output
+
+	// data is the union of files' data.
+	data graph.Output
+}
+
+func newVirtualUnits() *virtualUnits {
+	vu := &virtualUnits{
+		units: map[unit.ID2]*virtualUnit{},
+		files: map[unit.ID2]map[string]struct{}{},
+	}
+	vu.unitStores = unitStores{vu}
+	return vu
+}
+
+func (s *virtualUnits) importFile(u unit.ID2, file string, data graph.Output) error {
+	if u.Type == "" || u.Name == "" || file == "" {
+		return errors.New("virtual file import: unit type, unit name, and file must be set")
+	}
+	for _, def := range data.Defs {
+		if def.File != file {
+			return fmt.Errorf("virtual file import of %s: data contains def in other file %s", file, def.File)
+		}
+	}
+	for _, ref := range data.Refs {
+		if ref.File != file {
+			return fmt.Errorf("virtual file import of %s: data contains ref in other file %s", file, ref.File)
+		}
+	}
+	cleanForImport(&data, "", u.Type, u.Name)
+
+	vu := s.units[u]
+	if vu == nil {
+		vu = &virtualUnit{files: map[string]graph.Output{}}
+		s.units[u] = vu
+		s.files[u] = map[string]struct{}{}
+	}
+	vu.files[file] = data
+	s.files[u][file] = struct{}{}
+	vu.merge()
+	return nil
+}
+
+func (s *virtualUnits) discardFile(u unit.ID2, file string) {
+	vu := s.units[u]
+	if vu == nil {
+		return
+	}
+	delete(vu.files, file)
+	delete(s.files[u], file)
+	if len(vu.files) == 0 {
+		delete(s.units, u)
+		delete(s.files, u)
+		return
+	}
+	vu.merge()
+}
+
+// merge rebuilds the unit's combined data (in file order, so that
+// results are deterministic).
+func (vu *virtualUnit) merge() {
+	files := make([]string, 0, len(vu.files))
+	for file := range vu.files {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	vu.data = graph.Output{}
+	for _, file := range files {
+		d := vu.files[file]
+		vu.data.Defs = append(vu.data.Defs, d.Defs...)
+		vu.data.Refs = append(vu.data.Refs, d.Refs...)
+	}
+}
+
+func (s *virtualUnits) openUnitStore(u unit.ID2) UnitStore {
+	if vu, present := s.units[u]; present {
+		return &memoryUnitStore{data: &vu.data}
+	}
+	return nil
+}
+
+func (s *virtualUnits) openAllUnitStores() (map[unit.ID2]UnitStore, error) {
+	uss := make(map[unit.ID2]UnitStore, len(s.units))
+	for u := range s.units {
+		uss[u] = s.openUnitStore(u)
+	}
+	return uss, nil
+}
+
+var _ unitStoreOpener = (*virtualUnits)(nil)
+
+func (s *virtualUnits) String() string { return "virtualUnits" }
+
+func (s *overlayTreeStore) ImportFile(u unit.ID2, file string, data graph.Output) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.virtual.importFile(u, file, data)
+}
+
+func (s *overlayTreeStore) DiscardFile(u unit.ID2, file string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.virtual.discardFile(u, file)
+}
+
+var _ VirtualFileImporter = (*overlayTreeStore)(nil)
@@ -0,0 +1,205 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+// NewWriteCountingFS returns a filesystem that counts the bytes
+// written to files created on fs, and the WriteAmplification that the
+// counts are recorded in. Pass the filesystem to a store constructor
+// to measure how many bytes an import writes to each index, relative
+// to the bytes of source unit data it writes.
+//
+// Bytes are counted as they are written to fs, so if the store
+// encrypts its files (see NewEncryptedFS), the encrypted sizes are
+// counted.
+func NewWriteCountingFS(fs rwvfs.FileSystem) (rwvfs.WalkableFileSystem, *WriteAmplification) {
+	c := &writeCountingFS{FileSystem: fs, w: &WriteAmplification{}}
+	return rwvfs.Walkable(c), c.w
+}
+
+type writeCountingFS struct {
+	rwvfs.FileSystem
+	w *WriteAmplification
+}
+
+func (fs *writeCountingFS) Create(name string) (io.WriteCloser, error) {
+	f, err := fs.FileSystem.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &writeCountingFile{WriteCloser: f, name: name, w: fs.w}, nil
+}
+
+func (fs *writeCountingFS) String() string { return "WriteCounting(" + fs.FileSystem.String() + ")" }
+
+func (fs *writeCountingFS) CreateParentDirs(b bool) {
+	type createParents interface {
+		CreateParentDirs(bool)
+	}
+	if cfs, ok := fs.FileSystem.(createParents); ok {
+		cfs.CreateParentDirs(b)
+	}
+}
+
+// Join implements rwvfs.WalkableFileSystem using the underlying FS's
+// Join (if any).
+func (fs *writeCountingFS) Join(elem ...string) string {
+	if wfs, ok := fs.FileSystem.(rwvfs.WalkableFileSystem); ok {
+		return wfs.Join(elem...)
+	}
+	return path.Join(elem...)
+}
+
+// writeCountingFile counts the bytes written to it, and records them
+// when it is closed (so that files that are written in many small
+// writes don't contend on the WriteAmplification's lock).
+type writeCountingFile struct {
+	io.WriteCloser
+	name string
+	n    int64
+	w    *WriteAmplification
+}
+
+func (f *writeCountingFile) Write(p []byte) (int, error) {
+	n, err := f.WriteCloser.Write(p)
+	f.n += int64(n)
+	return n, err
+}
+
+// Sync syncs the underlying file (if it can be synced), so that the
+// SyncFile write policy works on a write-counting filesystem.
+func (f *writeCountingFile) Sync() error {
+	if s, ok := f.WriteCloser.(syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+func (f *writeCountingFile) Close() error {
+	f.w.record(f.name, f.n)
+	return f.WriteCloser.Close()
+}
+
+// WriteAmplification collects the bytes written to a store's files
+// (see NewWriteCountingFS), classified as source unit data, index, or
+// other (e.g., manifests and metadata) files. It is safe for
+// concurrent use. The zero value is ready to use.
+type WriteAmplification struct {
+	mu      sync.Mutex
+	data    int64
+	indexes map[string]int64
+	other   int64
+}
+
+// WriteAmplificationSnapshot is the number of bytes written to a
+// store's files, by kind of file.
+type WriteAmplificationSnapshot struct {
+	Data    int64            // bytes written to source unit data files (defs, refs, and units)
+	Indexes map[string]int64 // bytes written to each index (keyed by index name)
+	Other   int64            // bytes written to all other files
+}
+
+// IndexBytes returns the total number of bytes written to indexes.
+func (s WriteAmplificationSnapshot) IndexBytes() int64 {
+	var n int64
+	for _, b := range s.Indexes {
+		n += b
+	}
+	return n
+}
+
+// Ratio returns the number of bytes written to indexes per byte of
+// source unit data written, or 0 if no data was written.
+func (s WriteAmplificationSnapshot) Ratio() float64 {
+	if s.Data == 0 {
+		return 0
+	}
+	return float64(s.IndexBytes()) / float64(s.Data)
+}
+
+func (w *WriteAmplification) record(name string, n int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	base := path.Base(name)
+	switch {
+	case strings.HasSuffix(base, ".idx"):
+		if w.indexes == nil {
+			w.indexes = map[string]int64{}
+		}
+		w.indexes[strings.TrimSuffix(base, ".idx")] += n
+	case base == unitRefsByDefFilename:
+		// The refs ordered by def are only written to speed up def
+		// ref queries, so they are counted as an index.
+		if w.indexes == nil {
+			w.indexes = map[string]int64{}
+		}
+		w.indexes[strings.TrimSuffix(base, ".dat")] += n
+	case base == unitDefsFilename, base == unitRefsFilename, strings.HasSuffix(base, unitFileSuffix):
+		w.data += n
+	default:
+		w.other += n
+	}
+}
+
+// Snapshot returns the number of bytes written so far.
+func (w *WriteAmplification) Snapshot() WriteAmplificationSnapshot {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	snap := WriteAmplificationSnapshot{Data: w.data, Other: w.other, Indexes: make(map[string]int64, len(w.indexes))}
+	for name, n := range w.indexes {
+		snap.Indexes[name] = n
+	}
+	return snap
+}
+
+// String returns a multi-line report of the bytes written to data and
+// to each index (largest first), with each index's size relative to
+// the data.
+func (w *WriteAmplification) String() string {
+	snap := w.Snapshot()
+	names := make([]string, 0, len(snap.Indexes))
+	for name := range snap.Indexes {
+		names = append(names, name)
+	}
+	sort.Sort(indexesBySize{names, snap.Indexes})
+	ratio := func(n int64) string {
+		if snap.Data == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.2fx", float64(n)/float64(snap.Data))
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "data: %d bytes\n", snap.Data)
+	fmt.Fprintf(&b, "indexes: %d bytes (%s data)\n", snap.IndexBytes(), ratio(snap.IndexBytes()))
+	for _, name := range names {
+		fmt.Fprintf(&b, "  %s: %d bytes (%s data)\n", name, snap.Indexes[name], ratio(snap.Indexes[name]))
+	}
+	fmt.Fprintf(&b, "other: %d bytes\n", snap.Other)
+	return b.String()
+}
+
+// indexesBySize sorts index names by their sizes (largest first), and
+// then by name.
+type indexesBySize struct {
+	names []string
+	sizes map[string]int64
+}
+
+func (v indexesBySize) Len() int      { return len(v.names) }
+func (v indexesBySize) Swap(i, j int) { v.names[i], v.names[j] = v.names[j], v.names[i] }
+func (v indexesBySize) Less(i, j int) bool {
+	if si, sj := v.sizes[v.names[i]], v.sizes[v.names[j]]; si != sj {
+		return si > sj
+	}
+	return v.names[i] < v.names[j]
+}
@@ -0,0 +1,56 @@
+package store
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWriteCountingFS(t *testing.T) {
+	fs, w := NewWriteCountingFS(newTestFS())
+	setCreateParentDirs(fs)
+	files := map[string]string{
+		"u/t.unit.json":           "12345",
+		"u/t/def.dat":             "1234567890",
+		"u/t/ref.dat":             "12345",
+		"u/t/ref_by_def.dat":      "123",
+		"u/t/def_query.idx":       "1234",
+		"u/t/file_to_refs.idx":    "12",
+		"def_query_to_defs16.idx": "123456",
+		"u/t/unit_meta.json":      "1",
+	}
+	for name, data := range files {
+		f, err := fs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(f, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snap := w.Snapshot()
+	want := WriteAmplificationSnapshot{
+		Data: 20,
+		Indexes: map[string]int64{
+			"ref_by_def":          3,
+			"def_query":           4,
+			"file_to_refs":        2,
+			"def_query_to_defs16": 6,
+		},
+		Other: 1,
+	}
+	if !reflect.DeepEqual(snap, want) {
+		t.Errorf("got %+v, want %+v", snap, want)
+	}
+	if got, want := snap.Ratio(), 0.75; got != want {
+		t.Errorf("got ratio %v, want %v", got, want)
+	}
+	if s := w.String(); !strings.Contains(s, "indexes: 15 bytes (0.75x data)\n  def_query_to_defs16: 6 bytes (0.30x data)\n  def_query: 4 bytes") {
+		t.Errorf("got report %q, want indexes listed largest first with ratios", s)
+	}
+}
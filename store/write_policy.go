@@ -0,0 +1,224 @@
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"sync"
+
+	"golang.org/x/tools/godoc/vfs"
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+// A SyncPolicy specifies when the files that an FS-backed store
+// writes are flushed to stable storage (with fsync), so that they
+// survive a power loss or OS crash. Syncing makes imports slower, so
+// the default (SyncNone) leaves it to the OS.
+//
+// Files on filesystems that don't support syncing (such as S3) are
+// never synced.
+type SyncPolicy string
+
+const (
+	// SyncNone never syncs files.
+	SyncNone SyncPolicy = ""
+
+	// SyncFile syncs each file when it is closed.
+	SyncFile SyncPolicy = "file"
+
+	// SyncImport syncs all of the files written during an import
+	// when the import's version is created (see
+	// MultiRepoImporter.CreateVersion), so that the version is never
+	// visible before its data is durable. It's faster than SyncFile
+	// on filesystems where each sync is expensive, because the
+	// writes are flushed in one batch.
+	SyncImport SyncPolicy = "import"
+)
+
+func (p SyncPolicy) validate() error {
+	switch p {
+	case SyncNone, SyncFile, SyncImport:
+		return nil
+	}
+	return fmt.Errorf("invalid sync policy %q (valid policies are %q, %q, and %q)", p, SyncNone, SyncFile, SyncImport)
+}
+
+// writePolicy reports whether conf specifies any write buffering or
+// syncing.
+func (c FSStoreConf) writePolicy() bool {
+	return c.WriteBufferSize > 0 || c.Sync != SyncNone
+}
+
+// NewWritePolicyFS returns a filesystem that buffers and syncs the
+// files written to fs according to conf's WriteBufferSize and Sync
+// fields. If conf specifies neither, fs is returned (as a
+// WalkableFileSystem).
+//
+// It must wrap the filesystem that holds the files (i.e., it must be
+// applied before NewThrottledFS and NewEncryptedFS) so that it can
+// sync them.
+func NewWritePolicyFS(fs rwvfs.FileSystem, conf FSStoreConf) (rwvfs.WalkableFileSystem, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	if !conf.writePolicy() {
+		return rwvfs.Walkable(fs), nil
+	}
+	return &writePolicyFS{FileSystem: fs, bufSize: conf.WriteBufferSize, sync: conf.Sync, unsynced: map[string]struct{}{}}, nil
+}
+
+type writePolicyFS struct {
+	rwvfs.FileSystem
+	bufSize int
+	sync    SyncPolicy
+
+	mu       sync.Mutex
+	unsynced map[string]struct{} // files written since the last syncWrites (SyncImport only)
+}
+
+// syncer is implemented by files that can be flushed to stable
+// storage (such as *os.File).
+type syncer interface {
+	Sync() error
+}
+
+func (fs *writePolicyFS) Create(name string) (io.WriteCloser, error) {
+	f, err := fs.FileSystem.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	wf := &writePolicyFile{f: f, fs: fs, name: name}
+	if fs.bufSize > 0 {
+		wf.bw = bufio.NewWriterSize(f, fs.bufSize)
+	}
+	return wf, nil
+}
+
+// syncWrites syncs the files written since the last call (if the
+// policy is SyncImport).
+func (fs *writePolicyFS) syncWrites() error {
+	fs.mu.Lock()
+	names := make([]string, 0, len(fs.unsynced))
+	for name := range fs.unsynced {
+		names = append(names, name)
+	}
+	fs.unsynced = map[string]struct{}{}
+	fs.mu.Unlock()
+
+	sort.Strings(names)
+	for i, name := range names {
+		if err := fs.syncFile(name); err != nil {
+			// Sync the remaining files next time.
+			fs.mu.Lock()
+			for _, name := range names[i:] {
+				fs.unsynced[name] = struct{}{}
+			}
+			fs.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// syncFile reopens and syncs a file that was written and closed.
+func (fs *writePolicyFS) syncFile(name string) error {
+	f, err := fs.FileSystem.Open(name)
+	if isOSOrVFSNotExist(err) {
+		return nil // removed after it was written
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	if f, ok := f.(syncer); ok {
+		return f.Sync()
+	}
+	return nil
+}
+
+func (fs *writePolicyFS) String() string {
+	return fmt.Sprintf("WritePolicy(%s, buf=%d, sync=%q)", fs.FileSystem.String(), fs.bufSize, fs.sync)
+}
+
+func (fs *writePolicyFS) CreateParentDirs(b bool) {
+	type createParents interface {
+		CreateParentDirs(bool)
+	}
+	if cfs, ok := fs.FileSystem.(createParents); ok {
+		cfs.CreateParentDirs(b)
+	}
+}
+
+// Join implements rwvfs.WalkableFileSystem using the underlying FS's
+// Join (if any).
+func (fs *writePolicyFS) Join(elem ...string) string {
+	if wfs, ok := fs.FileSystem.(rwvfs.WalkableFileSystem); ok {
+		return wfs.Join(elem...)
+	}
+	return path.Join(elem...)
+}
+
+// writePolicyFile is a file being written on a writePolicyFS.
+type writePolicyFile struct {
+	f    io.WriteCloser
+	bw   *bufio.Writer // nil if unbuffered
+	fs   *writePolicyFS
+	name string
+}
+
+func (f *writePolicyFile) Write(p []byte) (int, error) {
+	if f.bw != nil {
+		return f.bw.Write(p)
+	}
+	return f.f.Write(p)
+}
+
+func (f *writePolicyFile) Close() error {
+	var err error
+	if f.bw != nil {
+		err = f.bw.Flush()
+	}
+	if err == nil && f.fs.sync == SyncFile {
+		if s, ok := f.f.(syncer); ok {
+			err = s.Sync()
+		}
+	}
+	if err2 := f.f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil && f.fs.sync == SyncImport {
+		f.fs.mu.Lock()
+		f.fs.unsynced[f.name] = struct{}{}
+		f.fs.mu.Unlock()
+	}
+	return err
+}
+
+// A writeSyncer is a filesystem that can sync the files written to
+// it (see SyncImport).
+type writeSyncer interface {
+	syncWrites() error
+}
+
+// syncWrites syncs the files written to fs (if fs is, or wraps, a
+// write policy filesystem with the SyncImport policy).
+func syncWrites(fs vfs.FileSystem) error {
+	if fs, ok := fs.(writeSyncer); ok {
+		return fs.syncWrites()
+	}
+	return nil
+}
+
+func (fs *throttledFS) syncWrites() error     { return syncWrites(fs.fs) }
+func (fs *encryptedFS) syncWrites() error     { return syncWrites(fs.fs) }
+func (fs *readCountingFS) syncWrites() error  { return syncWrites(fs.FileSystem) }
+func (fs *writeCountingFS) syncWrites() error { return syncWrites(fs.FileSystem) }
+
+var (
+	_ writeSyncer = (*writePolicyFS)(nil)
+	_ writeSyncer = (*throttledFS)(nil)
+	_ writeSyncer = (*encryptedFS)(nil)
+	_ writeSyncer = (*readCountingFS)(nil)
+	_ writeSyncer = (*writeCountingFS)(nil)
+)
@@ -0,0 +1,144 @@
+package store
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/tools/godoc/vfs"
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/graph"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// syncCountingFS counts the writes and syncs of the files on a VFS.
+type syncCountingFS struct {
+	rwvfs.WalkableFileSystem
+	writes, syncs int64 // accessed atomically
+}
+
+func (fs *syncCountingFS) Create(name string) (io.WriteCloser, error) {
+	f, err := fs.WalkableFileSystem.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &syncCountingFile{WriteCloser: f, fs: fs}, nil
+}
+
+func (fs *syncCountingFS) Open(name string) (vfs.ReadSeekCloser, error) {
+	f, err := fs.WalkableFileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &syncCountingReader{ReadSeekCloser: f, fs: fs}, nil
+}
+
+type syncCountingFile struct {
+	io.WriteCloser
+	fs *syncCountingFS
+}
+
+func (f *syncCountingFile) Write(p []byte) (int, error) {
+	atomic.AddInt64(&f.fs.writes, 1)
+	return f.WriteCloser.Write(p)
+}
+
+func (f *syncCountingFile) Sync() error { atomic.AddInt64(&f.fs.syncs, 1); return nil }
+
+type syncCountingReader struct {
+	vfs.ReadSeekCloser
+	fs *syncCountingFS
+}
+
+func (f *syncCountingReader) Sync() error { atomic.AddInt64(&f.fs.syncs, 1); return nil }
+
+func TestWritePolicyFS(t *testing.T) {
+	writeFile := func(fs rwvfs.FileSystem, name string) {
+		f, err := fs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if _, err := f.Write([]byte("0123456789")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := map[string]struct {
+		conf                  FSStoreConf
+		wantWrites, wantSyncs int64 // after writing 2 files
+		wantImportSyncs       int64 // after syncWrites
+	}{
+		"default":  {conf: FSStoreConf{}, wantWrites: 20},
+		"buffered": {conf: FSStoreConf{WriteBufferSize: 1024}, wantWrites: 2},
+		"file":     {conf: FSStoreConf{Sync: SyncFile}, wantWrites: 20, wantSyncs: 2},
+		"import":   {conf: FSStoreConf{Sync: SyncImport}, wantWrites: 20, wantImportSyncs: 2},
+	}
+	for label, test := range tests {
+		cfs := &syncCountingFS{WalkableFileSystem: rwvfs.Walkable(rwvfs.Map(map[string]string{}))}
+		fs, err := NewWritePolicyFS(cfs, test.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeFile(fs, "a")
+		writeFile(fs, "b")
+		if cfs.writes != test.wantWrites {
+			t.Errorf("%s: got %d writes, want %d", label, cfs.writes, test.wantWrites)
+		}
+		if cfs.syncs != test.wantSyncs {
+			t.Errorf("%s: got %d syncs, want %d", label, cfs.syncs, test.wantSyncs)
+		}
+
+		// Wrapping filesystems pass syncs through.
+		if err := syncWrites(NewThrottledFS(fs, FSStoreConf{MaxConcurrentOps: 1})); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := cfs.syncs-test.wantSyncs, test.wantImportSyncs; got != want {
+			t.Errorf("%s: got %d syncs on import, want %d", label, got, want)
+		}
+		if err := syncWrites(fs); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := cfs.syncs-test.wantSyncs, test.wantImportSyncs; got != want {
+			t.Errorf("%s: got %d syncs after second sync, want %d (files were synced twice)", label, got, want)
+		}
+	}
+
+	if _, err := NewWritePolicyFS(rwvfs.Map(map[string]string{}), FSStoreConf{Sync: "always"}); err == nil {
+		t.Error("invalid sync policy: got nil error")
+	}
+	for _, conf := range []FSStoreConf{{Sync: "always"}, {WriteBufferSize: -1}, {MaxConcurrentOps: -1}} {
+		if _, err := OpenFSMultiRepoStore(newTestFS(), &FSMultiRepoStoreConf{FSStoreConf: conf}); err == nil {
+			t.Errorf("OpenFSMultiRepoStore with invalid conf %+v: got nil error", conf)
+		}
+	}
+}
+
+func TestFSMultiRepoStore_syncImport(t *testing.T) {
+	cfs := &syncCountingFS{WalkableFileSystem: newTestFS()}
+	mrs := NewFSMultiRepoStore(cfs, &FSMultiRepoStoreConf{FSStoreConf: FSStoreConf{Sync: SyncImport}})
+	testSyncImport(t, mrs, "r", "c", "u")
+	if cfs.syncs == 0 {
+		t.Error("got no syncs after import")
+	}
+
+	// The files are synced when the version is created, not before.
+	syncs := cfs.syncs
+	u := &unit.SourceUnit{Key: unit.Key{Type: "t", Name: "u"}}
+	if err := mrs.Import("r", "c2", u, graph.Output{Defs: []*graph.Def{{DefKey: graph.DefKey{Path: "p"}}}}); err != nil {
+		t.Fatal(err)
+	}
+	if cfs.syncs != syncs {
+		t.Errorf("got %d syncs before CreateVersion, want 0", cfs.syncs-syncs)
+	}
+	if err := mrs.CreateVersion("r", "c2"); err != nil {
+		t.Fatal(err)
+	}
+	if cfs.syncs == syncs {
+		t.Error("got no syncs after CreateVersion")
+	}
+}
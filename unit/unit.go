@@ -127,6 +127,8 @@ type sourceUnit struct {
 	Data         *json.RawMessage            `json:",omitempty"`
 	Config       map[string]*json.RawMessage `json:",omitempty"`
 	Ops          map[string]*srclib.ToolRef  `json:",omitempty"`
+	Owners       []string                    `json:",omitempty"`
+	Metadata     map[string]string           `json:",omitempty"`
 }
 
 var _ json.Marshaler = (*SourceUnit)(nil)
@@ -171,6 +173,8 @@ func (u *SourceUnit) MarshalJSON() ([]byte, error) {
 		Data:         data,
 		Config:       cfg,
 		Ops:          ops,
+		Owners:       u.Owners,
+		Metadata:     u.Metadata,
 	})
 }
 
@@ -221,5 +225,7 @@ func (u *SourceUnit) UnmarshalJSON(b []byte) error {
 	}
 	u.Config = cfg
 	u.Ops = ops
+	u.Owners = su.Owners
+	u.Metadata = su.Metadata
 	return nil
 }